@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// #include "machine.h"
+// double analogInput(machine_t *machine, uint32_t input);
+import "C"
+
+// This file connects the analog inputs of the nRF52 SAADC to stimuli, like
+// the channels of the sensors (see sensors.go):
+//
+//	-analog=AIN0=1.65 -analog=AIN1=sine(1.5,1,20ms)+noise(0,0.01)
+//
+// The voltage is taken at the emulated time of each conversion. Inputs that
+// aren't set are at 0V.
+
+// The stimuli of the analog inputs of a machine, by input.
+type analogInputs [8]stimulus
+
+var analogMachines machineMap[*analogInputs]
+
+// Set the voltages on analog inputs, from specs like AIN0=1.65.
+func attachAnalog(m *Machine, specs []string, rng *rand.Rand) error {
+	inputs := &analogInputs{}
+	for _, spec := range specs {
+		name, value, ok := strings.Cut(spec, "=")
+		if !ok {
+			return fmt.Errorf("expected AIN=STIMULUS, got %q", spec)
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(strings.ToUpper(name), "AIN"))
+		if err != nil || !strings.HasPrefix(strings.ToUpper(name), "AIN") || n < 0 || n >= len(inputs) {
+			return fmt.Errorf("invalid analog input %q, expected AIN0..AIN7", name)
+		}
+		stim, err := parseStimulus(value, rng)
+		if err != nil {
+			return err
+		}
+		inputs[n] = stim
+	}
+	analogMachines.set(m.machine, inputs)
+	C.machine_set_analog(m.machine, C.analog_input_t(C.analogInput))
+	return nil
+}
+
+// Return the voltage on an analog input, for the C core.
+//
+//export analogInput
+func analogInput(machine *C.machine_t, input C.uint32_t) C.double {
+	stim := analogMachines.get(machine)[input]
+	if stim == nil {
+		return 0
+	}
+	return C.double(stim.value(float64(C.machine_time_us(machine)) / 1e6))
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"unsafe"
+)
+
+// #include "machine.h"
+// void audioIO(machine_t *machine, bool input, uint64_t time, int32_t *samples, uint32_t frames, uint32_t channels, uint32_t rate, uint32_t bits);
+import "C"
+
+// This file connects the audio peripherals in the C core (I2S and PDM on the
+// nRF52) to WAV files on the host. Samples played by the firmware are
+// appended to the output file, which is kept valid after every write so it
+// can be listened to while the firmware runs. The input file is a recording
+// that starts when the machine starts: all inputs hear the sample at the
+// current time, resampled to their rate, and silence after its end.
+
+// The WAV files of a machine.
+type audioFiles struct {
+	out    *os.File
+	format [3]uint32 // channels, rate and bits of the output file
+	size   uint32    // bytes of samples written to the output file
+	warned bool      // warned about samples in another format
+
+	in         []int32 // samples of the input file, left aligned
+	inChannels int
+	inRate     uint32
+}
+
+var audioMachines machineMap[*audioFiles]
+
+// Attach WAV files to the audio peripherals. Either path may be empty.
+func attachAudio(m *Machine, out, in string) error {
+	files := &audioFiles{}
+	if in != "" {
+		if err := files.load(in); err != nil {
+			return err
+		}
+	}
+	if out != "" {
+		f, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		files.out = f
+	}
+	audioMachines.set(m.machine, files)
+	C.machine_set_audio(m.machine, C.audio_io_t(C.audioIO))
+	return nil
+}
+
+// Read a PCM WAV file of 8, 16, 24 or 32 bits per sample.
+func (a *audioFiles) load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return fmt.Errorf("%s: not a WAV file", path)
+	}
+	var bits int
+	for pos := 12; pos+8 <= len(data); {
+		id := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		body := data[pos+8:]
+		if size > len(body) {
+			size = len(body) // truncated file, like one that is still being written
+		}
+		body = body[:size]
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return fmt.Errorf("%s: invalid fmt chunk", path)
+			}
+			format := binary.LittleEndian.Uint16(body[0:])
+			if format != 1 && format != 0xfffe { // PCM, WAVE_FORMAT_EXTENSIBLE
+				return fmt.Errorf("%s: unsupported sample format %d, expected PCM", path, format)
+			}
+			a.inChannels = int(binary.LittleEndian.Uint16(body[2:]))
+			a.inRate = binary.LittleEndian.Uint32(body[4:])
+			bits = int(binary.LittleEndian.Uint16(body[14:]))
+			if bits != 8 && bits != 16 && bits != 24 && bits != 32 {
+				return fmt.Errorf("%s: unsupported sample size of %d bits", path, bits)
+			}
+			if a.inChannels == 0 || a.inRate == 0 {
+				return fmt.Errorf("%s: invalid fmt chunk", path)
+			}
+		case "data":
+			if bits == 0 {
+				return fmt.Errorf("%s: data chunk before the fmt chunk", path)
+			}
+			width := bits / 8
+			for i := 0; i+width <= len(body); i += width {
+				var sample uint32
+				for j := 0; j < width; j++ {
+					sample |= uint32(body[i+j]) << (32 - bits + j*8)
+				}
+				if bits == 8 {
+					sample ^= 0x80000000 // 8-bit samples are unsigned
+				}
+				a.in = append(a.in, int32(sample))
+			}
+		}
+		pos += 8 + size + size%2
+	}
+	if bits == 0 {
+		return fmt.Errorf("%s: no fmt chunk", path)
+	}
+	return nil
+}
+
+// Append samples to the output file, and update the sizes in the header.
+func (a *audioFiles) write(samples []int32, channels, rate, bits uint32) error {
+	format := [3]uint32{channels, rate, bits}
+	if a.format == [3]uint32{} {
+		a.format = format
+		var header [44]byte
+		copy(header[0:], "RIFF")
+		copy(header[8:], "WAVEfmt ")
+		binary.LittleEndian.PutUint32(header[16:], 16)
+		binary.LittleEndian.PutUint16(header[20:], 1) // PCM
+		binary.LittleEndian.PutUint16(header[22:], uint16(channels))
+		binary.LittleEndian.PutUint32(header[24:], rate)
+		binary.LittleEndian.PutUint32(header[28:], rate*channels*bits/8)
+		binary.LittleEndian.PutUint16(header[32:], uint16(channels*bits/8))
+		binary.LittleEndian.PutUint16(header[34:], uint16(bits))
+		copy(header[36:], "data")
+		if _, err := a.out.WriteAt(header[:], 0); err != nil {
+			return err
+		}
+	} else if format != a.format {
+		if !a.warned {
+			a.warned = true
+			fmt.Fprintf(os.Stderr, "\naudio: output format changed to %d channels, %dHz, %d bits; dropping these samples\n", channels, rate, bits)
+		}
+		return nil
+	}
+	width := int(bits / 8)
+	buf := make([]byte, 0, len(samples)*width)
+	for _, sample := range samples {
+		if bits == 8 {
+			sample ^= -0x80000000 // 8-bit samples are unsigned
+		}
+		for j := 0; j < width; j++ {
+			buf = append(buf, byte(uint32(sample)>>(32-int(bits)+j*8)))
+		}
+	}
+	if _, err := a.out.WriteAt(buf, 44+int64(a.size)); err != nil {
+		return err
+	}
+	a.size += uint32(len(buf))
+	var sizes [4]byte
+	binary.LittleEndian.PutUint32(sizes[:], 36+a.size)
+	if _, err := a.out.WriteAt(sizes[:], 4); err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(sizes[:], a.size)
+	_, err := a.out.WriteAt(sizes[:], 40)
+	return err
+}
+
+// Fill in samples from the input file, starting at the given time in samples
+// at the given rate. A single input channel is heard on all channels, and a
+// single channel hears the average of all input channels.
+func (a *audioFiles) read(samples []int32, time uint64, channels, rate uint32) {
+	if len(a.in) == 0 {
+		return
+	}
+	inFrames := uint64(len(a.in) / a.inChannels)
+	for i := 0; i < len(samples)/int(channels); i++ {
+		frame := (time + uint64(i)) * uint64(a.inRate) / uint64(rate)
+		if frame >= inFrames {
+			return
+		}
+		in := a.in[int(frame)*a.inChannels:][:a.inChannels]
+		for c := 0; c < int(channels); c++ {
+			if channels == 1 {
+				var sum int64
+				for _, sample := range in {
+					sum += int64(sample)
+				}
+				samples[i] = int32(sum / int64(len(in)))
+			} else {
+				samples[i*int(channels)+c] = in[min(c, len(in)-1)]
+			}
+		}
+	}
+}
+
+// Exchange audio samples with the WAV files, for the C core.
+//
+//export audioIO
+func audioIO(machine *C.machine_t, input C.bool, time C.uint64_t, samples *C.int32_t, frames, channels, rate, bits C.uint32_t) {
+	a := audioMachines.get(machine)
+	buf := unsafe.Slice((*int32)(unsafe.Pointer(samples)), int(frames*channels))
+	if input {
+		a.read(buf, uint64(time), uint32(channels), uint32(rate))
+		return
+	}
+	if a.out == nil {
+		return
+	}
+	if err := a.write(buf, uint32(channels), uint32(rate), uint32(bits)); err != nil {
+		fmt.Fprintln(os.Stderr, "\naudio:", err)
+		a.out = nil
+	}
+}
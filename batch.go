@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file implements "emculator batch", which runs many firmware images,
+// like a directory of test programs, and reports how each of them ended:
+//
+//	emculator batch -batch-jobs=4 -timeout=10s -batch-report=results.xml tests/
+//
+// Each image runs in its own "emculator run" process, with the flags of the
+// batch command, until it exits. It passes when it exits with status 0, for
+// example through the semihosting SYS_EXIT call. Images that don't exit are
+// stopped after -timeout (one minute by default). The report is JUnit XML or
+// JSON, with the UART output of each image. With -coverage=DIR, an lcov
+// tracefile per image is written to this directory and its totals are in the
+// report.
+
+// File extensions of the firmware images that are run from a directory.
+var batchExtensions = map[string]bool{".elf": true, ".bin": true, ".uf2": true}
+
+// The result of a single firmware image of a batch.
+type batchResult struct {
+	Name     string           `json:"name"`
+	Path     string           `json:"path"`
+	Status   int              `json:"status"`
+	Passed   bool             `json:"passed"`
+	Failure  string           `json:"failure,omitempty"`
+	Duration float64          `json:"duration"` // seconds
+	Output   string           `json:"output"`   // UART and semihosting output
+	Log      string           `json:"log"`      // messages of the emulator
+	Coverage *coverageSummary `json:"coverage,omitempty"`
+}
+
+// Run the firmware images (or the images in the directories) of a batch, with
+// these extra flags, and return the exit status: 1 if any of them failed.
+func runBatch(paths []string, flags []string, w io.Writer) int {
+	images, err := batchImages(paths)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	if len(images) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: emculator batch [flags] FIRMWARE|DIR...")
+		return 2
+	}
+	if flagBatchJobs < 1 {
+		fmt.Fprintln(os.Stderr, "error: -batch-jobs must be at least 1")
+		return 2
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	hasTimeout := false
+	for _, f := range flags {
+		hasTimeout = hasTimeout || strings.HasPrefix(f, "-timeout=")
+	}
+	if !hasTimeout {
+		flags = append(flags, "-timeout=1m")
+	}
+	if flagCoverage != "" {
+		if err := os.MkdirAll(flagCoverage, 0777); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return 1
+		}
+	}
+
+	// Give each image a unique name, for the report and the coverage file.
+	results := make([]batchResult, len(images))
+	names := make(map[string]int)
+	for i, path := range images {
+		name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		names[name]++
+		if names[name] > 1 {
+			name = fmt.Sprintf("%s-%d", name, names[name])
+		}
+		results[i] = batchResult{Name: name, Path: path}
+	}
+
+	var lock sync.Mutex // protects w and failed
+	failed := 0
+	var wg sync.WaitGroup
+	jobs := make(chan struct{}, flagBatchJobs)
+	start := time.Now()
+	for i := range results {
+		wg.Add(1)
+		jobs <- struct{}{}
+		go func(result *batchResult) {
+			defer wg.Done()
+			runBatchImage(exe, flags, result)
+			<-jobs
+			lock.Lock()
+			defer lock.Unlock()
+			if !result.Passed {
+				failed++
+				fmt.Fprintf(w, "FAIL %s (%.3fs): %s\n", result.Name, result.Duration, result.Failure)
+				printOutputTail(w, []byte(result.Output+result.Log), 20)
+				return
+			}
+			fmt.Fprintf(w, "ok   %s (%.3fs)", result.Name, result.Duration)
+			if result.Coverage != nil {
+				fmt.Fprintf(w, " %s", result.Coverage)
+			}
+			fmt.Fprintln(w)
+		}(&results[i])
+	}
+	wg.Wait()
+	fmt.Fprintf(w, "%d passed, %d failed in %s\n", len(results)-failed, failed, time.Since(start).Round(time.Millisecond))
+
+	if flagBatchReport != "" {
+		if err := writeBatchReport(flagBatchReport, results, time.Since(start)); err != nil {
+			fmt.Fprintln(os.Stderr, "error: cannot write report:", err)
+			return 1
+		}
+	}
+	if failed != 0 {
+		return 1
+	}
+	return 0
+}
+
+// Return the firmware images to run: the files that were given, and the
+// firmware images in the directories that were given, sorted by name.
+func batchImages(paths []string) ([]string, error) {
+	var images []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			images = append(images, path)
+			continue
+		}
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		var found []string
+		for _, entry := range entries {
+			if !entry.IsDir() && batchExtensions[filepath.Ext(entry.Name())] {
+				found = append(found, filepath.Join(path, entry.Name()))
+			}
+		}
+		sort.Strings(found)
+		images = append(images, found...)
+	}
+	return images, nil
+}
+
+// Run a single firmware image and fill in its result.
+func runBatchImage(exe string, flags []string, result *batchResult) {
+	args := append([]string{"run"}, flags...)
+	// Coverage needs the line table, so it is only collected for ELF files.
+	coverage := ""
+	if data, err := ioutil.ReadFile(result.Path); flagCoverage != "" && err == nil && isELF(data) {
+		coverage = filepath.Join(flagCoverage, result.Name+".info")
+		args = append(args, "-coverage="+coverage)
+	}
+	args = append(args, result.Path)
+	var stdout, stderr bytes.Buffer
+	start := time.Now()
+	status, err := runEmulator(exe, args, &stdout, &stderr)
+	result.Duration = time.Since(start).Seconds()
+	result.Status = status
+	result.Output = stdout.String()
+	result.Log = stderr.String()
+	switch {
+	case err != nil:
+		result.Failure = err.Error()
+	case status == exitTimeout:
+		result.Failure = "timed out"
+	case status == exitPanic:
+		result.Failure = "panic"
+	case status != 0:
+		result.Failure = fmt.Sprintf("exit status %d", status)
+	default:
+		result.Passed = true
+	}
+	if coverage != "" {
+		if summary, err := readCoverageSummary(coverage); err == nil {
+			result.Coverage = &summary
+		}
+	}
+}
+
+// Write the results of a batch to a file: JUnit XML if the name ends in
+// .xml, JSON otherwise.
+func writeBatchReport(path string, results []batchResult, duration time.Duration) error {
+	var data []byte
+	var err error
+	if strings.HasSuffix(path, ".xml") {
+		data, err = junitReport(results, duration)
+	} else {
+		data, err = json.MarshalIndent(results, "", "\t")
+	}
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0666)
+}
+
+// A JUnit XML test suite, in the subset that CI systems read.
+type junitTestSuite struct {
+	XMLName   xml.Name        `xml:"testsuite"`
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Time      string          `xml:"time,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name       string           `xml:"name,attr"`
+	ClassName  string           `xml:"classname,attr"`
+	Time       string           `xml:"time,attr"`
+	Properties *junitProperties `xml:"properties,omitempty"`
+	Failure    *junitFailure    `xml:"failure,omitempty"`
+	SystemOut  string           `xml:"system-out,omitempty"`
+	SystemErr  string           `xml:"system-err,omitempty"`
+}
+
+type junitProperties struct {
+	Property []junitProperty `xml:"property"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+func junitReport(results []batchResult, duration time.Duration) ([]byte, error) {
+	suite := junitTestSuite{
+		Name:  "emculator",
+		Tests: len(results),
+		Time:  fmt.Sprintf("%.3f", duration.Seconds()),
+	}
+	for _, result := range results {
+		testCase := junitTestCase{
+			Name:      result.Name,
+			ClassName: "emculator." + filepath.Base(filepath.Dir(result.Path)),
+			Time:      fmt.Sprintf("%.3f", result.Duration),
+			SystemOut: result.Output,
+			SystemErr: result.Log,
+		}
+		if !result.Passed {
+			suite.Failures++
+			testCase.Failure = &junitFailure{Message: result.Failure, Text: result.Log}
+		}
+		if result.Coverage != nil {
+			testCase.Properties = &junitProperties{[]junitProperty{{"coverage", result.Coverage.String()}}}
+		}
+		suite.TestCases = append(suite.TestCases, testCase)
+	}
+	data, err := xml.MarshalIndent(suite, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// #include "machine.h"
+import "C"
+
+// This file implements the breakpoint manager. The C core only knows at which
+// addresses to stop. The manager keeps track of the breakpoints themselves
+// and decides, when the core stops at one of them, whether the stop should be
+// reported or the machine should continue.
+//
+// Breakpoints can have a condition and actions, which are evaluated here
+// instead of in GDB so that frequently hit breakpoints stay fast:
+//
+//     uart_isr if r0 == 5 && *counter > 3 do log counter overflow; dump; continue
+
+// Maximum number of hardware breakpoints, the number of instruction address
+// comparators in the FPB of a Cortex-M4. Software breakpoints are unlimited.
+const maxHardwareBreakpoints = 6
+
+// BreakpointKind is the kind of a breakpoint. Both kinds work the same way in
+// the emulator: the core stops at the address without changing memory, so
+// software breakpoints work in flash too. Hardware breakpoints are limited
+// like those of the FPB on a real chip: in number, and to the code region
+// below 0x20000000.
+type BreakpointKind int
+
+const (
+	BreakpointSoftware BreakpointKind = iota
+	BreakpointHardware
+)
+
+func (k BreakpointKind) String() string {
+	if k == BreakpointHardware {
+		return "hw"
+	}
+	return "sw"
+}
+
+// BreakpointOwner is who set a breakpoint. Breakpoints set by GDB or the
+// CMSIS-DAP probe are removed when it disconnects.
+type BreakpointOwner int
+
+const (
+	BreakpointUser BreakpointOwner = iota // command line or monitor
+	BreakpointGDB
+	BreakpointPanic // a fatal error handler of the firmware, see panic.go
+	BreakpointExit  // a function that ends the firmware, see panic.go
+	BreakpointProbe // an FPB comparator set through -cmsis-dap, see dap.go
+)
+
+// Breakpoint is a single breakpoint.
+type Breakpoint struct {
+	ID          int
+	Address     uint32
+	Kind        BreakpointKind
+	Owner       BreakpointOwner
+	Temporary   bool // delete the breakpoint when it stops the machine
+	Disabled    bool
+	IgnoreCount int    // number of hits to ignore before stopping
+	Hits        int    // number of times the breakpoint was reached
+	Condition   string // only stop when this condition is true
+	Actions     string // run these actions when the breakpoint is hit
+
+	condition breakCondition
+	actions   []breakAction
+	trace     func() // collect a trace frame and continue, for tracepoints
+}
+
+type breakpointManager struct {
+	machine     *C.machine_t
+	describe    func(address uint32) string // describe a location for log actions
+	output      io.Writer                   // where log and dump actions write to
+	lock        sync.Mutex
+	lastID      int
+	breakpoints []*Breakpoint // sorted by ID
+}
+
+func newBreakpointManager(machine *C.machine_t, describe func(uint32) string) *breakpointManager {
+	return &breakpointManager{machine: machine, describe: describe, output: os.Stderr}
+}
+
+// Add a breakpoint and return it with its ID set.
+func (bm *breakpointManager) Add(bp Breakpoint) (Breakpoint, error) {
+	bm.lock.Lock()
+	defer bm.lock.Unlock()
+	if bp.Kind == BreakpointHardware {
+		count := 0
+		for _, other := range bm.breakpoints {
+			if other.Kind == BreakpointHardware {
+				count++
+			}
+		}
+		if count >= maxHardwareBreakpoints {
+			return bp, fmt.Errorf("at most %d hardware breakpoints can be set", maxHardwareBreakpoints)
+		}
+		if bp.Address >= 0x20000000 {
+			return bp, fmt.Errorf("hardware breakpoints can only be set below 0x20000000, not at 0x%x", bp.Address)
+		}
+	}
+	// Check whether the address is valid. The bitmap is updated to the
+	// final state below.
+	if !C.machine_set_breakpoint(bm.machine, C.uint32_t(bp.Address), true) {
+		return bp, fmt.Errorf("cannot set a breakpoint at 0x%x", bp.Address)
+	}
+	bm.lastID++
+	bp.ID = bm.lastID
+	stored := bp
+	bm.breakpoints = append(bm.breakpoints, &stored)
+	bm.update(bp.Address)
+	return bp, nil
+}
+
+// Return whether a breakpoint matching f exists.
+func (bm *breakpointManager) Exists(f func(*Breakpoint) bool) bool {
+	bm.lock.Lock()
+	defer bm.lock.Unlock()
+	for _, bp := range bm.breakpoints {
+		if f(bp) {
+			return true
+		}
+	}
+	return false
+}
+
+// Delete the breakpoint with the given ID.
+func (bm *breakpointManager) Delete(id int) error {
+	if bm.DeleteFunc(func(bp *Breakpoint) bool { return bp.ID == id }) == 0 {
+		return fmt.Errorf("no breakpoint %d", id)
+	}
+	return nil
+}
+
+// Delete all breakpoints matching f and return how many were deleted.
+func (bm *breakpointManager) DeleteFunc(f func(*Breakpoint) bool) int {
+	bm.lock.Lock()
+	defer bm.lock.Unlock()
+	var kept, deleted []*Breakpoint
+	for _, bp := range bm.breakpoints {
+		if f(bp) {
+			deleted = append(deleted, bp)
+		} else {
+			kept = append(kept, bp)
+		}
+	}
+	bm.breakpoints = kept
+	for _, bp := range deleted {
+		bm.update(bp.Address)
+	}
+	return len(deleted)
+}
+
+// Change a breakpoint with the given ID.
+func (bm *breakpointManager) Modify(id int, f func(*Breakpoint)) error {
+	bm.lock.Lock()
+	defer bm.lock.Unlock()
+	for _, bp := range bm.breakpoints {
+		if bp.ID == id {
+			f(bp)
+			bm.update(bp.Address)
+			return nil
+		}
+	}
+	return fmt.Errorf("no breakpoint %d", id)
+}
+
+// List returns a copy of all breakpoints, sorted by ID.
+func (bm *breakpointManager) List() []Breakpoint {
+	bm.lock.Lock()
+	defer bm.lock.Unlock()
+	list := make([]Breakpoint, len(bm.breakpoints))
+	for i, bp := range bm.breakpoints {
+		list[i] = *bp
+	}
+	return list
+}
+
+// Update the breakpoint bitmap of the C core for the given address: it stops
+// there if any enabled breakpoint is set at that address.
+func (bm *breakpointManager) update(address uint32) {
+	set := false
+	for _, bp := range bm.breakpoints {
+		if bp.Address == address && !bp.Disabled {
+			set = true
+		}
+	}
+	C.machine_set_breakpoint(bm.machine, C.uint32_t(address), C.bool(set))
+}
+
+// Count a hit of the breakpoints at the given address, after the machine
+// stopped there with ERR_BREAK. It returns the breakpoint that stopped the
+// machine (nil for a BKPT instruction) and whether the stop should be
+// reported. If not, the machine should simply continue.
+func (bm *breakpointManager) hit(address uint32) (*Breakpoint, bool) {
+	bm.lock.Lock()
+	defer bm.lock.Unlock()
+	var stopped *Breakpoint
+	found := false
+	for _, bp := range bm.breakpoints {
+		if bp.Address != address || bp.Disabled {
+			continue
+		}
+		found = true
+		if !bp.condition.eval(bm.machine) {
+			continue
+		}
+		bp.Hits++
+		if bp.IgnoreCount > 0 {
+			bp.IgnoreCount--
+			continue
+		}
+		if bp.trace != nil {
+			bp.trace()
+			continue
+		}
+		if !bm.runActions(bp) {
+			continue
+		}
+		if stopped == nil {
+			stopped = bp
+		}
+	}
+	if !found {
+		// Not a breakpoint set here, so it must be a BKPT instruction.
+		return nil, true
+	}
+	if stopped == nil {
+		return nil, false
+	}
+	result := *stopped
+	if stopped.Temporary {
+		bm.remove(stopped)
+	}
+	return &result, true
+}
+
+// Run the actions of a breakpoint and return whether the machine should stop.
+func (bm *breakpointManager) runActions(bp *Breakpoint) bool {
+	stop := true
+	for _, action := range bp.actions {
+		switch action.name {
+		case "log":
+			fmt.Fprintf(bm.output, "breakpoint %d at %s: %s\n", bp.ID, bm.describe(bp.Address), action.text)
+		case "dump":
+			dumpState(bm.output, bm.machine)
+		case "irq":
+			C.machine_pend_irq(bm.machine, C.uint32_t(action.irq))
+		case "continue":
+			stop = false
+		}
+	}
+	return stop
+}
+
+// Remove a single breakpoint. The lock must be held.
+func (bm *breakpointManager) remove(bp *Breakpoint) {
+	for i, other := range bm.breakpoints {
+		if other == bp {
+			bm.breakpoints = append(bm.breakpoints[:i], bm.breakpoints[i+1:]...)
+			break
+		}
+	}
+	bm.update(bp.Address)
+}
+
+// A breakpoint condition: a list of comparisons that must all be true, like
+// "r0 == 5 && *counter > 3".
+type breakCondition []breakComparison
+
+type breakComparison struct {
+	left, right breakOperand
+	op          string
+}
+
+// An operand in a condition: a register, a constant, or the 32-bit word in
+// memory at the address given by either.
+type breakOperand struct {
+	register int // -1 for a constant
+	value    uint32
+	memory   bool
+}
+
+// A breakpoint action, run when the breakpoint is hit and its condition is
+// true.
+type breakAction struct {
+	name string // log, dump, irq or continue
+	text string // message for log
+	irq  uint32
+}
+
+// Parse a breakpoint description of the form "ADDR [if COND] [do ACTIONS]",
+// where ADDR is an address or symbol, COND is a list of comparisons joined by
+// "&&" and ACTIONS is a list of actions separated by ";".
+func parseBreakpoint(spec string, symbols map[string]symbol) (Breakpoint, error) {
+	var bp Breakpoint
+	location, actions := spec, ""
+	if i := strings.Index(location, " do "); i >= 0 {
+		location, actions = location[:i], strings.TrimSpace(location[i+len(" do "):])
+	}
+	condition := ""
+	if i := strings.Index(location, " if "); i >= 0 {
+		location, condition = location[:i], strings.TrimSpace(location[i+len(" if "):])
+	}
+	address, err := resolveAddress(strings.TrimSpace(location), symbols)
+	if err != nil {
+		return bp, err
+	}
+	bp.Address = address
+	if condition != "" {
+		bp.Condition = condition
+		bp.condition, err = parseBreakCondition(condition, symbols)
+		if err != nil {
+			return bp, err
+		}
+	}
+	if actions != "" {
+		bp.Actions = actions
+		bp.actions, err = parseBreakActions(actions)
+		if err != nil {
+			return bp, err
+		}
+	}
+	return bp, nil
+}
+
+func parseBreakCondition(s string, symbols map[string]symbol) (breakCondition, error) {
+	var condition breakCondition
+	for _, part := range strings.Split(s, "&&") {
+		var comparison breakComparison
+		for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+			if i := strings.Index(part, op); i >= 0 {
+				var err error
+				comparison.op = op
+				comparison.left, err = parseBreakOperand(part[:i], symbols)
+				if err != nil {
+					return nil, err
+				}
+				comparison.right, err = parseBreakOperand(part[i+len(op):], symbols)
+				if err != nil {
+					return nil, err
+				}
+				break
+			}
+		}
+		if comparison.op == "" {
+			return nil, fmt.Errorf("no comparison in condition: %s", strings.TrimSpace(part))
+		}
+		condition = append(condition, comparison)
+	}
+	return condition, nil
+}
+
+func parseBreakOperand(s string, symbols map[string]symbol) (breakOperand, error) {
+	s = strings.TrimSpace(s)
+	operand := breakOperand{register: -1}
+	if strings.HasPrefix(s, "*") {
+		operand.memory = true
+		s = strings.TrimSpace(s[1:])
+	}
+	switch {
+	case s == "sp":
+		operand.register = 13
+	case s == "lr":
+		operand.register = 14
+	case s == "pc":
+		operand.register = 15
+	case len(s) >= 2 && s[0] == 'r' && s[1] >= '0' && s[1] <= '9':
+		n, err := strconv.Atoi(s[1:])
+		if err != nil || n > 12 {
+			return operand, fmt.Errorf("invalid register: %s", s)
+		}
+		operand.register = n
+	default:
+		if sym, ok := symbols[s]; ok {
+			operand.value = sym.Address
+		} else {
+			value, err := parseUint32(s)
+			if err != nil {
+				return operand, fmt.Errorf("unknown symbol or value: %s", s)
+			}
+			operand.value = value
+		}
+	}
+	return operand, nil
+}
+
+func parseBreakActions(s string) ([]breakAction, error) {
+	var actions []breakAction
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(part)
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		action := breakAction{name: fields[0]}
+		switch action.name {
+		case "log":
+			action.text = strings.TrimSpace(part[len("log"):])
+		case "dump", "continue":
+			if len(fields) != 1 {
+				return nil, fmt.Errorf("%s takes no arguments", action.name)
+			}
+		case "irq":
+			if len(fields) != 2 {
+				return nil, errors.New("expected irq NUMBER")
+			}
+			irq, err := parseUint32(fields[1])
+			if err != nil || irq >= C.MACHINE_NUM_IRQS {
+				return nil, fmt.Errorf("invalid IRQ: %s", fields[1])
+			}
+			action.irq = irq
+		default:
+			return nil, fmt.Errorf("unknown action %#v, expected log, dump, irq or continue", action.name)
+		}
+		actions = append(actions, action)
+	}
+	return actions, nil
+}
+
+// Evaluate the condition on the current machine state. An empty condition is
+// always true.
+func (c breakCondition) eval(machine *C.machine_t) bool {
+	for _, comparison := range c {
+		left := comparison.left.eval(machine)
+		right := comparison.right.eval(machine)
+		var result bool
+		switch comparison.op {
+		case "==":
+			result = left == right
+		case "!=":
+			result = left != right
+		case "<=":
+			result = left <= right
+		case ">=":
+			result = left >= right
+		case "<":
+			result = left < right
+		case ">":
+			result = left > right
+		}
+		if !result {
+			return false
+		}
+	}
+	return true
+}
+
+func (o breakOperand) eval(machine *C.machine_t) uint32 {
+	value := o.value
+	if o.register >= 0 {
+		value = uint32(C.machine_readreg(machine, C.size_t(o.register)))
+		if o.register == 15 {
+			value-- // remove the Thumb bit
+		}
+	}
+	if o.memory {
+		var word C.uint32_t
+		C.machine_readmem(machine, unsafe.Pointer(&word), C.size_t(value), 4)
+		value = uint32(word)
+	}
+	return value
+}
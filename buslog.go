@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// #include "machine.h"
+import "C"
+
+// This file implements -buslog, which decodes the traffic on the I2C and SPI
+// buses and the UART into transactions, one per line:
+//
+//	0.012345 I2C write 0x3c: [0x00, 0xaf]
+//	0.012400 I2C read 0x76: [0x60]
+//	0.013000 I2C write 0x50: NACK
+//	0.014210 SPI flash: write [0x9f, 0x00, 0x00, 0x00] read [0xff, 0xef, 0x40, 0x18]
+//	0.020000 UART TX: "hello\r\n"
+//
+// The time is the emulated time in seconds. Each I2C transaction lasts from a
+// (repeated) start to the next start or the stop condition. An SPI
+// transaction lasts while the chip select pin is low, so SPI devices are
+// logged by their chip select pin. UART characters are collected up to a
+// newline, and UARTs other than UART0 are named like "UART1". Filters select
+// what is logged, see attachBusLog.
+
+// Maximum number of UART characters on a line of the log.
+const busLogUARTLine = 64
+
+// The decoder of the bus traffic of a machine.
+type busLog struct {
+	w    io.Writer
+	file *os.File      // nil when writing to stderr
+	buf  *bufio.Writer // buffers the writes to file
+
+	i2c      bool
+	i2cAddrs map[uint8]bool // addresses to log, all if empty
+	spi      map[int]string // names of the logged SPI devices, by device index
+	uart     bool
+
+	// The current I2C transaction.
+	i2cActive bool
+	i2cStart  uint64 // time in microseconds
+	i2cAddr   uint8  // address << 1 | read
+	i2cData   []byte
+	i2cNack   bool // the address or the last byte wasn't acknowledged
+
+	// The current SPI transaction of each logged device.
+	spiStart map[int]uint64
+	spiOut   map[int][]byte
+	spiIn    map[int][]byte
+
+	// UART characters that weren't logged yet, of each UART in each
+	// direction.
+	uartStart [C.MACHINE_NUM_UARTS][2]uint64
+	uartData  [C.MACHINE_NUM_UARTS][2][]byte
+}
+
+var busLogs machineMap[*busLog]
+
+// Log the bus traffic that matches the filters to path, or to stderr if path
+// is empty. A filter is one of:
+//
+//	i2c             all I2C transactions
+//	i2c:0x3c        I2C transactions with the device at this address
+//	spi:P0.10       SPI transactions while this chip select pin is low
+//	spi:flash=P0.10 the same, with a name for the device
+//	uart            characters sent and received by the UART
+//
+// This must be called after the SPI devices of the sensors were added, as
+// the devices of the log come after them.
+func attachBusLog(m *Machine, filters []string, path string) error {
+	l := &busLog{
+		spi:      map[int]string{},
+		i2cAddrs: map[uint8]bool{},
+		spiStart: map[int]uint64{},
+		spiOut:   map[int][]byte{},
+		spiIn:    map[int][]byte{},
+	}
+	for _, filter := range filters {
+		if err := l.parseFilter(m.machine, filter); err != nil {
+			return err
+		}
+	}
+	l.w = os.Stderr
+	if path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		l.file = f
+		l.buf = bufio.NewWriter(f)
+		l.w = l.buf
+	}
+	ok := attachTraceRing(m.machine, func(event *C.trace_event_t) {
+		if event._type == C.TRACE_BUS {
+			value := uint32(event.value)
+			l.trace(C.bus_op_t(value&0xff), uint32(event.address), uint8(value>>8), uint8(value>>16), value>>24 != 0, uint64(event.data))
+		}
+	}, nil)
+	if !ok {
+		return errors.New("cannot allocate the trace ring for the bus log")
+	}
+	busLogs.set(m.machine, l)
+	C.machine_set_bus_trace(m.machine, C.bus_trace_t(C.machine_trace_ring_bus))
+	return nil
+}
+
+// Add a filter, see attachBusLog.
+func (l *busLog) parseFilter(machine *C.machine_t, filter string) error {
+	kind, arg, _ := strings.Cut(filter, ":")
+	switch {
+	case kind == "i2c" && arg == "":
+		l.i2c = true
+	case kind == "i2c":
+		address, err := parseUint32(arg)
+		if err != nil || address >= 0x80 {
+			return fmt.Errorf("invalid I2C address %q", arg)
+		}
+		l.i2c = true
+		l.i2cAddrs[uint8(address)] = true
+	case kind == "spi" && arg != "":
+		name, pinName := arg, arg
+		if i := strings.IndexByte(arg, '='); i >= 0 {
+			name, pinName = arg[:i], arg[i+1:]
+		}
+		pin, err := parseGPIOPin(pinName)
+		if err != nil {
+			return err
+		}
+		if pin < 0 || name == "" {
+			return fmt.Errorf("invalid SPI device %q, expected a chip select pin like P0.10 or a name and pin like flash=P0.10", arg)
+		}
+		index := C.machine_add_spi_device(machine, C.int32_t(pin))
+		if index < 0 {
+			return errors.New("too many SPI devices")
+		}
+		l.spi[int(index)] = name
+	case kind == "uart" && arg == "":
+		l.uart = true
+	default:
+		return fmt.Errorf("unknown filter %q, expected i2c, i2c:ADDRESS, spi:PIN or uart", filter)
+	}
+	return nil
+}
+
+// Log the I2C transaction that is in progress, if any.
+func (l *busLog) endI2C() {
+	if !l.i2cActive {
+		return
+	}
+	l.i2cActive = false
+	address := l.i2cAddr >> 1
+	if len(l.i2cAddrs) != 0 && !l.i2cAddrs[address] {
+		return
+	}
+	direction := "write"
+	if l.i2cAddr&1 != 0 {
+		direction = "read"
+	}
+	l.printf(l.i2cStart, "I2C %s 0x%02x: ", direction, address)
+	if len(l.i2cData) == 0 && l.i2cNack {
+		fmt.Fprintln(l.w, "NACK")
+		return
+	}
+	fmt.Fprint(l.w, busLogBytes(l.i2cData))
+	if l.i2cNack {
+		fmt.Fprint(l.w, " (NACK)")
+	}
+	fmt.Fprintln(l.w)
+}
+
+// Log the SPI transaction of a device.
+func (l *busLog) endSPI(device int) {
+	if len(l.spiOut[device]) == 0 {
+		l.spiOut[device] = nil
+		return
+	}
+	l.printf(l.spiStart[device], "SPI %s: write %s read %s\n", l.spi[device], busLogBytes(l.spiOut[device]), busLogBytes(l.spiIn[device]))
+	l.spiOut[device] = nil
+	l.spiIn[device] = nil
+}
+
+// Log the UART characters that were collected in a direction: 0 for sent, 1
+// for received.
+func (l *busLog) endUART(uart, direction int) {
+	if len(l.uartData[uart][direction]) == 0 {
+		return
+	}
+	name := "UART"
+	if uart != 0 {
+		name += strconv.Itoa(uart)
+	}
+	l.printf(l.uartStart[uart][direction], "%s %s: %s\n", name, [2]string{"TX", "RX"}[direction], strconv.Quote(string(l.uartData[uart][direction])))
+	l.uartData[uart][direction] = l.uartData[uart][direction][:0]
+}
+
+// Log the transactions that are in progress, and write out the log.
+func (l *busLog) flush() {
+	l.endI2C()
+	for device := range l.spi {
+		l.endSPI(device)
+	}
+	for uart := range l.uartData {
+		l.endUART(uart, 0)
+		l.endUART(uart, 1)
+	}
+	if l.buf != nil {
+		if err := l.buf.Flush(); err != nil {
+			fmt.Fprintln(os.Stderr, "error: cannot write bus log:", err)
+		}
+	}
+}
+
+// Start a line of the log with the given time in microseconds.
+func (l *busLog) printf(us uint64, format string, args ...any) {
+	fmt.Fprintf(l.w, "%d.%06d ", us/1000000, us%1000000)
+	fmt.Fprintf(l.w, format, args...)
+}
+
+// Format bytes like [0x00, 0xaf].
+func busLogBytes(data []byte) string {
+	var s strings.Builder
+	s.WriteByte('[')
+	for i, c := range data {
+		if i != 0 {
+			s.WriteString(", ")
+		}
+		fmt.Fprintf(&s, "0x%02x", c)
+	}
+	s.WriteByte(']')
+	return s.String()
+}
+
+// Decode a bus operation from the trace ring, which happened at the given time
+// in microseconds.
+func (l *busLog) trace(op C.bus_op_t, device uint32, out, in uint8, ack bool, now uint64) {
+	switch op {
+	case C.BUS_I2C_START:
+		if !l.i2c {
+			return
+		}
+		l.endI2C()
+		l.i2cActive = true
+		l.i2cStart = now
+		l.i2cAddr = out
+		l.i2cData = l.i2cData[:0]
+		l.i2cNack = !ack
+		if l.i2cNack {
+			// Nothing follows when no device answers.
+			l.endI2C()
+		}
+	case C.BUS_I2C_WRITE:
+		if l.i2cActive {
+			l.i2cData = append(l.i2cData, out)
+			l.i2cNack = !ack
+		}
+	case C.BUS_I2C_READ:
+		if l.i2cActive {
+			l.i2cData = append(l.i2cData, in)
+		}
+	case C.BUS_I2C_STOP:
+		l.endI2C()
+	case C.BUS_SPI_SELECT:
+		if _, ok := l.spi[int(device)]; ok {
+			l.spiStart[int(device)] = now
+			l.spiOut[int(device)] = []byte{}
+			l.spiIn[int(device)] = []byte{}
+		}
+	case C.BUS_SPI_TRANSFER:
+		for index := range l.spi {
+			if device&(1<<index) != 0 && l.spiOut[index] != nil {
+				l.spiOut[index] = append(l.spiOut[index], out)
+				l.spiIn[index] = append(l.spiIn[index], in)
+			}
+		}
+	case C.BUS_SPI_DESELECT:
+		if _, ok := l.spi[int(device)]; ok {
+			l.endSPI(int(device))
+		}
+	case C.BUS_UART_SEND, C.BUS_UART_RECEIVE:
+		if !l.uart {
+			return
+		}
+		uart, direction, c := int(device), 0, out
+		if op == C.BUS_UART_RECEIVE {
+			direction, c = 1, in
+		}
+		if len(l.uartData[uart][direction]) == 0 {
+			l.uartStart[uart][direction] = now
+		}
+		l.uartData[uart][direction] = append(l.uartData[uart][direction], c)
+		if c == '\n' || len(l.uartData[uart][direction]) >= busLogUARTLine {
+			l.endUART(uart, direction)
+		}
+	}
+}
+
+// Write out the bus log of a machine, if it has one, and close it. This is
+// called when the firmware stops for good.
+func saveBusLog(machine *C.machine_t) {
+	l := busLogs.get(machine)
+	if l == nil {
+		return
+	}
+	C.machine_set_bus_trace(machine, nil)
+	drainTraceRing(machine)
+	busLogs.delete(machine)
+	l.flush()
+	if l.file != nil {
+		l.file.Close()
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// #include "machine.h"
+// void canSend(machine_t *machine, can_frame_t *frame);
+import "C"
+
+// This file implements a virtual CAN bus between the CAN controller of the
+// emulated chip and endpoints on the host, given with -can (repeatable):
+//
+//	log               print frames in the candump log format on stderr
+//	log:PATH          write them to a file, which canplayer can replay
+//	socketcan:IFACE   bridge to a Linux SocketCAN interface, like vcan0
+//
+// A frame from one endpoint reaches the firmware and all other endpoints.
+// Frames can also be sent from the "can" monitor command and with
+// Emculator.CAN on the control socket, in the syntax of cansend:
+// 123#DEADBEEF (standard), 1F334455#11 (extended) or 123#R (remote).
+
+// A classic CAN frame.
+type canFrame struct {
+	id       uint32
+	extended bool
+	remote   bool
+	dlc      uint8
+	data     [8]byte
+}
+
+// An endpoint on the CAN bus. The name of the endpoint a frame comes from is
+// passed along, for logging.
+type canEndpoint interface {
+	send(frame canFrame, from string) error
+}
+
+// The CAN bus of a machine.
+type canBus struct {
+	m         *Machine
+	endpoints []canEndpoint
+}
+
+var canBuses machineMap[*canBus]
+
+// Attach the CAN endpoints to a machine.
+func attachCAN(m *Machine, specs []string) error {
+	bus := &canBus{m: m}
+	for _, spec := range specs {
+		switch {
+		case spec == "log":
+			bus.endpoints = append(bus.endpoints, &canLog{m.machine, os.Stderr})
+		case strings.HasPrefix(spec, "log:"):
+			f, err := os.Create(spec[len("log:"):])
+			if err != nil {
+				return err
+			}
+			bus.endpoints = append(bus.endpoints, &canLog{m.machine, f})
+		case strings.HasPrefix(spec, "socketcan:"):
+			name := spec[len("socketcan:"):]
+			var endpoint canEndpoint
+			endpoint, err := openSocketCAN(name, func(frame canFrame) {
+				// Frames arrive on another goroutine.
+				getPeripheralBus(m).Do(func() {
+					bus.receive(frame, name, endpoint)
+				})
+			})
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			bus.endpoints = append(bus.endpoints, endpoint)
+		default:
+			return fmt.Errorf("unknown CAN endpoint %#v, expected log, log:PATH or socketcan:IFACE", spec)
+		}
+	}
+	canBuses.set(m.machine, bus)
+	C.machine_set_can(m.machine, C.can_send_t(C.canSend))
+	return nil
+}
+
+// Parse a frame in the syntax of cansend.
+func parseCANFrame(s string) (canFrame, error) {
+	var frame canFrame
+	id, data, ok := strings.Cut(s, "#")
+	if !ok || (len(id) != 3 && len(id) != 8) {
+		return frame, fmt.Errorf("invalid CAN frame %#v, expected something like 123#DEADBEEF", s)
+	}
+	n, err := strconv.ParseUint(id, 16, 32)
+	if err != nil || (len(id) == 3 && n > 0x7ff) || n > 0x1fffffff {
+		return frame, fmt.Errorf("invalid CAN identifier %#v", id)
+	}
+	frame.id, frame.extended = uint32(n), len(id) == 8
+	if strings.HasPrefix(data, "R") {
+		frame.remote = true
+		if data != "R" {
+			dlc, err := strconv.ParseUint(data[1:], 10, 8)
+			if err != nil || dlc > 8 {
+				return frame, fmt.Errorf("invalid length of remote frame %#v", data)
+			}
+			frame.dlc = uint8(dlc)
+		}
+		return frame, nil
+	}
+	bytes, err := hex.DecodeString(strings.ReplaceAll(data, ".", ""))
+	if err != nil || len(bytes) > 8 {
+		return frame, fmt.Errorf("invalid CAN data %#v, expected up to 8 bytes in hexadecimal", data)
+	}
+	frame.dlc = uint8(copy(frame.data[:], bytes))
+	return frame, nil
+}
+
+// Format a frame in the syntax of cansend.
+func (frame canFrame) String() string {
+	id := fmt.Sprintf("%03X", frame.id)
+	if frame.extended {
+		id = fmt.Sprintf("%08X", frame.id)
+	}
+	if frame.remote {
+		if frame.dlc == 0 {
+			return id + "#R"
+		}
+		return fmt.Sprintf("%s#R%d", id, frame.dlc)
+	}
+	return id + "#" + strings.ToUpper(hex.EncodeToString(frame.data[:min(frame.dlc, 8)]))
+}
+
+// Deliver a frame from an endpoint to the firmware and the other endpoints.
+// It must be called while the machine isn't running, or from a function
+// passed to the Do method of the peripheral bus. It returns whether the
+// firmware accepted the frame.
+func (b *canBus) receive(frame canFrame, from string, source canEndpoint) bool {
+	cframe := C.can_frame_t{
+		id:       C.uint32_t(frame.id),
+		extended: C.bool(frame.extended),
+		remote:   C.bool(frame.remote),
+		dlc:      C.uint8_t(frame.dlc),
+	}
+	for i, c := range frame.data {
+		cframe.data[i] = C.uint8_t(c)
+	}
+	accepted := bool(C.machine_can_receive(b.m.machine, &cframe))
+	b.send(frame, from, source)
+	return accepted
+}
+
+// Send a frame to all endpoints except its source.
+func (b *canBus) send(frame canFrame, from string, source canEndpoint) {
+	for _, endpoint := range b.endpoints {
+		if endpoint == source {
+			continue
+		}
+		if err := endpoint.send(frame, from); err != nil {
+			fmt.Fprintln(os.Stderr, "\ncan:", err)
+		}
+	}
+}
+
+// Send a frame given in the syntax of cansend, for the monitor and the control
+// socket. The machine must not be running.
+func (m *Machine) canSend(s string) (bool, error) {
+	bus := canBuses.get(m.machine)
+	if bus == nil {
+		return false, errors.New("no CAN bus, see -can")
+	}
+	frame, err := parseCANFrame(s)
+	if err != nil {
+		return false, err
+	}
+	return bus.receive(frame, "host", nil), nil
+}
+
+// A log of the frames on the bus, in the format of candump -L with the time
+// of the machine.
+type canLog struct {
+	machine *C.machine_t
+	w       io.Writer
+}
+
+func (l *canLog) send(frame canFrame, from string) error {
+	us := uint64(C.machine_time_us(l.machine))
+	_, err := fmt.Fprintf(l.w, "(%d.%06d) %s %s\n", us/1000000, us%1000000, from, frame)
+	return err
+}
+
+// Send a frame of the firmware to the endpoints, for the C core.
+//
+//export canSend
+func canSend(machine *C.machine_t, cframe *C.can_frame_t) {
+	frame := canFrame{
+		id:       uint32(cframe.id),
+		extended: bool(cframe.extended),
+		remote:   bool(cframe.remote),
+		dlc:      uint8(cframe.dlc),
+	}
+	copy(frame.data[:], C.GoBytes(unsafe.Pointer(&cframe.data[0]), 8))
+	canBuses.get(machine).send(frame, "emu", nil)
+}
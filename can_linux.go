@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// SocketCAN definitions from linux/can.h.
+const (
+	canRaw     = 1
+	canEFFFlag = 0x80000000 // extended frame
+	canRTRFlag = 0x40000000 // remote frame
+	canERRFlag = 0x20000000 // error frame
+)
+
+// A raw SocketCAN socket bound to an interface.
+type socketCAN struct {
+	f *os.File
+}
+
+// Open a raw socket on the given SocketCAN interface, and call receive with
+// each frame that arrives on it from another goroutine.
+func openSocketCAN(name string, receive func(canFrame)) (canEndpoint, error) {
+	fd, err := syscall.Socket(syscall.AF_CAN, syscall.SOCK_RAW, canRaw)
+	if err != nil {
+		return nil, err
+	}
+	var ifreq struct {
+		name  [syscall.IFNAMSIZ]byte
+		index int32
+		_     [20]byte
+	}
+	copy(ifreq.name[:syscall.IFNAMSIZ-1], name)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCGIFINDEX, uintptr(unsafe.Pointer(&ifreq))); errno != 0 {
+		syscall.Close(fd)
+		return nil, errno
+	}
+	// struct sockaddr_can
+	var addr struct {
+		family  uint16
+		_       uint16
+		ifindex int32
+		_       [16]byte
+	}
+	addr.family = syscall.AF_CAN
+	addr.ifindex = ifreq.index
+	if _, _, errno := syscall.Syscall(syscall.SYS_BIND, uintptr(fd), uintptr(unsafe.Pointer(&addr)), unsafe.Sizeof(addr)); errno != 0 {
+		syscall.Close(fd)
+		return nil, errno
+	}
+	syscall.SetNonblock(fd, true)
+	s := &socketCAN{os.NewFile(uintptr(fd), "can:"+name)}
+	go s.run(receive)
+	return s, nil
+}
+
+// Read frames from the socket, ignoring error frames.
+func (s *socketCAN) run(receive func(canFrame)) {
+	var buf [16]byte // struct can_frame
+	for {
+		if _, err := s.f.Read(buf[:]); err != nil {
+			return
+		}
+		id := binary.LittleEndian.Uint32(buf[0:])
+		if id&canERRFlag != 0 {
+			continue
+		}
+		frame := canFrame{
+			extended: id&canEFFFlag != 0,
+			remote:   id&canRTRFlag != 0,
+			dlc:      min(buf[4], 8),
+		}
+		frame.id = id & 0x7ff
+		if frame.extended {
+			frame.id = id & 0x1fffffff
+		}
+		copy(frame.data[:], buf[8:])
+		receive(frame)
+	}
+}
+
+func (s *socketCAN) send(frame canFrame, from string) error {
+	var buf [16]byte
+	id := frame.id
+	if frame.extended {
+		id |= canEFFFlag
+	}
+	if frame.remote {
+		id |= canRTRFlag
+	}
+	binary.LittleEndian.PutUint32(buf[0:], id)
+	buf[4] = min(frame.dlc, 8)
+	copy(buf[8:], frame.data[:])
+	_, err := s.f.Write(buf[:])
+	return err
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+// SocketCAN only exists on Linux.
+func openSocketCAN(name string, receive func(canFrame)) (canEndpoint, error) {
+	return nil, errors.New("SocketCAN is only supported on Linux")
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"unsafe"
+)
+
+// #include "machine.h"
+import "C"
+
+// This file implements -checkpoint-interval and -restore. While the firmware
+// runs, the complete machine state is saved every so many instructions into a
+// ring of files. When the firmware crashes after running for hours, the last
+// checkpoint before the crash can be restored to replay only the final stretch,
+// with tracing or a debugger. The C core saves the machine with all of its
+// memory; state that is kept in Go, like open semihosting files and the
+// peripherals of -peripheral, is not saved.
+
+// The first line of a checkpoint file, after which follows the snapshot of the
+// C core. The file is compressed with gzip.
+const checkpointMagic = "emculator checkpoint 1\n"
+
+// Saves checkpoints every interval instructions.
+type checkpointer struct {
+	dir      string
+	interval uint64
+	keep     int      // number of checkpoints to keep
+	files    []string // saved checkpoints, oldest first
+}
+
+func newCheckpointer(dir string, interval uint64, keep int) (*checkpointer, error) {
+	if keep < 1 {
+		return nil, errors.New("at least one checkpoint must be kept")
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	return &checkpointer{dir: dir, interval: interval, keep: keep}, nil
+}
+
+// Return the instruction limit for the next run of the machine: the next
+// checkpoint, or limit (if nonzero) when that comes first.
+func (c *checkpointer) limit(machine *C.machine_t, limit uint64) uint64 {
+	next := (uint64(machine.stats.instructions)/c.interval + 1) * c.interval
+	if limit != 0 && limit < next {
+		return limit
+	}
+	return next
+}
+
+// Whether the machine stopped at the instruction limit for a checkpoint,
+// instead of for the -max-instructions limit.
+func (c *checkpointer) due(machine *C.machine_t, limit uint64) bool {
+	count := uint64(machine.stats.instructions)
+	return count%c.interval == 0 && (limit == 0 || count < limit)
+}
+
+// Save a checkpoint, and remove the oldest one if there are too many.
+func (c *checkpointer) save(machine *C.machine_t) error {
+	path := filepath.Join(c.dir, fmt.Sprintf("checkpoint-%d.emck", uint64(machine.stats.instructions)))
+	if err := saveCheckpoint(machine, path); err != nil {
+		return err
+	}
+	c.files = append(c.files, path)
+	if len(c.files) > c.keep {
+		os.Remove(c.files[0])
+		c.files = c.files[1:]
+	}
+	return nil
+}
+
+// Return the last saved checkpoint, or "" if there is none.
+func (c *checkpointer) last() string {
+	if len(c.files) == 0 {
+		return ""
+	}
+	return c.files[len(c.files)-1]
+}
+
+// Write the state of the machine to a checkpoint file. The file is replaced at
+// once, so that a crash while writing it never leaves a broken checkpoint.
+func saveCheckpoint(machine *C.machine_t, path string) error {
+	snapshot := make([]byte, C.machine_snapshot_size(machine))
+	C.machine_save_snapshot(machine, (*C.uint8_t)(unsafe.SliceData(snapshot)))
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	zw, _ := gzip.NewWriterLevel(w, gzip.BestSpeed)
+	io.WriteString(zw, checkpointMagic)
+	zw.Write(snapshot)
+	if err := zw.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Restore the machine state from a checkpoint file. The machine must run the
+// same firmware with the same memory layout as when it was saved.
+func restoreCheckpoint(machine *C.machine_t, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return fmt.Errorf("%s is not a checkpoint", path)
+	}
+	magic := make([]byte, len(checkpointMagic))
+	if _, err := io.ReadFull(zr, magic); err != nil || string(magic) != checkpointMagic {
+		return fmt.Errorf("%s is not a checkpoint", path)
+	}
+	snapshot, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return fmt.Errorf("cannot read %s: %v", path, err)
+	}
+	switch C.machine_restore_snapshot(machine, (*C.uint8_t)(unsafe.SliceData(snapshot)), C.size_t(len(snapshot))) {
+	case C.SNAPSHOT_INVALID:
+		return fmt.Errorf("%s was saved by another version of the emulator", path)
+	case C.SNAPSHOT_MISMATCH:
+		return fmt.Errorf("%s was saved with another memory layout", path)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// #include "machine.h"
+import "C"
+
+// This file implements the subcommands that select a mode of the emulator:
+//
+//	emculator run fw.elf            run the firmware until it exits or crashes
+//	emculator debug fw.elf          start the firmware only when GDB continues it
+//	emculator test scenario.yaml    run test scenarios and check their output
+//	emculator batch tests/          run many firmware images and report the results
+//	emculator trace fw.elf          run while logging calls and peripheral accesses
+//	emculator inspect fw.elf        print what is in the firmware image
+//
+// Without a subcommand the firmware runs with a GDB server, like it always
+// did. A mode only changes the defaults of flags: flags given on the command
+// line or in the configuration file override them.
+
+// A mode of the emulator, selected with the first argument.
+type command struct {
+	usage    string
+	help     string
+	defaults map[string]string // flag name -> default value in this mode
+}
+
+var commands = map[string]command{
+	"run":     {"run [flags] FIRMWARE", "run the firmware until it exits or crashes, without a GDB server", map[string]string{"gdb": ""}},
+	"debug":   {"debug [flags] FIRMWARE", "serve GDB and keep the firmware halted at the reset vector until GDB continues it", map[string]string{"wait-for-debugger": "true"}},
+	"test":    {"test [flags] SCENARIO...", "run the test scenarios in these files and report which failed", nil},
+	"batch":   {"batch [flags] FIRMWARE|DIR...", "run many firmware images, each until it exits, and report which failed", nil},
+	"trace":   {"trace [flags] FIRMWARE", "run the firmware and log all calls and peripheral register accesses", map[string]string{"gdb": "", "loglevel": "calls", "periphtrace": "true"}},
+	"inspect": {"inspect [flags] FIRMWARE", "print the vector table, flash usage and debug information of the firmware, without running it", nil},
+	"flash":   {"flash COMMAND [flags] ARGS...", "work on flash images, see \"emculator flash\"", nil},
+}
+
+// Print the usage of the emulator, with its subcommands and flags.
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "usage: emculator [COMMAND] [flags] FIRMWARE")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-30s %s\n", commands[name].usage, commands[name].help)
+	}
+	fmt.Fprintln(os.Stderr, "flags:")
+	flag.PrintDefaults()
+}
+
+// Set the flag defaults of a mode, for the flags that were not set on the
+// command line or in the configuration file.
+func setCommandDefaults(name string) error {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	for key, value := range commands[name].defaults {
+		if set[key] {
+			continue
+		}
+		if err := flag.Set(key, value); err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// Return the flags that were set on the command line as -name=value
+// arguments, except for the given flags.
+func commandLineFlags(skip ...string) []string {
+	var flags []string
+	flag.Visit(func(f *flag.Flag) {
+		for _, name := range skip {
+			if f.Name == name {
+				return
+			}
+		}
+		if list, ok := f.Value.(*stringList); ok {
+			for _, value := range *list {
+				flags = append(flags, "-"+f.Name+"="+value)
+			}
+			return
+		}
+		flags = append(flags, "-"+f.Name+"="+f.Value.String())
+	})
+	return flags
+}
+
+// Print what "emculator inspect" shows about a firmware image: its size, the
+// vector table and the debug information it has.
+func inspectFirmware(w io.Writer, path string, firmware []byte, debug *debugInfo, flashBase uint32, flashSize int) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	format := "raw binary"
+	if isELF(data) {
+		format = "ELF"
+	} else if isUF2(data) {
+		format = "UF2"
+	}
+	fmt.Fprintf(w, "firmware:   %s (%s)\n", path, format)
+	fmt.Fprintf(w, "flash:      %d bytes at 0x%08x, %.1f%% of %d kB\n", len(firmware), flashBase, float64(len(firmware))*100/float64(flashSize), flashSize/1024)
+	if len(firmware) < 8 {
+		return fmt.Errorf("image is too small for a vector table")
+	}
+	fmt.Fprintf(w, "initial SP: 0x%08x\n", binary.LittleEndian.Uint32(firmware[0:]))
+	fmt.Fprintf(w, "reset:      %s\n", debug.describe(binary.LittleEndian.Uint32(firmware[4:])&^1))
+
+	// List the vectors that have a handler of their own. Handlers that are
+	// used for many vectors, like Default_Handler, are listed once. The vector
+	// table ends at the first entry that is not a Thumb address in the image.
+	numVectors := 16 + C.MACHINE_NUM_IRQS
+	if len(firmware)/4 < numVectors {
+		numVectors = len(firmware) / 4
+	}
+	uses := make(map[uint32]int)
+	for i := 2; i < numVectors; i++ {
+		handler := binary.LittleEndian.Uint32(firmware[i*4:])
+		if handler != 0 && (handler&1 == 0 || handler&^1 < flashBase || int(handler-flashBase) >= len(firmware)) {
+			numVectors = i
+			break
+		}
+		uses[handler]++
+	}
+	fmt.Fprintln(w, "vectors:")
+	shared := make(map[uint32]bool)
+	for i := 2; i < numVectors; i++ {
+		handler := binary.LittleEndian.Uint32(firmware[i*4:])
+		if handler == 0 || (i >= 7 && i <= 10) || i == 13 {
+			continue // unused, or reserved on Cortex-M
+		}
+		if uses[handler] > 2 {
+			if !shared[handler] {
+				fmt.Fprintf(w, "  %-10s %s\n", fmt.Sprintf("%d others", uses[handler]), debug.describe(handler&^1))
+				shared[handler] = true
+			}
+			continue
+		}
+		fmt.Fprintf(w, "  %-10s %s\n", exceptionName(i), debug.describe(handler&^1))
+	}
+
+	if debug == nil {
+		fmt.Fprintln(w, "debug info: none")
+		return nil
+	}
+	files := make(map[string]bool)
+	for _, line := range debug.lines {
+		files[line.File] = true
+	}
+	fmt.Fprintf(w, "debug info: %d symbols, %d line table rows in %d files, %d variables, %d functions with call frame information\n", len(debug.symbols), len(debug.lines), len(files), len(debug.variables), len(debug.frames))
+
+	// The largest symbols are the first place to look when the image grows.
+	var names []string
+	for name, sym := range debug.symbols {
+		if sym.Size != 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := debug.symbols[names[i]], debug.symbols[names[j]]
+		if a.Size != b.Size {
+			return a.Size > b.Size
+		}
+		return names[i] < names[j]
+	})
+	if len(names) > 10 {
+		names = names[:10]
+	}
+	if len(names) != 0 {
+		fmt.Fprintln(w, "largest symbols:")
+	}
+	for _, name := range names {
+		sym := debug.symbols[name]
+		fmt.Fprintf(w, "  %8d  0x%08x  %s\n", sym.Size, sym.Address, name)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// This file reads the project configuration file, .emculator.toml in the
+// working directory (or the file given with -config). It sets the same options
+// as the command line flags, which override it:
+//
+//	firmware = "build/firmware.elf"
+//	machine = "stm32"
+//	flash = 512
+//	sensor = ["bme280@0x76 temperature=sine(20,5,10s)"]
+//
+//	[uart]
+//	timing = true
+//	baud = 115200
+//
+// A key in a table is the flag with the name of the table as prefix, so
+// "baud" in [uart] is -uart-baud. Underscores may be used instead of dashes.
+// Arrays are for flags that can be repeated. Only this subset of TOML is
+// supported: no nested tables, inline tables or multi-line strings.
+
+// The name of the configuration file that is used when it exists.
+const defaultConfigFile = ".emculator.toml"
+
+// A key and its values from a configuration file.
+type configValue struct {
+	key    string
+	values []string
+	line   int
+}
+
+// Apply the configuration file to all flags that weren't set on the command
+// line, and return the firmware images it lists. A missing file is only an
+// error if it was given explicitly with -config.
+func applyConfig(path string, explicit bool) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) && !explicit {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	config, err := parseConfig(bufio.NewScanner(f))
+	if err != nil {
+		return nil, fmt.Errorf("%s:%v", path, err)
+	}
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	var firmware []string
+	for _, c := range config {
+		if c.key == "firmware" {
+			firmware = c.values
+			continue
+		}
+		if flag.Lookup(c.key) == nil || c.key == "config" {
+			return nil, fmt.Errorf("%s:%d: unknown option %s", path, c.line, c.key)
+		}
+		if set[c.key] {
+			continue // the command line overrides the file
+		}
+		for _, value := range c.values {
+			if err := flag.Set(c.key, value); err != nil {
+				return nil, fmt.Errorf("%s:%d: %s: %v", path, c.line, c.key, err)
+			}
+		}
+	}
+	return firmware, nil
+}
+
+// Parse the subset of TOML described above. Keys are returned in the order of
+// the file, as flag names.
+func parseConfig(scanner *bufio.Scanner) ([]configValue, error) {
+	var config []configValue
+	table := ""
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(stripConfigComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || strings.HasPrefix(line, "[[") {
+				return nil, fmt.Errorf("%d: invalid table %s", lineno, line)
+			}
+			table = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%d: expected KEY = VALUE", lineno)
+		}
+		key = strings.Trim(strings.TrimSpace(key), `"`)
+		if table != "" {
+			key = table + "-" + key
+		}
+		key = strings.ReplaceAll(key, "_", "-")
+		value = strings.TrimSpace(value)
+
+		// Arrays may continue on the next lines.
+		start := lineno
+		for strings.HasPrefix(value, "[") && !strings.HasSuffix(value, "]") && scanner.Scan() {
+			lineno++
+			value += " " + strings.TrimSpace(stripConfigComment(scanner.Text()))
+		}
+		values, err := parseConfigValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("%d: %s: %v", start, key, err)
+		}
+		config = append(config, configValue{key: key, values: values, line: start})
+	}
+	return config, scanner.Err()
+}
+
+// Remove a comment from a line, unless the # is inside a string.
+func stripConfigComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++ // skip the escaped character
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// Parse a value: a string, number, boolean or an array of them. All are
+// returned as strings to be passed to flag.Set.
+func parseConfigValue(s string) ([]string, error) {
+	if strings.HasPrefix(s, "[") {
+		if !strings.HasSuffix(s, "]") {
+			return nil, errors.New("unterminated array")
+		}
+		var values []string
+		rest := strings.TrimSpace(s[1 : len(s)-1])
+		for rest != "" {
+			item, tail, err := splitConfigItem(rest)
+			if err != nil {
+				return nil, err
+			}
+			value, err := parseConfigScalar(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+			rest = tail
+		}
+		return values, nil
+	}
+	value, err := parseConfigScalar(s)
+	if err != nil {
+		return nil, err
+	}
+	return []string{value}, nil
+}
+
+// Split the first item off a comma separated list of array items.
+func splitConfigItem(s string) (item, rest string, err error) {
+	end := 0
+	if s[0] == '"' || s[0] == '\'' {
+		// Find the end of the string, so that commas in it don't count.
+		for end = 1; end < len(s) && s[end] != s[0]; end++ {
+			if s[end] == '\\' && s[0] == '"' {
+				end++
+			}
+		}
+		if end >= len(s) {
+			return "", "", errors.New("unterminated string")
+		}
+	}
+	comma := strings.IndexByte(s[end:], ',')
+	if comma < 0 {
+		return strings.TrimSpace(s), "", nil
+	}
+	return strings.TrimSpace(s[:end+comma]), strings.TrimSpace(s[end+comma+1:]), nil
+}
+
+func parseConfigScalar(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		value, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid string %s", s)
+		}
+		return value, nil
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return "", fmt.Errorf("invalid string %s", s)
+		}
+		return s[1 : len(s)-1], nil
+	case s == "true" || s == "false":
+		return s, nil
+	}
+	number := strings.ReplaceAll(s, "_", "")
+	if _, err := strconv.ParseInt(number, 0, 64); err == nil {
+		return number, nil
+	}
+	if _, err := strconv.ParseFloat(number, 64); err == nil {
+		return number, nil
+	}
+	return "", fmt.Errorf("invalid value %s (strings must be quoted)", s)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Format parsed values as "LINE:KEY=VALUE|VALUE" so that they are easy to
+// compare.
+func formatConfig(config []configValue) []string {
+	var lines []string
+	for _, value := range config {
+		lines = append(lines, strconv.Itoa(value.line)+":"+value.key+"="+strings.Join(value.values, "|"))
+	}
+	return lines
+}
+
+func TestParseConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		config string
+		values []string
+		err    string
+	}{
+		{"empty", "", nil, ""},
+		{"integer", "gdb = 3333\n", []string{"1:gdb=3333"}, ""},
+		{"hex integer with underscores", "flash-base = 0x1000_0000\n", []string{"1:flash-base=0x10000000"}, ""},
+		{"float", "speed = 1.5\n", []string{"1:speed=1.5"}, ""},
+		{"boolean", "trace = true\n", []string{"1:trace=true"}, ""},
+		{"underscores in keys", "detect_panics = false\n", []string{"1:detect-panics=false"}, ""},
+		{"quoted key", "\"machine\" = \"PCA10040\"\n", []string{"1:machine=PCA10040"}, ""},
+		{"basic string escapes", `name = "a\"b\\c\td"` + "\n", []string{"1:name=a\"b\\c\td"}, ""},
+		{"literal string", `path = 'C:\firmware'` + "\n", []string{`1:path=C:\firmware`}, ""},
+		{"comments", "# comment\n\ngdb = 3333 # port\n  # indented\n", []string{"3:gdb=3333"}, ""},
+		{"hash in strings", "a = \"x # y\"\nb = 'x # y' # comment\n", []string{"1:a=x # y", "2:b=x # y"}, ""},
+		{"escaped quote before hash", `a = "x\" # y"` + "\n", []string{`1:a=x" # y`}, ""},
+		{"table", "[uart0]\nfile = \"out.txt\"\n[]\ngdb = 1\n", []string{"2:uart0-file=out.txt", "4:gdb=1"}, ""},
+		{"array", "watch = [0x20000000, \"a,b\", 'c']\n", []string{"1:watch=0x20000000|a,b|c"}, ""},
+		{"empty array", "watch = []\n", []string{"1:watch="}, ""},
+		{"multi-line array", "watch = [\n  1, # first\n  2,\n]\nx = 3\n", []string{"1:watch=1|2", "5:x=3"}, ""},
+		{"missing value", "gdb = 1\nmachine\n", nil, "2: expected KEY = VALUE"},
+		{"unquoted string", "\n\nmachine = PCA10040\n", nil, "3: machine: invalid value PCA10040 (strings must be quoted)"},
+		{"invalid string", "name = \"abc\n", nil, `1: name: invalid string "abc`},
+		{"unterminated literal string", "name = 'abc\n", nil, "1: name: invalid string 'abc"},
+		{"unterminated array", "x = 1\nwatch = [1,\n2\n", nil, "2: watch: unterminated array"},
+		{"unterminated string in array", "watch = [\"a, b]\n", nil, "1: watch: unterminated string"},
+		{"array of tables", "[[uart]]\n", nil, "1: invalid table [[uart]]"},
+		{"invalid table", "gdb = 1\n[uart0\n", nil, "2: invalid table [uart0"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config, err := parseConfig(bufio.NewScanner(strings.NewReader(tc.config)))
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Fatalf("got error %v, expected %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got := formatConfig(config)
+			if strings.Join(got, "\n") != strings.Join(tc.values, "\n") {
+				t.Errorf("got %q, expected %q", got, tc.values)
+			}
+		})
+	}
+}
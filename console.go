@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// This file implements the console: it multiplexes the terminal between the
+// UART of the firmware and the emulator itself. All input goes to the UART,
+// except for key sequences starting with Ctrl-A, like in QEMU:
+//
+//     Ctrl-A h       print help
+//     Ctrl-A x       exit the emulator
+//     Ctrl-A s       print statistics
+//     Ctrl-A c       halt the firmware and enter the monitor
+//     Ctrl-A k KEY   click a key of a keypad
+//     Ctrl-A Ctrl-A  send Ctrl-A to the firmware
+//
+// The keys of buttons and encoders (see inputs.go) also follow Ctrl-A.
+
+// The key that starts an escape sequence: Ctrl-A.
+const consoleEscape = 1
+
+const consoleHelp = `
+C-a h    print this help
+C-a x    exit the emulator
+C-a s    print statistics
+C-a c    halt the firmware and enter the monitor (an empty line resumes)
+C-a C-a  send C-a to the firmware
+`
+
+// Start the console, if standard input is a terminal. It must be called
+// before the machine starts running.
+func startConsole(m *Machine) error {
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		// Not a terminal, for example a pipe. Pass all input to the firmware
+		// unchanged.
+		return nil
+	}
+
+	// The UART and semihosting read from this pipe instead of from the
+	// terminal directly.
+	r, w := io.Pipe()
+	terminalUseInput(r)
+	terminalEnableRaw()
+
+	go func() {
+		input := bufio.NewReader(os.Stdin)
+		for {
+			c, err := input.ReadByte()
+			if err != nil {
+				w.Close()
+				return
+			}
+			if c != consoleEscape {
+				w.Write([]byte{c})
+				continue
+			}
+			c, err = input.ReadByte()
+			if err != nil {
+				w.Close()
+				return
+			}
+			switch c {
+			case consoleEscape:
+				w.Write([]byte{consoleEscape})
+			case 'h':
+				fmt.Fprint(os.Stderr, consoleHelp)
+				if m.inputs != nil {
+					m.inputs.help(os.Stderr)
+				}
+			case 'x':
+				terminalDisableRaw()
+				fmt.Fprintln(os.Stderr, "\nemculator: terminated")
+				os.Exit(0)
+			case 's':
+				m.Pause(func(running bool) error {
+					fmt.Fprintln(os.Stderr)
+					printStats(os.Stderr, m.machine)
+					return nil
+				})
+			case 'c':
+				consoleMonitor(m, input)
+			case 'k':
+				c, err = input.ReadByte()
+				if err != nil {
+					w.Close()
+					return
+				}
+				if m.inputs != nil {
+					if command, ok := m.inputs.keypadKey(c); ok {
+						m.inputCommand(command)
+					}
+				}
+			default:
+				if m.inputs != nil {
+					if command, ok := m.inputs.consoleKey(c); ok {
+						m.inputCommand(command)
+					}
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Halt the machine and run monitor commands typed by the user, until an
+// empty line is entered.
+func consoleMonitor(m *Machine, input *bufio.Reader) {
+	m.Pause(func(running bool) error {
+		// The terminal is in raw mode, so restore it for line editing.
+		terminalDisableRaw()
+		fmt.Fprintln(os.Stderr, "\nfirmware halted, enter monitor commands (an empty line resumes)")
+		for {
+			fmt.Fprint(os.Stderr, "(emculator) ")
+			line, err := input.ReadString('\n')
+			line = strings.TrimSpace(line)
+			if err != nil || line == "" {
+				break
+			}
+			if err := runMonitorCommand(m, line, os.Stderr); err != nil {
+				fmt.Fprintln(os.Stderr, "error:", err)
+			}
+		}
+		terminalEnableRaw()
+		return nil
+	})
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image/png"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"strings"
+)
+
+// #include "machine.h"
+import "C"
+
+// This file implements the control socket: a JSON-RPC 1.0 server on a unix
+// domain socket, so that test frameworks can drive the emulator without GDB.
+// A request looks like this:
+//
+//     {"method": "Emculator.ReadMemory", "params": [{"Address": 536870912, "Length": 4}], "id": 1}
+//
+// Calls that use the machine halt it for the duration of the call, so they can
+// be made while GDB is connected. A machine that GDB is continuing may be
+// paused and resumed; GDB is told when it stops.
+
+// Control is the RPC service that is exposed on the control socket.
+type Control struct {
+	m       *Machine
+	running bool // whether the machine was running before the current call
+}
+
+// ControlArgs are the arguments for all control calls. Only the fields used
+// by a call need to be set. Data is hex encoded for memory calls and a plain
+// string for UART input and input commands.
+type ControlArgs struct {
+	Address uint32
+	Length  int
+	Data    string
+	IRQ     uint32
+	UART    uint32
+}
+
+// ControlState describes the state of the machine.
+type ControlState struct {
+	Running      bool
+	Stop         string   // why the machine stopped, if it isn't running
+	Registers    []uint32 // r0-r15 and xPSR, where pc is the current instruction
+	Cycles       uint64
+	Instructions uint64
+}
+
+// Listen on the control socket at the given path and serve each connection.
+func controlServer(m *Machine, path string) error {
+	server := rpc.NewServer()
+	err := server.RegisterName("Emculator", &Control{m: m})
+	if err != nil {
+		return err
+	}
+	// Remove a stale socket from a previous run.
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	sock, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	for {
+		conn, err := sock.Accept()
+		if err != nil {
+			return err
+		}
+		go server.ServeCodec(jsonrpc.NewServerCodec(conn))
+	}
+}
+
+// Run f while the machine is halted, resuming it afterwards if it was running.
+func (c *Control) halted(f func() error) error {
+	return c.m.Pause(func(running bool) error {
+		c.running = running
+		return f()
+	})
+}
+
+// Pause halts the machine.
+func (c *Control) Pause(args *ControlArgs, reply *bool) error {
+	c.m.Halt()
+	*reply = true
+	return nil
+}
+
+// Resume continues a halted machine.
+func (c *Control) Resume(args *ControlArgs, reply *bool) error {
+	c.m.Continue()
+	*reply = true
+	return nil
+}
+
+// Reset does a pin reset. RAM is kept, like on a real chip.
+func (c *Control) Reset(args *ControlArgs, reply *bool) error {
+	return c.halted(func() error {
+		C.machine_reset_cause(c.m.machine, C.RESET_PIN)
+		*reply = true
+		return nil
+	})
+}
+
+// Reload writes a new firmware image to flash, from the path in Data or the
+// current image if it is empty, and resets the core. Peripherals, UART
+// backends and GDB stay connected. The machine runs again if it was running.
+func (c *Control) Reload(args *ControlArgs, reply *bool) error {
+	return c.halted(func() error {
+		_, err := c.m.Reload(args.Data)
+		*reply = err == nil
+		return err
+	})
+}
+
+// State returns the registers and statistics of the machine.
+func (c *Control) State(args *ControlArgs, reply *ControlState) error {
+	return c.halted(func() error {
+		reply.Running = c.running
+		if !c.running && c.m.stop != nil {
+			reply.Stop = c.m.stop.Error()
+		}
+		regs := c.m.DebugRegisters()
+		reply.Registers = regs[:]
+		reply.Cycles = uint64(c.m.machine.stats.cycles)
+		reply.Instructions = uint64(c.m.machine.stats.instructions)
+		return nil
+	})
+}
+
+// ReadMemory reads Length bytes at Address and returns them hex encoded.
+func (c *Control) ReadMemory(args *ControlArgs, reply *string) error {
+	if args.Length < 0 || args.Length > 1<<20 {
+		return errors.New("invalid length")
+	}
+	return c.halted(func() error {
+		*reply = hex.EncodeToString(c.m.ReadMemory(int(args.Address), args.Length))
+		return nil
+	})
+}
+
+// WriteMemory writes the hex encoded Data at Address.
+func (c *Control) WriteMemory(args *ControlArgs, reply *bool) error {
+	data, err := hex.DecodeString(args.Data)
+	if err != nil {
+		return err
+	}
+	return c.halted(func() error {
+		c.m.WriteMemory(int(args.Address), data)
+		*reply = true
+		return nil
+	})
+}
+
+// RaiseIRQ sets the given external interrupt pending in the NVIC.
+func (c *Control) RaiseIRQ(args *ControlArgs, reply *bool) error {
+	if args.IRQ >= C.MACHINE_NUM_IRQS {
+		return fmt.Errorf("IRQ must be below %d", C.MACHINE_NUM_IRQS)
+	}
+	return c.halted(func() error {
+		C.machine_pend_irq(c.m.machine, C.uint32_t(args.IRQ))
+		*reply = true
+		return nil
+	})
+}
+
+// InjectUART adds Data to the input of UART0, or of the UART given in UART, as
+// if it was received. It returns the number of bytes that fit in the input
+// queue.
+func (c *Control) InjectUART(args *ControlArgs, reply *int) error {
+	if args.UART >= C.MACHINE_NUM_UARTS {
+		return fmt.Errorf("UART must be below %d", C.MACHINE_NUM_UARTS)
+	}
+	if len(args.Data) == 0 {
+		return nil
+	}
+	return c.halted(func() error {
+		data := C.CBytes([]byte(args.Data))
+		*reply = int(C.machine_uart_inject(c.m.machine, C.uint32_t(args.UART), (*C.uint8_t)(data), C.size_t(len(args.Data))))
+		C.free(data)
+		return nil
+	})
+}
+
+// Input runs the input command in Data, like "click button1" or "rotate
+// knob 2". See inputs.go.
+func (c *Control) Input(args *ControlArgs, reply *bool) error {
+	if c.m.inputs == nil {
+		return errors.New("no input devices, see -input")
+	}
+	return c.halted(func() error {
+		if err := c.m.inputs.command(args.Data); err != nil {
+			return err
+		}
+		*reply = true
+		return nil
+	})
+}
+
+// CAN sends the CAN frame in Data, like "123#DEADBEEF", and returns whether
+// the CAN controller accepted it. See can.go.
+func (c *Control) CAN(args *ControlArgs, reply *bool) error {
+	return c.halted(func() error {
+		accepted, err := c.m.canSend(args.Data)
+		*reply = accepted
+		return err
+	})
+}
+
+// UART runs the uart command in Data, like "cts off" or "error framing", and
+// returns its output. See uartCommand.
+func (c *Control) UART(args *ControlArgs, reply *string) error {
+	return c.halted(func() error {
+		var buf strings.Builder
+		err := uartCommand(c.m.machine, strings.Fields(args.Data), &buf)
+		*reply = buf.String()
+		return err
+	})
+}
+
+// Print returns the value of the variable in Data, like "config.mode", as
+// the print monitor command shows it. See vars.go.
+func (c *Control) Print(args *ControlArgs, reply *string) error {
+	return c.halted(func() error {
+		value, err := c.m.printVariable(args.Data)
+		*reply = value
+		return err
+	})
+}
+
+// Set runs the assignment in Data, like "counter = 5". See vars.go.
+func (c *Control) Set(args *ControlArgs, reply *bool) error {
+	return c.halted(func() error {
+		if err := c.m.setVariable(args.Data); err != nil {
+			return err
+		}
+		*reply = true
+		return nil
+	})
+}
+
+// Periph returns the state of the peripheral named in Data, like "timer1", as
+// JSON. See periphstate.go.
+func (c *Control) Periph(args *ControlArgs, reply *string) error {
+	return c.halted(func() error {
+		state, err := dumpPeriph(c.m.machine, args.Data)
+		*reply = state
+		return err
+	})
+}
+
+// PeriphRestore restores the state of a peripheral from Data, which is its
+// name followed by the JSON that Periph returned, like "timer1 {...}".
+func (c *Control) PeriphRestore(args *ControlArgs, reply *bool) error {
+	return c.halted(func() error {
+		name, state, _ := strings.Cut(strings.TrimSpace(args.Data), " ")
+		if err := restorePeriph(c.m.machine, name, state); err != nil {
+			return err
+		}
+		*reply = true
+		return nil
+	})
+}
+
+// Screenshot returns the image of the display named in Data as a hex encoded
+// PNG file. Data may be empty if there is only one display.
+func (c *Control) Screenshot(args *ControlArgs, reply *string) error {
+	return c.halted(func() error {
+		img, err := c.m.Screenshot(args.Data)
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			return err
+		}
+		*reply = hex.EncodeToString(buf.Bytes())
+		return nil
+	})
+}
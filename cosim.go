@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// This file implements co-simulation: the emulator runs in lock-step with a
+// real chip and the registers of both are compared as they run, to find the
+// first instruction where the emulator behaves differently. The chip is
+// controlled through the GDB server of a debug probe (OpenOCD, pyOCD, the
+// J-Link GDB server) so that any SWD probe they support can be used. The chip
+// must be flashed with the same firmware.
+
+// Registers that are compared: r0-r15 and xPSR, in the order of the 'g'
+// packet of Cortex-M GDB servers.
+var cosimRegisterNames = [17]string{"r0", "r1", "r2", "r3", "r4", "r5", "r6", "r7", "r8", "r9", "r10", "r11", "r12", "sp", "lr", "pc", "xpsr"}
+
+// How long to wait for the GDB server to accept the connection and to reply to
+// a command. A reset through the probe can take a while, a step should not.
+const (
+	gdbClientDialTimeout  = 5 * time.Second
+	gdbClientReplyTimeout = 10 * time.Second
+)
+
+// A minimal GDB remote protocol client.
+type gdbClient struct {
+	sock net.Conn
+	conn *bufio.ReadWriter
+	acks bool
+}
+
+func dialGDB(address string) (*gdbClient, error) {
+	if !strings.Contains(address, ":") {
+		address = "localhost:" + address
+	}
+	sock, err := net.DialTimeout("tcp", address, gdbClientDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	client := &gdbClient{
+		sock: sock,
+		conn: bufio.NewReadWriter(bufio.NewReader(sock), bufio.NewWriter(sock)),
+		acks: true,
+	}
+	features, err := client.command("qSupported")
+	if err != nil {
+		sock.Close()
+		return nil, err
+	}
+	if strings.Contains(features, "QStartNoAckMode+") {
+		if reply, err := client.command("QStartNoAckMode"); err == nil && reply == "OK" {
+			client.acks = false
+		}
+	}
+	return client, nil
+}
+
+// Close the connection. The target is left as it is: GDB servers keep it
+// halted.
+func (c *gdbClient) Close() error {
+	return c.sock.Close()
+}
+
+// Send a command and return the reply. Output packets ("O...", from monitor
+// commands) are skipped. It fails when the GDB server doesn't reply in time.
+func (c *gdbClient) command(packet string) (string, error) {
+	if err := c.sock.SetDeadline(time.Now().Add(gdbClientReplyTimeout)); err != nil {
+		return "", err
+	}
+	// Packets sent by this client never contain characters that need to be
+	// escaped.
+	_, err := fmt.Fprintf(c.conn, "$%s#%s", packet, gdbPacketChecksum(packet))
+	if err != nil {
+		return "", err
+	}
+	if err := c.conn.Flush(); err != nil {
+		return "", err
+	}
+	for {
+		reply, err := gdbRecvPacket(c.conn)
+		if err != nil {
+			return "", err
+		}
+		if c.acks {
+			c.conn.WriteByte('+')
+			c.conn.Flush()
+		}
+		if strings.HasPrefix(reply, "O") && reply != "OK" && strings.HasPrefix(packet, "qRcmd,") {
+			continue
+		}
+		return reply, nil
+	}
+}
+
+// Run a monitor command, like "reset halt".
+func (c *gdbClient) monitor(cmd string) error {
+	reply, err := c.command("qRcmd," + hex.EncodeToString([]byte(cmd)))
+	if err != nil {
+		return err
+	}
+	if reply != "OK" {
+		return fmt.Errorf("monitor %s: %s", cmd, reply)
+	}
+	return nil
+}
+
+// Read r0-r15 and xPSR.
+func (c *gdbClient) registers() ([17]uint32, error) {
+	var regs [17]uint32
+	reply, err := c.command("g")
+	if err != nil {
+		return regs, err
+	}
+	data, err := hex.DecodeString(reply)
+	if err != nil || len(data) < len(regs)*4 {
+		return regs, fmt.Errorf("unexpected register packet: %q", reply)
+	}
+	for i := range regs {
+		regs[i] = binary.LittleEndian.Uint32(data[i*4:])
+	}
+	return regs, nil
+}
+
+// Single-step the target and return whether it is still running the program.
+func (c *gdbClient) step() (bool, error) {
+	reply, err := c.command("s")
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case strings.HasPrefix(reply, "S") || strings.HasPrefix(reply, "T"):
+		return true, nil
+	case strings.HasPrefix(reply, "W") || strings.HasPrefix(reply, "X"):
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected stop reply: %q", reply)
+	}
+}
+
+// Run the firmware in lock-step with the chip behind the GDB server at the
+// given address, comparing registers every interval instructions. The chip is
+// first reset with the given monitor command, if any. It returns an error
+// describing the first divergence.
+func runCosim(m *Machine, address, reset string, interval int, w io.Writer) error {
+	if interval < 1 {
+		return errors.New("the interval must be at least 1")
+	}
+	target, err := dialGDB(address)
+	if err != nil {
+		return fmt.Errorf("cannot connect to GDB server: %v", err)
+	}
+	defer target.Close()
+	if reset != "" {
+		if err := target.monitor(reset); err != nil {
+			return err
+		}
+	}
+	if _, err := target.command("?"); err != nil {
+		return err
+	}
+
+	var lastPC uint32
+	for count := uint64(0); ; count++ {
+		if count%uint64(interval) == 0 {
+			emulated := m.DebugRegisters()
+			real, err := target.registers()
+			if err != nil {
+				return err
+			}
+			if emulated != real {
+				fmt.Fprintf(w, "cosim: divergence after %d instructions\n", count)
+				if count != 0 {
+					text, _ := m.Disassemble(lastPC)
+					fmt.Fprintf(w, "  last instruction: %08x: %-24s %s\n", lastPC, text, m.debug.describe(lastPC))
+				}
+				fmt.Fprintln(w, "  register  emulator  target")
+				for i := range emulated {
+					marker := ""
+					if emulated[i] != real[i] {
+						marker = "  <--"
+					}
+					fmt.Fprintf(w, "  %-8s  %08x  %08x%s\n", cosimRegisterNames[i], emulated[i], real[i], marker)
+				}
+				return fmt.Errorf("the emulator diverged from the target at PC 0x%x", emulated[15])
+			}
+		}
+		if limit := uint64(m.machine.instruction_limit); limit != 0 && count >= limit {
+			fmt.Fprintf(w, "cosim: no divergence in %d instructions\n", count)
+			return nil
+		}
+
+		lastPC = m.ReadRegister(15) - 1
+		if stop := m.Step(); stop != nil {
+			fmt.Fprintf(w, "cosim: no divergence in %d instructions, stopped: %v\n", count, stop)
+			return nil
+		}
+		running, err := target.step()
+		if err != nil {
+			return err
+		}
+		if !running {
+			fmt.Fprintf(w, "cosim: no divergence in %d instructions, the target exited\n", count+1)
+			return nil
+		}
+	}
+}
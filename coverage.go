@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// #include "machine.h"
+import "C"
+
+// This file implements -coverage: line and function coverage of the firmware,
+// written as an lcov tracefile that genhtml and CI services understand. The C
+// core records which instructions in flash were executed, and the DWARF line
+// table maps them to source lines. Hit counts are 0 or 1.
+
+// A coverage summary, as counted in an lcov tracefile.
+type coverageSummary struct {
+	LinesHit       int `json:"lines_hit"`
+	LinesFound     int `json:"lines_found"`
+	FunctionsHit   int `json:"functions_hit"`
+	FunctionsFound int `json:"functions_found"`
+}
+
+// Start recording executed instructions for coverage.
+func enableCoverage(machine *C.machine_t, debug *debugInfo) error {
+	if debug == nil || len(debug.lines) == 0 {
+		return errors.New("coverage needs an ELF file with DWARF line information")
+	}
+	C.machine_enable_executed(machine)
+	return nil
+}
+
+// Write the coverage of the firmware to the given file, if coverage was
+// enabled.
+func saveCoverage(m *Machine, path string) {
+	if m.machine.executed == nil {
+		return
+	}
+	if err := writeCoverage(path, m); err != nil {
+		fmt.Fprintln(os.Stderr, "error: cannot save coverage:", err)
+	}
+}
+
+func writeCoverage(path string, m *Machine) error {
+	size := int(m.machine.image_size) / 16
+	executed := unsafe.Slice((*byte)(m.machine.executed), size)
+	flashBase := uint32(m.machine.flash_base)
+	isExecuted := func(start, end uint32) bool {
+		for address := start &^ 1; address < end; address += 2 {
+			index := address - flashBase
+			if address < flashBase || int(index/16) >= size {
+				continue
+			}
+			if executed[index/16]&(1<<(index/2%8)) != 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	// A line is covered when an instruction in any of its address ranges was
+	// executed.
+	lines := make(map[string]map[int]bool)
+	info := m.debug
+	for i, line := range info.lines {
+		if line.Line == 0 || i+1 == len(info.lines) {
+			continue
+		}
+		if lines[line.File] == nil {
+			lines[line.File] = make(map[int]bool)
+		}
+		lines[line.File][line.Line] = lines[line.File][line.Line] || isExecuted(line.Address, info.lines[i+1].Address)
+	}
+
+	// Functions are the symbols that start at a row of the line table.
+	type function struct {
+		name string
+		line int
+		hit  bool
+	}
+	functions := make(map[string][]function)
+	for name, sym := range info.symbols {
+		i := sort.Search(len(info.lines), func(i int) bool {
+			return info.lines[i].Address >= sym.Address
+		})
+		if sym.Size == 0 || i == len(info.lines) || info.lines[i].Address != sym.Address || info.lines[i].Line == 0 {
+			continue
+		}
+		file := info.lines[i].File
+		functions[file] = append(functions[file], function{name, info.lines[i].Line, isExecuted(sym.Address, sym.Address+2)})
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	var files []string
+	for file := range lines {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		fmt.Fprintf(w, "TN:\nSF:%s\n", file)
+		funcs := functions[file]
+		sort.Slice(funcs, func(i, j int) bool {
+			return funcs[i].line < funcs[j].line || (funcs[i].line == funcs[j].line && funcs[i].name < funcs[j].name)
+		})
+		hit := 0
+		for _, fn := range funcs {
+			fmt.Fprintf(w, "FN:%d,%s\n", fn.line, fn.name)
+		}
+		for _, fn := range funcs {
+			count := 0
+			if fn.hit {
+				count = 1
+				hit++
+			}
+			fmt.Fprintf(w, "FNDA:%d,%s\n", count, fn.name)
+		}
+		fmt.Fprintf(w, "FNF:%d\nFNH:%d\n", len(funcs), hit)
+		var numbers []int
+		for line := range lines[file] {
+			numbers = append(numbers, line)
+		}
+		sort.Ints(numbers)
+		hit = 0
+		for _, line := range numbers {
+			count := 0
+			if lines[file][line] {
+				count = 1
+				hit++
+			}
+			fmt.Fprintf(w, "DA:%d,%d\n", line, count)
+		}
+		fmt.Fprintf(w, "LF:%d\nLH:%d\nend_of_record\n", len(numbers), hit)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Add up the totals of all files in an lcov tracefile.
+func readCoverageSummary(path string) (coverageSummary, error) {
+	var summary coverageSummary
+	f, err := os.Open(path)
+	if err != nil {
+		return summary, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		n, _ := strconv.Atoi(value)
+		switch key {
+		case "LH":
+			summary.LinesHit += n
+		case "LF":
+			summary.LinesFound += n
+		case "FNH":
+			summary.FunctionsHit += n
+		case "FNF":
+			summary.FunctionsFound += n
+		}
+	}
+	return summary, scanner.Err()
+}
+
+// Format a summary like "lines 80.0% (40/50), functions 75.0% (3/4)".
+func (s coverageSummary) String() string {
+	percent := func(hit, found int) float64 {
+		if found == 0 {
+			return 0
+		}
+		return float64(hit) * 100 / float64(found)
+	}
+	return fmt.Sprintf("lines %.1f%% (%d/%d), functions %.1f%% (%d/%d)", percent(s.LinesHit, s.LinesFound), s.LinesHit, s.LinesFound, percent(s.FunctionsHit, s.FunctionsFound), s.FunctionsHit, s.FunctionsFound)
+}
@@ -0,0 +1,314 @@
+#include "crypto.h"
+
+#include <string.h>
+
+// AES: https://csrc.nist.gov/publications/detail/fips/197/final
+// CCM: https://tools.ietf.org/html/rfc3610
+// SHA-1 and SHA-2: https://csrc.nist.gov/publications/detail/fips/180/4/final
+// MD5: https://tools.ietf.org/html/rfc1321
+
+static const uint8_t aes_sbox[256] = {
+	0x63, 0x7c, 0x77, 0x7b, 0xf2, 0x6b, 0x6f, 0xc5, 0x30, 0x01, 0x67, 0x2b, 0xfe, 0xd7, 0xab, 0x76,
+	0xca, 0x82, 0xc9, 0x7d, 0xfa, 0x59, 0x47, 0xf0, 0xad, 0xd4, 0xa2, 0xaf, 0x9c, 0xa4, 0x72, 0xc0,
+	0xb7, 0xfd, 0x93, 0x26, 0x36, 0x3f, 0xf7, 0xcc, 0x34, 0xa5, 0xe5, 0xf1, 0x71, 0xd8, 0x31, 0x15,
+	0x04, 0xc7, 0x23, 0xc3, 0x18, 0x96, 0x05, 0x9a, 0x07, 0x12, 0x80, 0xe2, 0xeb, 0x27, 0xb2, 0x75,
+	0x09, 0x83, 0x2c, 0x1a, 0x1b, 0x6e, 0x5a, 0xa0, 0x52, 0x3b, 0xd6, 0xb3, 0x29, 0xe3, 0x2f, 0x84,
+	0x53, 0xd1, 0x00, 0xed, 0x20, 0xfc, 0xb1, 0x5b, 0x6a, 0xcb, 0xbe, 0x39, 0x4a, 0x4c, 0x58, 0xcf,
+	0xd0, 0xef, 0xaa, 0xfb, 0x43, 0x4d, 0x33, 0x85, 0x45, 0xf9, 0x02, 0x7f, 0x50, 0x3c, 0x9f, 0xa8,
+	0x51, 0xa3, 0x40, 0x8f, 0x92, 0x9d, 0x38, 0xf5, 0xbc, 0xb6, 0xda, 0x21, 0x10, 0xff, 0xf3, 0xd2,
+	0xcd, 0x0c, 0x13, 0xec, 0x5f, 0x97, 0x44, 0x17, 0xc4, 0xa7, 0x7e, 0x3d, 0x64, 0x5d, 0x19, 0x73,
+	0x60, 0x81, 0x4f, 0xdc, 0x22, 0x2a, 0x90, 0x88, 0x46, 0xee, 0xb8, 0x14, 0xde, 0x5e, 0x0b, 0xdb,
+	0xe0, 0x32, 0x3a, 0x0a, 0x49, 0x06, 0x24, 0x5c, 0xc2, 0xd3, 0xac, 0x62, 0x91, 0x95, 0xe4, 0x79,
+	0xe7, 0xc8, 0x37, 0x6d, 0x8d, 0xd5, 0x4e, 0xa9, 0x6c, 0x56, 0xf4, 0xea, 0x65, 0x7a, 0xae, 0x08,
+	0xba, 0x78, 0x25, 0x2e, 0x1c, 0xa6, 0xb4, 0xc6, 0xe8, 0xdd, 0x74, 0x1f, 0x4b, 0xbd, 0x8b, 0x8a,
+	0x70, 0x3e, 0xb5, 0x66, 0x48, 0x03, 0xf6, 0x0e, 0x61, 0x35, 0x57, 0xb9, 0x86, 0xc1, 0x1d, 0x9e,
+	0xe1, 0xf8, 0x98, 0x11, 0x69, 0xd9, 0x8e, 0x94, 0x9b, 0x1e, 0x87, 0xe9, 0xce, 0x55, 0x28, 0xdf,
+	0x8c, 0xa1, 0x89, 0x0d, 0xbf, 0xe6, 0x42, 0x68, 0x41, 0x99, 0x2d, 0x0f, 0xb0, 0x54, 0xbb, 0x16,
+};
+
+// Multiply by x in GF(2^8).
+static uint8_t aes_xtime(uint8_t b) {
+	return (uint8_t)(b << 1) ^ (b & 0x80 ? 0x1b : 0);
+}
+
+// Encrypt a single block with AES-128. The key and blocks are in the byte
+// order of FIPS 197.
+void aes128_encrypt(const uint8_t key[16], const uint8_t in[16], uint8_t out[16]) {
+	uint8_t round_key[16];
+	uint8_t s[16];
+	uint8_t rcon = 1;
+	memcpy(round_key, key, 16);
+	for (int i = 0; i < 16; i++) {
+		s[i] = in[i] ^ round_key[i];
+	}
+	for (int round = 1; round <= 10; round++) {
+		// Key expansion, one round key at a time.
+		uint8_t t[4] = {aes_sbox[round_key[13]] ^ rcon, aes_sbox[round_key[14]], aes_sbox[round_key[15]], aes_sbox[round_key[12]]};
+		for (int i = 0; i < 16; i++) {
+			round_key[i] ^= i < 4 ? t[i] : round_key[i - 4];
+		}
+		rcon = aes_xtime(rcon);
+
+		// SubBytes and ShiftRows. The state is stored column by column.
+		uint8_t u[16];
+		for (int i = 0; i < 16; i++) {
+			u[i] = aes_sbox[s[(i + 4 * (i % 4)) % 16]];
+		}
+		// MixColumns, except in the last round.
+		for (int c = 0; c < 4; c++) {
+			uint8_t *col = &u[c * 4];
+			if (round != 10) {
+				uint8_t a0 = col[0], a1 = col[1], a2 = col[2], a3 = col[3];
+				uint8_t all = a0 ^ a1 ^ a2 ^ a3;
+				col[0] ^= all ^ aes_xtime(a0 ^ a1);
+				col[1] ^= all ^ aes_xtime(a1 ^ a2);
+				col[2] ^= all ^ aes_xtime(a2 ^ a3);
+				col[3] ^= all ^ aes_xtime(a3 ^ a0);
+			}
+		}
+		for (int i = 0; i < 16; i++) {
+			s[i] = u[i] ^ round_key[i];
+		}
+	}
+	memcpy(out, s, 16);
+}
+
+// Fill a CCM block: the flags, the nonce and a big endian number in the
+// remaining bytes (the message length or the counter).
+static void aes128_ccm_block(uint8_t block[16], uint8_t flags, const uint8_t *nonce, size_t nonce_len, size_t number) {
+	block[0] = flags;
+	memcpy(&block[1], nonce, nonce_len);
+	for (size_t i = 15; i > nonce_len; i--) {
+		block[i] = number;
+		number >>= 8;
+	}
+}
+
+// Compute the MIC of AES-CCM over the additional data and the cleartext. The
+// nonce is 7 to 13 bytes, the MIC is 4 to 16 bytes (an even number) and the
+// additional data must be shorter than 0xff00 bytes.
+void aes128_ccm_mic(const uint8_t key[16], const uint8_t *nonce, size_t nonce_len, const uint8_t *adata, size_t adata_len, const uint8_t *data, size_t length, uint8_t *mic, size_t mic_len) {
+	uint8_t x[16], block[16];
+	uint8_t flags = (adata_len != 0 ? 0x40 : 0) | (mic_len - 2) / 2 << 3 | (14 - nonce_len);
+	aes128_ccm_block(block, flags, nonce, nonce_len, length);
+	aes128_encrypt(key, block, x);
+	// The additional data is prefixed with its length.
+	for (size_t pos = 0; adata_len != 0 && pos < adata_len + 2; pos += 16) {
+		for (size_t i = 0; i < 16; i++) {
+			size_t n = pos + i;
+			uint8_t b = n == 0 ? adata_len >> 8 : n == 1 ? adata_len : n < adata_len + 2 ? adata[n - 2] : 0;
+			block[i] = x[i] ^ b;
+		}
+		aes128_encrypt(key, block, x);
+	}
+	for (size_t pos = 0; pos < length; pos += 16) {
+		for (size_t i = 0; i < 16; i++) {
+			block[i] = x[i] ^ (pos + i < length ? data[pos + i] : 0);
+		}
+		aes128_encrypt(key, block, x);
+	}
+	aes128_ccm_block(block, 14 - nonce_len, nonce, nonce_len, 0); // counter block 0
+	aes128_encrypt(key, block, block);
+	for (size_t i = 0; i < mic_len; i++) {
+		mic[i] = x[i] ^ block[i];
+	}
+}
+
+// Encrypt or decrypt data in place with the key stream of AES-CCM, which
+// starts at counter block 1.
+void aes128_ccm_crypt(const uint8_t key[16], const uint8_t *nonce, size_t nonce_len, uint8_t *data, size_t length) {
+	uint8_t block[16];
+	for (size_t i = 0; i < length; i++) {
+		if (i % 16 == 0) {
+			aes128_ccm_block(block, 14 - nonce_len, nonce, nonce_len, i / 16 + 1);
+			aes128_encrypt(key, block, block);
+		}
+		data[i] ^= block[i % 16];
+	}
+}
+
+// Add the low bits of data (8, 16 or 32), most significant bit first, to a
+// CRC of the given size in bits (7 to 32) that uses the given polynomial.
+// There is no reflection or final XOR: the caller does that when needed.
+uint32_t crc_update(uint32_t crc, uint32_t polynomial, uint32_t size, uint32_t data, uint32_t bits) {
+	uint32_t mask = size == 32 ? 0xffffffff : (1u << size) - 1;
+	for (int i = bits - 1; i >= 0; i--) {
+		uint32_t bit = ((data >> i) ^ (crc >> (size - 1))) & 1;
+		crc = (crc << 1) & mask;
+		if (bit) {
+			crc ^= polynomial & mask;
+		}
+	}
+	return crc;
+}
+
+static uint32_t rol32(uint32_t x, int n) {
+	return (x << n) | (x >> (32 - n));
+}
+
+static uint32_t ror32(uint32_t x, int n) {
+	return (x >> n) | (x << (32 - n));
+}
+
+static const uint32_t sha256_k[64] = {
+	0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+	0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+	0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+	0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+	0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+	0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+	0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+	0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2,
+};
+
+// Constants of MD5: floor(abs(sin(i + 1)) * 2^32).
+static const uint32_t md5_k[64] = {
+	0xd76aa478, 0xe8c7b756, 0x242070db, 0xc1bdceee, 0xf57c0faf, 0x4787c62a, 0xa8304613, 0xfd469501,
+	0x698098d8, 0x8b44f7af, 0xffff5bb1, 0x895cd7be, 0x6b901122, 0xfd987193, 0xa679438e, 0x49b40821,
+	0xf61e2562, 0xc040b340, 0x265e5a51, 0xe9b6c7aa, 0xd62f105d, 0x02441453, 0xd8a1e681, 0xe7d3fbc8,
+	0x21e1cde6, 0xc33707d6, 0xf4d50d87, 0x455a14ed, 0xa9e3e905, 0xfcefa3f8, 0x676f02d9, 0x8d2a4c8a,
+	0xfffa3942, 0x8771f681, 0x6d9d6122, 0xfde5380c, 0xa4beea44, 0x4bdecfa9, 0xf6bb4b60, 0xbebfbc70,
+	0x289b7ec6, 0xeaa127fa, 0xd4ef3085, 0x04881d05, 0xd9d4d039, 0xe6db99e5, 0x1fa27cf8, 0xc4ac5665,
+	0xf4292244, 0x432aff97, 0xab9423a7, 0xfc93a039, 0x655b59c3, 0x8f0ccc92, 0xffeff47d, 0x85845dd1,
+	0x6fa87e4f, 0xfe2ce6e0, 0xa3014314, 0x4e0811a1, 0xf7537e82, 0xbd3af235, 0x2ad7d2bb, 0xeb86d391,
+};
+
+// Per-round shift amounts of MD5.
+static const uint8_t md5_r[16] = {7, 12, 17, 22, 5, 9, 14, 20, 4, 11, 16, 23, 6, 10, 15, 21};
+
+// Hash a 64-byte block.
+static void hash_block(hash_t *hash, const uint8_t *block) {
+	uint32_t w[80];
+	uint32_t *h = hash->state;
+	if (hash->algorithm == HASH_MD5) {
+		for (int i = 0; i < 16; i++) {
+			w[i] = block[i * 4] | block[i * 4 + 1] << 8 | block[i * 4 + 2] << 16 | (uint32_t)block[i * 4 + 3] << 24;
+		}
+		uint32_t a = h[0], b = h[1], c = h[2], d = h[3];
+		for (int i = 0; i < 64; i++) {
+			uint32_t f;
+			int g;
+			if (i < 16) {
+				f = (b & c) | (~b & d);
+				g = i;
+			} else if (i < 32) {
+				f = (d & b) | (~d & c);
+				g = (5 * i + 1) % 16;
+			} else if (i < 48) {
+				f = b ^ c ^ d;
+				g = (3 * i + 5) % 16;
+			} else {
+				f = c ^ (b | ~d);
+				g = (7 * i) % 16;
+			}
+			uint32_t tmp = d;
+			d = c;
+			c = b;
+			b = b + rol32(a + f + md5_k[i] + w[g], md5_r[i / 16 * 4 + i % 4]);
+			a = tmp;
+		}
+		h[0] += a;
+		h[1] += b;
+		h[2] += c;
+		h[3] += d;
+		return;
+	}
+	for (int i = 0; i < 16; i++) {
+		w[i] = (uint32_t)block[i * 4] << 24 | block[i * 4 + 1] << 16 | block[i * 4 + 2] << 8 | block[i * 4 + 3];
+	}
+	if (hash->algorithm == HASH_SHA1) {
+		for (int i = 16; i < 80; i++) {
+			w[i] = rol32(w[i - 3] ^ w[i - 8] ^ w[i - 14] ^ w[i - 16], 1);
+		}
+		uint32_t a = h[0], b = h[1], c = h[2], d = h[3], e = h[4];
+		for (int i = 0; i < 80; i++) {
+			uint32_t f, k;
+			if (i < 20) {
+				f = (b & c) | (~b & d);
+				k = 0x5a827999;
+			} else if (i < 40) {
+				f = b ^ c ^ d;
+				k = 0x6ed9eba1;
+			} else if (i < 60) {
+				f = (b & c) | (b & d) | (c & d);
+				k = 0x8f1bbcdc;
+			} else {
+				f = b ^ c ^ d;
+				k = 0xca62c1d6;
+			}
+			uint32_t tmp = rol32(a, 5) + f + e + k + w[i];
+			e = d;
+			d = c;
+			c = rol32(b, 30);
+			b = a;
+			a = tmp;
+		}
+		h[0] += a;
+		h[1] += b;
+		h[2] += c;
+		h[3] += d;
+		h[4] += e;
+		return;
+	}
+	for (int i = 16; i < 64; i++) {
+		uint32_t s0 = ror32(w[i - 15], 7) ^ ror32(w[i - 15], 18) ^ (w[i - 15] >> 3);
+		uint32_t s1 = ror32(w[i - 2], 17) ^ ror32(w[i - 2], 19) ^ (w[i - 2] >> 10);
+		w[i] = w[i - 16] + s0 + w[i - 7] + s1;
+	}
+	uint32_t v[8];
+	memcpy(v, h, sizeof(v));
+	for (int i = 0; i < 64; i++) {
+		uint32_t s1 = ror32(v[4], 6) ^ ror32(v[4], 11) ^ ror32(v[4], 25);
+		uint32_t ch = (v[4] & v[5]) ^ (~v[4] & v[6]);
+		uint32_t t1 = v[7] + s1 + ch + sha256_k[i] + w[i];
+		uint32_t s0 = ror32(v[0], 2) ^ ror32(v[0], 13) ^ ror32(v[0], 22);
+		uint32_t maj = (v[0] & v[1]) ^ (v[0] & v[2]) ^ (v[1] & v[2]);
+		memmove(&v[1], &v[0], sizeof(uint32_t) * 7);
+		v[4] += t1;
+		v[0] = t1 + s0 + maj;
+	}
+	for (int i = 0; i < 8; i++) {
+		h[i] += v[i];
+	}
+}
+
+// Start a new hash computation.
+void hash_init(hash_t *hash, hash_algorithm_t algorithm) {
+	static const uint32_t initial[4][8] = {
+		{0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476, 0xc3d2e1f0}, // SHA-1
+		{0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476},             // MD5
+		{0xc1059ed8, 0x367cd507, 0x3070dd17, 0xf70e5939, 0xffc00b31, 0x68581511, 0x64f98fa7, 0xbefa4fa4}, // SHA-224
+		{0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19}, // SHA-256
+	};
+	memset(hash, 0, sizeof(*hash));
+	hash->algorithm = algorithm;
+	memcpy(hash->state, initial[algorithm], sizeof(hash->state));
+}
+
+// Add data to the message.
+void hash_update(hash_t *hash, const uint8_t *data, size_t length) {
+	for (size_t i = 0; i < length; i++) {
+		hash->block[hash->length++ % 64] = data[i];
+		if (hash->length % 64 == 0) {
+			hash_block(hash, hash->block);
+		}
+	}
+}
+
+// Finish the hash computation, and return the size of the digest in bytes.
+size_t hash_final(hash_t *hash, uint8_t digest[32]) {
+	static const size_t sizes[4] = {20, 16, 28, 32};
+	uint64_t bits = hash->length * 8;
+	uint8_t padding[72] = {0x80};
+	size_t pad = 64 - (hash->length + 8) % 64;
+	for (int i = 0; i < 8; i++) {
+		// MD5 stores the length little endian, the others big endian.
+		padding[pad + i] = hash->algorithm == HASH_MD5 ? bits >> (i * 8) : bits >> (56 - i * 8);
+	}
+	hash_update(hash, padding, pad + 8);
+	for (size_t i = 0; i < sizes[hash->algorithm]; i++) {
+		uint32_t word = hash->state[i / 4];
+		digest[i] = hash->algorithm == HASH_MD5 ? word >> (i % 4 * 8) : word >> (24 - i % 4 * 8);
+	}
+	return sizes[hash->algorithm];
+}
@@ -0,0 +1,62 @@
+package main
+
+import "unsafe"
+
+// #include "crypto.h"
+import "C"
+
+// This file wraps the cryptographic primitives of crypto.c, which the crypto
+// accelerators of machine.c use, so that they can be checked against known
+// answers from Go.
+
+// Hash algorithms of crypto.h.
+type hashAlgorithm int
+
+const (
+	hashSHA1   hashAlgorithm = C.HASH_SHA1
+	hashMD5    hashAlgorithm = C.HASH_MD5
+	hashSHA224 hashAlgorithm = C.HASH_SHA224
+	hashSHA256 hashAlgorithm = C.HASH_SHA256
+)
+
+// Return a pointer to the first byte of b, or nil if it is empty.
+func cryptoBytes(b []byte) *C.uint8_t {
+	if len(b) == 0 {
+		return nil
+	}
+	return (*C.uint8_t)(unsafe.Pointer(&b[0]))
+}
+
+// Encrypt a single block with AES-128.
+func aes128Encrypt(key, block [16]byte) [16]byte {
+	var out [16]byte
+	C.aes128_encrypt(cryptoBytes(key[:]), cryptoBytes(block[:]), cryptoBytes(out[:]))
+	return out
+}
+
+// Encrypt data with AES-CCM, and return the ciphertext followed by the MIC.
+func aes128CCM(key [16]byte, nonce, adata, data []byte, micLen int) []byte {
+	out := append([]byte(nil), data...)
+	mic := make([]byte, micLen)
+	C.aes128_ccm_mic(cryptoBytes(key[:]), cryptoBytes(nonce), C.size_t(len(nonce)), cryptoBytes(adata), C.size_t(len(adata)), cryptoBytes(data), C.size_t(len(data)), cryptoBytes(mic), C.size_t(micLen))
+	C.aes128_ccm_crypt(cryptoBytes(key[:]), cryptoBytes(nonce), C.size_t(len(nonce)), cryptoBytes(out), C.size_t(len(out)))
+	return append(out, mic...)
+}
+
+// Return the digest of data.
+func hashSum(algorithm hashAlgorithm, data []byte) []byte {
+	var hash C.hash_t
+	var digest [32]byte
+	C.hash_init(&hash, C.hash_algorithm_t(algorithm))
+	C.hash_update(&hash, cryptoBytes(data), C.size_t(len(data)))
+	n := C.hash_final(&hash, cryptoBytes(digest[:]))
+	return digest[:n]
+}
+
+// Add data to a CRC in chunks of the given number of bits, see crc_update.
+func crcUpdate(crc, polynomial, size uint32, data []uint32, bits uint32) uint32 {
+	for _, value := range data {
+		crc = uint32(C.crc_update(C.uint32_t(crc), C.uint32_t(polynomial), C.uint32_t(size), C.uint32_t(value), C.uint32_t(bits)))
+	}
+	return crc
+}
@@ -0,0 +1,32 @@
+#pragma once
+
+#include <stddef.h>
+#include <stdint.h>
+
+// Cryptographic primitives for the crypto accelerators of the emulated chips.
+// They are written for clarity, not speed, and are not meant to protect
+// anything.
+
+// Hash algorithms, see hash_init.
+typedef enum {
+	HASH_SHA1,
+	HASH_MD5,
+	HASH_SHA224,
+	HASH_SHA256,
+} hash_algorithm_t;
+
+// State of a hash computation.
+typedef struct {
+	hash_algorithm_t algorithm;
+	uint32_t state[8];
+	uint64_t length;   // number of bytes hashed so far
+	uint8_t block[64]; // partial block, of length % 64 bytes
+} hash_t;
+
+void aes128_encrypt(const uint8_t key[16], const uint8_t in[16], uint8_t out[16]);
+void aes128_ccm_mic(const uint8_t key[16], const uint8_t *nonce, size_t nonce_len, const uint8_t *adata, size_t adata_len, const uint8_t *data, size_t length, uint8_t *mic, size_t mic_len);
+void aes128_ccm_crypt(const uint8_t key[16], const uint8_t *nonce, size_t nonce_len, uint8_t *data, size_t length);
+uint32_t crc_update(uint32_t crc, uint32_t polynomial, uint32_t size, uint32_t data, uint32_t bits);
+void hash_init(hash_t *hash, hash_algorithm_t algorithm);
+void hash_update(hash_t *hash, const uint8_t *data, size_t length);
+size_t hash_final(hash_t *hash, uint8_t digest[32]);
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// Decode a hex string with optional spaces, as printed in the standards.
+func unhex(t *testing.T, s string) []byte {
+	data, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestAES128(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		key        string
+		plaintext  string
+		ciphertext string
+	}{
+		{"FIPS 197 appendix B", "2b7e1516 28aed2a6 abf71588 09cf4f3c", "3243f6a8 885a308d 313198a2 e0370734", "3925841d 02dc09fb dc118597 196a0b32"},
+		{"FIPS 197 appendix C.1", "00010203 04050607 08090a0b 0c0d0e0f", "00112233 44556677 8899aabb ccddeeff", "69c4e0d8 6a7b0430 d8cdb780 70b4c55a"},
+	} {
+		var key, block [16]byte
+		copy(key[:], unhex(t, tc.key))
+		copy(block[:], unhex(t, tc.plaintext))
+		out := aes128Encrypt(key, block)
+		if got := hex.EncodeToString(out[:]); got != strings.ReplaceAll(tc.ciphertext, " ", "") {
+			t.Errorf("%s: got %s, expected %s", tc.name, got, tc.ciphertext)
+		}
+	}
+}
+
+func TestAES128CCM(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		key    string
+		nonce  string
+		adata  string
+		data   string
+		micLen int
+		output string // ciphertext and MIC
+	}{
+		{
+			"SP 800-38C example 1",
+			"40414243 44454647 48494a4b 4c4d4e4f", "10111213 141516", "00010203 04050607", "20212223", 4,
+			"7162015b 4dac255d",
+		},
+		{
+			"SP 800-38C example 2",
+			"40414243 44454647 48494a4b 4c4d4e4f", "10111213 14151617", "00010203 04050607 08090a0b 0c0d0e0f", "20212223 24252627 28292a2b 2c2d2e2f", 6,
+			"d2a1f0e0 51ea5f62 081a7792 073d593d 1fc64fbf accd",
+		},
+		{
+			"RFC 3610 packet vector 1",
+			"c0c1c2c3 c4c5c6c7 c8c9cacb cccdcecf", "00000003 020100a0 a1a2a3a4 a5", "00010203 04050607", "08090a0b 0c0d0e0f 10111213 14151617 18191a1b 1c1d1e", 8,
+			"588c979a 61c663d2 f066d0c2 c0f98980 6d5f6b61 dac38417 e8d12cfd f926e0",
+		},
+	} {
+		var key [16]byte
+		copy(key[:], unhex(t, tc.key))
+		out := aes128CCM(key, unhex(t, tc.nonce), unhex(t, tc.adata), unhex(t, tc.data), tc.micLen)
+		if got := hex.EncodeToString(out); got != strings.ReplaceAll(tc.output, " ", "") {
+			t.Errorf("%s: got %s, expected %s", tc.name, got, tc.output)
+		}
+	}
+}
+
+func TestHash(t *testing.T) {
+	const twoBlocks = "abcdbcdecdefdefgefghfghighijhijkijkljklmklmnlmnomnopnopq"
+	for _, tc := range []struct {
+		name      string
+		algorithm hashAlgorithm
+		message   string
+		digest    string
+	}{
+		// FIPS 180 examples.
+		{"SHA-1", hashSHA1, "abc", "a9993e36 4706816a ba3e2571 7850c26c 9cd0d89d"},
+		{"SHA-1", hashSHA1, twoBlocks, "84983e44 1c3bd26e baae4aa1 f95129e5 e54670f1"},
+		{"SHA-224", hashSHA224, "abc", "23097d22 3405d822 8642a477 bda255b3 2aadbce4 bda0b3f7 e36c9da7"},
+		{"SHA-224", hashSHA224, twoBlocks, "75388b16 512776cc 5dba5da1 fd890150 b0c6455c b4f58b19 52522525"},
+		{"SHA-256", hashSHA256, "abc", "ba7816bf 8f01cfea 414140de 5dae2223 b00361a3 96177a9c b410ff61 f20015ad"},
+		{"SHA-256", hashSHA256, twoBlocks, "248d6a61 d20638b8 e5c02693 0c3e6039 a33ce459 64ff2167 f6ecedd4 19db06c1"},
+		// RFC 1321 test suite.
+		{"MD5", hashMD5, "", "d41d8cd9 8f00b204 e9800998 ecf8427e"},
+		{"MD5", hashMD5, "abc", "90015098 3cd24fb0 d6963f7d 28e17f72"},
+		{"MD5", hashMD5, "message digest", "f96b697d 7cb7938d 525a2f31 aaf161d0"},
+		{"MD5", hashMD5, "12345678901234567890123456789012345678901234567890123456789012345678901234567890", "57edf4a2 2be3c955 ac49da2e 2107b67a"},
+	} {
+		if got := hex.EncodeToString(hashSum(tc.algorithm, []byte(tc.message))); got != strings.ReplaceAll(tc.digest, " ", "") {
+			t.Errorf("%s of %q: got %s, expected %s", tc.name, tc.message, got, tc.digest)
+		}
+	}
+}
+
+// The check values of the CRC catalogue are the CRC of "123456789".
+func TestCRC(t *testing.T) {
+	var bytes, words []uint32
+	for _, c := range []byte("123456789") {
+		bytes = append(bytes, uint32(c))
+	}
+	words = []uint32{0x31323334, 0x35363738}
+	for _, tc := range []struct {
+		name       string
+		polynomial uint32
+		size       uint32
+		init       uint32
+		check      uint32
+	}{
+		{"CRC-32/MPEG-2", 0x04c11db7, 32, 0xffffffff, 0x0376e6e7},
+		{"CRC-16/XMODEM", 0x1021, 16, 0, 0x31c3},
+		{"CRC-8/SMBUS", 0x07, 8, 0, 0xf4},
+		{"CRC-7/MMC", 0x09, 7, 0, 0x75},
+	} {
+		if got := crcUpdate(tc.init, tc.polynomial, tc.size, bytes, 8); got != tc.check {
+			t.Errorf("%s: got 0x%x, expected 0x%x", tc.name, got, tc.check)
+		}
+		// The STM32 CRC unit adds a word at a time, most significant byte
+		// first.
+		crc := crcUpdate(tc.init, tc.polynomial, tc.size, words, 32)
+		if got := crcUpdate(crc, tc.polynomial, tc.size, bytes[8:], 8); got != tc.check {
+			t.Errorf("%s in words: got 0x%x, expected 0x%x", tc.name, got, tc.check)
+		}
+	}
+}
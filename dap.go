@@ -0,0 +1,1090 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+)
+
+// #include "machine.h"
+import "C"
+
+// This file implements -cmsis-dap: a virtual CMSIS-DAP v2 debug probe that is
+// wired to the emulated core and served over USB/IP. Once usbip attaches it,
+// pyOCD, probe-rs and OpenOCD find it like a probe on a USB port:
+//
+//	emculator run -cmsis-dap=localhost:3240 firmware.elf
+//	sudo modprobe vhci-hcd
+//	sudo usbip attach -r localhost -b 1-1
+//	pyocd commander -t nrf52832
+//
+// The probe has an SW-DP with a single AHB-AP, through which the tools access
+// memory and the debug components of the core: DHCSR, DCRSR, DCRDR and DEMCR
+// to halt, step and access registers, AIRCR to reset, the FPB for breakpoints
+// and a ROM table that lists them. Memory is accessed over the bus like the
+// firmware does, so flash is programmed through the flash controller, with a
+// flash algorithm, like on a real chip. The core keeps running while the tools
+// read memory, it is only paused for each command packet.
+//
+// https://arm-software.github.io/CMSIS_5/DAP/html/group__DAP__Commands__gr.html
+// https://docs.kernel.org/usb/usbip_protocol.html
+
+// CMSIS-DAP commands.
+const (
+	dapInfo              = 0x00
+	dapHostStatus        = 0x01
+	dapConnect           = 0x02
+	dapDisconnect        = 0x03
+	dapTransferConfigure = 0x04
+	dapTransfer          = 0x05
+	dapTransferBlock     = 0x06
+	dapTransferAbort     = 0x07
+	dapWriteABORT        = 0x08
+	dapDelay             = 0x09
+	dapResetTarget       = 0x0a
+	dapSWJPins           = 0x10
+	dapSWJClock          = 0x11
+	dapSWJSequence       = 0x12
+	dapSWDConfigure      = 0x13
+	dapSWDSequence       = 0x1d
+	dapQueueCommands     = 0x7e
+	dapExecuteCommands   = 0x7f
+	dapInvalid           = 0xff
+)
+
+// Bits of a transfer request, and acknowledges of a transfer.
+const (
+	dapRequestAPnDP      = 1 << 0
+	dapRequestRnW        = 1 << 1
+	dapRequestValueMatch = 1 << 4
+	dapRequestMatchMask  = 1 << 5
+
+	dapAckOK       = 1
+	dapAckFault    = 4
+	dapMismatch    = 1 << 4
+	dapMaxPacket   = 512
+	dapPacketCount = 4
+)
+
+// Registers of the debug components, and their values.
+const (
+	dapDPIDR     = 0x2ba01477 // SW-DP of a Cortex-M3/M4
+	dapAPIDR     = 0x24770011 // AHB-AP of a Cortex-M3/M4
+	dapROMTable  = 0xe00ff000
+	dapCPUIDM4   = 0x410fc241
+	dapCPUIDM0   = 0x410cc601
+	dapFPBCodes  = 6 // instruction address comparators of the FPB
+	dapFPBLits   = 2 // literal comparators, which aren't used
+	dapDBGKEY    = 0xa05f
+	dapVECTKEY   = 0x05fa
+	dapDHCSRMask = 0x2f // C_DEBUGEN, C_HALT, C_STEP, C_MASKINTS, C_SNAPSTALL
+)
+
+// Bits of DFSR, which tells why the core halted.
+const (
+	dapDFSRHalted = 1 << 0
+	dapDFSRBkpt   = 1 << 1
+	dapDFSRVCatch = 1 << 3
+)
+
+// The state of the probe: the debug port, the access port and the debug
+// registers of the core that the emulator doesn't implement itself.
+type dapProbe struct {
+	m *Machine
+
+	running bool // whether the machine runs after the current packet
+	wasRun  bool // whether it ran after the previous packet
+	nreset  bool // nRESET is held low, so the core is held in reset
+
+	// Debug port.
+	ctrlStat  uint32
+	selection uint32 // SELECT
+	sticky    bool   // STICKYERR: an access port transfer faulted
+	rdbuff    uint32
+	matchMask uint32
+
+	// The AHB-AP.
+	csw uint32
+	tar uint32
+
+	// Debug registers of the core.
+	dhcsr     uint32 // the control bits that were written
+	dcrdr     uint32
+	demcr     uint32
+	dfsr      uint32
+	resetSeen bool // S_RESET_ST: the core was reset since DHCSR was read
+	fpCtrl    uint32
+	fpComp    [dapFPBCodes + dapFPBLits]uint32
+	fpIDs     [dapFPBCodes]int // IDs of the breakpoints of the comparators
+}
+
+// Serve the probe over USB/IP on the given TCP address, like localhost:3240.
+// One client can import it at a time, others can list it.
+func dapServer(m *Machine, address string) error {
+	sock, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	p := &dapProbe{m: m, csw: 0x03000052}
+	var lock sync.Mutex
+	attached := false
+	for {
+		conn, err := sock.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			imported := false // whether this connection has the probe
+			err := usbipServe(conn, func() bool {
+				lock.Lock()
+				defer lock.Unlock()
+				if attached {
+					return false
+				}
+				attached, imported = true, true
+				return true
+			}, p)
+			if err != nil && !errors.Is(err, io.EOF) {
+				fmt.Fprintln(os.Stderr, "cmsis-dap:", err)
+			}
+			if imported {
+				lock.Lock()
+				attached = false
+				p.release()
+				lock.Unlock()
+			}
+		}()
+	}
+}
+
+// Clean up after the client detached: remove its breakpoints and let the
+// firmware run, like after disconnecting a probe.
+func (p *dapProbe) release() {
+	p.m.Debug(func(running bool) bool {
+		p.m.breakpoints.DeleteFunc(func(bp *Breakpoint) bool {
+			return bp.Owner == BreakpointProbe
+		})
+		if p.dhcsr&(1<<3) != 0 { // C_MASKINTS
+			p.m.SetMaskISR("off")
+		}
+		p.dhcsr = 0
+		p.demcr = 0
+		p.fpCtrl = 0
+		p.fpComp = [len(p.fpComp)]uint32{}
+		p.fpIDs = [len(p.fpIDs)]int{}
+		p.nreset = false
+		p.wasRun = true
+		return true
+	})
+}
+
+// Execute a command packet and return the response, which is empty for
+// DAP_TransferAbort.
+func (p *dapProbe) handle(request []byte) []byte {
+	var response []byte
+	p.m.Debug(func(running bool) bool {
+		if p.wasRun && !running {
+			// The firmware stopped by itself, at a breakpoint or a fault.
+			if p.m.stop != nil && p.m.stop.Reason == StopBreakpoint {
+				p.dfsr |= dapDFSRBkpt
+			} else {
+				p.dfsr |= dapDFSRHalted
+			}
+		}
+		p.running = running && !p.nreset
+		r := &dapReader{data: request}
+		if len(request) != 0 && request[0] == dapTransferAbort {
+			// Transfers are never in progress while a packet arrives.
+		} else if len(request) != 0 && request[0] == dapQueueCommands {
+			// Queued commands are executed right away: the responses go
+			// out in the same order either way.
+			r.data[0] = dapExecuteCommands
+			response = p.command(r)
+		} else {
+			response = p.command(r)
+		}
+		p.wasRun = p.running
+		return p.running
+	})
+	return response
+}
+
+// A reader for the fields of a command, which reads zeros past the end.
+type dapReader struct {
+	data []byte
+}
+
+func (r *dapReader) u8() byte {
+	if len(r.data) < 1 {
+		r.data = nil
+		return 0
+	}
+	v := r.data[0]
+	r.data = r.data[1:]
+	return v
+}
+
+func (r *dapReader) u16() uint16 {
+	return uint16(r.u8()) | uint16(r.u8())<<8
+}
+
+func (r *dapReader) u32() uint32 {
+	return uint32(r.u16()) | uint32(r.u16())<<16
+}
+
+// Execute the command at the start of r, and return its response.
+func (p *dapProbe) command(r *dapReader) []byte {
+	id := r.u8()
+	switch id {
+	case dapInfo:
+		return append([]byte{id}, dapInfoValue(r.u8())...)
+	case dapHostStatus:
+		r.u8()
+		r.u8()
+		return []byte{id, 0}
+	case dapConnect:
+		if port := r.u8(); port == 0 || port == 1 {
+			return []byte{id, 1} // SWD
+		}
+		return []byte{id, 0} // JTAG isn't supported
+	case dapDisconnect, dapDelay:
+		if id == dapDelay {
+			r.u16()
+		}
+		return []byte{id, 0}
+	case dapTransferConfigure:
+		r.u8()
+		r.u16()
+		r.u16()
+		return []byte{id, 0}
+	case dapTransfer:
+		return p.transfer(r)
+	case dapTransferBlock:
+		return p.transferBlock(r)
+	case dapWriteABORT:
+		r.u8()
+		p.writeAbort(r.u32())
+		return []byte{id, 0}
+	case dapResetTarget:
+		// There is no device specific reset sequence: tools reset through
+		// AIRCR or nRESET instead.
+		return []byte{id, 0, 0}
+	case dapSWJPins:
+		output, selected := r.u8(), r.u8()
+		r.u32()
+		if selected&0x80 != 0 {
+			p.setReset(output&0x80 == 0)
+		}
+		pins := byte(0x0f)
+		if !p.nreset {
+			pins |= 0x80
+		}
+		return []byte{id, pins}
+	case dapSWJClock:
+		r.u32()
+		return []byte{id, 0}
+	case dapSWJSequence:
+		// Line resets and the JTAG-to-SWD switch: the debug port is always
+		// ready.
+		n := int(r.u8())
+		if n == 0 {
+			n = 256
+		}
+		for i := 0; i < (n+7)/8; i++ {
+			r.u8()
+		}
+		return []byte{id, 0}
+	case dapSWDConfigure:
+		r.u8()
+		return []byte{id, 0}
+	case dapSWDSequence:
+		response := []byte{id, 0}
+		count := int(r.u8())
+		for i := 0; i < count; i++ {
+			info := r.u8()
+			cycles := int(info & 0x3f)
+			if cycles == 0 {
+				cycles = 64
+			}
+			for j := 0; j < (cycles+7)/8; j++ {
+				if info&0x80 != 0 {
+					// Nothing drives SWDIO.
+					response = append(response, 0)
+				} else {
+					r.u8()
+				}
+			}
+		}
+		return response
+	case dapExecuteCommands:
+		n := r.u8()
+		response := []byte{id, n}
+		for i := 0; i < int(n); i++ {
+			response = append(response, p.command(r)...)
+		}
+		return response
+	}
+	return []byte{dapInvalid}
+}
+
+// Return the response data of DAP_Info: the length and the value.
+func dapInfoValue(id byte) []byte {
+	str := func(s string) []byte {
+		return append([]byte{byte(len(s) + 1)}, append([]byte(s), 0)...)
+	}
+	switch id {
+	case 0x01:
+		return str("eMCUlator")
+	case 0x02:
+		return str("eMCUlator CMSIS-DAP")
+	case 0x03:
+		return str(usbipSerial)
+	case 0x04:
+		return str("2.1.1") // CMSIS-DAP protocol version
+	case 0x09:
+		return str("1.0")
+	case 0xf0:
+		return []byte{1, 0x11} // SWD and atomic commands
+	case 0xfe:
+		return []byte{1, dapPacketCount}
+	case 0xff:
+		return []byte{2, dapMaxPacket & 0xff, dapMaxPacket >> 8}
+	}
+	return []byte{0}
+}
+
+// Execute DAP_Transfer: a list of debug and access port register accesses.
+func (p *dapProbe) transfer(r *dapReader) []byte {
+	r.u8() // index of the device in a JTAG chain
+	count := int(r.u8())
+	response := []byte{dapTransfer, 0, dapAckOK}
+	done := 0
+	for ; done < count; done++ {
+		request := r.u8()
+		var value uint32
+		if request&dapRequestRnW == 0 || request&dapRequestValueMatch != 0 {
+			value = r.u32()
+		}
+		if request&dapRequestRnW == 0 && request&dapRequestMatchMask != 0 {
+			p.matchMask = value
+			continue
+		}
+		if request&dapRequestValueMatch != 0 {
+			// The value can't change while the core is paused, so it is read
+			// only once.
+			match := value
+			ack := p.access(request, &value)
+			response[2] = ack
+			if ack == dapAckOK && value&p.matchMask != match&p.matchMask {
+				response[2] |= dapMismatch
+			}
+		} else {
+			ack := p.access(request, &value)
+			response[2] = ack
+			if ack == dapAckOK && request&dapRequestRnW != 0 {
+				response = binary.LittleEndian.AppendUint32(response, value)
+			}
+		}
+		if response[2] != dapAckOK {
+			break
+		}
+	}
+	// Skip the requests that weren't executed, for DAP_ExecuteCommands.
+	for i := done + 1; i < count; i++ {
+		if request := r.u8(); request&dapRequestRnW == 0 || request&dapRequestValueMatch != 0 {
+			r.u32()
+		}
+	}
+	response[1] = byte(done)
+	return response
+}
+
+// Execute DAP_TransferBlock: many accesses of the same register.
+func (p *dapProbe) transferBlock(r *dapReader) []byte {
+	r.u8()
+	count := int(r.u16())
+	request := r.u8()
+	response := []byte{dapTransferBlock, 0, 0, dapAckOK}
+	done := 0
+	for ; done < count; done++ {
+		var value uint32
+		if request&dapRequestRnW == 0 {
+			value = r.u32()
+		}
+		ack := p.access(request, &value)
+		response[3] = ack
+		if ack != dapAckOK {
+			break
+		}
+		if request&dapRequestRnW != 0 {
+			response = binary.LittleEndian.AppendUint32(response, value)
+		}
+	}
+	binary.LittleEndian.PutUint16(response[1:], uint16(done))
+	return response
+}
+
+// Clear the sticky errors, like a write to the ABORT register.
+func (p *dapProbe) writeAbort(value uint32) {
+	if value&0x1e != 0 { // STKCMPCLR, STKERRCLR, WDERRCLR, ORUNERRCLR
+		p.sticky = false
+	}
+}
+
+// Access a debug port or access port register, and return the acknowledge.
+func (p *dapProbe) access(request byte, value *uint32) byte {
+	read := request&dapRequestRnW != 0
+	address := uint32(request & 0x0c)
+	if request&dapRequestAPnDP == 0 {
+		switch {
+		case address == 0x0 && read:
+			*value = dapDPIDR
+		case address == 0x0:
+			p.writeAbort(*value)
+		case address == 0x4 && read:
+			*value = 0
+			if p.selection&0xf == 0 {
+				// CTRL/STAT: the power-up requests are acknowledged right away.
+				*value = p.ctrlStat | (p.ctrlStat&(1<<28|1<<30))<<1
+				if p.sticky {
+					*value |= 1 << 5 // STICKYERR
+				}
+			}
+		case address == 0x4:
+			if p.selection&0xf == 0 {
+				p.ctrlStat = *value &^ 0xa0000000
+			}
+		case address == 0x8 && read:
+			*value = p.rdbuff // RESEND
+		case address == 0x8:
+			p.selection = *value
+		case address == 0xc && read:
+			*value = p.rdbuff
+		}
+		return dapAckOK
+	}
+	if p.sticky {
+		return dapAckFault
+	}
+	if p.selection>>24 != 0 {
+		// There is only a single access port.
+		if read {
+			*value = 0
+			p.rdbuff = 0
+		}
+		return dapAckOK
+	}
+	switch register := p.selection&0xf0 | address; register {
+	case 0x00: // CSW
+		if read {
+			*value = p.csw | 1<<6 // DeviceEn
+		} else {
+			p.csw = *value &^ (1<<6 | 1<<7)
+		}
+	case 0x04: // TAR
+		if read {
+			*value = p.tar
+		} else {
+			p.tar = *value
+		}
+	case 0x0c: // DRW
+		size := uint32(1) << (p.csw & 7)
+		if size > 4 {
+			size = 4
+		}
+		if !p.memory(p.tar, size, !read, value) {
+			p.sticky = true
+			return dapAckFault
+		}
+		if (p.csw>>4)&3 != 0 { // AddrInc
+			p.tar += size
+		}
+	case 0x10, 0x14, 0x18, 0x1c: // BD0-BD3
+		if !p.memory(p.tar&^0xf|register&0xc, 4, !read, value) {
+			p.sticky = true
+			return dapAckFault
+		}
+	case 0xf4: // CFG: little endian
+		*value = 0
+	case 0xf8: // BASE
+		*value = dapROMTable | 3
+	case 0xfc: // IDR
+		*value = dapAPIDR
+	default:
+		*value = 0
+	}
+	if read {
+		p.rdbuff = *value
+	}
+	return dapAckOK
+}
+
+// Access memory through the AHB-AP. The value is on the byte lanes of the
+// address, like on the bus. It returns false if the access faulted.
+func (p *dapProbe) memory(address, size uint32, store bool, value *uint32) bool {
+	if address >= 0xe0000000 {
+		if handled, ok := p.debugRegister(address&^3, store, value); handled {
+			return ok
+		}
+	}
+	shift := 8 * (address & 3)
+	width := map[uint32]C.width_t{1: C.WIDTH_8, 2: C.WIDTH_16, 4: C.WIDTH_32}[size]
+	data := C.uint32_t(*value >> shift)
+	if C.machine_bus_transfer(p.m.machine, C.uint32_t(address), C.bool(store), &data, width) != 0 {
+		return false
+	}
+	if !store {
+		*value = uint32(data) << shift
+	}
+	return true
+}
+
+// Access the debug components that the probe implements. It returns whether
+// the address is one of them, and whether the access succeeded.
+func (p *dapProbe) debugRegister(address uint32, store bool, value *uint32) (handled, ok bool) {
+	read := func(v uint32) {
+		if !store {
+			*value = v
+		}
+	}
+	switch {
+	case address == 0xe000ed00: // CPUID
+		if p.m.machine.family == C.FAMILY_RP2040 {
+			read(dapCPUIDM0)
+		} else {
+			read(dapCPUIDM4)
+		}
+	case address == 0xe000ed0c: // AIRCR
+		read(0xfa050000)
+		if store && *value>>16 == dapVECTKEY && *value&(1<<2|1<<0) != 0 { // SYSRESETREQ, VECTRESET
+			p.reset(C.RESET_SREQ)
+		}
+	case address == 0xe000ed30: // DFSR
+		read(p.dfsr)
+		if store {
+			p.dfsr &^= *value
+		}
+	case address == 0xe000edf0: // DHCSR
+		if store {
+			p.writeDHCSR(*value)
+		} else {
+			*value = p.readDHCSR()
+		}
+	case address == 0xe000edf4: // DCRSR
+		if store {
+			p.transferCoreRegister(*value&0x7f, *value&(1<<16) != 0)
+		}
+	case address == 0xe000edf8: // DCRDR
+		read(p.dcrdr)
+		if store {
+			p.dcrdr = *value
+		}
+	case address == 0xe000edfc: // DEMCR
+		read(p.demcr)
+		if store {
+			p.demcr = *value & 0x010f07f1
+		}
+	case address >= 0xe000ef40 && address < 0xe000ef4c: // MVFR0-MVFR2: no FPU
+		read(0)
+	case address >= 0xe000efd0 && address < 0xe000f000: // SCS identification
+		read(dapComponentID(address&0xfff, 0x00c, 0xe))
+	case address >= 0xe0001000 && address < 0xe0002000: // DWT, without comparators or counters
+		if address == 0xe0001000 {
+			read(0x0f000000) // NOTRCPKT, NOEXTTRIG, NOCYCCNT, NOPRFCNT
+		} else {
+			read(dapComponentID(address&0xfff, 0x002, 0xe))
+		}
+	case address >= 0xe0002000 && address < 0xe0003000: // FPB
+		p.fpb(address&0xfff, store, value)
+	case address >= dapROMTable && address < dapROMTable+0x1000:
+		// Offsets from the ROM table, with the entry present bit.
+		entries := []uint32{
+			0xfff0f003, // SCS
+			0xfff02003, // DWT
+			0xfff03003, // FPB
+			0xfff01002, // ITM, not present
+		}
+		switch offset := address & 0xfff; {
+		case offset < uint32(4*len(entries)):
+			read(entries[offset/4])
+		case offset == 0xfcc: // MEMTYPE: system memory is present
+			read(1)
+		default:
+			read(dapComponentID(offset, 0x4c4, 0x1))
+		}
+	default:
+		return false, true
+	}
+	return true, true
+}
+
+// Return an identification register of a CoreSight component designed by
+// ARM, at the given offset in its 4kB block: PIDR4 at 0xfd0 to CIDR3 at 0xffc.
+func dapComponentID(offset, part uint32, class uint32) uint32 {
+	switch offset {
+	case 0xfd0: // PIDR4: JEP106 continuation code of ARM
+		return 0x04
+	case 0xfe0: // PIDR0
+		return part & 0xff
+	case 0xfe4: // PIDR1: JEP106 identity code of ARM, 0x3b
+		return part>>8 | 0xb0
+	case 0xfe8: // PIDR2
+		return 0x0b
+	case 0xff0, 0xff4, 0xff8, 0xffc: // CIDR0-CIDR3
+		return [4]uint32{0x0d, class << 4, 0x05, 0xb1}[(offset-0xff0)/4]
+	}
+	return 0
+}
+
+// Return DHCSR with the state of the core.
+func (p *dapProbe) readDHCSR() uint32 {
+	value := p.dhcsr | 1<<16 // S_REGRDY
+	if !p.running {
+		value |= 1 << 17 // S_HALT
+	}
+	if p.resetSeen {
+		value |= 1 << 25 // S_RESET_ST
+		p.resetSeen = false
+	}
+	return value
+}
+
+// Halt, step or resume the core, like a write to DHCSR.
+func (p *dapProbe) writeDHCSR(value uint32) {
+	if value>>16 != dapDBGKEY {
+		return
+	}
+	maskChanged := (p.dhcsr^value)&(1<<3) != 0
+	p.dhcsr = value & dapDHCSRMask
+	if maskChanged {
+		if value&(1<<3) != 0 { // C_MASKINTS
+			p.m.SetMaskISR("on")
+		} else {
+			p.m.SetMaskISR("off")
+		}
+	}
+	if p.nreset {
+		return
+	}
+	debug, halt, step := value&(1<<0) != 0, value&(1<<1) != 0, value&(1<<2) != 0
+	switch {
+	case debug && halt:
+		if p.running {
+			p.running = false
+			p.dfsr |= dapDFSRHalted
+			p.m.stop = &StopError{Reason: StopHalt, PC: p.m.ReadRegister(15) - 1}
+		}
+	case debug && step && !p.running:
+		p.m.stop = p.m.Step()
+		if p.m.stop == nil {
+			p.m.stop = &StopError{Reason: StopHalt, PC: p.m.ReadRegister(15) - 1}
+		}
+		p.dfsr |= dapDFSRHalted
+	default:
+		p.running = true
+	}
+}
+
+// Move a core register to or from DCRDR, like a write to DCRSR. The register
+// numbers are those of DCRSR: r0-r12, sp, lr, the return address, xPSR, MSP,
+// PSP and the special registers. The emulator has a single stack pointer and
+// no FPU, so the FPU registers read as zero.
+func (p *dapProbe) transferCoreRegister(register uint32, write bool) {
+	regs := p.m.DebugRegisters()
+	index := int(register)
+	if register == 17 || register == 18 { // MSP, PSP
+		index = 13
+	}
+	switch {
+	case index <= 16 && write:
+		regs[index] = p.dcrdr
+		p.m.WriteState(&regs)
+	case index <= 16:
+		p.dcrdr = regs[index]
+	case register == 20 && write: // CONTROL, FAULTMASK, BASEPRI, PRIMASK
+		p.m.machine.primask = C.bool(p.dcrdr&1 != 0)
+	case register == 20:
+		p.dcrdr = 0
+		if p.m.machine.primask {
+			p.dcrdr = 1
+		}
+	case !write:
+		p.dcrdr = 0
+	}
+}
+
+// Access a register of the FPB, at the given offset.
+func (p *dapProbe) fpb(offset uint32, store bool, value *uint32) {
+	switch {
+	case offset == 0x000: // FP_CTRL
+		if !store {
+			*value = p.fpCtrl&1 | dapFPBCodes<<4 | dapFPBLits<<8
+		} else if *value&(1<<1) != 0 { // KEY
+			p.fpCtrl = *value & 1
+			for n := range p.fpIDs {
+				p.updateBreakpoint(n)
+			}
+		}
+	case offset == 0x004: // FP_REMAP: remapping isn't supported
+		if !store {
+			*value = 0
+		}
+	case offset >= 0x008 && offset < 0x008+4*uint32(len(p.fpComp)): // FP_COMPn
+		n := int(offset-0x008) / 4
+		if !store {
+			*value = p.fpComp[n]
+		} else {
+			p.fpComp[n] = *value
+			if n < len(p.fpIDs) {
+				p.updateBreakpoint(n)
+			}
+		}
+	default:
+		if !store {
+			*value = dapComponentID(offset, 0x003, 0xe)
+		}
+	}
+}
+
+// Set the breakpoint of an FPB comparator, after FP_CTRL or FP_COMPn changed.
+func (p *dapProbe) updateBreakpoint(n int) {
+	if p.fpIDs[n] != 0 {
+		p.m.breakpoints.Delete(p.fpIDs[n])
+		p.fpIDs[n] = 0
+	}
+	comp := p.fpComp[n]
+	if p.fpCtrl&1 == 0 || comp&1 == 0 {
+		return
+	}
+	address := comp & 0x1ffffffc
+	if comp>>30 == 2 { // REPLACE: the upper halfword
+		address |= 2
+	}
+	bp, err := p.m.breakpoints.Add(Breakpoint{Address: address, Kind: BreakpointHardware, Owner: BreakpointProbe})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "cmsis-dap:", err)
+		return
+	}
+	p.fpIDs[n] = bp.ID
+}
+
+// Reset the chip. The core halts at the reset vector when DEMCR.VC_CORERESET
+// is set, and runs otherwise.
+func (p *dapProbe) reset(reason C.uint32_t) {
+	C.machine_reset_cause(p.m.machine, reason)
+	p.resetSeen = true
+	p.m.exited = false
+	if p.dhcsr&1 != 0 && p.demcr&1 != 0 { // C_DEBUGEN, VC_CORERESET
+		p.running = false
+		p.dfsr |= dapDFSRVCatch
+		p.m.stop = &StopError{Reason: StopHalt, PC: p.m.ReadRegister(15) - 1}
+	} else {
+		p.running = true
+	}
+}
+
+// Drive the nRESET pin: the core is held in reset while it is low, and starts
+// from the reset vector when it is released.
+func (p *dapProbe) setReset(low bool) {
+	if low && !p.nreset {
+		p.nreset = true
+		p.running = false
+		p.m.stop = &StopError{Reason: StopHalt, PC: p.m.ReadRegister(15) - 1}
+	} else if !low && p.nreset {
+		p.nreset = false
+		p.reset(C.RESET_PIN)
+	}
+}
+
+// USB/IP.
+const (
+	usbipVersion      = 0x0111
+	usbipReqDevlist   = 0x8005
+	usbipRepDevlist   = 0x0005
+	usbipReqImport    = 0x8003
+	usbipRepImport    = 0x0003
+	usbipCmdSubmit    = 1
+	usbipCmdUnlink    = 2
+	usbipRetSubmit    = 3
+	usbipRetUnlink    = 4
+	usbipBusID        = "1-1"
+	usbipSerial       = "emculator-1"
+	usbipSpeedHigh    = 3
+	usbipEPIPE        = -32  // the control request isn't supported (a stall)
+	usbipECONNRESET   = -104 // the request was unlinked
+	usbipVendorID     = 0x1209
+	usbipProductID    = 0x0001 // the test product ID of pid.codes
+	usbipDeviceNumber = 2
+)
+
+// The header of a request or reply before a device is imported.
+type usbipOpHeader struct {
+	Version uint16
+	Code    uint16
+	Status  uint32
+}
+
+// A device in the reply to a list or import request.
+type usbipDevice struct {
+	Path               [256]byte
+	BusID              [32]byte
+	BusNum             uint32
+	DevNum             uint32
+	Speed              uint32
+	VendorID           uint16
+	ProductID          uint16
+	BCDDevice          uint16
+	DeviceClass        uint8
+	DeviceSubClass     uint8
+	DeviceProtocol     uint8
+	ConfigurationValue uint8
+	NumConfigurations  uint8
+	NumInterfaces      uint8
+}
+
+// The header of a URB request or reply, once the device is imported.
+type usbipHeader struct {
+	Command   uint32
+	SeqNum    uint32
+	DevID     uint32
+	Direction uint32 // 0 for OUT, 1 for IN
+	EP        uint32
+}
+
+type usbipSubmit struct {
+	TransferFlags   uint32
+	BufferLength    uint32
+	StartFrame      uint32
+	NumberOfPackets uint32
+	Interval        uint32
+	Setup           [8]byte
+}
+
+type usbipRetSubmitBody struct {
+	Status          int32
+	ActualLength    uint32
+	StartFrame      uint32
+	NumberOfPackets uint32
+	ErrorCount      uint32
+	_               [8]byte
+}
+
+type usbipRetUnlinkBody struct {
+	Status int32
+	_      [24]byte
+}
+
+// The descriptors of the probe: a single vendor specific interface with a
+// bulk OUT and a bulk IN endpoint, which CMSIS-DAP v2 tools find by the
+// "CMSIS-DAP" in its name.
+var (
+	usbipDeviceDescriptor = []byte{
+		18, 1, 0x00, 0x02, // USB 2.0
+		0, 0, 0, 64,
+		usbipVendorID & 0xff, usbipVendorID >> 8, usbipProductID & 0xff, usbipProductID >> 8,
+		0x00, 0x01, // device release 1.0
+		1, 2, 3, // manufacturer, product and serial number strings
+		1, // configurations
+	}
+	usbipConfigDescriptor = []byte{
+		9, 2, 32, 0, 1, 1, 0, 0x80, 50, // 1 interface, bus powered, 100mA
+		9, 4, 0, 0, 2, 0xff, 0, 0, 4, // interface 0: vendor specific, string 4
+		7, 5, 0x01, 0x02, dapMaxPacket & 0xff, dapMaxPacket >> 8, 0, // bulk OUT
+		7, 5, 0x81, 0x02, dapMaxPacket & 0xff, dapMaxPacket >> 8, 0, // bulk IN
+	}
+	usbipQualifierDescriptor = []byte{10, 6, 0x00, 0x02, 0, 0, 0, 64, 1, 0}
+	usbipStrings             = []string{"", "eMCUlator", "eMCUlator CMSIS-DAP", usbipSerial, "eMCUlator CMSIS-DAP"}
+)
+
+// Describe the probe for a list or import reply.
+func usbipDescribe() usbipDevice {
+	d := usbipDevice{
+		BusNum:             1,
+		DevNum:             usbipDeviceNumber,
+		Speed:              usbipSpeedHigh,
+		VendorID:           usbipVendorID,
+		ProductID:          usbipProductID,
+		BCDDevice:          0x0100,
+		ConfigurationValue: 1,
+		NumConfigurations:  1,
+		NumInterfaces:      1,
+	}
+	copy(d.Path[:], "/sys/devices/emculator/usb1/"+usbipBusID)
+	copy(d.BusID[:], usbipBusID)
+	return d
+}
+
+// A bulk IN request that waits for a response.
+type usbipPending struct {
+	seqNum uint32
+	length uint32
+}
+
+// Serve a USB/IP connection: a list request, or an import request followed by
+// the URBs of the imported device. The attach function reserves the probe for
+// the connection, it returns false if another client has it.
+func usbipServe(conn io.ReadWriter, attach func() bool, p *dapProbe) error {
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	var op usbipOpHeader
+	if err := binary.Read(r, binary.BigEndian, &op); err != nil {
+		return err
+	}
+	switch op.Code {
+	case usbipReqDevlist:
+		binary.Write(w, binary.BigEndian, usbipOpHeader{usbipVersion, usbipRepDevlist, 0})
+		binary.Write(w, binary.BigEndian, uint32(1))
+		binary.Write(w, binary.BigEndian, usbipDescribe())
+		w.Write([]byte{0xff, 0, 0, 0}) // the interface: vendor specific
+		return w.Flush()
+	case usbipReqImport:
+		var busID [32]byte
+		if _, err := io.ReadFull(r, busID[:]); err != nil {
+			return err
+		}
+		if string(bytes.TrimRight(busID[:], "\x00")) != usbipBusID || !attach() {
+			binary.Write(w, binary.BigEndian, usbipOpHeader{usbipVersion, usbipRepImport, 1})
+			return w.Flush()
+		}
+		binary.Write(w, binary.BigEndian, usbipOpHeader{usbipVersion, usbipRepImport, 0})
+		binary.Write(w, binary.BigEndian, usbipDescribe())
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown USB/IP request 0x%04x", op.Code)
+	}
+
+	// The device is imported: handle its URBs. Bulk IN requests wait for the
+	// response to the next command.
+	var pending []usbipPending
+	var responses [][]byte
+	reply := func(seqNum uint32, status int32, data []byte) error {
+		binary.Write(w, binary.BigEndian, usbipHeader{Command: usbipRetSubmit, SeqNum: seqNum})
+		binary.Write(w, binary.BigEndian, usbipRetSubmitBody{Status: status, ActualLength: uint32(len(data))})
+		w.Write(data)
+		return w.Flush()
+	}
+	for {
+		var header usbipHeader
+		if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+			return err
+		}
+		switch header.Command {
+		case usbipCmdSubmit:
+			var submit usbipSubmit
+			if err := binary.Read(r, binary.BigEndian, &submit); err != nil {
+				return err
+			}
+			if submit.BufferLength > dapMaxPacket {
+				// All endpoints transfer at most a packet at a time.
+				return fmt.Errorf("URB of %d bytes is larger than the maximum packet size", submit.BufferLength)
+			}
+			var out []byte
+			if header.Direction == 0 {
+				out = make([]byte, submit.BufferLength)
+				if _, err := io.ReadFull(r, out); err != nil {
+					return err
+				}
+			}
+			var err error
+			switch {
+			case header.EP == 0:
+				data, status := usbipControl(submit.Setup)
+				if len(data) > int(submit.BufferLength) {
+					data = data[:submit.BufferLength]
+				}
+				err = reply(header.SeqNum, status, data)
+			case header.Direction == 0:
+				if response := p.handle(out); len(response) != 0 {
+					responses = append(responses, response)
+				}
+				err = reply(header.SeqNum, 0, nil)
+			default:
+				pending = append(pending, usbipPending{header.SeqNum, submit.BufferLength})
+			}
+			for err == nil && len(pending) != 0 && len(responses) != 0 {
+				data := responses[0]
+				if len(data) > int(pending[0].length) {
+					data = data[:pending[0].length]
+				}
+				err = reply(pending[0].seqNum, 0, data)
+				pending, responses = pending[1:], responses[1:]
+			}
+			if err != nil {
+				return err
+			}
+		case usbipCmdUnlink:
+			var unlink struct {
+				SeqNum uint32
+				_      [24]byte
+			}
+			if err := binary.Read(r, binary.BigEndian, &unlink); err != nil {
+				return err
+			}
+			// Only bulk IN requests can still be waiting.
+			status := int32(0)
+			for i, request := range pending {
+				if request.seqNum == unlink.SeqNum {
+					pending = append(pending[:i], pending[i+1:]...)
+					status = usbipECONNRESET
+					break
+				}
+			}
+			binary.Write(w, binary.BigEndian, usbipHeader{Command: usbipRetUnlink, SeqNum: header.SeqNum})
+			binary.Write(w, binary.BigEndian, usbipRetUnlinkBody{Status: status})
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown USB/IP command %d", header.Command)
+		}
+	}
+}
+
+// Handle a request on the control endpoint, and return the data and status.
+func usbipControl(setup [8]byte) ([]byte, int32) {
+	requestType, request := setup[0], setup[1]
+	value := binary.LittleEndian.Uint16(setup[2:])
+	switch {
+	case requestType == 0x80 && request == 6: // GET_DESCRIPTOR
+		switch index := int(value & 0xff); value >> 8 {
+		case 1:
+			return usbipDeviceDescriptor, 0
+		case 2:
+			return usbipConfigDescriptor, 0
+		case 3:
+			if index == 0 {
+				return []byte{4, 3, 0x09, 0x04}, 0 // English (United States)
+			}
+			if index < len(usbipStrings) {
+				s := []byte{0, 3}
+				for _, c := range usbipStrings[index] {
+					s = append(s, byte(c), 0)
+				}
+				s[0] = byte(len(s))
+				return s, 0
+			}
+		case 6:
+			return usbipQualifierDescriptor, 0
+		}
+	case requestType == 0x80 && request == 8: // GET_CONFIGURATION
+		return []byte{1}, 0
+	case requestType == 0x81 && request == 10: // GET_INTERFACE
+		return []byte{0}, 0
+	case requestType&0x80 != 0 && request == 0: // GET_STATUS
+		return []byte{0, 0}, 0
+	case requestType&0x80 == 0 && (request == 1 || request == 3 || request == 9 || request == 11):
+		// CLEAR_FEATURE, SET_FEATURE, SET_CONFIGURATION and SET_INTERFACE
+		// have nothing to change.
+		return nil, 0
+	}
+	return nil, usbipEPIPE
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// #include "machine.h"
+import "C"
+
+// This file sets the factory information of the emulated chip, which firmware
+// reads to identify the device, with -device (repeatable):
+//
+//	id=HEX                   unique ID: the 64-bit FICR.DEVICEID of an nRF or
+//	                         the 96-bit UID of an STM32, like id=0123456789abcdef
+//	addr=XX:XX:XX:XX:XX:XX   Bluetooth device address in FICR.DEVICEADDR (nRF)
+//	temperature=DEGREES      die temperature, as measured by TEMP (nRF)
+//	uicr:OFFSET=VALUE        a register of the UICR (nRF), like uicr:0x200=21
+//
+// The ID is a number: its least significant byte is the first byte in memory.
+// By default the ID reads as "Emul" and "ator" in hex dumps, its first 6 bytes
+// are the Bluetooth address and the die temperature is 25 °C.
+
+// Apply the -device settings to a machine that hasn't been reset yet.
+func setDeviceInfo(machine *C.machine_t, specs []string) error {
+	device := machine.device
+	for _, spec := range specs {
+		key, value, ok := strings.Cut(spec, "=")
+		if !ok {
+			return fmt.Errorf("invalid setting %#v, expected KEY=VALUE", spec)
+		}
+		switch {
+		case key == "id":
+			b, err := hex.DecodeString(strings.TrimPrefix(value, "0x"))
+			if err != nil || len(b) == 0 || len(b) > len(device.id) {
+				return fmt.Errorf("invalid id %#v, expected up to 24 hexadecimal digits", value)
+			}
+			for i := range device.id {
+				device.id[i] = 0
+				if i < len(b) {
+					device.id[i] = C.uint8_t(b[len(b)-1-i])
+				}
+			}
+		case key == "addr":
+			b, err := hex.DecodeString(strings.ReplaceAll(value, ":", ""))
+			if err != nil || len(b) != len(device.addr) {
+				return fmt.Errorf("invalid addr %#v, expected something like c0:de:45:6d:75:6c", value)
+			}
+			for i := range device.addr {
+				device.addr[i] = C.uint8_t(b[len(b)-1-i])
+			}
+		case key == "temperature":
+			t, err := strconv.ParseFloat(value, 64)
+			if err != nil || t < -273.15 || t > 1000 {
+				return fmt.Errorf("invalid temperature %#v", value)
+			}
+			device.temperature = C.int32_t(math.Round(t * 100))
+		case strings.HasPrefix(key, "uicr:"):
+			offset, err := strconv.ParseUint(key[len("uicr:"):], 0, 32)
+			if err != nil || offset%4 != 0 || offset >= uint64(len(machine.uicr)*4) {
+				return fmt.Errorf("invalid UICR offset %#v, expected a multiple of 4 below 0x400", key[len("uicr:"):])
+			}
+			n, err := strconv.ParseUint(value, 0, 32)
+			if err != nil {
+				return fmt.Errorf("invalid UICR value %#v", value)
+			}
+			machine.uicr[offset/4] = C.uint32_t(n)
+		default:
+			return fmt.Errorf("unknown setting %#v, expected id, addr, temperature or uicr:OFFSET", key)
+		}
+	}
+	C.machine_set_device_info(machine, (*C.uint8_t)(unsafe.Pointer(&device.id[0])), (*C.uint8_t)(unsafe.Pointer(&device.addr[0])), device.temperature)
+	return nil
+}
@@ -0,0 +1,499 @@
+#include "disasm.h"
+
+#include <stdio.h>
+
+// This file implements a disassembler for the Thumb and Thumb-2 instruction
+// sets, as used by the trace output, fault reports and the monitor. The syntax
+// follows objdump (unified syntax) closely, but not exactly.
+// For the encodings, see the ARMv7-M Architecture Reference Manual, chapter
+// A5 and A6.
+
+static const char *disasm_regs[16] = {
+	"r0", "r1", "r2", "r3", "r4", "r5", "r6", "r7",
+	"r8", "r9", "r10", "r11", "r12", "sp", "lr", "pc",
+};
+
+static const char *disasm_conds[16] = {
+	"eq", "ne", "cs", "cc", "mi", "pl", "vs", "vc",
+	"hi", "ls", "ge", "lt", "gt", "le", "", "",
+};
+
+static const char *disasm_shifts[4] = {"lsl", "lsr", "asr", "ror"};
+
+// Return the name of a special register as used by MRS and MSR.
+static const char * disasm_sysreg(uint32_t sysm) {
+	switch (sysm) {
+	case 0: return "apsr";
+	case 1: return "iapsr";
+	case 2: return "eapsr";
+	case 3: return "xpsr";
+	case 5: return "ipsr";
+	case 6: return "epsr";
+	case 7: return "iepsr";
+	case 8: return "msp";
+	case 9: return "psp";
+	case 16: return "primask";
+	case 17: return "basepri";
+	case 18: return "basepri_max";
+	case 19: return "faultmask";
+	case 20: return "control";
+	default: return "?";
+	}
+}
+
+// Format a register list like {r4, r5, lr}.
+static void disasm_reglist(uint32_t list, char *buf, size_t len) {
+	size_t n = 0;
+	n += snprintf(buf + n, len - n, "{");
+	bool first = true;
+	for (int i=0; i<16 && n < len; i++) {
+		if (list & (1 << i)) {
+			n += snprintf(buf + n, len - n, "%s%s", first ? "" : ", ", disasm_regs[i]);
+			first = false;
+		}
+	}
+	if (n < len) {
+		snprintf(buf + n, len - n, "}");
+	}
+}
+
+// Decode a Thumb-2 modified immediate constant (ThumbExpandImm).
+static uint32_t disasm_expand_imm(uint32_t imm12) {
+	uint32_t imm8 = imm12 & 0xff;
+	if ((imm12 >> 10) == 0) {
+		switch ((imm12 >> 8) & 0b11) {
+		case 0:
+			return imm8;
+		case 1:
+			return imm8 << 16 | imm8;
+		case 2:
+			return imm8 << 24 | imm8 << 8;
+		default:
+			return imm8 << 24 | imm8 << 16 | imm8 << 8 | imm8;
+		}
+	}
+	uint32_t value = 0x80 | (imm12 & 0x7f);
+	uint32_t rotate = imm12 >> 7;
+	return (value >> rotate) | (value << (32 - rotate));
+}
+
+// Disassemble a 16-bit Thumb instruction.
+static void disasm_thumb16(uint32_t address, uint16_t hw, char *buf, size_t len) {
+	uint32_t rd = hw & 0b111;
+	uint32_t rn = (hw >> 3) & 0b111;
+	uint32_t rm = (hw >> 6) & 0b111;
+	uint32_t imm8 = hw & 0xff;
+	uint32_t r8 = (hw >> 8) & 0b111;
+
+	if ((hw >> 11) == 0b00011) {
+		// Add/subtract register or 3-bit immediate
+		const char *op = (hw >> 9) & 1 ? "subs" : "adds";
+		if ((hw >> 10) & 1) {
+			snprintf(buf, len, "%s %s, %s, #%u", op, disasm_regs[rd], disasm_regs[rn], rm);
+		} else {
+			snprintf(buf, len, "%s %s, %s, %s", op, disasm_regs[rd], disasm_regs[rn], disasm_regs[rm]);
+		}
+	} else if ((hw >> 13) == 0b000) {
+		// Shift by immediate
+		uint32_t imm5 = (hw >> 6) & 0x1f;
+		uint32_t op = (hw >> 11) & 0b11;
+		if (op == 0 && imm5 == 0) {
+			snprintf(buf, len, "movs %s, %s", disasm_regs[rd], disasm_regs[rn]);
+		} else {
+			if (op != 0 && imm5 == 0) {
+				imm5 = 32;
+			}
+			snprintf(buf, len, "%ss %s, %s, #%u", disasm_shifts[op], disasm_regs[rd], disasm_regs[rn], imm5);
+		}
+	} else if ((hw >> 13) == 0b001) {
+		// Move/compare/add/subtract immediate
+		static const char *ops[4] = {"movs", "cmp", "adds", "subs"};
+		snprintf(buf, len, "%s %s, #%u", ops[(hw >> 11) & 0b11], disasm_regs[r8], imm8);
+	} else if ((hw >> 10) == 0b010000) {
+		// Data processing
+		static const char *ops[16] = {
+			"ands", "eors", "lsls", "lsrs", "asrs", "adcs", "sbcs", "rors",
+			"tst", "rsbs", "cmp", "cmn", "orrs", "muls", "bics", "mvns",
+		};
+		uint32_t op = (hw >> 6) & 0xf;
+		if (op == 9) {
+			snprintf(buf, len, "rsbs %s, %s, #0", disasm_regs[rd], disasm_regs[rn]);
+		} else if (op == 13) {
+			snprintf(buf, len, "muls %s, %s, %s", disasm_regs[rd], disasm_regs[rn], disasm_regs[rd]);
+		} else {
+			snprintf(buf, len, "%s %s, %s", ops[op], disasm_regs[rd], disasm_regs[rn]);
+		}
+	} else if ((hw >> 10) == 0b010001) {
+		// Special data instructions and branch and exchange
+		uint32_t rdn = (hw & 0b111) | ((hw >> 4) & 0b1000);
+		uint32_t rms = (hw >> 3) & 0xf;
+		switch ((hw >> 8) & 0b11) {
+		case 0:
+			snprintf(buf, len, "add %s, %s", disasm_regs[rdn], disasm_regs[rms]);
+			break;
+		case 1:
+			snprintf(buf, len, "cmp %s, %s", disasm_regs[rdn], disasm_regs[rms]);
+			break;
+		case 2:
+			snprintf(buf, len, "mov %s, %s", disasm_regs[rdn], disasm_regs[rms]);
+			break;
+		case 3:
+			snprintf(buf, len, "%s %s", (hw >> 7) & 1 ? "blx" : "bx", disasm_regs[rms]);
+			break;
+		}
+	} else if ((hw >> 11) == 0b01001) {
+		// Load from literal pool
+		uint32_t target = ((address + 4) & ~3) + imm8 * 4;
+		snprintf(buf, len, "ldr %s, [pc, #%u] ; 0x%x", disasm_regs[r8], imm8 * 4, target);
+	} else if ((hw >> 12) == 0b0101) {
+		// Load/store register offset
+		static const char *ops[8] = {"str", "strh", "strb", "ldrsb", "ldr", "ldrh", "ldrb", "ldrsh"};
+		snprintf(buf, len, "%s %s, [%s, %s]", ops[(hw >> 9) & 0b111], disasm_regs[rd], disasm_regs[rn], disasm_regs[rm]);
+	} else if ((hw >> 13) == 0b011 || (hw >> 12) == 0b1000) {
+		// Load/store immediate offset
+		uint32_t imm5 = (hw >> 6) & 0x1f;
+		bool load = (hw >> 11) & 1;
+		const char *op;
+		if ((hw >> 12) == 0b1000) {
+			op = load ? "ldrh" : "strh";
+			imm5 *= 2;
+		} else if ((hw >> 12) & 1) {
+			op = load ? "ldrb" : "strb";
+		} else {
+			op = load ? "ldr" : "str";
+			imm5 *= 4;
+		}
+		if (imm5 == 0) {
+			snprintf(buf, len, "%s %s, [%s]", op, disasm_regs[rd], disasm_regs[rn]);
+		} else {
+			snprintf(buf, len, "%s %s, [%s, #%u]", op, disasm_regs[rd], disasm_regs[rn], imm5);
+		}
+	} else if ((hw >> 12) == 0b1001) {
+		// Load/store SP-relative
+		snprintf(buf, len, "%s %s, [sp, #%u]", (hw >> 11) & 1 ? "ldr" : "str", disasm_regs[r8], imm8 * 4);
+	} else if ((hw >> 11) == 0b10100) {
+		// Generate PC-relative address
+		snprintf(buf, len, "adr %s, 0x%x", disasm_regs[r8], ((address + 4) & ~3) + imm8 * 4);
+	} else if ((hw >> 11) == 0b10101) {
+		// Generate SP-relative address
+		snprintf(buf, len, "add %s, sp, #%u", disasm_regs[r8], imm8 * 4);
+	} else if ((hw >> 12) == 0b1011) {
+		// Miscellaneous 16-bit instructions
+		if ((hw >> 8) == 0b10110000) {
+			snprintf(buf, len, "%s sp, #%u", (hw >> 7) & 1 ? "sub" : "add", (hw & 0x7f) * 4);
+		} else if ((hw & 0xf500) == 0xb100) {
+			uint32_t offset = ((hw >> 3) & 0x1f) << 1 | ((hw >> 9) & 1) << 6;
+			snprintf(buf, len, "%s %s, 0x%x", (hw >> 11) & 1 ? "cbnz" : "cbz", disasm_regs[rd], address + 4 + offset);
+		} else if ((hw >> 8) == 0b10110010) {
+			static const char *ops[4] = {"sxth", "sxtb", "uxth", "uxtb"};
+			snprintf(buf, len, "%s %s, %s", ops[(hw >> 6) & 0b11], disasm_regs[rd], disasm_regs[rn]);
+		} else if ((hw >> 9) == 0b1011010 || (hw >> 9) == 0b1011110) {
+			bool pop = (hw >> 11) & 1;
+			uint32_t list = imm8;
+			if ((hw >> 8) & 1) {
+				list |= 1 << (pop ? 15 : 14);
+			}
+			char reglist[80];
+			disasm_reglist(list, reglist, sizeof(reglist));
+			snprintf(buf, len, "%s %s", pop ? "pop" : "push", reglist);
+		} else if ((hw & 0xffe8) == 0xb660) {
+			static const char *flags[4] = {"", "f", "i", "if"};
+			snprintf(buf, len, "cps%s %s", (hw >> 4) & 1 ? "id" : "ie", flags[hw & 0b11]);
+		} else if ((hw >> 8) == 0b10111010 && ((hw >> 6) & 0b11) != 2) {
+			static const char *ops[4] = {"rev", "rev16", "", "revsh"};
+			snprintf(buf, len, "%s %s, %s", ops[(hw >> 6) & 0b11], disasm_regs[rd], disasm_regs[rn]);
+		} else if ((hw >> 8) == 0b10111110) {
+			snprintf(buf, len, "bkpt #%u", imm8);
+		} else if ((hw >> 8) == 0b10111111 && (hw & 0xf) != 0) {
+			// IT block: the mask encodes then/else for up to three more
+			// instructions.
+			uint32_t firstcond = (hw >> 4) & 0xf;
+			uint32_t mask = hw & 0xf;
+			char suffix[4] = {0};
+			int n = 0;
+			int end = mask & 1 ? 3 : mask & 2 ? 2 : mask & 4 ? 1 : 0;
+			for (int i=0; i<end; i++) {
+				bool bit = (mask >> (3 - i)) & 1;
+				suffix[n++] = bit == (firstcond & 1) ? 't' : 'e';
+			}
+			snprintf(buf, len, "it%s %s", suffix, disasm_conds[firstcond]);
+		} else if ((hw >> 8) == 0b10111111) {
+			static const char *hints[5] = {"nop", "yield", "wfe", "wfi", "sev"};
+			uint32_t op = (hw >> 4) & 0xf;
+			if (op < 5) {
+				snprintf(buf, len, "%s", hints[op]);
+			} else {
+				snprintf(buf, len, "hint #%u", op);
+			}
+		} else {
+			snprintf(buf, len, ".inst.n 0x%04x", hw);
+		}
+	} else if ((hw >> 12) == 0b1100) {
+		// Load/store multiple
+		bool load = (hw >> 11) & 1;
+		char reglist[80];
+		disasm_reglist(imm8, reglist, sizeof(reglist));
+		// The base register is only written back when it isn't in the list
+		// of a load.
+		bool writeback = !load || !(imm8 & (1 << r8));
+		snprintf(buf, len, "%s %s%s, %s", load ? "ldm" : "stm", disasm_regs[r8], writeback ? "!" : "", reglist);
+	} else if ((hw >> 12) == 0b1101) {
+		// Conditional branch, UDF and SVC
+		uint32_t cond = (hw >> 8) & 0xf;
+		if (cond == 0b1110) {
+			snprintf(buf, len, "udf #%u", imm8);
+		} else if (cond == 0b1111) {
+			snprintf(buf, len, "svc #%u", imm8);
+		} else {
+			int32_t offset = (int32_t)(int8_t)imm8 * 2;
+			snprintf(buf, len, "b%s 0x%x", disasm_conds[cond], address + 4 + offset);
+		}
+	} else if ((hw >> 11) == 0b11100) {
+		// Unconditional branch
+		int32_t offset = (int32_t)((uint32_t)hw << 21) >> 20;
+		snprintf(buf, len, "b 0x%x", address + 4 + offset);
+	} else {
+		snprintf(buf, len, ".inst.n 0x%04x", hw);
+	}
+}
+
+// Disassemble a 32-bit Thumb-2 instruction.
+static void disasm_thumb32(uint32_t address, uint16_t hw1, uint16_t hw2, char *buf, size_t len) {
+	uint32_t rn = hw1 & 0xf;
+	uint32_t rt = (hw2 >> 12) & 0xf;
+	uint32_t rd = (hw2 >> 8) & 0xf;
+	uint32_t rm = hw2 & 0xf;
+	bool setflags = (hw1 >> 4) & 1;
+
+	if ((hw1 >> 11) == 0b11110 && (hw2 >> 15) == 1) {
+		// Branches and miscellaneous control
+		if (hw1 == 0xf3bf && (hw2 & 0xff00) == 0x8f00) {
+			static const char *ops[16] = {
+				[4] = "dsb", [5] = "dmb", [6] = "isb",
+			};
+			const char *op = ops[(hw2 >> 4) & 0xf];
+			if (op != NULL) {
+				snprintf(buf, len, "%s sy", op);
+			} else {
+				snprintf(buf, len, ".inst.w 0x%04x%04x", hw1, hw2);
+			}
+		} else if ((hw1 & 0xfff0) == 0xf380 && (hw2 & 0xff00) == 0x8800) {
+			snprintf(buf, len, "msr %s, %s", disasm_sysreg(hw2 & 0xff), disasm_regs[rn]);
+		} else if (hw1 == 0xf3ef && (hw2 & 0xf000) == 0x8000) {
+			snprintf(buf, len, "mrs %s, %s", disasm_regs[rd], disasm_sysreg(hw2 & 0xff));
+		} else if ((hw1 & 0xfff0) == 0xf7f0 && (hw2 & 0xf000) == 0xa000) {
+			snprintf(buf, len, "udf.w #%u", (hw1 & 0xf) << 12 | (hw2 & 0xfff));
+		} else {
+			uint32_t s = (hw1 >> 10) & 1;
+			uint32_t j1 = (hw2 >> 13) & 1;
+			uint32_t j2 = (hw2 >> 11) & 1;
+			if ((hw2 >> 12) & 1) {
+				// BL or B.W
+				uint32_t i1 = !(j1 ^ s);
+				uint32_t i2 = !(j2 ^ s);
+				uint32_t imm = s << 24 | i1 << 23 | i2 << 22 | (hw1 & 0x3ff) << 12 | (hw2 & 0x7ff) << 1;
+				int32_t offset = (int32_t)(imm << 7) >> 7;
+				snprintf(buf, len, "%s 0x%x", (hw2 >> 14) & 1 ? "bl" : "b.w", address + 4 + offset);
+			} else if ((hw2 >> 14) == 0b10) {
+				// Conditional branch
+				uint32_t imm = s << 20 | j2 << 19 | j1 << 18 | (hw1 & 0x3f) << 12 | (hw2 & 0x7ff) << 1;
+				int32_t offset = (int32_t)(imm << 11) >> 11;
+				snprintf(buf, len, "b%s.w 0x%x", disasm_conds[(hw1 >> 6) & 0xf], address + 4 + offset);
+			} else {
+				snprintf(buf, len, ".inst.w 0x%04x%04x", hw1, hw2);
+			}
+		}
+	} else if ((hw1 >> 11) == 0b11110 && ((hw1 >> 9) & 1) == 0) {
+		// Data processing (modified immediate)
+		uint32_t imm12 = ((hw1 >> 10) & 1) << 11 | ((hw2 >> 12) & 0b111) << 8 | (hw2 & 0xff);
+		uint32_t imm = disasm_expand_imm(imm12);
+		uint32_t op = (hw1 >> 5) & 0xf;
+		const char *s = setflags ? "s" : "";
+		if (rd == 15 && setflags && (op == 0 || op == 4 || op == 8 || op == 13)) {
+			static const char *ops[16] = {[0] = "tst", [4] = "teq", [8] = "cmn", [13] = "cmp"};
+			snprintf(buf, len, "%s.w %s, #%u", ops[op], disasm_regs[rn], imm);
+		} else if (rn == 15 && (op == 2 || op == 3)) {
+			snprintf(buf, len, "%s%s.w %s, #%u", op == 2 ? "mov" : "mvn", s, disasm_regs[rd], imm);
+		} else {
+			static const char *ops[16] = {
+				"and", "bic", "orr", "orn", "eor", NULL, NULL, NULL,
+				"add", NULL, "adc", "sbc", NULL, "sub", "rsb", NULL,
+			};
+			if (ops[op] == NULL) {
+				snprintf(buf, len, ".inst.w 0x%04x%04x", hw1, hw2);
+			} else {
+				snprintf(buf, len, "%s%s.w %s, %s, #%u", ops[op], s, disasm_regs[rd], disasm_regs[rn], imm);
+			}
+		}
+	} else if ((hw1 >> 11) == 0b11110) {
+		// Data processing (plain binary immediate)
+		uint32_t op = (hw1 >> 4) & 0x1f;
+		uint32_t imm12 = ((hw1 >> 10) & 1) << 11 | ((hw2 >> 12) & 0b111) << 8 | (hw2 & 0xff);
+		if (op == 0b00000) {
+			snprintf(buf, len, "addw %s, %s, #%u", disasm_regs[rd], disasm_regs[rn], imm12);
+		} else if (op == 0b01010) {
+			snprintf(buf, len, "subw %s, %s, #%u", disasm_regs[rd], disasm_regs[rn], imm12);
+		} else if (op == 0b00100 || op == 0b01100) {
+			uint32_t imm16 = rn << 12 | imm12;
+			snprintf(buf, len, "%s %s, #%u", op == 0b00100 ? "movw" : "movt", disasm_regs[rd], imm16);
+		} else {
+			snprintf(buf, len, ".inst.w 0x%04x%04x", hw1, hw2);
+		}
+	} else if ((hw1 & 0xfe40) == 0xe800 && ((hw1 >> 7) & 0b11) != 0b00 && ((hw1 >> 7) & 0b11) != 0b11) {
+		// Load/store multiple
+		bool load = (hw1 >> 4) & 1;
+		bool writeback = (hw1 >> 5) & 1;
+		bool db = ((hw1 >> 7) & 0b11) == 0b10;
+		char reglist[100];
+		disasm_reglist(hw2, reglist, sizeof(reglist));
+		if (rn == 13 && writeback && load != db) {
+			snprintf(buf, len, "%s.w %s", load ? "pop" : "push", reglist);
+		} else {
+			snprintf(buf, len, "%s%s.w %s%s, %s", load ? "ldm" : "stm", db ? "db" : "ia", disasm_regs[rn], writeback ? "!" : "", reglist);
+		}
+	} else if ((hw1 & 0xfff0) == 0xe8d0 && (hw2 & 0xffe0) == 0xf000) {
+		// Table branch
+		if ((hw2 >> 4) & 1) {
+			snprintf(buf, len, "tbh [%s, %s, lsl #1]", disasm_regs[rn], disasm_regs[rm]);
+		} else {
+			snprintf(buf, len, "tbb [%s, %s]", disasm_regs[rn], disasm_regs[rm]);
+		}
+	} else if ((hw1 & 0xfe40) == 0xe840 && (hw1 & 0x0120) != 0) {
+		// Load/store dual
+		bool load = (hw1 >> 4) & 1;
+		bool add = (hw1 >> 7) & 1;
+		bool index = (hw1 >> 8) & 1;
+		bool writeback = (hw1 >> 5) & 1;
+		uint32_t imm = (hw2 & 0xff) * 4;
+		const char *op = load ? "ldrd" : "strd";
+		if (!index) {
+			snprintf(buf, len, "%s %s, %s, [%s], #%s%u", op, disasm_regs[rt], disasm_regs[rd], disasm_regs[rn], add ? "" : "-", imm);
+		} else {
+			snprintf(buf, len, "%s %s, %s, [%s, #%s%u]%s", op, disasm_regs[rt], disasm_regs[rd], disasm_regs[rn], add ? "" : "-", imm, writeback ? "!" : "");
+		}
+	} else if ((hw1 >> 9) == 0b1111100) {
+		// Load/store single
+		static const char *loads[2][3] = {{"ldrb", "ldrh", "ldr"}, {"ldrsb", "ldrsh", "?"}};
+		static const char *stores[3] = {"strb", "strh", "str"};
+		uint32_t size = (hw1 >> 5) & 0b11;
+		bool load = (hw1 >> 4) & 1;
+		bool sign = (hw1 >> 8) & 1;
+		if (size == 3 || (!load && sign) || (sign && size == 2)) {
+			snprintf(buf, len, ".inst.w 0x%04x%04x", hw1, hw2);
+			return;
+		}
+		const char *op = load ? loads[sign][size] : stores[size];
+		if (rn == 15) {
+			uint32_t imm12 = hw2 & 0xfff;
+			uint32_t target = (address + 4) & ~3;
+			target = (hw1 >> 7) & 1 ? target + imm12 : target - imm12;
+			snprintf(buf, len, "%s.w %s, [pc, #%s%u] ; 0x%x", op, disasm_regs[rt], (hw1 >> 7) & 1 ? "" : "-", imm12, target);
+		} else if ((hw1 >> 7) & 1) {
+			snprintf(buf, len, "%s.w %s, [%s, #%u]", op, disasm_regs[rt], disasm_regs[rn], hw2 & 0xfff);
+		} else if (((hw2 >> 6) & 0x3f) == 0) {
+			uint32_t shift = (hw2 >> 4) & 0b11;
+			if (shift != 0) {
+				snprintf(buf, len, "%s.w %s, [%s, %s, lsl #%u]", op, disasm_regs[rt], disasm_regs[rn], disasm_regs[rm], shift);
+			} else {
+				snprintf(buf, len, "%s.w %s, [%s, %s]", op, disasm_regs[rt], disasm_regs[rn], disasm_regs[rm]);
+			}
+		} else if ((hw2 >> 11) & 1) {
+			bool index = (hw2 >> 10) & 1;
+			bool add = (hw2 >> 9) & 1;
+			bool writeback = (hw2 >> 8) & 1;
+			uint32_t imm8 = hw2 & 0xff;
+			if (!index) {
+				snprintf(buf, len, "%s %s, [%s], #%s%u", op, disasm_regs[rt], disasm_regs[rn], add ? "" : "-", imm8);
+			} else {
+				snprintf(buf, len, "%s %s, [%s, #%s%u]%s", op, disasm_regs[rt], disasm_regs[rn], add ? "" : "-", imm8, writeback ? "!" : "");
+			}
+		} else {
+			snprintf(buf, len, ".inst.w 0x%04x%04x", hw1, hw2);
+		}
+	} else if ((hw1 >> 9) == 0b1110101) {
+		// Data processing (shifted register)
+		uint32_t op = (hw1 >> 5) & 0xf;
+		uint32_t type = (hw2 >> 4) & 0b11;
+		uint32_t imm5 = ((hw2 >> 12) & 0b111) << 2 | ((hw2 >> 6) & 0b11);
+		const char *s = setflags ? "s" : "";
+		char shift[16] = "";
+		if (type == 3 && imm5 == 0) {
+			snprintf(shift, sizeof(shift), ", rrx");
+		} else if (imm5 != 0 || type != 0) {
+			snprintf(shift, sizeof(shift), ", %s #%u", disasm_shifts[type], imm5 == 0 ? 32 : imm5);
+		}
+		if (rd == 15 && setflags && (op == 0 || op == 4 || op == 8 || op == 13)) {
+			static const char *ops[16] = {[0] = "tst", [4] = "teq", [8] = "cmn", [13] = "cmp"};
+			snprintf(buf, len, "%s.w %s, %s%s", ops[op], disasm_regs[rn], disasm_regs[rm], shift);
+		} else if (rn == 15 && op == 2 && shift[0] != 0 && !(type == 3 && imm5 == 0)) {
+			snprintf(buf, len, "%s%s.w %s, %s, #%u", disasm_shifts[type], s, disasm_regs[rd], disasm_regs[rm], imm5 == 0 ? 32 : imm5);
+		} else if (rn == 15 && (op == 2 || op == 3)) {
+			snprintf(buf, len, "%s%s.w %s, %s%s", op == 2 ? "mov" : "mvn", s, disasm_regs[rd], disasm_regs[rm], shift);
+		} else {
+			static const char *ops[16] = {
+				"and", "bic", "orr", "orn", "eor", NULL, NULL, NULL,
+				"add", NULL, "adc", "sbc", NULL, "sub", "rsb", NULL,
+			};
+			if (ops[op] == NULL) {
+				snprintf(buf, len, ".inst.w 0x%04x%04x", hw1, hw2);
+			} else {
+				snprintf(buf, len, "%s%s.w %s, %s, %s%s", ops[op], s, disasm_regs[rd], disasm_regs[rn], disasm_regs[rm], shift);
+			}
+		}
+	} else if ((hw1 >> 8) == 0b11111010) {
+		// Data processing (register)
+		uint32_t op1 = (hw1 >> 4) & 0xf;
+		uint32_t op2 = (hw2 >> 4) & 0xf;
+		if ((op1 >> 3) == 0 && op2 == 0) {
+			snprintf(buf, len, "%s%s.w %s, %s, %s", disasm_shifts[op1 >> 1], setflags ? "s" : "", disasm_regs[rd], disasm_regs[rn], disasm_regs[rm]);
+		} else if (op1 <= 0b0101 && rn == 15 && (op2 >> 3) == 1) {
+			static const char *ops[6] = {"sxth", "uxth", "sxtb16", "uxtb16", "sxtb", "uxtb"};
+			snprintf(buf, len, "%s.w %s, %s", ops[op1], disasm_regs[rd], disasm_regs[rm]);
+		} else if (op1 == 0b1001 && op2 <= 0b1011 && (op2 >> 2) == 0b10) {
+			static const char *ops[4] = {"rev", "rev16", "rbit", "revsh"};
+			snprintf(buf, len, "%s.w %s, %s", ops[op2 & 0b11], disasm_regs[rd], disasm_regs[rm]);
+		} else if (op1 == 0b1011 && op2 == 0b1000) {
+			snprintf(buf, len, "clz %s, %s", disasm_regs[rd], disasm_regs[rm]);
+		} else {
+			snprintf(buf, len, ".inst.w 0x%04x%04x", hw1, hw2);
+		}
+	} else if ((hw1 >> 7) == 0b111110110) {
+		// Multiply and multiply accumulate
+		uint32_t op1 = (hw1 >> 4) & 0b111;
+		uint32_t op2 = (hw2 >> 4) & 0b11;
+		uint32_t ra = rt;
+		if (op1 == 0 && op2 == 0 && ra == 15) {
+			snprintf(buf, len, "mul %s, %s, %s", disasm_regs[rd], disasm_regs[rn], disasm_regs[rm]);
+		} else if (op1 == 0 && op2 <= 1) {
+			snprintf(buf, len, "%s %s, %s, %s, %s", op2 ? "mls" : "mla", disasm_regs[rd], disasm_regs[rn], disasm_regs[rm], disasm_regs[ra]);
+		} else {
+			snprintf(buf, len, ".inst.w 0x%04x%04x", hw1, hw2);
+		}
+	} else if ((hw1 >> 7) == 0b111110111) {
+		// Long multiply, long multiply accumulate and divide
+		uint32_t op1 = (hw1 >> 4) & 0b111;
+		uint32_t op2 = (hw2 >> 4) & 0xf;
+		static const char *ops[8] = {"smull", "sdiv", "umull", "udiv", "smlal", NULL, "umlal", NULL};
+		if ((op1 == 1 || op1 == 3) && op2 == 0xf) {
+			snprintf(buf, len, "%s %s, %s, %s", ops[op1], disasm_regs[rd], disasm_regs[rn], disasm_regs[rm]);
+		} else if (ops[op1] != NULL && op2 == 0 && op1 != 1 && op1 != 3) {
+			snprintf(buf, len, "%s %s, %s, %s, %s", ops[op1], disasm_regs[rt], disasm_regs[rd], disasm_regs[rn], disasm_regs[rm]);
+		} else {
+			snprintf(buf, len, ".inst.w 0x%04x%04x", hw1, hw2);
+		}
+	} else {
+		snprintf(buf, len, ".inst.w 0x%04x%04x", hw1, hw2);
+	}
+}
+
+// Disassemble the Thumb instruction at the given address into buf. The second
+// halfword is only used for 32-bit instructions. Returns the size of the
+// instruction in bytes.
+int disasm_thumb(uint32_t address, uint16_t hw1, uint16_t hw2, char *buf, size_t len) {
+	if (disasm_is_32bit(hw1)) {
+		disasm_thumb32(address, hw1, hw2, buf, len);
+		return 4;
+	}
+	disasm_thumb16(address, hw1, buf, len);
+	return 2;
+}
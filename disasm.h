@@ -0,0 +1,13 @@
+#pragma once
+
+#include <stddef.h>
+#include <stdint.h>
+#include <stdbool.h>
+
+// Return whether the halfword is the first half of a 32-bit Thumb-2
+// instruction.
+static inline bool disasm_is_32bit(uint16_t hw1) {
+	return (hw1 >> 11) == 0b11101 || (hw1 >> 11) == 0b11110 || (hw1 >> 11) == 0b11111;
+}
+
+int disasm_thumb(uint32_t address, uint16_t hw1, uint16_t hw2, char *buf, size_t len);
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// #include "machine.h"
+import "C"
+
+// This file implements TFT displays on the SPI bus, with the MIPI DCS command
+// set of controllers like the ST7789, ILI9341 and ST7735. They are specified
+// on the command line like this:
+//
+//	st7789@spi:P0.10 dc=P0.11
+//	ili9341@spi:PA4 dc=PA3 rotate=90 name=main
+//	st7735@spi:9 dc=8 width=128 height=128 offset=2,3
+//
+// The part after @ is the chip select pin, dc is the data/command pin. Width
+// and height are those of the panel (the default depends on the controller)
+// and offset is the position of the panel in the memory of the controller.
+// The image is rotated clockwise by rotate degrees, for panels that are
+// mounted sideways. Screenshots of the current frame are saved as PNG with
+// -screenshot, the monitor command "screenshot" or Emculator.Screenshot on
+// the control socket, and test scenarios compare them to golden images.
+//
+// The controller handles CASET, RASET, RAMWR, RAMWRC, MADCTL (mirroring, row
+// and column exchange and BGR order), COLMOD (16 and 18 bits per pixel),
+// display on and off, sleep, inversion and reset. Reads return 0xff.
+
+// A kind of display controller, with the default panel.
+type displayKind struct {
+	ramWidth, ramHeight int  // size of the frame memory
+	width, height       int  // size of the panel
+	mirrorX, mirrorY    bool // the panel is wired mirrored, so drivers set MX or MY
+	bgr                 bool // the panel is BGR, so drivers set the BGR bit
+	inverted            bool // the panel is IPS, so drivers send INVON
+}
+
+var displayKinds = map[string]displayKind{
+	"st7789":  {ramWidth: 240, ramHeight: 320, width: 240, height: 240, inverted: true},
+	"ili9341": {ramWidth: 240, ramHeight: 320, width: 240, height: 320, mirrorX: true, bgr: true},
+	"st7735":  {ramWidth: 132, ramHeight: 162, width: 128, height: 160, mirrorX: true, mirrorY: true},
+}
+
+// Bits of MADCTL.
+const (
+	displayMY  = 0x80
+	displayMX  = 0x40
+	displayMV  = 0x20
+	displayBGR = 0x08
+)
+
+// A display attached to the SPI bus.
+type display struct {
+	kind           displayKind
+	name           string
+	dc             int // data/command pin
+	xOffset        int
+	yOffset        int
+	rotate         int // in degrees, clockwise
+	ram            *image.RGBA
+	cmd            uint8 // current command
+	params         []uint8
+	xs, xe, ys, ye int // address window
+	x, y           int // next pixel to write
+	pixel          []uint8
+	madctl         uint8
+	colmod         uint8
+	on             bool
+	sleeping       bool
+	inverted       bool
+}
+
+// The displays of each machine, in the order they were added.
+var displays machineMap[[]*display]
+
+// Attach a display to the machine, see the top of this file for the syntax of
+// spec.
+func addDisplay(m *Machine, spec string) error {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return errors.New("empty display specification")
+	}
+	name, bus, _ := strings.Cut(fields[0], "@")
+	kind, ok := displayKinds[name]
+	if !ok {
+		var names []string
+		for name := range displayKinds {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown display %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+	if !strings.HasPrefix(bus, "spi:") {
+		return fmt.Errorf("expected %s@spi:PIN", name)
+	}
+	cs, err := parseGPIOPin(bus[4:])
+	if err != nil {
+		return err
+	}
+	d := &display{kind: kind, name: name, dc: -1}
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return fmt.Errorf("expected KEY=VALUE, not %q", field)
+		}
+		switch key {
+		case "dc":
+			d.dc, err = parseGPIOPin(value)
+		case "width", "height":
+			var n int
+			n, err = strconv.Atoi(value)
+			if err == nil && (n <= 0 || n > 1024) {
+				err = fmt.Errorf("invalid %s %s", key, value)
+			}
+			if key == "width" {
+				d.kind.width = n
+			} else {
+				d.kind.height = n
+			}
+		case "offset":
+			x, y, _ := strings.Cut(value, ",")
+			d.xOffset, err = strconv.Atoi(x)
+			if err == nil {
+				d.yOffset, err = strconv.Atoi(y)
+			}
+			if err != nil || d.xOffset < 0 || d.yOffset < 0 {
+				err = fmt.Errorf("expected offset=X,Y, not %q", value)
+			}
+		case "rotate":
+			d.rotate, err = strconv.Atoi(value)
+			if err == nil && d.rotate%90 != 0 {
+				err = fmt.Errorf("rotate must be 0, 90, 180 or 270, not %s", value)
+			}
+			d.rotate = (d.rotate%360 + 360) % 360
+		case "name":
+			d.name = value
+		default:
+			return fmt.Errorf("unknown display option %q", key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if d.dc < 0 {
+		return errors.New("the display needs a dc pin")
+	}
+	// The frame memory must hold the panel.
+	if d.xOffset+d.kind.width > d.kind.ramWidth {
+		d.kind.ramWidth = d.xOffset + d.kind.width
+	}
+	if d.yOffset+d.kind.height > d.kind.ramHeight {
+		d.kind.ramHeight = d.yOffset + d.kind.height
+	}
+	list := displays.get(m.machine)
+	for _, other := range list {
+		if other.name == d.name {
+			return fmt.Errorf("display name %q is already in use, set another with name=", d.name)
+		}
+	}
+	d.ram = image.NewRGBA(image.Rect(0, 0, d.kind.ramWidth, d.kind.ramHeight))
+	d.reset()
+	if err := getSensorBus(m).addSPI(m, cs, d); err != nil {
+		return err
+	}
+	displays.set(m.machine, append(list, d))
+	return nil
+}
+
+// Reset the controller, like SWRESET. The frame memory keeps its contents.
+func (d *display) reset() {
+	d.cmd = 0
+	d.params = d.params[:0]
+	d.xs, d.xe, d.ys, d.ye = 0, d.kind.ramWidth-1, 0, d.kind.ramHeight-1
+	d.madctl = 0
+	d.colmod = 0x66
+	d.on = false
+	d.sleeping = true
+	d.inverted = false
+}
+
+func (d *display) spiSelect() {
+	d.pixel = d.pixel[:0]
+}
+
+// Receive a command or parameter byte, depending on the level of the dc pin.
+func (d *display) spiTransfer(machine *C.machine_t, in uint8) uint8 {
+	if C.machine_gpio_level(machine, C.uint32_t(d.dc)) == 0 {
+		d.command(in)
+	} else {
+		d.data(in)
+	}
+	return 0xff
+}
+
+// Start a new command.
+func (d *display) command(cmd uint8) {
+	d.cmd = cmd
+	d.params = d.params[:0]
+	d.pixel = d.pixel[:0]
+	switch cmd {
+	case 0x01: // SWRESET
+		d.reset()
+	case 0x10: // SLPIN
+		d.sleeping = true
+	case 0x11: // SLPOUT
+		d.sleeping = false
+	case 0x20: // INVOFF
+		d.inverted = false
+	case 0x21: // INVON
+		d.inverted = true
+	case 0x28: // DISPOFF
+		d.on = false
+	case 0x29: // DISPON
+		d.on = true
+	case 0x2c: // RAMWR
+		d.x, d.y = d.xs, d.ys
+	}
+}
+
+// Receive a parameter of the current command.
+func (d *display) data(b uint8) {
+	switch d.cmd {
+	case 0x2a, 0x2b: // CASET, RASET
+		d.params = append(d.params, b)
+		if len(d.params) == 4 {
+			start := int(d.params[0])<<8 | int(d.params[1])
+			end := int(d.params[2])<<8 | int(d.params[3])
+			if d.cmd == 0x2a {
+				d.xs, d.xe = start, end
+			} else {
+				d.ys, d.ye = start, end
+			}
+		}
+	case 0x2c, 0x3c: // RAMWR, RAMWRC
+		d.pixel = append(d.pixel, b)
+		if d.colmod&0x07 == 0x06 {
+			if len(d.pixel) == 3 { // 18 bits: 6 bits per byte, left aligned
+				d.write(color.RGBA{b6(d.pixel[0]), b6(d.pixel[1]), b6(d.pixel[2]), 0xff})
+				d.pixel = d.pixel[:0]
+			}
+		} else if len(d.pixel) == 2 { // 16 bits: RGB565
+			v := uint16(d.pixel[0])<<8 | uint16(d.pixel[1])
+			d.write(color.RGBA{b5(uint8(v >> 11)), b6(uint8(v>>5) << 2), b5(uint8(v)), 0xff})
+			d.pixel = d.pixel[:0]
+		}
+	case 0x36: // MADCTL
+		d.madctl = b
+	case 0x3a: // COLMOD
+		d.colmod = b
+	}
+}
+
+// Expand a 5-bit color component to 8 bits.
+func b5(v uint8) uint8 {
+	v &= 0x1f
+	return v<<3 | v>>2
+}
+
+// Expand a 6-bit color component, in the upper bits of v, to 8 bits.
+func b6(v uint8) uint8 {
+	return v&0xfc | v>>6
+}
+
+// Write a pixel at the current address and advance it through the address
+// window.
+func (d *display) write(c color.RGBA) {
+	col, row := d.x, d.y
+	cols, rows := d.kind.ramWidth, d.kind.ramHeight
+	if d.madctl&displayMV != 0 {
+		cols, rows = rows, cols
+	}
+	if d.madctl&displayMX != 0 {
+		col = cols - 1 - col
+	}
+	if d.madctl&displayMY != 0 {
+		row = rows - 1 - row
+	}
+	if d.madctl&displayMV != 0 {
+		col, row = row, col
+	}
+	if d.madctl&displayBGR != 0 {
+		c.R, c.B = c.B, c.R // swapped again by a BGR panel
+	}
+	d.ram.SetRGBA(col, row, c)
+
+	d.x++
+	if d.x > d.xe {
+		d.x = d.xs
+		d.y++
+		if d.y > d.ye {
+			d.y = d.ys
+		}
+	}
+}
+
+// Return the image that the panel shows now, as it is mounted.
+func (d *display) frame() *image.RGBA {
+	w, h := d.kind.width, d.kind.height
+	if d.rotate == 90 || d.rotate == 270 {
+		w, h = h, w
+	}
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	if !d.on || d.sleeping {
+		for i := 3; i < len(img.Pix); i += 4 {
+			img.Pix[i] = 0xff // black
+		}
+		return img
+	}
+	invert := d.inverted != d.kind.inverted
+	for y := 0; y < d.kind.height; y++ {
+		for x := 0; x < d.kind.width; x++ {
+			rx, ry := x+d.xOffset, y+d.yOffset
+			if d.kind.mirrorX {
+				rx = d.kind.ramWidth - 1 - rx
+			}
+			if d.kind.mirrorY {
+				ry = d.kind.ramHeight - 1 - ry
+			}
+			c := d.ram.RGBAAt(rx, ry)
+			if d.kind.bgr {
+				c.R, c.B = c.B, c.R
+			}
+			if invert {
+				c.R, c.G, c.B = ^c.R, ^c.G, ^c.B
+			}
+			c.A = 0xff
+			switch d.rotate {
+			case 0:
+				img.SetRGBA(x, y, c)
+			case 90:
+				img.SetRGBA(w-1-y, x, c)
+			case 180:
+				img.SetRGBA(w-1-x, h-1-y, c)
+			case 270:
+				img.SetRGBA(y, h-1-x, c)
+			}
+		}
+	}
+	return img
+}
+
+// Screenshot returns the image that the named display shows now. The name may
+// be empty if the machine has only one display. The machine must not be
+// running.
+func (m *Machine) Screenshot(name string) (image.Image, error) {
+	list := displays.get(m.machine)
+	if len(list) == 0 {
+		return nil, errors.New("no display is emulated, see -display")
+	}
+	if name == "" {
+		if len(list) != 1 {
+			return nil, errors.New("there are several displays, give the name of one")
+		}
+		return list[0].frame(), nil
+	}
+	for _, d := range list {
+		if d.name == name {
+			return d.frame(), nil
+		}
+	}
+	return nil, fmt.Errorf("unknown display %q", name)
+}
+
+// SaveScreenshot saves the image that the named display shows now as a PNG
+// file, see Screenshot.
+func (m *Machine) SaveScreenshot(name, path string) error {
+	img, err := m.Screenshot(name)
+	if err != nil {
+		return err
+	}
+	return writePNG(path, img)
+}
+
+func writePNG(path string, img image.Image) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = png.Encode(f, img)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func readPNG(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return img, nil
+}
+
+// Split a screenshot argument of -screenshot or a test scenario, which is
+// PATH or NAME=PATH.
+func splitScreenshotSpec(spec string) (name, path string) {
+	if name, path, ok := strings.Cut(spec, "="); ok {
+		return name, path
+	}
+	return "", spec
+}
+
+// Save screenshots like -screenshot does, when the firmware stops for good.
+// Each spec is a path, or a display name and a path separated by =.
+func saveScreenshots(m *Machine, specs []string) {
+	for _, spec := range specs {
+		name, path := splitScreenshotSpec(spec)
+		if err := m.SaveScreenshot(name, path); err != nil {
+			fmt.Fprintln(os.Stderr, "error: screenshot:", err)
+		}
+	}
+}
+
+// Compare an image with a golden image. Pixels differ when a color component
+// differs by more than tolerance. It returns an error that describes the
+// first difference, or nil if the images match.
+func compareImages(got, want image.Image, tolerance int) error {
+	if got.Bounds().Size() != want.Bounds().Size() {
+		return fmt.Errorf("the size is %v, expected %v", got.Bounds().Size(), want.Bounds().Size())
+	}
+	differ := 0
+	var first image.Point
+	var firstGot, firstWant color.RGBA
+	size := got.Bounds().Size()
+	for y := 0; y < size.Y; y++ {
+		for x := 0; x < size.X; x++ {
+			g := color.RGBAModel.Convert(got.At(got.Bounds().Min.X+x, got.Bounds().Min.Y+y)).(color.RGBA)
+			w := color.RGBAModel.Convert(want.At(want.Bounds().Min.X+x, want.Bounds().Min.Y+y)).(color.RGBA)
+			if absDiff(g.R, w.R) > tolerance || absDiff(g.G, w.G) > tolerance || absDiff(g.B, w.B) > tolerance {
+				if differ == 0 {
+					first, firstGot, firstWant = image.Pt(x, y), g, w
+				}
+				differ++
+			}
+		}
+	}
+	if differ != 0 {
+		return fmt.Errorf("%d pixels differ, the first at %d,%d is #%02x%02x%02x instead of #%02x%02x%02x", differ, first.X, first.Y, firstGot.R, firstGot.G, firstGot.B, firstWant.R, firstWant.G, firstWant.B)
+	}
+	return nil
+}
+
+func absDiff(a, b uint8) int {
+	if a > b {
+		return int(a - b)
+	}
+	return int(b - a)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// Rotation must cover the whole image of a panel that isn't square.
+func TestDisplayRotate(t *testing.T) {
+	for _, tc := range []struct {
+		rotate int
+		width  int
+		height int
+		corner image.Point // where the top left pixel of the panel ends up
+	}{
+		{0, 2, 3, image.Pt(0, 0)},
+		{90, 3, 2, image.Pt(2, 0)},
+		{180, 2, 3, image.Pt(1, 2)},
+		{270, 3, 2, image.Pt(0, 1)},
+	} {
+		d := &display{
+			kind:   displayKind{ramWidth: 2, ramHeight: 3, width: 2, height: 3},
+			rotate: tc.rotate,
+			ram:    image.NewRGBA(image.Rect(0, 0, 2, 3)),
+			on:     true,
+		}
+		// Every pixel has its own color, so that each must show up once.
+		for y := 0; y < 3; y++ {
+			for x := 0; x < 2; x++ {
+				d.ram.SetRGBA(x, y, color.RGBA{uint8(x + 1), uint8(y + 1), 0, 0xff})
+			}
+		}
+		img := d.frame()
+		if size := img.Bounds().Size(); size != image.Pt(tc.width, tc.height) {
+			t.Errorf("rotate=%d: got a %v image, expected %dx%d", tc.rotate, size, tc.width, tc.height)
+			continue
+		}
+		seen := make(map[color.RGBA]bool)
+		for y := 0; y < tc.height; y++ {
+			for x := 0; x < tc.width; x++ {
+				seen[img.RGBAAt(x, y)] = true
+			}
+		}
+		if len(seen) != 6 || seen[color.RGBA{}] {
+			t.Errorf("rotate=%d: not every pixel of the panel is shown", tc.rotate)
+		}
+		if c := img.RGBAAt(tc.corner.X, tc.corner.Y); c != (color.RGBA{1, 1, 0, 0xff}) {
+			t.Errorf("rotate=%d: the top left pixel isn't at %v", tc.rotate, tc.corner)
+		}
+	}
+}
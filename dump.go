@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// #include "machine.h"
+import "C"
+
+// Number of 32-bit words of the stack to print in a state dump.
+const dumpStackWords = 16
+
+// Print the registers and the top of the stack, to help find out where the
+// firmware got stuck.
+func dumpState(w io.Writer, machine *C.machine_t) {
+	m := NewMachine(machine, nil, nil)
+	regs := m.DebugRegisters()
+	fmt.Fprintln(w, "registers:")
+	for i := 0; i < 13; i++ {
+		fmt.Fprintf(w, "  r%-2d  %08x\n", i, regs[i])
+	}
+	sp := regs[13]
+	fmt.Fprintf(w, "  sp   %08x\n", sp)
+	fmt.Fprintf(w, "  lr   %08x\n", regs[14])
+	fmt.Fprintf(w, "  pc   %08x\n", regs[15])
+	fmt.Fprintf(w, "  xpsr %08x\n", regs[16])
+
+	// Don't read past the end of RAM.
+	sp &^= 3
+	words := dumpStackWords
+	if ramEnd := 0x20000000 + uint32(machine.mem_size); sp < 0x20000000 || sp >= ramEnd {
+		words = 0
+	} else if int(ramEnd-sp)/4 < words {
+		words = int(ramEnd-sp) / 4
+	}
+	fmt.Fprintln(w, "stack:")
+	stack := m.ReadMemory(int(sp), words*4)
+	for i := 0; i < words; i++ {
+		fmt.Fprintf(w, "  %08x: %08x\n", sp+uint32(i*4), binary.LittleEndian.Uint32(stack[i*4:]))
+	}
+}
+
+// Print why the machine stopped, where it stopped and how far it got.
+func printSummary(w io.Writer, machine *C.machine_t, debug *debugInfo, reason string) {
+	pc := uint32(C.machine_readreg(machine, 15) - 1)
+	fmt.Fprintf(w, "stopped: %s\n", reason)
+	fmt.Fprintf(w, "  instructions: %d\n", uint64(machine.stats.instructions))
+	fmt.Fprintf(w, "  cycles:       %d\n", uint64(machine.stats.cycles))
+	fmt.Fprintf(w, "  pc:           %s\n", debug.describe(pc))
+}
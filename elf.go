@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"debug/dwarf"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"unsafe"
+)
+
+// #include <stdlib.h>
+// #include "machine.h"
+import "C"
+
+// A symbol from the ELF symbol table.
+type symbol struct {
+	Address uint32 // address, with the Thumb bit cleared
+	Size    uint32
+}
+
+// A row of the DWARF line table: the instructions starting at Address belong
+// to the given source line. A Line of 0 marks the end of a sequence.
+type lineEntry struct {
+	Address uint32
+	File    string
+	Line    int
+}
+
+// A global or static variable from the DWARF debug information.
+type variable struct {
+	Address uint32
+	Type    dwarf.Type
+}
+
+// Symbols and debug information of an ELF file.
+type debugInfo struct {
+	symbols   map[string]symbol
+	lines     []lineEntry         // sorted by address
+	variables map[string]variable // variables at a fixed address, by name
+	frames    []stackFrame        // saved registers of functions, sorted by address
+}
+
+// Check whether the given file contents are an ELF file, as opposed to a raw
+// firmware image.
+func isELF(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(elf.ELFMAG))
+}
+
+// Convert an ELF file to a raw firmware image starting at address 0, and
+// return its function and object symbols and the line table if there is DWARF
+// debug information.
+func loadELF(data []byte, flashBase uint32, flashSize int) ([]byte, *debugInfo, error) {
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	if f.Machine != elf.EM_ARM {
+		return nil, nil, fmt.Errorf("ELF file is not for ARM but for %s", f.Machine)
+	}
+
+	// Copy all loadable segments that end up in flash. The physical address is
+	// used, so that initial values of .data are included. Segments can be
+	// placed either at flashBase or at its alias at 0.
+	var image []byte
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_LOAD || prog.Filesz == 0 {
+			continue
+		}
+		start := prog.Paddr
+		if start >= uint64(flashBase) {
+			start -= uint64(flashBase)
+		}
+		if start+prog.Filesz > uint64(flashSize) {
+			return nil, nil, fmt.Errorf("ELF segment at 0x%x does not fit in flash", prog.Paddr)
+		}
+		end := int(start + prog.Filesz)
+		if end > len(image) {
+			image = append(image, make([]byte, end-len(image))...)
+		}
+		_, err := prog.ReadAt(image[start:end], 0)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Mapping symbols like $t and $d are skipped.
+	info := &debugInfo{
+		symbols: make(map[string]symbol),
+	}
+	syms, err := f.Symbols()
+	if err != nil && err != elf.ErrNoSymbols {
+		return nil, nil, err
+	}
+	for _, sym := range syms {
+		typ := elf.ST_TYPE(sym.Info)
+		if sym.Name == "" || sym.Name[0] == '$' || (typ != elf.STT_FUNC && typ != elf.STT_OBJECT && typ != elf.STT_NOTYPE) {
+			continue
+		}
+		info.symbols[sym.Name] = symbol{
+			Address: uint32(sym.Value) &^ 1,
+			Size:    uint32(sym.Size),
+		}
+	}
+
+	// Read the line table, if the file has debug information.
+	if debug, err := f.DWARF(); err == nil {
+		info.lines, err = readLineTable(debug)
+		if err != nil {
+			return nil, nil, err
+		}
+		info.variables, err = readVariables(debug)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	info.frames, err = readFrames(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	return image, info, nil
+}
+
+// Read the line tables of all compile units, sorted by address.
+func readLineTable(debug *dwarf.Data) ([]lineEntry, error) {
+	var lines []lineEntry
+	r := debug.Reader()
+	for {
+		cu, err := r.Next()
+		if err != nil {
+			return nil, err
+		}
+		if cu == nil {
+			break
+		}
+		if cu.Tag != dwarf.TagCompileUnit {
+			r.SkipChildren()
+			continue
+		}
+		lr, err := debug.LineReader(cu)
+		if err != nil {
+			return nil, err
+		}
+		if lr != nil {
+			var entry dwarf.LineEntry
+			for lr.Next(&entry) == nil {
+				line := lineEntry{Address: uint32(entry.Address)}
+				if !entry.EndSequence && entry.File != nil {
+					line.File = filepath.Base(entry.File.Name)
+					line.Line = entry.Line
+				}
+				lines = append(lines, line)
+			}
+		}
+		r.SkipChildren()
+	}
+	sort.SliceStable(lines, func(i, j int) bool {
+		return lines[i].Address < lines[j].Address
+	})
+	return lines, nil
+}
+
+// Read the global and static variables, which have a fixed address. If
+// several have the same name, like static variables in different files, the
+// first is used.
+func readVariables(debug *dwarf.Data) (map[string]variable, error) {
+	variables := make(map[string]variable)
+	r := debug.Reader()
+	for {
+		entry, err := r.Next()
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			break
+		}
+		if entry.Tag != dwarf.TagVariable {
+			continue
+		}
+		name, _ := entry.Val(dwarf.AttrName).(string)
+		location, _ := entry.Val(dwarf.AttrLocation).([]byte)
+		typeOffset, ok := entry.Val(dwarf.AttrType).(dwarf.Offset)
+		if name == "" || len(location) != 5 || location[0] != 0x03 || !ok { // DW_OP_addr
+			continue
+		}
+		if _, ok := variables[name]; ok {
+			continue
+		}
+		typ, err := debug.Type(typeOffset)
+		if err != nil {
+			return nil, err
+		}
+		variables[name] = variable{
+			Address: binary.LittleEndian.Uint32(location[1:]),
+			Type:    typ,
+		}
+	}
+	return variables, nil
+}
+
+// Return the source location (file:line) of the given address, or an empty
+// string if it is not known.
+func (info *debugInfo) location(address uint32) string {
+	if info == nil {
+		return ""
+	}
+	i := sort.Search(len(info.lines), func(i int) bool {
+		return info.lines[i].Address > address
+	})
+	if i == 0 || info.lines[i-1].Line == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d", info.lines[i-1].File, info.lines[i-1].Line)
+}
+
+// Resolve a symbol name or a numeric address to an address. The Thumb bit of
+// function addresses is cleared.
+func resolveAddress(s string, symbols map[string]symbol) (uint32, error) {
+	if sym, ok := symbols[s]; ok {
+		return sym.Address, nil
+	}
+	address, err := parseUint32(s)
+	if err != nil {
+		return 0, fmt.Errorf("unknown symbol or address: %s", s)
+	}
+	return address &^ 1, nil
+}
+
+// Return a human readable name for the given address: the nearest preceding
+// symbol plus an offset and the source location if known, or just the address
+// if no symbol is known.
+func (info *debugInfo) describe(address uint32) string {
+	bestName := ""
+	bestAddress := uint32(0)
+	if info != nil {
+		for name, sym := range info.symbols {
+			if sym.Address <= address && (bestName == "" || sym.Address > bestAddress || (sym.Address == bestAddress && name < bestName)) {
+				bestName = name
+				bestAddress = sym.Address
+			}
+		}
+	}
+	var s string
+	if bestName == "" {
+		s = fmt.Sprintf("0x%x", address)
+	} else if bestAddress == address {
+		s = fmt.Sprintf("%s (0x%x)", bestName, address)
+	} else {
+		s = fmt.Sprintf("%s+0x%x (0x%x)", bestName, address-bestAddress, address)
+	}
+	if location := info.location(address); location != "" {
+		s += " at " + location
+	}
+	return s
+}
+
+// Pass the symbol table and line table to the machine, for call logging and
+// trace annotation, and the saved registers of functions for -stack-guard. If filter is not nil, only calls to matching symbols are
+// logged.
+func addDebugInfo(machine *C.machine_t, info *debugInfo, filter *regexp.Regexp) {
+	if info == nil {
+		return
+	}
+	for name, sym := range info.symbols {
+		cname := C.CString(name)
+		log := filter == nil || filter.MatchString(name)
+		C.machine_add_symbol(machine, C.uint32_t(sym.Address), C.uint32_t(sym.Size), cname, C.bool(log))
+		C.free(unsafe.Pointer(cname))
+	}
+	files := make(map[string]C.uint32_t)
+	for _, line := range info.lines {
+		file, ok := files[line.File]
+		if !ok && line.Line != 0 {
+			cfile := C.CString(line.File)
+			file = C.machine_add_source_file(machine, cfile)
+			C.free(unsafe.Pointer(cfile))
+			files[line.File] = file
+		}
+		C.machine_add_line(machine, C.uint32_t(line.Address), file, C.uint32_t(line.Line))
+	}
+	for _, frame := range info.frames {
+		C.machine_add_stack_frame(machine, C.uint32_t(frame.Address), C.uint32_t(frame.PrologueEnd), C.uint32_t(frame.SavedOffset), C.uint32_t(frame.SavedSize), C.uint32_t(frame.LROffset))
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// #include "machine.h"
+import "C"
+
+// This file implements fault injection, for testing how robust firmware is
+// against bit flips, misbehaving peripherals and brownouts. Faults are
+// specified on the command line like this:
+//
+//	flip:ADDR:BIT@TIME        flip a bit in RAM or flash
+//	stuck:ADDR=VALUE@TIME     make a peripheral register read a fixed value
+//	buserror:ADDR@TIME        make a peripheral register cause a bus error
+//	brownout@TIME             do a power-on reset, losing retained registers
+//
+// TIME is a number of cycles, or a duration with a unit (us, ms, s). It can
+// also be a range like 10ms..20ms, in which case a random time in that range is
+// picked.
+
+// A list of strings, for flags that can be specified multiple times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+type faultKind int
+
+const (
+	faultFlip faultKind = iota
+	faultStuck
+	faultBusError
+	faultBrownout
+)
+
+// A single fault that will be injected at a given cycle.
+type fault struct {
+	kind    faultKind
+	cycle   uint64
+	address uint32
+	value   uint32 // bit number for flips, register value for stuck registers
+	spec    string // original specification, for logging
+}
+
+// Parse all fault specifications and return them sorted by time.
+func parseFaults(specs []string, clock int, rng *rand.Rand) ([]*fault, error) {
+	var faults []*fault
+	for _, spec := range specs {
+		f, err := parseFault(spec, clock, rng)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fault %q: %v", spec, err)
+		}
+		faults = append(faults, f)
+	}
+	sort.SliceStable(faults, func(i, j int) bool {
+		return faults[i].cycle < faults[j].cycle
+	})
+	return faults, nil
+}
+
+func parseFault(spec string, clock int, rng *rand.Rand) (*fault, error) {
+	at := strings.LastIndexByte(spec, '@')
+	if at < 0 {
+		return nil, errors.New("no time specified")
+	}
+	cycle, err := parseFaultTime(spec[at+1:], clock, rng)
+	if err != nil {
+		return nil, err
+	}
+	f := &fault{cycle: cycle, spec: spec}
+	kind, args := spec[:at], ""
+	if colon := strings.IndexByte(kind, ':'); colon >= 0 {
+		kind, args = kind[:colon], kind[colon+1:]
+	}
+	switch kind {
+	case "flip":
+		f.kind = faultFlip
+		parts := strings.Split(args, ":")
+		if len(parts) != 2 {
+			return nil, errors.New("expected flip:ADDR:BIT")
+		}
+		if f.address, err = parseUint32(parts[0]); err != nil {
+			return nil, err
+		}
+		if f.value, err = parseUint32(parts[1]); err != nil {
+			return nil, err
+		}
+		if f.value >= 8 {
+			return nil, errors.New("bit number must be in the range 0..7")
+		}
+	case "stuck":
+		f.kind = faultStuck
+		parts := strings.Split(args, "=")
+		if len(parts) != 2 {
+			return nil, errors.New("expected stuck:ADDR=VALUE")
+		}
+		if f.address, err = parseUint32(parts[0]); err != nil {
+			return nil, err
+		}
+		if f.value, err = parseUint32(parts[1]); err != nil {
+			return nil, err
+		}
+	case "buserror":
+		f.kind = faultBusError
+		if f.address, err = parseUint32(args); err != nil {
+			return nil, err
+		}
+	case "brownout":
+		f.kind = faultBrownout
+		if args != "" {
+			return nil, errors.New("brownout does not take arguments")
+		}
+	default:
+		return nil, fmt.Errorf("unknown fault type %q", kind)
+	}
+	return f, nil
+}
+
+// Parse a time (or time range) into a cycle count.
+func parseFaultTime(s string, clock int, rng *rand.Rand) (uint64, error) {
+	if parts := strings.SplitN(s, "..", 2); len(parts) == 2 {
+		start, err := parseCycles(parts[0], clock)
+		if err != nil {
+			return 0, err
+		}
+		end, err := parseCycles(parts[1], clock)
+		if err != nil {
+			return 0, err
+		}
+		if end <= start {
+			return 0, errors.New("empty time range")
+		}
+		return start + uint64(rng.Int63n(int64(end-start))), nil
+	}
+	return parseCycles(s, clock)
+}
+
+// Parse a number of cycles, or a duration (with a unit) converted to cycles.
+func parseCycles(s string, clock int) (uint64, error) {
+	units := []struct {
+		suffix string
+		factor float64
+	}{
+		{"us", 1e-6},
+		{"ms", 1e-3},
+		{"s", 1},
+	}
+	for _, unit := range units {
+		if strings.HasSuffix(s, unit.suffix) {
+			value, err := strconv.ParseFloat(strings.TrimSuffix(s, unit.suffix), 64)
+			if err != nil || value < 0 {
+				return 0, fmt.Errorf("invalid duration: %q", s)
+			}
+			return uint64(value * unit.factor * float64(clock)), nil
+		}
+	}
+	return strconv.ParseUint(s, 0, 64)
+}
+
+func parseUint32(s string) (uint32, error) {
+	n, err := strconv.ParseUint(s, 0, 32)
+	return uint32(n), err
+}
+
+// Inject the fault into the machine.
+func (f *fault) inject(machine *C.machine_t) error {
+	switch f.kind {
+	case faultFlip:
+		if !C.machine_flip_bit(machine, C.uint32_t(f.address), C.uint32_t(f.value)) {
+			return fmt.Errorf("cannot flip bit at address 0x%x", f.address)
+		}
+	case faultStuck, faultBusError:
+		if !C.machine_inject_periph_fault(machine, C.uint32_t(f.address), C.uint32_t(f.value), f.kind == faultBusError) {
+			return errors.New("too many peripheral faults")
+		}
+	case faultBrownout:
+		C.machine_brownout(machine)
+	}
+	return nil
+}
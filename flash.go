@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// #include "machine.h"
+import "C"
+
+// This file implements the persistent flash file of -flash-file, and the
+// "emculator flash" subcommands that work on it (or on any raw flash image)
+// without running the firmware:
+//
+//	emculator flash dump flash.bin 0x3f000:256
+//	emculator flash diff before.bin after.bin
+//	emculator flash patch flash.bin 0x3f000 hex:0100ffff
+//
+// Addresses are offsets into the file, unless -base is given: then they are
+// addresses in the memory map, like 0x0803f000 on an STM32.
+
+// Load the flash contents of -flash-file, if it exists, with the firmware
+// image on top of it. Pages that the firmware doesn't use, like a settings
+// page, thus keep what the firmware wrote to them in an earlier run.
+func loadFlashFile(path string, firmware []byte, flashSize int) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return firmware, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != flashSize {
+		return nil, fmt.Errorf("%s has %d bytes, but the flash has %d", path, len(data), flashSize)
+	}
+	copy(data, firmware)
+	return data, nil
+}
+
+// Write the firmware image to the flash of the machine, like loadFlashFile
+// but without a copy of the flash file: where possible, the file is mapped
+// copy-on-write as the flash of the machine, so that only the pages that are
+// written to are copied. If path is empty or the file doesn't exist yet, the
+// rest of flash is erased.
+func loadFirmwareWithFlashFile(machine *C.machine_t, firmware []byte, path string) error {
+	if path == "" {
+		loadImage(machine, firmware)
+		return nil
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		loadImage(machine, firmware)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	flash := flashImage(machine)
+	if info.Size() != int64(len(flash)) {
+		return fmt.Errorf("%s has %d bytes, but the flash has %d", path, info.Size(), len(flash))
+	}
+	if !C.machine_map_image(machine, C.int(f.Fd())) {
+		if _, err := io.ReadFull(f, flash); err != nil {
+			return err
+		}
+	}
+	copy(flash, firmware)
+	return nil
+}
+
+// Write the flash contents to a file, for -flash-file. The file isn't
+// truncated first, as it may still be mapped as the flash of the machine.
+func saveFlashFile(machine *C.machine_t, path string) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0666)
+	if err == nil {
+		_, err = f.Write(flashImage(machine))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: cannot save flash:", err)
+	}
+}
+
+// A subcommand of "emculator flash".
+type flashCommand struct {
+	usage string
+	help  string
+	args  [2]int // minimum and maximum number of arguments after the flags
+	run   func(args []string, base uint32, w io.Writer) error
+}
+
+var flashCommands = map[string]flashCommand{
+	"dump":  {"dump FILE [ADDR[:SIZE]]", "print the contents as a hex dump (all of it by default)", [2]int{1, 2}, flashDump},
+	"diff":  {"diff FILE1 FILE2", "print the ranges of bytes that differ, and in which pages", [2]int{2, 2}, flashDiff},
+	"patch": {"patch FILE ADDR DATA", "change the file in place: DATA is hex:BYTES, erase:SIZE (set to 0xff) or file:PATH", [2]int{3, 3}, flashPatch},
+}
+
+// Flags of the flash subcommands, besides -base.
+var (
+	flagFlashPage   int
+	flagFlashOutput string
+)
+
+// Run "emculator flash" with the arguments after it, and return the exit
+// status.
+func runFlashCommand(args []string, w io.Writer) int {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "usage: emculator flash COMMAND [flags] ARGS...")
+		var names []string
+		for name := range flashCommands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(os.Stderr, "  %-26s %s\n", flashCommands[name].usage, flashCommands[name].help)
+		}
+	}
+	if len(args) == 0 {
+		usage()
+		return 2
+	}
+	command, ok := flashCommands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "error: unknown flash command %#v\n", args[0])
+		usage()
+		return 2
+	}
+	flags := flag.NewFlagSet("flash "+args[0], flag.ContinueOnError)
+	base := flags.String("base", "0", "address of the start of the file in the memory map, like 0x08000000 on STM32")
+	flags.IntVar(&flagFlashPage, "pagesize", 1024, "flash page size in bytes, for diff")
+	flags.StringVar(&flagFlashOutput, "o", "", "write the bytes of dump to this file instead of printing them")
+	flags.Usage = func() {
+		usage()
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	baseAddress, err := parseUint32(*base)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: invalid -base:", *base)
+		return 2
+	}
+	if flagFlashPage <= 0 || !isPowerOfTwo(flagFlashPage) {
+		fmt.Fprintln(os.Stderr, "error: -pagesize must be a power of two")
+		return 2
+	}
+	if flags.NArg() < command.args[0] || flags.NArg() > command.args[1] {
+		fmt.Fprintln(os.Stderr, "usage: emculator flash", command.usage)
+		return 2
+	}
+	if err := command.run(flags.Args(), baseAddress, w); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	return 0
+}
+
+// Parse an address, and return it as an offset into a file of the given size.
+func parseFlashOffset(s string, base uint32, size int) (int, error) {
+	address, err := parseUint32(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid address %#v", s)
+	}
+	if address < base || int(address-base) > size {
+		return 0, fmt.Errorf("address 0x%x is outside the file (0x%x..0x%x)", address, base, int(base)+size)
+	}
+	return int(address - base), nil
+}
+
+func flashDump(args []string, base uint32, w io.Writer) error {
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	start, end := 0, len(data)
+	if len(args) == 2 {
+		addr, size, hasSize := strings.Cut(args[1], ":")
+		start, err = parseFlashOffset(addr, base, len(data))
+		if err != nil {
+			return err
+		}
+		end = len(data)
+		if hasSize {
+			n, err := parseUint32(size)
+			if err != nil {
+				return fmt.Errorf("invalid size %#v", size)
+			}
+			if start+int(n) > len(data) {
+				return fmt.Errorf("0x%x bytes at 0x%x go past the end of the file", n, int(base)+start)
+			}
+			end = start + int(n)
+		}
+	}
+	if flagFlashOutput != "" {
+		return ioutil.WriteFile(flagFlashOutput, data[start:end], 0666)
+	}
+	dumpHex(w, data[start:end], int(base)+start)
+	return nil
+}
+
+// Print data like hexdump -C, with the given address for the first byte. Runs
+// of erased lines (all 0xff) are collapsed into a single "*".
+func dumpHex(w io.Writer, data []byte, address int) {
+	erased := false
+	for i := 0; i < len(data); i += 16 {
+		line := data[i:]
+		if len(line) > 16 {
+			line = line[:16]
+		}
+		if len(line) == 16 && strings.Trim(string(line), "\xff") == "" && i+16 < len(data) {
+			if !erased {
+				fmt.Fprintln(w, "*")
+				erased = true
+			}
+			continue
+		}
+		erased = false
+		text := make([]byte, len(line))
+		for j, c := range line {
+			text[j] = '.'
+			if c >= 0x20 && c < 0x7f {
+				text[j] = c
+			}
+		}
+		fmt.Fprintf(w, "%08x  %-47s  |%s|\n", address+i, strings.TrimSpace(hexBytes(line)), text)
+	}
+}
+
+// Format bytes as hex separated by spaces, with an extra space after 8 bytes.
+func hexBytes(data []byte) string {
+	var sb strings.Builder
+	for i, c := range data {
+		if i == 8 {
+			sb.WriteByte(' ')
+		}
+		fmt.Fprintf(&sb, "%02x ", c)
+	}
+	return sb.String()
+}
+
+func flashDiff(args []string, base uint32, w io.Writer) error {
+	a, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(args[1])
+	if err != nil {
+		return err
+	}
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	if len(a) != len(b) {
+		fmt.Fprintf(w, "sizes differ: %d and %d bytes, comparing the first %d\n", len(a), len(b), n)
+	}
+	differ := 0
+	for i := 0; i < n; {
+		if a[i] == b[i] {
+			i++
+			continue
+		}
+		start := i
+		for i < n && a[i] != b[i] {
+			i++
+		}
+		differ++
+		fmt.Fprintf(w, "0x%08x..0x%08x: %d bytes differ (page %d)\n", int(base)+start, int(base)+i, i-start, start/flagFlashPage)
+		if i-start <= 16 {
+			fmt.Fprintf(w, "  - %s\n  + %s\n", hex.EncodeToString(a[start:i]), hex.EncodeToString(b[start:i]))
+		}
+	}
+	if differ == 0 && len(a) == len(b) {
+		fmt.Fprintln(w, "files are identical")
+	}
+	return nil
+}
+
+func flashPatch(args []string, base uint32, w io.Writer) error {
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	offset, err := parseFlashOffset(args[1], base, len(data))
+	if err != nil {
+		return err
+	}
+	kind, value, _ := strings.Cut(args[2], ":")
+	var patch []byte
+	switch kind {
+	case "hex":
+		patch, err = hex.DecodeString(value)
+		if err != nil {
+			return fmt.Errorf("invalid hex data: %v", err)
+		}
+	case "erase":
+		size, err := parseUint32(value)
+		if err != nil {
+			return fmt.Errorf("invalid erase size %#v", value)
+		}
+		patch = make([]byte, size)
+		for i := range patch {
+			patch[i] = 0xff
+		}
+	case "file":
+		patch, err = ioutil.ReadFile(value)
+		if err != nil {
+			return err
+		}
+	default:
+		return errors.New("invalid data, expected hex:BYTES, erase:SIZE or file:PATH")
+	}
+	if offset+len(patch) > len(data) {
+		return fmt.Errorf("%d bytes at 0x%x go past the end of the file", len(patch), int(base)+offset)
+	}
+	copy(data[offset:], patch)
+	if err := ioutil.WriteFile(args[0], data, 0666); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "patched %d bytes at 0x%08x\n", len(patch), int(base)+offset)
+	return nil
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// #include "machine.h"
+import "C"
+
+// This file implements -flm, which programs the firmware into flash with a
+// flash algorithm from a CMSIS-Pack, like pyOCD, probe-rs and OpenOCD do on a
+// real chip, instead of running the firmware:
+//
+//	emculator run -machine=nrf52832 -flm=nrf52xxx.FLM firmware.elf
+//
+// The algorithm is loaded into RAM and its functions are called one by one:
+// Init, EraseSector for each sector under the firmware, UnInit, then Init
+// and ProgramPage for each page, and Verify if the algorithm has it. The
+// algorithm only sees the emulated flash controller, so what it gets wrong
+// (like a missing wait for NVMC.READY or a wrong sector size) shows up as a
+// fault, an error code or flash contents that don't match the firmware.
+//
+// https://open-cmsis-pack.github.io/Open-CMSIS-Pack-Spec/main/html/flashAlgorithm.html
+
+// A flash algorithm, loaded from an FLM file.
+type flmAlgorithm struct {
+	image      []byte            // the code and data, linked at address 0
+	staticBase uint32            // offset of the data, for the r9 register
+	functions  map[string]uint32 // offsets of the functions, with the Thumb bit
+	device     flmDevice
+}
+
+// The FlashDevice structure of a flash algorithm, which describes the flash it
+// programs.
+type flmDevice struct {
+	name           string
+	address        uint32
+	size           uint32
+	pageSize       uint32
+	empty          byte   // value of erased bytes
+	programTimeout uint32 // in milliseconds
+	eraseTimeout   uint32
+	sectors        []flmSectors
+}
+
+// A list of sectors of the same size, which lasts until the next one.
+type flmSectors struct {
+	size    uint32
+	address uint32 // relative to the start of flash
+}
+
+// The values of the fnc argument of Init and UnInit.
+const (
+	flmErase   = 1
+	flmProgram = 2
+	flmVerify  = 3
+)
+
+// Room on the stack for the functions of an algorithm. Algorithms hardly use
+// any stack, so this is what the tools reserve too.
+const flmStackSize = 1024
+
+// Load a flash algorithm from an FLM file: an ELF file with the sections
+// PrgCode and PrgData, which are position independent, and a DevDscr section
+// with the FlashDevice structure.
+func loadFLM(path string) (*flmAlgorithm, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if f.Machine != elf.EM_ARM {
+		return nil, errors.New("not an ARM flash algorithm")
+	}
+	algo := &flmAlgorithm{functions: map[string]uint32{}}
+	var device *elf.Section
+	for _, section := range f.Sections {
+		if section.Flags&elf.SHF_ALLOC == 0 {
+			continue
+		}
+		if section.Name == "DevDscr" {
+			device = section
+			continue
+		}
+		if section.Name == "PrgData" && (algo.staticBase == 0 || uint32(section.Addr) < algo.staticBase) {
+			algo.staticBase = uint32(section.Addr)
+		}
+		end := int(section.Addr + section.Size)
+		if end > len(algo.image) {
+			algo.image = append(algo.image, make([]byte, end-len(algo.image))...)
+		}
+		if section.Type == elf.SHT_NOBITS {
+			continue // zero-initialized data
+		}
+		data, err := section.Data()
+		if err != nil {
+			return nil, err
+		}
+		copy(algo.image[section.Addr:], data)
+	}
+	if len(algo.image) == 0 {
+		return nil, errors.New("no PrgCode section")
+	}
+	if device == nil {
+		return nil, errors.New("no DevDscr section")
+	}
+	symbols, err := f.Symbols()
+	if err != nil {
+		return nil, err
+	}
+	for _, sym := range symbols {
+		switch sym.Name {
+		case "Init", "UnInit", "EraseChip", "EraseSector", "ProgramPage", "Verify", "BlankCheck":
+			algo.functions[sym.Name] = uint32(sym.Value) | 1
+		case "FlashDevice":
+			data, err := device.Data()
+			if err != nil {
+				return nil, err
+			}
+			if sym.Value < device.Addr || sym.Value >= device.Addr+uint64(len(data)) {
+				return nil, errors.New("FlashDevice is not in the DevDscr section")
+			}
+			if err := algo.device.parse(data[sym.Value-device.Addr:]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if algo.device.pageSize == 0 {
+		return nil, errors.New("no FlashDevice structure")
+	}
+	for _, name := range []string{"Init", "UnInit", "EraseSector", "ProgramPage"} {
+		if _, ok := algo.functions[name]; !ok {
+			return nil, fmt.Errorf("no %s function", name)
+		}
+	}
+	return algo, nil
+}
+
+// Parse the FlashDevice structure, from the FlashOS.h of CMSIS.
+func (d *flmDevice) parse(data []byte) error {
+	if len(data) < 160 {
+		return errors.New("FlashDevice structure is too short")
+	}
+	le := binary.LittleEndian
+	name, _, _ := bytes.Cut(data[2:130], []byte{0})
+	d.name = string(name)
+	d.address = le.Uint32(data[132:])
+	d.size = le.Uint32(data[136:])
+	d.pageSize = le.Uint32(data[140:])
+	d.empty = data[148]
+	d.programTimeout = le.Uint32(data[152:])
+	d.eraseTimeout = le.Uint32(data[156:])
+	for i := 160; i+8 <= len(data); i += 8 {
+		size, address := le.Uint32(data[i:]), le.Uint32(data[i+4:])
+		if size == 0xffffffff && address == 0xffffffff {
+			break // SECTOR_END
+		}
+		if size == 0 || (len(d.sectors) != 0 && address <= d.sectors[len(d.sectors)-1].address) {
+			return fmt.Errorf("invalid sector list at entry %d", len(d.sectors))
+		}
+		d.sectors = append(d.sectors, flmSectors{size, address})
+	}
+	if len(d.sectors) == 0 || d.sectors[0].address != 0 {
+		return errors.New("the sector list doesn't start at the start of flash")
+	}
+	if d.pageSize == 0 {
+		return errors.New("the page size is zero")
+	}
+	return nil
+}
+
+// Return the start and size of the sector at the given offset in flash.
+func (d *flmDevice) sector(offset uint32) (uint32, uint32) {
+	sectors := d.sectors[0]
+	for _, s := range d.sectors {
+		if s.address <= offset {
+			sectors = s
+		}
+	}
+	return sectors.address + (offset-sectors.address)/sectors.size*sectors.size, sectors.size
+}
+
+// Program the firmware image into flash with the flash algorithm at path, and
+// check that the flash holds the image afterwards. The machine must be reset,
+// and its flash holds what was there before, like a -flash-file.
+func runFLM(m *Machine, path string, image []byte, flashBase uint32, clock int, w io.Writer) error {
+	algo, err := loadFLM(path)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	dev := &algo.device
+	fmt.Fprintf(w, "algorithm: %s, flash at 0x%08x (%d kB, %d byte pages)\n", dev.name, dev.address, dev.size/1024, dev.pageSize)
+	if dev.address != flashBase {
+		return fmt.Errorf("the algorithm is for flash at 0x%08x, but the machine has flash at 0x%08x", dev.address, flashBase)
+	}
+	flash := flashImage(m.machine)
+	if uint64(len(image)) > uint64(dev.size) || len(image) > len(flash) {
+		return fmt.Errorf("the firmware (%d bytes) doesn't fit in the flash of the algorithm", len(image))
+	}
+
+	// Place the algorithm at the start of RAM, with a buffer for a page after
+	// it and the stack at the end of RAM.
+	const ramBase = 0x20000000
+	buffer := (ramBase + uint32(len(algo.image)) + 3) &^ 3
+	stackTop := (ramBase + uint32(m.machine.mem_size)) &^ 7
+	if uint64(buffer)+uint64(dev.pageSize)+flmStackSize > uint64(stackTop) {
+		return fmt.Errorf("the algorithm (%d bytes) and a page don't fit in RAM", len(algo.image))
+	}
+	m.WriteMemory(ramBase, algo.image)
+
+	// Call a function of the algorithm and return what it returned. The
+	// function returns to the exit address of the emulator, which stops it.
+	call := func(name string, timeout uint32, args ...uint32) (uint32, error) {
+		regs := m.DebugRegisters()
+		copy(regs[:4], args)
+		regs[9] = ramBase + algo.staticBase
+		regs[13] = stackTop
+		regs[14] = 0xdeadbeef
+		regs[15] = ramBase + algo.functions[name]&^1
+		regs[16] = 1 << 24 // Thumb
+		m.WriteState(&regs)
+		if timeout == 0 {
+			timeout = 1000
+		}
+		C.machine_set_instruction_limit(m.machine, m.machine.stats.instructions+C.uint64_t(uint64(timeout)*uint64(clock)/1000))
+		stop := m.Run()
+		C.machine_set_instruction_limit(m.machine, 0)
+		switch stop.Reason {
+		case StopExit:
+			return m.ReadRegister(0), nil
+		case StopLimit:
+			return 0, fmt.Errorf("%s didn't return within its timeout of %dms", name, timeout)
+		default:
+			return 0, fmt.Errorf("%s stopped: %v", name, stop)
+		}
+	}
+	// Call Init or UnInit, which return 0 on success.
+	initialize := func(name string, fnc uint32) error {
+		args := []uint32{fnc}
+		if name == "Init" {
+			args = []uint32{dev.address, uint32(clock), fnc}
+		}
+		ret, err := call(name, 0, args...)
+		if err == nil && ret != 0 {
+			err = fmt.Errorf("%s(%d) returned %d", name, fnc, ret)
+		}
+		return err
+	}
+	instructions := func() uint64 {
+		return uint64(m.machine.stats.instructions)
+	}
+
+	// Erase the sectors under the firmware, and check that they're erased.
+	start := instructions()
+	if err := initialize("Init", flmErase); err != nil {
+		return err
+	}
+	sectors := 0
+	for offset := uint32(0); offset < uint32(len(image)); {
+		sector, size := dev.sector(offset)
+		ret, err := call("EraseSector", dev.eraseTimeout, dev.address+sector)
+		if err != nil {
+			return err
+		}
+		if ret != 0 {
+			return fmt.Errorf("EraseSector(0x%08x) returned %d", dev.address+sector, ret)
+		}
+		for i := sector; i < sector+size && int(i) < len(flash); i++ {
+			if flash[i] != dev.empty {
+				return fmt.Errorf("EraseSector(0x%08x) left 0x%02x at 0x%08x", dev.address+sector, flash[i], dev.address+i)
+			}
+		}
+		sectors++
+		offset = sector + size
+	}
+	if err := initialize("UnInit", flmErase); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "erase:     %d sectors in %d instructions\n", sectors, instructions()-start)
+
+	// Program the pages, the last one padded with erased bytes.
+	start = instructions()
+	if err := initialize("Init", flmProgram); err != nil {
+		return err
+	}
+	page := make([]byte, dev.pageSize)
+	pages := 0
+	for offset := uint32(0); offset < uint32(len(image)); offset += dev.pageSize {
+		n := copy(page, image[offset:])
+		for i := n; i < len(page); i++ {
+			page[i] = dev.empty
+		}
+		m.WriteMemory(int(buffer), page)
+		ret, err := call("ProgramPage", dev.programTimeout, dev.address+offset, dev.pageSize, buffer)
+		if err != nil {
+			return err
+		}
+		if ret != 0 {
+			return fmt.Errorf("ProgramPage(0x%08x) returned %d", dev.address+offset, ret)
+		}
+		pages++
+	}
+	if err := initialize("UnInit", flmProgram); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "program:   %d pages in %d instructions\n", pages, instructions()-start)
+
+	// Let the algorithm verify the pages, if it can: Verify returns the end of
+	// the range when it matches, and the first address that differs if not.
+	if _, ok := algo.functions["Verify"]; ok {
+		start = instructions()
+		if err := initialize("Init", flmVerify); err != nil {
+			return err
+		}
+		for offset := uint32(0); offset < uint32(len(image)); offset += dev.pageSize {
+			size := uint32(len(image)) - offset
+			if size > dev.pageSize {
+				size = dev.pageSize
+			}
+			m.WriteMemory(int(buffer), image[offset:offset+size])
+			ret, err := call("Verify", dev.programTimeout, dev.address+offset, size, buffer)
+			if err != nil {
+				return err
+			}
+			if ret != dev.address+offset+size {
+				return fmt.Errorf("Verify(0x%08x) reported a difference at 0x%08x", dev.address+offset, ret)
+			}
+		}
+		if err := initialize("UnInit", flmVerify); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "verify:    %d pages in %d instructions\n", pages, instructions()-start)
+	}
+
+	// Check the result, whatever the algorithm reported.
+	for i, c := range image {
+		if flash[i] != c {
+			return fmt.Errorf("flash at 0x%08x is 0x%02x instead of 0x%02x", dev.address+uint32(i), flash[i], c)
+		}
+	}
+	fmt.Fprintf(w, "flash matches the firmware (%d bytes)\n", len(image))
+	return nil
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+// #include "machine.h"
+import "C"
+
+// This file implements coverage-guided fuzzing of firmware. Inputs are fed
+// into the UART, an I2C device or the radio, and the edge coverage map of the
+// C core is used as feedback, much like AFL and libFuzzer do for host programs.
+
+// Size of the coverage map. Must be a power of two.
+const fuzzCoverageSize = 1 << 16
+
+// How often (in cycles) the fuzzer checks whether the radio listens for the
+// next packet.
+const fuzzRadioPoll = 1000
+
+// FuzzStatus is the outcome of running a single fuzz input.
+type FuzzStatus int
+
+const (
+	FuzzOK      FuzzStatus = iota // firmware exited or ran out of input
+	FuzzCrash                     // firmware hit a fault
+	FuzzTimeout                   // firmware didn't finish within the time limit
+)
+
+// FuzzChannel is how the fuzz input reaches the firmware.
+type FuzzChannel int
+
+const (
+	FuzzUART  FuzzChannel = iota // received on the UART
+	FuzzI2C                      // read from an I2C device, one byte per read
+	FuzzRadio                    // received by the radio, as packets
+)
+
+// FuzzConfig is the machine that a Fuzzer runs the firmware on, and how the
+// inputs reach the firmware.
+type FuzzConfig struct {
+	Machine     string // chip family, chip or board, like -machine
+	FlashSize   int    // in bytes
+	PageSize    int    // flash page size in bytes
+	RAMSize     int    // in bytes
+	Clock       int    // in Hz
+	Permissions string // like -permissions
+	Timeout     uint64 // maximum number of cycles per input
+	Channel     FuzzChannel
+	I2CAddress  uint8 // address of the I2C device with FuzzI2C
+	Verbose     bool  // print the output of the firmware
+}
+
+// FuzzResult is the result of running a single fuzz input.
+type FuzzResult struct {
+	Status      FuzzStatus
+	Err         StopReason // why the machine stopped
+	PC          uint32     // PC at the time the machine stopped
+	NewCoverage bool       // whether this input reached new code
+}
+
+// Fuzzer runs firmware repeatedly with different inputs and tracks the
+// coverage reached by all inputs.
+type Fuzzer struct {
+	machine  *C.machine_t
+	m        *Machine
+	config   FuzzConfig
+	firmware unsafe.Pointer
+	size     int
+	input    []byte // input of the current run
+	pos      int    // bytes of input read by the I2C device
+	coverage []byte
+	virgin   []byte // bits of the coverage map that have not been seen yet
+}
+
+// NewFuzzer creates a new fuzzer for the given firmware image.
+func NewFuzzer(firmware []byte, config FuzzConfig) (*Fuzzer, error) {
+	preset, ok := machinePresets[config.Machine]
+	if !ok {
+		return nil, fmt.Errorf("unknown machine %#v", config.Machine)
+	}
+	if _, err := parsePermissions(config.Permissions); err != nil {
+		return nil, err
+	}
+	switch config.Channel {
+	case FuzzUART, FuzzI2C:
+	case FuzzRadio:
+		if preset.family != C.FAMILY_NRF {
+			return nil, fmt.Errorf("machine %s has no radio to fuzz", config.Machine)
+		}
+	default:
+		return nil, fmt.Errorf("unknown fuzz channel %d", config.Channel)
+	}
+	f := &Fuzzer{
+		machine:  C.machine_create(C.size_t(config.FlashSize), C.size_t(config.PageSize), C.size_t(config.RAMSize), C.LOG_NONE),
+		config:   config,
+		firmware: C.CBytes(firmware),
+		size:     len(firmware),
+		virgin:   make([]byte, fuzzCoverageSize),
+	}
+	f.m = NewMachine(f.machine, nil, nil)
+	if !config.Verbose {
+		f.machine.uart[0].mute = true
+		f.m.console = ioutil.Discard
+	}
+	C.machine_set_family(f.machine, preset.family)
+	C.machine_set_clock(f.machine, C.uint32_t(config.Clock))
+	C.machine_set_deterministic(f.machine, true)
+	setPermissions(f.machine, config.Permissions)
+	if config.Channel == FuzzI2C {
+		bus := getSensorBus(f.m)
+		bus.i2c = append(bus.i2c, &sensor{model: fuzzI2CDevice{f}, address: config.I2CAddress})
+	}
+	coverage := C.machine_enable_coverage(f.machine, fuzzCoverageSize)
+	f.coverage = unsafe.Slice((*byte)(coverage), fuzzCoverageSize)
+	for i := range f.virgin {
+		f.virgin[i] = 0xff
+	}
+	return f, nil
+}
+
+// Free all resources associated with this fuzzer.
+func (f *Fuzzer) Free() {
+	C.machine_free(f.machine)
+	C.free(f.firmware)
+}
+
+// Run the firmware from a clean state with the given input.
+func (f *Fuzzer) Run(input []byte) FuzzResult {
+	for i := range f.coverage {
+		f.coverage[i] = 0
+	}
+
+	C.machine_load(f.machine, (*C.uint8_t)(f.firmware), C.size_t(f.size))
+	C.machine_power_cycle(f.machine)
+	C.machine_seed(f.machine, 1)
+	f.input, f.pos = input, 0
+	deadline := uint64(f.machine.stats.cycles) + f.config.Timeout
+	var err *StopError
+	switch f.config.Channel {
+	case FuzzUART:
+		cinput := C.CBytes(input)
+		C.machine_set_uart_input(f.machine, (*C.uint8_t)(cinput), C.size_t(len(input)))
+		err = f.run(deadline)
+		C.machine_set_uart_input(f.machine, nil, 0)
+		C.free(cinput)
+	case FuzzI2C:
+		err = f.run(deadline)
+	case FuzzRadio:
+		err = f.runRadio(deadline)
+	}
+	f.input = nil
+
+	result := FuzzResult{
+		Err:         err.Reason,
+		PC:          err.PC,
+		NewCoverage: f.updateCoverage(),
+	}
+	switch err.Reason {
+	case StopExit, StopInputEOF, StopHalt:
+		result.Status = FuzzOK
+	case StopDeadline:
+		result.Status = FuzzTimeout
+	default:
+		result.Status = FuzzCrash
+	}
+	return result
+}
+
+// Run until the given cycle, or until the firmware stops. Exiting with a
+// non-zero code (like a failed assertion) counts as a crash.
+func (f *Fuzzer) run(deadline uint64) *StopError {
+	C.machine_set_deadline(f.machine, C.uint64_t(deadline))
+	for {
+		err := f.m.Run()
+		if err.Reason != StopSemihosting {
+			return err
+		}
+		if exit, code := f.m.semihost(); exit {
+			err = &StopError{Reason: StopExit, PC: err.PC, ExitCode: code}
+			if code != 0 {
+				err.Reason = StopSemihosting
+			}
+			return err
+		}
+	}
+}
+
+// Run with the input as radio packets: each is a length byte followed by the
+// packet. The next packet is received as soon as the radio listens for it.
+// When it listens after the last packet, the run ends like it does when the
+// UART input runs out.
+func (f *Fuzzer) runRadio(deadline uint64) *StopError {
+	packets := fuzzRadioPackets(f.input)
+	for {
+		until := uint64(f.machine.stats.cycles) + fuzzRadioPoll
+		if until > deadline {
+			until = deadline
+		}
+		err := f.run(until)
+		if err.Reason != StopDeadline || until == deadline {
+			return err
+		}
+		var frequency, mode C.uint32_t
+		var address C.uint64_t
+		if !C.machine_radio_listening(f.machine, &frequency, &mode, &address) {
+			continue
+		}
+		if len(packets) == 0 {
+			return &StopError{Reason: StopInputEOF, PC: err.PC}
+		}
+		packet := C.CBytes(packets[0])
+		C.machine_radio_receive(f.machine, (*C.uint8_t)(packet), C.uint32_t(len(packets[0])), frequency, mode, address)
+		C.free(packet)
+		packets = packets[1:]
+	}
+}
+
+// Split a radio fuzz input into packets, each of which starts with its length.
+// The last packet is cut short when the input ends.
+func fuzzRadioPackets(input []byte) [][]byte {
+	var packets [][]byte
+	for len(input) != 0 {
+		length := 1 + int(input[0])
+		if length > len(input) {
+			length = len(input)
+		}
+		packets = append(packets, input[1:length])
+		input = input[length:]
+	}
+	return packets
+}
+
+// An I2C device whose registers read as the fuzz input, one byte per read.
+// Writes are ignored.
+type fuzzI2CDevice struct {
+	f *Fuzzer
+}
+
+func (d fuzzI2CDevice) sample(t float64, values map[string]float64) {
+}
+
+func (d fuzzI2CDevice) readRegister(reg uint8) uint8 {
+	f := d.f
+	if f.pos >= len(f.input) {
+		// Stop the machine, as more reads won't find anything new.
+		f.machine.input_eof = true
+		return 0xff
+	}
+	f.pos++
+	return f.input[f.pos-1]
+}
+
+func (d fuzzI2CDevice) writeRegister(reg, value uint8) {
+}
+
+// The channel of the config in the syntax of -fuzz-channel.
+func (config FuzzConfig) channelName() string {
+	switch config.Channel {
+	case FuzzI2C:
+		return fmt.Sprintf("i2c@0x%02x", config.I2CAddress)
+	case FuzzRadio:
+		return "radio"
+	default:
+		return "uart"
+	}
+}
+
+// Parse a -fuzz-channel: uart, radio, or i2c@ADDRESS like i2c@0x50.
+func parseFuzzChannel(s string) (FuzzChannel, uint8, error) {
+	switch s {
+	case "uart":
+		return FuzzUART, 0, nil
+	case "radio":
+		return FuzzRadio, 0, nil
+	}
+	if address, ok := strings.CutPrefix(s, "i2c@"); ok {
+		n, err := strconv.ParseUint(address, 0, 7)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid I2C address %#v", address)
+		}
+		return FuzzI2C, uint8(n), nil
+	}
+	return 0, 0, fmt.Errorf("invalid fuzz channel %#v, expected uart, radio or i2c@ADDRESS", s)
+}
+
+// Merge the coverage map of the last run into the global coverage, returning
+// whether any new coverage was found. Hit counts are put in buckets like AFL
+// does, so that a loop running a few more times also counts as new behavior.
+func (f *Fuzzer) updateCoverage() bool {
+	found := false
+	for i, count := range f.coverage {
+		if count == 0 {
+			continue
+		}
+		bucket := coverageBucket(count)
+		if f.virgin[i]&bucket != 0 {
+			f.virgin[i] &^= bucket
+			found = true
+		}
+	}
+	return found
+}
+
+// Number of edges that have been hit by any input.
+func (f *Fuzzer) Edges() int {
+	edges := 0
+	for _, b := range f.virgin {
+		if b != 0xff {
+			edges++
+		}
+	}
+	return edges
+}
+
+func coverageBucket(count byte) byte {
+	switch {
+	case count <= 3:
+		return 1 << (count - 1) // 1, 2, 3 map to bit 0, 1, 2
+	case count <= 7:
+		return 1 << 3
+	case count <= 15:
+		return 1 << 4
+	case count <= 31:
+		return 1 << 5
+	case count <= 127:
+		return 1 << 6
+	default:
+		return 1 << 7
+	}
+}
+
+// Values that are likely to trigger edge cases in input parsers.
+var fuzzInterestingBytes = []byte{0, 1, 0x7f, 0x80, 0xff, '\r', '\n', ' ', '0', '9', 'a', 'z', 3, 4, 0x1b}
+
+// Mutate the given input, returning a new slice.
+func fuzzMutate(rng *rand.Rand, input []byte, corpus [][]byte, maxLen int) []byte {
+	data := append([]byte(nil), input...)
+	for n := 1 + rng.Intn(4); n > 0; n-- {
+		switch rng.Intn(7) {
+		case 0: // flip a bit
+			if len(data) > 0 {
+				data[rng.Intn(len(data))] ^= 1 << uint(rng.Intn(8))
+			}
+		case 1: // set a random byte
+			if len(data) > 0 {
+				data[rng.Intn(len(data))] = byte(rng.Intn(256))
+			}
+		case 2: // set an interesting byte
+			if len(data) > 0 {
+				data[rng.Intn(len(data))] = fuzzInterestingBytes[rng.Intn(len(fuzzInterestingBytes))]
+			}
+		case 3: // insert a byte
+			pos := rng.Intn(len(data) + 1)
+			data = append(data[:pos], append([]byte{byte(rng.Intn(256))}, data[pos:]...)...)
+		case 4: // remove a byte
+			if len(data) > 0 {
+				pos := rng.Intn(len(data))
+				data = append(data[:pos], data[pos+1:]...)
+			}
+		case 5: // duplicate a chunk
+			if len(data) > 0 {
+				start := rng.Intn(len(data))
+				end := start + 1 + rng.Intn(len(data)-start)
+				pos := rng.Intn(len(data) + 1)
+				chunk := append([]byte(nil), data[start:end]...)
+				data = append(data[:pos], append(chunk, data[pos:]...)...)
+			}
+		case 6: // splice with another corpus entry
+			other := corpus[rng.Intn(len(corpus))]
+			if len(other) > 0 {
+				pos := rng.Intn(len(data) + 1)
+				data = append(data[:pos:pos], other[rng.Intn(len(other)):]...)
+			}
+		}
+	}
+	if len(data) > maxLen {
+		data = data[:maxLen]
+	}
+	return data
+}
+
+// Run a fuzzing session: read the corpus from corpusDir, and keep mutating
+// inputs until a crash is found or the given number of runs (0 for no limit)
+// is reached. New interesting inputs are stored in the corpus directory, crashes
+// and timeouts are stored in artifactDir. It returns whether a crash was found.
+func runFuzzer(firmware []byte, imagePath string, config FuzzConfig, corpusDir, artifactDir string, runs int, maxLen int, seed int64) (bool, error) {
+	if err := os.MkdirAll(corpusDir, 0777); err != nil {
+		return false, err
+	}
+	files, err := ioutil.ReadDir(corpusDir)
+	if err != nil {
+		return false, err
+	}
+	var corpus [][]byte
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(corpusDir, file.Name()))
+		if err != nil {
+			return false, err
+		}
+		corpus = append(corpus, data)
+	}
+	if len(corpus) == 0 {
+		corpus = append(corpus, []byte{})
+	}
+
+	fuzzer, err := NewFuzzer(firmware, config)
+	if err != nil {
+		return false, err
+	}
+	defer fuzzer.Free()
+	rng := rand.New(rand.NewSource(seed))
+	start := time.Now()
+	lastStatus := start
+
+	// Run the initial corpus first, so that inputs are only added when they
+	// find something new.
+	for _, input := range corpus {
+		fuzzer.Run(input)
+	}
+	fmt.Fprintf(os.Stderr, "#%d\tINITED cov: %d corp: %d\n", len(corpus), fuzzer.Edges(), len(corpus))
+
+	for i := len(corpus); runs == 0 || i < runs; i++ {
+		input := fuzzMutate(rng, corpus[rng.Intn(len(corpus))], corpus, maxLen)
+		result := fuzzer.Run(input)
+		if result.Status != FuzzOK {
+			prefix := "crash-"
+			if result.Status == FuzzTimeout {
+				prefix = "timeout-"
+			}
+			path, err := writeFuzzInput(artifactDir, prefix, input)
+			if err != nil {
+				return false, err
+			}
+			fmt.Fprintf(os.Stderr, "#%d\t%s at PC 0x%x: %s\n", i, result.Err, result.PC, path)
+			if config.Channel == FuzzUART {
+				fmt.Fprintf(os.Stderr, "reproduce with: emculator -uart-input=%s %s\n", path, imagePath)
+			} else {
+				fmt.Fprintf(os.Stderr, "reproduce with: emculator -fuzz-channel=%s -fuzz-replay=%s %s\n", config.channelName(), path, imagePath)
+			}
+			if result.Status == FuzzCrash {
+				return true, nil
+			}
+		}
+		if result.NewCoverage {
+			corpus = append(corpus, input)
+			if _, err := writeFuzzInput(corpusDir, "", input); err != nil {
+				return false, err
+			}
+			fmt.Fprintf(os.Stderr, "#%d\tNEW    cov: %d corp: %d len: %d\n", i, fuzzer.Edges(), len(corpus), len(input))
+		}
+		if time.Since(lastStatus) > 5*time.Second {
+			lastStatus = time.Now()
+			fmt.Fprintf(os.Stderr, "#%d\tpulse  cov: %d corp: %d exec/s: %.0f\n", i, fuzzer.Edges(), len(corpus), float64(i)/time.Since(start).Seconds())
+		}
+	}
+	fmt.Fprintf(os.Stderr, "done: cov: %d corp: %d\n", fuzzer.Edges(), len(corpus))
+	return false, nil
+}
+
+// Run the firmware once with the input stored in path, printing its output,
+// and report how it stopped. It returns whether the input crashed the firmware
+// or timed out.
+func replayFuzzInput(firmware []byte, config FuzzConfig, path string) (bool, error) {
+	input, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	config.Verbose = true
+	fuzzer, err := NewFuzzer(firmware, config)
+	if err != nil {
+		return false, err
+	}
+	defer fuzzer.Free()
+	result := fuzzer.Run(input)
+	fmt.Fprintf(os.Stderr, "%s at PC 0x%x\n", result.Err, result.PC)
+	return result.Status != FuzzOK, nil
+}
+
+// Write the input to a file named after its SHA1 hash and return the path.
+func writeFuzzInput(dir, prefix string, input []byte) (string, error) {
+	hash := sha1.Sum(input)
+	path := filepath.Join(dir, prefix+hex.EncodeToString(hash[:]))
+	return path, ioutil.WriteFile(path, input, 0666)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// #include "machine.h"
+import "C"
+
+// This file implements the extensions of the remote protocol that LLDB uses,
+// so that it can connect with "gdb-remote 7333" without arm-none-eabi-gdb:
+// information about the target and its memory regions, and the register
+// layout for an LLDB built without XML support (which can't read target.xml).
+// See https://github.com/llvm/llvm-project/blob/main/lldb/docs/resources/lldbgdbremote.md
+
+// The registers as LLDB sees them, in the order of target.xml.
+var gdbLLDBRegisters = []struct {
+	name    string
+	altName string
+	generic string // the role of the register in the calling convention
+}{
+	{"r0", "", "arg1"},
+	{"r1", "", "arg2"},
+	{"r2", "", "arg3"},
+	{"r3", "", "arg4"},
+	{"r4", "", ""},
+	{"r5", "", ""},
+	{"r6", "", ""},
+	{"r7", "", "fp"},
+	{"r8", "", ""},
+	{"r9", "", ""},
+	{"r10", "", ""},
+	{"r11", "", ""},
+	{"r12", "", ""},
+	{"sp", "r13", "sp"},
+	{"lr", "r14", "ra"},
+	{"pc", "r15", "pc"},
+	{"xpsr", "cpsr", "flags"},
+}
+
+// Handle a packet that only LLDB sends. It returns false if the packet isn't
+// one of those.
+func gdbLLDBPacket(machine *Machine, packet string) (string, bool) {
+	triple := hex.EncodeToString([]byte(gdbTriple(machine)))
+	switch {
+	case packet == "qHostInfo":
+		return "triple:" + triple + ";endian:little;ptrsize:4;", true
+	case packet == "qProcessInfo":
+		return "pid:1;triple:" + triple + ";endian:little;ptrsize:4;", true
+	case strings.HasPrefix(packet, "qRegisterInfo"):
+		n, err := strconv.ParseUint(packet[len("qRegisterInfo"):], 16, 32)
+		if err != nil || n >= uint64(len(gdbLLDBRegisters)) {
+			// LLDB asks for registers until it gets an error.
+			return "E45", true
+		}
+		reg := gdbLLDBRegisters[n]
+		reply := fmt.Sprintf("name:%s;", reg.name)
+		if reg.altName != "" {
+			reply += fmt.Sprintf("alt-name:%s;", reg.altName)
+		}
+		reply += fmt.Sprintf("bitsize:32;offset:%d;encoding:uint;format:hex;set:General Purpose Registers;", n*4)
+		if n < 16 {
+			// xPSR has no DWARF register number.
+			reply += fmt.Sprintf("ehframe:%d;dwarf:%d;", n, n)
+		}
+		if reg.generic != "" {
+			reply += fmt.Sprintf("generic:%s;", reg.generic)
+		}
+		return reply, true
+	case strings.HasPrefix(packet, "qMemoryRegionInfo:"):
+		address, err := strconv.ParseUint(packet[len("qMemoryRegionInfo:"):], 16, 32)
+		if err != nil {
+			return "E01", true
+		}
+		return gdbMemoryRegionInfo(machine, address), true
+	}
+	return "", false
+}
+
+// Return the LLVM target triple of the emulated core.
+func gdbTriple(machine *Machine) string {
+	if machine.machine.family == C.FAMILY_RP2040 {
+		return "thumbv6m-none-eabi" // Cortex-M0+
+	}
+	return "thumbv7em-none-eabi"
+}
+
+// Describe the memory region around an address for qMemoryRegionInfo: its
+// start, size and permissions. An address outside all regions is described as
+// the unmapped gap up to the next region.
+func gdbMemoryRegionInfo(machine *Machine, address uint64) string {
+	regions := memoryRegions(machine)
+	next := uint64(1 << 32)
+	for _, r := range regions {
+		if address >= r.start && address < r.start+r.size {
+			return fmt.Sprintf("start:%x;size:%x;permissions:%s;", r.start, r.size, r.permissions)
+		}
+		if r.start > address && r.start < next {
+			next = r.start
+		}
+	}
+	return fmt.Sprintf("start:%x;size:%x;", address, next-address)
+}
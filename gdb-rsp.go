@@ -2,13 +2,16 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/binary"
 	"encoding/hex"
-	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"strconv"
 	"strings"
+	"sync/atomic"
 )
 
 // This file implements the GDB Remote Serial Protocol (RSP).
@@ -47,28 +50,28 @@ var gdbAnnexTarget = `<?xml version="1.0"?>
 </target>
 `
 
-// GDB will request this to know the memory map of the device.
-var gdbAnnexMemoryMap = `<memory-map>
-<memory type="flash" start="0x0" length="0x%x">
-<property name="blocksize">0x%x</property>
-</memory>
-<memory type="ram" start="0x20000000" length="0x%x"/>
-</memory-map>
-`
+// The maximum size of a packet, including the framing characters. GDB sizes
+// its memory reads and writes to fit in it.
+const gdbPacketSize = 0x10000
 
-// Wait for GDB to connect and handle each connection.
-func gdbServer(machine *C.machine_t, port string, runChan chan struct{}) error {
-	sock, err := net.Listen("tcp", port)
+// Wait for GDB to connect and handle each connection. The port is either a
+// TCP address like "localhost:7333" or a unix domain socket like
+// "unix:/tmp/gdb.sock".
+func gdbServer(m *Machine, port string) error {
+	network := "tcp"
+	if strings.HasPrefix(port, "unix:") {
+		network = "unix"
+		port = port[len("unix:"):]
+		// Remove a stale socket from a previous run.
+		if info, err := os.Lstat(port); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(port)
+		}
+	}
+	sock, err := net.Listen(network, port)
 	if err != nil {
 		return err
 	}
 
-	m := &Machine{
-		machine: machine,
-		halted:  false,
-		runChan: runChan,
-	}
-
 	for {
 		conn, err := sock.Accept()
 		if err != nil {
@@ -82,20 +85,118 @@ func gdbServer(machine *C.machine_t, port string, runChan chan struct{}) error {
 		if err != nil {
 			fmt.Fprintln(os.Stderr, "gdb handler error:", err)
 		}
+		conn.Close()
 	}
 }
 
+// Handle the single GDB connection over standard input and output, when GDB
+// started the emulator with "target remote | emculator ...". The emulator
+// exits when GDB closes the connection.
+func gdbServeStdio(m *Machine, conn io.ReadWriter) {
+	err := gdbHandle(conn, m)
+	terminalDisableRaw()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gdb handler error:", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// Return a connection to GDB over standard input and output. UART and
+// semihosting output is sent to standard error instead, so that it doesn't
+// interfere with the protocol. This must be called before the machine starts
+// running.
+func gdbStdio(m *Machine) io.ReadWriter {
+	terminalOutput = os.Stderr
+	terminalUseInput(strings.NewReader(""))
+	m.console = os.Stderr
+	return struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}
+}
+
 // Handles a single GDB connection, receiving and handling commands.
-func gdbHandle(sock net.Conn, machine *Machine) error {
+func gdbHandle(sock io.ReadWriter, machine *Machine) error {
 	conn := bufio.NewReadWriter(bufio.NewReader(sock), bufio.NewWriter(sock))
 	acks := true
+	attached := true // false when the program was started with vRun
+	thread := "1"    // the ID of the only thread, "p1.1" with multiprocess extensions
+	nonStop := false // GDB uses non-stop mode, see QNonStop
+	resumed := false // in non-stop mode: GDB resumed the target and wasn't told it stopped
+	resume := false  // in non-stop mode: continue the target after handling this packet
+	// Halt the machine when GDB attaches, like a debug probe halts the chip.
+	// GDB may read registers and memory before it asks why the target
+	// stopped, and these reads must not race with the running firmware. The
+	// machine may also have stopped by itself already, on a fault or a
+	// breakpoint: then that is the stop reason that GDB gets.
+	if machine.Running() {
+		machine.Halt()
+	}
+	defer func() {
+		machine.lockHalted()
+		gdbRelease(machine)
+		machine.lock.Unlock()
+	}()
 	packetChan := make(chan string)
 	go gdbRecvPackets(conn, packetChan)
-	for packet := range packetChan {
+	var queued []string // received while stepping through a range
+	// Each packet is handled with the machine lock held and the machine
+	// halted, as GDB assumes the target is halted while it isn't continuing
+	// it. The machine may have been continued by something else, like the
+	// control socket, in which case it is halted again.
+	// In non-stop mode GDB sends packets while the target runs, to read
+	// variables for example. The machine is then only halted while the packet
+	// is handled, like with Pause, and GDB is notified when it stops by itself.
+	release := func() {
+		if resume {
+			machine.Continue()
+		}
+		machine.lock.Unlock()
+	}
+	for ; ; release() {
+		resume = false
+		var packet string
+		var ok bool
+		if len(queued) != 0 {
+			packet, ok = queued[0], true
+			queued = queued[1:]
+		} else if resumed {
+			select {
+			case packet, ok = <-packetChan:
+			case <-machine.stoppedChan():
+				// It may only be paused for a moment, see the 'c' packet.
+				machine.lock.Lock()
+				if machine.Halted() {
+					resumed = false
+					gdbSendNotification(conn, "Stop:"+gdbStopReply(machine, thread))
+					conn.Flush()
+				}
+				continue
+			}
+		} else {
+			packet, ok = <-packetChan
+		}
+		if !ok {
+			break
+		}
+		if machine.lockHalted() && resumed {
+			if machine.stop != nil && machine.stop.Reason == StopHalt {
+				machine.stop = machine.resumedFrom
+				resume = true
+			}
+		}
 		if packet == "" {
 			continue
 		}
 
+		if packet == "\x03" {
+			// Interrupt while the target is already halted: nothing to do. In
+			// non-stop mode, GDB is notified that it stopped.
+			resume = false
+			continue
+		}
+
 		// This is required before QStartNoAckMode has been negotiated.
 		// It has no use over TCP.
 		if acks {
@@ -104,12 +205,114 @@ func gdbHandle(sock net.Conn, machine *Machine) error {
 
 		if strings.HasPrefix(packet, "qSupported:") {
 			// Copied from OpenOCD.
-			gdbSendPacket(conn, "PacketSize=3fff;qXfer:memory-map:read+;qXfer:features:read+;QStartNoAckMode+")
+			reply := fmt.Sprintf("PacketSize=%x;qXfer:memory-map:read+;qXfer:features:read+;QStartNoAckMode+;QNonStop+", gdbPacketSize)
+			if strings.Contains(packet, "multiprocess+") {
+				reply += ";multiprocess+"
+				thread = "p1.1"
+			}
+			gdbSendPacket(conn, reply)
 		} else if packet == "QStartNoAckMode" {
 			gdbSendPacket(conn, "OK")
 			acks = false
-		} else if packet == "Hg0" {
-			gdbSendPacket(conn, "OK") // set thread mode
+		} else if packet == "QNonStop:0" || packet == "QNonStop:1" {
+			// GDB only switches modes while the target is halted.
+			nonStop = packet == "QNonStop:1"
+			gdbSendPacket(conn, "OK")
+		} else if packet == "vStopped" {
+			// GDB acknowledges a stop notification. There is only a single
+			// thread, so there are never more stops to report.
+			gdbSendPacket(conn, "OK")
+		} else if packet == "vCont?" {
+			gdbSendPacket(conn, "vCont;c;C;s;S;t;r")
+		} else if strings.HasPrefix(packet, "vCont;") && nonStop {
+			switch gdbVContAction(packet) {
+			case 'c':
+				resumed = true
+				resume = true
+				gdbSendPacket(conn, "OK")
+			case 's', 'r':
+				machine.stop = gdbStep(machine, packet, packetChan, &queued)
+				gdbSendPacket(conn, "OK")
+				gdbSendNotification(conn, "Stop:"+gdbStopReply(machine, thread))
+				resumed = false
+			case 't':
+				// Stop the target, which is reported with signal 0.
+				resume = false
+				gdbSendPacket(conn, "OK")
+				if resumed {
+					gdbSendNotification(conn, "Stop:"+gdbStopPacket(machine, 0, thread))
+					resumed = false
+				}
+			default:
+				gdbSendPacket(conn, "")
+			}
+		} else if packet == "!" {
+			// Enable extended-remote mode.
+			machine.setExtendedRemote(true)
+			gdbSendPacket(conn, "OK")
+		} else if strings.HasPrefix(packet, "qAttached") {
+			if attached {
+				gdbSendPacket(conn, "1")
+			} else {
+				gdbSendPacket(conn, "0")
+			}
+		} else if packet == "qOffsets" {
+			// The firmware is not relocated.
+			gdbSendPacket(conn, "Text=0;Data=0;Bss=0")
+		} else if strings.HasPrefix(packet, "vRun;") {
+			// Restart the program, optionally with a different firmware image
+			// and command line: vRun;filename;arg1;arg2...
+			var args []string
+			for _, arg := range strings.Split(packet[len("vRun;"):], ";") {
+				decoded, err := hex.DecodeString(arg)
+				if err != nil {
+					break
+				}
+				args = append(args, string(decoded))
+			}
+			if len(args) == 0 {
+				gdbSendPacket(conn, "E01")
+				continue
+			}
+			if err := machine.Restart(args[0], args[1:]); err != nil {
+				fmt.Fprintln(os.Stderr, "gdb: cannot restart:", err)
+				gdbSendPacket(conn, "E01")
+				continue
+			}
+			attached = false
+			gdbSendPacket(conn, gdbStopReply(machine, thread))
+		} else if strings.HasPrefix(packet, "vKill") {
+			// Kill the program. There is only one, so reset it to the initial
+			// state, ready for the next run.
+			if err := machine.Restart("", nil); err != nil {
+				fmt.Fprintln(os.Stderr, "gdb: cannot restart:", err)
+			}
+			gdbSendPacket(conn, "OK")
+		} else if packet[0] == 'R' {
+			// Restart the program, without a reply.
+			if err := machine.Restart("", strings.Fields(machine.cmdline)); err != nil {
+				fmt.Fprintln(os.Stderr, "gdb: cannot restart:", err)
+			}
+		} else if packet[0] == 'D' {
+			// Detach: let the target run freely (or keep it halted with
+			// -gdb-detach=halt) until GDB connects again. GDB closes the
+			// connection after the reply.
+			gdbRelease(machine)
+			gdbSendPacket(conn, "OK")
+		} else if packet == "k" {
+			// Kill the target. There is no reply.
+			if machine.gdbKill == "exit" {
+				terminalDisableRaw()
+				os.Exit(0)
+			}
+			if err := machine.Restart("", nil); err != nil {
+				fmt.Fprintln(os.Stderr, "gdb: cannot restart:", err)
+			}
+			gdbRelease(machine)
+		} else if packet[0] == 'H' || packet[0] == 'T' {
+			// Select the thread for later operations (Hg and Hc), or check
+			// whether a thread is alive (T).
+			gdbSendPacket(conn, gdbThreadPacket(packet))
 		} else if strings.HasPrefix(packet, "qXfer:") {
 			parts := strings.Split(packet[len("qXfer:"):], ":")
 			if len(parts) != 4 {
@@ -118,32 +321,71 @@ func gdbHandle(sock net.Conn, machine *Machine) error {
 			}
 			var offset, length int
 			_, err := fmt.Sscanf(parts[3], "%x,%x", &offset, &length)
-			if err != nil || offset != 0 {
-				gdbSendPacket(conn, "")
+			if err != nil {
+				gdbSendPacket(conn, "E00")
 				continue
 			}
 			data := ""
 			if strings.HasPrefix(packet, "qXfer:features:read:target.xml:") {
 				data = gdbAnnexTarget
 			} else if strings.HasPrefix(packet, "qXfer:memory-map:read::") {
-				data = fmt.Sprintf(gdbAnnexMemoryMap, flagFlashSize*1024, flagFlashPageSize, flagRAMSize*1024)
+				data = gdbMemoryMap(machine)
 			} else {
 				gdbSendPacket(conn, "")
 				continue
 			}
-			gdbSendPacket(conn, "l"+data)
+			// Send the requested part of the annex. The 'm' prefix means there
+			// is more data, 'l' that this is the last part.
+			if offset > len(data) {
+				gdbSendPacket(conn, "E00")
+				continue
+			}
+			data = data[offset:]
+			if length < len(data) {
+				gdbSendPacket(conn, "m"+data[:length])
+			} else {
+				gdbSendPacket(conn, "l"+data)
+			}
+		} else if strings.HasPrefix(packet, "qRcmd,") {
+			// Monitor command, like "monitor disas main".
+			command, err := hex.DecodeString(packet[len("qRcmd,"):])
+			if err != nil {
+				gdbSendPacket(conn, "E00")
+				continue
+			}
+			output := &bytes.Buffer{}
+			err = runMonitorCommand(machine, string(command), output)
+			if err != nil {
+				fmt.Fprintln(output, "error:", err)
+			}
+			if output.Len() != 0 {
+				gdbSendPacket(conn, "O"+hex.EncodeToString(output.Bytes()))
+			}
+			gdbSendPacket(conn, "OK")
+		} else if strings.HasPrefix(packet, "qCRC:") {
+			gdbSendPacket(conn, gdbCRCPacket(machine, packet))
+		} else if strings.HasPrefix(packet, "qSearch:memory:") {
+			gdbSendPacket(conn, gdbSearchPacket(machine, packet))
 		} else if strings.HasPrefix(packet, "qSymbol") {
 			gdbSendPacket(conn, "OK")
 		} else if packet == "qfThreadInfo" {
-			// Not sure what this means...
+			// List the threads: there is only one, the core.
+			gdbSendPacket(conn, "m"+thread)
+		} else if packet == "qsThreadInfo" {
 			gdbSendPacket(conn, "l")
-		} else if packet == "Hc-1" || packet == "Hc0" {
-			// Something about threads.
-			// Microcontrollers usually don't have threads.
-			gdbSendPacket(conn, "OK")
+		} else if packet == "qC" {
+			gdbSendPacket(conn, "QC"+thread)
 		} else if packet == "?" {
-			// TODO: send error if the program crashed.
-			gdbSendPacket(conn, "S00")
+			// GDB assumes the target is halted after asking why it halted,
+			// like a debug probe halts the chip when GDB connects. It is, as
+			// every packet is handled with the machine halted. In non-stop
+			// mode a running target is left running.
+			if resume {
+				gdbSendPacket(conn, "OK")
+			} else {
+				resumed = false
+				gdbSendPacket(conn, gdbStopReply(machine, thread))
+			}
 		} else if packet[0] == 'p' {
 			// Read a specific register.
 			var reg int
@@ -152,82 +394,90 @@ func gdbHandle(sock net.Conn, machine *Machine) error {
 				gdbSendPacket(conn, "")
 				continue
 			}
-			regval := machine.ReadRegister(reg)
-			// encode in little-endian format
-			reghex := ""
-			for i := 0; i < 4; i++ {
-				reghex += fmt.Sprintf("%02x", regval&0xff)
-				regval /= 256
+			if reg < 0 {
+				gdbSendPacket(conn, "E00")
+				continue
+			}
+			reghex, ok := machine.trace.frameRegisters(reg)
+			if !ok {
+				var regval uint32
+				if regs := machine.DebugRegisters(); reg < len(regs) {
+					regval = regs[reg]
+				}
+				// encode in little-endian format
+				for i := 0; i < 4; i++ {
+					reghex += fmt.Sprintf("%02x", regval&0xff)
+					regval /= 256
+				}
 			}
 			gdbSendPacket(conn, reghex)
 		} else if packet == "g" {
 			// Read all registers.
-			regs := machine.ReadRegisters(17)
-			gdbSendPacket(conn, hex.EncodeToString(regs))
-		} else if packet[0] == 'm' {
-			// Read memory in the given range.
-			var addr, length int
-			_, err := fmt.Sscanf(packet[1:], "%x,%x", &addr, &length)
-			if err != nil {
-				gdbSendPacket(conn, "")
-				continue
+			reply, ok := machine.trace.frameRegisters(-1)
+			if !ok {
+				regs := machine.DebugRegisters()
+				buf := make([]byte, 4*len(regs))
+				for i, regval := range regs {
+					binary.LittleEndian.PutUint32(buf[i*4:], regval)
+				}
+				reply = hex.EncodeToString(buf)
 			}
-			mem := machine.ReadMemory(addr, length)
-			out := hex.EncodeToString(mem)
-			gdbSendPacket(conn, out)
-		} else if packet == "c" {
-			// Continue running.
-			if machine.Halted() {
-				// The target was halted (this is not always the case). Start it
-				// again.
-				machine.Continue()
-			}
-			for machine.Running() {
+			gdbSendPacket(conn, reply)
+		} else if packet[0] == 'G' || packet[0] == 'P' {
+			// Write all registers, or a single one.
+			gdbSendPacket(conn, gdbWriteRegistersPacket(machine, packet))
+		} else if packet[0] == 'm' || packet[0] == 'M' {
+			gdbSendPacket(conn, gdbMemoryPacket(machine, packet))
+		} else if packet == "c" || (strings.HasPrefix(packet, "vCont;") && gdbVContAction(packet) == 'c') {
+			// Continue running, and let the run loop use the machine until it
+			// stops.
+			machine.Continue()
+			atomic.StoreInt32(&machine.continuing, 1)
+			machine.lock.Unlock()
+			for stopped := false; !stopped; {
 				// TODO: also continue on breakpoints.
 				select {
-				case packet := <-packetChan:
+				case packet, ok := <-packetChan:
+					if !ok {
+						// GDB disconnected while the target is running.
+						atomic.StoreInt32(&machine.continuing, 0)
+						return nil
+					}
 					if packet == "\x03" {
 						machine.Halt()
 					} else {
 						fmt.Fprintln(os.Stderr, "gdb: unexpected packet during continue:", packet)
 					}
-				case <-machine.runChan:
-					machine.halted = true
+				case <-machine.stoppedChan():
+					// The machine may only be paused for a moment, by the
+					// control socket for example. It has really stopped if
+					// it is still halted once the lock is free.
+					machine.lock.Lock()
+					stopped = machine.Halted()
+					if !stopped {
+						machine.lock.Unlock()
+					}
+				case call := <-machine.fileIO:
+					result := gdbFileIO(conn, packetChan, machine, call, acks)
+					call.result <- result
+					if result.interrupted {
+						machine.Halt()
+					}
 				}
 			}
+			atomic.StoreInt32(&machine.continuing, 0)
 			// Send a response only after the target has halted again.
-			gdbSendPacket(conn, "S00")
-		} else if packet == "s" {
-			// Single-step.
-			if !machine.Halted() {
-				// target not halted
-				gdbSendPacket(conn, "E00")
-				continue
-			}
-			result := machine.Step()
-			gdbSendPacket(conn, fmt.Sprintf("S%02x", result))
+			gdbSendPacket(conn, gdbStopReply(machine, thread))
+		} else if packet == "s" || (strings.HasPrefix(packet, "vCont;") && (gdbVContAction(packet) == 's' || gdbVContAction(packet) == 'r')) {
+			// Single-step, or step through a range.
+			machine.stop = gdbStep(machine, packet, packetChan, &queued)
+			gdbSendPacket(conn, gdbStopReply(machine, thread))
+		} else if strings.HasPrefix(packet, "QT") || strings.HasPrefix(packet, "qT") {
+			gdbSendPacket(conn, gdbTracePacket(machine, packet))
 		} else if packet[0] == 'Z' || packet[0] == 'z' {
-			// Set or remove a breakpoint.
-			num := packet[1] - '0'
-			if num >= 4 {
-				gdbSendPacket(conn, "E00")
-				continue
-			}
-			var address uint32
-			_, err := fmt.Sscanf(packet[2:], ",%x", &address)
-			if err != nil {
-				gdbSendPacket(conn, "E00")
-				continue
-			}
-			if packet[0] == 'z' {
-				// remove breakpoint
-				address = 0
-			}
-			if !machine.SetBreakpoint(int(num), address) {
-				gdbSendPacket(conn, "E00")
-				continue
-			}
-			gdbSendPacket(conn, "OK")
+			gdbSendPacket(conn, gdbBreakpointPacket(machine, packet))
+		} else if reply, ok := gdbLLDBPacket(machine, packet); ok {
+			gdbSendPacket(conn, reply)
 		} else {
 			// Unknown command, send an empty response.
 			gdbSendPacket(conn, "")
@@ -241,6 +491,369 @@ func gdbHandle(sock net.Conn, machine *Machine) error {
 	return nil
 }
 
+// Clean up after a GDB connection is closed, so that the next connection
+// starts from a known state: remove the breakpoints set by GDB and let the
+// target run again, or keep it halted with -gdb-detach=halt. The machine lock
+// must be held, with the machine halted.
+func gdbRelease(machine *Machine) {
+	machine.setExtendedRemote(false)
+	gdbTracePacket(machine, "QTStop")
+	gdbTracePacket(machine, "QTFrame:ffffffff")
+	machine.breakpoints.DeleteFunc(func(bp *Breakpoint) bool {
+		return bp.Owner == BreakpointGDB
+	})
+	if machine.gdbDetach != "halt" {
+		machine.Continue()
+	}
+}
+
+// Return the stop reply packet for a halted machine: either the signal for the
+// reason it stopped or, in extended-remote mode, the exit code of the program.
+// A machine that hasn't run yet or has just been stepped reports SIGTRAP. The
+// reply names the thread that stopped, with the ID that was reported to GDB.
+func gdbStopReply(machine *Machine, thread string) string {
+	if machine.exited {
+		if strings.HasPrefix(thread, "p") {
+			return fmt.Sprintf("W%02x;process:1", uint8(machine.exitCode))
+		}
+		return fmt.Sprintf("W%02x", uint8(machine.exitCode))
+	}
+	signal := gdbSignalTRAP
+	if machine.stop != nil {
+		signal = machine.stop.Reason.Signal()
+	}
+	return gdbStopPacket(machine, signal, thread)
+}
+
+// Return a "T" stop reply with the given signal.
+func gdbStopPacket(machine *Machine, signal int, thread string) string {
+	// All registers are sent along (expedited), so that GDB doesn't have to
+	// read them after every step.
+	reply := fmt.Sprintf("T%02xthread:%s;", signal, thread)
+	for i, regval := range machine.DebugRegisters() {
+		var buf [4]byte
+		binary.LittleEndian.PutUint32(buf[:], regval)
+		reply += fmt.Sprintf("%02x:%s;", i, hex.EncodeToString(buf[:]))
+	}
+	return reply
+}
+
+// Return the action of a vCont packet for the only thread: 'c' to continue,
+// 's' to step, 'r' to step through a range or 't' to stop. Signals to deliver
+// with C and S are ignored.
+func gdbVContAction(packet string) byte {
+	action := gdbVContFirst(packet)
+	switch action {
+	case "c", "s", "t":
+		return action[0]
+	}
+	if strings.HasPrefix(action, "r") {
+		return 'r'
+	}
+	if len(action) == 3 && (action[0] == 'C' || action[0] == 'S') {
+		return action[0] + 'a' - 'A'
+	}
+	return 0
+}
+
+// Return the first action of a vCont packet, without the thread ID.
+func gdbVContFirst(packet string) string {
+	action, _, _ := strings.Cut(packet[len("vCont;"):], ";")
+	action, _, _ = strings.Cut(action, ":")
+	return action
+}
+
+// Execute a step packet: "s", "vCont;s" or "vCont;rSTART,END". The latter
+// steps while the PC is within START..END, which GDB uses to step over a
+// source line. While stepping through a range, GDB can interrupt with Ctrl-C.
+// Other packets that arrive in the meantime are added to queued, to be
+// handled after the step.
+func gdbStep(machine *Machine, packet string, packetChan chan string, queued *[]string) *StopError {
+	var start, end uint32
+	if !strings.HasPrefix(packet, "vCont;") || gdbVContAction(packet) != 'r' {
+		return machine.Step()
+	}
+	if _, err := fmt.Sscanf(gdbVContFirst(packet), "r%x,%x", &start, &end); err != nil {
+		return machine.Step()
+	}
+	return machine.StepRange(start, end, func() bool {
+		select {
+		case packet, ok := <-packetChan:
+			if ok && packet != "\x03" {
+				*queued = append(*queued, packet)
+				return false
+			}
+			return true
+		default:
+			return false
+		}
+	})
+}
+
+// Handle the thread packets "Hg<id>", "Hc<id>" and "T<id>". There is a single
+// thread with ID 1 in process 1, which can also be selected as any thread (0)
+// or all threads (-1). Thread IDs may come with the process ID, like "p1.1".
+func gdbThreadPacket(packet string) string {
+	if len(packet) < 2 {
+		return ""
+	}
+	id := packet[1:]
+	if packet[0] == 'H' {
+		if id[0] != 'g' && id[0] != 'c' {
+			return ""
+		}
+		id = id[1:]
+	}
+	if strings.HasPrefix(id, "p") {
+		pid, tid, _ := strings.Cut(id[1:], ".")
+		if pid != "1" && pid != "0" && pid != "-1" {
+			return "E01"
+		}
+		if tid == "" {
+			// The whole process.
+			return "OK"
+		}
+		id = tid
+	}
+	switch id {
+	case "1":
+		return "OK"
+	case "0", "-1":
+		if packet[0] == 'H' {
+			return "OK"
+		}
+	}
+	return "E01"
+}
+
+// Handle a breakpoint packet: "Z type,addr,kind" to insert and "z type,addr,kind"
+// to remove a breakpoint, where type 0 is a software and type 1 a hardware
+// breakpoint. Watchpoints are not supported. Inserting a breakpoint that
+// already exists succeeds, as required by the protocol.
+//
+// The kind is the size of the breakpoint instruction GDB would write: 2 for a
+// 16-bit and 3 for a 32-bit Thumb-2 instruction. Either way the core stops
+// before the instruction at the address. Kind 4 (ARM state) can't exist on a
+// Cortex-M. Software breakpoints don't write a BKPT instruction, so they work
+// in flash as well as in RAM; hardware breakpoints are limited like on a real
+// chip, see BreakpointKind.
+func gdbBreakpointPacket(machine *Machine, packet string) string {
+	if len(packet) < 2 {
+		return ""
+	}
+	var kind BreakpointKind
+	switch packet[1] {
+	case '0':
+		kind = BreakpointSoftware
+	case '1':
+		kind = BreakpointHardware
+	default:
+		return ""
+	}
+	var address, size uint32
+	if _, err := fmt.Sscanf(packet[2:], ",%x,%x", &address, &size); err != nil {
+		return "E00"
+	}
+	if (size != 2 && size != 3) || address%2 != 0 {
+		return "E01"
+	}
+	match := func(bp *Breakpoint) bool {
+		return bp.Owner == BreakpointGDB && bp.Kind == kind && bp.Address == address
+	}
+	if packet[0] == 'z' {
+		machine.breakpoints.DeleteFunc(match)
+		return "OK"
+	}
+	if machine.breakpoints.Exists(match) {
+		return "OK"
+	}
+	_, err := machine.breakpoints.Add(Breakpoint{Address: address, Kind: kind, Owner: BreakpointGDB})
+	if err != nil {
+		return "E01"
+	}
+	return "OK"
+}
+
+// Handle a register write: "G XX..." writes all registers, in the format of
+// the reply to "g", and "P n=XXXXXXXX" writes register n. The registers are
+// written back together with a single call.
+func gdbWriteRegistersPacket(machine *Machine, packet string) string {
+	regs := machine.DebugRegisters()
+	if packet[0] == 'G' {
+		data, err := hex.DecodeString(packet[1:])
+		if err != nil || len(data) < 4*len(regs) {
+			return "E00"
+		}
+		for i := range regs {
+			regs[i] = binary.LittleEndian.Uint32(data[i*4:])
+		}
+	} else {
+		var reg int
+		var value string
+		n, _ := fmt.Sscanf(packet[1:], "%x=%s", &reg, &value)
+		data, err := hex.DecodeString(value)
+		if n != 2 || err != nil || len(data) != 4 || reg < 0 || reg >= len(regs) {
+			return "E00"
+		}
+		regs[reg] = binary.LittleEndian.Uint32(data)
+	}
+	machine.WriteState(&regs)
+	return "OK"
+}
+
+// Handle a memory read ("m addr,length") or write ("M addr,length:data")
+// packet and return the response.
+func gdbMemoryPacket(machine *Machine, packet string) string {
+	var addr, length int
+	if packet[0] == 'm' {
+		_, err := fmt.Sscanf(packet[1:], "%x,%x", &addr, &length)
+		if err != nil {
+			return ""
+		}
+		// A shorter read is allowed, GDB will read the rest afterwards.
+		if max := (gdbPacketSize - 4) / 2; length > max {
+			length = max
+		}
+		if reply, ok := machine.trace.frameMemory(machine, uint32(addr), length); ok {
+			return reply
+		}
+		mem := machine.ReadMemory(addr, length)
+		return hex.EncodeToString(mem)
+	}
+	colon := strings.IndexByte(packet, ':')
+	if colon < 0 {
+		return "E00"
+	}
+	_, err := fmt.Sscanf(packet[1:colon], "%x,%x", &addr, &length)
+	if err != nil {
+		return "E00"
+	}
+	data, err := hex.DecodeString(packet[colon+1:])
+	if err != nil || len(data) != length {
+		return "E00"
+	}
+	machine.WriteMemory(addr, data)
+	return "OK"
+}
+
+// Number of bytes of memory that qCRC and qSearch:memory read at a time.
+const gdbMemoryChunk = 64 * 1024
+
+// Handle "qCRC:addr,length", which GDB's compare-sections uses to check that
+// the firmware in memory matches the ELF file without reading all of it.
+func gdbCRCPacket(machine *Machine, packet string) string {
+	var addr, length uint32
+	if _, err := fmt.Sscanf(packet[len("qCRC:"):], "%x,%x", &addr, &length); err != nil {
+		return "E01"
+	}
+	crc := uint32(0xffffffff)
+	for length != 0 {
+		n := uint32(gdbMemoryChunk)
+		if length < n {
+			n = length
+		}
+		crc = gdbCRC32(crc, machine.ReadMemory(int(addr), int(n)))
+		addr += n
+		length -= n
+	}
+	return fmt.Sprintf("C%08x", crc)
+}
+
+// The CRC-32 that GDB uses for qCRC: polynomial 0x04c11db7, most significant
+// bit first and without a final XOR. The hash/crc32 package only does the
+// bit-reversed variant.
+var gdbCRC32Table = func() (table [256]uint32) {
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return
+}()
+
+func gdbCRC32(crc uint32, data []byte) uint32 {
+	for _, b := range data {
+		crc = crc<<8 ^ gdbCRC32Table[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// Handle "qSearch:memory:addr;length;pattern", which GDB's find command uses
+// to search memory on the target instead of reading all of it. The reply is
+// "1,addr" for the first match and "0" if there is none.
+func gdbSearchPacket(machine *Machine, packet string) string {
+	parts := strings.SplitN(packet[len("qSearch:memory:"):], ";", 3)
+	if len(parts) != 3 {
+		return "E01"
+	}
+	addr, err1 := strconv.ParseUint(parts[0], 16, 32)
+	length, err2 := strconv.ParseUint(parts[1], 16, 32)
+	pattern := []byte(parts[2]) // binary, already unescaped
+	if err1 != nil || err2 != nil || len(pattern) == 0 {
+		return "E01"
+	}
+	// Chunks overlap by the pattern length, to find matches that cross the
+	// boundary between two chunks.
+	end := addr + length
+	for start := addr; start+uint64(len(pattern)) <= end; start += gdbMemoryChunk {
+		n := uint64(gdbMemoryChunk + len(pattern) - 1)
+		if start+n > end {
+			n = end - start
+		}
+		if i := bytes.Index(machine.ReadMemory(int(start), int(n)), pattern); i >= 0 {
+			return fmt.Sprintf("1,%x", start+uint64(i))
+		}
+	}
+	return "0"
+}
+
+// Send a File-I/O request to GDB and wait for the reply. While waiting, GDB
+// reads and writes target memory to access the buffers of the call.
+func gdbFileIO(conn *bufio.ReadWriter, packetChan chan string, machine *Machine, call *fileIOCall, acks bool) fileIOResult {
+	gdbSendPacket(conn, call.packet())
+	conn.Flush()
+	for packet := range packetChan {
+		if packet == "\x03" {
+			// GDB will report the interrupt with the 'C' flag in its reply.
+			continue
+		}
+		if acks {
+			conn.WriteByte('+')
+		}
+		switch packet[0] {
+		case 'F':
+			// Reply: Fretcode,errno,C
+			parts := strings.Split(packet[1:], ",")
+			ret, err := strconv.ParseInt(parts[0], 16, 64)
+			if err != nil {
+				return fileIOResult{ret: -1, errno: fileIOEUNKNOWN}
+			}
+			result := fileIOResult{ret: ret}
+			if len(parts) >= 2 {
+				errno, _ := strconv.ParseInt(parts[1], 16, 32)
+				result.errno = int(errno)
+			}
+			if len(parts) >= 3 && parts[2] == "C" {
+				// The user pressed Ctrl-C during the call.
+				result.interrupted = true
+			}
+			return result
+		case 'm', 'M':
+			gdbSendPacket(conn, gdbMemoryPacket(machine, packet))
+		default:
+			gdbSendPacket(conn, "")
+		}
+		conn.Flush()
+	}
+	return fileIOResult{ret: -1, errno: fileIOEUNKNOWN}
+}
+
 func gdbRecvPackets(conn *bufio.ReadWriter, packetChan chan string) {
 	defer close(packetChan)
 	for {
@@ -258,54 +871,112 @@ func gdbRecvPackets(conn *bufio.ReadWriter, packetChan chan string) {
 	}
 }
 
+// States of the packet parser in gdbRecvPacket.
+const (
+	gdbStateIdle      = iota // waiting for the start of a packet
+	gdbStateData             // reading the payload
+	gdbStateEscape           // read '}', the next byte is escaped
+	gdbStateRepeat           // read '*', the next byte is a repeat count
+	gdbStateChecksum1        // reading the first checksum digit
+	gdbStateChecksum2        // reading the second checksum digit
+)
+
+// Receive a single packet from GDB. It returns "\x03" when GDB sends an
+// interrupt (Ctrl-C), which may arrive between any two packets. Acks,
+// notifications and packets with a bad checksum are skipped.
 func gdbRecvPacket(conn *bufio.ReadWriter) (string, error) {
-	// Packet format: "#payload$cs" where cs is the checksum (two hex bytes).
-	// https://www.embecosm.com/appnotes/ean4/embecosm-howto-rsp-server-ean4-issue-2.html#sec_presentation_layer
-	c, err := conn.ReadByte()
-	if err != nil {
-		return "", err
-	}
-	for c != '$' {
-		if c == 3 {
-			// Ctrl-C from GDB
-			return "\x03", nil
-		}
-		c, err = conn.ReadByte()
+	// Packet format: "$payload#cs" where cs is the checksum (two hex bytes).
+	// Notifications use '%' instead of '$'. Within the payload, '}' escapes
+	// the next byte (XOR 0x20) and "x*n" repeats x another n-29 times. The
+	// checksum is calculated over the payload as sent.
+	// https://sourceware.org/gdb/onlinedocs/gdb/Overview.html
+	state := gdbStateIdle
+	var raw, packet []byte
+	var checksum []byte
+	notification := false
+	for {
+		c, err := conn.ReadByte()
 		if err != nil {
 			return "", err
 		}
-	}
-	packet, err := conn.ReadString('#')
-
-	// Read the checksum which follows the hash sign
-	c1, err := conn.ReadByte()
-	if err != nil {
-		return "", err
-	}
-	c2, err := conn.ReadByte()
-	if err != nil {
-		return "", err
-	}
-	checksum := string([]byte{c1, c2})
-
-	// parse packet
-	// TODO: escaping
-	packet = packet[:len(packet)-1] // drop starting '#'
-	if len(packet) == 0 {
-		return "", nil
-	}
+		switch state {
+		case gdbStateIdle:
+			switch c {
+			case 3:
+				// Ctrl-C from GDB
+				return "\x03", nil
+			case '$', '%':
+				notification = c == '%'
+				raw = raw[:0]
+				packet = packet[:0]
+				state = gdbStateData
+			default:
+				// Acks ('+' and '-') and garbage between packets.
+			}
+			continue
+		case gdbStateChecksum1:
+			checksum = append(checksum[:0], c)
+			state = gdbStateChecksum2
+			continue
+		case gdbStateChecksum2:
+			checksum = append(checksum, c)
+			state = gdbStateIdle
+			if string(checksum) != gdbPacketChecksum(string(raw)) {
+				fmt.Fprintf(os.Stderr, "gdb: dropping packet with bad checksum: %q\n", raw)
+				continue
+			}
+			if notification {
+				// GDB doesn't send notifications, ignore them.
+				continue
+			}
+			return string(packet), nil
+		}
 
-	if checksum != gdbPacketChecksum(packet) {
-		return "", errors.New("checksum mismatch")
+		// The payload.
+		if c == '$' {
+			// Start of a new packet without finishing the previous one.
+			// Resynchronize on the new packet.
+			raw = raw[:0]
+			packet = packet[:0]
+			notification = false
+			state = gdbStateData
+			continue
+		}
+		if c == '#' && state == gdbStateData {
+			state = gdbStateChecksum1
+			continue
+		}
+		raw = append(raw, c)
+		switch state {
+		case gdbStateData:
+			if c == '}' {
+				state = gdbStateEscape
+			} else if c == '*' && len(packet) != 0 {
+				state = gdbStateRepeat
+			} else {
+				packet = append(packet, c)
+			}
+		case gdbStateEscape:
+			packet = append(packet, c^0x20)
+			state = gdbStateData
+		case gdbStateRepeat:
+			last := packet[len(packet)-1]
+			for n := int(c) - 29; n > 0; n-- {
+				packet = append(packet, last)
+			}
+			state = gdbStateData
+		}
+		if len(packet) > gdbPacketSize {
+			fmt.Fprintln(os.Stderr, "gdb: dropping packet that is too long")
+			state = gdbStateIdle
+		}
 	}
-
-	return packet, nil
 }
 
 func gdbSendPacket(conn *bufio.ReadWriter, msg string) error {
 	// See gdbRecvPacket for format.
-	// TODO: escaping
-	packet := fmt.Sprintf("$%s#%s", msg, gdbPacketChecksum(msg))
+	payload := gdbEncodePayload(msg)
+	packet := fmt.Sprintf("$%s#%s", payload, gdbPacketChecksum(payload))
 	_, err := conn.WriteString(packet)
 	if err != nil {
 		return err
@@ -313,6 +984,50 @@ func gdbSendPacket(conn *bufio.ReadWriter, msg string) error {
 	return nil
 }
 
+// Send an asynchronous notification, like "Stop:T05...". Notifications are
+// framed like packets, but start with '%' and are not acknowledged.
+func gdbSendNotification(conn *bufio.ReadWriter, msg string) error {
+	payload := gdbEncodePayload(msg)
+	_, err := fmt.Fprintf(conn, "%%%s#%s", payload, gdbPacketChecksum(payload))
+	return err
+}
+
+// Escape and run-length encode the payload of a packet. Special characters are
+// escaped with '}' followed by the character XOR 0x20. A character that is
+// repeated is sent once, followed by '*' and the repeat count plus 29 as a
+// printable character.
+// https://sourceware.org/gdb/onlinedocs/gdb/Overview.html
+func gdbEncodePayload(msg string) string {
+	buf := make([]byte, 0, len(msg))
+	for i := 0; i < len(msg); {
+		c := msg[i]
+		if c == '$' || c == '#' || c == '}' || c == '*' {
+			buf = append(buf, '}', c^0x20)
+			i++
+			continue
+		}
+		// Count how often this character is repeated after the first.
+		repeat := 0
+		for i+1+repeat < len(msg) && msg[i+1+repeat] == c && repeat < 126-29 {
+			repeat++
+		}
+		// A repeat count of 6 or 7 would encode as '#' or '$', which are not
+		// allowed. Use a shorter run instead.
+		if repeat == 6 || repeat == 7 {
+			repeat = 5
+		}
+		if repeat < 3 {
+			// Encoding is not shorter than the characters themselves.
+			buf = append(buf, c)
+			i++
+			continue
+		}
+		buf = append(buf, c, '*', byte(repeat+29))
+		i += 1 + repeat
+	}
+	return string(buf)
+}
+
 // Calculate the checksum over the payload of an RSP packet.
 func gdbPacketChecksum(msg string) string {
 	// https://www.embecosm.com/appnotes/ean4/embecosm-howto-rsp-server-ean4-issue-2.html#sec_presentation_layer
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+)
+
+// Frame a payload like gdbSendPacket does.
+func gdbFrame(payload string) string {
+	return "$" + payload + "#" + gdbPacketChecksum(payload)
+}
+
+// Read all packets from the given stream.
+func gdbRecvAll(t testing.TB, data string) []string {
+	conn := bufio.NewReadWriter(bufio.NewReader(strings.NewReader(data)), bufio.NewWriter(io.Discard))
+	var packets []string
+	for {
+		packet, err := gdbRecvPacket(conn)
+		if err == io.EOF {
+			return packets
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		packets = append(packets, packet)
+	}
+}
+
+func TestGDBPacketChecksum(t *testing.T) {
+	for _, tc := range []struct {
+		payload  string
+		checksum string
+	}{
+		{"", "00"},
+		{"g", "67"},
+		{"OK", "9a"},
+		{"qSupported", "37"},
+		{"\xff\x02", "01"}, // wraps around
+	} {
+		if got := gdbPacketChecksum(tc.payload); got != tc.checksum {
+			t.Errorf("checksum of %q: got %s, expected %s", tc.payload, got, tc.checksum)
+		}
+	}
+}
+
+func TestGDBEncodePayload(t *testing.T) {
+	for _, tc := range []struct {
+		msg     string
+		payload string
+	}{
+		{"", ""},
+		{"OK", "OK"},
+		{"a$b", "a}\x04b"},
+		{"#", "}\x03"},
+		{"}", "}]"},
+		{"*", "}\n"},
+		{"000", "000"},                      // a run of three is not shorter
+		{"0000", "0* "},                     // repeat 3, encoded as ' '
+		{"00000000", `0*"00`},               // repeat 7 would be '$', so 5 and then two more
+		{"0000000", `0*"0`},                 // repeat 6 would be '#'
+		{strings.Repeat("x", 100), "x*~xx"}, // at most 97 repeats
+		{"}}}}", "}]}]}]}]"},                // escaped characters are not run-length encoded
+	} {
+		if got := gdbEncodePayload(tc.msg); got != tc.payload {
+			t.Errorf("encoding %q: got %q, expected %q", tc.msg, got, tc.payload)
+		}
+	}
+}
+
+func TestGDBRecvPacket(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		data    string
+		packets []string
+	}{
+		{"plain", gdbFrame("OK"), []string{"OK"}},
+		{"acks", "+" + gdbFrame("g") + "-+", []string{"g"}},
+		{"interrupt", "\x03" + gdbFrame("c"), []string{"\x03", "c"}},
+		{"escape", gdbFrame("a}\x04b}]"), []string{"a$b}"}},
+		{"repeat", gdbFrame("0* 1"), []string{"00001"}},
+		{"repeat of an escaped byte", gdbFrame("}]*!"), []string{"}}}}}"}},
+		{"star at the start", gdbFrame("*a"), []string{"*a"}},
+		{"bad checksum", "$OK#00" + gdbFrame("g"), []string{"g"}},
+		{"notification", "%Stop:T05#" + gdbPacketChecksum("Stop:T05") + gdbFrame("g"), []string{"g"}},
+		{"restart", "$O" + gdbFrame("g"), []string{"g"}},
+		{"truncated", "$OK#9", nil},
+		{"too long", gdbFrame("a*~"+strings.Repeat("a*~", gdbPacketSize/97)) + gdbFrame("g"), []string{"g"}},
+		{"empty", gdbFrame(""), []string{""}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			packets := gdbRecvAll(t, tc.data)
+			if len(packets) != len(tc.packets) {
+				t.Fatalf("got packets %q, expected %q", packets, tc.packets)
+			}
+			for i := range packets {
+				if packets[i] != tc.packets[i] {
+					t.Errorf("packet %d: got %q, expected %q", i, packets[i], tc.packets[i])
+				}
+			}
+		})
+	}
+}
+
+// Encoding and then parsing a packet must result in the original message, and
+// the parser must not crash on any input.
+func FuzzGDBPacket(f *testing.F) {
+	f.Add([]byte("OK"))
+	f.Add([]byte("$#}*"))
+	f.Add([]byte("00000000"))
+	f.Add([]byte(gdbFrame("0* }]")))
+	f.Add([]byte("\x03$%+-"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		gdbRecvAll(t, string(data))
+
+		if len(data) > gdbPacketSize {
+			return
+		}
+		payload := gdbEncodePayload(string(data))
+		if strings.ContainsAny(payload, "$#") {
+			t.Fatalf("payload %q contains an unescaped $ or #", payload)
+		}
+		packets := gdbRecvAll(t, gdbFrame(payload))
+		if len(packets) != 1 || packets[0] != string(data) {
+			t.Fatalf("round trip of %q through %q: got %q", data, payload, packets)
+		}
+	})
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// #include "machine.h"
+import "C"
+
+// This file implements GDB tracepoints: breakpoints that record registers and
+// memory without stopping the target, for debugging code that doesn't work
+// anymore when it is halted. The frames can be inspected afterwards with
+// tfind, tdump etc.
+// https://sourceware.org/gdb/onlinedocs/gdb/Tracepoint-Packets.html
+//
+// Only collecting registers and memory is supported. Conditions, while-
+// stepping actions and expressions that need the agent are rejected.
+
+// Size of the trace buffer in bytes, roughly as counted by GDB.
+const traceBufferSize = 4 << 20
+
+type traceState struct {
+	lock        sync.Mutex
+	tracepoints []*tracepoint
+	frames      []traceFrame
+	used        int  // bytes used in the trace buffer
+	running     bool // whether tracing was started and hasn't stopped
+	stopReason  string
+	stopNumber  int // tracepoint that caused the stop, for tpasscount
+	selected    int // selected frame, or -1 to read the live target
+}
+
+// A tracepoint as downloaded from GDB with QTDP.
+type tracepoint struct {
+	number   int
+	address  uint32
+	enabled  bool
+	pass     int // stop tracing after this many hits, or 0 for no limit
+	hits     int
+	regmask  uint32 // registers to collect
+	memory   []traceMemory
+	frameIDs []int
+}
+
+// A memory range to collect: length bytes at offset from the given register,
+// or at the absolute address offset if basereg is -1.
+type traceMemory struct {
+	basereg int
+	offset  uint32
+	length  uint32
+}
+
+// A trace frame: the data collected at a single hit of a tracepoint.
+type traceFrame struct {
+	tracepoint int
+	regmask    uint32
+	registers  [17]uint32
+	memory     []traceBlock
+}
+
+type traceBlock struct {
+	address uint32
+	data    []byte
+}
+
+// Handle a tracepoint packet (starting with QT or qT) and return the reply.
+// Unsupported packets get an empty reply.
+func gdbTracePacket(machine *Machine, packet string) string {
+	t := &machine.trace
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	switch {
+	case packet == "QTinit":
+		t.stop(machine, "tstop")
+		t.tracepoints = nil
+		t.frames = nil
+		t.used = 0
+		t.stopReason = ""
+		t.selected = -1
+		return "OK"
+	case strings.HasPrefix(packet, "QTDP:"):
+		if t.running {
+			return "E01"
+		}
+		if err := t.define(packet[len("QTDP:"):]); err != nil {
+			return "E01"
+		}
+		return "OK"
+	case strings.HasPrefix(packet, "QTro:"):
+		// Read-only regions are read from the live target anyway.
+		return "OK"
+	case packet == "QTStart":
+		return t.start(machine)
+	case packet == "QTStop":
+		t.stop(machine, "tstop")
+		return "OK"
+	case packet == "qTStatus":
+		running := 0
+		if t.running {
+			running = 1
+		}
+		reason := t.stopReason
+		if t.running || reason == "" {
+			reason = "tnotrun"
+		}
+		return fmt.Sprintf("T%d;%s:%x;tframes:%x;tcreated:%x;tfree:%x;tsize:%x;circular:0;disconn:0",
+			running, reason, t.stopNumber, len(t.frames), len(t.frames), traceBufferSize-t.used, traceBufferSize)
+	case strings.HasPrefix(packet, "QTFrame:"):
+		return t.find(packet[len("QTFrame:"):])
+	default:
+		return ""
+	}
+}
+
+// Parse a QTDP packet, which either defines a tracepoint ("n:addr:ena:step:pass")
+// or adds actions to it ("-n:addr:actions").
+func (t *traceState) define(s string) error {
+	parts := strings.Split(strings.TrimSuffix(s, "-"), ":")
+	if len(parts) < 3 {
+		return fmt.Errorf("invalid QTDP packet: %s", s)
+	}
+	address, err := strconv.ParseUint(parts[1], 16, 64)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(parts[0], "-") {
+		if len(parts) != 5 {
+			// Conditions (X) and fast tracepoints (F) aren't supported.
+			return fmt.Errorf("unsupported QTDP packet: %s", s)
+		}
+		number, err := strconv.ParseUint(parts[0], 16, 32)
+		if err != nil {
+			return err
+		}
+		step, err := strconv.ParseUint(parts[3], 16, 32)
+		if err != nil || step != 0 {
+			return fmt.Errorf("while-stepping is not supported")
+		}
+		pass, err := strconv.ParseUint(parts[4], 16, 32)
+		if err != nil {
+			return err
+		}
+		t.tracepoints = append(t.tracepoints, &tracepoint{
+			number:  int(number),
+			address: uint32(address),
+			enabled: parts[2] == "E",
+			pass:    int(pass),
+		})
+		return nil
+	}
+
+	number, err := strconv.ParseUint(parts[0][1:], 16, 32)
+	if err != nil {
+		return err
+	}
+	tp := t.tracepoint(int(number))
+	if tp == nil {
+		return fmt.Errorf("unknown tracepoint %d", number)
+	}
+	// The action list is the rest of the packet, because memory actions
+	// contain no colons.
+	for _, action := range parts[2:] {
+		if action == "" {
+			continue
+		}
+		switch action[0] {
+		case 'R':
+			mask, err := hex.DecodeString(strings.Repeat("0", len(action[1:])%2) + action[1:])
+			if err != nil {
+				return err
+			}
+			// The mask is big endian, only the last 17 bits are registers
+			// known to this target.
+			for i, b := range mask {
+				shift := uint(len(mask)-1-i) * 8
+				if shift < 32 {
+					tp.regmask |= uint32(b) << shift
+				}
+			}
+			tp.regmask &= 1<<17 - 1
+		case 'M':
+			fields := strings.Split(action[1:], ",")
+			if len(fields) != 3 {
+				return fmt.Errorf("invalid memory action: %s", action)
+			}
+			basereg, err1 := strconv.ParseInt(fields[0], 16, 64)
+			offset, err2 := strconv.ParseUint(fields[1], 16, 64)
+			length, err3 := strconv.ParseUint(fields[2], 16, 32)
+			if err1 != nil || err2 != nil || err3 != nil || length > 1<<16 {
+				return fmt.Errorf("invalid memory action: %s", action)
+			}
+			memory := traceMemory{basereg: int(basereg), offset: uint32(offset), length: uint32(length)}
+			if basereg == 0xffffffff {
+				memory.basereg = -1
+			} else if basereg > 16 {
+				return fmt.Errorf("invalid register in memory action: %s", action)
+			}
+			tp.memory = append(tp.memory, memory)
+		default:
+			// Agent expressions (X) and while-stepping actions (S).
+			return fmt.Errorf("unsupported tracepoint action: %s", action)
+		}
+	}
+	return nil
+}
+
+func (t *traceState) tracepoint(number int) *tracepoint {
+	for _, tp := range t.tracepoints {
+		if tp.number == number {
+			return tp
+		}
+	}
+	return nil
+}
+
+// Start tracing: insert a breakpoint for each enabled tracepoint that collects
+// a frame and continues.
+func (t *traceState) start(machine *Machine) string {
+	t.stop(machine, "")
+	t.frames = nil
+	t.used = 0
+	t.stopReason = ""
+	t.stopNumber = 0
+	t.selected = -1
+	for _, tp := range t.tracepoints {
+		tp.hits = 0
+		if !tp.enabled {
+			continue
+		}
+		tp := tp
+		_, err := machine.breakpoints.Add(Breakpoint{
+			Address: tp.address,
+			Owner:   BreakpointGDB,
+			trace: func() {
+				t.collect(machine.machine, tp)
+			},
+		})
+		if err != nil {
+			t.stop(machine, "")
+			return "E01"
+		}
+	}
+	t.running = true
+	return "OK"
+}
+
+// Stop tracing with the given reason and remove the tracepoint breakpoints.
+// The lock must be held.
+func (t *traceState) stop(machine *Machine, reason string) {
+	if t.running {
+		t.running = false
+		t.stopReason = reason
+	}
+	machine.breakpoints.DeleteFunc(func(bp *Breakpoint) bool {
+		return bp.trace != nil
+	})
+}
+
+// Collect a trace frame for the given tracepoint. It is called from the
+// breakpoint manager, so it can't stop tracing by removing breakpoints: it only
+// stops collecting.
+func (t *traceState) collect(machine *C.machine_t, tp *tracepoint) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.running {
+		return
+	}
+	frame := traceFrame{
+		tracepoint: tp.number,
+		regmask:    tp.regmask | 1<<15, // the PC is always collected
+	}
+	frame.registers = debugRegisters(machine)
+	size := 4 * len(frame.registers)
+	for _, memory := range tp.memory {
+		address := memory.offset
+		if memory.basereg >= 0 {
+			address += frame.registers[memory.basereg]
+		}
+		data := make([]byte, memory.length)
+		if len(data) != 0 {
+			C.machine_readmem(machine, unsafe.Pointer(&data[0]), C.size_t(address), C.size_t(len(data)))
+		}
+		frame.memory = append(frame.memory, traceBlock{address, data})
+		size += 8 + len(data)
+	}
+	if t.used+size > traceBufferSize {
+		t.running = false
+		t.stopReason = "tfull"
+		return
+	}
+	t.used += size
+	t.frames = append(t.frames, frame)
+	tp.hits++
+	if tp.pass != 0 && tp.hits >= tp.pass {
+		t.running = false
+		t.stopReason = "tpasscount"
+		t.stopNumber = tp.number
+	}
+}
+
+// Handle QTFrame: select a trace frame and return "FfT<tracepoint>", or "F-1"
+// if no frame matches. After a frame is selected, register and memory reads
+// return the collected data.
+func (t *traceState) find(s string) string {
+	var match func(i int, frame *traceFrame) bool
+	fields := strings.Split(s, ":")
+	values := make([]uint32, len(fields)-1)
+	for i, field := range fields[1:] {
+		value, err := strconv.ParseUint(field, 16, 64)
+		if err != nil {
+			return "E01"
+		}
+		values[i] = uint32(value)
+	}
+	start := t.selected + 1
+	switch {
+	case len(fields) == 1:
+		n, err := strconv.ParseUint(fields[0], 16, 64)
+		if err != nil {
+			return "E01"
+		}
+		if int32(n) < 0 {
+			// Stop looking at trace frames.
+			t.selected = -1
+			return "F-1"
+		}
+		start = 0
+		match = func(i int, frame *traceFrame) bool { return i == int(n) }
+	case fields[0] == "pc" && len(values) == 1:
+		match = func(i int, frame *traceFrame) bool { return frame.registers[15] == values[0] }
+	case fields[0] == "tdp" && len(values) == 1:
+		match = func(i int, frame *traceFrame) bool { return frame.tracepoint == int(values[0]) }
+	case fields[0] == "range" && len(values) == 2:
+		match = func(i int, frame *traceFrame) bool {
+			return frame.registers[15] >= values[0] && frame.registers[15] <= values[1]
+		}
+	case fields[0] == "outside" && len(values) == 2:
+		match = func(i int, frame *traceFrame) bool {
+			return frame.registers[15] < values[0] || frame.registers[15] > values[1]
+		}
+	default:
+		return ""
+	}
+	for i := start; i < len(t.frames); i++ {
+		if match(i, &t.frames[i]) {
+			t.selected = i
+			return fmt.Sprintf("F%xT%x", i, t.frames[i].tracepoint)
+		}
+	}
+	t.selected = -1
+	return "F-1"
+}
+
+// Return the register packet for the selected trace frame, or false if no
+// frame is selected. If num is -1, all registers are returned as for the 'g'
+// packet. Registers that weren't collected are reported as unavailable.
+func (t *traceState) frameRegisters(num int) (string, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.selected < 0 {
+		return "", false
+	}
+	frame := &t.frames[t.selected]
+	reply := ""
+	for i, value := range frame.registers {
+		if num >= 0 && i != num {
+			continue
+		}
+		if frame.regmask&(1<<uint(i)) == 0 {
+			reply += "xxxxxxxx"
+			continue
+		}
+		var buf [4]byte
+		binary.LittleEndian.PutUint32(buf[:], value)
+		reply += hex.EncodeToString(buf[:])
+	}
+	return reply, true
+}
+
+// Return the memory packet for a read from the selected trace frame, or false
+// if no frame is selected. Reads from the image are served from the live
+// target, as code doesn't change.
+func (t *traceState) frameMemory(machine *Machine, address uint32, length int) (string, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.selected < 0 {
+		return "", false
+	}
+	flashSize := uint64(machine.machine.image_size)
+	if uint64(address)+uint64(length) <= flashSize || uint64(address-uint32(machine.machine.flash_base))+uint64(length) <= flashSize {
+		return hex.EncodeToString(machine.ReadMemory(int(address), length)), true
+	}
+	for _, block := range t.frames[t.selected].memory {
+		if address >= block.address && uint64(address)+uint64(length) <= uint64(block.address)+uint64(len(block.data)) {
+			offset := address - block.address
+			return hex.EncodeToString(block.data[offset : offset+uint32(length)]), true
+		}
+	}
+	return "E01", true
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// #include "machine.h"
+import "C"
+
+// This file implements golden-trace regression testing. The firmware runs for
+// a fixed number of instructions while the registers are hashed every few
+// instructions and all output (UART and semihosting) is hashed as well. The
+// result is stored in a JSON file, and later runs can be verified against it
+// to cheaply find changes in behavior of either the firmware or the emulator.
+
+// Version of the golden trace file format.
+const goldenVersion = 1
+
+// Number of hex characters of each checkpoint hash that are stored. 64 bits is
+// plenty to detect a difference and keeps the file small.
+const goldenCheckpointSize = 16
+
+// goldenTrace is the contents of a golden trace file.
+type goldenTrace struct {
+	Version      int      `json:"version"`
+	Firmware     string   `json:"firmware"` // only informational
+	Instructions uint64   `json:"instructions"`
+	Interval     uint64   `json:"interval"`
+	Stop         string   `json:"stop"`
+	Output       string   `json:"output"`      // SHA-256 of all output
+	Checkpoints  []string `json:"checkpoints"` // hash of the registers every interval instructions
+	Digest       string   `json:"digest"`      // SHA-256 of all of the above
+}
+
+// Compute the digest over the parts of the trace that describe the behavior of
+// the firmware.
+func (t *goldenTrace) digest() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\n%d\n%s\n%s\n", t.Instructions, t.Interval, t.Stop, t.Output)
+	for _, checkpoint := range t.Checkpoints {
+		fmt.Fprintln(h, checkpoint)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Run the firmware for at most limit instructions and return its trace, with a
+// checkpoint every interval instructions. The run ends early when the firmware
+// exits or stops because of a fault.
+func runGolden(m *Machine, limit, interval uint64) *goldenTrace {
+	output := sha256.New()
+	terminalOutput = io.MultiWriter(terminalOutput, output)
+	m.console = io.MultiWriter(m.console, output)
+
+	trace := &goldenTrace{
+		Version:  goldenVersion,
+		Firmware: filepath.Base(m.firmware),
+		Interval: interval,
+	}
+	var stop *StopError
+	for {
+		next := (uint64(m.machine.stats.instructions)/interval + 1) * interval
+		if next > limit {
+			next = limit
+		}
+		C.machine_set_instruction_limit(m.machine, C.uint64_t(next))
+		stop = m.Run()
+		if stop.Reason == StopSemihosting {
+			if exit, code := m.semihost(); exit {
+				stop = &StopError{Reason: StopExit, PC: stop.PC, ExitCode: code}
+				break
+			}
+			continue
+		}
+		if stop.Reason != StopLimit {
+			break
+		}
+		count := uint64(m.machine.stats.instructions)
+		if count%interval == 0 {
+			trace.Checkpoints = append(trace.Checkpoints, goldenCheckpoint(m))
+		}
+		if count >= limit {
+			break
+		}
+	}
+	trace.Instructions = uint64(m.machine.stats.instructions)
+	trace.Stop = stop.Error()
+	trace.Output = hashString(output)
+	trace.Digest = trace.digest()
+	return trace
+}
+
+// Hash the registers as a debugger sees them.
+func goldenCheckpoint(m *Machine) string {
+	regs := m.DebugRegisters()
+	buf := make([]byte, 4*len(regs))
+	for i, reg := range regs {
+		binary.LittleEndian.PutUint32(buf[i*4:], reg)
+	}
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:])[:goldenCheckpointSize]
+}
+
+func hashString(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Run the firmware and write its golden trace to the given file.
+func recordGolden(m *Machine, path string, limit, interval uint64, w io.Writer) error {
+	if limit == 0 {
+		return errors.New("-max-instructions must be set")
+	}
+	if interval == 0 {
+		return errors.New("the interval must be at least 1")
+	}
+	trace := runGolden(m, limit, interval)
+	data, err := json.MarshalIndent(trace, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, append(data, '\n'), 0666); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "golden: recorded %d checkpoints in %d instructions (%s) to %s\n", len(trace.Checkpoints), trace.Instructions, trace.Stop, path)
+	return nil
+}
+
+// Run the firmware with the parameters of the golden trace in the given file,
+// and report every difference with that trace. It returns an error if the
+// firmware behaved differently.
+func verifyGolden(m *Machine, path string, w io.Writer) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var golden goldenTrace
+	if err := json.Unmarshal(data, &golden); err != nil {
+		return fmt.Errorf("cannot parse %s: %v", path, err)
+	}
+	if golden.Version != goldenVersion {
+		return fmt.Errorf("%s: unsupported version %d", path, golden.Version)
+	}
+	if golden.Interval == 0 || golden.Digest != golden.digest() {
+		return fmt.Errorf("%s is corrupted", path)
+	}
+
+	trace := runGolden(m, golden.Instructions, golden.Interval)
+	if trace.Digest == golden.Digest {
+		fmt.Fprintf(w, "golden: %d checkpoints in %d instructions match %s\n", len(trace.Checkpoints), trace.Instructions, path)
+		return nil
+	}
+	for i, checkpoint := range trace.Checkpoints {
+		if i >= len(golden.Checkpoints) || checkpoint != golden.Checkpoints[i] {
+			fmt.Fprintf(w, "golden: registers differ at instruction %d\n", uint64(i+1)*trace.Interval)
+			break
+		}
+	}
+	if trace.Instructions != golden.Instructions {
+		fmt.Fprintf(w, "golden: stopped after %d instructions, expected %d\n", trace.Instructions, golden.Instructions)
+	}
+	if trace.Stop != golden.Stop {
+		fmt.Fprintf(w, "golden: stopped with %q, expected %q\n", trace.Stop, golden.Stop)
+	}
+	if trace.Output != golden.Output {
+		fmt.Fprintln(w, "golden: output differs")
+	}
+	return fmt.Errorf("behavior differs from %s", path)
+}
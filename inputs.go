@@ -0,0 +1,499 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// #include "machine.h"
+import "C"
+
+// This file implements input devices on GPIO pins: buttons, matrix keypads
+// and rotary encoders. They are specified on the command line like this:
+//
+//	button:NAME pin=PIN [key=K] [active=low|high] [bounce=DURATION]
+//	encoder:NAME a=PIN b=PIN [keys=<>] [step=DURATION] [bounce=DURATION]
+//	keypad:NAME rows=PIN,... cols=PIN,... [layout=123A456B789C*0#D] [bounce=DURATION]
+//
+// Buttons drive their pin like a switch to ground (or to VCC with
+// active=high) with a pull resistor. Encoders are two such switches in
+// quadrature, that rest with both pins high. A pressed key of a keypad
+// connects its row and column pin, so the firmware scans it like a real
+// keypad. With bounce, every change of a contact toggles it a few more times
+// at random moments within the bounce time, seeded with -fault-seed.
+//
+// The devices are operated with these commands:
+//
+//	press NAME [KEY]              press a button or a key of a keypad
+//	release NAME [KEY]            release it again
+//	click NAME [KEY] [HOLD]       press and release after HOLD (default 100ms)
+//	glitch NAME [KEY] [DURATION]  a short press without bounce (default 100us),
+//	                              for an encoder KEY is the pin: a or b
+//	rotate NAME STEPS             turn an encoder by STEPS detents, negative
+//	                              is counterclockwise
+//
+// Commands come from the console (Ctrl-A followed by the key of a button or
+// encoder, or Ctrl-A k followed by the key of a keypad), from the monitor
+// ("input click button1"), from the control socket (Emculator.Input) or from
+// a -script, which has a TIME COMMAND line per command, like "10ms rotate
+// knob 3" (see timeline.go).
+
+type inputKind int
+
+const (
+	inputButton inputKind = iota
+	inputEncoder
+	inputKeypad
+)
+
+var inputKinds = map[string]inputKind{
+	"button":  inputButton,
+	"encoder": inputEncoder,
+	"keypad":  inputKeypad,
+}
+
+// Default keypad layouts, by the number of rows and columns.
+var keypadLayouts = map[[2]int]string{
+	{4, 4}: "123A456B789C*0#D",
+	{4, 3}: "123456789*0#",
+}
+
+// Levels of the A and B pins of an encoder in each quadrature phase, in
+// clockwise order.
+var encoderPhases = [4][2]int{{1, 1}, {0, 1}, {0, 0}, {1, 0}}
+
+// A single input device.
+type inputDevice struct {
+	kind       inputKind
+	name       string
+	pins       []int  // the pin of a button, A and B of an encoder, rows and then columns of a keypad
+	rows       int    // number of rows of a keypad
+	layout     string // key labels of a keypad, row by row
+	keys       string // console keys: one for a button, counterclockwise and clockwise for an encoder
+	activeHigh bool
+	bounce     uint64 // in cycles
+	step       uint64 // time between encoder phases, in cycles
+	phase      int    // current encoder phase
+	busyUntil  uint64 // cycle at which the last queued encoder step ends
+}
+
+// An input change that happens at the given cycle.
+type inputEvent struct {
+	cycle uint64
+	apply func()
+}
+
+// A parsed input command.
+type inputCommand struct {
+	op     string
+	device *inputDevice
+	key    string
+	arg    string
+}
+
+// All input devices of a machine and their pending changes.
+type inputManager struct {
+	lock    sync.Mutex
+	machine *C.machine_t
+	clock   int
+	rng     *rand.Rand
+	devices []*inputDevice
+	events  []inputEvent // sorted by cycle
+}
+
+func newInputManager(machine *C.machine_t, clock int, rng *rand.Rand) *inputManager {
+	return &inputManager{machine: machine, clock: clock, rng: rng}
+}
+
+// Add an input device from its specification, and drive its pins to their
+// resting level.
+func (im *inputManager) add(spec string) error {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return errors.New("empty input specification")
+	}
+	parts := strings.SplitN(fields[0], ":", 2)
+	kind, ok := inputKinds[parts[0]]
+	if !ok || len(parts) != 2 || parts[1] == "" {
+		return fmt.Errorf("expected button:NAME, encoder:NAME or keypad:NAME, not %q", fields[0])
+	}
+	if im.find(parts[1]) != nil {
+		return fmt.Errorf("duplicate input name %q", parts[1])
+	}
+	d := &inputDevice{kind: kind, name: parts[1], step: uint64(im.clock / 500)}
+	options := map[string]string{}
+	for _, field := range fields[1:] {
+		eq := strings.IndexByte(field, '=')
+		if eq < 0 {
+			return fmt.Errorf("expected KEY=VALUE, not %q", field)
+		}
+		options[field[:eq]] = field[eq+1:]
+	}
+	pinOptions := map[inputKind][]string{
+		inputButton:  {"pin"},
+		inputEncoder: {"a", "b"},
+		inputKeypad:  {"rows", "cols"},
+	}[kind]
+	for _, option := range pinOptions {
+		if options[option] == "" {
+			return fmt.Errorf("%s needs %s=", parts[0], option)
+		}
+		var pins []int
+		for _, name := range strings.Split(options[option], ",") {
+			pin, err := parseGPIOPin(name)
+			if err != nil {
+				return err
+			}
+			if pin < 0 {
+				return fmt.Errorf("empty pin in %s=", option)
+			}
+			pins = append(pins, pin)
+		}
+		if option == "rows" {
+			d.rows = len(pins)
+		}
+		d.pins = append(d.pins, pins...)
+		delete(options, option)
+	}
+	for option, value := range options {
+		var err error
+		switch option {
+		case "key", "keys":
+			d.keys = value
+		case "active":
+			if value != "low" && value != "high" {
+				return fmt.Errorf("active must be low or high, not %q", value)
+			}
+			d.activeHigh = value == "high"
+		case "bounce":
+			d.bounce, err = parseCycles(value, im.clock)
+		case "step":
+			d.step, err = parseCycles(value, im.clock)
+		case "layout":
+			d.layout = value
+		default:
+			return fmt.Errorf("unknown option %q", option)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, c := range []byte(d.keys) {
+		if strings.IndexByte("hxsck\x01", c) >= 0 {
+			return fmt.Errorf("console key %q is used by the console itself", c)
+		}
+	}
+	switch kind {
+	case inputButton:
+		if len(d.keys) > 1 {
+			return errors.New("a button has a single console key")
+		}
+		im.drive(d.pins[0], !d.activeHigh)
+	case inputEncoder:
+		if d.keys != "" && len(d.keys) != 2 {
+			return errors.New("an encoder has two console keys: counterclockwise and clockwise")
+		}
+		im.drive(d.pins[0], true)
+		im.drive(d.pins[1], true)
+	case inputKeypad:
+		cols := len(d.pins) - d.rows
+		if d.layout == "" {
+			d.layout = keypadLayouts[[2]int{d.rows, cols}]
+		}
+		if len(d.layout) != d.rows*cols {
+			return fmt.Errorf("keypad layout must have %d keys", d.rows*cols)
+		}
+	}
+	im.devices = append(im.devices, d)
+	return nil
+}
+
+// Return the input device with the given name, or nil if there is none.
+func (im *inputManager) find(name string) *inputDevice {
+	for _, d := range im.devices {
+		if d.name == name {
+			return d
+		}
+	}
+	return nil
+}
+
+// Drive a pin of the machine high or low.
+func (im *inputManager) drive(pin int, high bool) {
+	level := 0
+	if high {
+		level = 1
+	}
+	C.machine_set_gpio_input(im.machine, C.uint32_t(pin), C.int(level))
+}
+
+// Parse an input command, like "click button1" or "rotate knob -2".
+func (im *inputManager) parse(line string) (*inputCommand, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil, errors.New("expected COMMAND NAME [ARGS]")
+	}
+	cmd := &inputCommand{op: fields[0], device: im.find(fields[1])}
+	if cmd.device == nil {
+		return nil, fmt.Errorf("unknown input %q", fields[1])
+	}
+	args := fields[2:]
+	d := cmd.device
+	switch cmd.op {
+	case "press", "release", "click", "glitch":
+		if d.kind == inputKeypad || (d.kind == inputEncoder && cmd.op == "glitch") {
+			if len(args) == 0 {
+				return nil, fmt.Errorf("expected a key of %s", d.name)
+			}
+			cmd.key, args = args[0], args[1:]
+			if d.kind == inputKeypad && (len(cmd.key) != 1 || strings.IndexByte(d.layout, cmd.key[0]) < 0) {
+				return nil, fmt.Errorf("%s has no key %q", d.name, cmd.key)
+			}
+			if d.kind == inputEncoder && cmd.key != "a" && cmd.key != "b" {
+				return nil, errors.New("the key of an encoder is a or b")
+			}
+		} else if d.kind != inputButton {
+			return nil, fmt.Errorf("%s is not a button or keypad", d.name)
+		}
+		maxArgs := 0
+		if cmd.op == "click" || cmd.op == "glitch" {
+			maxArgs = 1
+		}
+		if len(args) > maxArgs {
+			return nil, fmt.Errorf("too many arguments for %s", cmd.op)
+		}
+		if len(args) != 0 {
+			cmd.arg = args[0]
+			if _, err := parseCycles(cmd.arg, im.clock); err != nil {
+				return nil, err
+			}
+		}
+	case "rotate":
+		if d.kind != inputEncoder {
+			return nil, fmt.Errorf("%s is not an encoder", d.name)
+		}
+		if len(args) != 1 {
+			return nil, errors.New("expected rotate NAME STEPS")
+		}
+		if _, err := strconv.Atoi(args[0]); err != nil {
+			return nil, fmt.Errorf("invalid number of steps %q", args[0])
+		}
+		cmd.arg = args[0]
+	default:
+		return nil, fmt.Errorf("unknown input command %q", cmd.op)
+	}
+	return cmd, nil
+}
+
+// Parse and run an input command. The machine must not be running.
+func (im *inputManager) command(line string) error {
+	cmd, err := im.parse(line)
+	if err != nil {
+		return err
+	}
+	im.exec(cmd)
+	return nil
+}
+
+// Run a parsed input command. The machine must not be running.
+func (im *inputManager) exec(cmd *inputCommand) {
+	im.lock.Lock()
+	defer im.lock.Unlock()
+	im.run(cmd)
+	im.applyDue()
+}
+
+// Schedule the changes of a command, starting at the current cycle.
+func (im *inputManager) run(cmd *inputCommand) {
+	now := uint64(im.machine.stats.cycles)
+	d := cmd.device
+	duration := func(s string, defaultValue uint64) uint64 {
+		if s == "" {
+			return defaultValue
+		}
+		cycles, _ := parseCycles(s, im.clock) // checked in parse
+		return cycles
+	}
+	switch cmd.op {
+	case "press", "release":
+		im.contact(now, d.bounce, im.contactFunc(d, cmd.key), cmd.op == "press")
+	case "click":
+		set := im.contactFunc(d, cmd.key)
+		hold := duration(cmd.arg, uint64(im.clock/10))
+		im.contact(now, d.bounce, set, true)
+		im.contact(now+d.bounce+hold, d.bounce, set, false)
+	case "glitch":
+		set := im.contactFunc(d, cmd.key)
+		if d.kind == inputEncoder {
+			// Toggle the pin away from its current level and back.
+			pin := 0
+			if cmd.key == "b" {
+				pin = 1
+			}
+			level := encoderPhases[d.phase][pin] != 0
+			set = func(on bool) {
+				im.drive(d.pins[pin], level != on)
+			}
+		}
+		im.contact(now, 0, set, true)
+		im.contact(now+duration(cmd.arg, uint64(im.clock/10000)), 0, set, false)
+	case "rotate":
+		steps, _ := strconv.Atoi(cmd.arg)
+		direction := 1
+		if steps < 0 {
+			steps, direction = -steps, -1
+		}
+		// Queue the steps after those of an earlier command, so that quick
+		// turns add up.
+		at := now
+		if d.busyUntil > at {
+			at = d.busyUntil
+		}
+		for i := 0; i < steps*4; i++ {
+			old := d.phase
+			d.phase = (d.phase + direction + 4) % 4
+			pin := 0
+			if encoderPhases[old][0] == encoderPhases[d.phase][0] {
+				pin = 1 // only B changes in this phase
+			}
+			high := encoderPhases[d.phase][pin] != 0
+			im.contact(at, d.bounce, func(on bool) {
+				im.drive(d.pins[pin], high == on)
+			}, true)
+			at += d.step
+		}
+		d.busyUntil = at
+	}
+}
+
+// Return a function that closes (on) or opens a contact of a button or a key
+// of a keypad.
+func (im *inputManager) contactFunc(d *inputDevice, key string) func(on bool) {
+	if d.kind == inputKeypad {
+		index := strings.Index(d.layout, key)
+		cols := len(d.pins) - d.rows
+		row, col := d.pins[index/cols], d.pins[d.rows+index%cols]
+		return func(on bool) {
+			if C.machine_connect_gpio(im.machine, C.uint32_t(row), C.uint32_t(col), C.bool(on)) < 0 {
+				fmt.Fprintln(os.Stderr, "\ninput: too many keys pressed at the same time")
+			}
+		}
+	}
+	return func(on bool) {
+		im.drive(d.pins[0], on == d.activeHigh)
+	}
+}
+
+// Schedule a change of a contact at the given cycle. With bounce, the contact
+// toggles an even number of extra times at random moments within the bounce
+// time, so that it still ends up in the new state.
+func (im *inputManager) contact(cycle, bounce uint64, set func(on bool), on bool) {
+	im.schedule(cycle, func() { set(on) })
+	if bounce == 0 {
+		return
+	}
+	var times []uint64
+	for n := 2 * (1 + im.rng.Intn(3)); n > 0; n-- {
+		times = append(times, cycle+1+uint64(im.rng.Int63n(int64(bounce))))
+	}
+	sort.Slice(times, func(i, j int) bool {
+		return times[i] < times[j]
+	})
+	level := on
+	for _, t := range times {
+		level = !level
+		state := level
+		im.schedule(t, func() { set(state) })
+	}
+}
+
+// Add an event, after those already scheduled at the same cycle.
+func (im *inputManager) schedule(cycle uint64, apply func()) {
+	i := sort.Search(len(im.events), func(i int) bool {
+		return im.events[i].cycle > cycle
+	})
+	im.events = append(im.events, inputEvent{})
+	copy(im.events[i+1:], im.events[i:])
+	im.events[i] = inputEvent{cycle, apply}
+}
+
+// Apply all events that are due. The lock must be held.
+func (im *inputManager) applyDue() {
+	for len(im.events) != 0 && im.events[0].cycle <= uint64(im.machine.stats.cycles) {
+		event := im.events[0]
+		im.events = im.events[1:]
+		event.apply()
+	}
+}
+
+// Apply all events that are due and return the cycle of the next one, or 0
+// if there is none. The machine must not be running.
+func (im *inputManager) update() uint64 {
+	im.lock.Lock()
+	defer im.lock.Unlock()
+	im.applyDue()
+	if len(im.events) == 0 {
+		return 0
+	}
+	return im.events[0].cycle
+}
+
+// Return the command for a console key after Ctrl-A, if an input device uses
+// that key.
+func (im *inputManager) consoleKey(c byte) (string, bool) {
+	for _, d := range im.devices {
+		switch i := strings.IndexByte(d.keys, c); {
+		case i < 0:
+		case d.kind == inputButton:
+			return "click " + d.name, true
+		case d.kind == inputEncoder && i == 0:
+			return "rotate " + d.name + " -1", true
+		case d.kind == inputEncoder:
+			return "rotate " + d.name + " 1", true
+		}
+	}
+	return "", false
+}
+
+// Return the command for a keypad key typed after Ctrl-A k.
+func (im *inputManager) keypadKey(c byte) (string, bool) {
+	for _, d := range im.devices {
+		if d.kind == inputKeypad && strings.IndexByte(d.layout, c) >= 0 {
+			return "click " + d.name + " " + string(c), true
+		}
+	}
+	return "", false
+}
+
+// Describe the console keys of all input devices, for the console help.
+func (im *inputManager) help(w io.Writer) {
+	for _, d := range im.devices {
+		switch {
+		case d.kind == inputButton && d.keys != "":
+			fmt.Fprintf(w, "C-a %c    click %s\n", d.keys[0], d.name)
+		case d.kind == inputEncoder && d.keys != "":
+			fmt.Fprintf(w, "C-a %c    turn %s counterclockwise\n", d.keys[0], d.name)
+			fmt.Fprintf(w, "C-a %c    turn %s clockwise\n", d.keys[1], d.name)
+		case d.kind == inputKeypad:
+			fmt.Fprintf(w, "C-a k K  click key K of %s (%s)\n", d.name, d.layout)
+		}
+	}
+}
+
+// Run an input command while the machine may be running, halting it so that
+// the command takes effect at the current cycle.
+func (m *Machine) inputCommand(line string) error {
+	if m.inputs == nil {
+		return errors.New("no input devices, see -input")
+	}
+	return m.Pause(func(running bool) error {
+		return m.inputs.command(line)
+	})
+}
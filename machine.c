@@ -1,7 +1,11 @@
+#define _DEFAULT_SOURCE // for MAP_ANONYMOUS with -std=c11
+
 
 #include "machine.h"
+#include "disasm.h"
 #include "terminal.h"
 
+#include <math.h>
 #include <string.h>
 
 // This file implements the CPU core and memory subsystem.
@@ -25,9 +29,25 @@ void *wasm_malloc(size_t size);
 
 #define KEEPALIVE EMSCRIPTEN_KEEPALIVE
 
+// There is no host clock available. Time is always derived from the cycle
+// counter.
+#define machine_host_time_us() (0)
+
 #else // all other compilers
 
 #include <stdio.h>
+#include <time.h>
+#ifndef _WIN32
+#include <sys/mman.h>
+#include <unistd.h>
+#endif
+
+// Return the host (wall clock) time in microseconds.
+static uint64_t machine_host_time_us(void) {
+	struct timespec ts;
+	timespec_get(&ts, TIME_UTC);
+	return (uint64_t)ts.tv_sec * 1000000 + ts.tv_nsec / 1000;
+}
 
 // TODO: make this configurable
 #define machine_versioncheck(machine, core) (true)
@@ -38,1676 +58,10083 @@ void *wasm_malloc(size_t size);
 
 #endif
 
-static int machine_transfer(machine_t *machine, uint32_t address, transfer_type_t transfer_type, uint32_t *reg, width_t width, bool signextend) {
-	// Select memory region
-	uint32_t region = address >> 29; // 3 bits for the region
-	uint32_t region_address = address & (0xffffffff >> 3);
+// Allocate a zeroed memory region of the machine, like RAM. Where the host
+// supports it, the memory is mapped so that pages are only backed when they
+// are first touched: large regions and many machines in one process stay
+// cheap.
+static void *machine_alloc_region(size_t size) {
+#if defined(__EMSCRIPTEN__) || defined(_WIN32)
+	return calloc(size, 1);
+#else
+	if (size == 0) {
+		return NULL;
+	}
+	void *ptr = mmap(NULL, size, PROT_READ | PROT_WRITE, MAP_PRIVATE | MAP_ANONYMOUS, -1, 0);
+	return ptr == MAP_FAILED ? NULL : ptr;
+#endif
+}
 
-	void *ptr = 0;
-	if (region == 0) {
-		// code: 0x00000000 .. 0x1fffffff
-		if (region_address < machine->image_size) {
-			ptr = &machine->image8[region_address];
-		} else if (transfer_type == LOAD && address == 0x10000130) {
-			*reg = 0; // undocumented, but somewhere in FICR
-			return 0;
-		} else if (address == 0x10001200) {
-			ptr = &machine->uicr.pselreset[0];
-		} else if (address == 0x10001204) {
-			ptr = &machine->uicr.pselreset[1];
-		}
-		if (transfer_type == STORE && ptr != NULL) {
-			if ((address & 3) != 0 || width != WIDTH_32) {
-				machine_log(machine, LOG_ERROR, "ERROR: unaligned write to read-only memory (PC: %x, ptr: 0x%x)\n", machine->pc - 3, address);
-				return ERR_MEM;
-			}
-			if (!machine->image_writable) {
-				machine_log(machine, LOG_ERROR, "ERROR: write to read-only memory (PC: %x, ptr: 0x%x)\n", machine->pc - 3, address);
-				return ERR_MEM;
-			}
+// Free a region allocated with machine_alloc_region.
+static void machine_free_region(void *ptr, size_t size) {
+#if defined(__EMSCRIPTEN__) || defined(_WIN32)
+	free(ptr);
+#else
+	if (ptr != NULL) {
+		munmap(ptr, size);
+	}
+#endif
+}
 
-			// Emulate NOR memory where bits can only be cleared.
-			*(uint32_t*)ptr &= *reg;
-			return 0;
-		}
-	} else if (region == 1) {
-		// SRAM: 0x20000000 .. 0x3ffffff
-		if (region_address < machine->mem_size) {
-			ptr = &machine->mem8[region_address];
-		}
-	} else if (region == 2) {
-		// Peripherals: 0x40000000 .. 0x5fffffff
-		// Make this a special case
-		uint32_t value = 0;
-		if ((address & 3) != 0 || width != WIDTH_32) {
-			machine_log(machine, LOG_ERROR, "\nERROR: invalid %s peripheral address: 0x%08x (PC: %x)\n", transfer_type == LOAD ? "load" : "store", address, machine->pc - 3);
-			return ERR_MEM;
+// Clear a region allocated with machine_alloc_region. Instead of writing
+// zeroes, the pages are mapped again, so that they aren't backed anymore.
+static void machine_clear_region(void *ptr, size_t size) {
+#if defined(__EMSCRIPTEN__) || defined(_WIN32)
+	memset(ptr, 0, size);
+#else
+	if (ptr != NULL && mmap(ptr, size, PROT_READ | PROT_WRITE, MAP_PRIVATE | MAP_ANONYMOUS | MAP_FIXED, -1, 0) == MAP_FAILED) {
+		memset(ptr, 0, size);
+	}
+#endif
+}
+
+// Erased flash is mapped in chunks of this size, see machine_erase_region.
+#define MACHINE_ERASED_CHUNK (64 * 1024)
+
+#if !defined(__EMSCRIPTEN__) && !defined(_WIN32)
+// Return a file of MACHINE_ERASED_CHUNK erased (0xff) bytes that is shared by
+// all machines, or -1 if it can't be created.
+static int machine_erased_file(void) {
+	static int erased_fd = -2;
+	int fd = __atomic_load_n(&erased_fd, __ATOMIC_ACQUIRE);
+	if (fd != -2) {
+		return fd;
+	}
+	fd = -1;
+	FILE *f = tmpfile();
+	if (f != NULL) {
+		uint8_t chunk[4096];
+		memset(chunk, 0xff, sizeof(chunk));
+		bool ok = true;
+		for (size_t i = 0; i < MACHINE_ERASED_CHUNK; i += sizeof(chunk)) {
+			ok = ok && fwrite(chunk, 1, sizeof(chunk), f) == sizeof(chunk);
 		}
-		if (transfer_type == STORE && address == 0x40002000) { // STARTRX
-		} else if (transfer_type == STORE && address == 0x40002004) { // STOPRX
-		} else if (transfer_type == STORE && address == 0x40002008) { // STARTTX
-		} else if (transfer_type == STORE && address == 0x4000200c) { // STOPTX
-		} else if (address == 0x40002108) { // RXDRDY
-			value = 1;
-		} else if (address == 0x4000211c) { // TXDRDY
-			value = 1;
-		} else if (address == 0x40002124) { // ERROR
-		} else if (address == 0x40002144) { // RXTO
-		} else if (transfer_type == LOAD && address == 0x40002518) { // RXD
-			value = terminal_getchar();
-		} else if (transfer_type == STORE && address == 0x4000251c) { // TXD
-			terminal_putchar(*reg);
-		} else if (transfer_type == LOAD && address == 0x4000d100) { // RNG.VALRDY
-			value = 1;
-		} else if (transfer_type == LOAD && address == 0x4000d508) { // RNG.VALUE
-			value = rand() & 0xff;
-		} else if (transfer_type == LOAD && address == 0x4001e400) { // NVMC.READY
-			value = 1; // always ready
-		} else if (transfer_type == STORE && address == 0x4001e504) { // NVMC.CONFIG
-			machine->image_writable = *reg != 0;
-		} else if (transfer_type == STORE && address == 0x4001e508) { // NVMC.ERASEPAGE
-			if ((*reg & (machine->pagesize-1)) != 0 || *reg >= machine->image_size) {
-				machine_log(machine, LOG_ERROR, "ERROR: invalid page address: %x (PC: %x)\n", *reg, machine->pc - 3);
-				return ERR_MEM;
-			}
-			// Emulate erasing NOR flash.
-			memset(machine->image8 + *reg, 0xff, machine->pagesize);
+		if (ok && fflush(f) == 0) {
+			fd = fileno(f); // the file stays open until the process exits
 		} else {
-			machine_log(machine, LOG_WARN, "unknown %s peripheral address: 0x%08x (value: 0x%x, PC: %x)\n", transfer_type == LOAD ? "load" : "store", address, *reg, machine->pc - 3);
-		}
-		if (transfer_type == LOAD) {
-			if (width == WIDTH_8) {
-				value &= 0xff;
-			} else if (width == WIDTH_16) {
-				value &= 0xffff;
-			}
-			*reg = value;
-		}
-		return 0;
-	} else if (region == 7) {
-		// Private peripheral bus + Device: 0xe0000000 .. 0xffffffff
-		if (address == 0xe000e100 && transfer_type == STORE) {
-			// NVIC Interrupt Set-enable Register
-			machine_log(machine, LOG_WARN, "set interrupts: %08x\n", *reg);
-			return 0;
-		}
-		if (address == 0xe000e180 && transfer_type == STORE) {
-			// NVIC Interrupt Clear-enable Register
-			machine_log(machine, LOG_WARN, "clear interrupts: %08x\n", *reg);
-			return 0;
-		}
-		if (address == 0xe000ed88) {
-			ptr = &machine->scb.cpacr;
-		}
-		if ((address & 0xfffffff0) == 0xe000e400) {
-			ptr = &machine->nvic.ip[address % 32];
-		}
-		if ((address & 0xfffffff0) == 0xf0000fe0 && transfer_type == LOAD) {
-			machine_log(machine, LOG_WARN, "private address: %x\n", address);
-			// 0xf0000fe0, 0xf0000fe4, 0xf0000fe8, 0xf0000fec
-			// Not sure what this is all about but this is what the nrf
-			// seems to expect...
-			*reg = 0;
-			return 0;
+			fclose(f);
 		}
 	}
-
-	if (ptr == 0) {
-		if (transfer_type == LOAD) {
-			machine_log(machine, LOG_ERROR, "\nERROR: invalid load address: 0x%08x (PC: %x)\n", address, machine->pc - 3);
-		} else {
-			machine_log(machine, LOG_ERROR, "\nERROR: invalid store address: 0x%08x (PC: %x, value: %x)\n", address, machine->pc - 3, *reg);
+	int expected = -2;
+	if (!__atomic_compare_exchange_n(&erased_fd, &expected, fd, false, __ATOMIC_ACQ_REL, __ATOMIC_ACQUIRE)) {
+		// Another thread created the file first.
+		if (fd >= 0) {
+			close(fd);
 		}
-		return ERR_MEM;
-	} else if (((width == WIDTH_16 && (address & 1) != 0) || (width == WIDTH_32 && (address & 3) != 0))
-			&& !machine_versioncheck(machine, CORTEX_M4)) {
-		// Note: Cortex-M4 supports unaligned memory accesses when
-		// enabled.
-		machine_log(machine, LOG_ERROR, "\nERROR: unaligned %s address: 0x%08x (PC: %x)\n", transfer_type == LOAD ? "load" : "store", address, machine->pc - 3);
-		return ERR_MEM;
+		return expected;
 	}
+	return fd;
+}
+#endif
 
-	if (transfer_type == LOAD) {
-		if (width == WIDTH_8) {
-			uint8_t value = *(uint8_t*)ptr;
-			if (signextend) {
-				*reg = (int8_t)value;
-			} else {
-				*reg = value;
+// Erase (set to 0xff) a part of a region allocated with machine_alloc_region,
+// like flash. Where the host supports it, whole chunks are mapped copy-on-write
+// from a file of erased bytes, so that erased flash is only backed once it is
+// written to. Bytes that are erased already aren't written either.
+static void machine_erase_region(void *region, size_t offset, size_t size) {
+	uint8_t *ptr = region;
+	size_t end = offset + size;
+#if !defined(__EMSCRIPTEN__) && !defined(_WIN32)
+	size_t first = (offset + MACHINE_ERASED_CHUNK - 1) / MACHINE_ERASED_CHUNK * MACHINE_ERASED_CHUNK;
+	size_t last = end / MACHINE_ERASED_CHUNK * MACHINE_ERASED_CHUNK;
+	int fd = first < last ? machine_erased_file() : -1;
+	if (fd >= 0) {
+		for (size_t chunk = first; chunk < last; chunk += MACHINE_ERASED_CHUNK) {
+			if (mmap(ptr + chunk, MACHINE_ERASED_CHUNK, PROT_READ | PROT_WRITE, MAP_PRIVATE | MAP_FIXED, fd, 0) == MAP_FAILED) {
+				memset(ptr + chunk, 0xff, MACHINE_ERASED_CHUNK);
 			}
-		} else if (width == WIDTH_16) {
-			uint16_t value = *(uint16_t*)ptr;
-			if (signextend) {
-				*reg = (int16_t)value;
-			} else {
-				*reg = value;
-			}
-		} else if (width == WIDTH_32) {
-			*reg = *(uint32_t*)ptr;
-		} else {
-			// should be unreachable
 		}
-	} else { // STORE
-		if (width == WIDTH_8) {
-			*(uint8_t*)ptr = *reg;
-		} else if (width == WIDTH_16) {
-			*(uint16_t*)ptr = *reg;
-		} else if (width == WIDTH_32) {
-			*(uint32_t*)ptr = *reg;
-		} else {
-			// should be unreachable
+		machine_erase_region(region, offset, first - offset);
+		machine_erase_region(region, last, end - last);
+		return;
+	}
+#endif
+	for (size_t i = offset; i < end; i++) {
+		if (ptr[i] != 0xff) {
+			memset(ptr + i, 0xff, end - i);
+			break;
 		}
 	}
-	return 0;
-}
-
-KEEPALIVE
-void machine_reset(machine_t *machine) {
-	// Do a reset
-	machine->sp = machine->image32[0]; // initial stack pointer
-	//machine->lr = 0xffffffff; // exit address
-	machine->lr = 0xdeadbeef; // exit address
-	machine->pc = machine->image32[1]; // Reset_Vector address
-	machine->backtrace[1].pc = machine->pc - 1;
-	machine->backtrace[1].sp = machine->sp;
-	machine_log(machine, LOG_CALLS, "RESET %5x (sp: %x)\n", machine->pc - 1, machine->sp);
 }
 
-static void machine_add_backtrace(machine_t *machine, uint32_t pc, uint32_t sp) {
-	machine->call_depth++;
-	if (machine->call_depth >= 0 && machine->call_depth < MACHINE_BACKTRACE_LEN) {
-		while (machine->call_depth > 0 && machine->backtrace[machine->call_depth - 1].sp <= sp) {
-			// Remove leaf functions that we already returned from.
-			machine->call_depth--;
+// Return the symbol containing the given address, or NULL if there is none.
+static const symbol_t * machine_find_symbol(machine_t *machine, uint32_t address) {
+	size_t low = 0;
+	size_t high = machine->num_symbols;
+	while (low < high) {
+		size_t mid = (low + high) / 2;
+		if (machine->symbols[mid].address <= address) {
+			low = mid + 1;
+		} else {
+			high = mid;
 		}
-		machine->backtrace[machine->call_depth].pc = pc;
-		machine->backtrace[machine->call_depth].sp = sp;
 	}
+	if (low == 0) {
+		return NULL;
+	}
+	const symbol_t *symbol = &machine->symbols[low - 1];
+	if (symbol->size != 0 && address - symbol->address >= symbol->size) {
+		return NULL;
+	}
+	return symbol;
 }
 
-static int machine_instr_stmdb(machine_t *machine, uint32_t *reg, uint32_t reg_list, bool wback) {
-	uint32_t address = *reg;
-	for (int i = 14; i >= 0; i--) {
-		if (reg_list & (1 << i)) {
-			address -= 4;
-			if (reg == &machine->sp && wback) {
-				if (i == 14) {
-					machine_log(machine, LOG_CALLS, "%*sPUSH lr      (sp: %x) (lr: %x)\n", machine->call_depth * 2, "", address, machine->lr + 2);
-				} else {
-					machine_log(machine, LOG_CALLS, "%*spush r%d      (sp: %x)\n", machine->call_depth * 2, "", i, address);
-				}
-			}
-			if (machine_transfer(machine, address, STORE, &machine->regs[i], WIDTH_32, false)) {
-				return ERR_MEM;
-			}
+// Return the line table row of the given address, or NULL if there is none.
+static const line_t * machine_find_line(machine_t *machine, uint32_t address) {
+	size_t low = 0;
+	size_t high = machine->num_lines;
+	while (low < high) {
+		size_t mid = (low + high) / 2;
+		if (machine->lines[mid].address <= address) {
+			low = mid + 1;
+		} else {
+			high = mid;
 		}
 	}
-	if (wback) {
-		*reg = address;
+	if (low == 0 || machine->lines[low - 1].line == 0) {
+		return NULL;
 	}
-	return 0;
+	return &machine->lines[low - 1];
 }
 
-static int machine_instr_stmia(machine_t *machine, uint32_t *reg, uint32_t reg_list, bool wback) {
-	uint32_t address = *reg;
-	for (size_t i = 0; i <= 15; i++) {
-		if (((reg_list >> i) & 1) == 1) {
-			uint32_t *reg = &machine->regs[i];
-			if (machine_transfer(machine, address, STORE, reg, WIDTH_32, false)) {
-				return ERR_MEM;
-			}
-			address += 4;
-		}
+// Format the symbol and source location of the given address (like
+// " <main+0x4> main.c:12") into buf. The result is empty if neither is known.
+static const char * machine_symbol_name(machine_t *machine, uint32_t address, char *buf, size_t len) {
+	buf[0] = 0;
+#if !defined(__EMSCRIPTEN__)
+	const symbol_t *symbol = machine_find_symbol(machine, address);
+	int n = 0;
+	if (symbol != NULL && address == symbol->address) {
+		n = snprintf(buf, len, " <%s>", symbol->name);
+	} else if (symbol != NULL) {
+		n = snprintf(buf, len, " <%s+0x%x>", symbol->name, address - symbol->address);
 	}
-	if (wback) {
-		*reg = address;
+	const line_t *line = machine_find_line(machine, address);
+	if (line != NULL && n >= 0 && (size_t)n < len) {
+		snprintf(buf + n, len - n, " %s:%u", machine->source_files[line->file], line->line);
 	}
-	return 0;
+#endif
+	return buf;
 }
 
-static int machine_instr_ldmdb(machine_t *machine, uint32_t *reg, uint32_t reg_list, bool wback) {
-	uint32_t address = *reg;
-	for (int i = 14; i >= 0; i--) {
-		if (reg_list & (1 << i)) {
-			address -= 4;
-			if (machine_transfer(machine, address, LOAD, &machine->regs[i], WIDTH_32, false)) {
-				return ERR_MEM;
-			}
-		}
+// Return whether calls to the given address should be logged.
+static bool machine_log_call(machine_t *machine, uint32_t address) {
+	if (machine_loglevel(machine) < LOG_CALLS) {
+		return false;
 	}
-	if (wback) {
-		*reg = address;
+	if (!machine->symbols_filtered) {
+		return true;
 	}
-	return 0;
+	const symbol_t *symbol = machine_find_symbol(machine, address);
+	return symbol != NULL && symbol->log;
 }
 
-static int machine_instr_ldmia(machine_t *machine, uint32_t *reg, uint32_t reg_list, bool wback) {
-	uint32_t address = *reg;
-	for (int i = 0; i <= 15; i++) {
-		if (reg_list & (1 << i)) {
-			if (reg == &machine->sp && wback) {
-				if (i == 15) {
-					machine_log(machine, LOG_CALLS, "%*sPOP pc %5x (sp: %x)\n", machine->call_depth * 2, "", machine->pc - 1, address);
-				} else {
-					machine_log(machine, LOG_CALLS, "%*spop r%d       (sp: %x)\n", machine->call_depth * 2, "", i, address);
-				}
-			}
-			if (machine_transfer(machine, address, LOAD, &machine->regs[i], WIDTH_32, false)) {
-				return ERR_MEM;
-			}
-			address += 4;
-		}
+// Return the time in microseconds since the machine was created, following
+// the host clock. The host clock is stopped while the machine isn't running,
+// like when it is halted at a breakpoint: then time only advances with the
+// cycles of single-stepped instructions. See machine_set_time_while_halted.
+static uint64_t machine_host_us(machine_t *machine) {
+	if (machine->time_paused) {
+		return machine->paused_us + (machine->stats.cycles - machine->paused_cycles) * 1000000 / machine->clock;
 	}
-	if (wback) {
-		*reg = address;
+	return machine_host_time_us() - machine->host_start_us;
+}
+
+// Stop following the host clock, when the machine stops running.
+static void machine_time_pause(machine_t *machine) {
+	if (machine->time_paused || machine->time_while_halted) {
+		return;
 	}
-	return 0;
+	machine->paused_us = machine_host_us(machine);
+	machine->paused_cycles = machine->stats.cycles;
+	machine->time_paused = true;
 }
 
-static uint32_t machine_instr_lsl(machine_t *machine, uint32_t src, uint32_t shift, bool setflags) {
-	if (setflags && shift != 0) { // range 0..31, setflags only when shifting non-zero amount
-		machine->psr.c = src >> (32 - shift) & 1;
+// Follow the host clock again from the current time, when the machine starts
+// running.
+static void machine_time_resume(machine_t *machine) {
+	if (!machine->time_paused) {
+		return;
 	}
-	if (shift >= 32) {
-		return 0;
+	machine->host_start_us = machine_host_time_us() - machine_host_us(machine);
+	machine->time_paused = false;
+}
+
+// Return the number of ticks of a clock with the given frequency since the
+// machine was created. In deterministic mode this is derived from the cycle
+// counter, otherwise from the host clock.
+static uint64_t machine_ticks(machine_t *machine, uint32_t frequency) {
+	if (machine->deterministic) {
+		return machine->stats.cycles * frequency / machine->clock;
 	}
-	return src << shift;
+	return machine_host_us(machine) * frequency / 1000000;
 }
 
-static uint32_t machine_instr_lsr(machine_t *machine, uint32_t src, uint32_t shift, bool setflags) {
-	if (shift >= 32) {
-		if (setflags) {
-			machine->psr.c = (src >> 31) & 1;
-		}
+// Return the number of cycles until a clock of the given frequency, as
+// returned by machine_ticks, reaches the given number of ticks. It is 0 if it
+// already has.
+static uint64_t machine_cycles_until(machine_t *machine, uint32_t frequency, uint64_t ticks) {
+	if (ticks <= machine_ticks(machine, frequency)) {
 		return 0;
 	}
-	if (shift != 0 && setflags) {
-		machine->psr.c = src >> (shift - 1) & 1;
+	if (machine->deterministic) {
+		// The first cycle at which machine_ticks (which rounds down) reaches
+		// ticks.
+		uint64_t cycle = ticks / frequency * machine->clock + ((ticks % frequency) * machine->clock + frequency - 1) / frequency;
+		return cycle > machine->stats.cycles ? cycle - machine->stats.cycles : 0;
 	}
-	return src >> shift;
+	uint64_t us = ticks / frequency * 1000000 + ((ticks % frequency) * 1000000 + frequency - 1) / frequency;
+	return ((us - machine_host_us(machine)) * machine->clock + 999999) / 1000000;
 }
 
-static uint32_t machine_instr_asr(machine_t *machine, uint32_t src, uint32_t shift, bool setflags) {
-	if (shift >= 32) {
-		if (setflags) {
-			machine->psr.c = (((int32_t)src) >> 31) & 1;
+// Lower *cycle to n, if n is lower.
+static inline void machine_min_cycle(uint64_t *cycle, uint64_t n) {
+	if (n < *cycle) {
+		*cycle = n;
+	}
+}
+
+// Swap two events in the heap of the scheduler.
+static void machine_events_swap(machine_t *machine, uint32_t a, uint32_t b) {
+	uint64_t cycle = machine->events.heap[a].cycle;
+	event_t event = machine->events.heap[a].event;
+	machine->events.heap[a] = machine->events.heap[b];
+	machine->events.heap[b].cycle = cycle;
+	machine->events.heap[b].event = event;
+	machine->events.pos[machine->events.heap[a].event] = a + 1;
+	machine->events.pos[machine->events.heap[b].event] = b + 1;
+}
+
+// Move the event at index i of the heap of the scheduler up or down to where
+// it belongs.
+static void machine_events_sift(machine_t *machine, uint32_t i) {
+	while (i > 0 && machine->events.heap[i].cycle < machine->events.heap[(i - 1) / 2].cycle) {
+		machine_events_swap(machine, i, (i - 1) / 2);
+		i = (i - 1) / 2;
+	}
+	while (1) {
+		uint32_t min = i;
+		for (uint32_t child = 2 * i + 1; child <= 2 * i + 2 && child < machine->events.len; child++) {
+			if (machine->events.heap[child].cycle < machine->events.heap[min].cycle) {
+				min = child;
+			}
 		}
-		// shift twice to avoid undefined behavior in the C compiler
-		return (((int32_t)src) >> 16) >> 16;
-	} else if (shift >= 0) {
-		if (setflags) {
-			machine->psr.c = ((int32_t)src) >> (shift - 1) & 1;
+		if (min == i) {
+			return;
 		}
-		return ((int32_t)src) >> shift;
-	} else {
-		return src;
+		machine_events_swap(machine, i, min);
+		i = min;
 	}
 }
 
-static uint32_t machine_instr_add(machine_t *machine, uint32_t a, uint32_t b, bool setflags) {
-	uint32_t result = a + b;
-	if (setflags) {
-		int64_t result64s = (int64_t)(int32_t)a + (int64_t)(int32_t)b;
-		uint64_t result64u = (uint64_t)a + (uint64_t)b;
-		machine->psr.n = (int32_t)result < 0;
-		machine->psr.z = result == 0;
-		machine->psr.c = result64u >= ((uint64_t)1 << 32); // true if 32-bit overflow
-		machine->psr.v = ((int32_t)result < 0) != (result64s < 0);
+// Schedule an event at the given cycle, instead of the cycle it was scheduled
+// at before. UINT64_MAX unschedules it. Events are run before the first
+// instruction at or after their cycle, see machine_events_run.
+static void machine_schedule(machine_t *machine, event_t event, uint64_t cycle) {
+	uint32_t pos = machine->events.pos[event];
+	if (pos == 0) {
+		if (cycle == UINT64_MAX) {
+			return;
+		}
+		pos = ++machine->events.len;
+		machine->events.heap[pos - 1].event = event;
+		machine->events.pos[event] = pos;
+	} else if (cycle == UINT64_MAX) {
+		// Move the last event in its place.
+		uint32_t last = --machine->events.len;
+		machine->events.pos[event] = 0;
+		if (pos - 1 != last) {
+			machine->events.heap[pos - 1] = machine->events.heap[last];
+			machine->events.pos[machine->events.heap[pos - 1].event] = pos;
+			machine_events_sift(machine, pos - 1);
+		}
+		return;
 	}
-	return result;
+	machine->events.heap[pos - 1].cycle = cycle;
+	machine_events_sift(machine, pos - 1);
 }
 
-static uint32_t machine_instr_adc(machine_t *machine, uint32_t a, uint32_t b, bool setflags) {
-	uint32_t result = a + b + machine->psr.c;
-	if (setflags) {
-		int64_t result64s = (int64_t)(int32_t)a + (int64_t)(int32_t)b + machine->psr.c;
-		uint64_t result64u = (uint64_t)a + (uint64_t)b + machine->psr.c;
-		machine->psr.n = (int32_t)result < 0;
-		machine->psr.z = result == 0;
-		machine->psr.c = result64u >= ((uint64_t)1 << 32); // true if 32-bit overflow
-		machine->psr.v = ((int32_t)result < 0) != (result64s < 0);
+// Schedule an event again before the next instruction, because the state of
+// its peripheral changed. See machine_event_cycle.
+static inline void machine_reschedule(machine_t *machine, event_t event) {
+	machine->events.dirty |= 1u << event;
+}
+
+// Update the SysTick timer, which counts CPU cycles, and pend the SysTick
+// exception when it reaches zero.
+static void machine_systick_update(machine_t *machine) {
+	uint64_t period = (uint64_t)machine->systick.rvr + 1;
+	uint64_t elapsed = machine->stats.cycles - machine->systick.base;
+	if (machine->systick.rvr == 0 || elapsed < period) {
+		return;
+	}
+	machine->systick.base += elapsed - elapsed % period;
+	machine->systick.countflag = true;
+	if (machine->systick.csr & (1 << 1)) { // TICKINT
+		machine->scb.pendst = true;
 	}
-	return result;
 }
 
-static uint32_t machine_instr_sub(machine_t *machine, uint32_t a, uint32_t b, bool setflags) {
-	uint32_t result = a - b;
-	if (setflags) {
-		int64_t result64s = (int64_t)(int32_t)a - (int64_t)(int32_t)b;
-		uint64_t result64u = (uint64_t)a - (uint64_t)b;
-		machine->psr.n = (int32_t)result < 0;
-		machine->psr.z = result == 0;
-		machine->psr.c = (int64_t)result64u >= 0;
-		machine->psr.v = ((int32_t)result < 0) != (result64s < 0);
+// Track when a peripheral is turned on or off, for power estimation.
+static void machine_periph_power(machine_t *machine, periph_t periph, bool on) {
+	if (on && !machine->periph_on[periph]) {
+		machine->periph_on[periph] = true;
+		machine->periph_since[periph] = machine->stats.cycles;
+	} else if (!on && machine->periph_on[periph]) {
+		machine->periph_on[periph] = false;
+		machine->stats.cycles_periph[periph] += machine->stats.cycles - machine->periph_since[periph];
 	}
-	return result;
 }
 
-static uint32_t machine_instr_sbc(machine_t *machine, uint32_t a, uint32_t b, bool setflags) {
-	uint32_t result = a - b - !machine->psr.c;
-	if (setflags) {
-		int64_t result64s = (int64_t)(int32_t)a - (int64_t)(int32_t)b - !machine->psr.c;
-		int64_t result64u = (uint64_t)a - (uint64_t)b - !machine->psr.c;
-		machine->psr.n = (int32_t)result < 0;
-		machine->psr.z = result == 0;
-		machine->psr.c = (int64_t)result64u >= 0;
-		machine->psr.v = ((int32_t)result < 0) != (result64s < 0);
+// Return a pseudo-random number. This uses a per-machine xorshift generator so
+// that runs are reproducible.
+static uint32_t machine_random(machine_t *machine) {
+	uint32_t x = machine->random_state;
+	x ^= x << 13;
+	x ^= x >> 17;
+	x ^= x << 5;
+	machine->random_state = x;
+	return x;
+}
+
+// Return true with the given probability (0..1).
+static bool machine_chance(machine_t *machine, double probability) {
+	if (probability <= 0) {
+		return false;
 	}
-	return result;
+	return machine_random(machine) < probability * 4294967296.0;
 }
 
-// Return 1 if true, 0 if false, and -1 if invalid.
-static int machine_condition(machine_t *machine, uint32_t condition) {
-	if (condition == 0b0000) { // BEQ: Z == 1
-		return machine->psr.z == true;
-	} else if (condition == 0b0001) { // BNE: Z == 0
-		return machine->psr.z == false;
-	} else if (condition == 0b0010) { // BCS: C == 1
-		return machine->psr.c == true;
-	} else if (condition == 0b0011) { // BCC: C == 0
-		return machine->psr.c == false;
-	} else if (condition == 0b0100) { // BMI: N == 1
-		return machine->psr.n == true;
-	} else if (condition == 0b0101) { // BPL: N == 0
-		return machine->psr.n == false;
-	} else if (condition == 0b1000) { // BHI: C == 1 && Z == 0
-		return machine->psr.c == true && machine->psr.z == false;
-	} else if (condition == 0b1001) { // BLS: C == 0 || Z == 1
-		return machine->psr.c == false || machine->psr.z == true;
-	} else if (condition == 0b1010) { // BGE: N == V
-		return machine->psr.n == machine->psr.v;
-	} else if (condition == 0b1011) { // BLT: N != V
-		return machine->psr.n != machine->psr.v;
-	} else if (condition == 0b1100) { // BGT: Z == 0 && N == V
-		return machine->psr.z == false && machine->psr.n == machine->psr.v;
-	} else if (condition == 0b1101) { // BLE: Z == 1 || N != V
-		// For this instruction, different manuals say different
-		// things.
-		// One option:
-		//   Z == 1 || N != V
-		// Another option:
-		//   Z == 1 && N != V
-		// I've tested compiler-generated code and it appears the
-		// former is correct. Also, it is more consistent with e.g.
-		// BHI/BLS. An example of a page that says otherwise:
-		//   http://infocenter.arm.com/help/index.jsp?topic=/com.arm.doc.dui0497a/BABEHFEF.html
-		return machine->psr.z == true || machine->psr.n != machine->psr.v;
-	} else {
-		return -1;
+// Erase a flash page, possibly interrupted by a power cut.
+static void machine_flash_erase(machine_t *machine, uint32_t address) {
+	machine->stats.flash_erases++;
+	machine->flash_erase_counts[address / machine->pagesize]++;
+	if (machine_chance(machine, machine->flash_cut_erase)) {
+		// Power is cut while erasing: only some bits are erased.
+		machine_log(machine, LOG_WARN, "\npower cut while erasing flash page 0x%08x (PC: %x)\n", address, machine->pc - 3);
+		for (size_t i = 0; i < machine->pagesize; i++) {
+			machine->image8[address + i] |= machine_random(machine);
+		}
+		machine->power_cut = true;
+		return;
 	}
+	// Emulate erasing NOR flash.
+	machine_erase_region(machine->image8, address, machine->pagesize);
 }
 
-// ALU operations for Thumb-2, which are used in two different instruction
-// formats.
-static int machine_alu_op(machine_t *machine, uint32_t op, uint32_t *reg_dst, uint32_t *reg_src, uint32_t value, bool setflags) {
-	if (op == 0b0000) {
-		uint32_t result = *reg_src & value;
-		if (reg_dst == &machine->pc && setflags) {
-			// TST
-			machine->psr.n = (int32_t)result < 0;
-			machine->psr.z = result == 0;
-			setflags = false;
-		} else {
-			// AND
-			*reg_dst = result;
+// Whether machine_halt was called and machine_run hasn't stopped yet.
+bool machine_halt_requested(machine_t *machine) {
+	return __atomic_load_n(&machine->halt, __ATOMIC_ACQUIRE);
+}
+
+// Report a bus operation to the host, see machine_set_bus_trace.
+static void machine_bus_traced(machine_t *machine, bus_op_t op, uint32_t device, uint8_t out, uint8_t in, bool ack) {
+	if (machine->bus.trace != NULL) {
+		machine->bus.trace(machine, op, device, out, in, ack);
+	}
+}
+
+// Whether the UART is connected to the terminal: UART0 is, unless the host
+// set its callbacks.
+static bool machine_uart_terminal(uart_t *uart) {
+	return uart->index == 0 && uart->output == NULL && uart->receive == NULL;
+}
+
+// Whether a character from the host is waiting to be received: injected
+// input, the receive callback, the input buffer or the terminal.
+static bool machine_uart_input_ready(machine_t *machine, uart_t *uart) {
+	if (uart->inject_len != 0) {
+		return true;
+	}
+	if (uart->receive != NULL) {
+		return uart->receive(machine, uart->index, false) >= 0;
+	}
+	if (uart->input == NULL) {
+		return machine_uart_terminal(uart) && terminal_poll();
+	}
+	return uart->input_pos < uart->input_len;
+}
+
+// Take the next character from the host.
+static uint32_t machine_uart_getchar(machine_t *machine, uart_t *uart) {
+	uint32_t c;
+	if (uart->inject_len != 0) {
+		c = uart->inject[uart->inject_pos];
+		uart->inject_pos = (uart->inject_pos + 1) % uart->inject_size;
+		uart->inject_len--;
+	} else if (uart->receive != NULL) {
+		int received = uart->receive(machine, uart->index, true);
+		if (received < 0) {
+			return 0;
 		}
-	} else if (op == 0b0001) {
-		// BIC
-		*reg_dst = *reg_src & ~value; // AND NOT
-	} else if (op == 0b0010) {
-		if (reg_src == &machine->pc) {
-			// MOV
-			*reg_dst = value;
-		} else {
-			// ORR
-			*reg_dst = *reg_src | value;
+		c = received;
+	} else if (uart->input == NULL) {
+		c = terminal_getchar();
+	} else if (uart->input_pos >= uart->input_len) {
+		return 0;
+	} else {
+		c = uart->input[uart->input_pos++];
+	}
+	machine_bus_traced(machine, BUS_UART_RECEIVE, uart->index, 0, c, true);
+	return c;
+}
+
+// Return the number of cycles that a character takes on the line, or 0 if
+// characters take no time.
+static uint64_t machine_uart_char_cycles(machine_t *machine, uart_t *uart) {
+	if (!uart->timing || uart->baud == 0) {
+		return 0;
+	}
+	return (uint64_t)machine->clock * uart->frame_bits / uart->baud;
+}
+
+// Return the number of cycles between received characters: a character time,
+// or longer with -uart-pacing. It is 0 if characters arrive as soon as there is
+// room for them.
+static uint64_t machine_uart_rx_cycles(machine_t *machine, uart_t *uart) {
+	uint64_t cycles = machine_uart_char_cycles(machine, uart);
+	uint64_t pacing = (uint64_t)machine->clock * uart->pacing / 1000000000;
+	return pacing > cycles ? pacing : cycles;
+}
+
+// Whether the baud rate of the firmware is too far off from that of the host
+// to receive characters: more than 3%, about what the sampling of a real UART
+// tolerates.
+static bool machine_uart_baud_mismatch(machine_t *machine, uart_t *uart) {
+	uint32_t baud = uart->baud, host = uart->host_baud;
+	if (baud == 0 || host == 0) {
+		return false;
+	}
+	uint32_t diff = baud > host ? baud - host : host - baud;
+	return (uint64_t)diff * 100 > (uint64_t)host * 3;
+}
+
+// Set the configuration of the UART that the firmware uses: its baud rate (0
+// if unknown), the bits of a character including the start and stop bits, RTS
+// and CTS flow control, and the depth of its FIFOs.
+static void machine_uart_configure(machine_t *machine, uart_t *uart, uint32_t baud, uint32_t frame_bits, bool rtsflow, bool ctsflow, uint32_t depth) {
+	uart->baud = baud;
+	uart->frame_bits = frame_bits;
+	uart->rtsflow = rtsflow;
+	uart->ctsflow = ctsflow;
+	uart->depth = depth;
+	if (machine_uart_baud_mismatch(machine, uart) && !uart->baud_warned) {
+		uart->baud_warned = true;
+		machine_log(machine, LOG_WARN, "UART baud rate %u does not match the host (%u), characters are received with framing errors\n", baud, uart->host_baud);
+	}
+}
+
+// Start receiving: characters that the host has ready arrive from now on.
+static void machine_uart_rx_enable(machine_t *machine, uart_t *uart) {
+	uart->rx_next = machine->stats.cycles;
+}
+
+// Move the characters that arrived from the host into the receive FIFO.
+// Without timing, a character arrives as soon as there is room for it. With
+// timing, one arrives every character time while the host has input: when the
+// FIFO is full it is lost (an overrun), unless RTS flow control makes the host
+// wait. With pacing, characters arrive at most once per pacing interval, but
+// without timing the host still waits for room in the FIFO.
+static void machine_uart_receive(machine_t *machine, uart_t *uart) {
+	uint64_t cycles = machine_uart_rx_cycles(machine, uart);
+	bool overrun = machine_uart_char_cycles(machine, uart) != 0 && !uart->rtsflow;
+	uint64_t now = machine->stats.cycles;
+	while (cycles == 0 || uart->rx_next <= now) {
+		if (!machine_uart_input_ready(machine, uart)) {
+			// The line is idle, so the next character can't arrive
+			// before now.
+			uart->rx_next = now;
+			return;
 		}
-	} else if (op == 0b0011) {
-		if (reg_src == &machine->pc) {
-			// MVN
-			*reg_dst = ~value;
-		} else {
-			// ORN
-			*reg_dst = *reg_src | ~value;
+		bool full = uart->rx_len >= uart->depth;
+		if (full && !overrun) {
+			// RTS is deasserted, the host waits.
+			uart->rx_next = now;
+			return;
 		}
-	} else if (op == 0b0100) {
-		uint32_t result = *reg_src ^ value;
-		if (reg_dst == &machine->pc && setflags) {
-			// TEQ
-			machine->psr.n = (int32_t)result < 0;
-			machine->psr.z = result == 0;
-			setflags = false;
-		} else {
-			// EOR
-			*reg_dst = result;
+		uint32_t errors = uart->inject_errors;
+		uart->inject_errors = 0;
+		if (machine_uart_baud_mismatch(machine, uart)) {
+			errors |= UART_ERROR_FRAMING;
 		}
-	} else if (op == 0b1000) {
-		if (reg_dst == &machine->pc && setflags) {
-			// CMN
-			machine_instr_add(machine, *reg_src, value, true);
-			setflags = false;
-		} else {
-			// ADD
-			*reg_dst = machine_instr_add(machine, *reg_src, value, setflags);
+		uint8_t c = machine_uart_getchar(machine, uart);
+		uart->rx_next += cycles;
+		if (full) {
+			// The character is lost. The last character in the FIFO
+			// carries the overrun, like on the RP2040.
+			machine->stats.uart_overruns++;
+			uart->rx_overrun = true;
+			uart->errors |= UART_ERROR_OVERRUN;
+			uart->rx_errors[(uart->rx_head + uart->rx_len - 1) % MACHINE_UART_FIFO] |= UART_ERROR_OVERRUN;
+			continue;
 		}
-	} else if (op == 0b1010) {
-		// ADC
-		*reg_dst = machine_instr_adc(machine, *reg_src, value, setflags);
-	} else if (op == 0b1011) {
-		// SBC
-		*reg_dst = machine_instr_sbc(machine, *reg_src, value, setflags);
-	} else if (op == 0b1110) {
-		// RSB
-		*reg_dst = machine_instr_sub(machine, value, *reg_src, setflags);
-	} else if (op == 0b1101) {
-		if (reg_dst == &machine->pc && setflags) {
-			// CMP
-			machine_instr_sub(machine, *reg_src, value, true);
-			setflags = false;
-		} else {
-			// SUB
-			*reg_dst = machine_instr_sub(machine, *reg_src, value, setflags);
+		uint32_t index = (uart->rx_head + uart->rx_len) % MACHINE_UART_FIFO;
+		uart->rx_fifo[index] = c;
+		uart->rx_errors[index] = errors;
+		uart->rx_len++;
+		machine->stats.uart_rx_bytes++;
+		if (errors != 0) {
+			machine->stats.uart_rx_errors++;
+			uart->errors |= errors;
 		}
-	} else {
-		return ERR_UNDEFINED;
 	}
-	if (setflags) {
-		machine->psr.n = (int32_t)*reg_dst < 0;
-		machine->psr.z = *reg_dst == 0;
-	}
-	return ERR_OK;
 }
 
-static bool machine_is_32bit_instruction(uint16_t instruction) {
-	return ((instruction >> 11) == 0b11101 || (instruction >> 12) == 0b1111);
+// Whether a received character can be read. When reading from an input buffer
+// that is exhausted, the machine is stopped: the firmware would otherwise wait
+// forever.
+static bool machine_uart_rx_ready(machine_t *machine, uart_t *uart) {
+	machine_uart_receive(machine, uart);
+	if (uart->rx_len != 0) {
+		return true;
+	}
+	if (uart->input != NULL && uart->inject_len == 0 && uart->input_pos >= uart->input_len) {
+		machine->input_eof = true;
+	}
+	return false;
 }
 
-int machine_step(machine_t *machine) {
-	// Some handy aliases
-	uint32_t *pc = &machine->pc; // r15
-	uint32_t *lr = &machine->lr; // r14
-	uint32_t *sp = &machine->sp; // r13
+// Return the errors of the next character in the receive FIFO, UART_ERROR_*.
+static uint32_t machine_uart_rx_errors(machine_t *machine, uart_t *uart) {
+	return uart->rx_len != 0 ? uart->rx_errors[uart->rx_head] : 0;
+}
 
-	if (*pc - 1 == machine->hwbreak[0] ||
-		*pc - 1 == machine->hwbreak[1] ||
-		*pc - 1 == machine->hwbreak[2] ||
-		*pc - 1 == machine->hwbreak[3]) {
-		return ERR_BREAK;
+// Read a character from the receive FIFO, and return its errors in *errors.
+// Without timing, reading while the FIFO is empty waits for the terminal.
+static uint32_t machine_uart_read(machine_t *machine, uart_t *uart, uint32_t *errors) {
+	*errors = 0;
+	if (!machine_uart_rx_ready(machine, uart)) {
+		if (machine_uart_rx_cycles(machine, uart) != 0 || uart->input != NULL || !machine_uart_terminal(uart)) {
+			return 0;
+		}
+		if (uart->inject_len != 0) {
+			machine->stats.uart_rx_bytes++;
+			return machine_uart_getchar(machine, uart);
+		}
+		// Wait for the terminal, unless the machine is halted meanwhile. The
+		// load is then executed again when the machine continues, see
+		// machine_run_loop.
+		int c;
+		while ((c = terminal_getchar()) == TERMINAL_INTERRUPTED) {
+			if (machine_halt_requested(machine)) {
+				machine->interrupted = true;
+				memcpy(machine->interrupted_regs, machine->regs, sizeof(machine->regs));
+				return 0;
+			}
+		}
+		if (c < 0) {
+			// The input ended.
+			return 0;
+		}
+		machine->stats.uart_rx_bytes++;
+		machine_bus_traced(machine, BUS_UART_RECEIVE, uart->index, 0, c, true);
+		return c;
 	}
+	uint8_t c = uart->rx_fifo[uart->rx_head];
+	*errors = uart->rx_errors[uart->rx_head];
+	uart->rx_head = (uart->rx_head + 1) % MACHINE_UART_FIFO;
+	uart->rx_len--;
+	return c;
+}
 
-	if (*pc == 0xdeadbeef) {
-		return ERR_EXIT;
+// Whether the chip may send: CTS is asserted, or not used.
+static bool machine_uart_cts(machine_t *machine, uart_t *uart) {
+	return uart->cts || !uart->ctsflow;
+}
+
+// Send a character to the host, after the characters before it. While CTS is
+// deasserted it is held back instead, replacing a character held before.
+static void machine_uart_send(machine_t *machine, uart_t *uart, uint8_t c) {
+	if (!machine_uart_cts(machine, uart)) {
+		uart->tx_held = c;
+		return;
 	}
-	if (*pc > machine->image_size - 2) {
-		return ERR_PC;
+	uint64_t now = machine->stats.cycles;
+	uint64_t start = uart->tx_done > now ? uart->tx_done : now;
+	uart->tx_done = start + machine_uart_char_cycles(machine, uart);
+	machine_reschedule(machine, EVENT_UART);
+	machine->stats.uart_tx_bytes++;
+	machine_bus_traced(machine, BUS_UART_SEND, uart->index, c, 0, true);
+	if (uart->output != NULL) {
+		uart->output(machine, uart->index, c);
+	} else if (machine_uart_terminal(uart) && !uart->mute) {
+		terminal_putchar(c);
 	}
-	if ((*pc & 1) != 1) {
-		return ERR_PC;
+}
+
+// Return the number of characters that have not been sent completely yet,
+// including a character that is held back.
+static uint32_t machine_uart_tx_pending(machine_t *machine, uart_t *uart) {
+	uint64_t cycles = machine_uart_char_cycles(machine, uart);
+	uint64_t now = machine->stats.cycles;
+	uint32_t pending = uart->tx_held >= 0;
+	if (cycles != 0 && uart->tx_done > now) {
+		pending += (uart->tx_done - now + cycles - 1) / cycles;
 	}
-	uint16_t instruction = machine->image16[*pc/2];
+	return pending;
+}
 
-	// Increment PC to point to the next instruction.
-	*pc += 2;
+static int machine_transfer(machine_t *machine, uint32_t address, transfer_type_t transfer_type, uint32_t *reg, width_t width, bool signextend);
+static bool machine_add_stub_handler(machine_t *machine, uint32_t start, uint32_t end, stub_call_t handler);
 
-	bool inITBlock = machine_versioncheck(machine, CORTEX_M4) ? machine->psr.it2 != 0 : false;
+static const uint32_t nrf_uart_base[MACHINE_NUM_UARTS] = {0x40002000, 0x40028000};
+static const uint32_t nrf_uart_irq[MACHINE_NUM_UARTS] = {2, 40}; // UARTE1 can't be taken, see MACHINE_NUM_IRQS
+static const uint32_t nrf_rtc_base[3] = {0x4000b000, 0x40011000, 0x40024000};
+static const uint32_t nrf_rtc_irq[3] = {11, 17, 36}; // RTC2 can't be taken, see MACHINE_NUM_IRQS
+static const uint32_t nrf_timer_base[NRF_NUM_TIMERS] = {0x40008000, 0x40009000, 0x4000a000, 0x4001a000, 0x4001b000};
+static const uint32_t nrf_timer_irq[NRF_NUM_TIMERS] = {8, 9, 10, 26, 27};
+static const uint32_t nrf_timer_num_cc[NRF_NUM_TIMERS] = {4, 4, 4, 6, 6};
+static const uint32_t nrf_spi_base[4] = {0x40003000, 0x40004000, 0x40023000, 0x4002f000}; // the IRQ is bits 12..17
+static const uint32_t nrf_pwm_base[4] = {0x4001c000, 0x40021000, 0x40022000, 0x4002d000}; // the IRQ is bits 12..17
 
-	if (inITBlock) {
-		// Check whether we need to execute the following instruction.
-		uint32_t state = machine->psr.it1 | (machine->psr.it2 << 2);
-		uint32_t condition = state >> 4;
-		uint32_t newstate = (state & 0b11100000) | ((state << 1) & 0b11111);
-		if ((newstate & 0b1111) == 0) {
-			newstate = 0;
-		}
-		machine->psr.it1 = newstate & 0b11;
-		machine->psr.it2 = newstate >> 2;
-		int result = machine_condition(machine, condition);
-		if (result < 0) {
-			return ERR_UNDEFINED;
-		}
-		if (!result) {
-			// Don't do anything.
-			// We could also have changed instruction to a nop.
-			if (machine_is_32bit_instruction(instruction)) {
-				*pc += 2;
-			}
-			return ERR_OK;
-		} else {
-			// Continue.
+// Peripheral models of the built-in peripherals, see builtin_periph_t.
+enum {
+	BUILTIN_SCS,          // NVIC, SysTick and SCB, decoded in machine_transfer
+	BUILTIN_NRF_POWER,
+	BUILTIN_NRF_RADIO,
+	BUILTIN_NRF_UART,
+	BUILTIN_NRF_SPI,      // SPI, SPIM, TWI and TWIM
+	BUILTIN_NRF_GPIOTE,
+	BUILTIN_NRF_SAADC,
+	BUILTIN_NRF_TIMER,
+	BUILTIN_NRF_RTC,
+	BUILTIN_NRF_TEMP,
+	BUILTIN_NRF_RNG,
+	BUILTIN_NRF_ECB,
+	BUILTIN_NRF_CCM,
+	BUILTIN_NRF_EGU,
+	BUILTIN_NRF_PWM,
+	BUILTIN_NRF_PDM,
+	BUILTIN_NRF_NVMC,
+	BUILTIN_NRF_PPI,
+	BUILTIN_NRF_I2S,
+	BUILTIN_NRF_QSPI,
+	BUILTIN_NRF_GPIO,
+	BUILTIN_STM32_SPI,
+	BUILTIN_STM32_USART,
+	BUILTIN_STM32_I2C,
+	BUILTIN_STM32_CAN,
+	BUILTIN_STM32_PWR,
+	BUILTIN_STM32_AFIO,   // AFIO (F1)
+	BUILTIN_STM32_EXTI,
+	BUILTIN_STM32_GPIO_F1,
+	BUILTIN_STM32_USART1, // USART1 (F1) or SYSCFG (F4)
+	BUILTIN_STM32_RCC_F1,
+	BUILTIN_STM32_FLASH,
+	BUILTIN_STM32_GPIO_F4,
+	BUILTIN_STM32_CRC,
+	BUILTIN_STM32_RCC_F4,
+	BUILTIN_STM32_HASH,
+	BUILTIN_RP2040,       // registers of machine_rp2040_transfer
+	BUILTIN_RP2040_SIO,   // decoded in machine_transfer
+};
+
+static const builtin_periph_t nrf_peripherals[] = {
+	{0x40000000, 0x1000, BUILTIN_NRF_POWER, 0, "POWER, CLOCK"},
+	{0x40001000, 0x1000, BUILTIN_NRF_RADIO, 0, "RADIO"},
+	{0x40002000, 0x1000, BUILTIN_NRF_UART, 0, "UART0, UARTE0"},
+	{0x40003000, 0x1000, BUILTIN_NRF_SPI, 0, "SPI0, SPIM0, TWI0, TWIM0"},
+	{0x40004000, 0x1000, BUILTIN_NRF_SPI, 1, "SPI1, SPIM1, TWI1, TWIM1"},
+	{0x40006000, 0x1000, BUILTIN_NRF_GPIOTE, 0, "GPIOTE"},
+	{0x40007000, 0x1000, BUILTIN_NRF_SAADC, 0, "SAADC"},
+	{0x40008000, 0x1000, BUILTIN_NRF_TIMER, 0, "TIMER0"},
+	{0x40009000, 0x1000, BUILTIN_NRF_TIMER, 1, "TIMER1"},
+	{0x4000a000, 0x1000, BUILTIN_NRF_TIMER, 2, "TIMER2"},
+	{0x4000b000, 0x1000, BUILTIN_NRF_RTC, 0, "RTC0"},
+	{0x4000c000, 0x1000, BUILTIN_NRF_TEMP, 0, "TEMP"},
+	{0x4000d000, 0x1000, BUILTIN_NRF_RNG, 0, "RNG"},
+	{0x4000e000, 0x1000, BUILTIN_NRF_ECB, 0, "ECB"},
+	{0x4000f000, 0x1000, BUILTIN_NRF_CCM, 0, "CCM"},
+	{0x40011000, 0x1000, BUILTIN_NRF_RTC, 1, "RTC1"},
+	{0x40014000, 0x1000, BUILTIN_NRF_EGU, 0, "EGU0"},
+	{0x40015000, 0x1000, BUILTIN_NRF_EGU, 1, "EGU1"},
+	{0x40016000, 0x1000, BUILTIN_NRF_EGU, 2, "EGU2"},
+	{0x40017000, 0x1000, BUILTIN_NRF_EGU, 3, "EGU3"},
+	{0x40018000, 0x1000, BUILTIN_NRF_EGU, 4, "EGU4"},
+	{0x40019000, 0x1000, BUILTIN_NRF_EGU, 5, "EGU5"},
+	{0x4001a000, 0x1000, BUILTIN_NRF_TIMER, 3, "TIMER3"},
+	{0x4001b000, 0x1000, BUILTIN_NRF_TIMER, 4, "TIMER4"},
+	{0x4001c000, 0x1000, BUILTIN_NRF_PWM, 0, "PWM0"},
+	{0x4001d000, 0x1000, BUILTIN_NRF_PDM, 0, "PDM"},
+	{0x4001e000, 0x1000, BUILTIN_NRF_NVMC, 0, "NVMC"},
+	{0x4001f000, 0x1000, BUILTIN_NRF_PPI, 0, "PPI"},
+	{0x40021000, 0x1000, BUILTIN_NRF_PWM, 1, "PWM1"},
+	{0x40022000, 0x1000, BUILTIN_NRF_PWM, 2, "PWM2"},
+	{0x40023000, 0x1000, BUILTIN_NRF_SPI, 2, "SPI2, SPIM2"},
+	{0x40024000, 0x1000, BUILTIN_NRF_RTC, 2, "RTC2"},
+	{0x40025000, 0x1000, BUILTIN_NRF_I2S, 0, "I2S"},
+	{0x40028000, 0x1000, BUILTIN_NRF_UART, 1, "UARTE1"},
+	{0x40029000, 0x1000, BUILTIN_NRF_QSPI, 0, "QSPI"},
+	{0x4002d000, 0x1000, BUILTIN_NRF_PWM, 3, "PWM3"},
+	{0x4002f000, 0x1000, BUILTIN_NRF_SPI, 3, "SPIM3"},
+	{0x50000000, 0x1000, BUILTIN_NRF_GPIO, 0, "P0, P1"},
+	{0xe000e000, 0x1000, BUILTIN_SCS, 0, "NVIC, SysTick and SCB"},
+};
+
+// The F1 and F4 are mostly compatible, but place some peripherals elsewhere.
+// The first match is used.
+static const builtin_periph_t stm32_peripherals[] = {
+	{0x40003800, 0x400, BUILTIN_STM32_SPI, 1, "SPI2"},
+	{0x40003c00, 0x400, BUILTIN_STM32_SPI, 2, "SPI3"},
+	{0x40004400, 0x400, BUILTIN_STM32_USART, 1, "USART2"},
+	{0x40005400, 0x400, BUILTIN_STM32_I2C, 0, "I2C1"},
+	{0x40005800, 0x400, BUILTIN_STM32_I2C, 1, "I2C2"},
+	{0x40005c00, 0x400, BUILTIN_STM32_I2C, 2, "I2C3"},
+	{0x40006400, 0x400, BUILTIN_STM32_CAN, 0, "CAN1"},
+	{0x40007000, 0x400, BUILTIN_STM32_PWR, 0, "PWR"},
+	{0x40010000, 0x400, BUILTIN_STM32_AFIO, 0, "AFIO (F1)"},
+	{0x40010400, 0x400, BUILTIN_STM32_EXTI, 0, "EXTI (F1)"},
+	{0x40011000, 0x400, BUILTIN_STM32_USART, 0, "USART1 (F4)"},
+	{0x40010800, 0x1c00, BUILTIN_STM32_GPIO_F1, 0, "GPIOA..GPIOG (F1)"},
+	{0x40013000, 0x400, BUILTIN_STM32_SPI, 0, "SPI1"},
+	{0x40013800, 0x400, BUILTIN_STM32_USART1, 0, "USART1 (F1), SYSCFG (F4)"},
+	{0x40013c00, 0x400, BUILTIN_STM32_EXTI, 0, "EXTI (F4)"},
+	{0x40020000, 0x2c00, BUILTIN_STM32_GPIO_F4, 0, "GPIOA..GPIOK (F4)"},
+	{0x40021000, 0x400, BUILTIN_STM32_RCC_F1, 0, "RCC (F1)"},
+	{0x40022000, 0x400, BUILTIN_STM32_FLASH, 0, "FLASH (F1)"},
+	{0x40023000, 0x400, BUILTIN_STM32_CRC, 0, "CRC"},
+	{0x40023800, 0x400, BUILTIN_STM32_RCC_F4, 0, "RCC (F4)"},
+	{0x40023c00, 0x400, BUILTIN_STM32_FLASH, 1, "FLASH (F4)"},
+	{0x50060400, 0x400, BUILTIN_STM32_HASH, 0, "HASH (F4)"},
+	{0xe000e000, 0x1000, BUILTIN_SCS, 0, "NVIC, SysTick and SCB"},
+};
+
+// The registers of other peripherals are stored as well, but they don't do
+// anything and are reported as unknown.
+static const builtin_periph_t rp2040_peripherals[] = {
+	{0x40000000, 0x4000, BUILTIN_RP2040, 0, "SYSINFO, SYSCFG"},
+	{0x40008000, 0x1c000, BUILTIN_RP2040, 0, "CLOCKS, RESETS, PSM, IO_BANK0, IO_QSPI, PADS_BANK0, PADS_QSPI, XOSC, PLL_SYS, PLL_USB"},
+	{0x40034000, 0x8000, BUILTIN_RP2040, 0, "UART0, UART1"},
+	{0x4003c000, 0x8000, BUILTIN_RP2040, 0, "SPI0, SPI1"},
+	{0x40044000, 0x8000, BUILTIN_RP2040, 0, "I2C0, I2C1"},
+	{0x40054000, 0x8000, BUILTIN_RP2040, 0, "TIMER, WATCHDOG"},
+	{0x40060000, 0x4000, BUILTIN_RP2040, 0, "ROSC"},
+	{0xd0000000, 0x1000, BUILTIN_RP2040_SIO, 0, "SIO"},
+	{0xe000e000, 0x1000, BUILTIN_SCS, 0, "NVIC, SysTick and SCB"},
+};
+
+// Return the table of the built-in peripherals of a family and its length.
+KEEPALIVE
+size_t machine_builtin_peripherals(family_t family, const builtin_periph_t **periphs) {
+	switch (family) {
+	case FAMILY_STM32:
+		*periphs = stm32_peripherals;
+		return sizeof(stm32_peripherals) / sizeof(stm32_peripherals[0]);
+	case FAMILY_RP2040:
+		*periphs = rp2040_peripherals;
+		return sizeof(rp2040_peripherals) / sizeof(rp2040_peripherals[0]);
+	default:
+		*periphs = nrf_peripherals;
+		return sizeof(nrf_peripherals) / sizeof(nrf_peripherals[0]);
+	}
+}
+
+// Find the built-in peripheral at an address in a table, or return NULL if
+// there is none.
+static const builtin_periph_t *builtin_periph_find(const builtin_periph_t *periphs, size_t n, uint32_t address) {
+	for (size_t i = 0; i < n; i++) {
+		if (address - periphs[i].start < periphs[i].size) {
+			return &periphs[i];
 		}
 	}
+	return NULL;
+}
 
-	// Decode/execute instruction
+// Find the built-in peripheral of the family of the machine at an address.
+static const builtin_periph_t *machine_find_peripheral(machine_t *machine, uint32_t address) {
+	const builtin_periph_t *periphs;
+	size_t n = machine_builtin_peripherals(machine->family, &periphs);
+	return builtin_periph_find(periphs, n, address);
+}
 
-	if ((instruction >> 13) == 0b000) {
-		uint32_t *reg_dst = &machine->regs[(instruction >> 0) & 0b111];
-		uint32_t *reg_src = &machine->regs[(instruction >> 3) & 0b111];
-		uint32_t op       = (instruction >> 11)  & 0b11;
-		bool setflags = !inITBlock;
-		if (op != 3) {
-			// Format 1: move shifted register
-			uint32_t offset5 = (instruction >> 6) & 0x1f;
-			if (op == 0) { // LSLS
-				*reg_dst = machine_instr_lsl(machine, *reg_src, offset5, setflags);
-			} else if (op == 1) { // LSRS
-				*reg_dst = machine_instr_lsr(machine, *reg_src, offset5 == 0 ? 32 : offset5, setflags);
-			} else if (op == 2) { // ASRS
-				*reg_dst = machine_instr_asr(machine, *reg_src, offset5 == 0 ? 32 : offset5, setflags);
-			}
-		} else { // op == 3
-			// Format 2: add/subtract
-			uint32_t value    = (instruction >> 6)  & 0b111;
-			uint32_t op       = (instruction >> 9)  & 0b1;
-			bool     flag_imm = (instruction >> 10) & 0b1;
-			if (!flag_imm) {
-				value = machine->regs[value];
-			}
-			if (op == 0) { // ADDS
-				*reg_dst = machine_instr_add(machine, *reg_src, value, setflags);
-			} else { // SUBS
-				*reg_dst = machine_instr_sub(machine, *reg_src, value, setflags);
-			}
+// Event and task endpoints of the pre-programmed PPI channels 20..31.
+static const uint32_t nrf_ppi_fixed[32 - NRF_PPI_CHANNELS][2] = {
+	{0x40008140, 0x40001000}, // TIMER0 COMPARE[0] -> RADIO TXEN
+	{0x40008140, 0x40001004}, // TIMER0 COMPARE[0] -> RADIO RXEN
+	{0x40008144, 0x40001010}, // TIMER0 COMPARE[1] -> RADIO DISABLE
+	{0x40001128, 0x4000f000}, // RADIO BCMATCH -> AAR START
+	{0x40001100, 0x4000f000}, // RADIO READY -> CCM KSGEN
+	{0x40001104, 0x4000f004}, // RADIO ADDRESS -> CCM CRYPT
+	{0x40001104, 0x40008044}, // RADIO ADDRESS -> TIMER0 CAPTURE[1]
+	{0x4000110c, 0x40008048}, // RADIO END -> TIMER0 CAPTURE[2]
+	{0x4000b140, 0x40001000}, // RTC0 COMPARE[0] -> RADIO TXEN
+	{0x4000b140, 0x40001004}, // RTC0 COMPARE[0] -> RADIO RXEN
+	{0x4000b140, 0x4000800c}, // RTC0 COMPARE[0] -> TIMER0 CLEAR
+	{0x4000b140, 0x40008000}, // RTC0 COMPARE[0] -> TIMER0 START
+};
+
+// Events of the RADIO peripheral.
+enum {
+	RADIO_EVENT_READY    = 0,
+	RADIO_EVENT_ADDRESS  = 1,
+	RADIO_EVENT_PAYLOAD  = 2,
+	RADIO_EVENT_END      = 3,
+	RADIO_EVENT_DISABLED = 4,
+	RADIO_EVENT_TXREADY  = 21,
+	RADIO_EVENT_RXREADY  = 22,
+};
+
+// Trigger the task at the given address, as if the CPU wrote 1 to it.
+static void machine_nrf_task(machine_t *machine, uint32_t address) {
+	uint32_t value = 1;
+	uint32_t transfer_address = machine->transfer_address;
+	periph_trace_t trace = machine->periph_trace;
+	machine->periph_trace = NULL; // not an access of the CPU
+	machine_transfer(machine, address, STORE, &value, WIDTH_32, false);
+	machine->periph_trace = trace;
+	machine->transfer_address = transfer_address;
+}
+
+// Trigger the tasks that are connected to the event at the given address
+// through an enabled PPI channel.
+static void machine_ppi_event(machine_t *machine, uint32_t address) {
+	if (machine->nrf.ppi.chen == 0 || machine->nrf.ppi_depth >= 8) {
+		return; // the depth limit breaks loops of channels
+	}
+	machine->nrf.ppi_depth++;
+	for (int ch = 0; ch < 32; ch++) {
+		if (!(machine->nrf.ppi.chen & (1u << ch))) {
+			continue;
 		}
-		if (setflags) {
-			machine->psr.n = (int32_t)*reg_dst < 0;
-			machine->psr.z = *reg_dst == 0;
+		uint32_t eep, tep;
+		if (ch < NRF_PPI_CHANNELS) {
+			eep = machine->nrf.ppi.eep[ch];
+			tep = machine->nrf.ppi.tep[ch];
+		} else {
+			eep = nrf_ppi_fixed[ch - NRF_PPI_CHANNELS][0];
+			tep = nrf_ppi_fixed[ch - NRF_PPI_CHANNELS][1];
 		}
+		if (eep != address) {
+			continue;
+		}
+		if (tep != 0) {
+			machine_nrf_task(machine, tep);
+		}
+		if (machine->nrf.ppi.fork_tep[ch] != 0) {
+			machine_nrf_task(machine, machine->nrf.ppi.fork_tep[ch]);
+		}
+	}
+	machine->nrf.ppi_depth--;
+}
 
-	} else if ((instruction >> 13) == 0b001) {
-		// Format 3: move/compare/add/subtract immediate
-		uint32_t  imm  = instruction & 0xff;
-		uint32_t *reg = &machine->regs[(instruction >> 8)  & 0b111];
-		size_t   op   = (instruction >> 11) & 0b11;
-		bool setflags = !inITBlock;
-		if (op == 0) { // MOVS
-			*reg = imm;
-		} else if (op == 1) { // CMP
-			// Update flags as if doing *reg - imm
-			machine_instr_sub(machine, *reg, imm, true);
-			setflags = false;
-			// Don't update *reg
-		} else if (op == 2) { // ADDS
-			*reg = machine_instr_add(machine, *reg, imm, setflags);
-		} else if (op == 3) { // SUBS
-			*reg = machine_instr_sub(machine, *reg, imm, setflags);
+// Generate event n of the peripheral at the given base address: set its
+// EVENTS register, pend the interrupt if it is enabled and trigger the tasks
+// connected to it.
+static void machine_nrf_event(machine_t *machine, nrf_periph_t *periph, uint32_t base, uint32_t irq, int n) {
+	periph->events |= 1u << n;
+	if (periph->inten & (1u << n)) {
+		machine_pend_irq(machine, irq);
+	}
+	machine_ppi_event(machine, base + 0x100 + 4 * n);
+}
+
+// Access one of the registers that all nRF peripherals have: EVENTS_*, SHORTS
+// and INTEN/INTENSET/INTENCLR. It returns false for other registers.
+static bool machine_nrf_common(machine_t *machine, nrf_periph_t *periph, uint32_t irq, uint32_t offset, transfer_type_t transfer_type, uint32_t *value) {
+	if (offset >= 0x100 && offset < 0x180) { // EVENTS_*
+		uint32_t bit = 1u << ((offset - 0x100) / 4);
+		if (transfer_type == LOAD) {
+			*value = (periph->events & bit) != 0;
+		} else if (*value & 1) {
+			periph->events |= bit;
+		} else {
+			periph->events &= ~bit;
 		}
-		if (setflags) {
-			machine->psr.n = (int32_t)*reg < 0;
-			machine->psr.z = *reg == 0;
+	} else if (offset == 0x200) { // SHORTS
+		if (transfer_type == LOAD) {
+			*value = periph->shorts;
+		} else {
+			periph->shorts = *value;
+		}
+	} else if (offset == 0x300 || offset == 0x304 || offset == 0x308) { // INTEN, INTENSET, INTENCLR
+		if (transfer_type == LOAD) {
+			*value = periph->inten;
+			return true;
+		}
+		if (offset == 0x300) {
+			periph->inten = *value;
+		} else if (offset == 0x304) {
+			periph->inten |= *value;
+		} else {
+			periph->inten &= ~*value;
 		}
+		if (periph->events & periph->inten) {
+			// The interrupt line is high as long as an enabled event is set.
+			machine_pend_irq(machine, irq);
+		}
+	} else {
+		return false;
+	}
+	return true;
+}
 
-	} else if ((instruction >> 10) == 0b010000) {
-		// Format 4: ALU operations
-		uint32_t *reg_dst = &machine->regs[(instruction >> 0) & 0b111];
-		uint32_t *reg_src = &machine->regs[(instruction >> 3) & 0b111];
-		uint32_t op       = (instruction >> 6) & 0b1111;
-		bool setflags = !inITBlock;
-		if (op == 0b0000) { // ANDS
-			*reg_dst &= *reg_src;
-		} else if (op == 0b0001) { // EORS
-			*reg_dst ^= *reg_src;
-		} else if (op == 0b0010) { // LSLS
-			*reg_dst = machine_instr_lsl(machine, *reg_dst, *reg_src & 0xff, setflags);
-		} else if (op == 0b0011) { // LSRS
-			*reg_dst = machine_instr_lsr(machine, *reg_dst, *reg_src & 0xff, setflags);
-		} else if (op == 0b0100) { // ASRS
-			*reg_dst = machine_instr_asr(machine, *reg_dst, *reg_src & 0xff, setflags);
-		} else if (op == 0b0101) { // ADCS
-			*reg_dst = machine_instr_adc(machine, *reg_dst, *reg_src, setflags);
-		} else if (op == 0b0110) { // SBCS
-			*reg_dst = machine_instr_sbc(machine, *reg_dst, *reg_src, setflags);
-		} else if (op == 0b1000) { // TST
-			// set CC on Rd AND Rs
-			machine->psr.n = (int32_t)(*reg_src & *reg_dst) < 0;
-			machine->psr.z = (int32_t)(*reg_src & *reg_dst) == 0;
-			setflags = false;
-		} else if (op == 0b1001) { // NEG / RSBS
-			*reg_dst = machine_instr_sub(machine, 0, *reg_src, setflags);
-		} else if (op == 0b1010) { // CMP
-			// set CC on Rd - Rs
-			machine_instr_sub(machine, *reg_dst, *reg_src, true);
-			setflags = false;
-		} else if (op == 0b1011) { // CMN
-			// set cc on Rd + Rs
-			machine_instr_add(machine, *reg_dst, *reg_src, true);
-			setflags = false;
-		} else if (op == 0b1100) { // ORRS
-			// does not update C or V
-			*reg_dst |= *reg_src;
-		} else if (op == 0b1101) { // MULS
-			// does not update C or V
-			*reg_dst *= *reg_src;
-		} else if (op == 0b1110) { // BICS
-			// does not update C or V
-			*reg_dst &= ~*reg_src;
-		} else if (op == 0b1111) { // MVNS
-			// does not update C or V
-			*reg_dst = ~*reg_src;
+// Report an EasyDMA buffer that isn't in RAM. EasyDMA can only access RAM, so
+// on a real chip the transfer fails or corrupts memory, as happens with a
+// constant string in flash. The transfer is done anyway.
+static void machine_dma_check(machine_t *machine, const char *name, uint32_t ptr, uint32_t length) {
+	if (length != 0 && (ptr < 0x20000000 || ptr - 0x20000000 + length > machine->mem_size)) {
+		machine_log(machine, LOG_ERROR, "%s buffer at 0x%08x is not in RAM, which EasyDMA can't access (PC: %x)\n", name, ptr, machine->pc - 3);
+	}
+}
+
+// Return the first counter value after last (both not wrapped) at which a
+// counter of the given number of bits equals cc.
+static uint64_t machine_counter_next(uint64_t last, uint32_t cc, uint32_t bits) {
+	uint64_t period = (uint64_t)1 << bits;
+	uint64_t next = last - last % period + (cc & (period - 1));
+	if (next <= last) {
+		next += period;
+	}
+	return next;
+}
+
+// Return the offset in flash of a code address, which is in flash or in its
+// alias at 0 (or, on the RP2040, in one of the XIP aliases). The result is at
+// least image_size for other addresses.
+static inline uint32_t machine_code_offset(machine_t *machine, uint32_t address) {
+	if (machine->family == FAMILY_RP2040) {
+		if ((address & 0xfc000000) == 0x10000000 && (address & 0xffffff) < machine->image_size) {
+			return address & 0xffffff;
+		}
+		return 0xffffffff; // the boot ROM is at 0
+	}
+	if (address - machine->flash_base < machine->image_size) {
+		return address - machine->flash_base;
+	}
+	return address;
+}
+
+// Return the offset in the external flash of an address in the XIP area of
+// the nRF52840 QSPI peripheral, at 0x12000000. The flash is only mapped there
+// while QSPI is enabled, with an offset of XIPOFFSET. It returns false if the
+// address isn't mapped.
+static bool machine_qspi_xip_offset(machine_t *machine, uint32_t address, uint32_t *offset) {
+	if (address - 0x12000000 >= 0x08000000 || machine->qspi_flash.size == 0 || machine->family != FAMILY_NRF || !(machine->nrf.qspi.regs[0] & 1)) {
+		return false;
+	}
+	*offset = (address - 0x12000000 + machine->nrf.qspi.regs[(0x540 - 0x500) / 4]) % machine->qspi_flash.size;
+	return true;
+}
+
+// Return the instruction halfword at the given code address.
+static inline uint16_t machine_fetch16(machine_t *machine, uint32_t address) {
+	if ((address >> 29) == 1) {
+		// Code in RAM, see machine_check_execute.
+		uint32_t offset = address & 0x1fffffff;
+		return offset < machine->mem_size ? machine->mem16[offset / 2] : 0;
+	}
+	uint32_t offset;
+	if (machine_qspi_xip_offset(machine, address, &offset)) {
+		// Code in external flash, see machine_check_execute.
+		offset &= ~1u;
+		if (offset + 2 > machine->qspi_flash.size) {
+			return 0xffff;
+		}
+		return machine->qspi_flash.data[offset] | machine->qspi_flash.data[offset + 1] << 8;
+	}
+	return machine->image16[machine_code_offset(machine, address) / 2];
+}
+
+// Return the current counter value of an RTC, without wrapping at 24 bits.
+static uint64_t machine_rtc_value(machine_t *machine, rtc_t *rtc) {
+	if (!rtc->running) {
+		return rtc->counter;
+	}
+	uint64_t ticks = machine_ticks(machine, 32768) - rtc->start_ticks;
+	return rtc->counter + ticks / (rtc->prescaler + 1);
+}
+
+// Set the counter of an RTC.
+static void machine_rtc_set(machine_t *machine, rtc_t *rtc, uint32_t counter) {
+	rtc->counter = counter;
+	rtc->start_ticks = machine_ticks(machine, 32768);
+	rtc->last = counter;
+}
+
+// Generate the TICK, OVRFLW and COMPARE events of an RTC for the time that
+// passed since the last update.
+static void machine_rtc_update(machine_t *machine, int index) {
+	rtc_t *rtc = &machine->rtc[index];
+	if (!rtc->running) {
+		return;
+	}
+	uint64_t now = machine_rtc_value(machine, rtc);
+	uint64_t last = rtc->last;
+	if (now <= last) {
+		return;
+	}
+	rtc->last = now;
+	if ((rtc->periph.inten | rtc->evten) & 1) {
+		machine_nrf_event(machine, &rtc->periph, nrf_rtc_base[index], nrf_rtc_irq[index], 0); // TICK
+	}
+	if ((now >> 24) != (last >> 24)) {
+		machine_nrf_event(machine, &rtc->periph, nrf_rtc_base[index], nrf_rtc_irq[index], 1); // OVRFLW
+	}
+	for (int n = 0; n < 4; n++) {
+		if (machine_counter_next(last, rtc->cc[n], 24) <= now) {
+			machine_nrf_event(machine, &rtc->periph, nrf_rtc_base[index], nrf_rtc_irq[index], 16 + n); // COMPARE[n]
+		}
+	}
+}
+
+// Access a register of one of the nRF RTC peripherals.
+static uint32_t machine_rtc_transfer(machine_t *machine, int index, uint32_t offset, transfer_type_t transfer_type, uint32_t value) {
+	rtc_t *rtc = &machine->rtc[index];
+	machine_rtc_update(machine, index);
+	if (machine_nrf_common(machine, &rtc->periph, nrf_rtc_irq[index], offset, transfer_type, &value)) {
+		return value;
+	}
+	if (transfer_type == STORE && offset == 0x000) { // TASKS_START
+		if (!rtc->running) {
+			rtc->running = true;
+			machine_rtc_set(machine, rtc, rtc->counter);
+		}
+	} else if (transfer_type == STORE && offset == 0x004) { // TASKS_STOP
+		rtc->counter = machine_rtc_value(machine, rtc) & 0xffffff;
+		rtc->last = rtc->counter;
+		rtc->running = false;
+	} else if (transfer_type == STORE && offset == 0x008) { // TASKS_CLEAR
+		machine_rtc_set(machine, rtc, 0);
+	} else if (transfer_type == STORE && offset == 0x00c) { // TASKS_TRIGOVRFLW
+		machine_rtc_set(machine, rtc, 0xfffff0);
+	} else if (offset == 0x340 || offset == 0x344 || offset == 0x348) { // EVTEN, EVTENSET, EVTENCLR
+		if (transfer_type == LOAD) {
+			return rtc->evten;
+		}
+		if (offset == 0x340) {
+			rtc->evten = value;
+		} else if (offset == 0x344) {
+			rtc->evten |= value;
 		} else {
-			// The only missing ALU op is ROR.
-			return ERR_UNDEFINED;
+			rtc->evten &= ~value;
 		}
-		if (setflags) {
-			machine->psr.n = (int32_t)*reg_dst < 0;
-			machine->psr.z = *reg_dst == 0;
+	} else if (offset == 0x504) { // COUNTER
+		return machine_rtc_value(machine, rtc) & 0xffffff;
+	} else if (offset == 0x508) { // PRESCALER
+		if (transfer_type == STORE) {
+			machine_rtc_set(machine, rtc, machine_rtc_value(machine, rtc) & 0xffffff);
+			rtc->prescaler = value & 0xfff;
 		}
+		return rtc->prescaler;
+	} else if (offset >= 0x540 && offset < 0x550) { // CC[n]
+		uint32_t *cc = &rtc->cc[(offset - 0x540) / 4];
+		if (transfer_type == STORE) {
+			*cc = value & 0xffffff;
+		}
+		return *cc;
+	} else {
+		machine_log(machine, LOG_WARN, "unknown RTC %s at offset 0x%03x (PC: %x)\n", transfer_type == LOAD ? "load" : "store", offset, machine->pc - 3);
+	}
+	return 0;
+}
 
-	} else if ((instruction >> 10) == 0b010001) {
-		// Format 5: Hi register operations/branch exchange
-		uint32_t *reg_dst = &machine->regs[(instruction >> 0) & 0b111];
-		uint32_t *reg_src = &machine->regs[(instruction >> 3) & 0b111];
-		bool     h2       = (instruction >> 6) & 0b1;
-		bool     h1       = (instruction >> 7) & 0b1;
-		uint32_t op       = (instruction >> 8) & 0b11;
-		reg_src += h2 * 8; // make high register (if h2 is 1)
-		if (op == 3) { // BX/BLX
-			if (reg_dst != &machine->r0) {
-				return ERR_UNDEFINED; // unimplemented
+static uint32_t machine_timer_bits(nrf_timer_t *timer) {
+	static const uint32_t bits[4] = {16, 8, 24, 32};
+	return bits[timer->bitmode & 3];
+}
+
+// Return the current counter value of a TIMER, without wrapping. In counter
+// mode it only changes with TASKS_COUNT.
+static uint64_t machine_timer_value(machine_t *machine, nrf_timer_t *timer) {
+	if (!timer->running || timer->mode != 0) {
+		return timer->counter;
+	}
+	return timer->counter + machine_ticks(machine, 16000000 >> timer->prescaler) - timer->start_ticks;
+}
+
+// Set the counter of a TIMER.
+static void machine_timer_set(machine_t *machine, nrf_timer_t *timer, uint64_t counter) {
+	timer->counter = counter;
+	timer->start_ticks = machine_ticks(machine, 16000000 >> timer->prescaler);
+	timer->last = counter;
+}
+
+// Generate the COMPARE events of a TIMER for the time that passed since the
+// last update, handling the shortcuts that clear or stop the timer on a match.
+static void machine_timer_update(machine_t *machine, int index) {
+	nrf_timer_t *timer = &machine->nrf.timer[index];
+	uint32_t bits = machine_timer_bits(timer);
+	// Limit the number of matches handled at once: a timer that is cleared on
+	// a match could otherwise keep the emulator busy for a long time.
+	for (int i = 0; i < 16 && timer->running; i++) {
+		uint64_t now = machine_timer_value(machine, timer);
+		uint64_t last = timer->last;
+		uint64_t first = now + 1;
+		for (uint32_t n = 0; n < nrf_timer_num_cc[index]; n++) {
+			uint64_t next = machine_counter_next(last, timer->cc[n], bits);
+			if (next < first) {
+				first = next;
 			}
-			if (h1) {
-				machine_log(machine, LOG_CALLS, "%*sBLX r%ld %6x (sp: %x) -> %x\n", machine->call_depth * 2, "", reg_src - machine->regs, *pc - 3, *sp, *reg_src - 1);
-				machine_add_backtrace(machine, *pc - 3, *sp);
-			} else if (reg_src == lr) {
-				machine_log(machine, LOG_CALLS, "%*sBX lr %6x (sp: %x) <- %x\n", machine->call_depth * 2, "", *pc - 3, *sp, *reg_src - 1);
+		}
+		if (first > now) {
+			timer->last = now;
+			return;
+		}
+		timer->last = first;
+		bool clear = false, stop = false;
+		for (uint32_t n = 0; n < nrf_timer_num_cc[index]; n++) {
+			if (machine_counter_next(last, timer->cc[n], bits) != first) {
+				continue;
 			}
-			uint32_t next_lr = *pc;
-			*pc = *reg_src;
-			if (h1) { // BLX
-				*lr = next_lr;
+			machine_nrf_event(machine, &timer->periph, nrf_timer_base[index], nrf_timer_irq[index], 16 + n); // COMPARE[n]
+			clear |= (timer->periph.shorts & (1u << n)) != 0;
+			stop |= (timer->periph.shorts & (1u << (n + 8))) != 0;
+		}
+		if (timer->last != first) {
+			// A task triggered through the PPI changed the timer.
+			continue;
+		}
+		if (stop) {
+			timer->counter = first & (((uint64_t)1 << bits) - 1);
+			timer->last = timer->counter;
+			timer->running = false;
+		} else if (clear) {
+			// The timer was cleared when it matched, not now.
+			if (timer->mode == 0) {
+				timer->start_ticks += first - timer->counter;
 			}
-		} else { // ALU operation with high registers
-			reg_dst += h1 * 8; // make high register (if h1 is 1)
-			if (op == 0) { // ADD
-				*reg_dst += *reg_src;
-			} else if (op == 1) { // CMP
-				// set CC on Rd - Rs
-				machine_instr_sub(machine, *reg_dst, *reg_src, true);
-			} else if (op == 2) { // MOV
-				*reg_dst = *reg_src;
-				if (reg_dst == pc) {
-					*reg_dst |= 1; // force T-bit to 1
-				}
+			timer->counter = 0;
+			timer->last = 0;
+		}
+	}
+}
+
+// Access a register of one of the nRF TIMER peripherals.
+static uint32_t machine_timer_transfer(machine_t *machine, int index, uint32_t offset, transfer_type_t transfer_type, uint32_t value) {
+	nrf_timer_t *timer = &machine->nrf.timer[index];
+	uint32_t num_cc = nrf_timer_num_cc[index];
+	machine_timer_update(machine, index);
+	if (machine_nrf_common(machine, &timer->periph, nrf_timer_irq[index], offset, transfer_type, &value)) {
+		return value;
+	}
+	if (transfer_type == STORE && offset == 0x000) { // TASKS_START
+		if (!timer->running) {
+			timer->running = true;
+			machine_timer_set(machine, timer, timer->counter);
+		}
+	} else if (transfer_type == STORE && offset == 0x004) { // TASKS_STOP
+		timer->counter = machine_timer_value(machine, timer);
+		timer->last = timer->counter;
+		timer->running = false;
+	} else if (transfer_type == STORE && offset == 0x008) { // TASKS_COUNT
+		if (timer->running && timer->mode != 0) {
+			timer->counter++;
+			machine_timer_update(machine, index);
+		}
+	} else if (transfer_type == STORE && offset == 0x00c) { // TASKS_CLEAR
+		machine_timer_set(machine, timer, 0);
+	} else if (transfer_type == STORE && offset == 0x010) { // TASKS_SHUTDOWN
+		timer->running = false;
+		timer->counter = 0;
+		timer->last = 0;
+	} else if (transfer_type == STORE && offset >= 0x040 && offset < 0x040 + 4 * num_cc) { // TASKS_CAPTURE[n]
+		timer->cc[(offset - 0x040) / 4] = machine_timer_value(machine, timer) & (((uint64_t)1 << machine_timer_bits(timer)) - 1);
+	} else if (offset == 0x504) { // MODE
+		if (transfer_type == STORE) {
+			timer->mode = value & 3;
+		}
+		return timer->mode;
+	} else if (offset == 0x508) { // BITMODE
+		if (transfer_type == STORE) {
+			timer->bitmode = value & 3;
+		}
+		return timer->bitmode;
+	} else if (offset == 0x510) { // PRESCALER
+		if (transfer_type == STORE) {
+			uint64_t counter = machine_timer_value(machine, timer);
+			timer->prescaler = value & 0xf;
+			if (timer->prescaler > 9) {
+				timer->prescaler = 9;
 			}
+			machine_timer_set(machine, timer, counter);
+		}
+		return timer->prescaler;
+	} else if (offset >= 0x540 && offset < 0x540 + 4 * num_cc) { // CC[n]
+		uint32_t *cc = &timer->cc[(offset - 0x540) / 4];
+		if (transfer_type == STORE) {
+			*cc = value;
 		}
+		return *cc;
+	} else {
+		machine_log(machine, LOG_WARN, "unknown TIMER %s at offset 0x%03x (PC: %x)\n", transfer_type == LOAD ? "load" : "store", offset, machine->pc - 3);
+	}
+	return 0;
+}
 
-	} else if ((instruction >> 11) == 0b01001) {
-		// Format 6: PC-relative load
-		uint32_t imm = instruction & 0xff; // 8 bits
-		uint32_t *reg = &machine->regs[(instruction >> 8)  & 0b111];
-		uint32_t address = ((*pc + 2) & ~3UL) + imm * 4;
-		if (machine_transfer(machine, address, LOAD, reg, WIDTH_32, false)) {
-			return ERR_MEM;
+// Access a register of the POWER and CLOCK peripherals, which share the same
+// address range.
+static uint32_t machine_power_transfer(machine_t *machine, uint32_t offset, transfer_type_t transfer_type, uint32_t value) {
+	if (machine_nrf_common(machine, &machine->nrf.clock.periph, 0, offset, transfer_type, &value)) {
+		return value;
+	}
+	if (transfer_type == STORE && offset == 0x000) { // CLOCK.TASKS_HFCLKSTART
+		machine->nrf.clock.hfclk_running = true;
+		machine_nrf_event(machine, &machine->nrf.clock.periph, 0x40000000, 0, 0); // HFCLKSTARTED
+	} else if (transfer_type == STORE && offset == 0x004) { // CLOCK.TASKS_HFCLKSTOP
+		machine->nrf.clock.hfclk_running = false;
+	} else if (transfer_type == STORE && offset == 0x008) { // CLOCK.TASKS_LFCLKSTART
+		machine->nrf.clock.lfclk_running = true;
+		machine->nrf.clock.lfclksrccopy = machine->nrf.clock.lfclksrc;
+		machine_nrf_event(machine, &machine->nrf.clock.periph, 0x40000000, 0, 1); // LFCLKSTARTED
+	} else if (transfer_type == STORE && offset == 0x00c) { // CLOCK.TASKS_LFCLKSTOP
+		machine->nrf.clock.lfclk_running = false;
+	} else if (transfer_type == STORE && offset == 0x010) { // CLOCK.TASKS_CAL
+		machine_nrf_event(machine, &machine->nrf.clock.periph, 0x40000000, 0, 3); // DONE
+	} else if (transfer_type == LOAD && offset == 0x408) { // CLOCK.HFCLKRUN
+		return machine->nrf.clock.hfclk_running;
+	} else if (transfer_type == LOAD && offset == 0x40c) { // CLOCK.HFCLKSTAT
+		return machine->nrf.clock.hfclk_running ? (1 | 1 << 16) : 0;
+	} else if (transfer_type == LOAD && offset == 0x414) { // CLOCK.LFCLKRUN
+		return machine->nrf.clock.lfclk_running;
+	} else if (transfer_type == LOAD && offset == 0x418) { // CLOCK.LFCLKSTAT
+		return machine->nrf.clock.lfclk_running ? ((machine->nrf.clock.lfclksrccopy & 3) | 1 << 16) : 0;
+	} else if (transfer_type == LOAD && offset == 0x41c) { // CLOCK.LFCLKSRCCOPY
+		return machine->nrf.clock.lfclksrccopy;
+	} else if (offset == 0x400) { // POWER.RESETREAS
+		if (transfer_type == LOAD) {
+			return machine->power.resetreas;
+		}
+		machine->power.resetreas &= ~value; // write '1' to clear
+	} else if (offset == 0x51c || offset == 0x520) { // POWER.GPREGRET, POWER.GPREGRET2
+		uint32_t *gpregret = &machine->power.gpregret[(offset - 0x51c) / 4];
+		if (transfer_type == STORE) {
+			*gpregret = value & 0xff;
 		}
+		return *gpregret;
+	} else if (offset == 0x518) { // CLOCK.LFCLKSRC
+		if (transfer_type == STORE) {
+			machine->nrf.clock.lfclksrc = value;
+		}
+		return machine->nrf.clock.lfclksrc;
+	} else if (offset == 0x538 || offset == 0x540) { // CLOCK.CTIV, CLOCK.TRACECONFIG
+	} else {
+		machine_log(machine, LOG_WARN, "unknown POWER/CLOCK %s at offset 0x%03x (PC: %x)\n", transfer_type == LOAD ? "load" : "store", offset, machine->pc - 3);
+	}
+	return 0;
+}
 
-	} else if ((instruction >> 12) == 0b0101) {
-		uint32_t *reg_change = &machine->regs[(instruction >> 0) & 0b111];
-		uint32_t *reg_base   = &machine->regs[(instruction >> 3) & 0b111];
-		uint32_t *reg_offset = &machine->regs[(instruction >> 6) & 0b111];
-		if (((instruction >> 9) & 0b1) == 0) {
-			// Format 7: Load/store with register offset (LDR)
-			bool flag_byte = (instruction >> 10) & 0b1;
-			bool flag_load = (instruction >> 11) & 0b1;
-			transfer_type_t transfer_type = flag_load ? LOAD : STORE;
-			width_t width = flag_byte ? WIDTH_8 : WIDTH_32;
-			if (machine_transfer(machine, *reg_base + *reg_offset, transfer_type, reg_change, width, false)) {
-				return ERR_MEM;
-			}
-		} else {
-			// Format 8: Load/store sign-extended byte/halfword
-			bool flag_sign_extend = (instruction >> 10) & 0b1;
-			bool flag_H           = (instruction >> 11) & 0b1;
-			uint32_t address = *reg_base + *reg_offset;
-			if (flag_sign_extend) {
-				if (flag_H) {
-					if (machine_transfer(machine, address, LOAD, reg_change, WIDTH_16, true)) { // LDSH
-						return ERR_MEM;
-					}
-				} else {
-					if (machine_transfer(machine, address, LOAD, reg_change, WIDTH_8, true)) { // LDSB
-						return ERR_MEM;
-					}
-				}
-			} else {
-				transfer_type_t transfer_type = flag_H ? LOAD : STORE;
-				if (machine_transfer(machine, address, transfer_type, reg_change, WIDTH_16, false)) { // STRH/LDRH
-					return ERR_MEM;
-				}
-			}
-		}
+// Turn the UART power on while one of the UARTs receives or sends.
+static void machine_uart_nrf_power(machine_t *machine) {
+	bool on = false;
+	for (int i = 0; i < MACHINE_NUM_UARTS; i++) {
+		on = on || machine->uart[i].rx_started || machine->uart[i].tx_started;
+	}
+	machine_periph_power(machine, PERIPH_UART, on);
+}
 
-	} else if ((instruction >> 13) == 0b011) {
-		// Format 9: load/store with immediate offset
-		uint32_t *reg_change = &machine->regs[(instruction >> 0)  & 0b111];
-		uint32_t *reg_base   = &machine->regs[(instruction >> 3)  & 0b111];
-		uint32_t offset5     = (instruction >> 6) & 0x1f;
-		bool     flag_load   = (instruction >> 11) & 0b1;
-		bool     flag_byte   = (instruction >> 12) & 0b1;
-		transfer_type_t transfer_type = flag_load ? LOAD : STORE;
-		if (flag_byte) {
-			uint32_t address = *reg_base + offset5;
-			if (machine_transfer(machine, address, transfer_type, reg_change, WIDTH_8, false)) {
-				return ERR_MEM;
-			}
-		} else {
-			uint32_t address = *reg_base + offset5 * 4;
-			if (machine_transfer(machine, address, transfer_type, reg_change, WIDTH_32, false)) {
-				return ERR_MEM;
-			}
-		}
+// Report receive errors in ERRORSRC, with an ERROR event.
+static void machine_uart_nrf_errors(machine_t *machine, uart_t *uart) {
+	if (uart->errors == 0) {
+		return;
+	}
+	uart->errorsrc |= uart->errors;
+	uart->errors = 0;
+	machine_nrf_event(machine, &uart->periph, nrf_uart_base[uart->index], nrf_uart_irq[uart->index], 9); // ERROR
+}
 
-	} else if ((instruction >> 12) == 0b1000) {
-		// Format 10: load/store halfword
-		uint32_t *reg_change = &machine->regs[(instruction >> 0)  & 0b111];
-		uint32_t *reg_base   = &machine->regs[(instruction >> 3)  & 0b111];
-		uint32_t offset5     = (instruction >> 6) & 0x1f;
-		bool     flag_load   = (instruction >> 11) & 0b1;
-		transfer_type_t transfer_type = flag_load ? LOAD : STORE;
-		uint32_t address = *reg_base + (offset5 << 1);
-		if (machine_transfer(machine, address, transfer_type, reg_change, WIDTH_16, false)) {
-			return ERR_MEM;
-		}
+// Apply BAUDRATE and CONFIG. The receive FIFO holds 6 characters for the
+// UART and 4 for the UARTE, which writes them to RAM when it has a buffer.
+static void machine_uart_nrf_configure(machine_t *machine, uart_t *uart) {
+	uint32_t config = uart->config;
+	bool hwfc = config & 1;
+	uint32_t frame_bits = 1 + 8 + (((config >> 1) & 7) != 0) + ((config >> 4) & 1 ? 2 : 1); // PARITY, STOP
+	uint32_t baud = (uint64_t)uart->baudrate * 16000000 >> 32;
+	machine_uart_configure(machine, uart, baud, frame_bits, hwfc, hwfc, uart->enable == 8 ? 4 : 6);
+}
 
-	} else if ((instruction >> 12) == 0b1001) {
-		// Format 11: SP-relative load/store
-		uint32_t word8     = (instruction >> 0) & 0xff; // 8 bits
-		uint32_t *reg      = &machine->regs[(instruction >> 8) & 0b111];
-		bool     flag_load = (instruction >> 11) & 0b1;
-		transfer_type_t transfer_type = flag_load ? LOAD : STORE;
-		if (machine_transfer(machine, *sp + word8 * 4, transfer_type, reg, WIDTH_32, false)) {
-			return ERR_MEM;
+// Send the TXD buffer of the UARTE that was latched at TXSTARTED. ENDTX
+// happens when it has been sent, see machine_uart_update.
+static void machine_uarte_send(machine_t *machine, uart_t *uart) {
+	uint8_t buf[256];
+	uint32_t length = uart->tx_buf_len;
+	for (uint32_t i = 0; i < length; i += sizeof(buf)) {
+		uint32_t chunk = length - i < sizeof(buf) ? length - i : sizeof(buf);
+		machine_readmem(machine, buf, uart->tx_buf + i, chunk);
+		for (uint32_t j = 0; j < chunk; j++) {
+			machine_uart_send(machine, uart, buf[j]);
 		}
+	}
+	uart->tx_amount = length;
+	uart->tx_busy = true;
+}
 
-	} else if ((instruction >> 12) == 0b1010) {
-		// Format 12: load address
-		uint32_t word8    = (instruction >> 0) & 0xff; // 8 bits
-		uint32_t *reg_dst = &machine->regs[(instruction >> 8) & 0b111];
-		bool     flag_sp  = (instruction >> 11) & 0b1;
-		uint32_t value = flag_sp ? *sp : *pc;
-		if (!flag_sp) {
-			// ADR
-			// for PC: force bit 1 to 0
-			value += 2;
-			value &= ~0b11UL;
-		}
-		*reg_dst = value + (word8 << 2);
+// Latch the RXD buffer of the UARTE and receive into it from now on. The
+// firmware can then set up the next buffer, for the ENDRX_STARTRX short.
+static void machine_uarte_rx_start(machine_t *machine, uart_t *uart) {
+	uart->rx_buf = uart->rx_ptr;
+	uart->rx_buf_len = uart->rx_maxcnt;
+	uart->rx_amount = 0;
+	machine_dma_check(machine, "UARTE RXD", uart->rx_buf, uart->rx_buf_len);
+	machine_nrf_event(machine, &uart->periph, nrf_uart_base[uart->index], nrf_uart_irq[uart->index], 19); // RXSTARTED
+}
 
-	} else if ((instruction >> 8) == 0b10110000) {
-		// Format 13: add offset to Stack Pointer
-		uint32_t offset6  = (instruction >> 0) & 0x3f; // 6 bits
-		bool     flag_neg = (instruction >> 7) & 0b1;
-		if (flag_neg) { // SUB SP, #imm
-			machine_log(machine, LOG_CALLS, "%*ssub     0x%02x (sp: %x)\n", machine->call_depth * 2, "", offset6 * 4, *sp);
-			*sp -= offset6 * 4;
-		} else { // ADD SP, #imm
-			machine_log(machine, LOG_CALLS, "%*sadd    %2x (sp: %x)\n", machine->call_depth * 2, "", offset6 * 4, *sp);
-			*sp += offset6 * 4;
+// Move a byte from the receive FIFO to the RXD buffer of the UARTE.
+static void machine_uarte_store(machine_t *machine, uart_t *uart) {
+	uint32_t errors;
+	uint32_t c = machine_uart_read(machine, uart, &errors);
+	uint32_t transfer_address = machine->transfer_address;
+	machine_transfer(machine, uart->rx_buf + uart->rx_amount, STORE, &c, WIDTH_8, false);
+	machine->transfer_address = transfer_address;
+	uart->rx_amount++;
+	machine_nrf_event(machine, &uart->periph, nrf_uart_base[uart->index], nrf_uart_irq[uart->index], 2); // RXDRDY
+}
+
+// Finish sending with the UARTE, receive bytes with it, or pend the RXDRDY
+// interrupt of the legacy UART while there is data available.
+static void machine_uart_update(machine_t *machine, uart_t *uart) {
+	if (uart->tx_waiting && machine_uart_cts(machine, uart)) {
+		uart->tx_waiting = false;
+		machine_uarte_send(machine, uart);
+	}
+	if (uart->tx_busy && machine_uart_tx_pending(machine, uart) == 0) {
+		uart->tx_busy = false;
+		machine_nrf_event(machine, &uart->periph, nrf_uart_base[uart->index], nrf_uart_irq[uart->index], 7); // TXDRDY
+		machine_nrf_event(machine, &uart->periph, nrf_uart_base[uart->index], nrf_uart_irq[uart->index], 8); // ENDTX
+	}
+	if (!uart->rx_started) {
+		return;
+	}
+	if (uart->enable != 8) {
+		if ((uart->periph.inten & (1 << 2)) && machine_uart_rx_ready(machine, uart)) {
+			machine_pend_irq(machine, nrf_uart_irq[uart->index]);
 		}
+		machine_uart_nrf_errors(machine, uart);
+		return;
+	}
+	machine_uart_receive(machine, uart);
+	while (uart->rx_started && uart->rx_amount < uart->rx_buf_len && uart->rx_len != 0) {
+		machine_uarte_store(machine, uart);
+		machine_uart_receive(machine, uart);
+		if (uart->rx_amount < uart->rx_buf_len) {
+			continue;
+		}
+		machine_nrf_event(machine, &uart->periph, nrf_uart_base[uart->index], nrf_uart_irq[uart->index], 4); // ENDRX
+		if (uart->periph.shorts & (1 << 5)) { // ENDRX_STARTRX
+			machine_uarte_rx_start(machine, uart);
+		} else if (uart->periph.shorts & (1 << 6)) { // ENDRX_STOPRX
+			uart->rx_started = false;
+			machine_uart_nrf_power(machine);
+			machine_nrf_event(machine, &uart->periph, nrf_uart_base[uart->index], nrf_uart_irq[uart->index], 17); // RXTO
+		}
+	}
+	machine_uart_nrf_errors(machine, uart);
+}
 
-	} else if ((instruction >> 8) == 0b10110010) {
-		// Sign or zero extend
-		uint32_t *reg_dst = &machine->regs[(instruction >> 0) & 0b111];
-		uint32_t *reg_src = &machine->regs[(instruction >> 3) & 0b111];
-		uint32_t opcode   = (instruction >> 6) & 0b11;
-		if (opcode == 0b00) {
-			// T1: SXTH (signed extend halfword)
-			*reg_dst = (int32_t)(*reg_src << 16) >> 16;
-		} else if (opcode == 0b01) {
-			// T1: SXTB (signed extend byte)
-			*reg_dst = (int32_t)(*reg_src << 24) >> 24;
-		} else if (opcode == 0b10) {
-			// T1: UXTH (unsigned extend halfword)
-			*reg_dst = *reg_src & 0xffff;
-		} else if (opcode == 0b11) {
-			// T1: UXTB (unsigned extend byte)
-			*reg_dst = *reg_src & 0xff;
+// Access the registers that the UART and UARTE have in common: ERRORSRC,
+// ENABLE, BAUDRATE and CONFIG. It returns false for other registers.
+static bool machine_uart_nrf_common(machine_t *machine, uart_t *uart, uint32_t offset, transfer_type_t transfer_type, uint32_t *value) {
+	uint32_t *reg;
+	if (offset == 0x480) { // ERRORSRC
+		if (transfer_type == STORE) {
+			uart->errorsrc &= ~*value; // write 1 to clear
 		}
+		*value = uart->errorsrc;
+		return true;
+	} else if (offset == 0x500) { // ENABLE
+		reg = &uart->enable;
+		*value &= 0xf;
+	} else if (offset == 0x524) { // BAUDRATE
+		reg = &uart->baudrate;
+	} else if (offset == 0x56c) { // CONFIG
+		reg = &uart->config;
+		*value &= 0x1f;
+	} else {
+		return false;
+	}
+	if (transfer_type == STORE) {
+		*reg = *value;
+		machine_uart_nrf_configure(machine, uart);
+	}
+	*value = *reg;
+	return true;
+}
 
-	} else if (((instruction >> 8) & 0b11110101) == 0b10110001 && machine_versioncheck(machine, CORTEX_M4)) {
-		// T1: CBZ / CBNZ (compare and branch on [non-]zero)
-		// Note: the previous two instruction encodings (sign/zero extend,
-		// add sp) must be before this instruction.
-		uint32_t *reg = &machine->regs[(instruction >> 0) & 0b111];
-		uint32_t imm5 = (instruction >> 3) & 0b11111;
-		uint32_t flag_i  = ((instruction >> 9) & 0b1);
-		bool flag_nz = ((instruction >> 11) & 0b1);
-		if ((*reg == 0) == !flag_nz) {
-			*pc += (flag_i << 6) + (imm5 << 1) + 2;
+// Access a register of the UART in EasyDMA mode (UARTE).
+static uint32_t machine_uarte_transfer(machine_t *machine, uart_t *uart, uint32_t offset, transfer_type_t transfer_type, uint32_t value) {
+	if (machine_nrf_common(machine, &uart->periph, nrf_uart_irq[uart->index], offset, transfer_type, &value)) {
+		return value;
+	}
+	if (machine_uart_nrf_common(machine, uart, offset, transfer_type, &value)) {
+		return value;
+	}
+	if (transfer_type == STORE && offset == 0x000) { // TASKS_STARTRX
+		uart->rx_started = true;
+		machine_uart_rx_enable(machine, uart);
+		machine_uart_nrf_power(machine);
+		machine_uarte_rx_start(machine, uart);
+	} else if (transfer_type == STORE && offset == 0x004) { // TASKS_STOPRX
+		if (uart->rx_started) {
+			uart->rx_started = false;
+			machine_uart_nrf_power(machine);
+			machine_nrf_event(machine, &uart->periph, nrf_uart_base[uart->index], nrf_uart_irq[uart->index], 4); // ENDRX
+			machine_nrf_event(machine, &uart->periph, nrf_uart_base[uart->index], nrf_uart_irq[uart->index], 17); // RXTO
 		}
+	} else if (transfer_type == STORE && offset == 0x008) { // TASKS_STARTTX
+		// The whole buffer is sent once CTS allows it.
+		uart->tx_started = true;
+		uart->tx_buf = uart->tx_ptr;
+		uart->tx_buf_len = uart->tx_maxcnt;
+		machine_dma_check(machine, "UARTE TXD", uart->tx_buf, uart->tx_buf_len);
+		machine_uart_nrf_power(machine);
+		machine_nrf_event(machine, &uart->periph, nrf_uart_base[uart->index], nrf_uart_irq[uart->index], 20); // TXSTARTED
+		uart->tx_waiting = true;
+		machine_uart_update(machine, uart);
+	} else if (transfer_type == STORE && offset == 0x00c) { // TASKS_STOPTX
+		uart->tx_started = false;
+		uart->tx_waiting = false;
+		machine_uart_nrf_power(machine);
+		machine_nrf_event(machine, &uart->periph, nrf_uart_base[uart->index], nrf_uart_irq[uart->index], 22); // TXSTOPPED
+	} else if (transfer_type == STORE && offset == 0x02c) { // TASKS_FLUSHRX
+		// Write what is left in the receive FIFO to the RXD buffer, which is
+		// latched again, like after a STOPRX.
+		if (!uart->rx_started) {
+			uart->rx_buf = uart->rx_ptr;
+			uart->rx_buf_len = uart->rx_maxcnt;
+			uart->rx_amount = 0;
+			while (uart->rx_amount < uart->rx_buf_len && uart->rx_len != 0) {
+				machine_uarte_store(machine, uart);
+			}
+			machine_nrf_event(machine, &uart->periph, nrf_uart_base[uart->index], nrf_uart_irq[uart->index], 4); // ENDRX
+		}
+	} else if (offset == 0x534 || offset == 0x538 || offset == 0x544 || offset == 0x548) { // RXD.PTR, RXD.MAXCNT, TXD.PTR, TXD.MAXCNT
+		uint32_t *reg = offset == 0x534 ? &uart->rx_ptr : offset == 0x538 ? &uart->rx_maxcnt : offset == 0x544 ? &uart->tx_ptr : &uart->tx_maxcnt;
+		if (transfer_type == STORE) {
+			*reg = value;
+		}
+		return *reg;
+	} else if (transfer_type == LOAD && offset == 0x53c) { // RXD.AMOUNT
+		return uart->rx_amount;
+	} else if (transfer_type == LOAD && offset == 0x54c) { // TXD.AMOUNT
+		return uart->tx_amount;
+	} else if (offset >= 0x500 && offset < 0x570) { // pin selection
+	} else {
+		machine_log(machine, LOG_WARN, "unknown UARTE %s at offset 0x%03x (PC: %x)\n", transfer_type == LOAD ? "load" : "store", offset, machine->pc - 3);
+	}
+	return 0;
+}
 
-	} else if ((instruction & 0xffef) == 0xb662) {
-		// CPSID/CPSIE
-		// Ignore for now.
+// Access a register of UART0 or UARTE1, which are UARTEs when ENABLE is 8.
+static uint32_t machine_uart_transfer(machine_t *machine, uart_t *uart, uint32_t offset, transfer_type_t transfer_type, uint32_t value) {
+	if (uart->enable == 8 && offset != 0x500) {
+		return machine_uarte_transfer(machine, uart, offset, transfer_type, value);
+	}
+	if (machine_uart_nrf_common(machine, uart, offset, transfer_type, &value)) {
+		return value;
+	}
+	if (transfer_type == STORE && offset == 0x000) { // STARTRX
+		uart->rx_started = true;
+		machine_uart_rx_enable(machine, uart);
+		machine_uart_nrf_power(machine);
+	} else if (transfer_type == STORE && offset == 0x004) { // STOPRX
+		uart->rx_started = false;
+		machine_uart_nrf_power(machine);
+	} else if (transfer_type == STORE && offset == 0x008) { // STARTTX
+		uart->tx_started = true;
+		machine_uart_nrf_power(machine);
+	} else if (transfer_type == STORE && offset == 0x00c) { // STOPTX
+		uart->tx_started = false;
+		machine_uart_nrf_power(machine);
+	} else if (offset == 0x108) { // RXDRDY
+		bool ready = machine_uart_rx_ready(machine, uart);
+		machine_uart_nrf_errors(machine, uart);
+		return ready;
+	} else if (offset == 0x11c) { // TXDRDY
+		return machine_uart_tx_pending(machine, uart) == 0;
+	} else if (offset == 0x100 || offset == 0x104 || offset == 0x124 || offset == 0x144) { // CTS, NCTS, ERROR, RXTO
+		machine_nrf_common(machine, &uart->periph, nrf_uart_irq[uart->index], offset, transfer_type, &value);
+		return value;
+	} else if (offset == 0x300 || offset == 0x304 || offset == 0x308) { // INTEN, INTENSET, INTENCLR
+		machine_nrf_common(machine, &uart->periph, nrf_uart_irq[uart->index], offset, transfer_type, &value);
+		return value;
+	} else if (transfer_type == LOAD && offset == 0x518) { // RXD
+		uint32_t errors;
+		uint32_t c = machine_uart_read(machine, uart, &errors);
+		machine_uart_nrf_errors(machine, uart);
+		return c;
+	} else if (transfer_type == STORE && offset == 0x51c) { // TXD
+		machine_uart_send(machine, uart, value);
+	} else if (offset >= 0x500 && offset < 0x570) { // pin selection
+	} else {
+		machine_log(machine, LOG_WARN, "unknown UART %s at offset 0x%03x (PC: %x)\n", transfer_type == LOAD ? "load" : "store", offset, machine->pc - 3);
+	}
+	return 0;
+}
 
-	} else if ((instruction >> 8) == 0b10111010) {
-		// T1: Reverse bytes
-		uint32_t *reg_dst = &machine->regs[(instruction >> 0) & 0b111];
-		uint32_t *reg_src = &machine->regs[(instruction >> 3) & 0b111];
-		uint32_t opcode   = (instruction >> 6) & 0b11;
-		if (opcode == 0b00) { // REV: reverse bytes
-			*reg_dst =
-				(*reg_src >> 0  & 0xff) << 24 |
-				(*reg_src >> 8  & 0xff) << 16 |
-				(*reg_src >> 16 & 0xff) << 8 |
-				(*reg_src >> 24 & 0xff) << 0;
-		//} else if (opcode == 0b01) { // REV16
-		//} else if (opcode == 0b11) { // REVSH
+// Return the output level of a GPIO pin (port * 32 + pin), whether or not it
+// is configured as an output.
+static bool machine_gpio_output(machine_t *machine, uint32_t pin) {
+	uint32_t port = pin / 32, n = pin % 32;
+	if (machine->family == FAMILY_STM32) {
+		// Only the GPIO ports of either the F1 or the F4 are used, the
+		// others stay zero.
+		uint32_t odr = (port < 7 ? machine->stm32.gpio_f1[port][3] : 0) | (port < 11 ? machine->stm32.gpio_f4[port][5] : 0);
+		return (odr >> n) & 1;
+	} else if (machine->family == FAMILY_RP2040) {
+		return port == 0 && ((machine->rp2040.gpio_out >> n) & 1);
+	}
+	return port < 2 && ((machine->nrf.gpio[port].out >> n) & 1);
+}
+
+// Return whether a GPIO pin (port * 32 + pin) is configured as an output.
+static bool machine_gpio_is_output(machine_t *machine, uint32_t pin) {
+	uint32_t port = pin / 32, n = pin % 32;
+	if (machine->family == FAMILY_STM32) {
+		bool f1 = port < 7 && n < 16 && ((machine->stm32.gpio_f1[port][n / 8] >> (n % 8 * 4)) & 3) != 0; // CRL/CRH.MODE
+		bool f4 = port < 11 && n < 16 && ((machine->stm32.gpio_f4[port][0] >> (n * 2)) & 3) == 1; // MODER
+		return f1 || f4;
+	} else if (machine->family == FAMILY_RP2040) {
+		return port == 0 && ((machine->rp2040.gpio_oe >> n) & 1);
+	}
+	return port < 2 && (machine->nrf.gpio[port].pin_cnf[n] & 1);
+}
+
+// Return the level that the host, or an output pin connected to it, drives on
+// a GPIO pin: 0 or 1, or -1 if the pin is floating. Connected outputs that
+// disagree are resolved like open-drain outputs: low wins.
+static int machine_gpio_external(machine_t *machine, uint32_t pin) {
+	uint32_t port = pin / 32, bit = 1u << (pin % 32);
+	if (port >= MACHINE_GPIO_PORTS) {
+		return -1;
+	}
+	if (machine->gpio_input.driven[port] & bit) {
+		return (machine->gpio_input.high[port] & bit) != 0;
+	}
+	int level = -1;
+	for (uint32_t i = 0; i < machine->gpio_input.num_links; i++) {
+		uint32_t other;
+		if (machine->gpio_input.links[i][0] == pin) {
+			other = machine->gpio_input.links[i][1];
+		} else if (machine->gpio_input.links[i][1] == pin) {
+			other = machine->gpio_input.links[i][0];
 		} else {
-			return ERR_UNDEFINED;
+			continue;
+		}
+		if (machine_gpio_is_output(machine, other)) {
+			level = (level != 0) && machine_gpio_output(machine, other);
 		}
+	}
+	return level;
+}
 
-	} else if ((instruction >> 8) == 0b10111110) {
-		// T1: BKPT (software breakpoint)
-		uint32_t imm8 = (instruction >> 0) & 0b11111111;
-		// This emulator handles some breakpoints in a special way.
-		if (imm8 == 0x81) {
-			machine->loglevel = LOG_INSTRS;
-		} else if (imm8 == 0x80) {
-			machine->loglevel = LOG_ERROR;
-		} else {
-			return ERR_BREAK;
+// Drive a GPIO pin (port * 32 + pin) high or low, or toggle it when state is
+// negative.
+static void machine_gpio_drive(machine_t *machine, uint32_t pin, int state) {
+	uint32_t *out = &machine->nrf.gpio[(pin >> 5) & 1].out;
+	uint32_t bit = 1u << (pin & 31);
+	if (state < 0) {
+		*out ^= bit;
+	} else if (state) {
+		*out |= bit;
+	} else {
+		*out &= ~bit;
+	}
+}
+
+// Return the IN register of a GPIO port. Outputs read what they drive, inputs
+// read what the host drives on them or else their pull resistor.
+static uint32_t machine_nrf_gpio_in(machine_t *machine, uint32_t port) {
+	uint32_t in = 0;
+	for (uint32_t i = 0; i < 32; i++) {
+		uint32_t cnf = machine->nrf.gpio[port].pin_cnf[i];
+		int external = machine_gpio_external(machine, port * 32 + i);
+		if (cnf & 1) { // output
+			in |= ((machine->nrf.gpio[port].out >> i) & 1) << i;
+		} else if (external >= 0) {
+			in |= (uint32_t)external << i;
+		} else if (((cnf >> 2) & 3) == 3) { // pull-up
+			in |= 1u << i;
 		}
+	}
+	return in;
+}
 
-	} else if ((instruction >> 8) == 0b10111111 && machine_versioncheck(machine, CORTEX_M4)) {
-		uint32_t firstcond = (instruction >> 4) & 0b1111;
-		uint32_t mask      = (instruction >> 0) & 0b1111;
-		if (mask == 0b0000) {
-			// NOP-compatible hints (NOP, YIELD, WFE, WFI, SEV, DBG).
-			// For now, ignore. TODO: implement WFE/WFI.
-		} else {
-			// IT
-			uint32_t state = (firstcond << 4) | mask;
-			machine->psr.it1 = state & 0b11;
-			machine->psr.it2 = state >> 2;
+// Generate the GPIOTE IN events for input pins that changed level, and the
+// PORT event when a pin starts to meet its SENSE condition.
+static void machine_nrf_gpio_edges(machine_t *machine, uint32_t port, uint32_t changed, uint32_t in) {
+	for (int n = 0; n < 8; n++) {
+		uint32_t config = machine->nrf.gpiote.config[n];
+		uint32_t pin = (config >> 8) & 0x3f;
+		if ((config & 3) != 1 || pin / 32 != port || !((changed >> (pin % 32)) & 1)) {
+			continue; // not in event mode, or not this pin
+		}
+		bool high = (in >> (pin % 32)) & 1;
+		uint32_t polarity = (config >> 16) & 3;
+		if (polarity == 3 || (polarity == 1 && high) || (polarity == 2 && !high)) { // toggle, LoToHi, HiToLo
+			machine_nrf_event(machine, &machine->nrf.gpiote.periph, 0x40006000, 6, n); // IN[n]
 		}
+	}
+}
 
-	} else if ((instruction >> 12) == 0b1011 && ((instruction >> 9) & 0b11) == 0b10) { // 1011x10
-		// Format 14: push/pop registers
-		uint32_t reg_list   = (instruction >> 0) & 0xff;
-		bool     flag_load  = (instruction >> 11) & 0b1;
-		bool     flag_pc_lr = (instruction >> 8) & 0b1; // store LR / load PC
-		if (flag_load) { // POP
-			if (flag_pc_lr) {
-				reg_list |= (1 << 15); // PC
-			}
-			int err = machine_instr_ldmia(machine, sp, reg_list, true);
-			if (err != 0) {
-				return err;
-			}
-		} else { // PUSH
-			if (flag_pc_lr) {
-				reg_list |= (1 << 14); // LR
-			}
-			int err = machine_instr_stmdb(machine, sp, reg_list, true);
-			if (err != 0) {
-				return err;
+// Update the LATCH registers and the DETECT signal from the SENSE
+// configuration of all pins, generating the PORT event of GPIOTE when DETECT
+// goes high.
+static void machine_nrf_gpio_sense(machine_t *machine) {
+	bool detect = false;
+	for (uint32_t port = 0; port < 2; port++) {
+		uint32_t in = machine->gpio_input.in[port];
+		for (uint32_t i = 0; i < 32; i++) {
+			uint32_t sense = (machine->nrf.gpio[port].pin_cnf[i] >> 16) & 3;
+			if ((sense == 2 && ((in >> i) & 1)) || (sense == 3 && !((in >> i) & 1))) { // High, Low
+				machine->nrf.gpio[port].latch |= 1u << i;
+				detect = true;
 			}
 		}
+	}
+	if (detect && !machine->nrf.gpiote.detect) {
+		machine_nrf_event(machine, &machine->nrf.gpiote.periph, 0x40006000, 6, 31); // PORT
+	}
+	machine->nrf.gpiote.detect = detect;
+}
 
-	} else if ((instruction >> 12) == 0b1100) {
-		// Format 15: multiple load/store (LDMIA and STMIA)
-		uint32_t  reg_list = (instruction >> 0) & 0xff;
-		uint32_t  reg_base_num = (instruction >> 8) & 0b111;
-		uint32_t *reg_base = &machine->regs[reg_base_num];
-		bool     flag_load = (instruction >> 11) & 0b1;
-		if (reg_list == 0) {
-			machine_log(machine, LOG_ERROR, "\nERROR: LDMIA/STMIA does not allow zero registers (%04x)\n", instruction);
-			return ERR_UNDEFINED;
+// Timing of the WS2812 data line in nanoseconds, from the WS2812B datasheet.
+// High pulses shorter than WS2812_T1H_MIN are zeros, longer ones are ones,
+// like the LEDs decode them. Pulses that are outside the limits are decoded
+// anyway, but counted as timing errors.
+#define WS2812_T0H_MIN (200)
+#define WS2812_T0H_MAX (500)
+#define WS2812_T1H_MIN (550)
+#define WS2812_T1H_MAX (1000)
+#define WS2812_TL_MAX  (5000)  // longest low time between two bits
+#define WS2812_RESET   (50000) // low time after which the LEDs show the frame
+
+// Show the frame received by the WS2812 LEDs. A frame that doesn't end on a
+// byte boundary counts as a timing error.
+static void machine_ws2812_latch(machine_t *machine) {
+	if (machine->ws2812.bits % 8 != 0) {
+		machine->stats.ws2812_errors++;
+	}
+	machine->stats.ws2812_frames++;
+	machine->ws2812.frame(machine, machine->ws2812.data, machine->ws2812.bits / 8);
+	machine->ws2812.bits = 0;
+}
+
+// Decode an edge on the WS2812 data pin, at the given cycle.
+static void machine_ws2812_edge(machine_t *machine, bool level, uint64_t cycle) {
+	if (level == machine->ws2812.level) {
+		return;
+	}
+	uint64_t ns = (cycle - machine->ws2812.edge) * 1000000000 / machine->clock;
+	if (level) { // the end of a low period
+		if (ns >= WS2812_RESET && machine->ws2812.bits != 0) {
+			machine_ws2812_latch(machine);
+		} else if (ns > WS2812_TL_MAX && machine->ws2812.bits != 0) {
+			machine->stats.ws2812_errors++;
 		}
-		if (flag_load) {
-			// LDMIA!
-			bool wback = (reg_list & (1 << reg_base_num)) == 0;
-			machine_instr_ldmia(machine, reg_base, reg_list, wback);
-		} else {
-			// STMIA!
-			machine_instr_stmia(machine, reg_base, reg_list, true);
+	} else { // the end of a pulse that encodes a bit
+		bool bit = ns >= WS2812_T1H_MIN;
+		if (bit ? ns > WS2812_T1H_MAX : ns < WS2812_T0H_MIN || ns > WS2812_T0H_MAX) {
+			machine->stats.ws2812_errors++;
+		}
+		uint32_t bits = machine->ws2812.bits;
+		if (bits < MACHINE_WS2812_BYTES * 8) {
+			if (bits % 8 == 0) {
+				machine->ws2812.data[bits / 8] = 0;
+			}
+			machine->ws2812.data[bits / 8] |= bit << (7 - bits % 8);
+			machine->ws2812.bits++;
 		}
+	}
+	machine->ws2812.level = level;
+	machine->ws2812.edge = cycle;
+	machine_reschedule(machine, EVENT_WS2812);
+}
 
-	} else if ((instruction >> 12) == 0b1101) {
-		// Format 16: conditional branch
-		// http://infocenter.arm.com/help/topic/com.arm.doc.dui0497a/BABEHFEF.html
-		uint32_t offset8   = (instruction >> 0) & 0xff;
-		uint32_t condition = (instruction >> 8) & 0b1111;
-		int32_t offset = ((int32_t)(offset8 << 24) >> 23);
-		offset += 2;
-		int result = machine_condition(machine, condition);
-		if (result < 0) {
-			return ERR_UNDEFINED;
-		}
-		if (result) {
-			*pc += offset;
-		}
-
-	} else if ((instruction >> 11) == 0b11100) {
-		// Format 18: unconditional branch
-		uint32_t offset11 = (instruction >> 0) & 0x7ff;
-		int32_t offset = ((int32_t)(offset11 << 21) >> 20);
-		*pc += offset + 2;
-
-	} else if ((instruction >> 11) == 0b11101 && machine_versioncheck(machine, CORTEX_M4)) {
-		// 32-bit instruction
-		uint16_t hw1 = instruction;
-		uint16_t hw2 = machine->image16[*pc/2];
-		*pc += 2;
+// Show the frame of the WS2812 LEDs once the data line has been low for long
+// enough.
+static void machine_ws2812_update(machine_t *machine) {
+	uint64_t reset = (uint64_t)machine->clock * WS2812_RESET / 1000000000;
+	if (!machine->ws2812.level && machine->stats.cycles >= machine->ws2812.edge + reset) {
+		machine_ws2812_latch(machine);
+	}
+}
 
-		if (((hw1 >> 6) == 0b1110100100)) {
-			bool flag_load  = (hw1 >> 4) & 0b1;
-			bool flag_wback = (hw1 >> 5) & 0b1;
-			uint32_t *reg = &machine->regs[(hw1 >> 0) & 0b1111];
-			if (!flag_load) {
-				// STMDB
-				int err = machine_instr_stmdb(machine, reg, hw2, flag_wback);
-				if (err != 0) {
-					return err;
-				}
-			} else {
-				// LDMDB
-				int err = machine_instr_ldmdb(machine, reg, hw2, flag_wback);
-				if (err != 0) {
-					return err;
-				}
+// Access a register of the GPIOTE peripheral. Pins in event mode generate
+// events when the host changes their input level, see
+// machine_set_gpio_input.
+static uint32_t machine_gpiote_transfer(machine_t *machine, uint32_t offset, transfer_type_t transfer_type, uint32_t value) {
+	if (machine_nrf_common(machine, &machine->nrf.gpiote.periph, 6, offset, transfer_type, &value)) {
+		return value;
+	}
+	if (transfer_type == STORE && offset < 0x090) { // TASKS_OUT[n], TASKS_SET[n], TASKS_CLR[n]
+		uint32_t config = machine->nrf.gpiote.config[(offset % 0x30) / 4 % 8];
+		if ((offset % 0x30) < 0x20 && (config & 3) == 3) { // task mode
+			int states[3] = {-1, 1, 0};
+			machine_gpio_drive(machine, (config >> 8) & 0x3f, states[offset / 0x30]);
+		}
+	} else if (offset >= 0x510 && offset < 0x530) { // CONFIG[n]
+		uint32_t *config = &machine->nrf.gpiote.config[(offset - 0x510) / 4];
+		if (transfer_type == STORE) {
+			*config = value;
+			if ((value & 3) == 3) {
+				// The pin is now an output with the OUTINIT level.
+				uint32_t pin = (value >> 8) & 0x3f;
+				machine->nrf.gpio[pin >> 5].pin_cnf[pin & 31] |= 1;
+				machine_gpio_drive(machine, pin, (value >> 20) & 1);
 			}
+		}
+		return *config;
+	} else {
+		machine_log(machine, LOG_WARN, "unknown GPIOTE %s at offset 0x%03x (PC: %x)\n", transfer_type == LOAD ? "load" : "store", offset, machine->pc - 3);
+	}
+	return 0;
+}
 
-		} else if ((hw1 >> 6) == 0b1110100010) {
-			bool flag_load  = (hw1 >> 4) & 0b1;
-			bool flag_wback = (hw1 >> 5) & 0b1;
-			uint32_t *reg = &machine->regs[(hw1 >> 0) & 0b1111];
-			if (flag_load) {
-				// LDMIA
-				int err = machine_instr_ldmia(machine, reg, hw2, flag_wback);
-				if (err != 0) {
-					return err;
-				}
+// Access a register of the GPIO ports. P0 starts at 0x50000000 and P1 at
+// 0x50000300, so the registers of P1 are at offset 0x300 from those of P0.
+static uint32_t machine_gpio_transfer(machine_t *machine, uint32_t offset, transfer_type_t transfer_type, uint32_t value) {
+	int port = 0;
+	if (offset >= 0x800) {
+		port = 1;
+		offset -= 0x300;
+	}
+	uint32_t *out = &machine->nrf.gpio[port].out;
+	uint32_t *pin_cnf = machine->nrf.gpio[port].pin_cnf;
+	uint32_t dir = 0;
+	for (int i = 0; i < 32; i++) {
+		dir |= (pin_cnf[i] & 1) << i;
+	}
+	if (offset == 0x504 || offset == 0x508 || offset == 0x50c) { // OUT, OUTSET, OUTCLR
+		if (transfer_type == STORE) {
+			if (offset == 0x504) {
+				*out = value;
+			} else if (offset == 0x508) {
+				*out |= value;
 			} else {
-				// STMIA
-				int err = machine_instr_stmia(machine, reg, hw2, flag_wback);
-				if (err != 0) {
-					return err;
-				}
+				*out &= ~value;
 			}
-
-		} else if (((hw1 >> 6) & 0b1111111001) == 0b1110100001) {
-			// Load/store double and exclusive, and table branch
-			bool     flag_index = (hw1 >> 8) & 0b1; // preindex
-			bool     flag_up    = (hw1 >> 7) & 0b1;
-			bool     flag_wback = (hw1 >> 5) & 0b1;
-			bool     flag_load  = (hw1 >> 4) & 0b1;
-			uint32_t *reg_src   = &machine->regs[(hw1 >> 0)  & 0b1111]; // Rn
-			if (flag_index || flag_wback) {
-				// Load and store double: LDRD, STRD
-				uint32_t imm8 = hw2 & 0xff;
-				uint32_t *reg_dst1 = &machine->regs[(hw2 >> 12) & 0b1111]; // Rt
-				uint32_t *reg_dst2 = &machine->regs[(hw2 >>  8) & 0b1111]; // Rt2
-				uint32_t base = reg_src == pc ? *reg_src & ~3UL : *reg_src;
-				uint32_t offset_addr = flag_up ? base + imm8 : base - imm8;
-				uint32_t address = flag_index ? offset_addr : (reg_src == pc ? *reg_src & ~1UL : *reg_src);
-				transfer_type_t transfer_type = flag_load ? LOAD : STORE;
-				if (flag_wback) {
-					*reg_src = offset_addr;
-				}
-				if (machine_transfer(machine, address, transfer_type, reg_dst1, WIDTH_32, false)) {
-					return ERR_MEM;
-				}
-				if (machine_transfer(machine, address + 4, transfer_type, reg_dst2, WIDTH_32, false)) {
-					return ERR_MEM;
-				}
-			} else if (!flag_up) {
-				// Load and store exclusive.
-				*pc -= 2;
-				return ERR_UNDEFINED;
-			} else  {
-				// Load/store exclusive byte, halfword, doubleword, and
-				// table branch.
-				uint32_t op        = (hw2 >> 4)  & 0b1111;
-				uint32_t *reg_src2 = &machine->regs[(hw2 >> 0)  & 0b1111]; // Rm
-				if (op == 0b0000 && flag_load) {
-					// TBB
-					uint32_t baseaddr = *reg_src;
-					if (reg_src == pc) {
-						baseaddr -= 1; // Thumb bit
-					}
-					uint32_t offset = *reg_src2;
-					uint32_t halfwords;
-					if (machine_transfer(machine, baseaddr + offset, LOAD, &halfwords, WIDTH_8, false)) {
-						return ERR_MEM;
-					}
-					*pc += halfwords << 1;
-				} else if (op == 0b0001 && flag_load) {
-					// TBH
-					uint32_t baseaddr = *reg_src;
-					if (reg_src == pc) {
-						baseaddr -= 1; // Thumb bit
-					}
-					uint32_t offset = *reg_src2 << 1;
-					uint32_t halfwords;
-					if (machine_transfer(machine, baseaddr + offset, LOAD, &halfwords, WIDTH_16, false)) {
-						return ERR_MEM;
-					}
-					*pc += halfwords << 1;
-				} else {
-					*pc -= 2;
-					return ERR_UNDEFINED;
+		}
+		return *out;
+	} else if (transfer_type == LOAD && offset == 0x510) { // IN
+		return machine_nrf_gpio_in(machine, port);
+	} else if (offset == 0x514 || offset == 0x518 || offset == 0x51c) { // DIR, DIRSET, DIRCLR
+		if (transfer_type == STORE) {
+			for (int i = 0; i < 32; i++) {
+				if (offset == 0x514 ? ((value >> i) & 1) != (dir >> i & 1) : (value >> i) & 1) {
+					pin_cnf[i] = (pin_cnf[i] & ~1u) | (offset != 0x51c && (value >> i) & 1);
 				}
 			}
+		}
+		return dir;
+	} else if (offset == 0x520) { // LATCH
+		if (transfer_type == STORE) {
+			machine->nrf.gpio[port].latch &= ~value;
+		}
+		return machine->nrf.gpio[port].latch;
+	} else if (offset == 0x524) { // DETECTMODE
+	} else if (offset >= 0x700 && offset < 0x780) { // PIN_CNF[n]
+		uint32_t *cnf = &pin_cnf[(offset - 0x700) / 4];
+		if (transfer_type == STORE) {
+			*cnf = value;
+		}
+		return *cnf;
+	} else {
+		machine_log(machine, LOG_WARN, "unknown GPIO %s at offset 0x%03x (PC: %x)\n", transfer_type == LOAD ? "load" : "store", offset, machine->pc - 3);
+	}
+	return 0;
+}
 
-		} else if ((hw1 >> 9) == 0b1110101) {
-			// Data processing instructions with constant shift
-			uint32_t op        = (hw1 >> 5) & 0b1111;
-			uint32_t flag_set  = (hw1 >> 4) & 0b1;
-			uint32_t *reg_dst  = &machine->regs[(hw2 >> 8) & 0b1111]; // Rd
-			uint32_t *reg_src  = &machine->regs[(hw1 >> 0) & 0b1111]; // Rn
-			uint32_t *reg_src2 = &machine->regs[(hw2 >> 0) & 0b1111]; // Rm
-			uint32_t imm3      = (hw2 >> 12) & 0b111;
-			uint32_t imm2      = (hw2 >> 6)  & 0b11;
-			uint32_t type      = (hw2 >> 4)  & 0b11;
+// Return whether the peripheral of a PPI event or task endpoint is emulated.
+// The PPI can connect any of them, but nothing happens with the events and
+// tasks of other peripherals.
+static bool machine_ppi_emulated(uint32_t address, bool event) {
+	const builtin_periph_t *periph = builtin_periph_find(nrf_peripherals, sizeof(nrf_peripherals) / sizeof(nrf_peripherals[0]), address);
+	if (periph == NULL) {
+		return false;
+	}
+	switch (periph->id) {
+	case BUILTIN_NRF_RNG:
+	case BUILTIN_NRF_PPI:
+		return !event; // RNG START and STOP, PPI CHG[n].EN and CHG[n].DIS
+	case BUILTIN_NRF_NVMC:
+	case BUILTIN_NRF_GPIO:
+	case BUILTIN_SCS:
+		return false;
+	default:
+		return true;
+	}
+}
 
-			uint32_t imm5 = (imm3 << 2) | imm2;
-			// DecodeImmShift(type, imm3:imm2)
-			// Shift(value, shift_t / type, shift_n / amount, APSR.C / carry_in)
-			uint32_t shifted;
-			switch (type) {
-				case 0b00: // LSL
-					shifted = machine_instr_lsl(machine, *reg_src2, imm5, flag_set);
-					break;
-				case 0b01: // LSR
-					shifted = machine_instr_lsr(machine, *reg_src2, imm5 == 0 ? 32 : imm5, flag_set);
-					break;
-				case 0b10: // ASR
-					shifted = machine_instr_asr(machine, *reg_src2, imm5 == 0 ? 32 : imm5, flag_set);
-					break;
-				case 0b11: // ROR, RRX
-					*pc -= 2; // undo 32-bit change
-					return ERR_UNDEFINED;
-			}
+// Warn when a PPI channel is connected to an event or task that isn't
+// emulated, as the firmware would silently stop working.
+static void machine_ppi_check(machine_t *machine, const char *reg, int n, const char *field, uint32_t address, bool event) {
+	if (address != 0 && !machine_ppi_emulated(address, event)) {
+		machine_log(machine, LOG_WARN, "PPI %s[%d].%s is set to the %s at 0x%08x, whose peripheral is not emulated (PC: %x)\n", reg, n, field, event ? "event" : "task", address, machine->pc - 3);
+	}
+}
 
-			int err = machine_alu_op(machine, op, reg_dst, reg_src, shifted, flag_set);
-			if (err != ERR_OK) {
-				*pc -= 2;
-				return err;
+// Access a register of the PPI peripheral.
+static uint32_t machine_ppi_transfer(machine_t *machine, uint32_t offset, transfer_type_t transfer_type, uint32_t value) {
+	if (offset < 0x030) { // TASKS_CHG[n].EN, TASKS_CHG[n].DIS
+		if (transfer_type == STORE) {
+			uint32_t group = machine->nrf.ppi.chg[offset / 8];
+			if (offset % 8 == 0) {
+				machine->nrf.ppi.chen |= group;
+			} else {
+				machine->nrf.ppi.chen &= ~group;
 			}
-
+		}
+	} else if (offset == 0x500 || offset == 0x504 || offset == 0x508) { // CHEN, CHENSET, CHENCLR
+		if (transfer_type == LOAD) {
+			return machine->nrf.ppi.chen;
+		}
+		if (offset == 0x500) {
+			machine->nrf.ppi.chen = value;
+		} else if (offset == 0x504) {
+			machine->nrf.ppi.chen |= value;
 		} else {
-			*pc -= 2; // undo 32-bit change
-			return ERR_UNDEFINED;
+			machine->nrf.ppi.chen &= ~value;
+		}
+	} else if (offset >= 0x510 && offset < 0x510 + 8 * NRF_PPI_CHANNELS) { // CH[n].EEP, CH[n].TEP
+		uint32_t *reg = offset % 8 == 0 ? &machine->nrf.ppi.eep[(offset - 0x510) / 8] : &machine->nrf.ppi.tep[(offset - 0x510) / 8];
+		if (transfer_type == STORE) {
+			*reg = value;
+			machine_ppi_check(machine, "CH", (offset - 0x510) / 8, offset % 8 == 0 ? "EEP" : "TEP", value, offset % 8 == 0);
+		}
+		return *reg;
+	} else if (offset >= 0x800 && offset < 0x818) { // CHG[n]
+		uint32_t *chg = &machine->nrf.ppi.chg[(offset - 0x800) / 4];
+		if (transfer_type == STORE) {
+			*chg = value;
 		}
+		return *chg;
+	} else if (offset >= 0x910 && offset < 0x990) { // FORK[n].TEP
+		uint32_t *tep = &machine->nrf.ppi.fork_tep[(offset - 0x910) / 4];
+		if (transfer_type == STORE) {
+			*tep = value;
+			machine_ppi_check(machine, "FORK", (offset - 0x910) / 4, "TEP", value, false);
+		}
+		return *tep;
+	} else {
+		machine_log(machine, LOG_WARN, "unknown PPI %s at offset 0x%03x (PC: %x)\n", transfer_type == LOAD ? "load" : "store", offset, machine->pc - 3);
+	}
+	return 0;
+}
 
-	} else if ((instruction >> 12) == 0b1111) {
-		// 32-bit instruction
-		uint16_t hw1 = instruction;
-		uint16_t hw2 = machine->image16[*pc/2];
-		*pc += 2;
+// Read bytes from memory for EasyDMA.
+static void machine_dma_read(machine_t *machine, uint32_t address, uint8_t *data, size_t length) {
+	uint32_t transfer_address = machine->transfer_address;
+	for (size_t i = 0; i < length; i++) {
+		uint32_t value = 0;
+		machine_transfer(machine, address + i, LOAD, &value, WIDTH_8, false);
+		data[i] = value;
+	}
+	machine->transfer_address = transfer_address;
+}
 
-		if ((hw1 >> 11) == 0b11110 && (hw2 >> 15) == 0b0 && machine_versioncheck(machine, CORTEX_M4)) {
-			// Data processing instructions: immediate, including bitfield
-			// and saturate
-			uint32_t imm3 = (hw2 >> 12) & 0b111;
-			uint32_t *reg_dst = &machine->regs[(hw2 >> 8) & 0b1111]; // Rd
-			uint32_t *reg_src = &machine->regs[(hw1 >> 0) & 0b1111]; // Rn
+// Write bytes to memory for EasyDMA.
+static void machine_dma_write(machine_t *machine, uint32_t address, const uint8_t *data, size_t length) {
+	uint32_t transfer_address = machine->transfer_address;
+	for (size_t i = 0; i < length; i++) {
+		uint32_t value = data[i];
+		machine_transfer(machine, address + i, STORE, &value, WIDTH_8, false);
+	}
+	machine->transfer_address = transfer_address;
+}
 
-			if (((hw1 >> 9) & 0b1) == 0b0) {
-				// Data processing with modified 12-bit immediate
-				uint32_t bit_i    = (hw1 >> 10) & 0b1;
-				uint32_t op       = (hw1 >> 5) & 0b1111;
-				bool     flag_set = (hw1 >> 4) & 0b1;
-				uint32_t imm8     = (hw2 >> 0) & 0xff;
-				uint32_t imm12 = imm8 | (imm3 << 8) | (bit_i << 11);
+static void machine_radio_event(machine_t *machine, int n) {
+	machine_nrf_event(machine, &machine->nrf.radio.periph, 0x40001000, 1, n);
+}
 
-				// ThumbExpandImmWithC()
-				uint32_t imm32;
-				if ((imm12 >> 10) == 0b00) {
-					uint32_t imm8 = imm12 & 0xff;
-					switch ((imm12 >> 8) & 0b11) {
-						case 0b00:
-							imm32 = imm8;
-							break;
-						case 0b01:
-							imm32 = (imm8 << 16) | imm8;
-							break;
-						case 0b10:
-							imm32 = (imm8 << 24) | (imm8 << 8);
-							break;
-						case 0b11:
-							imm32 = (imm8 << 24) | (imm8 << 16) | (imm8 << 8) | imm8;
-							break;
-					}
-				} else {
-					uint32_t unrotated_value = 0x80 | (imm8 & 0x7f);
-					uint32_t n = imm12 >> 7;
-					// ROR_C(unrotated_value aka x, n)
-					imm32 = n == 0 ? unrotated_value : ((unrotated_value >> n) | (unrotated_value << (32 - n)));
-					if (flag_set) {
-						machine->psr.c = imm32 >> 31;
-					}
-				}
+// Let the given RADIO event happen after the given number of microseconds.
+static void machine_radio_schedule(machine_t *machine, int event, uint32_t us) {
+	machine->nrf.radio.pending = true;
+	machine->nrf.radio.pending_event = event;
+	machine->nrf.radio.pending_at = machine_ticks(machine, 1000000) + us;
+	machine_reschedule(machine, EVENT_RADIO);
+}
 
-				int err = machine_alu_op(machine, op, reg_dst, reg_src, imm32, flag_set);
-				if (err != ERR_OK) {
-					*pc -= 2;
-					return err;
-				}
+// Return the time in microseconds that a packet of the given length takes on
+// air. Preamble, address and CRC take about 8 bytes. The 2Mbit modes
+// (Nrf_2Mbit and Ble_2Mbit) take 4µs per byte, the others 8µs.
+static uint32_t machine_radio_airtime(machine_t *machine, uint32_t length) {
+	uint32_t mode = machine->nrf.radio.regs[(0x510 - 0x500) / 4] & 0xf;
+	uint32_t us_per_byte = mode == 1 || mode == 4 ? 4 : 8;
+	return (length + 8) * us_per_byte;
+}
 
-			} else if (((hw1 >> 6) & 0b1101) == 0b1001) {
-				// Move, plain 16-bit immediate
-				uint32_t bit_i    = (hw1 >> 10) & 0b1;
-				uint32_t op       = (hw1 >> 7) & 0b1;
-				uint32_t op2      = (hw1 >> 4) & 0b11;
-				uint32_t imm4     = (hw1 >> 0) & 0b1111;
-				uint32_t imm8     = (hw2 >> 0) & 0xff;
+// Return the on-air address of the given logical address (0..7): its prefix
+// byte followed by the BALEN most significant bytes of its base address.
+static uint64_t machine_radio_address(machine_t *machine, uint32_t logical) {
+	uint32_t *regs = machine->nrf.radio.regs;
+	uint32_t balen = (regs[(0x518 - 0x500) / 4] >> 16) & 7; // PCNF1.BALEN
+	uint32_t base = regs[((logical == 0 ? 0x51c : 0x520) - 0x500) / 4]; // BASE0, BASE1
+	uint32_t prefixes = regs[((logical < 4 ? 0x524 : 0x528) - 0x500) / 4]; // PREFIX0, PREFIX1
+	uint32_t prefix = (prefixes >> (8 * (logical % 4))) & 0xff;
+	if (balen < 4) {
+		base &= balen == 0 ? 0 : 0xffffffffu << (8 * (4 - balen));
+	}
+	return (uint64_t)prefix << 32 | base;
+}
 
-				uint32_t imm16 = (imm4 << 12) | (bit_i << 11) | (imm3 << 8) | imm8;
-				if (op == 1 && op2 == 0b00) {
-					// MOVT
-					*pc -= 2;
-					return ERR_UNDEFINED;
-				} else if (op == 0 && op2 == 0b00) {
-					// MOVW
-					*reg_dst = imm16;
-				} else {
-					*pc -= 2;
-					return ERR_UNDEFINED;
-				}
+// Transmit the packet at PACKETPTR: log it, pass it to the host and schedule
+// the END event for when it has been sent.
+static void machine_radio_transmit(machine_t *machine) {
+	uint32_t *regs = machine->nrf.radio.regs;
+	uint32_t packetptr = regs[(0x504 - 0x500) / 4];
+	uint32_t pcnf0 = regs[(0x514 - 0x500) / 4];
+	uint32_t pcnf1 = regs[(0x518 - 0x500) / 4];
+	uint32_t lflen = pcnf0 & 0xf;
+	uint32_t s0len = (pcnf0 >> 8) & 1;
+	uint32_t s1len = (pcnf0 >> 16) & 0xf;
+	uint32_t header = s0len + (lflen + 7) / 8 + (s1len + 7) / 8;
+	uint8_t packet[3 + 255 + 255];
+	machine_readmem(machine, packet, packetptr, header);
+	uint32_t length = lflen ? packet[s0len] & ((1u << lflen) - 1) : 0;
+	length += (pcnf1 >> 8) & 0xff; // STATLEN
+	if (length > (pcnf1 & 0xff)) { // MAXLEN
+		length = pcnf1 & 0xff;
+	}
+	machine_readmem(machine, packet + header, packetptr + header, length);
 
-			} else if (((hw1 >> 8) & 0b11) == 0b11 && (((hw1 >> 4) & 0b1) == 0b0)) {
-				// Bit field operations, saturate with shift
-				uint32_t op       = (hw1 >> 5) & 0b111;
-				uint32_t imm5     = (hw2 >> 0) & 0b11111;
-				uint32_t imm2     = (hw2 >> 6) & 0b11;
-				if (op == 0b011) {
-					uint32_t msb = imm5;
-					uint32_t lsb = (imm3 << 2) | imm2;
-					uint32_t mask = 0xffffffff;
-					uint32_t msb_offset = 31 - msb;
-					mask = (mask >> lsb) << lsb;
-					mask = (mask << msb_offset) >> msb_offset;
-					uint32_t insert;
-					if (reg_src == pc) {
-						// BFC
-						insert = 0;
-					} else {
-						// BFI
-						insert = *reg_src << lsb;
-					}
-					*reg_dst = (*reg_dst & ~mask) | (insert & mask);
-				} else if (op == 0b110) {
-					// UBFX
-					uint32_t lsb         = (imm3 << 2) | imm2;
-					uint32_t widthminus1 = imm5;
-					uint32_t msb         = lsb + widthminus1;
-					*reg_dst = *reg_src << (31 - msb);
-					*reg_dst = *reg_dst >> (lsb + (31 - msb));
-				} else if (op == 0b010) {
-					// SBFX
-					uint32_t lsb         = (imm3 << 2) | imm2;
-					uint32_t widthminus1 = imm5;
-					uint32_t msb         = lsb + widthminus1;
-					*reg_dst = *reg_src << (31 - msb);
-					*reg_dst = (int32_t)*reg_dst >> (lsb + (31 - msb));
-				} else {
-					*pc -= 2; // undo 32-bit change
-					return ERR_UNDEFINED;
-				}
+	uint32_t txaddress = regs[(0x52c - 0x500) / 4] & 7;
+	machine_radio_send(machine, packet, header + length, regs[(0x508 - 0x500) / 4] & 0x17f, regs[(0x510 - 0x500) / 4] & 0xf, machine_radio_address(machine, txaddress));
 
-			} else {
-				*pc -= 2; // undo 32-bit change
-				return ERR_UNDEFINED;
-			}
+	machine_radio_event(machine, RADIO_EVENT_ADDRESS);
+	machine_radio_schedule(machine, RADIO_EVENT_END, machine_radio_airtime(machine, header + length));
+}
 
-		} else if ((hw1 >> 4) == 0b111100111011 && (hw2 >> 14) == 0b10) {
-			// Special control operations, ignore.
+// Trigger a task of the RADIO peripheral.
+static void machine_radio_task(machine_t *machine, uint32_t offset) {
+	radio_state_t state = machine->nrf.radio.state;
+	if (offset == 0x000 || offset == 0x004) { // TASKS_TXEN, TASKS_RXEN
+		if (state != RADIO_DISABLED) {
+			return;
+		}
+		machine->nrf.radio.state = offset == 0x000 ? RADIO_TXRU : RADIO_RXRU;
+		machine_periph_power(machine, PERIPH_RADIO, true);
+		machine_radio_schedule(machine, RADIO_EVENT_READY, 40); // ramp-up time
+	} else if (offset == 0x008) { // TASKS_START
+		if (state == RADIO_TXIDLE) {
+			machine->nrf.radio.state = RADIO_TX;
+			machine_radio_transmit(machine);
+		} else if (state == RADIO_RXIDLE) {
+			machine->nrf.radio.state = RADIO_RX; // wait forever for a packet
+		}
+	} else if (offset == 0x00c) { // TASKS_STOP
+		if (state == RADIO_TX || state == RADIO_RX) {
+			machine->nrf.radio.state = state == RADIO_TX ? RADIO_TXIDLE : RADIO_RXIDLE;
+			machine->nrf.radio.pending = false;
+		}
+	} else if (offset == 0x010) { // TASKS_DISABLE
+		if (state == RADIO_DISABLED) {
+			return;
+		}
+		machine->nrf.radio.state = RADIO_DISABLED;
+		machine->nrf.radio.pending = false;
+		machine_periph_power(machine, PERIPH_RADIO, false);
+		machine_radio_event(machine, RADIO_EVENT_DISABLED);
+		if (machine->nrf.radio.periph.shorts & (1 << 2)) { // DISABLED_TXEN
+			machine_radio_task(machine, 0x000);
+		} else if (machine->nrf.radio.periph.shorts & (1 << 3)) { // DISABLED_RXEN
+			machine_radio_task(machine, 0x004);
+		}
+	}
+}
 
-		} else if ((hw1 >> 11) == 0b11110 && ((hw2 >> 11) & 0b10111) == 0b10111) {
-			// BL, B.W
-			uint32_t imm10 = hw1 & 0x3ff;
-			uint32_t imm11 = hw2 & 0x7ff;
-			bool flag_link = (hw2 >> 14) & 0b1;
-			int32_t pc_offset = (int32_t)(((uint32_t)imm10 << 12) | ((uint32_t)imm11 << 1)); // >> 11;
-			pc_offset <<= 10; // put in the top bits
-			pc_offset >>= 10; // sign-extend
-			uint32_t new_pc = (int32_t)*pc + pc_offset;
-			machine_log(machine, LOG_CALLS, "%*sBL   %7x (sp: %x) -> %x\n", machine->call_depth * 2, "", *pc - 5, *sp, new_pc - 1);
-			machine_add_backtrace(machine, *pc - 5, *sp);
-			if (flag_link) {
-				*lr = *pc;
-			}
-			*pc = new_pc;
+// Generate the RADIO event that was scheduled, if it is time.
+static void machine_radio_update(machine_t *machine) {
+	if (!machine->nrf.radio.pending || machine_ticks(machine, 1000000) < machine->nrf.radio.pending_at) {
+		return;
+	}
+	machine->nrf.radio.pending = false;
+	uint32_t shorts = machine->nrf.radio.periph.shorts;
+	if (machine->nrf.radio.pending_event == RADIO_EVENT_READY) {
+		bool tx = machine->nrf.radio.state == RADIO_TXRU;
+		machine->nrf.radio.state = tx ? RADIO_TXIDLE : RADIO_RXIDLE;
+		machine_radio_event(machine, RADIO_EVENT_READY);
+		machine_radio_event(machine, tx ? RADIO_EVENT_TXREADY : RADIO_EVENT_RXREADY);
+		if (shorts & (1 << 0)) { // READY_START
+			machine_radio_task(machine, 0x008);
+		}
+	} else if (machine->nrf.radio.pending_event == RADIO_EVENT_END) {
+		machine->nrf.radio.state = machine->nrf.radio.state == RADIO_RX ? RADIO_RXIDLE : RADIO_TXIDLE;
+		machine_radio_event(machine, RADIO_EVENT_PAYLOAD);
+		machine_radio_event(machine, RADIO_EVENT_END);
+		if (shorts & (1 << 1)) { // END_DISABLE
+			machine_radio_task(machine, 0x010);
+		} else if (shorts & (1 << 6)) { // END_START
+			machine_radio_task(machine, 0x008);
+		}
+	}
+}
 
-		} else if ((hw1 >> 11) == 0b11110 && ((hw2 >> 12) & 0b1101) == 0b1000) {
-			// T3: B (conditional branch)
-			uint32_t cond = (hw1 >> 6) & 0b1111;
-			if ((cond >> 1) == 0b111) {
-				// Something else
-				if (hw1 == 0xf3ef && (hw2 >> 12) == 0b1000) {
-					// MRS
-					// I couldn't quickly find any documentation for the encoding
-					// of this instruction so this is mostly a guess based on what
-					// the disassembler produces.
-					uint32_t *reg_dst = &machine->regs[(hw2 >> 8) & 0b1111]; // Rd
-					uint32_t imm8 = (hw2 >> 0) & 0xff;
-					if (imm8 == 0x08) {
-						// MSP
-						// No MSP/PSP distinction implemented yet so assuming it
-						// equals the stack pointer.
-						*reg_dst = *sp;
-					} else {
-						*pc -= 2;
-						return ERR_UNDEFINED;
-					}
-				} else {
-					*pc -= 2;
-					return ERR_UNDEFINED;
-				}
-			} else if (machine_versioncheck(machine, CORTEX_M4)) {
-				uint32_t imm6 = hw1 & 0x3f;
-				uint32_t imm11 = hw2 & 0x7ff;
-				uint32_t s  = (hw1 >> 10) & 0b1;
-				uint32_t j1 = (hw2 >> 13) & 0b1;
-				uint32_t j2 = (hw2 >> 11) & 0b1;
-				int32_t pc_offset = (int32_t)((s << 20) | (j2 << 19) | (j1 << 18) | (imm6 << 12) | (imm11 << 1));
-				pc_offset <<= 11; // put in the top bits
-				pc_offset >>= 11; // sign-extend
-				uint32_t new_pc = (int32_t)*pc + pc_offset;
-				if (machine_condition(machine, cond)) {
-					*pc = new_pc;
-				}
-			}
+// Access a register of the RADIO peripheral.
+static uint32_t machine_radio_transfer(machine_t *machine, uint32_t offset, transfer_type_t transfer_type, uint32_t value) {
+	machine_radio_update(machine);
+	if (machine_nrf_common(machine, &machine->nrf.radio.periph, 1, offset, transfer_type, &value)) {
+		return value;
+	}
+	if (transfer_type == STORE && offset < 0x100) { // TASKS_*
+		machine_radio_task(machine, offset);
+	} else if (transfer_type == LOAD && offset == 0x400) { // CRCSTATUS
+		return 1;
+	} else if (transfer_type == LOAD && offset == 0x404) { // RXMATCH
+		return machine->nrf.radio.rxmatch;
+	} else if (transfer_type == LOAD && offset >= 0x408 && offset < 0x414) { // RXCRC, DAI, PDUSTAT
+	} else if (transfer_type == LOAD && offset == 0x550) { // STATE
+		return machine->nrf.radio.state;
+	} else if (offset >= 0x500 && offset < 0x600) { // configuration
+		uint32_t *reg = &machine->nrf.radio.regs[(offset - 0x500) / 4];
+		if (transfer_type == STORE) {
+			*reg = value;
+		}
+		return *reg;
+	} else if (offset >= 0x600 && offset < 0x780) { // DAB, DAP, DACNF, MODECNF0 etc.
+	} else if (offset == 0xffc) { // POWER
+		if (transfer_type == STORE) {
+			machine->nrf.radio.power = value & 1;
+		}
+		return machine->nrf.radio.power;
+	} else {
+		machine_log(machine, LOG_WARN, "unknown RADIO %s at offset 0x%03x (PC: %x)\n", transfer_type == LOAD ? "load" : "store", offset, machine->pc - 3);
+	}
+	return 0;
+}
 
-		} else if ((hw1 >> 9) == 0b1111100 && machine_versioncheck(machine, CORTEX_M4)) {
-			// Load and store single data item, and memory hints
-			uint32_t *reg_base   = &machine->regs[(hw1 >> 0 ) & 0b1111]; // Rn
-			uint32_t *reg_target = &machine->regs[(hw2 >> 12) & 0b1111]; // Rt
-			bool     flag_signed = (hw1 >> 8) & 0b1;
-			uint32_t size        = (hw1 >> 5) & 0b11;
-			bool     flag_load   = (hw1 >> 4) & 0b1;
+// Return whether the given chip select pin (port * 32 + pin) is driven low. A
+// negative pin means the device is always selected.
+static bool machine_chip_selected(machine_t *machine, int32_t cs) {
+	return cs < 0 || !machine_gpio_output(machine, cs);
+}
 
-			transfer_type_t transfer_type = flag_load ? LOAD : STORE;
-			width_t width;
-			if (size == 0b10) {
-				if (flag_signed) {
-					*pc -= 2;
-					return ERR_UNDEFINED;
-				}
-				width = WIDTH_32;
-			} else if (size == 0b00) {
-				width = WIDTH_8;
-			} else if (size == 0b01) {
-				width = WIDTH_16;
-			} else {
-				*pc -= 2;
-				return ERR_UNDEFINED;
+// Calculate the CRC7 used by SD card commands and registers.
+static uint8_t machine_sdcard_crc7(const uint8_t *data, size_t len) {
+	uint8_t crc = 0;
+	for (size_t i = 0; i < len; i++) {
+		for (int bit = 7; bit >= 0; bit--) {
+			uint8_t in = ((data[i] >> bit) & 1) ^ (crc >> 6);
+			crc = (crc << 1) & 0x7f;
+			if (in) {
+				crc ^= 0x09;
 			}
+		}
+	}
+	return crc;
+}
 
-			if (reg_base == pc) {
-				if (width != WIDTH_32 || !flag_load) {
-					// TODO: other widths
-					*pc -= 2;
-					return ERR_UNDEFINED;
-				}
-				// PC +/- imm12 (PC-relative)
-				uint32_t imm12 = (hw2 >> 0) & 0xfff;
-				bool flag_up = (hw1 >> 7) & 0b1;
-				uint32_t address = (*pc - 1) & ~3UL;
-				if (flag_up) {
-					address += imm12;
-				} else {
-					address -= imm12;
-				}
-				if (machine_transfer(machine, address, transfer_type, reg_target, width, flag_signed)) {
-					return ERR_MEM;
-				}
+// Calculate the CRC16 (CCITT) used by SD card data blocks.
+static uint16_t machine_sdcard_crc16(const uint8_t *data, size_t len) {
+	uint16_t crc = 0;
+	for (size_t i = 0; i < len; i++) {
+		crc ^= data[i] << 8;
+		for (int bit = 0; bit < 8; bit++) {
+			crc = crc & 0x8000 ? (crc << 1) ^ 0x1021 : crc << 1;
+		}
+	}
+	return crc;
+}
 
-			} else if (((hw1 >> 7) & 0b1) == 0b1) {
-				if (reg_base == pc) {
-					*pc -= 2;
-					return ERR_UNDEFINED;
-				} else {
-					// T3: LDR.W / STR.W (immediate)
-					uint32_t imm12 = (hw2 >> 0) & 0xfff;
-					uint32_t address = *reg_base + imm12;
-					if (machine_transfer(machine, address, transfer_type, reg_target, width, flag_signed)) {
-						return ERR_MEM;
-					}
-				}
+// Queue a byte to send to the SPI host.
+static void machine_sdcard_respond(machine_t *machine, uint8_t value) {
+	if (machine->sdcard.response_len < sizeof(machine->sdcard.response)) {
+		machine->sdcard.response[machine->sdcard.response_len++] = value;
+	}
+}
 
-			} else {
-				if (((hw2 >> 6) & 0b111111) == 0b000000) {
-					// T2: LDR.W / STR.W (register)
-					uint32_t *reg_off = &machine->regs[(hw2 >> 0) & 0b1111];
-					uint32_t shift = (hw2 >> 4) & 0b11;
-					uint32_t address = *reg_base + (*reg_off << shift);
-					if (machine_transfer(machine, address, transfer_type, reg_target, width, flag_signed)) {
-						return ERR_MEM;
-					}
+// Queue a data block: the start token, the data and its CRC. Registers like
+// the CSD are sent the same way as blocks read from the image.
+static void machine_sdcard_respond_data(machine_t *machine, const uint8_t *data, size_t len) {
+	uint16_t crc = machine_sdcard_crc16(data, len);
+	machine_sdcard_respond(machine, 0xff);
+	machine_sdcard_respond(machine, 0xfe); // start block token
+	for (size_t i = 0; i < len; i++) {
+		machine_sdcard_respond(machine, data[i]);
+	}
+	machine_sdcard_respond(machine, crc >> 8);
+	machine_sdcard_respond(machine, crc);
+}
 
-				} else if (((hw2 >> 11) & 0b1) == 0b1) {
-					// T4: LDR.W / STR.W (immediate)
-					bool flag_index = (hw2 >> 10) & 0b1;
-					bool flag_add   = (hw2 >> 9)  & 0b1;
-					bool flag_wback = (hw2 >> 8)  & 0b1;
-					uint32_t imm8   = (hw2 >> 0)  & 0xff;
-					uint32_t offset_addr = flag_add ? *reg_base + imm8 : *reg_base - imm8;
-					uint32_t address = flag_index ? offset_addr : *reg_base;
-					if (flag_wback) {
-						*reg_base = offset_addr;
-					}
-					if (machine_transfer(machine, address, transfer_type, reg_target, width, flag_signed)) {
-						return ERR_MEM;
-					}
+// Queue the next block of a read. It returns false (and queues a data error
+// token) if the block can't be read.
+static bool machine_sdcard_read_block(machine_t *machine) {
+	uint8_t block[512];
+	if (machine->sdcard.block >= machine->sdcard.blocks || machine->sdcard.io(machine, machine->sdcard.block, block, false) != ERR_OK) {
+		machine_sdcard_respond(machine, 0xff);
+		machine_sdcard_respond(machine, 0x08); // data error token: out of range
+		return false;
+	}
+	machine_sdcard_respond_data(machine, block, sizeof(block));
+	machine->sdcard.block++;
+	return true;
+}
 
-				} else {
-					*pc -= 2; // undo 32-bit change
-					return ERR_UNDEFINED;
-				}
-			}
+// Run a command that was received in SPI mode and queue its response. Only
+// SDHC cards are emulated, so addresses are block numbers.
+static void machine_sdcard_command(machine_t *machine) {
+	const uint8_t *cmd = machine->sdcard.cmd;
+	uint32_t index = cmd[0] & 0x3f;
+	uint32_t arg = (uint32_t)cmd[1] << 24 | cmd[2] << 16 | cmd[3] << 8 | cmd[4];
+	bool app_cmd = machine->sdcard.app_cmd;
+	machine->sdcard.app_cmd = false;
+	machine->sdcard.response_len = 0;
+	machine->sdcard.response_pos = 0;
+	machine->sdcard.state = SDCARD_IDLE;
+	machine_sdcard_respond(machine, 0xff); // one byte of response delay (NCR)
+	machine_log(machine, LOG_CALLS, "SD card: %sCMD%u (arg: %x)\n", app_cmd ? "A" : "", index, arg);
 
-		} else if ((hw1 >> 9) == 0b1111101 && machine_versioncheck(machine, CORTEX_M4)) {
-			// Data processing instructions, non-immediate
-			// (except for Data processing: constant shift)
-			uint32_t *reg_dst  = &machine->regs[(hw2 >> 8) & 0b1111]; // Rd
-			uint32_t *reg_src  = &machine->regs[(hw1 >> 0) & 0b1111]; // Rn
-			uint32_t *reg_src2 = &machine->regs[(hw2 >> 0) & 0b1111]; // Rm
-			if ((hw1 >> 7) == 0b111110100 && ((hw2 >> 7) & 0b111100001) == 0b111100000) {
-				// Register-controlled shift.
-				uint32_t op       = (hw1 >> 5) & 0b11;
-				bool     flag_set = (hw1 >> 4) & 0b1;
-				uint32_t op2      = (hw2 >> 4) & 0b111;
-				if (op2 != 0b000) {
-					*pc -= 2; // undo 32-bit change
-					return ERR_UNDEFINED;
-				}
-				if (op == 0b00) {
-					*reg_dst = machine_instr_lsl(machine, *reg_src, *reg_src2 & 0xff, flag_set);
-				} else if (op == 0b01) {
-					*reg_dst = machine_instr_lsr(machine, *reg_src, *reg_src2 & 0xff, flag_set);
-				} else if (op == 0b10) {
-					*reg_dst = machine_instr_asr(machine, *reg_src, *reg_src2 & 0xff, flag_set);
-				} else {
-					// ROR
-					*pc -= 2; // undo 32-bit change
-					return ERR_UNDEFINED;
-				}
-				if (flag_set) {
-					machine->psr.n = (int32_t)*reg_dst < 0;
-					machine->psr.z = *reg_dst == 0;
-				}
+	if (index == 0) { // GO_IDLE_STATE
+		machine_sdcard_respond(machine, 0x01); // R1: idle
+	} else if (index == 8) { // SEND_IF_COND
+		machine_sdcard_respond(machine, 0x01); // R7: R1 and the echoed voltage and check pattern
+		machine_sdcard_respond(machine, 0x00);
+		machine_sdcard_respond(machine, 0x00);
+		machine_sdcard_respond(machine, arg >> 8 & 0x0f);
+		machine_sdcard_respond(machine, arg);
+	} else if (index == 55) { // APP_CMD
+		machine->sdcard.app_cmd = true;
+		machine_sdcard_respond(machine, 0x00);
+	} else if (app_cmd && index == 41) { // SD_SEND_OP_COND: initialization is done immediately
+		machine_sdcard_respond(machine, 0x00);
+	} else if (index == 1) { // SEND_OP_COND (MMC)
+		machine_sdcard_respond(machine, 0x00);
+	} else if (index == 58) { // READ_OCR
+		machine_sdcard_respond(machine, 0x00); // R3: R1 and the OCR: powered up, SDHC, 2.7-3.6V
+		machine_sdcard_respond(machine, 0xc0);
+		machine_sdcard_respond(machine, 0xff);
+		machine_sdcard_respond(machine, 0x80);
+		machine_sdcard_respond(machine, 0x00);
+	} else if (index == 9) { // SEND_CSD: version 2.0, with the size in units of 512kB
+		uint32_t size = machine->sdcard.blocks / 1024;
+		size = size > 0 ? size - 1 : 0;
+		uint8_t csd[16] = {0x40, 0x0e, 0x00, 0x32, 0x5b, 0x59, 0x00, size >> 16 & 0x3f, size >> 8, size, 0x7f, 0x80, 0x0a, 0x40, 0x00, 0x00};
+		csd[15] = machine_sdcard_crc7(csd, 15) << 1 | 1;
+		machine_sdcard_respond(machine, 0x00);
+		machine_sdcard_respond_data(machine, csd, sizeof(csd));
+	} else if (index == 10) { // SEND_CID
+		uint8_t cid[16] = {0x00, 'E', 'M', 'E', 'M', 'C', 'U', 'L', 0x10, 0x45, 0x6d, 0x75, 0x6c, 0x01, 0x6a, 0x00};
+		cid[15] = machine_sdcard_crc7(cid, 15) << 1 | 1;
+		machine_sdcard_respond(machine, 0x00);
+		machine_sdcard_respond_data(machine, cid, sizeof(cid));
+	} else if (index == 13) { // SEND_STATUS, or SD_STATUS after CMD55
+		machine_sdcard_respond(machine, 0x00); // R2
+		machine_sdcard_respond(machine, 0x00);
+		if (app_cmd) {
+			uint8_t status[64] = {0};
+			machine_sdcard_respond_data(machine, status, sizeof(status));
+		}
+	} else if (index == 12) { // STOP_TRANSMISSION
+		machine_sdcard_respond(machine, 0xff); // stuff byte
+		machine_sdcard_respond(machine, 0x00);
+	} else if (index == 16 || index == 59 || (app_cmd && index == 23)) { // SET_BLOCKLEN, CRC_ON_OFF, SET_WR_BLK_ERASE_COUNT
+		machine_sdcard_respond(machine, 0x00);
+	} else if (index == 17 || index == 18) { // READ_SINGLE_BLOCK, READ_MULTIPLE_BLOCK
+		if (arg >= machine->sdcard.blocks) {
+			machine_sdcard_respond(machine, 0x40); // parameter error
+			return;
+		}
+		machine_sdcard_respond(machine, 0x00);
+		machine->sdcard.block = arg;
+		if (machine_sdcard_read_block(machine) && index == 18) {
+			machine->sdcard.state = SDCARD_READ;
+		}
+	} else if (index == 24 || index == 25) { // WRITE_BLOCK, WRITE_MULTIPLE_BLOCK
+		if (arg >= machine->sdcard.blocks) {
+			machine_sdcard_respond(machine, 0x40); // parameter error
+			return;
+		}
+		machine_sdcard_respond(machine, 0x00);
+		machine->sdcard.block = arg;
+		machine->sdcard.data_len = 0;
+		machine->sdcard.state = SDCARD_WRITE;
+	} else {
+		machine_log(machine, LOG_WARN, "SD card: unsupported %sCMD%u (PC: %x)\n", app_cmd ? "A" : "", index, machine->pc - 3);
+		machine_sdcard_respond(machine, 0x04); // illegal command
+	}
+}
+
+// Receive a byte of a block that is being written, and write the block to the
+// image once it is complete.
+static void machine_sdcard_write_byte(machine_t *machine, uint8_t in) {
+	bool multiple = (machine->sdcard.cmd[0] & 0x3f) == 25; // WRITE_MULTIPLE_BLOCK
+	if (machine->sdcard.state == SDCARD_WRITE) {
+		if (in == 0xfe || (in == 0xfc && multiple)) { // start block token
+			machine->sdcard.state = SDCARD_WRITE_DATA;
+			machine->sdcard.data_len = 0;
+		} else if (in == 0xfd && multiple) { // stop transmission token
+			machine->sdcard.state = SDCARD_IDLE;
+			machine_sdcard_respond(machine, 0xff);
+			machine_sdcard_respond(machine, 0x00); // busy
+		}
+		return;
+	}
+	machine->sdcard.data[machine->sdcard.data_len++] = in;
+	if (machine->sdcard.data_len < 514) {
+		return;
+	}
+
+	// The block and its CRC were received.
+	machine->sdcard.response_len = 0;
+	machine->sdcard.response_pos = 0;
+	uint8_t token = 0x05; // data accepted
+	if (machine->sdcard.block >= machine->sdcard.blocks || machine->sdcard.io(machine, machine->sdcard.block, machine->sdcard.data, true) != ERR_OK) {
+		token = 0x0d; // write error
+		machine->sdcard.state = SDCARD_IDLE;
+	} else {
+		machine->sdcard.block++;
+		machine->sdcard.state = multiple ? SDCARD_WRITE : SDCARD_IDLE;
+	}
+	machine_sdcard_respond(machine, token);
+	machine_sdcard_respond(machine, 0x00); // busy for one byte
+}
+
+// Transfer a byte to and from the SD card, as an SPI master would.
+static uint8_t machine_sdcard_transfer(machine_t *machine, uint8_t in) {
+	if (machine->sdcard.io == NULL || !machine_chip_selected(machine, machine->sdcard.cs)) {
+		machine->sdcard.cmd_len = 0;
+		return 0xff;
+	}
+
+	uint8_t out = 0xff;
+	if (machine->sdcard.response_pos < machine->sdcard.response_len) {
+		out = machine->sdcard.response[machine->sdcard.response_pos++];
+	} else if (machine->sdcard.state == SDCARD_READ) {
+		// Queue the next block of a multiple block read.
+		machine->sdcard.response_len = 0;
+		machine->sdcard.response_pos = 0;
+		if (!machine_sdcard_read_block(machine)) {
+			machine->sdcard.state = SDCARD_IDLE;
+		}
+	}
+
+	if (machine->sdcard.state == SDCARD_WRITE || machine->sdcard.state == SDCARD_WRITE_DATA) {
+		if (machine->sdcard.response_pos >= machine->sdcard.response_len) {
+			machine_sdcard_write_byte(machine, in);
+		}
+		return out;
+	}
+	if (machine->sdcard.cmd_len == 0 && (in & 0xc0) != 0x40) {
+		return out; // not the start of a command
+	}
+	machine->sdcard.cmd[machine->sdcard.cmd_len++] = in;
+	if (machine->sdcard.cmd_len == 6) {
+		machine->sdcard.cmd_len = 0;
+		machine_sdcard_command(machine);
+	}
+	return out;
+}
+
+// Tell the SPI devices of the host about changes of their chip select pins.
+static void machine_bus_update_cs(machine_t *machine) {
+	for (uint32_t i = 0; i < machine->bus.spi_devices; i++) {
+		bool selected = machine_chip_selected(machine, machine->bus.spi_cs[i]);
+		if (selected == ((machine->bus.spi_selected >> i) & 1)) {
+			continue;
+		}
+		machine->bus.spi_selected ^= 1 << i;
+		machine_bus_traced(machine, selected ? BUS_SPI_SELECT : BUS_SPI_DESELECT, i, 0, 0, true);
+		if (machine->bus.io != NULL) {
+			machine->bus.io(machine, selected ? BUS_SPI_SELECT : BUS_SPI_DESELECT, i, NULL);
+		}
+	}
+}
+
+// Transfer a byte over the SPI bus, to the SD card and the selected devices of
+// the host. MISO floats high when no device drives it.
+static uint8_t machine_spi_byte(machine_t *machine, uint8_t in) {
+	uint8_t out = machine_sdcard_transfer(machine, in);
+	machine_bus_update_cs(machine);
+	for (uint32_t i = 0; i < machine->bus.spi_devices && machine->bus.io != NULL; i++) {
+		if ((machine->bus.spi_selected >> i) & 1) {
+			uint8_t data = in;
+			machine->bus.io(machine, BUS_SPI_TRANSFER, i, &data);
+			out &= data;
+		}
+	}
+	machine_bus_traced(machine, BUS_SPI_TRANSFER, machine->bus.spi_selected, in, out, true);
+	return out;
+}
+
+// Send a (repeated) start condition and the address byte on the I2C bus.
+// Returns whether a device acknowledged the address.
+static bool machine_i2c_start(machine_t *machine, uint8_t address) {
+	bool ack = machine->bus.io != NULL && machine->bus.io(machine, BUS_I2C_START, 0, &address) == ERR_OK;
+	machine_bus_traced(machine, BUS_I2C_START, 0, address, 0, ack);
+	return ack;
+}
+
+// Write a byte to the addressed I2C device. Returns whether it was
+// acknowledged.
+static bool machine_i2c_write(machine_t *machine, uint8_t value) {
+	bool ack = machine->bus.io != NULL && machine->bus.io(machine, BUS_I2C_WRITE, 0, &value) == ERR_OK;
+	machine_bus_traced(machine, BUS_I2C_WRITE, 0, value, 0, ack);
+	return ack;
+}
+
+// Read a byte from the addressed I2C device. SDA floats high when there is no
+// device.
+static uint8_t machine_i2c_read(machine_t *machine) {
+	uint8_t value = 0xff;
+	if (machine->bus.io != NULL) {
+		machine->bus.io(machine, BUS_I2C_READ, 0, &value);
+	}
+	machine_bus_traced(machine, BUS_I2C_READ, 0, 0, value, true);
+	return value;
+}
+
+// Send a stop condition on the I2C bus.
+static void machine_i2c_stop(machine_t *machine) {
+	if (machine->bus.io != NULL) {
+		machine->bus.io(machine, BUS_I2C_STOP, 0, NULL);
+	}
+	machine_bus_traced(machine, BUS_I2C_STOP, 0, 0, 0, true);
+}
+
+// Move a PTR register of SPIM or TWIM (RXD.PTR or TXD.PTR) to the next buffer
+// after a transfer of maxcnt bytes, if its LIST register (at PTR + 0xc)
+// selects an array list. The next transfer then continues with the next
+// buffer of the array without the CPU, as when it is started through PPI.
+static void machine_dma_list(uint32_t *regs, uint32_t ptr, uint32_t maxcnt) {
+	if ((regs[(ptr + 0xc - 0x500) / 4] & 3) == 1) { // ArrayList
+		regs[(ptr - 0x500) / 4] += maxcnt;
+	}
+}
+
+// Run an EasyDMA transfer of SPIM: send TXD.MAXCNT bytes (followed by ORC)
+// while receiving RXD.MAXCNT bytes. It completes immediately.
+static void machine_spim_start(machine_t *machine, int index) {
+	uint32_t *regs = machine->nrf.spi[index].regs;
+	nrf_periph_t *periph = &machine->nrf.spi[index].periph;
+	uint32_t base = nrf_spi_base[index], irq = (base >> 12) & 0x3f;
+	uint32_t rx_ptr = regs[(0x534 - 0x500) / 4], rx_max = regs[(0x538 - 0x500) / 4];
+	uint32_t tx_ptr = regs[(0x544 - 0x500) / 4], tx_max = regs[(0x548 - 0x500) / 4];
+	uint32_t transfer_address = machine->transfer_address;
+	machine_dma_check(machine, "SPIM RXD", rx_ptr, rx_max);
+	machine_dma_check(machine, "SPIM TXD", tx_ptr, tx_max);
+	machine_nrf_event(machine, periph, base, irq, 19); // STARTED
+	for (uint32_t i = 0; i < rx_max || i < tx_max; i++) {
+		uint32_t c = regs[(0x5c0 - 0x500) / 4] & 0xff; // ORC
+		if (i < tx_max) {
+			machine_transfer(machine, tx_ptr + i, LOAD, &c, WIDTH_8, false);
+		}
+		c = machine_spi_byte(machine, c);
+		if (i < rx_max) {
+			machine_transfer(machine, rx_ptr + i, STORE, &c, WIDTH_8, false);
+		}
+	}
+	machine->transfer_address = transfer_address;
+	regs[(0x53c - 0x500) / 4] = rx_max; // RXD.AMOUNT
+	regs[(0x54c - 0x500) / 4] = tx_max; // TXD.AMOUNT
+	machine_dma_list(regs, 0x534, rx_max);
+	machine_dma_list(regs, 0x544, tx_max);
+	machine_nrf_event(machine, periph, base, irq, 4); // ENDRX
+	machine_nrf_event(machine, periph, base, irq, 8); // ENDTX
+	machine_nrf_event(machine, periph, base, irq, 6); // END
+}
+
+// Start an I2C transfer for TWI or TWIM in the given direction, to the
+// device in the ADDRESS register. When the address is not acknowledged, this
+// generates the ERROR event and returns false.
+static bool machine_twi_begin(machine_t *machine, int index, bool read) {
+	nrf_periph_t *periph = &machine->nrf.spi[index].periph;
+	uint32_t base = nrf_spi_base[index];
+	uint32_t address = machine->nrf.spi[index].regs[(0x588 - 0x500) / 4] & 0x7f;
+	machine->nrf.spi[index].twi_active = true;
+	machine->nrf.spi[index].twi_read = read;
+	if (!machine_i2c_start(machine, address << 1 | read)) {
+		machine->nrf.spi[index].errorsrc |= 1 << 1; // ANACK
+		machine_nrf_event(machine, periph, base, (base >> 12) & 0x3f, 9); // ERROR
+		return false;
+	}
+	return true;
+}
+
+// Stop the current I2C transfer of TWI or TWIM.
+static void machine_twi_stop(machine_t *machine, int index) {
+	nrf_periph_t *periph = &machine->nrf.spi[index].periph;
+	uint32_t base = nrf_spi_base[index];
+	if (machine->nrf.spi[index].twi_active) {
+		machine_i2c_stop(machine);
+		machine->nrf.spi[index].twi_active = false;
+	}
+	machine->nrf.spi[index].twi_suspended = false;
+	machine_nrf_event(machine, periph, base, (base >> 12) & 0x3f, 1); // STOPPED
+}
+
+// Run a task of TWIM. The EasyDMA transfers complete immediately, after which
+// the LASTTX/LASTRX shorts are applied.
+static void machine_twim_task(machine_t *machine, int index, uint32_t offset) {
+	uint32_t *regs = machine->nrf.spi[index].regs;
+	nrf_periph_t *periph = &machine->nrf.spi[index].periph;
+	uint32_t base = nrf_spi_base[index], irq = (base >> 12) & 0x3f;
+	uint32_t transfer_address = machine->transfer_address;
+	if (offset == 0x008) { // STARTTX
+		uint32_t tx_ptr = regs[(0x544 - 0x500) / 4], tx_max = regs[(0x548 - 0x500) / 4];
+		// After LASTTX_SUSPEND and RESUME, the next buffer continues the
+		// same write without a repeated start.
+		bool resume = machine->nrf.spi[index].twi_suspended && machine->nrf.spi[index].twi_active && !machine->nrf.spi[index].twi_read;
+		machine->nrf.spi[index].twi_suspended = false;
+		if (!resume && !machine_twi_begin(machine, index, false)) {
+			return;
+		}
+		machine_dma_check(machine, "TWIM TXD", tx_ptr, tx_max);
+		machine_nrf_event(machine, periph, base, irq, 20); // TXSTARTED
+		uint32_t i;
+		for (i = 0; i < tx_max; i++) {
+			uint32_t c = 0;
+			machine_transfer(machine, tx_ptr + i, LOAD, &c, WIDTH_8, false);
+			if (!machine_i2c_write(machine, c)) {
+				machine->nrf.spi[index].errorsrc |= 1 << 2; // DNACK
+				machine_nrf_event(machine, periph, base, irq, 9); // ERROR
+				break;
+			}
+		}
+		machine->transfer_address = transfer_address;
+		regs[(0x54c - 0x500) / 4] = i; // TXD.AMOUNT
+		machine_dma_list(regs, 0x544, tx_max);
+		machine_nrf_event(machine, periph, base, irq, 24); // LASTTX
+		if (periph->shorts & (1 << 7)) { // LASTTX_STARTRX
+			machine_twim_task(machine, index, 0x000);
+		} else if (periph->shorts & (1 << 8)) { // LASTTX_SUSPEND
+			machine->nrf.spi[index].twi_suspended = true;
+			machine_nrf_event(machine, periph, base, irq, 18); // SUSPENDED
+		} else if (periph->shorts & (1 << 9)) { // LASTTX_STOP
+			machine_twi_stop(machine, index);
+		}
+	} else if (offset == 0x000) { // STARTRX
+		uint32_t rx_ptr = regs[(0x534 - 0x500) / 4], rx_max = regs[(0x538 - 0x500) / 4];
+		machine->nrf.spi[index].twi_suspended = false;
+		if (!machine_twi_begin(machine, index, true)) {
+			return;
+		}
+		machine_dma_check(machine, "TWIM RXD", rx_ptr, rx_max);
+		machine_nrf_event(machine, periph, base, irq, 19); // RXSTARTED
+		for (uint32_t i = 0; i < rx_max; i++) {
+			uint32_t c = machine_i2c_read(machine);
+			machine_transfer(machine, rx_ptr + i, STORE, &c, WIDTH_8, false);
+		}
+		machine->transfer_address = transfer_address;
+		regs[(0x53c - 0x500) / 4] = rx_max; // RXD.AMOUNT
+		machine_dma_list(regs, 0x534, rx_max);
+		machine_nrf_event(machine, periph, base, irq, 23); // LASTRX
+		if (periph->shorts & (1 << 10)) { // LASTRX_STARTTX
+			machine_twim_task(machine, index, 0x008);
+		} else if (periph->shorts & (1 << 12)) { // LASTRX_STOP
+			machine_twi_stop(machine, index);
+		}
+	} else if (offset == 0x014) { // STOP
+		machine_twi_stop(machine, index);
+	} else if (offset == 0x01c) { // SUSPEND
+		machine_nrf_event(machine, periph, base, irq, 18); // SUSPENDED
+	}
+}
+
+// Generate the BB (byte boundary) event of the legacy TWI peripheral and
+// apply its shorts.
+static void machine_twi_byte_boundary(machine_t *machine, int index) {
+	nrf_periph_t *periph = &machine->nrf.spi[index].periph;
+	uint32_t base = nrf_spi_base[index], irq = (base >> 12) & 0x3f;
+	machine_nrf_event(machine, periph, base, irq, 14); // BB
+	if (periph->shorts & (1 << 1)) { // BB_STOP
+		machine_twi_stop(machine, index);
+	} else if (periph->shorts & (1 << 0)) { // BB_SUSPEND
+		machine_nrf_event(machine, periph, base, irq, 18); // SUSPENDED
+	}
+}
+
+// Receive a byte with the legacy TWI peripheral into RXD.
+static void machine_twi_receive(machine_t *machine, int index) {
+	nrf_periph_t *periph = &machine->nrf.spi[index].periph;
+	uint32_t base = nrf_spi_base[index], irq = (base >> 12) & 0x3f;
+	machine->nrf.spi[index].rxd = machine_i2c_read(machine);
+	machine->nrf.spi[index].rxd_pending = true;
+	machine_nrf_event(machine, periph, base, irq, 2); // RXDREADY
+	machine_twi_byte_boundary(machine, index);
+}
+
+// Run a task of the legacy TWI peripheral. Reads are done one byte at a time:
+// the next byte is only received after RXD was read and the transfer was
+// resumed, like the clock stretching of the real peripheral.
+static void machine_twi_task(machine_t *machine, int index, uint32_t offset) {
+	if (offset == 0x008) { // STARTTX
+		machine_twi_begin(machine, index, false);
+	} else if (offset == 0x000) { // STARTRX
+		machine->nrf.spi[index].rxd_pending = false;
+		if (machine_twi_begin(machine, index, true)) {
+			machine_twi_receive(machine, index);
+		}
+	} else if (offset == 0x014) { // STOP
+		machine_twi_stop(machine, index);
+	} else if (offset == 0x020) { // RESUME
+		if (!machine->nrf.spi[index].twi_active || !machine->nrf.spi[index].twi_read) {
+			return;
+		}
+		if (!machine->nrf.spi[index].rxd_pending) {
+			machine_twi_receive(machine, index);
+		} else if (machine->nrf.spi[index].periph.shorts & (1 << 1)) { // BB_STOP
+			// The last byte was already received, before it was read.
+			machine_twi_stop(machine, index);
+		}
+	}
+}
+
+// Access a register of an SPI (ENABLE=1), SPIM (ENABLE=7), TWI (ENABLE=5) or
+// TWIM (ENABLE=6) peripheral. The SD card and the SPI and I2C devices of the
+// host are on the bus.
+static uint32_t machine_spi_transfer(machine_t *machine, int index, uint32_t offset, transfer_type_t transfer_type, uint32_t value) {
+	nrf_periph_t *periph = &machine->nrf.spi[index].periph;
+	uint32_t base = nrf_spi_base[index];
+	if (machine_nrf_common(machine, periph, (base >> 12) & 0x3f, offset, transfer_type, &value)) {
+		return value;
+	}
+	uint32_t enable = machine->nrf.spi[index].regs[0];
+	if (transfer_type == STORE && offset < 0x100) { // TASKS_*
+		if (offset == 0x010 && enable == 7) { // START
+			machine_spim_start(machine, index);
+		} else if (enable == 6) {
+			machine_twim_task(machine, index, offset);
+		} else if (enable == 5) {
+			machine_twi_task(machine, index, offset);
+		}
+	} else if ((enable == 5 || enable == 6) && offset == 0x4c4) { // ERRORSRC
+		if (transfer_type == STORE) {
+			machine->nrf.spi[index].errorsrc &= ~value;
+		}
+		return machine->nrf.spi[index].errorsrc;
+	} else if ((enable == 1 || enable == 5) && offset == 0x518) { // RXD
+		machine->nrf.spi[index].rxd_pending = false;
+		return machine->nrf.spi[index].rxd;
+	} else if (enable == 1 && offset == 0x51c) { // TXD
+		if (transfer_type == STORE) {
+			machine->nrf.spi[index].rxd = machine_spi_byte(machine, value);
+			machine_nrf_event(machine, periph, base, (base >> 12) & 0x3f, 2); // READY
+		}
+	} else if (enable == 5 && offset == 0x51c) { // TXD
+		if (transfer_type == STORE && machine->nrf.spi[index].twi_active && !machine->nrf.spi[index].twi_read) {
+			if (machine_i2c_write(machine, value)) {
+				machine_nrf_event(machine, periph, base, (base >> 12) & 0x3f, 7); // TXDSENT
+			} else {
+				machine->nrf.spi[index].errorsrc |= 1 << 2; // DNACK
+				machine_nrf_event(machine, periph, base, (base >> 12) & 0x3f, 9); // ERROR
+			}
+			machine_twi_byte_boundary(machine, index);
+		}
+	} else if (offset >= 0x500 && offset < 0x5c8) { // configuration
+		uint32_t *reg = &machine->nrf.spi[index].regs[(offset - 0x500) / 4];
+		if (transfer_type == STORE) {
+			*reg = value;
+		}
+		return *reg;
+	} else {
+		machine_log(machine, LOG_WARN, "unknown SPI %s at offset 0x%03x (PC: %x)\n", transfer_type == LOAD ? "load" : "store", offset, machine->pc - 3);
+	}
+	return 0;
+}
+
+// Play a sequence of a PWM peripheral. Only the waveform of the pins that
+// the WS2812 decoder watches matters, so it is decoded right away and the
+// sequence ends immediately. LOOP and the loop shortcuts are not supported:
+// the sequence plays once.
+static void machine_pwm_seqstart(machine_t *machine, int index, int seq) {
+	uint32_t *regs = machine->nrf.pwm[index].regs;
+	nrf_periph_t *periph = &machine->nrf.pwm[index].periph;
+	uint32_t base = nrf_pwm_base[index], irq = (base >> 12) & 0x3f;
+	uint32_t ptr = regs[(0x520 + seq * 0x20 - 0x500) / 4];
+	uint32_t cnt = regs[(0x524 + seq * 0x20 - 0x500) / 4] & 0x7fff;
+	uint32_t refresh = regs[(0x528 + seq * 0x20 - 0x500) / 4] & 0xffffff;
+	uint32_t countertop = regs[(0x508 - 0x500) / 4] & 0x7fff;
+	uint32_t prescaler = regs[(0x50c - 0x500) / 4] & 7;
+	uint32_t load = regs[(0x510 - 0x500) / 4] & 3; // DECODER.LOAD
+	uint32_t channels = load == 0 ? 1 : load == 1 ? 2 : 4; // values per period: common, grouped, individual and waveform
+	machine_nrf_event(machine, periph, base, irq, 2 + seq); // SEQSTARTED[n]
+	int channel = -1;
+	for (int i = 0; i < 4; i++) {
+		if (machine->ws2812.frame != NULL && regs[(0x560 - 0x500) / 4 + i] == (uint32_t)machine->ws2812.pin) { // PSEL.OUT[n]
+			channel = i;
+		}
+	}
+	if (channel >= 0 && (regs[0] & 1) && countertop != 0) { // ENABLE
+		// The value of a channel of grouped values is shared by two channels.
+		uint32_t slot = load == 1 ? channel / 2 : load == 0 ? 0 : channel;
+		uint64_t period = (uint64_t)countertop * machine->clock / (16000000 >> prescaler);
+		uint64_t cycle = machine->stats.cycles;
+		if (machine->ws2812.edge > cycle) {
+			cycle = machine->ws2812.edge; // the previous sequence is still playing
+		}
+		uint32_t transfer_address = machine->transfer_address;
+		for (uint32_t i = 0; i + slot < cnt; i += channels) {
+			uint32_t value = 0;
+			machine_transfer(machine, ptr + (i + slot) * 2, LOAD, &value, WIDTH_16, false);
+			uint32_t compare = value & 0x7fff;
+			if (compare > countertop) {
+				compare = countertop;
+			}
+			// With the FallingEdge polarity (bit 15) the output starts high
+			// and goes low at the compare value, otherwise it is the other
+			// way around.
+			uint32_t high = value & 0x8000 ? compare : countertop - compare;
+			for (uint32_t n = 0; n <= refresh; n++) {
+				machine_ws2812_edge(machine, high != 0, cycle);
+				machine_ws2812_edge(machine, false, cycle + period * high / countertop);
+				cycle += period;
+			}
+		}
+		machine->transfer_address = transfer_address;
+	}
+	machine_nrf_event(machine, periph, base, irq, 4 + seq); // SEQEND[n]
+	if (periph->shorts & (1 << seq)) { // SEQENDn_STOP
+		machine_nrf_event(machine, periph, base, irq, 1); // STOPPED
+	}
+}
+
+// Access a register of a PWM peripheral. See machine_pwm_seqstart.
+static uint32_t machine_pwm_transfer(machine_t *machine, int index, uint32_t offset, transfer_type_t transfer_type, uint32_t value) {
+	nrf_periph_t *periph = &machine->nrf.pwm[index].periph;
+	uint32_t base = nrf_pwm_base[index];
+	if (machine_nrf_common(machine, periph, (base >> 12) & 0x3f, offset, transfer_type, &value)) {
+		return value;
+	}
+	if (transfer_type == STORE && offset == 0x004) { // TASKS_STOP
+		machine_nrf_event(machine, periph, base, (base >> 12) & 0x3f, 1); // STOPPED
+	} else if (transfer_type == STORE && (offset == 0x008 || offset == 0x00c)) { // TASKS_SEQSTART[n]
+		machine_pwm_seqstart(machine, index, (offset - 0x008) / 4);
+	} else if (transfer_type == STORE && offset == 0x010) { // TASKS_NEXTSTEP
+	} else if (offset >= 0x500 && offset <= 0x56c) {
+		uint32_t *reg = &machine->nrf.pwm[index].regs[(offset - 0x500) / 4];
+		if (transfer_type == STORE) {
+			*reg = value;
+		}
+		return *reg;
+	} else {
+		machine_log(machine, LOG_WARN, "unknown PWM %s at offset 0x%03x (PC: %x)\n", transfer_type == LOAD ? "load" : "store", offset, machine->pc - 3);
+	}
+	return 0;
+}
+
+// MCKFREQ values of the I2S peripheral and the divider of the 32MHz clock
+// they select. The register is documented as a fraction of 2^32, but the
+// hardware doesn't quite follow that.
+static const uint32_t nrf_i2s_mckfreq[][2] = {
+	{0x20000000, 8}, {0x18000000, 10}, {0x16000000, 11}, {0x11000000, 15},
+	{0x10000000, 16}, {0x0c000000, 21}, {0x0b000000, 23}, {0x08800000, 30},
+	{0x08400000, 31}, {0x08000000, 32}, {0x06000000, 42}, {0x04100000, 63},
+	{0x020c0000, 125},
+};
+
+// Return the sample rate (the LRCK frequency) of the I2S peripheral.
+static uint32_t machine_i2s_rate(machine_t *machine) {
+	static const uint32_t ratios[9] = {32, 48, 64, 96, 128, 192, 256, 384, 512};
+	uint32_t *regs = machine->nrf.i2s.regs;
+	uint32_t mckfreq = regs[(0x514 - 0x500) / 4];
+	uint32_t ratio = regs[(0x518 - 0x500) / 4];
+	uint32_t mck = (uint64_t)32000000 * mckfreq >> 32;
+	for (size_t i = 0; i < sizeof(nrf_i2s_mckfreq) / sizeof(nrf_i2s_mckfreq[0]); i++) {
+		if (nrf_i2s_mckfreq[i][0] == mckfreq) {
+			mck = 32000000 / nrf_i2s_mckfreq[i][1];
+		}
+	}
+	uint32_t rate = mck / ratios[ratio < 9 ? ratio : 8];
+	return rate != 0 ? rate : 1;
+}
+
+// Return the width of the I2S samples in bits, and the number of channels.
+static uint32_t machine_i2s_format(machine_t *machine, uint32_t *channels) {
+	uint32_t *regs = machine->nrf.i2s.regs;
+	*channels = regs[(0x528 - 0x500) / 4] == 0 ? 2 : 1; // CHANNELS: stereo, left or right
+	uint32_t swidth = regs[(0x51c - 0x500) / 4];
+	return swidth == 0 ? 8 : swidth == 1 ? 16 : 24;
+}
+
+// Play and record the buffers of the I2S peripheral that were latched at the
+// last TXPTRUPD and RXPTRUPD events. Samples of 8 and 16 bits are packed in
+// the 32-bit words of the buffers, samples of 24 bits take a word each. The
+// samples are exchanged with the host in chunks of MACHINE_AUDIO_CHUNK.
+static void machine_i2s_buffer(machine_t *machine, uint64_t time) {
+	uint32_t *regs = machine->nrf.i2s.regs;
+	uint32_t maxcnt = regs[(0x550 - 0x500) / 4] & 0x3fff; // RXTXD.MAXCNT, in words
+	uint32_t channels;
+	uint32_t bits = machine_i2s_format(machine, &channels);
+	uint32_t size = bits == 24 ? 32 : bits; // bits of memory per sample
+	width_t width = size == 8 ? WIDTH_8 : size == 16 ? WIDTH_16 : WIDTH_32;
+	uint32_t count = maxcnt * (32 / size) / channels * channels;
+	uint32_t transfer_address = machine->transfer_address;
+	for (uint32_t pos = 0; pos < count; pos += MACHINE_AUDIO_CHUNK) {
+		int32_t samples[MACHINE_AUDIO_CHUNK];
+		uint32_t n = count - pos < MACHINE_AUDIO_CHUNK ? count - pos : MACHINE_AUDIO_CHUNK;
+		if (regs[(0x50c - 0x500) / 4] & 1) { // CONFIG.TXEN
+			for (uint32_t i = 0; i < n; i++) {
+				uint32_t word = 0;
+				machine_transfer(machine, machine->nrf.i2s.txd_ptr + (pos + i) * size / 8, LOAD, &word, width, false);
+				samples[i] = (int32_t)(word << (32 - bits));
+			}
+			machine->stats.audio_out += n / channels;
+			if (machine->audio.io != NULL) {
+				machine->audio.io(machine, false, time + pos / channels, samples, n / channels, channels, machine->nrf.i2s.rate, bits);
+			}
+		}
+		if (regs[(0x508 - 0x500) / 4] & 1) { // CONFIG.RXEN
+			memset(samples, 0, sizeof(samples));
+			if (machine->audio.io != NULL) {
+				machine->audio.io(machine, true, time + pos / channels, samples, n / channels, channels, machine->nrf.i2s.rate, bits);
+			}
+			machine->stats.audio_in += n / channels;
+			for (uint32_t i = 0; i < n; i++) {
+				// 24-bit samples are sign extended to the whole word.
+				uint32_t word = (uint32_t)(samples[i] >> (32 - bits));
+				machine_transfer(machine, machine->nrf.i2s.rxd_ptr + (pos + i) * size / 8, STORE, &word, width, false);
+			}
+		}
+	}
+	machine->transfer_address = transfer_address;
+}
+
+// Latch the buffer pointers of the I2S peripheral, so that the firmware can
+// set up the next buffers.
+static void machine_i2s_ptrupd(machine_t *machine) {
+	uint32_t *regs = machine->nrf.i2s.regs;
+	machine->nrf.i2s.rxd_ptr = regs[(0x538 - 0x500) / 4];
+	machine->nrf.i2s.txd_ptr = regs[(0x540 - 0x500) / 4];
+	if (regs[(0x508 - 0x500) / 4] & 1) { // CONFIG.RXEN
+		machine_nrf_event(machine, &machine->nrf.i2s.periph, 0x40025000, 37, 1); // RXPTRUPD
+	}
+	if (regs[(0x50c - 0x500) / 4] & 1) { // CONFIG.TXEN
+		machine_nrf_event(machine, &machine->nrf.i2s.periph, 0x40025000, 37, 5); // TXPTRUPD
+	}
+}
+
+// Finish the I2S buffers when the time to play them has passed.
+static void machine_i2s_update(machine_t *machine) {
+	if (!machine->nrf.i2s.started) {
+		return;
+	}
+	uint32_t channels;
+	uint32_t bits = machine_i2s_format(machine, &channels);
+	uint32_t maxcnt = machine->nrf.i2s.regs[(0x550 - 0x500) / 4] & 0x3fff;
+	uint32_t frames = maxcnt * (bits == 24 ? 1 : 32 / bits) / channels;
+	if (frames == 0 || machine_ticks(machine, machine->nrf.i2s.rate) - machine->nrf.i2s.start < frames) {
+		return;
+	}
+	machine_i2s_buffer(machine, machine->nrf.i2s.start);
+	machine->nrf.i2s.start += frames;
+	machine_i2s_ptrupd(machine);
+}
+
+// Access a register of the I2S peripheral. Samples are exchanged a buffer at
+// a time, when the buffer would have been played completely. The IRQ (37) is
+// above MACHINE_NUM_IRQS, so the firmware has to poll the events. Only master
+// mode is supported.
+static uint32_t machine_i2s_transfer(machine_t *machine, uint32_t offset, transfer_type_t transfer_type, uint32_t value) {
+	nrf_periph_t *periph = &machine->nrf.i2s.periph;
+	if (machine_nrf_common(machine, periph, 37, offset, transfer_type, &value)) {
+		return value;
+	}
+	if (transfer_type == STORE && offset == 0x000) { // TASKS_START
+		if ((machine->nrf.i2s.regs[0] & 1) && !machine->nrf.i2s.started) { // ENABLE
+			machine->nrf.i2s.started = true;
+			machine->nrf.i2s.rate = machine_i2s_rate(machine);
+			machine->nrf.i2s.start = machine_ticks(machine, machine->nrf.i2s.rate);
+			machine_i2s_ptrupd(machine);
+		}
+	} else if (transfer_type == STORE && offset == 0x004) { // TASKS_STOP
+		if (machine->nrf.i2s.started) {
+			machine->nrf.i2s.started = false;
+			machine_nrf_event(machine, periph, 0x40025000, 37, 2); // STOPPED
+		}
+	} else if (offset >= 0x500 && offset <= 0x570) {
+		uint32_t *reg = &machine->nrf.i2s.regs[(offset - 0x500) / 4];
+		if (transfer_type == STORE) {
+			*reg = value;
+		}
+		return *reg;
+	} else {
+		machine_log(machine, LOG_WARN, "unknown I2S %s at offset 0x%03x (PC: %x)\n", transfer_type == LOAD ? "load" : "store", offset, machine->pc - 3);
+	}
+	return 0;
+}
+
+// PDMCLKCTRL values and the PDM clock frequency they select.
+static const uint32_t nrf_pdm_clk[][2] = {
+	{0x08000000, 1000000}, {0x08400000, 1032000}, {0x08800000, 1067000},
+	{0x09800000, 1231000}, {0x0a000000, 1280000}, {0x0a800000, 1333000},
+};
+
+// Return the sample rate of the PDM peripheral: the PDM clock divided by the
+// decimation ratio.
+static uint32_t machine_pdm_rate(machine_t *machine) {
+	uint32_t *regs = machine->nrf.pdm.regs;
+	uint32_t pdmclkctrl = regs[(0x504 - 0x500) / 4];
+	uint32_t clk = (uint64_t)32000000 * pdmclkctrl >> 32;
+	for (size_t i = 0; i < sizeof(nrf_pdm_clk) / sizeof(nrf_pdm_clk[0]); i++) {
+		if (nrf_pdm_clk[i][0] == pdmclkctrl) {
+			clk = nrf_pdm_clk[i][1];
+		}
+	}
+	uint32_t rate = clk / (regs[(0x520 - 0x500) / 4] & 1 ? 80 : 64); // RATIO
+	return rate != 0 ? rate : 1;
+}
+
+// Fill the PDM buffer that was latched at the last STARTED event with 16-bit
+// samples from the host, applying the gain of each channel.
+static void machine_pdm_buffer(machine_t *machine, uint64_t time) {
+	uint32_t *regs = machine->nrf.pdm.regs;
+	uint32_t channels = regs[(0x508 - 0x500) / 4] & 1 ? 1 : 2; // MODE.OPERATION: stereo or mono
+	uint32_t count = (regs[(0x564 - 0x500) / 4] & 0x7fff) / channels * channels; // SAMPLE.MAXCNT, in samples
+	uint32_t transfer_address = machine->transfer_address;
+	for (uint32_t pos = 0; pos < count; pos += MACHINE_AUDIO_CHUNK) {
+		int32_t samples[MACHINE_AUDIO_CHUNK] = {0};
+		uint32_t n = count - pos < MACHINE_AUDIO_CHUNK ? count - pos : MACHINE_AUDIO_CHUNK;
+		if (machine->audio.io != NULL) {
+			machine->audio.io(machine, true, time + pos / channels, samples, n / channels, channels, machine->nrf.pdm.rate, 16);
+		}
+		machine->stats.audio_in += n / channels;
+		for (uint32_t i = 0; i < n; i++) {
+			// GAINL and GAINR go from -20dB (0x00) to +20dB (0x50) in
+			// steps of 0.5dB. Mono uses GAINL.
+			uint32_t gain = regs[(0x518 - 0x500) / 4 + i % channels];
+			double sample = (double)(samples[i] >> 16) * pow(10, ((double)(gain <= 0x50 ? gain : 0x50) - 0x28) / 40);
+			int32_t value = sample > 32767 ? 32767 : sample < -32768 ? -32768 : (int32_t)sample;
+			uint32_t word = (uint16_t)value;
+			machine_transfer(machine, machine->nrf.pdm.ptr + (pos + i) * 2, STORE, &word, WIDTH_16, false);
+		}
+	}
+	machine->transfer_address = transfer_address;
+}
+
+// Latch the buffer pointer of the PDM peripheral, so that the firmware can set
+// up the next buffer.
+static void machine_pdm_started(machine_t *machine) {
+	machine->nrf.pdm.ptr = machine->nrf.pdm.regs[(0x560 - 0x500) / 4]; // SAMPLE.PTR
+	machine_nrf_event(machine, &machine->nrf.pdm.periph, 0x4001d000, 29, 0); // STARTED
+}
+
+// Finish the PDM buffer when the time to record it has passed.
+static void machine_pdm_update(machine_t *machine) {
+	if (!machine->nrf.pdm.started) {
+		return;
+	}
+	uint32_t *regs = machine->nrf.pdm.regs;
+	uint32_t frames = (regs[(0x564 - 0x500) / 4] & 0x7fff) / (regs[(0x508 - 0x500) / 4] & 1 ? 1 : 2);
+	if (frames == 0 || machine_ticks(machine, machine->nrf.pdm.rate) - machine->nrf.pdm.start < frames) {
+		return;
+	}
+	machine_pdm_buffer(machine, machine->nrf.pdm.start);
+	machine->nrf.pdm.start += frames;
+	machine_nrf_event(machine, &machine->nrf.pdm.periph, 0x4001d000, 29, 2); // END
+	machine_pdm_started(machine);
+}
+
+// Access a register of the PDM peripheral, which records a microphone. See
+// machine_pdm_update.
+static uint32_t machine_pdm_transfer(machine_t *machine, uint32_t offset, transfer_type_t transfer_type, uint32_t value) {
+	nrf_periph_t *periph = &machine->nrf.pdm.periph;
+	if (machine_nrf_common(machine, periph, 29, offset, transfer_type, &value)) {
+		return value;
+	}
+	if (transfer_type == STORE && offset == 0x000) { // TASKS_START
+		if ((machine->nrf.pdm.regs[0] & 1) && !machine->nrf.pdm.started) { // ENABLE
+			machine->nrf.pdm.started = true;
+			machine->nrf.pdm.rate = machine_pdm_rate(machine);
+			machine->nrf.pdm.start = machine_ticks(machine, machine->nrf.pdm.rate);
+			machine_pdm_started(machine);
+		}
+	} else if (transfer_type == STORE && offset == 0x004) { // TASKS_STOP
+		if (machine->nrf.pdm.started) {
+			machine->nrf.pdm.started = false;
+			machine_nrf_event(machine, periph, 0x4001d000, 29, 1); // STOPPED
+		}
+	} else if (offset >= 0x500 && offset <= 0x564) {
+		uint32_t *reg = &machine->nrf.pdm.regs[(offset - 0x500) / 4];
+		if (transfer_type == STORE) {
+			*reg = value;
+		}
+		return *reg;
+	} else {
+		machine_log(machine, LOG_WARN, "unknown PDM %s at offset 0x%03x (PC: %x)\n", transfer_type == LOAD ? "load" : "store", offset, machine->pc - 3);
+	}
+	return 0;
+}
+
+// Supply voltage of the nRF52, for the VDD input and reference of the SAADC.
+#define NRF_VDD (3.0)
+
+// Return the voltage on a PSELP or PSELN input of the SAADC: not connected,
+// AIN0..AIN7 or VDD.
+static double machine_saadc_input(machine_t *machine, uint32_t psel) {
+	psel &= 0x1f;
+	if (psel >= 1 && psel <= 8) { // AIN0..AIN7
+		return machine->analog.input != NULL ? machine->analog.input(machine, psel - 1) : 0;
+	} else if (psel == 9) { // VDD
+		return NRF_VDD;
+	}
+	return 0;
+}
+
+// Convert each enabled channel of the SAADC, and store the results in the
+// buffer in use. The END event follows when it is full.
+static void machine_saadc_sample(machine_t *machine) {
+	nrf_periph_t *periph = &machine->nrf.saadc.periph;
+	uint32_t *regs = machine->nrf.saadc.regs;
+	if (!machine->nrf.saadc.started) {
+		return;
+	}
+	uint32_t transfer_address = machine->transfer_address;
+	for (int n = 0; n < 8; n++) {
+		uint32_t *ch = &regs[(0x510 - 0x500) / 4 + n * 4]; // PSELP, PSELN, CONFIG, LIMIT
+		if ((ch[0] & 0x1f) == 0) {
+			continue; // not connected, so the channel is disabled
+		}
+		if (machine->nrf.saadc.amount >= machine->nrf.saadc.maxcnt) {
+			break; // the samples are dropped until the next START
+		}
+		// RESULT = (V(P) - V(N)) * GAIN / REFERENCE * 2^(RESOLUTION - m),
+		// where m is 1 for differential mode.
+		static const double gains[8] = {1.0 / 6, 1.0 / 5, 1.0 / 4, 1.0 / 3, 1.0 / 2, 1, 2, 4};
+		bool diff = ch[2] & (1 << 20); // CONFIG.MODE
+		double voltage = machine_saadc_input(machine, ch[0]) - (diff ? machine_saadc_input(machine, ch[1]) : 0);
+		double reference = ch[2] & (1 << 12) ? NRF_VDD / 4 : 0.6; // CONFIG.REFSEL
+		uint32_t bits = 8 + 2 * (regs[(0x5f0 - 0x500) / 4] & 3) - diff; // RESOLUTION
+		double result = round(voltage * gains[(ch[2] >> 8) & 7] / reference * (1 << bits));
+		int32_t max = (1 << bits) - 1;
+		int32_t value = result > max ? max : result < -max - 1 ? -max - 1 : (int32_t)result;
+		uint32_t word = (uint16_t)value;
+		machine_transfer(machine, machine->nrf.saadc.ptr + machine->nrf.saadc.amount * 2, STORE, &word, WIDTH_16, false);
+		machine->nrf.saadc.amount++;
+		machine_nrf_event(machine, periph, 0x40007000, 7, 2); // DONE
+		machine_nrf_event(machine, periph, 0x40007000, 7, 3); // RESULTDONE
+		if (value > (int16_t)(ch[3] >> 16)) {
+			machine_nrf_event(machine, periph, 0x40007000, 7, 6 + 2 * n); // CH[n].LIMITH
+		}
+		if (value < (int16_t)ch[3]) {
+			machine_nrf_event(machine, periph, 0x40007000, 7, 7 + 2 * n); // CH[n].LIMITL
+		}
+	}
+	machine->transfer_address = transfer_address;
+	if (machine->nrf.saadc.amount >= machine->nrf.saadc.maxcnt) {
+		machine->nrf.saadc.started = false;
+		machine_nrf_event(machine, periph, 0x40007000, 7, 1); // END
+	}
+}
+
+// Take the samples of the internal timer of the SAADC that are due, see
+// SAMPLERATE.
+static void machine_saadc_update(machine_t *machine) {
+	if (!machine->nrf.saadc.sampling) {
+		return;
+	}
+	uint32_t cc = machine->nrf.saadc.regs[(0x5f8 - 0x500) / 4] & 0x7ff;
+	uint64_t ticks = machine_ticks(machine, 16000000);
+	while (machine->nrf.saadc.next <= ticks) {
+		machine_saadc_sample(machine);
+		machine->nrf.saadc.next += cc;
+	}
+}
+
+// Access a register of the SAADC peripheral, which converts the voltages of
+// the host (see machine_set_analog) right away: a SAMPLE task stores a result
+// for each enabled channel. With SAMPLERATE.MODE set to the internal timer,
+// the SAMPLE task starts sampling at the rate of SAMPLERATE.CC instead.
+static uint32_t machine_saadc_transfer(machine_t *machine, uint32_t offset, transfer_type_t transfer_type, uint32_t value) {
+	nrf_periph_t *periph = &machine->nrf.saadc.periph;
+	uint32_t *regs = machine->nrf.saadc.regs;
+	if (machine_nrf_common(machine, periph, 7, offset, transfer_type, &value)) {
+		return value;
+	}
+	if (transfer_type == STORE && offset == 0x000) { // TASKS_START
+		if (regs[0] & 1) { // ENABLE
+			machine->nrf.saadc.started = true;
+			machine->nrf.saadc.ptr = regs[(0x62c - 0x500) / 4];             // RESULT.PTR
+			machine->nrf.saadc.maxcnt = regs[(0x630 - 0x500) / 4] & 0x7fff; // RESULT.MAXCNT
+			machine->nrf.saadc.amount = 0;
+			machine_dma_check(machine, "SAADC RESULT", machine->nrf.saadc.ptr, machine->nrf.saadc.maxcnt * 2);
+			machine_nrf_event(machine, periph, 0x40007000, 7, 0); // STARTED
+		}
+	} else if (transfer_type == STORE && offset == 0x004) { // TASKS_SAMPLE
+		uint32_t samplerate = regs[(0x5f8 - 0x500) / 4];
+		if (!(samplerate & (1 << 12))) {
+			machine_saadc_sample(machine);
+		} else if (!machine->nrf.saadc.sampling && (samplerate & 0x7ff) >= 80) { // CC must be 80..2047
+			machine->nrf.saadc.sampling = true;
+			machine->nrf.saadc.next = machine_ticks(machine, 16000000);
+			machine_saadc_update(machine);
+		}
+	} else if (transfer_type == STORE && offset == 0x008) { // TASKS_STOP
+		machine->nrf.saadc.started = false;
+		machine->nrf.saadc.sampling = false;
+		machine_nrf_event(machine, periph, 0x40007000, 7, 5); // STOPPED
+	} else if (transfer_type == STORE && offset == 0x00c) { // TASKS_CALIBRATEOFFSET
+		machine_nrf_event(machine, periph, 0x40007000, 7, 4); // CALIBRATEDONE
+	} else if (transfer_type == LOAD && offset == 0x400) { // STATUS
+		return 0; // ready, conversions finish right away
+	} else if (transfer_type == LOAD && offset == 0x634) { // RESULT.AMOUNT
+		return machine->nrf.saadc.amount;
+	} else if (offset >= 0x500 && offset < 0x634) {
+		uint32_t *reg = &regs[(offset - 0x500) / 4];
+		if (transfer_type == STORE) {
+			*reg = value;
+		}
+		return *reg;
+	} else {
+		machine_log(machine, LOG_WARN, "unknown SAADC %s at offset 0x%03x (PC: %x)\n", transfer_type == LOAD ? "load" : "store", offset, machine->pc - 3);
+	}
+	return 0;
+}
+
+// Access a register of an EGU (event generator unit): each TRIGGER[n] task
+// generates the TRIGGERED[n] event, to raise an interrupt or to trigger tasks
+// through the PPI.
+static uint32_t machine_egu_transfer(machine_t *machine, int index, uint32_t offset, transfer_type_t transfer_type, uint32_t value) {
+	nrf_periph_t *periph = &machine->nrf.egu[index];
+	if (machine_nrf_common(machine, periph, 20 + index, offset, transfer_type, &value)) {
+		return value;
+	}
+	if (transfer_type == STORE && offset < 0x040) { // TASKS_TRIGGER[n]
+		machine_nrf_event(machine, periph, 0x40014000 + index * 0x1000, 20 + index, offset / 4); // TRIGGERED[n]
+	} else {
+		machine_log(machine, LOG_WARN, "unknown EGU%d %s at offset 0x%03x (PC: %x)\n", index, transfer_type == LOAD ? "load" : "store", offset, machine->pc - 3);
+	}
+	return 0;
+}
+
+// A register in the register layout of a crypto accelerator. The code of an
+// accelerator only knows its registers by ID, the layout tables below map
+// them to the offsets of a chip. Another chip with a similar accelerator
+// only needs another table.
+typedef struct {
+	uint8_t id;      // register ID of the accelerator, like CRC_DR
+	uint8_t count;   // number of registers, for an array of registers
+	uint16_t offset; // offset of the (first) register
+} crypto_reg_t;
+
+// Find the register at an offset in a layout. It returns the register ID and
+// sets *index to the index in an array of registers, or returns -1 if there
+// is no register at the offset.
+static int machine_crypto_reg(const crypto_reg_t *layout, size_t len, uint32_t offset, uint32_t *index) {
+	for (size_t i = 0; i < len; i++) {
+		if (offset % 4 == 0 && offset >= layout[i].offset && offset < layout[i].offset + layout[i].count * 4u) {
+			*index = (offset - layout[i].offset) / 4;
+			return layout[i].id;
+		}
+	}
+	return -1;
+}
+
+// Registers of the ECB, see machine_ecb_transfer.
+enum {
+	ECB_STARTECB,   // task
+	ECB_STOPECB,    // task
+	ECB_ECBDATAPTR,
+};
+
+static const crypto_reg_t nrf_ecb_layout[] = {
+	{ECB_STARTECB, 1, 0x000},
+	{ECB_STOPECB, 1, 0x004},
+	{ECB_ECBDATAPTR, 1, 0x504},
+};
+
+// Access a register of the ECB peripheral, which encrypts the 16-byte
+// cleartext at ECBDATAPTR + 16 with the AES-128 key at ECBDATAPTR and stores
+// the ciphertext at ECBDATAPTR + 32. It finishes right away.
+static uint32_t machine_ecb_transfer(machine_t *machine, uint32_t offset, transfer_type_t transfer_type, uint32_t value) {
+	nrf_periph_t *periph = &machine->nrf.ecb.periph;
+	if (machine_nrf_common(machine, periph, 14, offset, transfer_type, &value)) {
+		return value;
+	}
+	uint32_t index;
+	switch (machine_crypto_reg(nrf_ecb_layout, sizeof(nrf_ecb_layout) / sizeof(nrf_ecb_layout[0]), offset, &index)) {
+	case ECB_STARTECB:
+		if (transfer_type == STORE) {
+			uint8_t data[48];
+			machine_dma_read(machine, machine->nrf.ecb.ecbdataptr, data, 32);
+			aes128_encrypt(&data[0], &data[16], &data[32]);
+			machine_dma_write(machine, machine->nrf.ecb.ecbdataptr + 32, &data[32], 16);
+			machine_nrf_event(machine, periph, 0x4000e000, 14, 0); // ENDECB
+		}
+		break;
+	case ECB_STOPECB:
+		break;
+	case ECB_ECBDATAPTR:
+		if (transfer_type == STORE) {
+			machine->nrf.ecb.ecbdataptr = value;
+		}
+		return machine->nrf.ecb.ecbdataptr;
+	default:
+		machine_log(machine, LOG_WARN, "unknown ECB %s at offset 0x%03x (PC: %x)\n", transfer_type == LOAD ? "load" : "store", offset, machine->pc - 3);
+	}
+	return 0;
+}
+
+// Registers of the CCM, see machine_ccm_transfer. The configuration registers
+// are stored in machine->nrf.ccm.regs in this order.
+enum {
+	CCM_ENABLE,
+	CCM_MODE,
+	CCM_CNFPTR,
+	CCM_INPTR,
+	CCM_OUTPTR,
+	CCM_SCRATCHPTR,
+	CCM_MAXPACKETSIZE,
+	CCM_RATEOVERRIDE,
+	CCM_KSGEN,      // task
+	CCM_CRYPT,      // task
+	CCM_STOP,       // task
+	CCM_MICSTATUS,
+};
+
+static const crypto_reg_t nrf_ccm_layout[] = {
+	{CCM_KSGEN, 1, 0x000},
+	{CCM_CRYPT, 1, 0x004},
+	{CCM_STOP, 1, 0x008},
+	{CCM_MICSTATUS, 1, 0x400},
+	{CCM_ENABLE, 8, 0x500}, // ENABLE..RATEOVERRIDE
+};
+
+// Encrypt or decrypt the packet at INPTR into OUTPTR with the AES-CCM of
+// Bluetooth LE: a 13-byte nonce, a 4-byte MIC and the masked header byte as
+// additional data. A packet is a header byte, a length byte, an RFU byte and
+// the payload, followed by the MIC when it is encrypted. The configuration at
+// CNFPTR holds the key, the 39-bit packet counter (in 8 bytes), the direction
+// bit and the IV.
+static void machine_ccm_crypt(machine_t *machine) {
+	uint32_t *regs = machine->nrf.ccm.regs;
+	uint8_t cnf[33];
+	machine_dma_read(machine, regs[CCM_CNFPTR], cnf, sizeof(cnf));
+	uint8_t nonce[13];
+	memcpy(nonce, &cnf[16], 5);
+	nonce[4] = (nonce[4] & 0x7f) | (cnf[24] & 1) << 7;
+	memcpy(&nonce[5], &cnf[25], 8);
+	bool decrypt = regs[CCM_MODE] & 1; // MODE.MODE
+	bool extended = (regs[CCM_MODE] >> 24) & 1; // MODE.LENGTH: 8-bit instead of 5-bit length
+	uint8_t packet[3 + 255 + 4];
+	machine_dma_read(machine, regs[CCM_INPTR], packet, 3);
+	uint32_t length = extended ? packet[1] : packet[1] & 0x1f;
+	machine_dma_read(machine, regs[CCM_INPTR] + 3, &packet[3], length);
+	machine->nrf.ccm.micstatus = 1;
+	if (length != 0) { // empty packets are not encrypted
+		uint8_t header = packet[0] & 0xe3; // without NESN, SN and MD
+		uint32_t plain = length;
+		uint8_t mic[4];
+		if (decrypt) {
+			plain = length < 4 ? 0 : length - 4;
+		} else {
+			aes128_ccm_mic(cnf, nonce, 13, &header, 1, &packet[3], plain, mic, 4);
+		}
+		aes128_ccm_crypt(cnf, nonce, 13, &packet[3], plain);
+		if (decrypt) {
+			aes128_ccm_mic(cnf, nonce, 13, &header, 1, &packet[3], plain, mic, 4);
+			machine->nrf.ccm.micstatus = length >= 4 && memcmp(mic, &packet[3 + plain], 4) == 0;
+			length = plain;
+		} else {
+			memcpy(&packet[3 + plain], mic, 4);
+			length = plain + 4;
+		}
+		packet[1] = length;
+	}
+	machine_dma_write(machine, regs[CCM_OUTPTR], packet, 3 + length);
+	machine_nrf_event(machine, &machine->nrf.ccm.periph, 0x4000f000, 15, 1); // ENDCRYPT
+}
+
+// Access a register of the CCM peripheral. Key stream generation and
+// encryption happen right away, see machine_ccm_crypt.
+static uint32_t machine_ccm_transfer(machine_t *machine, uint32_t offset, transfer_type_t transfer_type, uint32_t value) {
+	nrf_periph_t *periph = &machine->nrf.ccm.periph;
+	if (machine_nrf_common(machine, periph, 15, offset, transfer_type, &value)) {
+		return value;
+	}
+	bool enabled = (machine->nrf.ccm.regs[CCM_ENABLE] & 3) == 2;
+	uint32_t index;
+	switch (machine_crypto_reg(nrf_ccm_layout, sizeof(nrf_ccm_layout) / sizeof(nrf_ccm_layout[0]), offset, &index)) {
+	case CCM_KSGEN:
+		if (transfer_type == STORE && enabled) {
+			machine_nrf_event(machine, periph, 0x4000f000, 15, 0); // ENDKSGEN
+			if (periph->shorts & 1) { // ENDKSGEN_CRYPT
+				machine_ccm_crypt(machine);
+			}
+		}
+		break;
+	case CCM_CRYPT:
+		if (transfer_type == STORE && enabled) {
+			machine_ccm_crypt(machine);
+		}
+		break;
+	case CCM_STOP:
+		break;
+	case CCM_MICSTATUS:
+		return machine->nrf.ccm.micstatus;
+	case CCM_ENABLE: {
+		uint32_t *reg = &machine->nrf.ccm.regs[CCM_ENABLE + index];
+		if (transfer_type == STORE) {
+			*reg = value;
+		}
+		return *reg;
+	}
+	default:
+		machine_log(machine, LOG_WARN, "unknown CCM %s at offset 0x%03x (PC: %x)\n", transfer_type == LOAD ? "load" : "store", offset, machine->pc - 3);
+	}
+	return 0;
+}
+
+// Return the contents of the external SPI flash and its size.
+static uint8_t *machine_qspi_flash_data(machine_t *machine, size_t *size) {
+	if (machine->family == FAMILY_RP2040) {
+		*size = machine->image_size;
+		return machine->image8;
+	}
+	*size = machine->qspi_flash.size;
+	return machine->qspi_flash.data;
+}
+
+// Select or deselect the external SPI flash. Erase commands and the status
+// register are only updated when the chip is deselected, like on real chips.
+static void machine_qspi_flash_select(machine_t *machine, bool selected) {
+	if (selected == machine->qspi_flash.selected) {
+		return;
+	}
+	machine->qspi_flash.selected = selected;
+	if (selected) {
+		machine->qspi_flash.pos = 0;
+		return;
+	}
+
+	size_t size;
+	uint8_t *data = machine_qspi_flash_data(machine, &size);
+	uint8_t *status = machine->qspi_flash.status;
+	bool wel = status[0] & (1 << 1);
+	uint32_t address = machine->qspi_flash.address;
+	uint32_t erase = 0;
+	bool complete = machine->qspi_flash.pos >= 4; // the address was sent
+	if (machine->qspi_flash.pos == 0) {
+		return;
+	}
+	switch (machine->qspi_flash.command) {
+	case 0x06: // write enable
+		status[0] |= 1 << 1;
+		return;
+	case 0x04: // write disable
+		break;
+	case 0x02: case 0x32: // page program
+		if (wel && machine->qspi_flash.pos > 4) {
+			machine->stats.flash_writes++;
+		}
+		break;
+	case 0x01: case 0x31: // write status register
+		break;
+	case 0x20: // sector erase
+		erase = 4096;
+		break;
+	case 0x52: // block erase
+		erase = 32 * 1024;
+		break;
+	case 0xd8: // block erase
+		erase = 64 * 1024;
+		break;
+	case 0x60: case 0xc7: // chip erase
+		erase = size;
+		complete = true;
+		break;
+	case 0xb9: // deep power-down
+		machine->qspi_flash.powered_down = true;
+		return;
+	default:
+		return; // commands that don't change anything
+	}
+	if (erase != 0 && wel && complete) {
+		if (erase >= size) {
+			erase = size;
+			address = 0;
+		} else {
+			address = address % size & ~(erase - 1);
+		}
+		memset(data + address, 0xff, erase < size - address ? erase : size - address);
+		machine->stats.flash_erases++;
+	}
+	status[0] &= ~(1 << 1); // WEL is cleared after a write or erase
+}
+
+// Transfer a byte to and from the selected external SPI flash. Dual and quad
+// commands are treated like their single bit variants, and all operations
+// complete immediately so the WIP bit is never set.
+static uint8_t machine_qspi_flash_transfer(machine_t *machine, uint8_t in) {
+	if (!machine->qspi_flash.selected) {
+		return 0xff;
+	}
+	uint32_t index = machine->qspi_flash.pos++ - 1; // byte after the command
+	if (index == (uint32_t)-1) {
+		if (machine->qspi_flash.powered_down && in != 0xab) {
+			in = 0; // ignored until released from deep power-down
+		}
+		machine->qspi_flash.command = in;
+		machine->qspi_flash.address = 0;
+		return 0xff;
+	}
+
+	size_t size;
+	uint8_t *data = machine_qspi_flash_data(machine, &size);
+	uint8_t *status = machine->qspi_flash.status;
+	uint32_t dummy = 0; // dummy bytes between the address and the data
+	switch (machine->qspi_flash.command) {
+	case 0x9f: { // read JEDEC ID: Winbond, with the capacity as a power of two
+		uint32_t capacity = 0;
+		while (((size_t)2 << capacity) <= size) {
+			capacity++;
+		}
+		const uint8_t id[3] = {0xef, 0x40, capacity};
+		return index < 3 ? id[index] : 0xff;
+	}
+	case 0x05: // read status register 1
+		return status[0];
+	case 0x35: // read status register 2
+		return status[1];
+	case 0x01: // write status register 1 and 2
+	case 0x31: // write status register 2
+		if (status[0] & (1 << 1)) {
+			if (index == 0 && machine->qspi_flash.command == 0x01) {
+				status[0] = (in & ~3) | (status[0] & 3);
+			} else if (index <= 1) {
+				status[1] = in;
+			}
+		}
+		return 0xff;
+	case 0x4b: { // read unique ID, after four dummy bytes
+		const uint8_t id[8] = {0x45, 0x6d, 0x75, 0x6c, 0xff, 0xff, 0xc0, 0xde};
+		return index >= 4 && index < 12 ? id[index - 4] : 0xff;
+	}
+	case 0xab: // release from deep power-down, and read the device ID
+		machine->qspi_flash.powered_down = false;
+		return index >= 3 ? 0x14 : 0xff;
+	case 0x0b: case 0x3b: case 0x6b: case 0xbb: case 0xeb: // fast read
+		dummy = 1;
+		// fall through
+	case 0x03: // read
+	case 0x02: case 0x32: // page program
+	case 0x20: case 0x52: case 0xd8: // sector and block erase
+		if (index < 3) {
+			machine->qspi_flash.address = machine->qspi_flash.address << 8 | in;
+			return 0xff;
+		}
+		if (index < 3 + dummy || size == 0) {
+			return 0xff;
+		}
+		break;
+	default:
+		return 0xff;
+	}
+
+	uint32_t n = index - 3 - dummy; // data byte
+	uint32_t address = machine->qspi_flash.address;
+	if (machine->qspi_flash.command == 0x02 || machine->qspi_flash.command == 0x32) {
+		// Program within the page, wrapping around at its end.
+		address = (address & ~0xffu) | ((address + n) & 0xff);
+		if (status[0] & (1 << 1)) {
+			data[address % size] &= in;
+		}
+		return 0xff;
+	} else if (machine->qspi_flash.command == 0x20 || machine->qspi_flash.command == 0x52 || machine->qspi_flash.command == 0xd8) {
+		return 0xff;
+	}
+	return data[(address + n) % size];
+}
+
+// Run a complete command on the external SPI flash: select it, send the
+// command and the 24-bit address (if it has one) and deselect it again.
+static void machine_qspi_flash_command(machine_t *machine, uint8_t command, int32_t address) {
+	machine_qspi_flash_select(machine, true);
+	machine_qspi_flash_transfer(machine, command);
+	if (address >= 0) {
+		machine_qspi_flash_transfer(machine, address >> 16);
+		machine_qspi_flash_transfer(machine, address >> 8);
+		machine_qspi_flash_transfer(machine, address);
+	}
+}
+
+// Handle a task of the nRF52840 QSPI peripheral. Reads, writes and erases
+// are done with the same SPI commands the peripheral would send, so they go
+// through the same flash model as custom instructions.
+static void machine_qspi_task(machine_t *machine, uint32_t offset) {
+	uint32_t *regs = machine->nrf.qspi.regs;
+	uint32_t transfer_address = machine->transfer_address;
+	if (offset == 0x000) { // ACTIVATE
+	} else if (offset == 0x004) { // READSTART
+		uint32_t src = regs[(0x504 - 0x500) / 4], dst = regs[(0x508 - 0x500) / 4], cnt = regs[(0x50c - 0x500) / 4];
+		machine_qspi_flash_command(machine, 0x03, src);
+		for (uint32_t i = 0; i < cnt; i++) {
+			uint32_t c = machine_qspi_flash_transfer(machine, 0xff);
+			machine_transfer(machine, dst + i, STORE, &c, WIDTH_8, false);
+		}
+		machine_qspi_flash_select(machine, false);
+	} else if (offset == 0x008) { // WRITESTART
+		uint32_t dst = regs[(0x510 - 0x500) / 4], src = regs[(0x514 - 0x500) / 4], cnt = regs[(0x518 - 0x500) / 4];
+		for (uint32_t i = 0; i < cnt; ) {
+			// Program up to the end of each page.
+			machine_qspi_flash_command(machine, 0x06, -1);
+			machine_qspi_flash_select(machine, false);
+			machine_qspi_flash_command(machine, 0x02, dst + i);
+			do {
+				uint32_t c = 0xff;
+				machine_transfer(machine, src + i, LOAD, &c, WIDTH_8, false);
+				machine_qspi_flash_transfer(machine, c);
+				i++;
+			} while (i < cnt && (dst + i) % 256 != 0);
+			machine_qspi_flash_select(machine, false);
+		}
+	} else if (offset == 0x00c) { // ERASESTART
+		const uint8_t commands[3] = {0x20, 0xd8, 0xc7}; // 4kB, 64kB, all
+		uint32_t len = regs[(0x520 - 0x500) / 4];
+		machine_qspi_flash_command(machine, 0x06, -1);
+		machine_qspi_flash_select(machine, false);
+		machine_qspi_flash_command(machine, commands[len < 3 ? len : 0], len == 2 ? -1 : (int32_t)regs[(0x51c - 0x500) / 4]);
+		machine_qspi_flash_select(machine, false);
+	} else if (offset == 0x010) { // DEACTIVATE
+		machine->transfer_address = transfer_address;
+		return; // no READY event
+	} else {
+		machine_log(machine, LOG_WARN, "unknown QSPI task at offset 0x%03x (PC: %x)\n", offset, machine->pc - 3);
+		return;
+	}
+	machine->transfer_address = transfer_address;
+	machine_nrf_event(machine, &machine->nrf.qspi.periph, 0x40029000, 41, 0); // READY
+}
+
+// Send a custom instruction to the external flash, with up to 8 data bytes
+// from and to CINSTRDAT0 and CINSTRDAT1.
+static void machine_qspi_cinstr(machine_t *machine, uint32_t conf) {
+	uint32_t *dat = &machine->nrf.qspi.regs[(0x638 - 0x500) / 4];
+	uint32_t length = (conf >> 8) & 0xf; // including the opcode
+	machine_qspi_flash_select(machine, true);
+	machine_qspi_flash_transfer(machine, conf & 0xff);
+	for (uint32_t i = 0; i + 1 < length && i < 8; i++) {
+		uint32_t shift = (i % 4) * 8;
+		uint8_t out = machine_qspi_flash_transfer(machine, dat[i / 4] >> shift);
+		dat[i / 4] = (dat[i / 4] & ~(0xffu << shift)) | (uint32_t)out << shift;
+	}
+	machine_qspi_flash_select(machine, false);
+	machine_nrf_event(machine, &machine->nrf.qspi.periph, 0x40029000, 41, 0); // READY
+}
+
+// Access a register of the nRF52840 QSPI peripheral. Only 24-bit addressing
+// is supported, and long frame mode is not.
+static uint32_t machine_qspi_transfer(machine_t *machine, uint32_t offset, transfer_type_t transfer_type, uint32_t value) {
+	if (machine_nrf_common(machine, &machine->nrf.qspi.periph, 41, offset, transfer_type, &value)) {
+		return value;
+	}
+	if (transfer_type == STORE && offset < 0x100) { // TASKS_*
+		if (value & 1) {
+			machine_qspi_task(machine, offset);
+		}
+	} else if (transfer_type == LOAD && offset == 0x604) { // STATUS
+		return 1 << 3 | machine->qspi_flash.status[0] << 24; // READY, SREG
+	} else if (offset >= 0x500 && offset < 0x648) { // configuration
+		uint32_t *reg = &machine->nrf.qspi.regs[(offset - 0x500) / 4];
+		if (transfer_type == STORE) {
+			*reg = value;
+			if (offset == 0x634) { // CINSTRCONF
+				machine_qspi_cinstr(machine, value);
+			}
+		}
+		return *reg;
+	} else {
+		machine_log(machine, LOG_WARN, "unknown QSPI %s at offset 0x%03x (PC: %x)\n", transfer_type == LOAD ? "load" : "store", offset, machine->pc - 3);
+	}
+	return 0;
+}
+
+// Reset values of the calibration registers of the TEMP peripheral of an
+// nRF52832 (A0..A5, B0..B5 and T0..T4), also found in FICR.TEMP.
+static const uint32_t nrf_temp_calibration[17] = {
+	0x326, 0x348, 0x3aa, 0x40e, 0x4bd, 0x5a3,
+	0x3fef, 0x3fbe, 0x3fbe, 0x012, 0x124, 0x27c,
+	0xe2, 0x00, 0x19, 0x3c, 0x50,
+};
+
+// Read a register of the FICR of an nRF52832.
+static uint32_t machine_ficr(machine_t *machine, uint32_t offset) {
+	const uint8_t *id = machine->device.id;
+	const uint8_t *addr = machine->device.addr;
+	if (offset == 0x010) { // CODEPAGESIZE
+		return machine->pagesize;
+	} else if (offset == 0x014) { // CODESIZE
+		return machine->image_size / machine->pagesize;
+	} else if (offset == 0x060) { // DEVICEID[0]
+		return id[0] | id[1] << 8 | id[2] << 16 | (uint32_t)id[3] << 24;
+	} else if (offset == 0x064) { // DEVICEID[1]
+		return id[4] | id[5] << 8 | id[6] << 16 | (uint32_t)id[7] << 24;
+	} else if (offset >= 0x080 && offset <= 0x09c) { // ER[0..3], IR[0..3]
+		// These keys are random on real chips. Derive them from the
+		// device ID, so that they are the same for the same device.
+		hash_t hash;
+		uint8_t digest[32];
+		hash_init(&hash, HASH_SHA256);
+		hash_update(&hash, id, 8);
+		hash_final(&hash, digest);
+		const uint8_t *key = &digest[offset - 0x080];
+		return key[0] | key[1] << 8 | key[2] << 16 | (uint32_t)key[3] << 24;
+	} else if (offset == 0x0a4) { // DEVICEADDR[0]
+		return addr[0] | addr[1] << 8 | addr[2] << 16 | (uint32_t)addr[3] << 24;
+	} else if (offset == 0x0a8) { // DEVICEADDR[1]
+		return 0xffff0000 | addr[4] | addr[5] << 8;
+	} else if (offset == 0x0a0) { // DEVICEADDRTYPE
+		return 1; // random
+	} else if (offset == 0x100) { // INFO.PART
+		return 0x52832;
+	} else if (offset == 0x104) { // INFO.VARIANT
+		return 0x41414530; // AAE0
+	} else if (offset == 0x108) { // INFO.PACKAGE
+		return 0x2000; // QF
+	} else if (offset == 0x10c) { // INFO.RAM
+		return machine->mem_size / 1024;
+	} else if (offset == 0x110) { // INFO.FLASH
+		return machine->image_size / 1024;
+	} else if (offset == 0x130 || offset == 0x134) {
+		return 0; // undocumented, used to check for errata
+	} else if (offset >= 0x404 && offset <= 0x444) { // TEMP: A0..A5, B0..B5, T0..T4
+		return nrf_temp_calibration[(offset - 0x404) / 4];
+	}
+	return 0xffffffff;
+}
+
+// Access a register of the TEMP peripheral, which measures the die
+// temperature set with machine_set_device_info. A measurement is ready right
+// away.
+static uint32_t machine_temp_transfer(machine_t *machine, uint32_t offset, transfer_type_t transfer_type, uint32_t value) {
+	nrf_periph_t *periph = &machine->nrf.temp.periph;
+	if (machine_nrf_common(machine, periph, 12, offset, transfer_type, &value)) {
+		return value;
+	}
+	if (transfer_type == STORE && offset == 0x000) { // TASKS_START
+		int32_t temperature = machine->device.temperature;
+		machine->nrf.temp.temp = (temperature >= 0 ? temperature + 12 : temperature - 12) / 25; // round to 0.25 °C
+		machine_nrf_event(machine, periph, 0x4000c000, 12, 0); // DATARDY
+	} else if (transfer_type == STORE && offset == 0x004) { // TASKS_STOP
+	} else if (offset == 0x508) { // TEMP
+		return machine->nrf.temp.temp;
+	} else if (offset >= 0x520 && offset <= 0x560) { // A0..A5, B0..B5, T0..T4
+		uint32_t *reg = &machine->nrf.temp.regs[(offset - 0x520) / 4];
+		if (transfer_type == STORE) {
+			*reg = value;
+		}
+		return *reg;
+	} else {
+		machine_log(machine, LOG_WARN, "unknown TEMP %s at offset 0x%03x (PC: %x)\n", transfer_type == LOAD ? "load" : "store", offset, machine->pc - 3);
+	}
+	return 0;
+}
+
+// Access a register of the STM32 RCC. Oscillators and PLLs are ready as soon
+// as they're turned on, and a system clock switch takes effect immediately.
+static uint32_t machine_stm32_rcc_transfer(machine_t *machine, uint32_t *regs, size_t num_regs, bool f4, uint32_t offset, transfer_type_t transfer_type, uint32_t value) {
+	uint32_t cfgr = f4 ? 0x08 : 0x04;
+	uint32_t bdcr = f4 ? 0x70 : 0x20;
+	uint32_t csr = f4 ? 0x74 : 0x24;
+	// HSION, HSEON, PLLON, PLL2ON/PLLI2SON and PLL3ON/PLLSAION, each
+	// followed by its ready flag.
+	uint32_t cr_on = 1 << 0 | 1 << 16 | 1 << 24 | 1 << 26 | 1 << 28;
+	if (offset / 4 >= num_regs) {
+		machine_log(machine, LOG_WARN, "unknown RCC %s at offset 0x%03x (PC: %x)\n", transfer_type == LOAD ? "load" : "store", offset, machine->pc - 3);
+		return 0;
+	}
+	uint32_t *reg = &regs[offset / 4];
+	if (transfer_type == STORE) {
+		if (offset == 0x00) { // CR
+			value &= ~(cr_on << 1);
+		} else if (offset == cfgr) {
+			value &= ~0xc; // SWS
+		} else if (offset == bdcr || offset == csr) {
+			value &= ~2; // LSERDY, LSIRDY
+		}
+		*reg = value;
+		return 0;
+	}
+	value = *reg;
+	if (offset == 0x00) { // CR
+		value |= (value & cr_on) << 1;
+	} else if (offset == cfgr) {
+		value |= (value & 3) << 2; // SWS follows SW
+	} else if (offset == bdcr || offset == csr) {
+		value |= (value & 1) << 1; // LSEON, LSION
+	}
+	return value;
+}
+
+// Access a register of an STM32 GPIO port. Outputs read back the level they
+// drive and inputs read their pull resistor, on the F1 selected by ODR.
+// Return the IDR register of an STM32 GPIO port. Outputs read what they
+// drive, inputs read what the host drives on them or else their pull resistor.
+static uint32_t machine_stm32_gpio_in(machine_t *machine, uint32_t port, bool f4) {
+	uint32_t *regs = f4 ? machine->stm32.gpio_f4[port] : machine->stm32.gpio_f1[port];
+	uint32_t odr = regs[f4 ? 5 : 3];
+	uint32_t in = 0;
+	for (uint32_t pin = 0; pin < 16; pin++) {
+		int external = machine_gpio_external(machine, port * 32 + pin);
+		uint32_t level;
+		if (f4) {
+			uint32_t mode = (regs[0] >> (pin * 2)) & 3;     // MODER
+			uint32_t pupd = (regs[3] >> (pin * 2)) & 3;     // PUPDR
+			if (mode == 1) {
+				level = (odr >> pin) & 1;
+			} else if (mode != 3 && external >= 0) {
+				level = external;
+			} else {
+				level = mode == 0 && pupd == 1;
+			}
+		} else {
+			// ODR selects the pull-up or pull-down of inputs.
+			bool output = ((regs[pin / 8] >> (pin % 8 * 4)) & 3) != 0; // MODE
+			level = output || external < 0 ? (odr >> pin) & 1 : (uint32_t)external;
+		}
+		in |= level << pin;
+	}
+	return in;
+}
+
+static uint32_t machine_stm32_gpio_transfer(machine_t *machine, uint32_t port, bool f4, uint32_t offset, transfer_type_t transfer_type, uint32_t value) {
+	uint32_t *regs = f4 ? machine->stm32.gpio_f4[port] : machine->stm32.gpio_f1[port];
+	uint32_t idr = f4 ? 0x10 : 0x08;
+	uint32_t *odr = &regs[idr / 4 + 1];
+	if (offset > (f4 ? 0x24 : 0x18)) {
+		machine_log(machine, LOG_WARN, "unknown GPIO %s at offset 0x%03x (PC: %x)\n", transfer_type == LOAD ? "load" : "store", offset, machine->pc - 3);
+		return 0;
+	}
+	if (offset == idr + 8) { // BSRR
+		if (transfer_type == STORE) {
+			*odr &= ~(value >> 16);
+			*odr |= value & 0xffff;
+		}
+		return 0;
+	} else if (!f4 && offset == 0x14) { // BRR
+		if (transfer_type == STORE) {
+			*odr &= ~(value & 0xffff);
+		}
+		return 0;
+	} else if (offset == idr) {
+		return machine_stm32_gpio_in(machine, port, f4);
+	}
+	if (transfer_type == STORE) {
+		regs[offset / 4] = value;
+	}
+	return regs[offset / 4];
+}
+
+// Apply BRR, CR1, CR2 and CR3 of a USART. The peripheral clock is assumed to
+// be the CPU clock.
+static void machine_stm32_usart_configure(machine_t *machine, int index) {
+	uint32_t *regs = machine->stm32.usart[index];
+	uart_t *uart = &machine->uart[index];
+	uint32_t brr = regs[0], cr1 = regs[1], cr2 = regs[2], cr3 = regs[3];
+	if (cr1 & (1 << 15)) { // OVER8: the lowest 3 bits are eighths
+		brr = (brr & ~0xfu) | (brr & 7) << 1;
+		brr /= 2;
+	}
+	uint32_t baud = brr != 0 ? machine->clock / brr : 0;
+	uint32_t stop = ((cr2 >> 12) & 3) >= 2 ? 2 : 1; // CR2.STOP: 1, 0.5, 2 or 1.5 bits
+	uint32_t frame_bits = 1 + ((cr1 >> 12) & 1 ? 9 : 8) + stop; // CR1.M, the parity bit is one of them
+	machine_uart_configure(machine, uart, baud, frame_bits, cr3 & (1 << 8), cr3 & (1 << 9), 1); // CR3.RTSE, CR3.CTSE
+}
+
+// Access a register of USART1 or USART2, which are UART0 and UART1 of the host
+// like on nRF chips. The data register holds a single received character, and
+// errors are reported in SR. Their interrupts can't be used, as they're above
+// MACHINE_NUM_IRQS.
+static uint32_t machine_stm32_usart_transfer(machine_t *machine, int index, uint32_t offset, transfer_type_t transfer_type, uint32_t value) {
+	uint32_t *regs = machine->stm32.usart[index];
+	uart_t *uart = &machine->uart[index];
+	if (offset == 0x00) { // SR
+		if (transfer_type == STORE) {
+			if (!(value & (1 << 9))) { // CTS is cleared by writing 0
+				uart->cts_changed = false;
+			}
+			return 0;
+		}
+		uint32_t sr = 0;
+		uint32_t pending = machine_uart_tx_pending(machine, uart);
+		if (pending <= 1 && uart->tx_held < 0) {
+			sr |= 1 << 7; // TXE
+		}
+		if (pending == 0) {
+			sr |= 1 << 6; // TC
+		}
+		if ((regs[1] & (1 << 2)) && machine_uart_rx_ready(machine, uart)) { // CR1.RE
+			uint32_t errors = machine_uart_rx_errors(machine, uart);
+			sr |= 1 << 5; // RXNE
+			if (errors & (UART_ERROR_FRAMING | UART_ERROR_BREAK)) {
+				sr |= 1 << 1; // FE
+			}
+			if (errors & UART_ERROR_PARITY) {
+				sr |= 1 << 0; // PE
+			}
+		}
+		if (uart->rx_overrun) {
+			sr |= 1 << 3; // ORE
+		}
+		if (uart->cts_changed) {
+			sr |= 1 << 9; // CTS
+		}
+		return sr;
+	} else if (offset == 0x04) { // DR
+		if (transfer_type == LOAD) {
+			// This clears the error flags, which are read from SR
+			// first.
+			uint32_t errors;
+			uart->rx_overrun = false;
+			return machine_uart_read(machine, uart, &errors);
+		}
+		machine_uart_send(machine, uart, value & 0xff);
+	} else if (offset <= 0x18) { // BRR, CR1, CR2, CR3, GTPR
+		if (transfer_type == LOAD) {
+			return regs[(offset - 0x08) / 4];
+		}
+		if (offset == 0x0c && (value & (1 << 2)) && !(regs[1] & (1 << 2))) { // CR1.RE
+			machine_uart_rx_enable(machine, uart);
+		}
+		regs[(offset - 0x08) / 4] = value;
+		machine_stm32_usart_configure(machine, index);
+		if (offset == 0x0c) { // CR1
+			bool on = false;
+			for (int i = 0; i < 2; i++) {
+				uint32_t cr1 = machine->stm32.usart[i][1];
+				on = on || ((cr1 & (1 << 13)) && (cr1 & 0xc)); // UE and TE or RE
+			}
+			machine_periph_power(machine, PERIPH_UART, on);
+		}
+	} else {
+		machine_log(machine, LOG_WARN, "unknown USART %s at offset 0x%03x (PC: %x)\n", transfer_type == LOAD ? "load" : "store", offset, machine->pc - 3);
+	}
+	return 0;
+}
+
+// Access a register of SPI1, SPI2 or SPI3, with the SD card and the SPI
+// devices of the host on the bus. Transfers complete immediately.
+static uint32_t machine_stm32_spi_transfer(machine_t *machine, int index, uint32_t offset, transfer_type_t transfer_type, uint32_t value) {
+	uint32_t *regs = machine->stm32.spi[index];
+	if (offset > 0x20) {
+		machine_log(machine, LOG_WARN, "unknown SPI %s at offset 0x%03x (PC: %x)\n", transfer_type == LOAD ? "load" : "store", offset, machine->pc - 3);
+		return 0;
+	}
+	if (offset == 0x08) { // SR
+		return 1 << 1 | (regs[2] & 1); // TXE, RXNE
+	} else if (offset == 0x0c) { // DR
+		if (transfer_type == STORE) {
+			if (regs[0] & (1 << 6)) { // CR1.SPE
+				regs[3] = machine_spi_byte(machine, value);
+				regs[2] |= 1; // RXNE
+			}
+			return 0;
+		}
+		regs[2] &= ~1;
+		return regs[3];
+	}
+	if (transfer_type == STORE) {
+		regs[offset / 4] = value;
+	}
+	return regs[offset / 4];
+}
+
+// Receive bytes from the I2C bus until both DR and the shift register are
+// full, so that BTF can be set like on a real chip.
+static void machine_stm32_i2c_receive(machine_t *machine, int index) {
+	uint32_t *regs = machine->stm32.i2c[index].regs;
+	while (machine->stm32.i2c[index].active && machine->stm32.i2c[index].read && machine->stm32.i2c[index].rx_len < 2 && !(regs[5] & (1 << 1))) {
+		machine->stm32.i2c[index].rx[machine->stm32.i2c[index].rx_len++] = machine_i2c_read(machine);
+	}
+}
+
+// Access a register of I2C1, I2C2 or I2C3 of the STM32F1/F4 (I2C v1) in
+// master mode. Bytes are sent and received immediately, so the firmware only
+// sees the status flags change.
+static uint32_t machine_stm32_i2c_transfer(machine_t *machine, int index, uint32_t offset, transfer_type_t transfer_type, uint32_t value) {
+	uint32_t *regs = machine->stm32.i2c[index].regs;
+	if (offset >= 0x28) {
+		machine_log(machine, LOG_WARN, "unknown I2C %s at offset 0x%03x (PC: %x)\n", transfer_type == LOAD ? "load" : "store", offset, machine->pc - 3);
+		return 0;
+	}
+	if (offset == 0x00 && transfer_type == STORE) { // CR1
+		regs[0] = value & ~(3u << 8); // START and STOP are cleared by hardware
+		if (value & (1 << 8)) { // START
+			regs[5] |= 1 << 0; // SB: the address is sent with the next DR write
+		}
+		if ((value & (1 << 9)) && machine->stm32.i2c[index].active) { // STOP
+			machine_i2c_stop(machine);
+			machine->stm32.i2c[index].active = false;
+		}
+		return 0;
+	} else if (offset == 0x10) { // DR
+		if (transfer_type == STORE) {
+			if (regs[5] & (1 << 0)) { // SB: address byte
+				regs[5] &= ~(1u << 0);
+				machine->stm32.i2c[index].active = true;
+				machine->stm32.i2c[index].read = value & 1;
+				machine->stm32.i2c[index].rx_len = 0;
+				regs[5] |= machine_i2c_start(machine, value) ? 1 << 1 : 1 << 10; // ADDR or AF
+			} else if (machine->stm32.i2c[index].active && !machine->stm32.i2c[index].read && !machine_i2c_write(machine, value)) {
+				regs[5] |= 1 << 10; // AF
+			}
+			return 0;
+		}
+		uint32_t c = machine->stm32.i2c[index].rx[0];
+		if (machine->stm32.i2c[index].rx_len > 0) {
+			machine->stm32.i2c[index].rx[0] = machine->stm32.i2c[index].rx[1];
+			machine->stm32.i2c[index].rx_len--;
+		}
+		machine_stm32_i2c_receive(machine, index);
+		return c;
+	} else if (offset == 0x14) { // SR1
+		if (transfer_type == STORE) {
+			regs[5] &= value | 0xff; // the error flags are cleared by writing zero
+			return 0;
+		}
+		uint32_t sr1 = regs[5];
+		bool addressing = sr1 & 3; // SB or ADDR is set
+		if (!addressing && machine->stm32.i2c[index].active && !machine->stm32.i2c[index].read) {
+			sr1 |= 1 << 7 | 1 << 2; // TXE, BTF
+		} else if (!addressing && machine->stm32.i2c[index].rx_len != 0) {
+			// Received bytes can still be read after a stop condition.
+			sr1 |= 1 << 6 | (machine->stm32.i2c[index].rx_len == 2) << 2; // RXNE, BTF
+		}
+		return sr1;
+	} else if (offset == 0x18) { // SR2
+		if (transfer_type == STORE) {
+			return 0;
+		}
+		if (regs[5] & (1 << 1)) {
+			// Reading SR2 clears ADDR, after which the first bytes are
+			// received.
+			regs[5] &= ~(1u << 1);
+			machine_stm32_i2c_receive(machine, index);
+		}
+		bool busy = machine->stm32.i2c[index].active || (regs[5] & (1 << 0));
+		return busy << 1 | busy | (busy && !machine->stm32.i2c[index].read) << 2; // BUSY, MSL, TRA
+	}
+	if (transfer_type == STORE) {
+		regs[offset / 4] = value;
+	}
+	return regs[offset / 4];
+}
+
+// Set the pending bits of the given EXTI lines, for those that aren't masked,
+// and raise their interrupts. EXTI15_10 (IRQ 40) is above MACHINE_NUM_IRQS, so
+// lines 10..15 can only be polled.
+static void machine_stm32_exti_pend(machine_t *machine, uint32_t lines) {
+	lines &= machine->stm32.exti[0]; // IMR
+	machine->stm32.exti[5] |= lines; // PR
+	for (uint32_t line = 0; line < 16; line++) {
+		if ((lines >> line) & 1) {
+			machine_pend_irq(machine, line < 5 ? 6 + line : line < 10 ? 23 : 40);
+		}
+	}
+}
+
+// Trigger the EXTI lines of the GPIO pins of a port that changed level, as
+// selected by EXTICR1..4 and the rising and falling trigger registers.
+static void machine_stm32_gpio_edges(machine_t *machine, uint32_t port, uint32_t changed, uint32_t in) {
+	uint32_t lines = 0;
+	for (uint32_t line = 0; line < 16; line++) {
+		uint32_t exticr = machine->stm32.syscfg[2 + line / 4];
+		if (!((changed >> line) & 1) || ((exticr >> (line % 4 * 4)) & 0xf) != port) {
+			continue;
+		}
+		uint32_t trigger = (in >> line) & 1 ? machine->stm32.exti[2] : machine->stm32.exti[3]; // RTSR, FTSR
+		lines |= trigger & (1u << line);
+	}
+	if (lines != 0) {
+		machine_stm32_exti_pend(machine, lines);
+	}
+}
+
+// Access a register of EXTI. Only the GPIO lines 0..15 are connected.
+static uint32_t machine_stm32_exti_transfer(machine_t *machine, uint32_t offset, transfer_type_t transfer_type, uint32_t value) {
+	uint32_t *reg = &machine->stm32.exti[offset / 4];
+	if (transfer_type == LOAD) {
+		return *reg;
+	}
+	if (offset == 0x10) { // SWIER
+		machine_stm32_exti_pend(machine, value & ~*reg & 0xffff);
+		*reg |= value & 0xffff;
+	} else if (offset == 0x14) { // PR: cleared by writing one, which also clears SWIER
+		*reg &= ~value;
+		machine->stm32.exti[4] &= ~value;
+	} else {
+		*reg = value & 0xffff;
+	}
+	return 0;
+}
+
+// Access a register of the built-in STM32 peripherals: RCC, PWR, FLASH,
+// USART1, USART2, SPI, I2C, GPIO, EXTI and AFIO/SYSCFG, at their STM32F1 and
+// STM32F4 addresses.
+// Reset bxCAN: it starts in sleep mode, with the filters in initialization
+// mode.
+static void machine_stm32_can_reset(machine_t *machine) {
+	memset(&machine->stm32.can, 0, sizeof(machine->stm32.can));
+	uint32_t *regs = machine->stm32.can.regs;
+	regs[0] = 0x00010002; // MCR: DBF, SLEEP
+	regs[1] = 0x00000c02; // MSR: SAMP, RX, SLAK
+	regs[2] = 0x1c000000; // TSR: TME0..2
+	regs[7] = 0x01230000; // BTR
+	machine->stm32.can.filter[0] = 0x2a1c0e01; // FMR: CAN2SB = 14, FINIT
+}
+
+// Return the identifier of a frame in the layout of the TIxR and RIxR
+// registers and of 32-bit filters.
+static uint32_t machine_can_id32(const can_frame_t *frame) {
+	uint32_t id = frame->remote ? 1 << 1 : 0;
+	if (frame->extended) {
+		return id | 1 << 2 | (frame->id & 0x1fffffff) << 3;
+	}
+	return id | (frame->id & 0x7ff) << 21;
+}
+
+// Return the identifier of a frame in the layout of 16-bit filters, which
+// only contains the upper 14 bits of extended identifiers.
+static uint32_t machine_can_id16(const can_frame_t *frame) {
+	uint32_t id32 = machine_can_id32(frame);
+	return (id32 >> 21) << 5 | (uint32_t)frame->remote << 4 | (uint32_t)frame->extended << 3 | ((id32 >> 18) & 7);
+}
+
+// Set the bxCAN interrupts pending while their condition holds, as they're
+// level triggered.
+static void machine_stm32_can_irq(machine_t *machine) {
+	uint32_t *regs = machine->stm32.can.regs;
+	uint32_t ier = regs[5];
+	if ((ier & 1) && (regs[2] & (1 << 0 | 1 << 8 | 1 << 16))) { // TMEIE, RQCP0..2
+		machine_pend_irq(machine, 19);
+	}
+	for (int fifo = 0; fifo < 2; fifo++) {
+		uint32_t rfr = regs[3 + fifo];
+		uint32_t enabled = ier >> (1 + fifo * 3); // FMPIE, FFIE and FOVIE
+		if (((enabled & 1) && (rfr & 3)) || ((enabled & 2) && (rfr & (1 << 3))) || ((enabled & 4) && (rfr & (1 << 4)))) {
+			machine_pend_irq(machine, 20 + fifo); // RX0, RX1
+		}
+	}
+}
+
+// Find the filter that accepts a frame. It returns the FIFO of the filter and
+// stores its filter match index in fmi, or returns -1 if no filter accepts
+// the frame. Filters are numbered per FIFO, including inactive banks. The
+// first bank that matches wins, while real hardware prefers 32-bit over
+// 16-bit and list over mask filters.
+static int machine_stm32_can_filter(machine_t *machine, const can_frame_t *frame, uint32_t *fmi) {
+	uint32_t *filter = machine->stm32.can.filter;
+	uint32_t banks = (filter[0] >> 8) & 0x3f; // FMR.CAN2SB: the banks of CAN1
+	uint32_t numbers[2] = {0, 0};
+	uint32_t id32 = machine_can_id32(frame);
+	uint32_t id16 = machine_can_id16(frame);
+	for (uint32_t i = 0; i < banks && i < 28; i++) {
+		int fifo = (filter[3] >> i) & 1; // FFA1R
+		bool list = (filter[1] >> i) & 1; // FM1R
+		bool wide = (filter[2] >> i) & 1; // FS1R
+		uint32_t *fr = machine->stm32.can.fr[i];
+		uint32_t n = numbers[fifo];
+		numbers[fifo] += (wide ? 1 : 2) * (list ? 2 : 1);
+		if (!((filter[4] >> i) & 1)) { // FA1R
+			continue;
+		}
+		for (uint32_t j = 0; j < (wide ? 1 : 2) * (list ? 2 : 1); j++) {
+			bool match;
+			if (wide && list) {
+				match = id32 == (fr[j] & ~1u);
+			} else if (wide) {
+				match = ((id32 ^ fr[0]) & fr[1] & ~1u) == 0;
+			} else if (list) {
+				match = id16 == ((fr[j / 2] >> (j % 2 * 16)) & 0xffff);
+			} else {
+				match = ((id16 ^ fr[j]) & (fr[j] >> 16) & 0xffff) == 0;
+			}
+			if (match) {
+				*fmi = n + j;
+				return fifo;
+			}
+		}
+	}
+	return -1;
+}
+
+// Put a frame from the bus in a receive FIFO, if a filter accepts it. It
+// returns whether the frame was stored.
+static bool machine_stm32_can_receive(machine_t *machine, const can_frame_t *frame) {
+	uint32_t *regs = machine->stm32.can.regs;
+	if (regs[1] & 3) { // MSR: INAK, SLAK
+		return false;
+	}
+	uint32_t fmi;
+	int fifo = machine_stm32_can_filter(machine, frame, &fmi);
+	if (fifo < 0) {
+		return false;
+	}
+	uint32_t *rfr = &regs[3 + fifo];
+	uint32_t slot = *rfr & 3; // FMP
+	if (slot == 3) {
+		*rfr |= 1 << 4; // FOVR
+		if (regs[0] & (1 << 3)) { // MCR.RFLM: discard the new message
+			machine_stm32_can_irq(machine);
+			return false;
+		}
+		slot = 2; // the last message is overwritten
+	} else {
+		*rfr = (*rfr & ~3u) | (slot + 1) | (slot == 2 ? 1 << 3 : 0); // FMP, FULL
+	}
+	uint32_t *rx = machine->stm32.can.rx[fifo][slot];
+	rx[0] = machine_can_id32(frame);
+	rx[1] = (frame->dlc & 0xf) | fmi << 8;
+	rx[2] = frame->data[0] | frame->data[1] << 8 | frame->data[2] << 16 | (uint32_t)frame->data[3] << 24;
+	rx[3] = frame->data[4] | frame->data[5] << 8 | frame->data[6] << 16 | (uint32_t)frame->data[7] << 24;
+	machine->stats.can_rx++;
+	machine_stm32_can_irq(machine);
+	return true;
+}
+
+// Send the frame in a transmit mailbox. Every frame is acknowledged and sent
+// right away: there is no arbitration with other nodes, and sending takes no
+// time. In loop back mode the frame is also received, in silent mode it
+// doesn't reach the bus.
+static void machine_stm32_can_transmit(machine_t *machine, int mailbox) {
+	uint32_t *regs = machine->stm32.can.regs;
+	uint32_t *tx = machine->stm32.can.tx[mailbox];
+	can_frame_t frame = {0};
+	frame.extended = (tx[0] >> 2) & 1;
+	frame.remote = (tx[0] >> 1) & 1;
+	frame.id = frame.extended ? tx[0] >> 3 : tx[0] >> 21;
+	frame.dlc = tx[1] & 0xf;
+	for (int i = 0; i < 8; i++) {
+		frame.data[i] = tx[2 + i / 4] >> (i % 4 * 8);
+	}
+	tx[0] &= ~1u; // TXRQ
+	if (!(regs[7] & (1u << 31))) { // BTR.SILM
+		machine->stats.can_tx++;
+		if (machine->can.send != NULL) {
+			machine->can.send(machine, &frame);
+		}
+	}
+	regs[2] = (regs[2] & ~(0xffu << (mailbox * 8)) & ~(3u << 24)) | 3u << (mailbox * 8) | 1u << (26 + mailbox) | (uint32_t)mailbox << 24; // RQCP, TXOK, TME, CODE
+	if (regs[7] & (1 << 30)) { // BTR.LBKM
+		machine_stm32_can_receive(machine, &frame);
+	}
+	machine_stm32_can_irq(machine);
+}
+
+// Send the frames that were requested while bxCAN was in initialization or
+// sleep mode.
+static void machine_stm32_can_transmit_pending(machine_t *machine) {
+	for (int mailbox = 0; mailbox < 3; mailbox++) {
+		if (!(machine->stm32.can.regs[1] & 3) && (machine->stm32.can.tx[mailbox][0] & 1)) { // INAK, SLAK, TXRQ
+			machine_stm32_can_transmit(machine, mailbox);
+		}
+	}
+}
+
+// Access a register of bxCAN (CAN1). Frames go to and come from the host, see
+// machine_stm32_can_transmit and machine_can_receive.
+static uint32_t machine_stm32_can_transfer(machine_t *machine, uint32_t offset, transfer_type_t transfer_type, uint32_t value) {
+	uint32_t *regs = machine->stm32.can.regs;
+	if (offset >= 0x180 && offset < 0x1b0) { // transmit mailboxes
+		int mailbox = (offset - 0x180) / 0x10;
+		uint32_t *reg = &machine->stm32.can.tx[mailbox][offset / 4 % 4];
+		if (transfer_type == LOAD) {
+			return *reg;
+		}
+		if (!(regs[2] & (1u << (26 + mailbox)))) { // TME: the mailbox is in use
+			return 0;
+		}
+		*reg = value;
+		if (offset % 0x10 == 0 && (value & 1)) { // TIxR.TXRQ
+			regs[2] &= ~(1u << (26 + mailbox));
+			machine_stm32_can_transmit_pending(machine);
+		}
+		return 0;
+	} else if (offset >= 0x1b0 && offset < 0x1d0) { // receive FIFO output mailboxes
+		return transfer_type == LOAD ? machine->stm32.can.rx[(offset - 0x1b0) / 0x10][0][offset / 4 % 4] : 0;
+	} else if (offset >= 0x240 && offset < 0x320) { // filter banks
+		uint32_t *reg = &machine->stm32.can.fr[(offset - 0x240) / 8][offset / 4 % 2];
+		if (transfer_type == STORE) {
+			*reg = value;
+		}
+		return *reg;
+	} else if (offset == 0x200 || offset == 0x204 || offset == 0x20c || offset == 0x214 || offset == 0x21c) { // FMR, FM1R, FS1R, FFA1R, FA1R
+		uint32_t *reg = &machine->stm32.can.filter[offset == 0x200 ? 0 : (offset - 0x204) / 8 + 1];
+		if (transfer_type == STORE) {
+			*reg = value;
+		}
+		return *reg;
+	} else if (offset >= 0x20) {
+		machine_log(machine, LOG_WARN, "unknown CAN %s at offset 0x%03x (PC: %x)\n", transfer_type == LOAD ? "load" : "store", offset, machine->pc - 3);
+		return 0;
+	}
+	if (transfer_type == LOAD) {
+		return regs[offset / 4];
+	}
+	if (offset == 0x00) { // MCR
+		if (value & (1 << 15)) { // RESET
+			machine_stm32_can_reset(machine);
+			return 0;
+		}
+		regs[0] = value & 0x000100ff;
+		// INRQ and SLEEP take effect right away. INRQ wins if both are set.
+		regs[1] = (regs[1] & ~3u) | (value & 1) | (value & 2 && !(value & 1) ? 2 : 0); // INAK, SLAK
+		machine_stm32_can_transmit_pending(machine);
+	} else if (offset == 0x04) { // MSR
+		regs[1] &= ~(value & (7 << 2)); // ERRI, WKUI and SLAKI are cleared by writing 1
+	} else if (offset == 0x08) { // TSR
+		for (int mailbox = 0; mailbox < 3; mailbox++) {
+			uint32_t bits = value >> (mailbox * 8);
+			if (bits & 1) { // RQCP clears RQCP, TXOK, ALST and TERR
+				regs[2] &= ~(0xfu << (mailbox * 8));
+			}
+			if ((bits & (1 << 7)) && !(regs[2] & (1u << (26 + mailbox)))) { // ABRQ
+				machine->stm32.can.tx[mailbox][0] &= ~1u;
+				regs[2] = (regs[2] & ~(0xfu << (mailbox * 8))) | 1u << (mailbox * 8) | 1u << (26 + mailbox); // RQCP, TME
+			}
+		}
+		machine_stm32_can_irq(machine);
+	} else if (offset == 0x0c || offset == 0x10) { // RF0R, RF1R
+		int fifo = (offset - 0x0c) / 4;
+		uint32_t *rfr = &regs[3 + fifo];
+		*rfr &= ~(value & (3 << 3)); // FULL and FOVR are cleared by writing 1
+		if ((value & (1 << 5)) && (*rfr & 3)) { // RFOM: release the output mailbox
+			memmove(machine->stm32.can.rx[fifo][0], machine->stm32.can.rx[fifo][1], sizeof(machine->stm32.can.rx[fifo][0]) * 2);
+			*rfr = (*rfr & ~(3u | 1 << 3)) | ((*rfr & 3) - 1);
+		}
+		machine_stm32_can_irq(machine);
+	} else if (offset == 0x14) { // IER
+		regs[5] = value;
+		machine_stm32_can_irq(machine);
+	} else if (offset == 0x18) { // ESR
+		regs[6] = (regs[6] & ~(7u << 4)) | (value & (7 << 4)); // only LEC is writable
+	} else if (offset == 0x1c) { // BTR
+		if (regs[1] & 1) { // INAK: only writable in initialization mode
+			regs[7] = value & 0xc37f03ff;
+		}
+	}
+	return 0;
+}
+
+// Reverse the order of the lowest bits of value.
+static uint32_t machine_reverse_bits(uint32_t value, uint32_t bits) {
+	uint32_t result = 0;
+	for (uint32_t i = 0; i < bits; i++) {
+		result |= ((value >> i) & 1) << (bits - 1 - i);
+	}
+	return result;
+}
+
+// Registers of the CRC unit, see machine_stm32_crc_transfer. They are stored
+// in machine->stm32.crc in this order.
+enum {
+	CRC_DR,
+	CRC_IDR,
+	CRC_CR,
+	CRC_INIT = 4,
+	CRC_POL,
+};
+
+static const crypto_reg_t stm32_crc_layout[] = {
+	{CRC_DR, 1, 0x00},
+	{CRC_IDR, 1, 0x04},
+	{CRC_CR, 1, 0x08},
+	{CRC_INIT, 1, 0x10},
+	{CRC_POL, 1, 0x14},
+};
+
+// Access a register of the STM32 CRC unit. The F1 and F4 compute a fixed
+// CRC-32 (polynomial 0x04c11db7, without reflection), but the registers of
+// newer series that configure the polynomial and its size, the initial value
+// and bit reversal work too.
+static uint32_t machine_stm32_crc_transfer(machine_t *machine, uint32_t offset, transfer_type_t transfer_type, uint32_t value) {
+	uint32_t *regs = machine->stm32.crc;
+	uint32_t index;
+	int reg = machine_crypto_reg(stm32_crc_layout, sizeof(stm32_crc_layout) / sizeof(stm32_crc_layout[0]), offset, &index);
+	if (reg < 0) {
+		machine_log(machine, LOG_WARN, "unknown CRC %s at offset 0x%03x (PC: %x)\n", transfer_type == LOAD ? "load" : "store", offset, machine->pc - 3);
+		return 0;
+	}
+	uint32_t polysize = (regs[CRC_CR] >> 3) & 3; // CR.POLYSIZE: 32, 16, 8 or 7 bits
+	uint32_t size = polysize == 3 ? 7 : 32 >> polysize;
+	uint32_t mask = size == 32 ? 0xffffffff : (1u << size) - 1;
+	if (transfer_type == LOAD) {
+		if (reg == CRC_DR && (regs[CRC_CR] & (1 << 7))) { // CR.REV_OUT
+			return machine_reverse_bits(regs[CRC_DR], size);
+		}
+		return regs[reg];
+	}
+	if (reg == CRC_DR) {
+		uint32_t rev_in = (regs[CRC_CR] >> 5) & 3; // CR.REV_IN: reverse bytes, halfwords or the word
+		if (rev_in != 0) {
+			uint32_t width = 4 << rev_in;
+			uint32_t reversed = 0;
+			for (uint32_t i = 0; i < 32; i += width) {
+				reversed |= machine_reverse_bits(value >> i, width) << i;
+			}
+			value = reversed;
+		}
+		regs[CRC_DR] = crc_update(regs[CRC_DR], regs[CRC_POL], size, value, 32);
+	} else if (reg == CRC_CR) {
+		regs[CRC_CR] = value & 0xf8;
+		if (value & 1) { // RESET
+			regs[CRC_DR] = regs[CRC_INIT] & mask;
+		}
+	} else {
+		regs[reg] = value;
+	}
+	return 0;
+}
+
+// Apply HASH_CR.DATATYPE to a word written to DIN, so that the first byte of
+// the message is in bits 31..24.
+static uint32_t machine_stm32_hash_swap(uint32_t cr, uint32_t value) {
+	switch ((cr >> 4) & 3) {
+	case 1: // halfwords
+		return value << 16 | value >> 16;
+	case 2: // bytes
+		return value << 24 | (value & 0xff00) << 8 | (value >> 8 & 0xff00) | value >> 24;
+	case 3: // bits
+		return machine_reverse_bits(value, 32);
+	}
+	return value;
+}
+
+// Add the word that was last written to DIN to the message, or only its first
+// bytes for the last word.
+static void machine_stm32_hash_flush(machine_t *machine, uint32_t bytes) {
+	uint32_t din = machine->stm32.hash.din;
+	uint8_t data[4] = {din >> 24, din >> 16, din >> 8, din};
+	hash_update(&machine->stm32.hash.hash, data, bytes);
+	machine->stm32.hash.din_pending = false;
+}
+
+// Registers of the HASH processor, see machine_stm32_hash_transfer.
+enum {
+	HASH_REG_CR,
+	HASH_REG_DIN,
+	HASH_REG_STR,
+	HASH_REG_HR,
+	HASH_REG_IMR,
+	HASH_REG_SR,
+};
+
+static const crypto_reg_t stm32_hash_layout[] = {
+	{HASH_REG_CR, 1, 0x00},
+	{HASH_REG_DIN, 1, 0x04},
+	{HASH_REG_STR, 1, 0x08},
+	{HASH_REG_HR, 5, 0x0c},   // HR0..HR4
+	{HASH_REG_IMR, 1, 0x20},
+	{HASH_REG_SR, 1, 0x24},
+	{HASH_REG_HR, 8, 0x310},  // HASH_DIGEST HR0..HR7
+};
+
+// Access a register of the HASH processor of the STM32F4. It computes SHA-1,
+// MD5, SHA-224 and SHA-256 digests; HMAC and context swapping are not
+// supported. A digest is ready as soon as DCAL is set.
+static uint32_t machine_stm32_hash_transfer(machine_t *machine, uint32_t offset, transfer_type_t transfer_type, uint32_t value) {
+	static const hash_algorithm_t algorithms[4] = {HASH_SHA1, HASH_MD5, HASH_SHA224, HASH_SHA256};
+	uint32_t index;
+	switch (machine_crypto_reg(stm32_hash_layout, sizeof(stm32_hash_layout) / sizeof(stm32_hash_layout[0]), offset, &index)) {
+	case HASH_REG_CR:
+		if (transfer_type == LOAD) {
+			return machine->stm32.hash.cr;
+		}
+		machine->stm32.hash.cr = value & ~(1u << 2);
+		if (value & (1 << 6)) { // MODE
+			machine_log(machine, LOG_WARN, "HASH: HMAC mode is not supported (PC: %x)\n", machine->pc - 3);
+		}
+		if (value & (1 << 2)) { // INIT
+			hash_init(&machine->stm32.hash.hash, algorithms[((value >> 17) & 2) | ((value >> 7) & 1)]); // ALGO
+			machine->stm32.hash.din_pending = false;
+			machine->stm32.hash.sr &= ~(1u << 1); // DCIS
+		}
+		break;
+	case HASH_REG_DIN:
+		if (transfer_type == LOAD) {
+			return machine->stm32.hash.din;
+		}
+		if (machine->stm32.hash.din_pending) {
+			machine_stm32_hash_flush(machine, 4);
+		}
+		machine->stm32.hash.din = machine_stm32_hash_swap(machine->stm32.hash.cr, value);
+		machine->stm32.hash.din_pending = true;
+		break;
+	case HASH_REG_STR:
+		if (transfer_type == LOAD) {
+			return machine->stm32.hash.str;
+		}
+		machine->stm32.hash.str = value & 0x1f;
+		if (value & (1 << 8)) { // DCAL
+			uint32_t nblw = value & 0x1f; // valid bits in the last word, 0 means all
+			if (nblw % 8 != 0) {
+				machine_log(machine, LOG_WARN, "HASH: messages must be a whole number of bytes (PC: %x)\n", machine->pc - 3);
+			}
+			if (machine->stm32.hash.din_pending) {
+				machine_stm32_hash_flush(machine, nblw == 0 ? 4 : nblw / 8);
+			}
+			uint8_t digest[32] = {0};
+			hash_final(&machine->stm32.hash.hash, digest);
+			for (int i = 0; i < 8; i++) {
+				machine->stm32.hash.hr[i] = (uint32_t)digest[i * 4] << 24 | digest[i * 4 + 1] << 16 | digest[i * 4 + 2] << 8 | digest[i * 4 + 3];
+			}
+			machine->stm32.hash.sr |= 1 << 1; // DCIS
+		}
+		break;
+	case HASH_REG_HR:
+		return transfer_type == LOAD ? machine->stm32.hash.hr[index] : 0;
+	case HASH_REG_IMR:
+		if (transfer_type == STORE) {
+			machine->stm32.hash.imr = value & 3;
+		}
+		return machine->stm32.hash.imr;
+	case HASH_REG_SR:
+		if (transfer_type == STORE) {
+			machine->stm32.hash.sr &= value; // DCIS is cleared by writing 0
+			return 0;
+		}
+		return machine->stm32.hash.sr | 1 << 0; // DINIS: always ready for input
+	default:
+		machine_log(machine, LOG_WARN, "unknown HASH %s at offset 0x%03x (PC: %x)\n", transfer_type == LOAD ? "load" : "store", offset, machine->pc - 3);
+	}
+	return 0;
+}
+
+// Fill the factory information in the system memory of the STM32 F1 and F4:
+// the unique ID, the flash size and (on the F4) calibration values for the
+// internal channels of the ADC, with typical values.
+static void machine_stm32_info_init(machine_t *machine) {
+	uint32_t flash_size = machine->image_size / 1024;
+	uint32_t *f1 = machine->stm32.info_f1;
+	f1[0] = 0xffff0000 | flash_size; // F_SIZE
+	f1[1] = 0xffffffff;
+	memcpy(&f1[2], machine->device.id, 12); // UID
+	uint32_t *f4 = machine->stm32.info_f4;
+	memcpy(&f4[0], machine->device.id, 12); // UID
+	f4[3] = 0xffffffff;
+	f4[4] = flash_size << 16 | 0xffff; // F_SIZE
+	f4[5] = 0xffffffff;
+	f4[6] = 1502 << 16 | 0xffff; // VREFINT_CAL: 1.21 V at VDDA = 3.3 V
+	f4[7] = 1207 << 16 | 959;    // TS_CAL2 (110 °C) and TS_CAL1 (30 °C)
+}
+
+static uint32_t machine_stm32_transfer(machine_t *machine, uint32_t address, transfer_type_t transfer_type, uint32_t value) {
+	const builtin_periph_t *periph = machine_find_peripheral(machine, address);
+	uint32_t base = address & ~0x3ffu;
+	uint32_t offset = address & 0x3ff;
+	switch (periph != NULL ? periph->id : -1) {
+	case BUILTIN_STM32_RCC_F1:
+		return machine_stm32_rcc_transfer(machine, machine->stm32.rcc_f1, 16, false, offset, transfer_type, value);
+	case BUILTIN_STM32_RCC_F4:
+		return machine_stm32_rcc_transfer(machine, machine->stm32.rcc_f4, 40, true, offset, transfer_type, value);
+	case BUILTIN_STM32_PWR:
+		if (offset < 8) {
+			uint32_t *reg = &machine->stm32.pwr[offset / 4];
+			if (transfer_type == STORE) {
+				*reg = value;
+				return 0;
+			}
+			if (offset == 0x04) { // CSR
+				// VOSRDY, and ODRDY and ODSWRDY as soon as over-drive is enabled.
+				return *reg | 1 << 14 | (machine->stm32.pwr[0] & (3 << 16));
+			}
+			return *reg;
+		}
+		break;
+	case BUILTIN_STM32_FLASH:
+		if (offset < 0x20) {
+			// Only the wait states can be set: programming is not supported.
+			uint32_t *reg = &machine->stm32.flash[periph->index][offset / 4];
+			if (transfer_type == STORE) {
+				*reg = value;
+			}
+			return *reg;
+		}
+		break;
+	case BUILTIN_STM32_SPI:
+		return machine_stm32_spi_transfer(machine, periph->index, offset, transfer_type, value);
+	case BUILTIN_STM32_I2C:
+		return machine_stm32_i2c_transfer(machine, periph->index, offset, transfer_type, value);
+	case BUILTIN_STM32_EXTI:
+		if (offset < 0x18) {
+			return machine_stm32_exti_transfer(machine, offset, transfer_type, value);
+		}
+		break;
+	case BUILTIN_STM32_USART1:
+		// SYSCFG of the F4 is at the address of USART1 of the F1, so it is
+		// only used once its clock is enabled in RCC.APB2ENR.
+		if (!(machine->stm32.rcc_f4[17] & (1 << 14))) {
+			return machine_stm32_usart_transfer(machine, 0, offset, transfer_type, value);
+		}
+		// fall through
+	case BUILTIN_STM32_AFIO:
+		if (offset < 0x24) {
+			uint32_t *reg = &machine->stm32.syscfg[offset / 4];
+			if (transfer_type == STORE) {
+				*reg = value;
+			}
+			return *reg;
+		}
+		break;
+	case BUILTIN_STM32_CAN:
+		return machine_stm32_can_transfer(machine, offset, transfer_type, value);
+	case BUILTIN_STM32_CRC:
+		return machine_stm32_crc_transfer(machine, offset, transfer_type, value);
+	case BUILTIN_STM32_HASH:
+		return machine_stm32_hash_transfer(machine, offset, transfer_type, value);
+	case BUILTIN_STM32_USART:
+		return machine_stm32_usart_transfer(machine, periph->index, offset, transfer_type, value);
+	case BUILTIN_STM32_GPIO_F1:
+		return machine_stm32_gpio_transfer(machine, (base - periph->start) / 0x400, false, offset, transfer_type, value);
+	case BUILTIN_STM32_GPIO_F4:
+		return machine_stm32_gpio_transfer(machine, (base - periph->start) / 0x400, true, offset, transfer_type, value);
+	}
+	machine_log(machine, LOG_WARN, "unknown %s peripheral address: 0x%08x (value: 0x%x, PC: %x)\n", transfer_type == LOAD ? "load" : "store", address, value, machine->pc - 3);
+	return 0;
+}
+
+// Layout of the RP2040 boot ROM stub. The tables are real, but the functions
+// they point to are implemented natively: the boot ROM is a stub range (see
+// machine_set_family) of machine_rp2040_rom_call.
+#define RP2040_ROM_FUNC_TABLE   (0x100)
+#define RP2040_ROM_DATA_TABLE   (0x180)
+#define RP2040_ROM_COPYRIGHT    (0x1e0)
+#define RP2040_ROM_SF_TABLE     (0x200) // soft float functions
+#define RP2040_ROM_SD_TABLE     (0x280) // soft double functions
+#define RP2040_ROM_SF_FUNCS     (0x1000)
+#define RP2040_ROM_SD_FUNCS     (0x1100)
+#define RP2040_ROM_LOOKUP       (0x1200)
+#define RP2040_ROM_FUNCS        (0x1300)
+#define RP2040_ROM_CORE1_WAIT   (0x1400) // core 1 returns here from its entry point
+#define RP2040_ROM_NUM_FLOAT    (31) // entries in the SF and SD tables
+#define RP2040_ROM_CODE(a, b)   ((a) | (b) << 8)
+
+// Functions in the function table, by their two-letter code.
+static const char rp2040_rom_funcs[][2] = {
+	"P3", "R3", "L3", "T3", // popcount32, reverse32, clz32, ctz32
+	"MS", "S4", "MC", "C4", // memset, memset4, memcpy, memcpy44
+	"IF", "EX", "RE", "RP", "FC", "CX", // flash functions
+	"UB", // reset_to_usb_boot
+};
+
+static void machine_rp2040_rom_put16(machine_t *machine, uint32_t offset, uint32_t value) {
+	machine->rp2040.rom[offset] = value;
+	machine->rp2040.rom[offset + 1] = value >> 8;
+}
+
+static void machine_rp2040_rom_put32(machine_t *machine, uint32_t offset, uint32_t value) {
+	machine_rp2040_rom_put16(machine, offset, value);
+	machine_rp2040_rom_put16(machine, offset + 2, value >> 16);
+}
+
+// Build the part of the boot ROM that the Pico SDK and TinyGo read: the magic,
+// the version and the function and data lookup tables.
+static void machine_rp2040_rom_init(machine_t *machine) {
+	memset(machine->rp2040.rom, 0, sizeof(machine->rp2040.rom));
+	machine_rp2040_rom_put32(machine, 0x00, 0x20042000); // initial stack pointer
+	machine_rp2040_rom_put32(machine, 0x04, (RP2040_ROM_FUNCS + 2 * 14) | 1); // reset: reset_to_usb_boot
+	machine->rp2040.rom[0x10] = 'M';
+	machine->rp2040.rom[0x11] = 'u';
+	machine->rp2040.rom[0x12] = 1;
+	machine->rp2040.rom[0x13] = 3; // version (B2)
+	machine_rp2040_rom_put16(machine, 0x14, RP2040_ROM_FUNC_TABLE);
+	machine_rp2040_rom_put16(machine, 0x16, RP2040_ROM_DATA_TABLE);
+	machine_rp2040_rom_put16(machine, 0x18, RP2040_ROM_LOOKUP | 1);
+
+	uint32_t offset = RP2040_ROM_FUNC_TABLE;
+	for (size_t i = 0; i < sizeof(rp2040_rom_funcs) / sizeof(rp2040_rom_funcs[0]); i++) {
+		machine_rp2040_rom_put16(machine, offset, RP2040_ROM_CODE(rp2040_rom_funcs[i][0], rp2040_rom_funcs[i][1]));
+		machine_rp2040_rom_put16(machine, offset + 2, (RP2040_ROM_FUNCS + 2 * i) | 1);
+		offset += 4;
+	}
+
+	offset = RP2040_ROM_DATA_TABLE;
+	const struct {
+		char code[2];
+		uint32_t ptr;
+	} data[] = {
+		{"CR", RP2040_ROM_COPYRIGHT},
+		{"SF", RP2040_ROM_SF_TABLE},
+		{"SD", RP2040_ROM_SD_TABLE},
+	};
+	for (size_t i = 0; i < sizeof(data) / sizeof(data[0]); i++) {
+		machine_rp2040_rom_put16(machine, offset, RP2040_ROM_CODE(data[i].code[0], data[i].code[1]));
+		machine_rp2040_rom_put16(machine, offset + 2, data[i].ptr);
+		offset += 4;
+	}
+	memcpy(machine->rp2040.rom + RP2040_ROM_COPYRIGHT, "(C) emculator", 14);
+	for (uint32_t i = 0; i < RP2040_ROM_NUM_FLOAT; i++) {
+		machine_rp2040_rom_put32(machine, RP2040_ROM_SF_TABLE + 4 * i, (RP2040_ROM_SF_FUNCS + 2 * i) | 1);
+		machine_rp2040_rom_put32(machine, RP2040_ROM_SD_TABLE + 4 * i, (RP2040_ROM_SD_FUNCS + 2 * i) | 1);
+	}
+}
+
+static float machine_reg_float(uint32_t reg) {
+	float f;
+	memcpy(&f, &reg, 4);
+	return f;
+}
+
+static uint32_t machine_float_reg(float f) {
+	uint32_t reg;
+	memcpy(&reg, &f, 4);
+	return reg;
+}
+
+static double machine_regs_double(uint32_t lo, uint32_t hi) {
+	uint64_t bits = (uint64_t)hi << 32 | lo;
+	double d;
+	memcpy(&d, &bits, 8);
+	return d;
+}
+
+static uint64_t machine_double_bits(double d) {
+	uint64_t bits;
+	memcpy(&bits, &d, 8);
+	return bits;
+}
+
+// Convert to an integer with saturation, rounding towards minus infinity like
+// the boot ROM does.
+static int64_t machine_sat_int(double v, double min, double max) {
+	if (v != v) {
+		return 0;
+	}
+	v = floor(v);
+	if (v <= min) {
+		return (int64_t)min;
+	}
+	if (v >= max) {
+		return max >= 9.2e18 ? INT64_MAX : (int64_t)max;
+	}
+	return (int64_t)v;
+}
+
+static uint64_t machine_sat_uint(double v, double max) {
+	if (v != v || v <= 0) {
+		return 0;
+	}
+	v = floor(v);
+	if (v >= max) {
+		return max >= 1.8e19 ? UINT64_MAX : (uint64_t)max;
+	}
+	return (uint64_t)v;
+}
+
+// Run one of the functions of the SF (single precision) or SD (double
+// precision) table. Arguments and results are passed like the AAPCS does: a
+// double takes two registers. Fixed point conversions take the number of
+// fraction bits as the next argument.
+static void machine_rp2040_float(machine_t *machine, uint32_t index, bool dp) {
+	uint32_t *r = machine->regs;
+	double a = dp ? machine_regs_double(r[0], r[1]) : machine_reg_float(r[0]);
+	double b = dp ? machine_regs_double(r[2], r[3]) : machine_reg_float(r[1]);
+	uint32_t n = dp ? r[2] : r[1]; // fraction bits, for fixed point conversions
+	int64_t i64 = (int64_t)((uint64_t)r[1] << 32 | r[0]);
+	double result = 0;
+	bool integer = false; // the result is in r0 (and r1), not a float
+	switch (index) {
+	case 0: result = a + b; break; // add
+	case 1: result = a - b; break; // sub
+	case 2: result = a * b; break; // mul
+	case 3: result = a / b; break; // div
+	case 4: case 20: // cmp
+		r[0] = a < b ? -1 : a > b ? 1 : 0;
+		integer = true;
+		break;
+	case 5: result = sqrt(a); break;
+	case 6: case 7: // to int, to fix
+		r[0] = machine_sat_int(ldexp(a, index == 7 ? n : 0), INT32_MIN, INT32_MAX);
+		integer = true;
+		break;
+	case 8: case 9: // to uint, to ufix
+		r[0] = machine_sat_uint(ldexp(a, index == 9 ? n : 0), UINT32_MAX);
+		integer = true;
+		break;
+	case 10: result = (int32_t)r[0]; break; // from int
+	case 11: result = ldexp((int32_t)r[0], -(int)r[1]); break; // from fix
+	case 12: result = r[0]; break; // from uint
+	case 13: result = ldexp(r[0], -(int)r[1]); break; // from ufix
+	case 14: result = cos(a); break;
+	case 15: result = sin(a); break;
+	case 16: result = tan(a); break;
+	case 17: // sincos: the cosine goes into the next register(s)
+		if (dp) {
+			uint64_t c = machine_double_bits(cos(a));
+			r[2] = c;
+			r[3] = c >> 32;
+		} else {
+			r[1] = machine_float_reg(cos(a));
+		}
+		result = sin(a);
+		break;
+	case 18: result = exp(a); break;
+	case 19: result = log(a); break;
+	case 21: result = atan2(a, b); break;
+	case 22: result = i64; break; // from int64
+	case 23: result = ldexp(i64, -(int)n); break; // from fix64
+	case 24: result = (uint64_t)i64; break; // from uint64
+	case 25: result = ldexp((uint64_t)i64, -(int)n); break; // from ufix64
+	case 26: case 27: case 28: case 29: { // to int64, fix64, uint64, ufix64
+		uint32_t bits = index == 27 || index == 29 ? n : 0;
+		uint64_t v = index < 28 ? (uint64_t)machine_sat_int(ldexp(a, bits), -9.3e18, 9.3e18) : machine_sat_uint(ldexp(a, bits), 1.9e19);
+		r[0] = v;
+		r[1] = v >> 32;
+		integer = true;
+		break;
+	}
+	case 30: // float to double, or double to float
+		dp = !dp;
+		result = a;
+		break;
+	default:
+		machine_log(machine, LOG_WARN, "unsupported boot ROM %s function %u (PC: %x)\n", dp ? "SD" : "SF", index, machine->lr - 1);
+		integer = true;
+	}
+	if (integer) {
+		return;
+	}
+	if (dp) {
+		uint64_t bits = machine_double_bits(result);
+		r[0] = bits;
+		r[1] = bits >> 32;
+	} else {
+		r[0] = machine_float_reg(result);
+	}
+}
+
+// Program (clear bits of) or erase the XIP flash, at an offset from the start
+// of flash.
+static void machine_rp2040_flash(machine_t *machine, uint32_t offset, uint32_t count, const uint8_t *data) {
+	for (uint32_t i = 0; i < count && offset + i < machine->image_size; i++) {
+		if (data != NULL) {
+			machine->image8[offset + i] &= data[i];
+		} else {
+			machine->image8[offset + i] = 0xff;
+		}
+	}
+}
+
+// Mark an interrupt as pending on a single core of the RP2040, like the
+// SIO_IRQ_PROC interrupt of its FIFO.
+static void machine_rp2040_pend_irq(machine_t *machine, uint32_t core, uint32_t irq) {
+	if (core == machine->rp2040.core) {
+		machine->nvic.pending |= 1 << irq;
+		if (machine->scb.scr & (1 << 4)) { // SEVONPEND
+			machine->event = true;
+		}
+	} else {
+		core_state_t *other = &machine->rp2040.other;
+		other->nvic.pending |= 1 << irq;
+		if (other->scb.scr & (1 << 4)) {
+			other->event = true;
+		}
+	}
+}
+
+// Raise SIO_IRQ_PROC0 or SIO_IRQ_PROC1 when the FIFO of the core has data,
+// or after a FIFO error.
+static void machine_rp2040_fifo_irq(machine_t *machine, uint32_t core) {
+	if (machine->rp2040.fifo[core].len != 0 || machine->rp2040.fifo_errors[core] != 0) {
+		machine_rp2040_pend_irq(machine, core, 15 + core);
+	}
+}
+
+// Push a word into the FIFO that the given core reads. When it is full, the
+// word is lost and the writing core gets a WOF error.
+static void machine_rp2040_fifo_push(machine_t *machine, uint32_t core, uint32_t value) {
+	if (machine->rp2040.fifo[core].len == 8) {
+		machine->rp2040.fifo_errors[core ^ 1] |= 1 << 2; // WOF
+		machine_rp2040_fifo_irq(machine, core ^ 1);
+		return;
+	}
+	machine->rp2040.fifo[core].data[machine->rp2040.fifo[core].len++] = value;
+	machine_rp2040_fifo_irq(machine, core);
+}
+
+// Exchange the contents of two variables of the same type.
+#define MACHINE_SWAP(a, b) machine_swap(&(a), &(b), sizeof(a))
+
+static void machine_swap(void *a, void *b, size_t size) {
+	uint8_t tmp[64];
+	for (size_t i = 0; i < size; i += sizeof(tmp)) {
+		size_t n = size - i < sizeof(tmp) ? size - i : sizeof(tmp);
+		memcpy(tmp, (uint8_t*)a + i, n);
+		memcpy((uint8_t*)a + i, (uint8_t*)b + i, n);
+		memcpy((uint8_t*)b + i, tmp, n);
+	}
+}
+
+// Exchange the state of the executing core with that of the other core.
+static void machine_rp2040_switch_core(machine_t *machine) {
+	core_state_t *other = &machine->rp2040.other;
+	MACHINE_SWAP(machine->regs, other->regs);
+	MACHINE_SWAP(machine->nvic, other->nvic);
+	MACHINE_SWAP(machine->scb, other->scb);
+	MACHINE_SWAP(machine->systick, other->systick);
+	MACHINE_SWAP(machine->ipsr, other->ipsr);
+	MACHINE_SWAP(machine->active, other->active);
+	MACHINE_SWAP(machine->primask, other->primask);
+	MACHINE_SWAP(machine->event, other->event);
+	MACHINE_SWAP(machine->sleep, other->sleep);
+	MACHINE_SWAP(machine->sleep_wfe, other->sleep_wfe);
+	MACHINE_SWAP(machine->pending_seen, other->pending_seen);
+	MACHINE_SWAP(machine->pended_at, other->pended_at);
+	MACHINE_SWAP(machine->handler_since, other->handler_since);
+	MACHINE_SWAP(machine->call_depth, other->call_depth);
+	MACHINE_SWAP(machine->backtrace, other->backtrace);
+	MACHINE_SWAP(machine->last_sp, other->last_sp);
+	MACHINE_SWAP(machine->instruction_pc, other->instruction_pc);
+	MACHINE_SWAP(machine->break_skip, other->break_skip);
+	MACHINE_SWAP(machine->coverage_prev_location, other->coverage_prev_location);
+	MACHINE_SWAP(machine->coverage_prev_pc, other->coverage_prev_pc);
+	MACHINE_SWAP(machine->stack_guard.guards, other->stack_guards);
+	MACHINE_SWAP(machine->stack_guard.count, other->stack_guard_count);
+	MACHINE_SWAP(machine->rp2040.dividend, other->dividend);
+	MACHINE_SWAP(machine->rp2040.divisor, other->divisor);
+	MACHINE_SWAP(machine->rp2040.quotient, other->quotient);
+	MACHINE_SWAP(machine->rp2040.remainder, other->remainder);
+	machine->rp2040.core ^= 1;
+}
+
+// Make core 0 the executing core, so that a debugger sees it after a stop
+// that isn't caused by core 1.
+static void machine_rp2040_select_core0(machine_t *machine) {
+	if (machine->family == FAMILY_RP2040 && machine->rp2040.core != 0) {
+		machine_rp2040_switch_core(machine);
+	}
+}
+
+// Start core 1 at the given entry point, like its boot ROM does at the end of
+// the launch sequence. When the entry point returns, core 1 goes back to its
+// boot ROM, see RP2040_ROM_CORE1_WAIT.
+static void machine_rp2040_launch_core1(machine_t *machine, uint32_t vtor, uint32_t sp, uint32_t entry) {
+	machine_rp2040_switch_core(machine);
+	memset(machine->regs, 0, sizeof(machine->regs));
+	machine->psr.t = 1; // Thumb mode
+	memset(&machine->nvic, 0, sizeof(machine->nvic));
+	memset(&machine->scb, 0, sizeof(machine->scb));
+	memset(&machine->systick, 0, sizeof(machine->systick));
+	machine->scb.vtor = vtor;
+	machine->sp = sp;
+	machine->lr = RP2040_ROM_CORE1_WAIT | 1;
+	machine->pc = entry | 1;
+	machine->ipsr = 0;
+	machine->active = 0;
+	machine->pending_seen = 0;
+	machine->primask = false;
+	machine->event = false;
+	machine->sleep = SLEEP_NONE;
+	machine->call_depth = 1;
+	machine->backtrace[1].pc = machine->pc - 1;
+	machine->backtrace[1].sp = machine->sp;
+	machine->break_skip = false;
+	machine->stack_guard.count = 0;
+	machine_rp2040_switch_core(machine);
+	machine->rp2040.core1_running = true;
+	machine->rp2040.core1_cycles = machine->stats.cycles;
+	machine_log(machine, LOG_CALLS, "core 1 launched at %x (sp: %x)\n", entry & ~1u, sp);
+}
+
+// Put core 1 back in its boot ROM, where it waits for the launch sequence.
+static void machine_rp2040_stop_core1(machine_t *machine) {
+	machine->rp2040.core1_running = false;
+	machine->rp2040.launch_seq = 0;
+}
+
+// A write to the FIFO of core 1 while it is in its boot ROM, which answers
+// the launch sequence (0, 0, 1, vector table, stack pointer, entry point) by
+// echoing each word and then starts the entry point.
+static void machine_rp2040_launch_write(machine_t *machine, uint32_t value) {
+	uint32_t *seq = &machine->rp2040.launch_seq;
+	if (*seq >= 3 || value == (*seq == 2 ? 1u : 0u)) {
+		machine->rp2040.launch[(*seq)++] = value;
+	} else {
+		*seq = value == 0 ? 1 : 0;
+	}
+	if (value == 0) {
+		// The boot ROM drains its FIFO before it answers a 0.
+		machine->rp2040.fifo[1].len = 0;
+	}
+	machine_rp2040_fifo_push(machine, 0, value);
+	if (*seq == 6) {
+		*seq = 0;
+		machine_rp2040_launch_core1(machine, machine->rp2040.launch[3], machine->rp2040.launch[4], machine->rp2040.launch[5]);
+	}
+}
+
+// Handle a write to PSM.FRCE_OFF: forcing PROC1 off resets core 1, and once
+// it is released core 1 starts in its boot ROM, which drains its FIFO and
+// pushes a 0 to tell core 0 it is ready.
+static void machine_rp2040_psm_write(machine_t *machine, uint32_t old, uint32_t value) {
+	const uint32_t proc1 = 1 << 16;
+	if ((value & proc1) && !(old & proc1)) {
+		machine_rp2040_stop_core1(machine);
+		machine->rp2040.fifo[1].len = 0;
+	} else if (!(value & proc1) && (old & proc1)) {
+		machine->rp2040.fifo[1].len = 0;
+		machine_rp2040_fifo_push(machine, 0, 0);
+	}
+}
+
+// Run the boot ROM function at the given address, as the stub of the boot ROM
+// range (see machine_set_family). It returns an error for addresses that are
+// not a ROM function.
+static int machine_rp2040_rom_call(machine_t *machine, stub_kind_t kind, uint32_t address) {
+	uint32_t *r = machine->regs;
+	if (address >= RP2040_ROM_SF_FUNCS && address < RP2040_ROM_SF_FUNCS + 2 * RP2040_ROM_NUM_FLOAT) {
+		machine_rp2040_float(machine, (address - RP2040_ROM_SF_FUNCS) / 2, false);
+	} else if (address >= RP2040_ROM_SD_FUNCS && address < RP2040_ROM_SD_FUNCS + 2 * RP2040_ROM_NUM_FLOAT) {
+		machine_rp2040_float(machine, (address - RP2040_ROM_SD_FUNCS) / 2, true);
+	} else if (address == RP2040_ROM_LOOKUP) {
+		// rom_table_lookup(table, code)
+		uint32_t table = r[0];
+		r[0] = 0;
+		for (; table + 4 <= sizeof(machine->rp2040.rom); table += 4) {
+			uint32_t code = machine->rp2040.rom[table] | machine->rp2040.rom[table + 1] << 8;
+			if (code == 0) {
+				break;
+			}
+			if (code == (r[1] & 0xffff)) {
+				r[0] = machine->rp2040.rom[table + 2] | machine->rp2040.rom[table + 3] << 8;
+				break;
+			}
+		}
+	} else if (address >= RP2040_ROM_FUNCS && address < RP2040_ROM_FUNCS + 2 * sizeof(rp2040_rom_funcs) / sizeof(rp2040_rom_funcs[0])) {
+		const char *name = rp2040_rom_funcs[(address - RP2040_ROM_FUNCS) / 2];
+		uint32_t transfer_address = machine->transfer_address;
+		switch (RP2040_ROM_CODE(name[0], name[1])) {
+		case RP2040_ROM_CODE('P', '3'): // popcount32
+			r[0] = __builtin_popcount(r[0]);
+			break;
+		case RP2040_ROM_CODE('R', '3'): { // reverse32
+			uint32_t v = r[0];
+			r[0] = 0;
+			for (int i = 0; i < 32; i++) {
+				r[0] |= ((v >> i) & 1) << (31 - i);
+			}
+			break;
+		}
+		case RP2040_ROM_CODE('L', '3'): // clz32
+			r[0] = r[0] ? __builtin_clz(r[0]) : 32;
+			break;
+		case RP2040_ROM_CODE('T', '3'): // ctz32
+			r[0] = r[0] ? __builtin_ctz(r[0]) : 32;
+			break;
+		case RP2040_ROM_CODE('M', 'S'): // memset(ptr, c, n)
+		case RP2040_ROM_CODE('S', '4'): // memset4(ptr, c, n)
+			for (uint32_t i = 0; i < r[2]; i++) {
+				uint32_t c = r[1] & 0xff;
+				machine_transfer(machine, r[0] + i, STORE, &c, WIDTH_8, false);
+			}
+			break;
+		case RP2040_ROM_CODE('M', 'C'): // memcpy(dest, src, n)
+		case RP2040_ROM_CODE('C', '4'): // memcpy44(dest, src, n)
+			for (uint32_t i = 0; i < r[2]; i++) {
+				uint32_t c;
+				machine_transfer(machine, r[1] + i, LOAD, &c, WIDTH_8, false);
+				machine_transfer(machine, r[0] + i, STORE, &c, WIDTH_8, false);
+			}
+			break;
+		case RP2040_ROM_CODE('R', 'E'): // flash_range_erase(offset, count, block_size, block_cmd)
+			machine->stats.flash_erases++;
+			machine_rp2040_flash(machine, r[0], r[1], NULL);
+			break;
+		case RP2040_ROM_CODE('R', 'P'): // flash_range_program(offset, data, count)
+			machine->stats.flash_writes++;
+			for (uint32_t i = 0; i < r[2]; i++) {
+				uint32_t c;
+				machine_transfer(machine, r[1] + i, LOAD, &c, WIDTH_8, false);
+				uint8_t byte = c;
+				machine_rp2040_flash(machine, r[0] + i, 1, &byte);
+			}
+			break;
+		case RP2040_ROM_CODE('U', 'B'): // reset_to_usb_boot
+			machine_log(machine, LOG_ERROR, "\nreset to USB boot requested (PC: %x)\n", machine->lr - 1);
+			return ERR_EXIT;
+		default:
+			// The other flash functions (connect_internal_flash,
+			// flash_exit_xip, flash_flush_cache and flash_enter_cmd_xip)
+			// have nothing to do.
+			break;
+		}
+		machine->transfer_address = transfer_address;
+	} else {
+		machine_log(machine, LOG_ERROR, "\nERROR: call to unknown boot ROM address 0x%x (LR: %x)\n", address, machine->lr - 1);
+		return ERR_PC;
+	}
+	return ERR_OK;
+}
+
+// Apply a write to one of the four aliases of an RP2040 peripheral register:
+// normal, XOR, set bits and clear bits.
+static uint32_t machine_rp2040_alias_write(uint32_t old, uint32_t value, uint32_t alias) {
+	switch (alias) {
+	case 1:
+		return old ^ value;
+	case 2:
+		return old | value;
+	case 3:
+		return old & ~value;
+	default:
+		return value;
+	}
+}
+
+// Return the stored value of a register of a peripheral that isn't modelled,
+// or NULL when there is no room to store more registers.
+static uint32_t *machine_rp2040_reg(machine_t *machine, uint32_t address) {
+	size_t num = sizeof(machine->rp2040.regs) / sizeof(machine->rp2040.regs[0]);
+	size_t i = (address >> 2) * 2654435761u % num;
+	for (size_t tries = 0; tries < num; tries++, i = (i + 1) % num) {
+		if (machine->rp2040.regs[i].address == 0) {
+			machine->rp2040.regs[i].address = address | 1;
+		}
+		if (machine->rp2040.regs[i].address == (address | 1)) {
+			return &machine->rp2040.regs[i].value;
+		}
+	}
+	return NULL;
+}
+
+static uint32_t machine_rp2040_reg_value(machine_t *machine, uint32_t address) {
+	uint32_t *reg = machine_rp2040_reg(machine, address);
+	return reg ? *reg : 0;
+}
+
+// Return the time of the RP2040 TIMER, in microseconds.
+static uint64_t machine_rp2040_time(machine_t *machine) {
+	return machine_ticks(machine, 1000000) + machine->rp2040.timer.offset;
+}
+
+// Fire the TIMER alarms that have passed, pending their interrupts (0..3).
+static void machine_rp2040_timer_update(machine_t *machine) {
+	uint32_t now = machine_rp2040_time(machine);
+	for (uint32_t n = 0; n < 4; n++) {
+		if ((machine->rp2040.timer.armed & (1 << n)) && (int32_t)(now - machine->rp2040.timer.alarm[n]) >= 0) {
+			machine->rp2040.timer.armed &= ~(1 << n);
+			machine->rp2040.timer.intr |= 1 << n;
+		}
+	}
+	uint32_t ints = (machine->rp2040.timer.intr | machine->rp2040.timer.intf) & machine->rp2040.timer.inte;
+	for (uint32_t n = 0; n < 4; n++) {
+		if (ints & (1 << n)) {
+			machine_pend_irq(machine, n);
+		}
+	}
+}
+
+// Access a register of the RP2040 TIMER, a 64-bit microsecond counter with
+// four alarms.
+static uint32_t machine_rp2040_timer_transfer(machine_t *machine, uint32_t offset, uint32_t alias, transfer_type_t transfer_type, uint32_t value) {
+	uint64_t now = machine_rp2040_time(machine);
+	uint32_t *reg = NULL;
+	if (offset == 0x00 && transfer_type == STORE) { // TIMEHW
+		machine->rp2040.timer.timehw = value;
+	} else if (offset == 0x04 && transfer_type == STORE) { // TIMELW
+		uint64_t time = (uint64_t)machine->rp2040.timer.timehw << 32 | value;
+		machine->rp2040.timer.offset += time - now;
+	} else if (offset == 0x08) { // TIMEHR
+		return machine->rp2040.timer.latched;
+	} else if (offset == 0x0c) { // TIMELR
+		machine->rp2040.timer.latched = now >> 32;
+		return now;
+	} else if (offset >= 0x10 && offset < 0x20) { // ALARM0..ALARM3
+		uint32_t n = (offset - 0x10) / 4;
+		if (transfer_type == STORE) {
+			machine->rp2040.timer.alarm[n] = value;
+			machine->rp2040.timer.armed |= 1 << n;
+			machine_rp2040_timer_update(machine);
+		}
+		return machine->rp2040.timer.alarm[n];
+	} else if (offset == 0x20) { // ARMED
+		if (transfer_type == STORE) {
+			machine->rp2040.timer.armed &= ~value; // write 1 to disarm
+		}
+		return machine->rp2040.timer.armed;
+	} else if (offset == 0x24) { // TIMERAWH
+		return now >> 32;
+	} else if (offset == 0x28) { // TIMERAWL
+		return now;
+	} else if (offset == 0x34) { // INTR
+		if (transfer_type == STORE) {
+			machine->rp2040.timer.intr &= ~value; // write 1 to clear
+		}
+		return machine->rp2040.timer.intr;
+	} else if (offset == 0x38) { // INTE
+		reg = &machine->rp2040.timer.inte;
+	} else if (offset == 0x3c) { // INTF
+		reg = &machine->rp2040.timer.intf;
+	} else if (offset == 0x40) { // INTS
+		return (machine->rp2040.timer.intr | machine->rp2040.timer.intf) & machine->rp2040.timer.inte;
+	} else if (offset == 0x2c || offset == 0x30) { // DBGPAUSE, PAUSE
+	} else {
+		machine_log(machine, LOG_WARN, "unknown TIMER %s at offset 0x%03x (PC: %x)\n", transfer_type == LOAD ? "load" : "store", offset, machine->pc - 3);
+	}
+	if (reg == NULL) {
+		return 0;
+	}
+	if (transfer_type == STORE) {
+		*reg = machine_rp2040_alias_write(*reg, value, alias);
+		machine_rp2040_timer_update(machine);
+	}
+	return *reg;
+}
+
+// Stop the current transfer of an RP2040 I2C controller, which also happens
+// automatically after an abort.
+static void machine_rp2040_i2c_stop(machine_t *machine, int index) {
+	if (machine->rp2040.i2c[index].active) {
+		machine_i2c_stop(machine);
+		machine->rp2040.i2c[index].active = false;
+	}
+	machine->rp2040.i2c[index].raw_intr |= 1 << 9; // STOP_DET
+}
+
+// Access a register of I2C0 or I2C1 of the RP2040 (a DesignWare I2C
+// controller) in master mode. Commands written to IC_DATA_CMD are executed
+// immediately, so the transmit FIFO is always empty. It returns false for the
+// registers that only store their value.
+static bool machine_rp2040_i2c_transfer(machine_t *machine, int index, uint32_t offset, transfer_type_t transfer_type, uint32_t *value) {
+	uint32_t base = index ? 0x40048000 : 0x40044000;
+	uint8_t *rx = machine->rp2040.i2c[index].rx;
+	uint32_t *rx_len = &machine->rp2040.i2c[index].rx_len;
+	uint32_t *raw_intr = &machine->rp2040.i2c[index].raw_intr;
+	if (offset == 0x10) { // IC_DATA_CMD
+		if (transfer_type == LOAD) {
+			*value = 0;
+			if (*rx_len != 0) {
+				*value = rx[0];
+				(*rx_len)--;
+				memmove(rx, rx + 1, *rx_len);
+			}
+			return true;
+		}
+		if (*raw_intr & (1 << 6)) {
+			return true; // TX_ABRT: the FIFO is flushed until it is cleared
+		}
+		bool read = (*value >> 8) & 1; // CMD
+		if (!machine->rp2040.i2c[index].active || machine->rp2040.i2c[index].read != read || (*value & (1 << 10))) { // RESTART
+			uint32_t address = machine_rp2040_reg_value(machine, base + 0x04) & 0x7f; // IC_TAR
+			machine->rp2040.i2c[index].active = true;
+			machine->rp2040.i2c[index].read = read;
+			if (!machine_i2c_start(machine, address << 1 | read)) {
+				machine->rp2040.i2c[index].abort_source |= 1 << 0; // ABRT_7B_ADDR_NOACK
+				*raw_intr |= 1 << 6; // TX_ABRT
+				machine_rp2040_i2c_stop(machine, index);
+				return true;
+			}
+		}
+		if (read) {
+			uint8_t c = machine_i2c_read(machine);
+			if (*rx_len < sizeof(machine->rp2040.i2c[0].rx)) {
+				rx[(*rx_len)++] = c;
+			}
+		} else if (!machine_i2c_write(machine, *value)) {
+			machine->rp2040.i2c[index].abort_source |= 1 << 3; // ABRT_TXDATA_NOACK
+			*raw_intr |= 1 << 6; // TX_ABRT
+			machine_rp2040_i2c_stop(machine, index);
+			return true;
+		}
+		if (*value & (1 << 9)) { // STOP
+			machine_rp2040_i2c_stop(machine, index);
+		}
+		return true;
+	}
+	if (transfer_type == STORE) {
+		return false;
+	}
+	uint32_t raw = *raw_intr | 1 << 4 | (*rx_len != 0) << 2; // TX_EMPTY, RX_FULL
+	if (offset == 0x2c) { // IC_INTR_STAT
+		*value = raw & machine_rp2040_reg_value(machine, base + 0x30); // IC_INTR_MASK
+	} else if (offset == 0x34) { // IC_RAW_INTR_STAT
+		*value = raw;
+	} else if (offset == 0x40) { // IC_CLR_INTR
+		*value = *raw_intr != 0;
+		*raw_intr = 0;
+		machine->rp2040.i2c[index].abort_source = 0;
+	} else if (offset == 0x54) { // IC_CLR_TX_ABRT
+		*value = (*raw_intr >> 6) & 1;
+		*raw_intr &= ~(1u << 6);
+		machine->rp2040.i2c[index].abort_source = 0;
+	} else if (offset == 0x60) { // IC_CLR_STOP_DET
+		*value = (*raw_intr >> 9) & 1;
+		*raw_intr &= ~(1u << 9);
+	} else if (offset == 0x70) { // IC_STATUS
+		*value = 1 << 1 | 1 << 2 | (*rx_len != 0) << 3; // TFNF, TFE, RFNE
+	} else if (offset == 0x74) { // IC_TXFLR
+		*value = 0;
+	} else if (offset == 0x78) { // IC_RXFLR
+		*value = *rx_len;
+	} else if (offset == 0x80) { // IC_TX_ABRT_SOURCE
+		*value = machine->rp2040.i2c[index].abort_source;
+	} else if (offset == 0x9c) { // IC_ENABLE_STATUS
+		*value = machine_rp2040_reg_value(machine, base + 0x6c) & 1; // IC_ENABLE
+	} else {
+		return false;
+	}
+	return true;
+}
+
+// Return the GPIO_IN register of the RP2040. Outputs read what they drive,
+// inputs read what the host drives on them or else their pull-up.
+static uint32_t machine_rp2040_gpio_in(machine_t *machine) {
+	uint32_t in = 0;
+	for (uint32_t pin = 0; pin < 30; pin++) {
+		int external = machine_gpio_external(machine, pin);
+		uint32_t level;
+		if ((machine->rp2040.gpio_oe >> pin) & 1) {
+			level = (machine->rp2040.gpio_out >> pin) & 1;
+		} else if (external >= 0) {
+			level = external;
+		} else {
+			level = (machine_rp2040_reg_value(machine, 0x4001c004 + pin * 4) >> 3) & 1; // PADS_BANK0.GPIOn.PUE
+		}
+		in |= level << pin;
+	}
+	return in;
+}
+
+// Return IO_BANK0.INTRn: the latched edges and the current levels of GPIO
+// pins 8n..8n+7.
+static uint32_t machine_rp2040_gpio_intr(machine_t *machine, uint32_t n) {
+	uint32_t in = machine_rp2040_gpio_in(machine);
+	uint32_t intr = machine->rp2040.gpio_intr[n];
+	for (uint32_t i = 0; i < 8 && n * 8 + i < 30; i++) {
+		intr |= ((in >> (n * 8 + i)) & 1 ? 2u : 1u) << (i * 4); // LEVEL_HIGH, LEVEL_LOW
+	}
+	return intr;
+}
+
+// Return IO_BANK0.PROC0_INTSn: the GPIO interrupts of core 0 that are
+// enabled or forced.
+static uint32_t machine_rp2040_gpio_ints(machine_t *machine, uint32_t n) {
+	uint32_t inte = machine_rp2040_reg_value(machine, 0x40014100 + n * 4);
+	uint32_t intf = machine_rp2040_reg_value(machine, 0x40014110 + n * 4);
+	return (machine_rp2040_gpio_intr(machine, n) & inte) | intf;
+}
+
+// Raise IO_IRQ_BANK0 when a GPIO interrupt of core 0 is active.
+static void machine_rp2040_gpio_irq(machine_t *machine) {
+	for (uint32_t n = 0; n < 4; n++) {
+		if (machine_rp2040_gpio_ints(machine, n) != 0) {
+			machine_pend_irq(machine, 13);
+			return;
+		}
+	}
+}
+
+// Latch the edges of the GPIO pins that changed level in IO_BANK0.INTR0..3.
+static void machine_rp2040_gpio_edges(machine_t *machine, uint32_t changed, uint32_t in) {
+	for (uint32_t pin = 0; pin < 30; pin++) {
+		if ((changed >> pin) & 1) {
+			machine->rp2040.gpio_intr[pin / 8] |= ((in >> pin) & 1 ? 8u : 4u) << (pin % 8 * 4); // EDGE_HIGH, EDGE_LOW
+		}
+	}
+	machine_rp2040_gpio_irq(machine);
+}
+
+// Convert UART errors to the bit order of the RP2040: FE, PE, BE and OE.
+static uint32_t machine_rp2040_uart_errors(uint32_t errors) {
+	return ((errors & UART_ERROR_FRAMING) ? 1 : 0) | ((errors & UART_ERROR_PARITY) ? 2 : 0) | ((errors & UART_ERROR_BREAK) ? 4 : 0) | ((errors & UART_ERROR_OVERRUN) ? 8 : 0);
+}
+
+// Access UARTDR, UARTRSR or UARTFR of UART0 or UART1 (a PL011). The other
+// registers are stored like those of other peripherals, and configure the
+// line: UARTIBRD, UARTFBRD, UARTLCR_H and UARTCR.
+static uint32_t machine_rp2040_uart_transfer(machine_t *machine, uint32_t base, uint32_t offset, transfer_type_t transfer_type, uint32_t value) {
+	uart_t *uart = &machine->uart[base == 0x40038000 ? 1 : 0];
+	uint32_t divisor = machine_rp2040_reg_value(machine, base + 0x24) * 64 + (machine_rp2040_reg_value(machine, base + 0x28) & 0x3f); // UARTIBRD, UARTFBRD
+	uint32_t lcr_h = machine_rp2040_reg_value(machine, base + 0x2c);
+	uint32_t cr = machine_rp2040_reg_value(machine, base + 0x30);
+	uint32_t frame_bits = 1 + 5 + ((lcr_h >> 5) & 3) + ((lcr_h >> 1) & 1) + ((lcr_h >> 3) & 1 ? 2 : 1); // WLEN, PEN, STP2
+	uint32_t depth = (lcr_h & (1 << 4)) ? 32 : 1; // FEN
+	machine_uart_configure(machine, uart, divisor != 0 ? (uint64_t)machine->clock * 4 / divisor : 0, frame_bits, cr & (1 << 14), cr & (1 << 15), depth); // RTSEN, CTSEN
+	if (offset == 0x000) { // UARTDR
+		if (transfer_type == STORE) {
+			machine_uart_send(machine, uart, value & 0xff);
+			return 0;
+		}
+		uint32_t errors;
+		uint32_t c = machine_uart_read(machine, uart, &errors);
+		return c | machine_rp2040_uart_errors(errors) << 8;
+	} else if (offset == 0x004) { // UARTRSR
+		if (transfer_type == STORE) {
+			uart->rx_overrun = false; // any write clears the errors
+			return 0;
+		}
+		machine_uart_receive(machine, uart);
+		return machine_rp2040_uart_errors(machine_uart_rx_errors(machine, uart) & ~UART_ERROR_OVERRUN) | (uart->rx_overrun ? 8 : 0);
+	} else if (transfer_type == LOAD) { // UARTFR
+		uint32_t pending = machine_uart_tx_pending(machine, uart);
+		uint32_t fr = uart->cts ? 1 << 0 : 0; // CTS
+		if (pending != 0) {
+			fr |= 1 << 3; // BUSY
+		}
+		if (!machine_uart_rx_ready(machine, uart)) {
+			fr |= 1 << 4; // RXFE
+		}
+		if (pending > depth || uart->tx_held >= 0) {
+			fr |= 1 << 5; // TXFF
+		}
+		if (uart->rx_len >= depth) {
+			fr |= 1 << 6; // RXFF
+		}
+		if (pending <= 1 && uart->tx_held < 0) {
+			fr |= 1 << 7; // TXFE
+		}
+		return fr;
+	}
+	return 0;
+}
+
+// Access a register of the RP2040 peripherals on the APB and AHB buses.
+// UART0, UART1 and TIMER are modelled. Other peripherals store their
+// registers, and report that resets are done, that oscillators are stable,
+// that PLLs are locked and that clock switches have taken effect.
+static uint32_t machine_rp2040_transfer(machine_t *machine, uint32_t address, transfer_type_t transfer_type, uint32_t value) {
+	uint32_t alias = (address >> 12) & 3; // normal, XOR, set or clear
+	uint32_t base = address & ~0x3000u;
+	if ((base & ~0xfffu) == 0x40054000) { // TIMER
+		machine_reschedule(machine, EVENT_RP2040_TIMER);
+		return machine_rp2040_timer_transfer(machine, base & 0xfff, alias, transfer_type, value);
+	} else if (((base & ~0xfffu) == 0x40034000 || (base & ~0xfffu) == 0x40038000) && ((base & 0xfff) == 0x000 || (base & 0xfff) == 0x004 || (base & 0xfff) == 0x018)) { // UART0, UART1: UARTDR, UARTRSR, UARTFR
+		return machine_rp2040_uart_transfer(machine, base & ~0xfffu, base & 0xfff, transfer_type, value);
+	} else if (((base & ~0xfffu) == 0x40044000 || (base & ~0xfffu) == 0x40048000) && machine_rp2040_i2c_transfer(machine, base >= 0x40048000, base & 0xfff, transfer_type, &value)) { // I2C0, I2C1
+		return value;
+	} else if (base == 0x4003c008 || base == 0x40040008) { // SPI0.SSPDR, SPI1.SSPDR
+		// The SD card and the SPI devices of the host are on the bus, and
+		// transfers complete immediately.
+		uint8_t *rx = machine->rp2040.spi[base == 0x40040008].rx;
+		uint32_t *rx_len = &machine->rp2040.spi[base == 0x40040008].rx_len;
+		if (transfer_type == STORE) {
+			uint8_t in = machine_spi_byte(machine, value);
+			if (*rx_len < sizeof(machine->rp2040.spi[0].rx)) {
+				rx[(*rx_len)++] = in;
+			}
+			return 0;
+		}
+		if (*rx_len == 0) {
+			return 0;
+		}
+		uint32_t result = rx[0];
+		(*rx_len)--;
+		memmove(rx, rx + 1, *rx_len);
+		return result;
+	} else if (transfer_type == LOAD && (base == 0x4003c00c || base == 0x4004000c)) { // SPI0.SSPSR, SPI1.SSPSR
+		return 1 << 0 | 1 << 1 | (machine->rp2040.spi[base == 0x4004000c].rx_len != 0) << 2; // TFE, TNF, RNE
+	} else if (base >= 0x400140f0 && base < 0x40014100) { // IO_BANK0.INTR0..3
+		if (transfer_type == LOAD) {
+			return machine_rp2040_gpio_intr(machine, (base - 0x400140f0) / 4);
+		}
+		machine->rp2040.gpio_intr[(base - 0x400140f0) / 4] &= ~value; // edges are cleared by writing one
+		machine_rp2040_gpio_irq(machine);
+		return 0;
+	} else if (transfer_type == LOAD && base >= 0x40014120 && base < 0x40014130) { // IO_BANK0.PROC0_INTS0..3
+		return machine_rp2040_gpio_ints(machine, (base - 0x40014120) / 4);
+	}
+
+	if (machine_find_peripheral(machine, base) == NULL) {
+		machine_log(machine, LOG_WARN, "unknown %s peripheral address: 0x%08x (value: 0x%x, PC: %x)\n", transfer_type == LOAD ? "load" : "store", address, value, machine->pc - 3);
+	}
+	uint32_t *reg = machine_rp2040_reg(machine, base);
+	if (reg == NULL) {
+		machine_log(machine, LOG_WARN, "too many RP2040 registers, ignoring %s of 0x%08x (PC: %x)\n", transfer_type == LOAD ? "load" : "store", address, machine->pc - 3);
+		return 0;
+	}
+	if (transfer_type == STORE) {
+		uint32_t old = *reg;
+		*reg = machine_rp2040_alias_write(*reg, value, alias);
+		if (base == 0x40010004) { // PSM.FRCE_OFF
+			machine_rp2040_psm_write(machine, old, *reg);
+		} else if (base == 0x4001800c) { // IO_QSPI.GPIO_QSPI_SS_CTRL
+			machine_qspi_flash_select(machine, ((*reg >> 8) & 3) == 2); // OUTOVER: drive low
+		} else if (base >= 0x40014100 && base < 0x40014120) { // IO_BANK0.PROC0_INTE0..3, PROC0_INTF0..3
+			machine_rp2040_gpio_irq(machine);
+		}
+		return 0;
+	}
+	if (base == 0x40000000) { // SYSINFO.CHIP_ID
+		return 0x20002927; // B2
+	} else if (base == 0x40000004) { // SYSINFO.PLATFORM
+		return 2; // ASIC
+	} else if (base == 0x4000c008) { // RESETS.RESET_DONE
+		return ~machine_rp2040_reg_value(machine, 0x4000c000) & 0x01ffffff;
+	} else if (base == 0x4001000c) { // PSM.DONE
+		return ~machine_rp2040_reg_value(machine, 0x40010004) & 0x0001ffff;
+	} else if (base >= 0x40008000 && base < 0x40008078 && (base - 0x40008000) % 12 == 8) { // CLOCKS.CLK_*_SELECTED
+		uint32_t ctrl = machine_rp2040_reg_value(machine, base - 8);
+		if (base == 0x40008038) { // CLK_REF_SELECTED
+			return 1 << (ctrl & 3);
+		} else if (base == 0x40008044) { // CLK_SYS_SELECTED
+			return 1 << (ctrl & 1);
+		}
+		return 1;
+	} else if (base == 0x40024004 || base == 0x40060018) { // XOSC.STATUS, ROSC.STATUS
+		return 1u << 31 | 1 << 12; // STABLE, ENABLED
+	} else if (base == 0x40028000 || base == 0x4002c000) { // PLL_SYS.CS, PLL_USB.CS
+		return *reg | 1u << 31; // LOCK
+	} else if (base == 0x4005802c) { // WATCHDOG.TICK
+		return *reg | (*reg & (1 << 9)) << 1; // RUNNING follows ENABLE
+	}
+	return *reg;
+}
+
+// Access a register of XIP_CTRL or XIP_SSI. The flash is always memory
+// mapped, but the SSI data register talks directly to the flash while chip
+// select is forced low through IO_QSPI, like flash_do_cmd in the Pico SDK does.
+static uint32_t machine_rp2040_ssi_transfer(machine_t *machine, uint32_t address, transfer_type_t transfer_type, uint32_t value) {
+	if (address == 0x18000020) { // SSI.TXFLR
+		return 0;
+	} else if (address == 0x18000024) { // SSI.RXFLR
+		return machine->rp2040.ssi_rx_len;
+	} else if (address == 0x18000028) { // SSI.SR
+		return 1 << 1 | 1 << 2 | (machine->rp2040.ssi_rx_len != 0) << 3; // TFNF, TFE, RFNE
+	} else if (address == 0x18000060) { // SSI.DR0
+		if (transfer_type == STORE) {
+			uint8_t in = machine_qspi_flash_transfer(machine, value);
+			if (machine->rp2040.ssi_rx_len < sizeof(machine->rp2040.ssi_rx)) {
+				machine->rp2040.ssi_rx[machine->rp2040.ssi_rx_len++] = in;
+			}
+			return 0;
+		}
+		if (machine->rp2040.ssi_rx_len == 0) {
+			return 0;
+		}
+		uint32_t result = machine->rp2040.ssi_rx[0];
+		machine->rp2040.ssi_rx_len--;
+		memmove(machine->rp2040.ssi_rx, machine->rp2040.ssi_rx + 1, machine->rp2040.ssi_rx_len);
+		return result;
+	}
+	uint32_t *reg = machine_rp2040_reg(machine, address);
+	if (reg == NULL) {
+		return 0;
+	}
+	if (transfer_type == STORE) {
+		*reg = value;
+	}
+	return *reg;
+}
+
+// Calculate the result of the SIO hardware divider.
+static void machine_rp2040_divide(machine_t *machine, bool is_signed) {
+	uint32_t dividend = machine->rp2040.dividend, divisor = machine->rp2040.divisor;
+	if (divisor == 0) {
+		machine->rp2040.quotient = is_signed && (int32_t)dividend < 0 ? 1 : 0xffffffff;
+		machine->rp2040.remainder = dividend;
+	} else if (is_signed && !((int32_t)dividend == INT32_MIN && (int32_t)divisor == -1)) {
+		machine->rp2040.quotient = (int32_t)dividend / (int32_t)divisor;
+		machine->rp2040.remainder = (int32_t)dividend % (int32_t)divisor;
+	} else if (is_signed) {
+		machine->rp2040.quotient = dividend;
+		machine->rp2040.remainder = 0;
+	} else {
+		machine->rp2040.quotient = dividend / divisor;
+		machine->rp2040.remainder = dividend % divisor;
+	}
+}
+
+// Access a register of the RP2040 SIO: GPIO, the inter-core FIFOs, the
+// hardware divider and spinlocks, as seen by the executing core. The
+// interpolators are not supported.
+static uint32_t machine_rp2040_sio_transfer(machine_t *machine, uint32_t offset, transfer_type_t transfer_type, uint32_t value) {
+	uint32_t core = machine->rp2040.core;
+	if (offset == 0x000) { // CPUID
+		return core;
+	} else if (offset == 0x004) { // GPIO_IN
+		return machine_rp2040_gpio_in(machine);
+	} else if (offset >= 0x010 && offset < 0x030) { // GPIO_OUT, GPIO_OE and their SET, CLR and XOR registers
+		uint32_t *reg = offset < 0x020 ? &machine->rp2040.gpio_out : &machine->rp2040.gpio_oe;
+		if (transfer_type == STORE) {
+			const uint32_t aliases[4] = {0, 2, 3, 1}; // normal, set, clear, XOR
+			*reg = machine_rp2040_alias_write(*reg, value, aliases[(offset / 4) % 4]) & 0x3fffffff;
+		}
+		return *reg;
+	} else if (offset == 0x008 || (offset >= 0x030 && offset < 0x050)) { // GPIO_HI_*
+	} else if (offset == 0x050) { // FIFO_ST
+		if (transfer_type == STORE) {
+			machine->rp2040.fifo_errors[core] &= ~value; // WOF and ROE are cleared by writing one
+			return 0;
+		}
+		bool vld = machine->rp2040.fifo[core].len != 0;
+		bool rdy = machine->rp2040.fifo[core ^ 1].len < 8;
+		return vld | rdy << 1 | machine->rp2040.fifo_errors[core];
+	} else if (offset == 0x054) { // FIFO_WR
+		if (transfer_type == STORE) {
+			if (core == 0 && !machine->rp2040.core1_running && !(machine_rp2040_reg_value(machine, 0x40010004) & (1 << 16))) {
+				machine_rp2040_launch_write(machine, value);
+			} else {
+				machine_rp2040_fifo_push(machine, core ^ 1, value);
+			}
+		}
+	} else if (offset == 0x058) { // FIFO_RD
+		if (transfer_type == LOAD) {
+			if (machine->rp2040.fifo[core].len == 0) {
+				machine->rp2040.fifo_errors[core] |= 1 << 3; // ROE
+				machine_rp2040_fifo_irq(machine, core);
+				return 0;
+			}
+			uint32_t result = machine->rp2040.fifo[core].data[0];
+			machine->rp2040.fifo[core].len--;
+			memmove(machine->rp2040.fifo[core].data, machine->rp2040.fifo[core].data + 1, machine->rp2040.fifo[core].len * 4);
+			machine_rp2040_fifo_irq(machine, core);
+			return result;
+		}
+	} else if (offset == 0x05c) { // SPINLOCK_ST
+		return machine->rp2040.spinlocks;
+	} else if (offset >= 0x060 && offset < 0x070) { // DIV_UDIVIDEND, DIV_UDIVISOR, DIV_SDIVIDEND, DIV_SDIVISOR
+		uint32_t *reg = (offset / 4) % 2 == 0 ? &machine->rp2040.dividend : &machine->rp2040.divisor;
+		if (transfer_type == STORE) {
+			*reg = value;
+			machine_rp2040_divide(machine, offset >= 0x068);
+		}
+		return *reg;
+	} else if (offset == 0x070 || offset == 0x074) { // DIV_QUOTIENT, DIV_REMAINDER
+		uint32_t *reg = offset == 0x070 ? &machine->rp2040.quotient : &machine->rp2040.remainder;
+		if (transfer_type == STORE) {
+			*reg = value; // restoring the divider state after an interrupt
+		}
+		return *reg;
+	} else if (offset == 0x078) { // DIV_CSR
+		return 1; // READY: results are available immediately
+	} else if (offset >= 0x100 && offset < 0x180) { // SPINLOCK0..SPINLOCK31
+		uint32_t bit = 1u << ((offset - 0x100) / 4);
+		if (transfer_type == STORE) {
+			machine->rp2040.spinlocks &= ~bit;
+			return 0;
+		}
+		if (machine->rp2040.spinlocks & bit) {
+			return 0; // already claimed
+		}
+		machine->rp2040.spinlocks |= bit;
+		return bit;
+	} else {
+		machine_log(machine, LOG_WARN, "unknown SIO %s at offset 0x%03x (PC: %x)\n", transfer_type == LOAD ? "load" : "store", offset, machine->pc - 3);
+	}
+	return 0;
+}
+
+// Cycles between polls of the terminal for input to the nRF UART, which is
+// relatively slow.
+#define MACHINE_UART_POLL (256)
+
+// Return the cycle at which an event happens next given the current state of
+// its peripheral, or UINT64_MAX if it doesn't. Peripherals that count another
+// clock than the CPU clock are predicted with machine_cycles_until. When
+// following the host clock the prediction may be off: the event then runs
+// early without effect and is scheduled again, or a little late.
+static uint64_t machine_event_cycle(machine_t *machine, event_t event) {
+	uint64_t now = machine->stats.cycles;
+	switch (event) {
+		case EVENT_SYSTICK:
+			if (!(machine->systick.csr & 1) || machine->systick.rvr == 0) {
+				return UINT64_MAX;
+			}
+			return machine->systick.base + machine->systick.rvr + 1;
+		case EVENT_RTC0:
+		case EVENT_RTC1:
+		case EVENT_RTC2: {
+			rtc_t *rtc = &machine->rtc[event - EVENT_RTC0];
+			if (!rtc->running) {
+				return UINT64_MAX;
+			}
+			uint64_t next = ((rtc->last >> 24) + 1) << 24; // OVRFLW
+			if ((rtc->periph.inten | rtc->evten) & 1) {
+				next = rtc->last + 1; // TICK
+			}
+			for (int n = 0; n < 4; n++) {
+				machine_min_cycle(&next, machine_counter_next(rtc->last, rtc->cc[n], 24));
+			}
+			uint64_t ticks = rtc->start_ticks + (next - rtc->counter) * (rtc->prescaler + 1);
+			return now + machine_cycles_until(machine, 32768, ticks);
+		}
+		case EVENT_TIMER0:
+		case EVENT_TIMER1:
+		case EVENT_TIMER2:
+		case EVENT_TIMER3:
+		case EVENT_TIMER4: {
+			int index = event - EVENT_TIMER0;
+			nrf_timer_t *timer = &machine->nrf.timer[index];
+			if (!timer->running || timer->mode != 0) {
+				return UINT64_MAX; // counter mode only counts with TASKS_COUNT
+			}
+			uint64_t next = UINT64_MAX;
+			for (uint32_t n = 0; n < nrf_timer_num_cc[index]; n++) {
+				machine_min_cycle(&next, machine_counter_next(timer->last, timer->cc[n], machine_timer_bits(timer)));
+			}
+			uint64_t ticks = timer->start_ticks + (next - timer->counter);
+			return now + machine_cycles_until(machine, 16000000 >> timer->prescaler, ticks);
+		}
+		case EVENT_RADIO:
+			if (!machine->nrf.radio.pending) {
+				return UINT64_MAX;
+			}
+			return now + machine_cycles_until(machine, 1000000, machine->nrf.radio.pending_at);
+		case EVENT_I2S: {
+			if (!machine->nrf.i2s.started) {
+				return UINT64_MAX;
+			}
+			uint32_t channels;
+			uint32_t bits = machine_i2s_format(machine, &channels);
+			uint32_t maxcnt = machine->nrf.i2s.regs[(0x550 - 0x500) / 4] & 0x3fff;
+			uint32_t frames = maxcnt * (bits == 24 ? 1 : 32 / bits) / channels;
+			if (frames == 0) {
+				return UINT64_MAX;
+			}
+			return now + machine_cycles_until(machine, machine->nrf.i2s.rate, machine->nrf.i2s.start + frames);
+		}
+		case EVENT_PDM: {
+			if (!machine->nrf.pdm.started) {
+				return UINT64_MAX;
+			}
+			uint32_t *regs = machine->nrf.pdm.regs;
+			uint32_t frames = (regs[(0x564 - 0x500) / 4] & 0x7fff) / (regs[(0x508 - 0x500) / 4] & 1 ? 1 : 2);
+			if (frames == 0) {
+				return UINT64_MAX;
+			}
+			return now + machine_cycles_until(machine, machine->nrf.pdm.rate, machine->nrf.pdm.start + frames);
+		}
+		case EVENT_SAADC: {
+			if (!machine->nrf.saadc.sampling) {
+				return UINT64_MAX;
+			}
+			return now + machine_cycles_until(machine, 16000000, machine->nrf.saadc.next);
+		}
+		case EVENT_UART: {
+			if (machine->family != FAMILY_NRF) {
+				return UINT64_MAX; // the other UARTs are updated when they are read
+			}
+			uint64_t cycle = UINT64_MAX;
+			for (int i = 0; i < MACHINE_NUM_UARTS; i++) {
+				uart_t *uart = &machine->uart[i];
+				if (uart->tx_waiting && machine_uart_cts(machine, uart)) {
+					return now;
+				}
+				if (uart->tx_busy && uart->tx_held < 0) {
+					// ENDTX, when the last character has been sent.
+					uint64_t done = machine_uart_char_cycles(machine, uart) != 0 ? uart->tx_done : now;
+					machine_min_cycle(&cycle, done > now ? done : now);
+				}
+				if (uart->rx_started) {
+					// Poll at fixed cycles, so that polling the registers
+					// (which schedules this again) doesn't postpone it.
+					machine_min_cycle(&cycle, (now | (MACHINE_UART_POLL - 1)) + 1);
+				}
+			}
+			return cycle;
+		}
+		case EVENT_RP2040_TIMER: {
+			if (machine->family != FAMILY_RP2040) {
+				return UINT64_MAX;
+			}
+			uint64_t cycle = UINT64_MAX;
+			if ((machine->rp2040.timer.intr | machine->rp2040.timer.intf) & machine->rp2040.timer.inte) {
+				// The interrupt is level-triggered: pend it again every 16
+				// cycles while it is asserted.
+				cycle = (now | 15) + 1;
+			}
+			uint32_t time = machine_rp2040_time(machine);
+			for (uint32_t n = 0; n < 4; n++) {
+				if (machine->rp2040.timer.armed & (1 << n)) {
+					uint32_t us = machine->rp2040.timer.alarm[n] - time;
+					if ((int32_t)us <= 0) {
+						return now;
+					}
+					machine_min_cycle(&cycle, now + machine_cycles_until(machine, 1000000, machine_ticks(machine, 1000000) + us));
+				}
+			}
+			return cycle;
+		}
+		case EVENT_WS2812:
+			if (machine->ws2812.bits == 0 || machine->ws2812.level) {
+				return UINT64_MAX;
+			}
+			return machine->ws2812.edge + (uint64_t)machine->clock * WS2812_RESET / 1000000000;
+		case EVENT_HOST:
+			return machine->host_timer.fire != NULL ? machine->host_timer.cycle : UINT64_MAX;
+		case EVENT_NUM:
+			break;
+	}
+	return UINT64_MAX;
+}
+
+// Run an event: update its peripheral to the current time.
+static void machine_event_run(machine_t *machine, event_t event) {
+	switch (event) {
+		case EVENT_SYSTICK:
+			machine_systick_update(machine);
+			break;
+		case EVENT_RTC0:
+		case EVENT_RTC1:
+		case EVENT_RTC2:
+			machine_rtc_update(machine, event - EVENT_RTC0);
+			break;
+		case EVENT_TIMER0:
+		case EVENT_TIMER1:
+		case EVENT_TIMER2:
+		case EVENT_TIMER3:
+		case EVENT_TIMER4:
+			machine_timer_update(machine, event - EVENT_TIMER0);
+			break;
+		case EVENT_RADIO:
+			machine_radio_update(machine);
+			break;
+		case EVENT_I2S:
+			machine_i2s_update(machine);
+			break;
+		case EVENT_PDM:
+			machine_pdm_update(machine);
+			break;
+		case EVENT_SAADC:
+			machine_saadc_update(machine);
+			break;
+		case EVENT_UART:
+			for (int i = 0; i < MACHINE_NUM_UARTS; i++) {
+				machine_uart_update(machine, &machine->uart[i]);
+			}
+			break;
+		case EVENT_RP2040_TIMER:
+			machine_rp2040_timer_update(machine);
+			break;
+		case EVENT_WS2812:
+			machine_ws2812_update(machine);
+			break;
+		case EVENT_HOST: {
+			// The host may set the timer again from the callback.
+			host_timer_t fire = machine->host_timer.fire;
+			machine->host_timer.fire = NULL;
+			if (fire != NULL) {
+				fire(machine);
+			}
+			break;
+		}
+		case EVENT_NUM:
+			break;
+	}
+}
+
+// Schedule the events whose peripherals changed since the last instruction.
+static void machine_events_update(machine_t *machine) {
+	uint32_t dirty = machine->events.dirty;
+	machine->events.dirty = 0;
+	for (event_t event = 0; event < EVENT_NUM; event++) {
+		if (dirty & (1u << event)) {
+			machine_schedule(machine, event, machine_event_cycle(machine, event));
+		}
+	}
+}
+
+// Run the events that are due, and schedule them again. An event that is
+// still due afterwards (like a timer with many matches) runs again before the
+// next instruction.
+static void machine_events_run(machine_t *machine) {
+	uint32_t due = 0;
+	while (machine->events.len != 0 && machine->events.heap[0].cycle <= machine->stats.cycles) {
+		event_t event = machine->events.heap[0].event;
+		due |= 1u << event;
+		machine_schedule(machine, event, UINT64_MAX);
+	}
+	for (event_t event = 0; event < EVENT_NUM; event++) {
+		if (due & (1u << event)) {
+			machine_event_run(machine, event);
+			machine_reschedule(machine, event);
+		}
+	}
+	machine_events_update(machine);
+}
+
+// Return the input levels of the pins of a GPIO port, as the firmware reads
+// them.
+static uint32_t machine_gpio_in(machine_t *machine, uint32_t port) {
+	if (machine->family == FAMILY_STM32) {
+		// Only one of the two register sets is configured by the firmware.
+		return (port < 7 ? machine_stm32_gpio_in(machine, port, false) : 0) | machine_stm32_gpio_in(machine, port, true);
+	} else if (machine->family == FAMILY_RP2040) {
+		return port == 0 ? machine_rp2040_gpio_in(machine) : 0;
+	}
+	return port < 2 ? machine_nrf_gpio_in(machine, port) : 0;
+}
+
+// Remember the current input levels of all GPIO pins, so that only later
+// changes generate interrupts.
+static void machine_gpio_inputs_sync(machine_t *machine) {
+	for (uint32_t port = 0; port < MACHINE_GPIO_PORTS; port++) {
+		machine->gpio_input.in[port] = machine_gpio_in(machine, port);
+	}
+}
+
+// Generate the interrupts and events of the GPIO pins whose input level
+// changed since the last call.
+static void machine_gpio_inputs_update(machine_t *machine) {
+	uint32_t ports = machine->family == FAMILY_STM32 ? 11 : machine->family == FAMILY_RP2040 ? 1 : 2;
+	for (uint32_t port = 0; port < ports; port++) {
+		uint32_t in = machine_gpio_in(machine, port);
+		uint32_t changed = in ^ machine->gpio_input.in[port];
+		machine->gpio_input.in[port] = in;
+		if (changed == 0) {
+			continue;
+		}
+		if (machine->family == FAMILY_STM32) {
+			machine_stm32_gpio_edges(machine, port, changed, in);
+		} else if (machine->family == FAMILY_RP2040) {
+			machine_rp2040_gpio_edges(machine, changed, in);
+		} else {
+			machine_nrf_gpio_edges(machine, port, changed, in);
+		}
+	}
+	if (machine->family == FAMILY_NRF) {
+		machine_nrf_gpio_sense(machine);
+	}
+}
+
+// Return the levels of the probed GPIO pins, a bit per probe.
+static uint32_t machine_probe_levels(machine_t *machine) {
+	uint32_t levels = 0;
+	for (uint32_t i = 0; i < machine->probe.count; i++) {
+		uint32_t pin = machine->probe.pins[i];
+		levels |= ((machine_gpio_in(machine, pin / 32) >> (pin % 32)) & 1) << i;
+	}
+	return levels;
+}
+
+// Report the levels of the probed GPIO pins to the host if any of them
+// changed.
+static void machine_probe_update(machine_t *machine) {
+	if (machine->probe.changed == NULL) {
+		return;
+	}
+	uint32_t levels = machine_probe_levels(machine);
+	if (levels != machine->probe.levels) {
+		machine->probe.levels = levels;
+		machine->probe.changed(machine, machine->stats.cycles, levels);
+	}
+}
+
+// Update everything that depends on the level of GPIO pins. This is called
+// after every store to a peripheral, as it may have changed a pin.
+static void machine_gpio_update(machine_t *machine) {
+	if (machine->ws2812.frame != NULL) {
+		machine_ws2812_edge(machine, machine_gpio_output(machine, machine->ws2812.pin), machine->stats.cycles);
+	}
+	if (machine->bus.spi_devices != 0) {
+		machine_bus_update_cs(machine);
+	}
+	if (machine->gpio_input.used) {
+		machine_gpio_inputs_update(machine);
+	}
+	machine_probe_update(machine);
+}
+
+// Report a peripheral register access to the host, see machine_set_periph_trace.
+static void machine_periph_traced(machine_t *machine, uint32_t address, transfer_type_t transfer_type, uint32_t value) {
+	if (machine->periph_trace != NULL) {
+		machine->periph_trace(machine, address, transfer_type == STORE, value, machine->instruction_pc);
+	}
+}
+
+// Return the saved registers of the function at the given address, or NULL if
+// it doesn't save any or isn't known.
+static const stack_frame_t * machine_find_stack_frame(machine_t *machine, uint32_t address) {
+	size_t low = 0;
+	size_t high = machine->stack_guard.num_frames;
+	while (low < high) {
+		size_t mid = (low + high) / 2;
+		if (machine->stack_guard.frames[mid].address < address) {
+			low = mid + 1;
+		} else {
+			high = mid;
+		}
+	}
+	if (low == machine->stack_guard.num_frames || machine->stack_guard.frames[low].address != address) {
+		return NULL;
+	}
+	return &machine->stack_guard.frames[low];
+}
+
+// Guard the registers that the called function at the given address (without
+// the Thumb bit) is going to save. It is called before the branch, so SP is
+// still the SP at the call.
+static void machine_stack_guard_call(machine_t *machine, uint32_t address) {
+	const stack_frame_t *frame = machine_find_stack_frame(machine, address);
+	if (frame == NULL || machine->stack_guard.count >= MACHINE_STACK_GUARDS) {
+		return;
+	}
+	stack_guard_t *guard = &machine->stack_guard.guards[machine->stack_guard.count++];
+	guard->frame = frame;
+	guard->entry_sp = machine->sp;
+	guard->ipsr = machine->ipsr;
+	guard->armed = false;
+	guard->lr = 0;
+}
+
+// Update the guards before the instruction at pc runs: drop those of functions
+// that returned (or were left with a longjmp or an exception return), and arm the innermost one once
+// its prologue has saved all registers.
+static void machine_stack_guard_update(machine_t *machine, uint32_t pc) {
+	while (machine->stack_guard.count != 0) {
+		stack_guard_t *guard = &machine->stack_guard.guards[machine->stack_guard.count - 1];
+		const stack_frame_t *frame = guard->frame;
+		bool prologue = pc - frame->address < frame->prologue_end - frame->address;
+		if (guard->ipsr != 0 && !(machine->active & ((uint64_t)1 << guard->ipsr))) {
+			// Called by an exception handler that returned.
+			machine->stack_guard.count--;
+			continue;
+		}
+		if (guard->ipsr != machine->ipsr || prologue) {
+			// In an exception handler that interrupted it, or not done saving
+			// registers yet.
+			return;
+		}
+		if (machine->sp >= guard->entry_sp) {
+			machine->stack_guard.count--;
+			continue;
+		}
+		if (!guard->armed && machine->sp <= guard->entry_sp - frame->saved_offset) {
+			guard->armed = true;
+			uint32_t lr_address = (guard->entry_sp - frame->lr_offset) & 0x1fffffff;
+			if (frame->lr_offset != 0 && lr_address + 4 <= machine->mem_size) {
+				guard->lr = machine->mem32[lr_address / 4];
+			}
+		}
+		return;
+	}
+}
+
+// Check a load or store against the saved registers of the functions on the
+// stack, and return ERR_MEM for a store into them or, with check_return, for
+// loading a return address that isn't the one that was saved. Only the frames
+// of the current exception (or thread mode) are checked, and only where they
+// are above SP: below it they are no longer in use.
+static int machine_stack_guard_check(machine_t *machine, uint32_t address, transfer_type_t transfer_type, width_t width) {
+	if (address < machine->sp) {
+		return ERR_OK;
+	}
+	for (size_t i = machine->stack_guard.count; i > 0; i--) {
+		stack_guard_t *guard = &machine->stack_guard.guards[i - 1];
+		const stack_frame_t *frame = guard->frame;
+		if (!guard->armed || guard->ipsr != machine->ipsr) {
+			continue;
+		}
+		uint32_t start = guard->entry_sp - frame->saved_offset;
+		if (address + (1u << width) <= start || address >= start + frame->saved_size) {
+			continue;
+		}
+		char name[128];
+		if (transfer_type == STORE) {
+			machine_log(machine, LOG_ERROR, "\nERROR: stack overflow: store to 0x%08x overwrites the registers saved by the function at %x%s, at 0x%08x..0x%08x (PC: %x)\n", address, frame->address, machine_symbol_name(machine, frame->address, name, sizeof(name)), start, start + frame->saved_size, machine->instruction_pc);
+			return ERR_MEM;
+		}
+		uint32_t lr_address = guard->entry_sp - frame->lr_offset;
+		if (machine->stack_guard.check_return && frame->lr_offset != 0 && address == lr_address && width == WIDTH_32 && (address & 0x1fffffff) + 4 <= machine->mem_size) {
+			uint32_t lr = machine->mem32[(address & 0x1fffffff) / 4];
+			if (lr != guard->lr) {
+				machine_log(machine, LOG_ERROR, "\nERROR: stack overflow: return address of the function at %x%s is 0x%08x, but 0x%08x was saved at 0x%08x (PC: %x)\n", frame->address, machine_symbol_name(machine, frame->address, name, sizeof(name)), lr, guard->lr, address, machine->instruction_pc);
+				return ERR_MEM;
+			}
+		}
+	}
+	return ERR_OK;
+}
+
+// Access a register of a built-in peripheral of the nRF family. The value is
+// the value to store, or is set to the loaded value.
+static int machine_nrf_transfer(machine_t *machine, uint32_t address, transfer_type_t transfer_type, uint32_t *value) {
+	const builtin_periph_t *periph = machine_find_peripheral(machine, address);
+	uint32_t offset = address & 0xfff;
+	switch (periph != NULL ? periph->id : -1) {
+	case BUILTIN_NRF_POWER:
+		*value = machine_power_transfer(machine, offset, transfer_type, *value);
+		break;
+	case BUILTIN_NRF_RADIO:
+		*value = machine_radio_transfer(machine, offset, transfer_type, *value);
+		machine_reschedule(machine, EVENT_RADIO);
+		break;
+	case BUILTIN_NRF_UART:
+		*value = machine_uart_transfer(machine, &machine->uart[periph->index], offset, transfer_type, *value);
+		machine_reschedule(machine, EVENT_UART);
+		break;
+	case BUILTIN_NRF_GPIOTE:
+		*value = machine_gpiote_transfer(machine, offset, transfer_type, *value);
+		break;
+	case BUILTIN_NRF_TIMER:
+		*value = machine_timer_transfer(machine, periph->index, offset, transfer_type, *value);
+		machine_reschedule(machine, EVENT_TIMER0 + periph->index);
+		break;
+	case BUILTIN_NRF_PPI:
+		*value = machine_ppi_transfer(machine, offset, transfer_type, *value);
+		break;
+	case BUILTIN_NRF_SPI:
+		*value = machine_spi_transfer(machine, periph->index, offset, transfer_type, *value);
+		break;
+	case BUILTIN_NRF_PWM:
+		*value = machine_pwm_transfer(machine, periph->index, offset, transfer_type, *value);
+		break;
+	case BUILTIN_NRF_TEMP:
+		*value = machine_temp_transfer(machine, offset, transfer_type, *value);
+		break;
+	case BUILTIN_NRF_ECB:
+		*value = machine_ecb_transfer(machine, offset, transfer_type, *value);
+		break;
+	case BUILTIN_NRF_CCM:
+		*value = machine_ccm_transfer(machine, offset, transfer_type, *value);
+		break;
+	case BUILTIN_NRF_I2S:
+		*value = machine_i2s_transfer(machine, offset, transfer_type, *value);
+		machine_reschedule(machine, EVENT_I2S);
+		break;
+	case BUILTIN_NRF_PDM:
+		*value = machine_pdm_transfer(machine, offset, transfer_type, *value);
+		machine_reschedule(machine, EVENT_PDM);
+		break;
+	case BUILTIN_NRF_SAADC:
+		*value = machine_saadc_transfer(machine, offset, transfer_type, *value);
+		machine_reschedule(machine, EVENT_SAADC);
+		break;
+	case BUILTIN_NRF_EGU:
+		*value = machine_egu_transfer(machine, periph->index, offset, transfer_type, *value);
+		break;
+	case BUILTIN_NRF_QSPI:
+		*value = machine_qspi_transfer(machine, offset, transfer_type, *value);
+		break;
+	case BUILTIN_NRF_GPIO:
+		*value = machine_gpio_transfer(machine, offset, transfer_type, *value);
+		break;
+	case BUILTIN_NRF_RTC:
+		*value = machine_rtc_transfer(machine, periph->index, offset, transfer_type, *value);
+		machine_reschedule(machine, EVENT_RTC0 + periph->index);
+		break;
+	case BUILTIN_NRF_RNG:
+		if (transfer_type == STORE && offset == 0x000) { // START
+			machine_periph_power(machine, PERIPH_RNG, true);
+		} else if (transfer_type == STORE && offset == 0x004) { // STOP
+			machine_periph_power(machine, PERIPH_RNG, false);
+		} else if (transfer_type == LOAD && offset == 0x100) { // VALRDY
+			*value = 1;
+		} else if (transfer_type == LOAD && offset == 0x508) { // VALUE
+			*value = machine_random(machine) & 0xff;
+		} else {
+			periph = NULL;
+		}
+		break;
+	case BUILTIN_NRF_NVMC:
+		if (transfer_type == LOAD && (offset == 0x400 || offset == 0x408)) { // READY, READYNEXT
+			*value = 1; // always ready
+		} else if (transfer_type == STORE && offset == 0x504) { // CONFIG
+			machine->image_writable = *value != 0;
+		} else if (transfer_type == STORE && (offset == 0x508 || offset == 0x510)) { // ERASEPAGE, ERASEPCR0
+			if ((*value & (machine->pagesize-1)) != 0 || *value >= machine->image_size) {
+				machine_log(machine, LOG_ERROR, "ERROR: invalid page address: %x (PC: %x)\n", *value, machine->pc - 3);
+				return ERR_MEM;
+			}
+			machine_flash_erase(machine, *value);
+		} else if (transfer_type == STORE && offset == 0x50c) { // ERASEALL
+			if (*value & 1) {
+				for (uint32_t page = 0; page < machine->image_size; page += machine->pagesize) {
+					machine_flash_erase(machine, page);
+				}
+			}
+		} else {
+			periph = NULL;
+		}
+		break;
+	default:
+		periph = NULL;
+	}
+	if (periph == NULL) {
+		machine_log(machine, LOG_WARN, "unknown %s peripheral address: 0x%08x (value: 0x%x, PC: %x)\n", transfer_type == LOAD ? "load" : "store", address, *value, machine->pc - 3);
+	}
+	return ERR_OK;
+}
+
+static int machine_transfer(machine_t *machine, uint32_t address, transfer_type_t transfer_type, uint32_t *reg, width_t width, bool signextend) {
+	machine->transfer_address = address;
+	if (machine->stack_guard.count != 0 && (address >> 29) == 1) {
+		int err = machine_stack_guard_check(machine, address, transfer_type, width);
+		if (err != ERR_OK) {
+			return err;
+		}
+	}
+	if (transfer_type == STORE && machine->watch.count != 0) {
+		for (size_t i = 0; i < machine->watch.count; i++) {
+			if (address - machine->watch.address[i] < machine->watch.size[i] || machine->watch.address[i] - address < (1u << width)) {
+				machine->watch.hit |= 1u << i;
+			}
+		}
+	}
+
+	// Select memory region
+	uint32_t region = address >> 29; // 3 bits for the region
+	uint32_t region_address = address & (0xffffffff >> 3);
+	if (transfer_type == STORE || region == 2 || region == 7) {
+		// Stores and peripheral accesses (even loads) may get the firmware out
+		// of a loop.
+		machine->hang.side_effect = true;
+	}
+
+	void *ptr = 0;
+	if (region == 0) {
+		// code: 0x00000000 .. 0x1fffffff
+		uint32_t xip_offset;
+		if (machine->family == FAMILY_RP2040 && address < 0x4000) {
+			// Boot ROM. Only the tables are stored, the functions are
+			// implemented in machine_rp2040_rom_call.
+			if (transfer_type == STORE) {
+				machine_log(machine, LOG_ERROR, "ERROR: write to boot ROM (PC: %x, ptr: 0x%x)\n", machine->pc - 3, address);
+				return ERR_MEM;
+			}
+			if (address >= sizeof(machine->rp2040.rom)) {
+				*reg = 0;
+				return 0;
+			}
+			ptr = &machine->rp2040.rom[address];
+		} else if (machine->family == FAMILY_RP2040 && (address & 0xf0000000) == 0x10000000 && address >= 0x14000000) {
+			// XIP_CTRL and XIP_SSI: the flash is always memory mapped.
+			if ((address & 3) != 0 || width != WIDTH_32) {
+				machine_log(machine, LOG_ERROR, "\nERROR: invalid %s peripheral address: 0x%08x (PC: %x)\n", transfer_type == LOAD ? "load" : "store", address, machine->pc - 3);
+				return ERR_MEM;
+			}
+			uint32_t value = machine_rp2040_ssi_transfer(machine, address, transfer_type, *reg);
+			if (transfer_type == LOAD) {
+				*reg = value;
+			}
+			return 0;
+		} else if (machine->family == FAMILY_RP2040) {
+			if (machine_code_offset(machine, address) < machine->image_size) {
+				ptr = &machine->image8[machine_code_offset(machine, address)];
+			}
+		} else if (region_address < machine->image_size) {
+			ptr = &machine->image8[region_address];
+		} else if (machine->flash_base != 0 && address - machine->flash_base < machine->image_size) {
+			ptr = &machine->image8[address - machine->flash_base];
+		} else if (machine->family == FAMILY_STM32 && transfer_type == LOAD && address - 0x1ffff7e0 < sizeof(machine->stm32.info_f1)) {
+			ptr = (uint8_t*)machine->stm32.info_f1 + (address - 0x1ffff7e0);
+		} else if (machine->family == FAMILY_STM32 && transfer_type == LOAD && address - 0x1fff7a10 < sizeof(machine->stm32.info_f4)) {
+			ptr = (uint8_t*)machine->stm32.info_f4 + (address - 0x1fff7a10);
+		} else if (machine->family != FAMILY_NRF) {
+			// No FICR or UICR.
+		} else if (transfer_type == LOAD && (address & 0xfffff000) == 0x10000000) {
+			*reg = machine_ficr(machine, address & 0xffc) >> (address & 3) * 8;
+			if (width != WIDTH_32) {
+				*reg &= width == WIDTH_8 ? 0xff : 0xffff;
+			}
+			return 0;
+		} else if ((address & 0xfffffc00) == 0x10001000) {
+			ptr = (uint8_t*)machine->uicr + (address & 0x3ff);
+		} else if (machine_qspi_xip_offset(machine, address, &xip_offset)) {
+			// External flash, mapped by the QSPI peripheral.
+			if (transfer_type == STORE) {
+				machine_log(machine, LOG_ERROR, "ERROR: write to QSPI XIP memory (PC: %x, ptr: 0x%x)\n", machine->pc - 3, address);
+				return ERR_MEM;
+			}
+			uint32_t offset = xip_offset;
+			if (offset + (1 << width) > machine->qspi_flash.size) {
+				*reg = 0xffffffff;
+				return 0;
+			}
+			ptr = &machine->qspi_flash.data[offset];
+		}
+		if (transfer_type == STORE && ptr != NULL) {
+			if ((address & 3) != 0 || width != WIDTH_32) {
+				machine_log(machine, LOG_ERROR, "ERROR: unaligned write to read-only memory (PC: %x, ptr: 0x%x)\n", machine->pc - 3, address);
+				return ERR_MEM;
+			}
+			if (!machine->image_writable && machine->permissions[PERM_WRITE_FLASH] == ACCESS_FAULT) {
+				machine_log(machine, LOG_ERROR, "ERROR: write to read-only memory (PC: %x, ptr: 0x%x)\n", machine->pc - 3, address);
+				return ERR_MEM;
+			}
+			if (!machine->image_writable && machine->permissions[PERM_WRITE_FLASH] == ACCESS_WARN) {
+				machine_log(machine, LOG_ERROR, "ignored write to read-only memory (PC: %x, ptr: 0x%x)\n", machine->pc - 3, address);
+				return 0;
+			}
+
+			machine->stats.flash_writes++;
+			if (machine_chance(machine, machine->flash_cut_write)) {
+				// Power is cut while writing: only some bits are
+				// programmed.
+				machine_log(machine, LOG_WARN, "\npower cut while writing to flash address 0x%08x (PC: %x)\n", address, machine->pc - 3);
+				*(uint32_t*)ptr &= *reg | machine_random(machine);
+				machine->power_cut = true;
+				return 0;
+			}
+
+			// Emulate NOR memory where bits can only be cleared.
+			*(uint32_t*)ptr &= *reg;
+			return 0;
+		}
+	} else if (region == 1) {
+		// SRAM: 0x20000000 .. 0x3ffffff
+		if (region_address < machine->mem_size) {
+			ptr = &machine->mem8[region_address];
+		}
+	} else if (region == 2) {
+		// Peripherals: 0x40000000 .. 0x5fffffff
+		// Make this a special case
+		uint32_t value = 0;
+		if ((address & 3) != 0 || width != WIDTH_32) {
+			machine_log(machine, LOG_ERROR, "\nERROR: invalid %s peripheral address: 0x%08x (PC: %x)\n", transfer_type == LOAD ? "load" : "store", address, machine->pc - 3);
+			return ERR_MEM;
+		}
+		for (size_t i = 0; i < machine->num_periph_faults; i++) {
+			periph_fault_t *fault = &machine->periph_faults[i];
+			if (fault->address != address) {
+				continue;
+			}
+			if (fault->buserror) {
+				machine_log(machine, LOG_ERROR, "\nERROR: injected bus error at peripheral address: 0x%08x (PC: %x)\n", address, machine->pc - 3);
+				return ERR_MEM;
+			}
+			if (transfer_type == LOAD) {
+				*reg = fault->value;
+			}
+			machine_periph_traced(machine, address, transfer_type, *reg);
+			return 0;
+		}
+		for (size_t i = 0; i < machine->num_external_periphs; i++) {
+			external_periph_t *periph = &machine->external_periphs[i];
+			if (address - periph->start >= periph->size) {
+				continue;
+			}
+			if (machine->external_transfer(machine, i, address - periph->start, transfer_type == STORE, reg) != ERR_OK) {
+				machine_log(machine, LOG_ERROR, "\nERROR: bus error at peripheral address: 0x%08x (PC: %x)\n", address, machine->pc - 3);
+				return ERR_MEM;
+			}
+			machine_periph_traced(machine, address, transfer_type, *reg);
+			return 0;
+		}
+		if (machine->family == FAMILY_STM32) {
+			value = machine_stm32_transfer(machine, address, transfer_type, *reg);
+		} else if (machine->family == FAMILY_RP2040) {
+			value = machine_rp2040_transfer(machine, address, transfer_type, *reg);
+		} else {
+			value = *reg;
+			int err = machine_nrf_transfer(machine, address, transfer_type, &value);
+			if (err != ERR_OK) {
+				return err;
+			}
+		}
+		if (transfer_type == LOAD) {
+			if (width == WIDTH_8) {
+				value &= 0xff;
+			} else if (width == WIDTH_16) {
+				value &= 0xffff;
+			}
+			*reg = value;
+		} else {
+			machine_gpio_update(machine);
+		}
+		machine_periph_traced(machine, address, transfer_type, *reg);
+		return 0;
+	} else if (region == 3 || region == 4) {
+		// External RAM: 0x60000000 .. 0x9fffffff
+		for (size_t i = 0; i < machine->num_ext_ram; i++) {
+			if (address - machine->ext_ram[i].start < machine->ext_ram[i].size) {
+				ptr = &machine->ext_ram[i].data[address - machine->ext_ram[i].start];
+				break;
+			}
+		}
+	} else if (region == 6 && machine->family == FAMILY_RP2040 && (address & 0xfffff000) == 0xd0000000) {
+		// SIO: 0xd0000000 .. 0xd0000fff
+		if ((address & 3) != 0 || width != WIDTH_32) {
+			machine_log(machine, LOG_ERROR, "\nERROR: invalid %s SIO address: 0x%08x (PC: %x)\n", transfer_type == LOAD ? "load" : "store", address, machine->pc - 3);
+			return ERR_MEM;
+		}
+		uint32_t value = machine_rp2040_sio_transfer(machine, address & 0xfff, transfer_type, *reg);
+		if (transfer_type == LOAD) {
+			*reg = value;
+		} else {
+			machine_gpio_update(machine);
+		}
+		machine_periph_traced(machine, address, transfer_type, *reg);
+		return 0;
+	} else if (region == 7) {
+		// Private peripheral bus + Device: 0xe0000000 .. 0xffffffff
+		if (address == 0xe000e010) {
+			// SysTick Control and Status Register
+			if (transfer_type == LOAD) {
+				machine_systick_update(machine);
+				*reg = machine->systick.csr | (machine->systick.countflag << 16);
+				machine->systick.countflag = false;
+			} else {
+				if ((*reg & 1) && !(machine->systick.csr & 1)) {
+					// SysTick is enabled, start counting.
+					machine->systick.base = machine->stats.cycles;
+				}
+				machine->systick.csr = *reg & 0b111;
+				machine_reschedule(machine, EVENT_SYSTICK);
+			}
+			return 0;
+		}
+		if (address == 0xe000e014) {
+			// SysTick Reload Value Register
+			if (transfer_type == LOAD) {
+				*reg = machine->systick.rvr;
+			} else {
+				machine->systick.rvr = *reg & 0xffffff;
+				machine_reschedule(machine, EVENT_SYSTICK);
+			}
+			return 0;
+		}
+		if (address == 0xe000e018) {
+			// SysTick Current Value Register
+			if (transfer_type == LOAD) {
+				machine_systick_update(machine);
+				uint64_t period = (uint64_t)machine->systick.rvr + 1;
+				uint64_t elapsed = machine->stats.cycles - machine->systick.base;
+				*reg = (machine->systick.csr & 1) ? (period - elapsed) % period : 0;
+			} else {
+				// Writing any value clears the counter.
+				machine->systick.base = machine->stats.cycles;
+				machine->systick.countflag = false;
+				machine_reschedule(machine, EVENT_SYSTICK);
+			}
+			return 0;
+		}
+		if (address == 0xe000e01c && transfer_type == LOAD) {
+			// SysTick Calibration Value Register: no calibration value.
+			*reg = 1 << 31; // NOREF
+			return 0;
+		}
+		if (address == 0xe000e100 || address == 0xe000e180) {
+			// NVIC Interrupt Set-enable and Clear-enable Registers
+			if (transfer_type == LOAD) {
+				*reg = machine->nvic.enabled;
+			} else if (address == 0xe000e100) {
+				machine_log(machine, LOG_WARN, "set interrupts: %08x\n", *reg);
+				machine->nvic.enabled |= *reg;
+			} else {
+				machine_log(machine, LOG_WARN, "clear interrupts: %08x\n", *reg);
+				machine->nvic.enabled &= ~*reg;
+			}
+			return 0;
+		}
+		if (address == 0xe000e200 || address == 0xe000e280) {
+			// NVIC Interrupt Set-pending and Clear-pending Registers
+			if (transfer_type == LOAD) {
+				*reg = machine->nvic.pending;
+			} else if (address == 0xe000e200) {
+				machine->nvic.pending |= *reg;
+				if (machine->scb.scr & (1 << 4)) { // SEVONPEND
+					machine->event = true;
+				}
+			} else {
+				machine->nvic.pending &= ~*reg;
+			}
+			return 0;
+		}
+		if (address == 0xe000ed04) {
+			// SCB Interrupt Control and State Register
+			if (transfer_type == LOAD) {
+				*reg = machine->ipsr | (machine->scb.pendsv << 28) | (machine->scb.pendst << 26);
+				if (machine->nvic.pending & machine->nvic.enabled) {
+					*reg |= 1 << 22; // ISRPENDING
+				}
+			} else {
+				if (*reg & (1 << 28)) { // PENDSVSET
+					machine->scb.pendsv = true;
+				} else if (*reg & (1 << 27)) { // PENDSVCLR
+					machine->scb.pendsv = false;
+				}
+				if (*reg & (1 << 26)) { // PENDSTSET
+					machine->scb.pendst = true;
+				} else if (*reg & (1 << 25)) { // PENDSTCLR
+					machine->scb.pendst = false;
+				}
+			}
+			return 0;
+		}
+		if (address == 0xe000ed08) {
+			ptr = &machine->scb.vtor;
+		}
+		if (address == 0xe000ed10) {
+			ptr = &machine->scb.scr;
+		}
+		if (address == 0xe000ed1c || address == 0xe000ed20) {
+			ptr = &machine->scb.shpr[(address - 0xe000ed1c) / 4];
+		}
+		if (address == 0xe000ed0c && transfer_type == STORE) {
+			// SCB Application Interrupt and Reset Control Register
+			if ((*reg >> 16) == 0x05fa && (*reg & (1 << 2)) != 0) {
+				// SYSRESETREQ, with the correct VECTKEY
+				machine->reset_request = true;
+			}
+			return 0;
+		}
+		if (address == 0xe000ed88) {
+			ptr = &machine->scb.cpacr;
+		}
+		if ((address & 0xffffffe0) == 0xe000e400) {
+			ptr = &machine->nvic.ip[address % 32];
+		}
+		if ((address & 0xfffffff0) == 0xf0000fe0 && transfer_type == LOAD) {
+			machine_log(machine, LOG_WARN, "private address: %x\n", address);
+			// 0xf0000fe0, 0xf0000fe4, 0xf0000fe8, 0xf0000fec
+			// Not sure what this is all about but this is what the nrf
+			// seems to expect...
+			*reg = 0;
+			return 0;
+		}
+	}
+
+	if (ptr == 0) {
+		if (transfer_type == LOAD) {
+			machine_log(machine, LOG_ERROR, "\nERROR: invalid load address: 0x%08x (PC: %x)\n", address, machine->pc - 3);
+		} else {
+			machine_log(machine, LOG_ERROR, "\nERROR: invalid store address: 0x%08x (PC: %x, value: %x)\n", address, machine->pc - 3, *reg);
+		}
+		return ERR_MEM;
+	} else if (((width == WIDTH_16 && (address & 1) != 0) || (width == WIDTH_32 && (address & 3) != 0))
+			&& !machine_versioncheck(machine, CORTEX_M4)) {
+		// Note: Cortex-M4 supports unaligned memory accesses when
+		// enabled.
+		machine_log(machine, LOG_ERROR, "\nERROR: unaligned %s address: 0x%08x (PC: %x)\n", transfer_type == LOAD ? "load" : "store", address, machine->pc - 3);
+		return ERR_MEM;
+	}
+
+	if (transfer_type == LOAD) {
+		if (width == WIDTH_8) {
+			uint8_t value = *(uint8_t*)ptr;
+			if (signextend) {
+				*reg = (int8_t)value;
+			} else {
+				*reg = value;
+			}
+		} else if (width == WIDTH_16) {
+			uint16_t value = *(uint16_t*)ptr;
+			if (signextend) {
+				*reg = (int16_t)value;
+			} else {
+				*reg = value;
+			}
+		} else if (width == WIDTH_32) {
+			*reg = *(uint32_t*)ptr;
+		} else {
+			// should be unreachable
+		}
+	} else { // STORE
+		if (width == WIDTH_8) {
+			*(uint8_t*)ptr = *reg;
+		} else if (width == WIDTH_16) {
+			*(uint16_t*)ptr = *reg;
+		} else if (width == WIDTH_32) {
+			*(uint32_t*)ptr = *reg;
+		} else {
+			// should be unreachable
+		}
+	}
+	return 0;
+}
+
+KEEPALIVE
+void machine_reset(machine_t *machine) {
+	machine_reset_cause(machine, RESET_POWERON);
+}
+
+// Reset the core and peripherals, recording the reason in RESETREAS. RAM is
+// not cleared, and neither are the retained registers of the POWER peripheral
+// unless it is a power-on reset.
+KEEPALIVE
+void machine_reset_cause(machine_t *machine, uint32_t reason) {
+	if (reason == RESET_POWERON) {
+		memset(&machine->power, 0, sizeof(machine->power));
+	}
+	machine->power.resetreas |= reason;
+	machine->reset_request = false;
+	machine->power_cut = false;
+	for (size_t i = 0; i < 13; i++) {
+		machine->regs[i] = 0;
+	}
+	memset(&machine->psr, 0, sizeof(machine->psr));
+	machine->psr.t = 1; // Thumb mode
+	memset(&machine->nvic, 0, sizeof(machine->nvic));
+	memset(&machine->scb, 0, sizeof(machine->scb));
+	for (int i = 0; i < MACHINE_NUM_UARTS; i++) {
+		uart_t *uart = &machine->uart[i];
+		uart->rx_started = false;
+		uart->tx_started = false;
+		memset(&uart->periph, 0, sizeof(uart->periph));
+		uart->enable = 0;
+		uart->rx_amount = 0;
+		uart->tx_amount = 0;
+		uart->tx_waiting = false;
+		uart->tx_busy = false;
+		uart->errorsrc = 0;
+		uart->baudrate = 0x04000000; // 250000 baud
+		uart->config = 0;
+		uart->cts_changed = false;
+		machine_uart_configure(machine, uart, 0, 10, false, false, 1);
+		uart->rx_len = 0;
+		uart->rx_overrun = false;
+		uart->errors = 0;
+		uart->tx_held = -1;
+	}
+	memset(&machine->rtc, 0, sizeof(machine->rtc));
+	memset(&machine->nrf, 0, sizeof(machine->nrf));
+	machine->nrf.i2s.regs[(0x514 - 0x500) / 4] = 0x20000000; // CONFIG.MCKFREQ: 4MHz
+	machine->nrf.i2s.regs[(0x518 - 0x500) / 4] = 6;          // CONFIG.RATIO: 256x
+	machine->nrf.i2s.regs[(0x51c - 0x500) / 4] = 1;          // CONFIG.SWIDTH: 16 bits
+	machine->nrf.pdm.regs[(0x504 - 0x500) / 4] = 0x08400000; // PDMCLKCTRL: 1.032MHz
+	machine->nrf.pdm.regs[(0x518 - 0x500) / 4] = 0x28;       // GAINL: 0dB
+	machine->nrf.pdm.regs[(0x51c - 0x500) / 4] = 0x28;       // GAINR: 0dB
+	for (int n = 0; n < 8; n++) {
+		machine->nrf.saadc.regs[(0x518 - 0x500) / 4 + n * 4] = 0x00020000; // CH[n].CONFIG: 10us acquisition
+		machine->nrf.saadc.regs[(0x51c - 0x500) / 4 + n * 4] = 0x7fff8000; // CH[n].LIMIT: no limits
+	}
+	machine->nrf.saadc.regs[(0x5f0 - 0x500) / 4] = 1;        // RESOLUTION: 10 bits
+	memset(&machine->stm32, 0, sizeof(machine->stm32));
+	memset(&machine->rp2040, 0, sizeof(machine->rp2040));
+	machine->qspi_flash.selected = false;
+	machine->sdcard.state = SDCARD_IDLE;
+	machine->sdcard.app_cmd = false;
+	machine->sdcard.cmd_len = 0;
+	machine->sdcard.response_len = 0;
+	machine->sdcard.response_pos = 0;
+	machine->bus.spi_selected = 0;
+	machine->ws2812.bits = 0;
+	machine_rp2040_rom_init(machine);
+	machine->stm32.rcc_f1[0] = 0x83; // CR: HSI on
+	machine->stm32.rcc_f4[0] = 0x83;
+	machine->stm32.rcc_f4[1] = 0x24003010; // PLLCFGR
+	machine_stm32_can_reset(machine);
+	machine->stm32.crc[0] = 0xffffffff; // DR
+	machine->stm32.crc[4] = 0xffffffff; // INIT
+	machine->stm32.crc[5] = 0x04c11db7; // POL
+	machine_stm32_info_init(machine);
+	memcpy(machine->nrf.temp.regs, nrf_temp_calibration, sizeof(nrf_temp_calibration));
+	machine->nrf.radio.power = 1;
+	for (int port = 0; port < 2; port++) {
+		for (int pin = 0; pin < 32; pin++) {
+			machine->nrf.gpio[port].pin_cnf[pin] = 2; // input buffer disconnected
+		}
+	}
+	if (machine->gpio_input.used) {
+		// Pins that the host drives don't cause edges on reset.
+		machine_gpio_inputs_sync(machine);
+	}
+	memset(&machine->systick, 0, sizeof(machine->systick));
+	memset(&machine->events, 0, sizeof(machine->events));
+	machine_reschedule_all(machine);
+	for (periph_t periph = 0; periph < PERIPH_NUM; periph++) {
+		machine_periph_power(machine, periph, false);
+	}
+	machine->ipsr = 0;
+	machine->active = 0;
+	machine->pending_seen = 0;
+	machine->primask = false;
+	machine->event = false;
+	machine->sleep = SLEEP_NONE;
+	machine->image_writable = false;
+	machine->call_depth = 1;
+	machine->stack_guard.count = 0;
+
+	// Do a reset. The RP2040 boot ROM would run the second stage bootloader
+	// in the first 256 bytes of flash, which then jumps to the vector table
+	// that follows it. Skip all that and start from that vector table.
+	// Likewise, the MBR of an nRF SoftDevice would forward the reset to the
+	// application after it, see machine_set_boot_vectors.
+	uint32_t vectors = machine->boot_vectors;
+	if (machine->family == FAMILY_RP2040) {
+		vectors = 0x100;
+	}
+	if (vectors != 0) {
+		machine->scb.vtor = machine->flash_base + vectors;
+	}
+	machine->sp = machine->image32[vectors / 4]; // initial stack pointer
+	//machine->lr = 0xffffffff; // exit address
+	machine->lr = 0xdeadbeef; // exit address
+	machine->pc = machine->image32[vectors / 4 + 1]; // Reset_Vector address
+	machine->backtrace[1].pc = machine->pc - 1;
+	machine->backtrace[1].sp = machine->sp;
+	machine_log(machine, LOG_CALLS, "RESET %5x (sp: %x, reason: %x)\n", machine->pc - 1, machine->sp, reason);
+}
+
+static void machine_add_backtrace(machine_t *machine, uint32_t pc, uint32_t sp) {
+	machine->call_depth++;
+	if (machine->call_depth >= 0 && machine->call_depth < MACHINE_BACKTRACE_LEN) {
+		while (machine->call_depth > 0 && machine->backtrace[machine->call_depth - 1].sp <= sp) {
+			// Remove leaf functions that we already returned from.
+			machine->call_depth--;
+		}
+		machine->backtrace[machine->call_depth].pc = pc;
+		machine->backtrace[machine->call_depth].sp = sp;
+	}
+}
+
+static int machine_instr_stmdb(machine_t *machine, uint32_t *reg, uint32_t reg_list, bool wback) {
+	uint32_t address = *reg;
+	for (int i = 14; i >= 0; i--) {
+		if (reg_list & (1 << i)) {
+			address -= 4;
+			if (reg == &machine->sp && wback) {
+				if (i == 14) {
+					machine_log(machine, LOG_CALLS, "%*sPUSH lr      (sp: %x) (lr: %x)\n", machine->call_depth * 2, "", address, machine->lr + 2);
+				} else {
+					machine_log(machine, LOG_CALLS, "%*spush r%d      (sp: %x)\n", machine->call_depth * 2, "", i, address);
+				}
+			}
+			if (machine_transfer(machine, address, STORE, &machine->regs[i], WIDTH_32, false)) {
+				return ERR_MEM;
+			}
+		}
+	}
+	if (wback) {
+		*reg = address;
+	}
+	return 0;
+}
+
+static int machine_instr_stmia(machine_t *machine, uint32_t *reg, uint32_t reg_list, bool wback) {
+	uint32_t address = *reg;
+	for (size_t i = 0; i <= 15; i++) {
+		if (((reg_list >> i) & 1) == 1) {
+			uint32_t *reg = &machine->regs[i];
+			if (machine_transfer(machine, address, STORE, reg, WIDTH_32, false)) {
+				return ERR_MEM;
+			}
+			address += 4;
+		}
+	}
+	if (wback) {
+		*reg = address;
+	}
+	return 0;
+}
+
+static int machine_instr_ldmdb(machine_t *machine, uint32_t *reg, uint32_t reg_list, bool wback) {
+	uint32_t address = *reg;
+	for (int i = 14; i >= 0; i--) {
+		if (reg_list & (1 << i)) {
+			address -= 4;
+			if (machine_transfer(machine, address, LOAD, &machine->regs[i], WIDTH_32, false)) {
+				return ERR_MEM;
+			}
+		}
+	}
+	if (wback) {
+		*reg = address;
+	}
+	return 0;
+}
+
+static int machine_instr_ldmia(machine_t *machine, uint32_t *reg, uint32_t reg_list, bool wback) {
+	uint32_t address = *reg;
+	for (int i = 0; i <= 15; i++) {
+		if (reg_list & (1 << i)) {
+			if (reg == &machine->sp && wback) {
+				if (i == 15) {
+					machine_log(machine, LOG_CALLS, "%*sPOP pc %5x (sp: %x)\n", machine->call_depth * 2, "", machine->pc - 1, address);
+				} else {
+					machine_log(machine, LOG_CALLS, "%*spop r%d       (sp: %x)\n", machine->call_depth * 2, "", i, address);
+				}
+			}
+			if (machine_transfer(machine, address, LOAD, &machine->regs[i], WIDTH_32, false)) {
+				return ERR_MEM;
+			}
+			address += 4;
+		}
+	}
+	if (wback) {
+		*reg = address;
+	}
+	return 0;
+}
+
+static uint32_t machine_instr_lsl(machine_t *machine, uint32_t src, uint32_t shift, bool setflags) {
+	if (setflags && shift != 0) { // range 0..31, setflags only when shifting non-zero amount
+		machine->psr.c = src >> (32 - shift) & 1;
+	}
+	if (shift >= 32) {
+		return 0;
+	}
+	return src << shift;
+}
+
+static uint32_t machine_instr_lsr(machine_t *machine, uint32_t src, uint32_t shift, bool setflags) {
+	if (shift >= 32) {
+		if (setflags) {
+			machine->psr.c = (src >> 31) & 1;
+		}
+		return 0;
+	}
+	if (shift != 0 && setflags) {
+		machine->psr.c = src >> (shift - 1) & 1;
+	}
+	return src >> shift;
+}
+
+static uint32_t machine_instr_asr(machine_t *machine, uint32_t src, uint32_t shift, bool setflags) {
+	if (shift >= 32) {
+		if (setflags) {
+			machine->psr.c = (((int32_t)src) >> 31) & 1;
+		}
+		// shift twice to avoid undefined behavior in the C compiler
+		return (((int32_t)src) >> 16) >> 16;
+	} else if (shift >= 0) {
+		if (setflags) {
+			machine->psr.c = ((int32_t)src) >> (shift - 1) & 1;
+		}
+		return ((int32_t)src) >> shift;
+	} else {
+		return src;
+	}
+}
+
+static uint32_t machine_instr_add(machine_t *machine, uint32_t a, uint32_t b, bool setflags) {
+	uint32_t result = a + b;
+	if (setflags) {
+		int64_t result64s = (int64_t)(int32_t)a + (int64_t)(int32_t)b;
+		uint64_t result64u = (uint64_t)a + (uint64_t)b;
+		machine->psr.n = (int32_t)result < 0;
+		machine->psr.z = result == 0;
+		machine->psr.c = result64u >= ((uint64_t)1 << 32); // true if 32-bit overflow
+		machine->psr.v = ((int32_t)result < 0) != (result64s < 0);
+	}
+	return result;
+}
+
+static uint32_t machine_instr_adc(machine_t *machine, uint32_t a, uint32_t b, bool setflags) {
+	uint32_t result = a + b + machine->psr.c;
+	if (setflags) {
+		int64_t result64s = (int64_t)(int32_t)a + (int64_t)(int32_t)b + machine->psr.c;
+		uint64_t result64u = (uint64_t)a + (uint64_t)b + machine->psr.c;
+		machine->psr.n = (int32_t)result < 0;
+		machine->psr.z = result == 0;
+		machine->psr.c = result64u >= ((uint64_t)1 << 32); // true if 32-bit overflow
+		machine->psr.v = ((int32_t)result < 0) != (result64s < 0);
+	}
+	return result;
+}
+
+static uint32_t machine_instr_sub(machine_t *machine, uint32_t a, uint32_t b, bool setflags) {
+	uint32_t result = a - b;
+	if (setflags) {
+		int64_t result64s = (int64_t)(int32_t)a - (int64_t)(int32_t)b;
+		uint64_t result64u = (uint64_t)a - (uint64_t)b;
+		machine->psr.n = (int32_t)result < 0;
+		machine->psr.z = result == 0;
+		machine->psr.c = (int64_t)result64u >= 0;
+		machine->psr.v = ((int32_t)result < 0) != (result64s < 0);
+	}
+	return result;
+}
+
+static uint32_t machine_instr_sbc(machine_t *machine, uint32_t a, uint32_t b, bool setflags) {
+	uint32_t result = a - b - !machine->psr.c;
+	if (setflags) {
+		int64_t result64s = (int64_t)(int32_t)a - (int64_t)(int32_t)b - !machine->psr.c;
+		int64_t result64u = (uint64_t)a - (uint64_t)b - !machine->psr.c;
+		machine->psr.n = (int32_t)result < 0;
+		machine->psr.z = result == 0;
+		machine->psr.c = (int64_t)result64u >= 0;
+		machine->psr.v = ((int32_t)result < 0) != (result64s < 0);
+	}
+	return result;
+}
+
+// Return 1 if true, 0 if false, and -1 if invalid.
+static int machine_condition(machine_t *machine, uint32_t condition) {
+	if (condition == 0b0000) { // BEQ: Z == 1
+		return machine->psr.z == true;
+	} else if (condition == 0b0001) { // BNE: Z == 0
+		return machine->psr.z == false;
+	} else if (condition == 0b0010) { // BCS: C == 1
+		return machine->psr.c == true;
+	} else if (condition == 0b0011) { // BCC: C == 0
+		return machine->psr.c == false;
+	} else if (condition == 0b0100) { // BMI: N == 1
+		return machine->psr.n == true;
+	} else if (condition == 0b0101) { // BPL: N == 0
+		return machine->psr.n == false;
+	} else if (condition == 0b1000) { // BHI: C == 1 && Z == 0
+		return machine->psr.c == true && machine->psr.z == false;
+	} else if (condition == 0b1001) { // BLS: C == 0 || Z == 1
+		return machine->psr.c == false || machine->psr.z == true;
+	} else if (condition == 0b1010) { // BGE: N == V
+		return machine->psr.n == machine->psr.v;
+	} else if (condition == 0b1011) { // BLT: N != V
+		return machine->psr.n != machine->psr.v;
+	} else if (condition == 0b1100) { // BGT: Z == 0 && N == V
+		return machine->psr.z == false && machine->psr.n == machine->psr.v;
+	} else if (condition == 0b1101) { // BLE: Z == 1 || N != V
+		// For this instruction, different manuals say different
+		// things.
+		// One option:
+		//   Z == 1 || N != V
+		// Another option:
+		//   Z == 1 && N != V
+		// I've tested compiler-generated code and it appears the
+		// former is correct. Also, it is more consistent with e.g.
+		// BHI/BLS. An example of a page that says otherwise:
+		//   http://infocenter.arm.com/help/index.jsp?topic=/com.arm.doc.dui0497a/BABEHFEF.html
+		return machine->psr.z == true || machine->psr.n != machine->psr.v;
+	} else {
+		return -1;
+	}
+}
+
+// ALU operations for Thumb-2, which are used in two different instruction
+// formats.
+static int machine_alu_op(machine_t *machine, uint32_t op, uint32_t *reg_dst, uint32_t *reg_src, uint32_t value, bool setflags) {
+	if (op == 0b0000) {
+		uint32_t result = *reg_src & value;
+		if (reg_dst == &machine->pc && setflags) {
+			// TST
+			machine->psr.n = (int32_t)result < 0;
+			machine->psr.z = result == 0;
+			setflags = false;
+		} else {
+			// AND
+			*reg_dst = result;
+		}
+	} else if (op == 0b0001) {
+		// BIC
+		*reg_dst = *reg_src & ~value; // AND NOT
+	} else if (op == 0b0010) {
+		if (reg_src == &machine->pc) {
+			// MOV
+			*reg_dst = value;
+		} else {
+			// ORR
+			*reg_dst = *reg_src | value;
+		}
+	} else if (op == 0b0011) {
+		if (reg_src == &machine->pc) {
+			// MVN
+			*reg_dst = ~value;
+		} else {
+			// ORN
+			*reg_dst = *reg_src | ~value;
+		}
+	} else if (op == 0b0100) {
+		uint32_t result = *reg_src ^ value;
+		if (reg_dst == &machine->pc && setflags) {
+			// TEQ
+			machine->psr.n = (int32_t)result < 0;
+			machine->psr.z = result == 0;
+			setflags = false;
+		} else {
+			// EOR
+			*reg_dst = result;
+		}
+	} else if (op == 0b1000) {
+		if (reg_dst == &machine->pc && setflags) {
+			// CMN
+			machine_instr_add(machine, *reg_src, value, true);
+			setflags = false;
+		} else {
+			// ADD
+			*reg_dst = machine_instr_add(machine, *reg_src, value, setflags);
+		}
+	} else if (op == 0b1010) {
+		// ADC
+		*reg_dst = machine_instr_adc(machine, *reg_src, value, setflags);
+	} else if (op == 0b1011) {
+		// SBC
+		*reg_dst = machine_instr_sbc(machine, *reg_src, value, setflags);
+	} else if (op == 0b1110) {
+		// RSB
+		*reg_dst = machine_instr_sub(machine, value, *reg_src, setflags);
+	} else if (op == 0b1101) {
+		if (reg_dst == &machine->pc && setflags) {
+			// CMP
+			machine_instr_sub(machine, *reg_src, value, true);
+			setflags = false;
+		} else {
+			// SUB
+			*reg_dst = machine_instr_sub(machine, *reg_src, value, setflags);
+		}
+	} else {
+		return ERR_UNDEFINED;
+	}
+	if (setflags) {
+		machine->psr.n = (int32_t)*reg_dst < 0;
+		machine->psr.z = *reg_dst == 0;
+	}
+	return ERR_OK;
+}
+
+// Return the xPSR register in the format used by the architecture.
+static uint32_t machine_get_xpsr(machine_t *machine) {
+	return ((uint32_t)machine->psr.n << 31) |
+		((uint32_t)machine->psr.z << 30) |
+		((uint32_t)machine->psr.c << 29) |
+		((uint32_t)machine->psr.v << 28) |
+		((uint32_t)machine->psr.it1 << 25) |
+		((uint32_t)machine->psr.t << 24) |
+		((uint32_t)machine->psr.it2 << 10) |
+		machine->ipsr;
+}
+
+static void machine_set_xpsr(machine_t *machine, uint32_t xpsr) {
+	machine->psr.n = (xpsr >> 31) & 1;
+	machine->psr.z = (xpsr >> 30) & 1;
+	machine->psr.c = (xpsr >> 29) & 1;
+	machine->psr.v = (xpsr >> 28) & 1;
+	machine->psr.it1 = (xpsr >> 25) & 0b11;
+	machine->psr.t = (xpsr >> 24) & 1;
+	machine->psr.it2 = (xpsr >> 10) & 0b111111;
+	machine->ipsr = xpsr & 0x1ff;
+}
+
+// Return the priority of the given exception. Lower values mean a higher
+// priority.
+static int machine_exception_priority(machine_t *machine, uint32_t exception) {
+	if (exception == 2) { // NMI
+		return -2;
+	} else if (exception == 3) { // HardFault
+		return -1;
+	} else if (exception == 11) { // SVCall
+		return (machine->scb.shpr[0] >> 24) & 0xff;
+	} else if (exception == 14) { // PendSV
+		return (machine->scb.shpr[1] >> 16) & 0xff;
+	} else if (exception == 15) { // SysTick
+		return (machine->scb.shpr[1] >> 24) & 0xff;
+	} else if (exception >= 16 && exception < 16 + MACHINE_NUM_IRQS) {
+		return machine->nvic.ip[exception - 16];
+	}
+	return 256;
+}
+
+// Return the current execution priority: the priority of the highest priority
+// active exception, possibly boosted by PRIMASK.
+static int machine_execution_priority(machine_t *machine, bool use_primask) {
+	int priority = 256; // thread mode
+	for (uint32_t exception = 2; exception < 16 + MACHINE_NUM_IRQS; exception++) {
+		if (machine->active & ((uint64_t)1 << exception)) {
+			int exception_priority = machine_exception_priority(machine, exception);
+			if (exception_priority < priority) {
+				priority = exception_priority;
+			}
+		}
+	}
+	if (use_primask && machine->primask && priority > 0) {
+		priority = 0;
+	}
+	return priority;
+}
+
+// Return the pending exception with the highest priority, or 0 if no exception
+// is pending.
+static uint32_t machine_pending_exception(machine_t *machine) {
+	uint32_t pending = 0;
+	int priority = 256;
+	if (machine->scb.pendsv && machine_exception_priority(machine, 14) < priority) {
+		pending = 14;
+		priority = machine_exception_priority(machine, 14);
+	}
+	if (machine->scb.pendst && machine_exception_priority(machine, 15) < priority) {
+		pending = 15;
+		priority = machine_exception_priority(machine, 15);
+	}
+	uint32_t irqs = machine->nvic.pending & machine->nvic.enabled;
+	for (uint32_t irq = 0; irqs != 0 && irq < MACHINE_NUM_IRQS; irq++) {
+		if ((irqs & (1 << irq)) && machine->nvic.ip[irq] < priority) {
+			pending = 16 + irq;
+			priority = machine->nvic.ip[irq];
+		}
+	}
+	return pending;
+}
+
+// Record the cycle at which exceptions become pending, for the latency
+// statistics.
+static void machine_track_pending(machine_t *machine) {
+	uint64_t pending = (uint64_t)(machine->nvic.pending & machine->nvic.enabled) << 16;
+	if (machine->scb.pendsv) {
+		pending |= 1 << 14;
+	}
+	if (machine->scb.pendst) {
+		pending |= 1 << 15;
+	}
+	uint64_t pended = pending & ~machine->pending_seen;
+	while (pended != 0) {
+		machine->pended_at[__builtin_ctzll(pended)] = machine->stats.cycles;
+		pended &= pended - 1;
+	}
+	machine->pending_seen = pending;
+}
+
+// Return the stub for the code at this address, or NULL if it isn't in a stub
+// range. Ranges that were added later come first, so that a single function
+// can be replaced in a larger range.
+static stub_call_t machine_stub_range(machine_t *machine, uint32_t address) {
+	for (uint32_t i = machine->stubs.num_ranges; i-- > 0; ) {
+		if (address >= machine->stubs.start[i] && address < machine->stubs.end[i]) {
+			return machine->stubs.handler[i] != NULL ? machine->stubs.handler[i] : machine->stubs.call;
+		}
+	}
+	return NULL;
+}
+
+// Call a stub. A ROM function returns to its caller afterwards, unless the
+// stub jumped somewhere else.
+static int machine_stub_call(machine_t *machine, stub_call_t stub, stub_kind_t kind, uint32_t id) {
+	uint32_t pc = machine->pc;
+	int err = stub(machine, kind, id);
+	if (err == ERR_OK && kind == STUB_ROM && machine->pc == pc) {
+		machine->pc = machine->lr;
+	}
+	return err;
+}
+
+// Push an exception frame on the stack and jump to the exception handler.
+static int machine_exception_entry(machine_t *machine, uint32_t exception) {
+	uint32_t xpsr = machine_get_xpsr(machine);
+	uint32_t frameptr = machine->sp;
+	if (frameptr & 4) {
+		// Align the frame on an 8-byte boundary.
+		frameptr -= 4;
+		xpsr |= 1 << 9;
+	}
+	frameptr -= 32;
+	uint32_t frame[8] = {machine->r0, machine->r1, machine->r2, machine->r3, machine->r12, machine->lr, machine->pc - 1, xpsr};
+	for (size_t i = 0; i < 8; i++) {
+		if (machine_transfer(machine, frameptr + i * 4, STORE, &frame[i], WIDTH_32, false)) {
+			return ERR_MEM;
+		}
+	}
+	uint32_t handler;
+	if (machine_transfer(machine, machine->scb.vtor + exception * 4, LOAD, &handler, WIDTH_32, false)) {
+		return ERR_MEM;
+	}
+	machine_log(machine, LOG_CALLS, "%*sEXCEPTION %ld %4x (sp: %x) -> %x\n", machine->call_depth * 2, "", (long)exception, machine->pc - 1, machine->sp, handler - 1);
+	machine_add_backtrace(machine, machine->pc - 1, machine->sp);
+	machine->sp = frameptr;
+	uint32_t preempted = machine->ipsr;
+	machine->lr = preempted == 0 ? 0xfffffff9 : 0xfffffff1;
+	machine->pc = handler;
+	machine->ipsr = exception;
+	machine->active |= (uint64_t)1 << exception;
+	machine->event = true;
+	if (exception == 14) {
+		machine->scb.pendsv = false;
+	} else if (exception == 15) {
+		machine->scb.pendst = false;
+	} else if (exception >= 16) {
+		machine->nvic.pending &= ~(1 << (exception - 16));
+	}
+	machine->stats.exceptions++;
+	machine->stats.exceptions_by_number[exception]++;
+
+	// Update the latency statistics. The handler that was running (if any)
+	// is preempted, so its cycles stop counting.
+	uint64_t now = machine->stats.cycles;
+	if (preempted != 0) {
+		machine->stats.exception_cycles[preempted] += now - machine->handler_since;
+	}
+	machine->handler_since = now;
+	uint64_t latency = 0;
+	if (machine->pending_seen & ((uint64_t)1 << exception)) {
+		latency = now - machine->pended_at[exception];
+		machine->pending_seen &= ~((uint64_t)1 << exception);
+	}
+	machine->stats.exception_latency[exception] += latency;
+	if (latency > machine->stats.exception_latency_max[exception]) {
+		machine->stats.exception_latency_max[exception] = latency;
+	}
+	uint32_t nesting = __builtin_popcountll(machine->active);
+	if (nesting > machine->stats.exception_nesting_max[exception]) {
+		machine->stats.exception_nesting_max[exception] = nesting;
+	}
+	if (machine->exception_trace != NULL) {
+		machine->exception_trace(machine, exception, true);
+	}
+	return ERR_OK;
+}
+
+// Return from an exception, by popping the exception frame from the stack.
+static int machine_exception_return(machine_t *machine) {
+	uint32_t exc_return = machine->pc;
+	if ((exc_return != 0xfffffff1 && exc_return != 0xfffffff9) || machine->ipsr == 0) {
+		return ERR_PC;
+	}
+	uint32_t frame[8];
+	for (size_t i = 0; i < 8; i++) {
+		if (machine_transfer(machine, machine->sp + i * 4, LOAD, &frame[i], WIDTH_32, false)) {
+			return ERR_MEM;
+		}
+	}
+	machine_log(machine, LOG_CALLS, "%*sEXCEPTION RETURN %ld (sp: %x) <- %x\n", machine->call_depth * 2, "", (long)machine->ipsr, machine->sp, frame[6]);
+	uint32_t exception = machine->ipsr;
+	machine->active &= ~((uint64_t)1 << machine->ipsr);
+	machine->stats.exception_cycles[machine->ipsr] += machine->stats.cycles - machine->handler_since;
+	machine->handler_since = machine->stats.cycles;
+	machine->r0 = frame[0];
+	machine->r1 = frame[1];
+	machine->r2 = frame[2];
+	machine->r3 = frame[3];
+	machine->r12 = frame[4];
+	machine->lr = frame[5];
+	machine->pc = frame[6] | 1;
+	machine->sp += 32;
+	if (frame[7] & (1 << 9)) {
+		machine->sp += 4;
+	}
+	machine_set_xpsr(machine, frame[7] & ~(1 << 9));
+	machine->event = true;
+	if (machine->ipsr == 0 && (machine->scb.scr & (1 << 1))) {
+		// SLEEPONEXIT
+		machine->sleep = (machine->scb.scr & (1 << 2)) ? SLEEP_DEEP : SLEEP_LIGHT;
+	}
+	if (machine->exception_trace != NULL) {
+		machine->exception_trace(machine, exception, false);
+	}
+	return ERR_OK;
+}
+
+// Put the core to sleep, until an interrupt (or event for WFE) arrives.
+static void machine_sleep(machine_t *machine, bool wfe) {
+	machine->sleep = (machine->scb.scr & (1 << 2)) ? SLEEP_DEEP : SLEEP_LIGHT; // SLEEPDEEP
+	machine->sleep_wfe = wfe;
+	machine_log(machine, LOG_CALLS, "%*s%s %5x (%s)\n", machine->call_depth * 2, "", wfe ? "WFE" : "WFI", machine->pc - 3, machine->sleep == SLEEP_DEEP ? "deep sleep" : "sleep");
+}
+
+// Whether the core would wake up from sleep right now: an interrupt is
+// pending that would preempt the current execution priority (ignoring
+// PRIMASK), or an event is pending for WFE.
+static bool machine_wakeup_pending(machine_t *machine, bool wfe) {
+	if (wfe && machine->event) {
+		return true;
+	}
+	uint32_t exception = machine_pending_exception(machine);
+	return exception != 0 && machine_exception_priority(machine, exception) < machine_execution_priority(machine, false);
+}
+
+// Whether an exception could still interrupt the current code: an enabled
+// interrupt or SysTick exception has a higher priority, and PRIMASK doesn't
+// mask it.
+static bool machine_interruptible(machine_t *machine) {
+	int priority = machine_execution_priority(machine, true);
+	if (machine->scb.pendsv && machine_exception_priority(machine, 14) < priority) {
+		return true;
+	}
+	if ((machine->systick.csr & 3) == 3 && machine_exception_priority(machine, 15) < priority) {
+		return true;
+	}
+	for (uint32_t irq = 0; irq < MACHINE_NUM_IRQS; irq++) {
+		if ((machine->nvic.enabled & (1u << irq)) && machine->nvic.ip[irq] < priority) {
+			return true;
+		}
+	}
+	return false;
+}
+
+// Check whether the firmware is stuck in a tight loop: it has been running the
+// same few instructions for hang.cycles cycles, without storing to memory or
+// accessing a peripheral, and no interrupt can get it out of there.
+static bool machine_check_hang(machine_t *machine, uint32_t pc) {
+	if (pc < machine->hang.low) {
+		machine->hang.low = pc;
+	}
+	if (pc > machine->hang.high) {
+		machine->hang.high = pc;
+	}
+	if (machine->hang.side_effect || machine->hang.high - machine->hang.low >= MACHINE_HANG_SPAN) {
+		// Not a loop (yet): start over at this instruction.
+		machine->hang.side_effect = false;
+		machine->hang.low = pc;
+		machine->hang.high = pc;
+		machine->hang.start = machine->stats.cycles;
+		return false;
+	}
+	if (machine->stats.cycles - machine->hang.start < machine->hang.cycles) {
+		return false;
+	}
+	// Check again after another hang.cycles cycles, when the machine
+	// continues.
+	machine->hang.start = machine->stats.cycles;
+	return !machine_interruptible(machine);
+}
+
+// Check whether code may be executed at the given address, outside of the
+// firmware image. Code can run from RAM, depending on PERM_EXEC_RAM, but the
+// peripheral and system regions are execute-never.
+static int machine_check_execute(machine_t *machine, uint32_t address) {
+	uint32_t region = address >> 29;
+	if (region == 1 && (address & 0x1fffffff) + 2 <= machine->mem_size) {
+		switch (machine->permissions[PERM_EXEC_RAM]) {
+		case ACCESS_ALLOW:
+			return ERR_OK;
+		case ACCESS_WARN:
+			if ((machine->instruction_pc >> 29) != 1) {
+				// Only warn when jumping into RAM.
+				machine_log(machine, LOG_ERROR, "executing from RAM at 0x%08x (PC: %x)\n", address, machine->instruction_pc);
+			}
+			return ERR_OK;
+		case ACCESS_FAULT:
+			machine_log(machine, LOG_ERROR, "\nERROR: execute from RAM at 0x%08x (PC: %x)\n", address, machine->instruction_pc);
+			machine->transfer_address = address;
+			return ERR_MEM;
+		}
+	}
+	uint32_t xip_offset;
+	if (machine_qspi_xip_offset(machine, address, &xip_offset) && xip_offset + 2 <= machine->qspi_flash.size) {
+		// External flash of the nRF52840, mapped by the QSPI peripheral.
+		return ERR_OK;
+	}
+	if (region == 2 || region >= 5) {
+		machine_log(machine, LOG_ERROR, "\nERROR: execute from execute-never peripheral or system address 0x%08x (PC: %x)\n", address, machine->instruction_pc);
+		machine->transfer_address = address;
+		return ERR_MEM;
+	}
+	return ERR_PC;
+}
+
+static bool machine_is_32bit_instruction(uint16_t instruction) {
+	return ((instruction >> 11) == 0b11101 || (instruction >> 12) == 0b1111);
+}
+
+// Execute a single instruction on the executing core, see machine_step_core.
+static int machine_execute(machine_t *machine) {
+	// Some handy aliases
+	uint32_t *pc = &machine->pc; // r15
+	uint32_t *lr = &machine->lr; // r14
+	uint32_t *sp = &machine->sp; // r13
+
+	if (machine->watch.hit != 0) {
+		// The previous instruction stored to a watched range.
+		uint32_t hit = machine->watch.hit;
+		machine->watch.hit = 0;
+		machine->watch.changed(machine, hit, machine->instruction_pc);
+	}
+	if (machine->reset_request) {
+		// The previous instruction requested a system reset.
+		machine_reset_cause(machine, RESET_SREQ);
+	}
+	if (machine->power_cut) {
+		// The previous instruction was interrupted by a (simulated) power
+		// cut.
+		machine->stats.power_cuts++;
+		machine_brownout(machine);
+	}
+
+	if (machine->events.dirty != 0) {
+		machine_events_update(machine);
+	}
+	if (machine->events.len != 0 && machine->events.heap[0].cycle <= machine->stats.cycles) {
+		machine_events_run(machine);
+	}
+
+	if ((*pc & 0xfffffff0) == 0xfffffff0) {
+		// Branch to EXC_RETURN.
+		int err = machine_exception_return(machine);
+		if (err != ERR_OK) {
+			return err;
+		}
+	}
+
+	machine_track_pending(machine);
+	if (machine->sleep != SLEEP_NONE) {
+		if (!machine_wakeup_pending(machine, machine->sleep_wfe)) {
+			// Stay asleep.
+			machine->stats.cycles++;
+			machine->stats.cycles_state[machine->sleep]++;
+			return ERR_OK;
+		}
+		uint32_t latency = machine->wakeup_latency[machine->sleep];
+		machine->stats.cycles += latency;
+		machine->stats.cycles_state[machine->sleep] += latency;
+		machine->stats.wakeups++;
+		machine->sleep = SLEEP_NONE;
+		if (machine->sleep_wfe) {
+			machine->event = false;
+		}
+	}
+
+	uint32_t exception = machine_pending_exception(machine);
+	if (exception != 0 && !machine->debug_mask && machine_exception_priority(machine, exception) < machine_execution_priority(machine, true)) {
+		return machine_exception_entry(machine, exception);
+	}
+
+	if (machine->coverage != NULL && *pc != machine->coverage_prev_pc + 2 && *pc != machine->coverage_prev_pc + 4) {
+		// Start of a new basic block: record the edge from the previous
+		// block, like AFL does.
+		// The count saturates, so that an edge of a long polling loop
+		// doesn't wrap around to 0 and disappear.
+		uint32_t location = (*pc >> 1) * 0x9e3779b1;
+		uint8_t *count = &machine->coverage[(location ^ machine->coverage_prev_location) & (machine->coverage_size - 1)];
+		if (*count != 0xff) {
+			(*count)++;
+		}
+		machine->coverage_prev_location = location >> 1;
+	}
+	machine->coverage_prev_pc = *pc;
+
+	uint32_t code_offset = machine_code_offset(machine, *pc);
+	if (machine->executed != NULL && code_offset - 1 < machine->image_size) {
+		uint32_t index = (code_offset - 1) / 2;
+		machine->executed[index / 8] |= 1 << (index % 8);
+	}
+	if (machine->breakpoints != NULL && !machine->break_skip && code_offset - 1 < machine->image_size) {
+		uint32_t index = (code_offset - 1) / 2;
+		if (machine->breakpoints[index / 8] & (1 << (index % 8))) {
+			// Continue past this breakpoint the next time.
+			machine->break_skip = true;
+			return ERR_BREAK;
+		}
+	}
+	if (machine->ram_breakpoints != NULL && !machine->break_skip && (*pc - 1) >> 29 == 1 && ((*pc - 1) & 0x1fffffff) < machine->mem_size) {
+		uint32_t index = ((*pc - 1) & 0x1fffffff) / 2;
+		if (machine->ram_breakpoints[index / 8] & (1 << (index % 8))) {
+			machine->break_skip = true;
+			return ERR_BREAK;
+		}
+	}
+	machine->break_skip = false;
+
+	if (machine->family == FAMILY_RP2040 && machine->rp2040.core == 1 && *pc - 1 == RP2040_ROM_CORE1_WAIT) {
+		// The entry point of core 1 returned: wait for the next launch.
+		machine_rp2040_stop_core1(machine);
+		return ERR_OK;
+	}
+	stub_call_t stub = machine_stub_range(machine, *pc - 1);
+	if (stub != NULL) {
+		// Call to a function that the host or the boot ROM implements.
+		return machine_stub_call(machine, stub, STUB_ROM, *pc - 1);
+	}
+
+	if (*pc == 0xdeadbeef) {
+		return ERR_EXIT;
+	}
+	if (code_offset > machine->image_size - 2) {
+		int err = machine_check_execute(machine, *pc - 1);
+		if (err != ERR_OK) {
+			return err;
+		}
+	}
+	if ((*pc & 1) != 1) {
+		return ERR_PC;
+	}
+	if (machine->hang.cycles != 0 && machine_check_hang(machine, *pc - 1)) {
+		return ERR_HANG;
+	}
+	if (machine->stack_guard.count != 0) {
+		machine_stack_guard_update(machine, *pc - 1);
+	}
+	uint16_t instruction = machine_fetch16(machine, *pc);
+	machine->instruction_pc = *pc - 1;
+	if (machine->histogram != NULL) {
+		machine->histogram[instruction]++;
+	}
+
+	// Increment PC to point to the next instruction.
+	*pc += 2;
+
+	// This is an approximation: most instructions take a single cycle.
+	machine->stats.instructions++;
+	machine->stats.cycles++;
+	machine->stats.cycles_state[SLEEP_NONE]++;
+
+	bool inITBlock = machine_versioncheck(machine, CORTEX_M4) ? machine->psr.it2 != 0 : false;
+
+	if (inITBlock) {
+		// Check whether we need to execute the following instruction.
+		uint32_t state = machine->psr.it1 | (machine->psr.it2 << 2);
+		uint32_t condition = state >> 4;
+		uint32_t newstate = (state & 0b11100000) | ((state << 1) & 0b11111);
+		if ((newstate & 0b1111) == 0) {
+			newstate = 0;
+		}
+		machine->psr.it1 = newstate & 0b11;
+		machine->psr.it2 = newstate >> 2;
+		int result = machine_condition(machine, condition);
+		if (result < 0) {
+			return ERR_UNDEFINED;
+		}
+		if (!result) {
+			// Don't do anything.
+			// We could also have changed instruction to a nop.
+			if (machine_is_32bit_instruction(instruction)) {
+				*pc += 2;
+			}
+			return ERR_OK;
+		} else {
+			// Continue.
+		}
+	}
+
+	// Decode/execute instruction
+
+	if ((instruction >> 13) == 0b000) {
+		uint32_t *reg_dst = &machine->regs[(instruction >> 0) & 0b111];
+		uint32_t *reg_src = &machine->regs[(instruction >> 3) & 0b111];
+		uint32_t op       = (instruction >> 11)  & 0b11;
+		bool setflags = !inITBlock;
+		if (op != 3) {
+			// Format 1: move shifted register
+			uint32_t offset5 = (instruction >> 6) & 0x1f;
+			if (op == 0) { // LSLS
+				*reg_dst = machine_instr_lsl(machine, *reg_src, offset5, setflags);
+			} else if (op == 1) { // LSRS
+				*reg_dst = machine_instr_lsr(machine, *reg_src, offset5 == 0 ? 32 : offset5, setflags);
+			} else if (op == 2) { // ASRS
+				*reg_dst = machine_instr_asr(machine, *reg_src, offset5 == 0 ? 32 : offset5, setflags);
+			}
+		} else { // op == 3
+			// Format 2: add/subtract
+			uint32_t value    = (instruction >> 6)  & 0b111;
+			uint32_t op       = (instruction >> 9)  & 0b1;
+			bool     flag_imm = (instruction >> 10) & 0b1;
+			if (!flag_imm) {
+				value = machine->regs[value];
+			}
+			if (op == 0) { // ADDS
+				*reg_dst = machine_instr_add(machine, *reg_src, value, setflags);
+			} else { // SUBS
+				*reg_dst = machine_instr_sub(machine, *reg_src, value, setflags);
+			}
+		}
+		if (setflags) {
+			machine->psr.n = (int32_t)*reg_dst < 0;
+			machine->psr.z = *reg_dst == 0;
+		}
+
+	} else if ((instruction >> 13) == 0b001) {
+		// Format 3: move/compare/add/subtract immediate
+		uint32_t  imm  = instruction & 0xff;
+		uint32_t *reg = &machine->regs[(instruction >> 8)  & 0b111];
+		size_t   op   = (instruction >> 11) & 0b11;
+		bool setflags = !inITBlock;
+		if (op == 0) { // MOVS
+			*reg = imm;
+		} else if (op == 1) { // CMP
+			// Update flags as if doing *reg - imm
+			machine_instr_sub(machine, *reg, imm, true);
+			setflags = false;
+			// Don't update *reg
+		} else if (op == 2) { // ADDS
+			*reg = machine_instr_add(machine, *reg, imm, setflags);
+		} else if (op == 3) { // SUBS
+			*reg = machine_instr_sub(machine, *reg, imm, setflags);
+		}
+		if (setflags) {
+			machine->psr.n = (int32_t)*reg < 0;
+			machine->psr.z = *reg == 0;
+		}
+
+	} else if ((instruction >> 10) == 0b010000) {
+		// Format 4: ALU operations
+		uint32_t *reg_dst = &machine->regs[(instruction >> 0) & 0b111];
+		uint32_t *reg_src = &machine->regs[(instruction >> 3) & 0b111];
+		uint32_t op       = (instruction >> 6) & 0b1111;
+		bool setflags = !inITBlock;
+		if (op == 0b0000) { // ANDS
+			*reg_dst &= *reg_src;
+		} else if (op == 0b0001) { // EORS
+			*reg_dst ^= *reg_src;
+		} else if (op == 0b0010) { // LSLS
+			*reg_dst = machine_instr_lsl(machine, *reg_dst, *reg_src & 0xff, setflags);
+		} else if (op == 0b0011) { // LSRS
+			*reg_dst = machine_instr_lsr(machine, *reg_dst, *reg_src & 0xff, setflags);
+		} else if (op == 0b0100) { // ASRS
+			*reg_dst = machine_instr_asr(machine, *reg_dst, *reg_src & 0xff, setflags);
+		} else if (op == 0b0101) { // ADCS
+			*reg_dst = machine_instr_adc(machine, *reg_dst, *reg_src, setflags);
+		} else if (op == 0b0110) { // SBCS
+			*reg_dst = machine_instr_sbc(machine, *reg_dst, *reg_src, setflags);
+		} else if (op == 0b1000) { // TST
+			// set CC on Rd AND Rs
+			machine->psr.n = (int32_t)(*reg_src & *reg_dst) < 0;
+			machine->psr.z = (int32_t)(*reg_src & *reg_dst) == 0;
+			setflags = false;
+		} else if (op == 0b1001) { // NEG / RSBS
+			*reg_dst = machine_instr_sub(machine, 0, *reg_src, setflags);
+		} else if (op == 0b1010) { // CMP
+			// set CC on Rd - Rs
+			machine_instr_sub(machine, *reg_dst, *reg_src, true);
+			setflags = false;
+		} else if (op == 0b1011) { // CMN
+			// set cc on Rd + Rs
+			machine_instr_add(machine, *reg_dst, *reg_src, true);
+			setflags = false;
+		} else if (op == 0b1100) { // ORRS
+			// does not update C or V
+			*reg_dst |= *reg_src;
+		} else if (op == 0b1101) { // MULS
+			// does not update C or V
+			*reg_dst *= *reg_src;
+		} else if (op == 0b1110) { // BICS
+			// does not update C or V
+			*reg_dst &= ~*reg_src;
+		} else if (op == 0b1111) { // MVNS
+			// does not update C or V
+			*reg_dst = ~*reg_src;
+		} else {
+			// The only missing ALU op is ROR.
+			return ERR_UNDEFINED;
+		}
+		if (setflags) {
+			machine->psr.n = (int32_t)*reg_dst < 0;
+			machine->psr.z = *reg_dst == 0;
+		}
+
+	} else if ((instruction >> 10) == 0b010001) {
+		// Format 5: Hi register operations/branch exchange
+		uint32_t *reg_dst = &machine->regs[(instruction >> 0) & 0b111];
+		uint32_t *reg_src = &machine->regs[(instruction >> 3) & 0b111];
+		bool     h2       = (instruction >> 6) & 0b1;
+		bool     h1       = (instruction >> 7) & 0b1;
+		uint32_t op       = (instruction >> 8) & 0b11;
+		reg_src += h2 * 8; // make high register (if h2 is 1)
+		if (op == 3) { // BX/BLX
+			if (reg_dst != &machine->r0) {
+				return ERR_UNDEFINED; // unimplemented
+			}
+			if (h1) {
+				if (machine_log_call(machine, *reg_src - 1)) {
+					char name[128];
+					machine_log(machine, LOG_CALLS, "%*sBLX r%ld %6x (sp: %x) -> %x%s\n", machine->call_depth * 2, "", reg_src - machine->regs, *pc - 3, *sp, *reg_src - 1, machine_symbol_name(machine, *reg_src - 1, name, sizeof(name)));
+				}
+				machine_add_backtrace(machine, *pc - 3, *sp);
+				if (machine->stack_guard.enabled) {
+					machine_stack_guard_call(machine, *reg_src & ~1u);
+				}
+			} else if (reg_src == lr) {
+				if (machine_log_call(machine, *pc - 3)) {
+					char name[128];
+					machine_log(machine, LOG_CALLS, "%*sBX lr %6x (sp: %x) <- %x%s\n", machine->call_depth * 2, "", *pc - 3, *sp, *reg_src - 1, machine_symbol_name(machine, *reg_src - 1, name, sizeof(name)));
+				}
+			}
+			uint32_t next_lr = *pc;
+			*pc = *reg_src;
+			if (h1) { // BLX
+				*lr = next_lr;
+			}
+		} else { // ALU operation with high registers
+			reg_dst += h1 * 8; // make high register (if h1 is 1)
+			if (op == 0) { // ADD
+				*reg_dst += *reg_src;
+			} else if (op == 1) { // CMP
+				// set CC on Rd - Rs
+				machine_instr_sub(machine, *reg_dst, *reg_src, true);
+			} else if (op == 2) { // MOV
+				*reg_dst = *reg_src;
+				if (reg_dst == pc) {
+					*reg_dst |= 1; // force T-bit to 1
+				}
+			}
+		}
+
+	} else if ((instruction >> 11) == 0b01001) {
+		// Format 6: PC-relative load
+		uint32_t imm = instruction & 0xff; // 8 bits
+		uint32_t *reg = &machine->regs[(instruction >> 8)  & 0b111];
+		uint32_t address = ((*pc + 2) & ~3UL) + imm * 4;
+		if (machine_transfer(machine, address, LOAD, reg, WIDTH_32, false)) {
+			return ERR_MEM;
+		}
+
+	} else if ((instruction >> 12) == 0b0101) {
+		uint32_t *reg_change = &machine->regs[(instruction >> 0) & 0b111];
+		uint32_t *reg_base   = &machine->regs[(instruction >> 3) & 0b111];
+		uint32_t *reg_offset = &machine->regs[(instruction >> 6) & 0b111];
+		if (((instruction >> 9) & 0b1) == 0) {
+			// Format 7: Load/store with register offset (LDR)
+			bool flag_byte = (instruction >> 10) & 0b1;
+			bool flag_load = (instruction >> 11) & 0b1;
+			transfer_type_t transfer_type = flag_load ? LOAD : STORE;
+			width_t width = flag_byte ? WIDTH_8 : WIDTH_32;
+			if (machine_transfer(machine, *reg_base + *reg_offset, transfer_type, reg_change, width, false)) {
+				return ERR_MEM;
+			}
+		} else {
+			// Format 8: Load/store sign-extended byte/halfword
+			bool flag_sign_extend = (instruction >> 10) & 0b1;
+			bool flag_H           = (instruction >> 11) & 0b1;
+			uint32_t address = *reg_base + *reg_offset;
+			if (flag_sign_extend) {
+				if (flag_H) {
+					if (machine_transfer(machine, address, LOAD, reg_change, WIDTH_16, true)) { // LDSH
+						return ERR_MEM;
+					}
+				} else {
+					if (machine_transfer(machine, address, LOAD, reg_change, WIDTH_8, true)) { // LDSB
+						return ERR_MEM;
+					}
+				}
+			} else {
+				transfer_type_t transfer_type = flag_H ? LOAD : STORE;
+				if (machine_transfer(machine, address, transfer_type, reg_change, WIDTH_16, false)) { // STRH/LDRH
+					return ERR_MEM;
+				}
+			}
+		}
+
+	} else if ((instruction >> 13) == 0b011) {
+		// Format 9: load/store with immediate offset
+		uint32_t *reg_change = &machine->regs[(instruction >> 0)  & 0b111];
+		uint32_t *reg_base   = &machine->regs[(instruction >> 3)  & 0b111];
+		uint32_t offset5     = (instruction >> 6) & 0x1f;
+		bool     flag_load   = (instruction >> 11) & 0b1;
+		bool     flag_byte   = (instruction >> 12) & 0b1;
+		transfer_type_t transfer_type = flag_load ? LOAD : STORE;
+		if (flag_byte) {
+			uint32_t address = *reg_base + offset5;
+			if (machine_transfer(machine, address, transfer_type, reg_change, WIDTH_8, false)) {
+				return ERR_MEM;
+			}
+		} else {
+			uint32_t address = *reg_base + offset5 * 4;
+			if (machine_transfer(machine, address, transfer_type, reg_change, WIDTH_32, false)) {
+				return ERR_MEM;
+			}
+		}
+
+	} else if ((instruction >> 12) == 0b1000) {
+		// Format 10: load/store halfword
+		uint32_t *reg_change = &machine->regs[(instruction >> 0)  & 0b111];
+		uint32_t *reg_base   = &machine->regs[(instruction >> 3)  & 0b111];
+		uint32_t offset5     = (instruction >> 6) & 0x1f;
+		bool     flag_load   = (instruction >> 11) & 0b1;
+		transfer_type_t transfer_type = flag_load ? LOAD : STORE;
+		uint32_t address = *reg_base + (offset5 << 1);
+		if (machine_transfer(machine, address, transfer_type, reg_change, WIDTH_16, false)) {
+			return ERR_MEM;
+		}
+
+	} else if ((instruction >> 12) == 0b1001) {
+		// Format 11: SP-relative load/store
+		uint32_t word8     = (instruction >> 0) & 0xff; // 8 bits
+		uint32_t *reg      = &machine->regs[(instruction >> 8) & 0b111];
+		bool     flag_load = (instruction >> 11) & 0b1;
+		transfer_type_t transfer_type = flag_load ? LOAD : STORE;
+		if (machine_transfer(machine, *sp + word8 * 4, transfer_type, reg, WIDTH_32, false)) {
+			return ERR_MEM;
+		}
+
+	} else if ((instruction >> 12) == 0b1010) {
+		// Format 12: load address
+		uint32_t word8    = (instruction >> 0) & 0xff; // 8 bits
+		uint32_t *reg_dst = &machine->regs[(instruction >> 8) & 0b111];
+		bool     flag_sp  = (instruction >> 11) & 0b1;
+		uint32_t value = flag_sp ? *sp : *pc;
+		if (!flag_sp) {
+			// ADR
+			// for PC: force bit 1 to 0
+			value += 2;
+			value &= ~0b11UL;
+		}
+		*reg_dst = value + (word8 << 2);
+
+	} else if ((instruction >> 8) == 0b10110000) {
+		// Format 13: add offset to Stack Pointer
+		uint32_t offset6  = (instruction >> 0) & 0x3f; // 6 bits
+		bool     flag_neg = (instruction >> 7) & 0b1;
+		if (flag_neg) { // SUB SP, #imm
+			machine_log(machine, LOG_CALLS, "%*ssub     0x%02x (sp: %x)\n", machine->call_depth * 2, "", offset6 * 4, *sp);
+			*sp -= offset6 * 4;
+		} else { // ADD SP, #imm
+			machine_log(machine, LOG_CALLS, "%*sadd    %2x (sp: %x)\n", machine->call_depth * 2, "", offset6 * 4, *sp);
+			*sp += offset6 * 4;
+		}
+
+	} else if ((instruction >> 8) == 0b10110010) {
+		// Sign or zero extend
+		uint32_t *reg_dst = &machine->regs[(instruction >> 0) & 0b111];
+		uint32_t *reg_src = &machine->regs[(instruction >> 3) & 0b111];
+		uint32_t opcode   = (instruction >> 6) & 0b11;
+		if (opcode == 0b00) {
+			// T1: SXTH (signed extend halfword)
+			*reg_dst = (int32_t)(*reg_src << 16) >> 16;
+		} else if (opcode == 0b01) {
+			// T1: SXTB (signed extend byte)
+			*reg_dst = (int32_t)(*reg_src << 24) >> 24;
+		} else if (opcode == 0b10) {
+			// T1: UXTH (unsigned extend halfword)
+			*reg_dst = *reg_src & 0xffff;
+		} else if (opcode == 0b11) {
+			// T1: UXTB (unsigned extend byte)
+			*reg_dst = *reg_src & 0xff;
+		}
+
+	} else if (((instruction >> 8) & 0b11110101) == 0b10110001 && machine_versioncheck(machine, CORTEX_M4)) {
+		// T1: CBZ / CBNZ (compare and branch on [non-]zero)
+		// Note: the previous two instruction encodings (sign/zero extend,
+		// add sp) must be before this instruction.
+		uint32_t *reg = &machine->regs[(instruction >> 0) & 0b111];
+		uint32_t imm5 = (instruction >> 3) & 0b11111;
+		uint32_t flag_i  = ((instruction >> 9) & 0b1);
+		bool flag_nz = ((instruction >> 11) & 0b1);
+		if ((*reg == 0) == !flag_nz) {
+			*pc += (flag_i << 6) + (imm5 << 1) + 2;
+		}
+
+	} else if ((instruction & 0xffef) == 0xb662) {
+		// CPSID/CPSIE
+		machine->primask = (instruction >> 4) & 0b1;
+
+	} else if ((instruction >> 8) == 0b10111010) {
+		// T1: Reverse bytes
+		uint32_t *reg_dst = &machine->regs[(instruction >> 0) & 0b111];
+		uint32_t *reg_src = &machine->regs[(instruction >> 3) & 0b111];
+		uint32_t opcode   = (instruction >> 6) & 0b11;
+		if (opcode == 0b00) { // REV: reverse bytes
+			*reg_dst =
+				(*reg_src >> 0  & 0xff) << 24 |
+				(*reg_src >> 8  & 0xff) << 16 |
+				(*reg_src >> 16 & 0xff) << 8 |
+				(*reg_src >> 24 & 0xff) << 0;
+		//} else if (opcode == 0b01) { // REV16
+		//} else if (opcode == 0b11) { // REVSH
+		} else {
+			return ERR_UNDEFINED;
+		}
+
+	} else if ((instruction >> 8) == 0b10111110) {
+		// T1: BKPT (software breakpoint)
+		uint32_t imm8 = (instruction >> 0) & 0b11111111;
+		// This emulator handles some breakpoints in a special way.
+		if (imm8 == 0x81) {
+			machine->loglevel = LOG_INSTRS;
+		} else if (imm8 == 0x80) {
+			machine->loglevel = LOG_ERROR;
+		} else if (imm8 == 0xab) {
+			// Semihosting call: operation in r0, parameter in r1. It is
+			// handled by the caller of machine_run, which stores the
+			// result in r0.
+			return ERR_SEMIHOSTING;
+		} else {
+			return ERR_BREAK;
+		}
+
+	} else if ((instruction >> 8) == 0b10111111) {
+		uint32_t firstcond = (instruction >> 4) & 0b1111;
+		uint32_t mask      = (instruction >> 0) & 0b1111;
+		if (mask == 0b0000) {
+			// NOP-compatible hints (NOP, YIELD, WFE, WFI, SEV, DBG).
+			if (firstcond == 0b0010) { // WFE
+				if (machine->event) {
+					machine->event = false;
+				} else {
+					machine_sleep(machine, true);
+				}
+			} else if (firstcond == 0b0011) { // WFI
+				if (!machine_wakeup_pending(machine, false)) {
+					machine_sleep(machine, false);
+				}
+			} else if (firstcond == 0b0100) { // SEV
+				machine->event = true;
+				if (machine->family == FAMILY_RP2040) {
+					machine->rp2040.other.event = true; // wake up the other core too
+				}
+			}
+		} else if (!machine_versioncheck(machine, CORTEX_M4)) {
+			return ERR_UNDEFINED;
+		} else {
+			// IT
+			uint32_t state = (firstcond << 4) | mask;
+			machine->psr.it1 = state & 0b11;
+			machine->psr.it2 = state >> 2;
+		}
+
+	} else if ((instruction >> 12) == 0b1011 && ((instruction >> 9) & 0b11) == 0b10) { // 1011x10
+		// Format 14: push/pop registers
+		uint32_t reg_list   = (instruction >> 0) & 0xff;
+		bool     flag_load  = (instruction >> 11) & 0b1;
+		bool     flag_pc_lr = (instruction >> 8) & 0b1; // store LR / load PC
+		if (flag_load) { // POP
+			if (flag_pc_lr) {
+				reg_list |= (1 << 15); // PC
+			}
+			int err = machine_instr_ldmia(machine, sp, reg_list, true);
+			if (err != 0) {
+				return err;
+			}
+		} else { // PUSH
+			if (flag_pc_lr) {
+				reg_list |= (1 << 14); // LR
+			}
+			int err = machine_instr_stmdb(machine, sp, reg_list, true);
+			if (err != 0) {
+				return err;
+			}
+		}
+
+	} else if ((instruction >> 12) == 0b1100) {
+		// Format 15: multiple load/store (LDMIA and STMIA)
+		uint32_t  reg_list = (instruction >> 0) & 0xff;
+		uint32_t  reg_base_num = (instruction >> 8) & 0b111;
+		uint32_t *reg_base = &machine->regs[reg_base_num];
+		bool     flag_load = (instruction >> 11) & 0b1;
+		if (reg_list == 0) {
+			machine_log(machine, LOG_ERROR, "\nERROR: LDMIA/STMIA does not allow zero registers (%04x)\n", instruction);
+			return ERR_UNDEFINED;
+		}
+		if (flag_load) {
+			// LDMIA!
+			bool wback = (reg_list & (1 << reg_base_num)) == 0;
+			machine_instr_ldmia(machine, reg_base, reg_list, wback);
+		} else {
+			// STMIA!
+			machine_instr_stmia(machine, reg_base, reg_list, true);
+		}
+
+	} else if ((instruction >> 8) == 0b11011111) {
+		// T1: SVC (supervisor call)
+		uint32_t imm8 = (instruction >> 0) & 0b11111111;
+		if (machine->stubs.call != NULL && (machine->stubs.svc[imm8 / 32] & (1u << (imm8 % 32)))) {
+			return machine_stub_call(machine, machine->stubs.call, STUB_SVC, imm8);
+		}
+		if (machine_exception_priority(machine, 11) >= machine_execution_priority(machine, true)) {
+			// This escalates to a HardFault on a real chip.
+			machine_log(machine, LOG_ERROR, "\nERROR: SVC while SVCall can't be taken (PC: %x)\n", *pc - 3);
+			return ERR_UNDEFINED;
+		}
+		return machine_exception_entry(machine, 11);
+
+	} else if ((instruction >> 12) == 0b1101) {
+		// Format 16: conditional branch
+		// http://infocenter.arm.com/help/topic/com.arm.doc.dui0497a/BABEHFEF.html
+		uint32_t offset8   = (instruction >> 0) & 0xff;
+		uint32_t condition = (instruction >> 8) & 0b1111;
+		int32_t offset = ((int32_t)(offset8 << 24) >> 23);
+		offset += 2;
+		int result = machine_condition(machine, condition);
+		if (result < 0) {
+			return ERR_UNDEFINED;
+		}
+		if (result) {
+			*pc += offset;
+		}
+
+	} else if ((instruction >> 11) == 0b11100) {
+		// Format 18: unconditional branch
+		uint32_t offset11 = (instruction >> 0) & 0x7ff;
+		int32_t offset = ((int32_t)(offset11 << 21) >> 20);
+		*pc += offset + 2;
+
+	} else if ((instruction >> 11) == 0b11101 && machine_versioncheck(machine, CORTEX_M4)) {
+		// 32-bit instruction
+		uint16_t hw1 = instruction;
+		uint16_t hw2 = machine_fetch16(machine, *pc);
+		*pc += 2;
+
+		if (((hw1 >> 6) == 0b1110100100)) {
+			bool flag_load  = (hw1 >> 4) & 0b1;
+			bool flag_wback = (hw1 >> 5) & 0b1;
+			uint32_t *reg = &machine->regs[(hw1 >> 0) & 0b1111];
+			if (!flag_load) {
+				// STMDB
+				int err = machine_instr_stmdb(machine, reg, hw2, flag_wback);
+				if (err != 0) {
+					return err;
+				}
+			} else {
+				// LDMDB
+				int err = machine_instr_ldmdb(machine, reg, hw2, flag_wback);
+				if (err != 0) {
+					return err;
+				}
+			}
+
+		} else if ((hw1 >> 6) == 0b1110100010) {
+			bool flag_load  = (hw1 >> 4) & 0b1;
+			bool flag_wback = (hw1 >> 5) & 0b1;
+			uint32_t *reg = &machine->regs[(hw1 >> 0) & 0b1111];
+			if (flag_load) {
+				// LDMIA
+				int err = machine_instr_ldmia(machine, reg, hw2, flag_wback);
+				if (err != 0) {
+					return err;
+				}
+			} else {
+				// STMIA
+				int err = machine_instr_stmia(machine, reg, hw2, flag_wback);
+				if (err != 0) {
+					return err;
+				}
+			}
+
+		} else if (((hw1 >> 6) & 0b1111111001) == 0b1110100001) {
+			// Load/store double and exclusive, and table branch
+			bool     flag_index = (hw1 >> 8) & 0b1; // preindex
+			bool     flag_up    = (hw1 >> 7) & 0b1;
+			bool     flag_wback = (hw1 >> 5) & 0b1;
+			bool     flag_load  = (hw1 >> 4) & 0b1;
+			uint32_t *reg_src   = &machine->regs[(hw1 >> 0)  & 0b1111]; // Rn
+			if (flag_index || flag_wback) {
+				// Load and store double: LDRD, STRD
+				uint32_t imm8 = hw2 & 0xff;
+				uint32_t *reg_dst1 = &machine->regs[(hw2 >> 12) & 0b1111]; // Rt
+				uint32_t *reg_dst2 = &machine->regs[(hw2 >>  8) & 0b1111]; // Rt2
+				uint32_t base = reg_src == pc ? *reg_src & ~3UL : *reg_src;
+				uint32_t offset_addr = flag_up ? base + imm8 : base - imm8;
+				uint32_t address = flag_index ? offset_addr : (reg_src == pc ? *reg_src & ~1UL : *reg_src);
+				transfer_type_t transfer_type = flag_load ? LOAD : STORE;
+				if (flag_wback) {
+					*reg_src = offset_addr;
+				}
+				if (machine_transfer(machine, address, transfer_type, reg_dst1, WIDTH_32, false)) {
+					return ERR_MEM;
+				}
+				if (machine_transfer(machine, address + 4, transfer_type, reg_dst2, WIDTH_32, false)) {
+					return ERR_MEM;
+				}
+			} else if (!flag_up) {
+				// Load and store exclusive.
+				*pc -= 2;
+				return ERR_UNDEFINED;
+			} else  {
+				// Load/store exclusive byte, halfword, doubleword, and
+				// table branch.
+				uint32_t op        = (hw2 >> 4)  & 0b1111;
+				uint32_t *reg_src2 = &machine->regs[(hw2 >> 0)  & 0b1111]; // Rm
+				if (op == 0b0000 && flag_load) {
+					// TBB
+					uint32_t baseaddr = *reg_src;
+					if (reg_src == pc) {
+						baseaddr -= 1; // Thumb bit
+					}
+					uint32_t offset = *reg_src2;
+					uint32_t halfwords;
+					if (machine_transfer(machine, baseaddr + offset, LOAD, &halfwords, WIDTH_8, false)) {
+						return ERR_MEM;
+					}
+					*pc += halfwords << 1;
+				} else if (op == 0b0001 && flag_load) {
+					// TBH
+					uint32_t baseaddr = *reg_src;
+					if (reg_src == pc) {
+						baseaddr -= 1; // Thumb bit
+					}
+					uint32_t offset = *reg_src2 << 1;
+					uint32_t halfwords;
+					if (machine_transfer(machine, baseaddr + offset, LOAD, &halfwords, WIDTH_16, false)) {
+						return ERR_MEM;
+					}
+					*pc += halfwords << 1;
+				} else {
+					*pc -= 2;
+					return ERR_UNDEFINED;
+				}
+			}
+
+		} else if ((hw1 >> 9) == 0b1110101) {
+			// Data processing instructions with constant shift
+			uint32_t op        = (hw1 >> 5) & 0b1111;
+			uint32_t flag_set  = (hw1 >> 4) & 0b1;
+			uint32_t *reg_dst  = &machine->regs[(hw2 >> 8) & 0b1111]; // Rd
+			uint32_t *reg_src  = &machine->regs[(hw1 >> 0) & 0b1111]; // Rn
+			uint32_t *reg_src2 = &machine->regs[(hw2 >> 0) & 0b1111]; // Rm
+			uint32_t imm3      = (hw2 >> 12) & 0b111;
+			uint32_t imm2      = (hw2 >> 6)  & 0b11;
+			uint32_t type      = (hw2 >> 4)  & 0b11;
+
+			uint32_t imm5 = (imm3 << 2) | imm2;
+			// DecodeImmShift(type, imm3:imm2)
+			// Shift(value, shift_t / type, shift_n / amount, APSR.C / carry_in)
+			uint32_t shifted;
+			switch (type) {
+				case 0b00: // LSL
+					shifted = machine_instr_lsl(machine, *reg_src2, imm5, flag_set);
+					break;
+				case 0b01: // LSR
+					shifted = machine_instr_lsr(machine, *reg_src2, imm5 == 0 ? 32 : imm5, flag_set);
+					break;
+				case 0b10: // ASR
+					shifted = machine_instr_asr(machine, *reg_src2, imm5 == 0 ? 32 : imm5, flag_set);
+					break;
+				case 0b11: // ROR, RRX
+					*pc -= 2; // undo 32-bit change
+					return ERR_UNDEFINED;
+			}
+
+			int err = machine_alu_op(machine, op, reg_dst, reg_src, shifted, flag_set);
+			if (err != ERR_OK) {
+				*pc -= 2;
+				return err;
+			}
+
+		} else {
+			*pc -= 2; // undo 32-bit change
+			return ERR_UNDEFINED;
+		}
+
+	} else if ((instruction >> 12) == 0b1111) {
+		// 32-bit instruction
+		uint16_t hw1 = instruction;
+		uint16_t hw2 = machine_fetch16(machine, *pc);
+		*pc += 2;
+
+		if ((hw1 >> 11) == 0b11110 && (hw2 >> 15) == 0b0 && machine_versioncheck(machine, CORTEX_M4)) {
+			// Data processing instructions: immediate, including bitfield
+			// and saturate
+			uint32_t imm3 = (hw2 >> 12) & 0b111;
+			uint32_t *reg_dst = &machine->regs[(hw2 >> 8) & 0b1111]; // Rd
+			uint32_t *reg_src = &machine->regs[(hw1 >> 0) & 0b1111]; // Rn
+
+			if (((hw1 >> 9) & 0b1) == 0b0) {
+				// Data processing with modified 12-bit immediate
+				uint32_t bit_i    = (hw1 >> 10) & 0b1;
+				uint32_t op       = (hw1 >> 5) & 0b1111;
+				bool     flag_set = (hw1 >> 4) & 0b1;
+				uint32_t imm8     = (hw2 >> 0) & 0xff;
+				uint32_t imm12 = imm8 | (imm3 << 8) | (bit_i << 11);
+
+				// ThumbExpandImmWithC()
+				uint32_t imm32;
+				if ((imm12 >> 10) == 0b00) {
+					uint32_t imm8 = imm12 & 0xff;
+					switch ((imm12 >> 8) & 0b11) {
+						case 0b00:
+							imm32 = imm8;
+							break;
+						case 0b01:
+							imm32 = (imm8 << 16) | imm8;
+							break;
+						case 0b10:
+							imm32 = (imm8 << 24) | (imm8 << 8);
+							break;
+						case 0b11:
+							imm32 = (imm8 << 24) | (imm8 << 16) | (imm8 << 8) | imm8;
+							break;
+					}
+				} else {
+					uint32_t unrotated_value = 0x80 | (imm8 & 0x7f);
+					uint32_t n = imm12 >> 7;
+					// ROR_C(unrotated_value aka x, n)
+					imm32 = n == 0 ? unrotated_value : ((unrotated_value >> n) | (unrotated_value << (32 - n)));
+					if (flag_set) {
+						machine->psr.c = imm32 >> 31;
+					}
+				}
+
+				int err = machine_alu_op(machine, op, reg_dst, reg_src, imm32, flag_set);
+				if (err != ERR_OK) {
+					*pc -= 2;
+					return err;
+				}
+
+			} else if (((hw1 >> 6) & 0b1101) == 0b1001) {
+				// Move, plain 16-bit immediate
+				uint32_t bit_i    = (hw1 >> 10) & 0b1;
+				uint32_t op       = (hw1 >> 7) & 0b1;
+				uint32_t op2      = (hw1 >> 4) & 0b11;
+				uint32_t imm4     = (hw1 >> 0) & 0b1111;
+				uint32_t imm8     = (hw2 >> 0) & 0xff;
+
+				uint32_t imm16 = (imm4 << 12) | (bit_i << 11) | (imm3 << 8) | imm8;
+				if (op == 1 && op2 == 0b00) {
+					// MOVT
+					*pc -= 2;
+					return ERR_UNDEFINED;
+				} else if (op == 0 && op2 == 0b00) {
+					// MOVW
+					*reg_dst = imm16;
+				} else {
+					*pc -= 2;
+					return ERR_UNDEFINED;
+				}
+
+			} else if (((hw1 >> 8) & 0b11) == 0b11 && (((hw1 >> 4) & 0b1) == 0b0)) {
+				// Bit field operations, saturate with shift
+				uint32_t op       = (hw1 >> 5) & 0b111;
+				uint32_t imm5     = (hw2 >> 0) & 0b11111;
+				uint32_t imm2     = (hw2 >> 6) & 0b11;
+				if (op == 0b011) {
+					uint32_t msb = imm5;
+					uint32_t lsb = (imm3 << 2) | imm2;
+					uint32_t mask = 0xffffffff;
+					uint32_t msb_offset = 31 - msb;
+					mask = (mask >> lsb) << lsb;
+					mask = (mask << msb_offset) >> msb_offset;
+					uint32_t insert;
+					if (reg_src == pc) {
+						// BFC
+						insert = 0;
+					} else {
+						// BFI
+						insert = *reg_src << lsb;
+					}
+					*reg_dst = (*reg_dst & ~mask) | (insert & mask);
+				} else if (op == 0b110) {
+					// UBFX
+					uint32_t lsb         = (imm3 << 2) | imm2;
+					uint32_t widthminus1 = imm5;
+					uint32_t msb         = lsb + widthminus1;
+					*reg_dst = *reg_src << (31 - msb);
+					*reg_dst = *reg_dst >> (lsb + (31 - msb));
+				} else if (op == 0b010) {
+					// SBFX
+					uint32_t lsb         = (imm3 << 2) | imm2;
+					uint32_t widthminus1 = imm5;
+					uint32_t msb         = lsb + widthminus1;
+					*reg_dst = *reg_src << (31 - msb);
+					*reg_dst = (int32_t)*reg_dst >> (lsb + (31 - msb));
+				} else {
+					*pc -= 2; // undo 32-bit change
+					return ERR_UNDEFINED;
+				}
+
+			} else {
+				*pc -= 2; // undo 32-bit change
+				return ERR_UNDEFINED;
+			}
+
+		} else if ((hw1 >> 4) == 0b111100111011 && (hw2 >> 14) == 0b10) {
+			// Special control operations, ignore.
+
+		} else if ((hw1 >> 11) == 0b11110 && ((hw2 >> 11) & 0b10111) == 0b10111) {
+			// BL, B.W
+			uint32_t imm10 = hw1 & 0x3ff;
+			uint32_t imm11 = hw2 & 0x7ff;
+			bool flag_link = (hw2 >> 14) & 0b1;
+			int32_t pc_offset = (int32_t)(((uint32_t)imm10 << 12) | ((uint32_t)imm11 << 1)); // >> 11;
+			pc_offset <<= 10; // put in the top bits
+			pc_offset >>= 10; // sign-extend
+			uint32_t new_pc = (int32_t)*pc + pc_offset;
+			if (machine_log_call(machine, new_pc - 1)) {
+				char name[128];
+				machine_log(machine, LOG_CALLS, "%*sBL   %7x (sp: %x) -> %x%s\n", machine->call_depth * 2, "", *pc - 5, *sp, new_pc - 1, machine_symbol_name(machine, new_pc - 1, name, sizeof(name)));
+			}
+			machine_add_backtrace(machine, *pc - 5, *sp);
+			if (flag_link && machine->stack_guard.enabled) {
+				machine_stack_guard_call(machine, new_pc - 1);
+			}
+			if (flag_link) {
+				*lr = *pc;
+			}
+			*pc = new_pc;
+
+		} else if ((hw1 >> 11) == 0b11110 && ((hw2 >> 12) & 0b1101) == 0b1000) {
+			// T3: B (conditional branch)
+			uint32_t cond = (hw1 >> 6) & 0b1111;
+			if ((cond >> 1) == 0b111) {
+				// Something else
+				if (hw1 == 0xf3ef && (hw2 >> 12) == 0b1000) {
+					// MRS
+					// I couldn't quickly find any documentation for the encoding
+					// of this instruction so this is mostly a guess based on what
+					// the disassembler produces.
+					uint32_t *reg_dst = &machine->regs[(hw2 >> 8) & 0b1111]; // Rd
+					uint32_t imm8 = (hw2 >> 0) & 0xff;
+					if (imm8 == 0x05) {
+						// IPSR
+						*reg_dst = machine->ipsr;
+					} else if (imm8 == 0x08) {
+						// MSP
+						// No MSP/PSP distinction implemented yet so assuming it
+						// equals the stack pointer.
+						*reg_dst = *sp;
+					} else if (imm8 == 0x10) {
+						// PRIMASK
+						*reg_dst = machine->primask;
+					} else {
+						*pc -= 2;
+						return ERR_UNDEFINED;
+					}
+				} else if ((hw1 & 0xfff0) == 0xf380 && (hw2 >> 8) == 0x88) {
+					// MSR
+					uint32_t *reg_src = &machine->regs[(hw1 >> 0) & 0b1111]; // Rn
+					uint32_t imm8 = (hw2 >> 0) & 0xff;
+					if (imm8 == 0x08) {
+						// MSP
+						*sp = *reg_src & ~3UL;
+					} else if (imm8 == 0x10) {
+						// PRIMASK
+						machine->primask = *reg_src & 1;
+					} else {
+						*pc -= 2;
+						return ERR_UNDEFINED;
+					}
+				} else {
+					*pc -= 2;
+					return ERR_UNDEFINED;
+				}
+			} else if (machine_versioncheck(machine, CORTEX_M4)) {
+				uint32_t imm6 = hw1 & 0x3f;
+				uint32_t imm11 = hw2 & 0x7ff;
+				uint32_t s  = (hw1 >> 10) & 0b1;
+				uint32_t j1 = (hw2 >> 13) & 0b1;
+				uint32_t j2 = (hw2 >> 11) & 0b1;
+				int32_t pc_offset = (int32_t)((s << 20) | (j2 << 19) | (j1 << 18) | (imm6 << 12) | (imm11 << 1));
+				pc_offset <<= 11; // put in the top bits
+				pc_offset >>= 11; // sign-extend
+				uint32_t new_pc = (int32_t)*pc + pc_offset;
+				if (machine_condition(machine, cond)) {
+					*pc = new_pc;
+				}
+			}
+
+		} else if ((hw1 >> 9) == 0b1111100 && machine_versioncheck(machine, CORTEX_M4)) {
+			// Load and store single data item, and memory hints
+			uint32_t *reg_base   = &machine->regs[(hw1 >> 0 ) & 0b1111]; // Rn
+			uint32_t *reg_target = &machine->regs[(hw2 >> 12) & 0b1111]; // Rt
+			bool     flag_signed = (hw1 >> 8) & 0b1;
+			uint32_t size        = (hw1 >> 5) & 0b11;
+			bool     flag_load   = (hw1 >> 4) & 0b1;
+
+			transfer_type_t transfer_type = flag_load ? LOAD : STORE;
+			width_t width;
+			if (size == 0b10) {
+				if (flag_signed) {
+					*pc -= 2;
+					return ERR_UNDEFINED;
+				}
+				width = WIDTH_32;
+			} else if (size == 0b00) {
+				width = WIDTH_8;
+			} else if (size == 0b01) {
+				width = WIDTH_16;
+			} else {
+				*pc -= 2;
+				return ERR_UNDEFINED;
+			}
+
+			if (reg_base == pc) {
+				if (width != WIDTH_32 || !flag_load) {
+					// TODO: other widths
+					*pc -= 2;
+					return ERR_UNDEFINED;
+				}
+				// PC +/- imm12 (PC-relative)
+				uint32_t imm12 = (hw2 >> 0) & 0xfff;
+				bool flag_up = (hw1 >> 7) & 0b1;
+				uint32_t address = (*pc - 1) & ~3UL;
+				if (flag_up) {
+					address += imm12;
+				} else {
+					address -= imm12;
+				}
+				if (machine_transfer(machine, address, transfer_type, reg_target, width, flag_signed)) {
+					return ERR_MEM;
+				}
+
+			} else if (((hw1 >> 7) & 0b1) == 0b1) {
+				if (reg_base == pc) {
+					*pc -= 2;
+					return ERR_UNDEFINED;
+				} else {
+					// T3: LDR.W / STR.W (immediate)
+					uint32_t imm12 = (hw2 >> 0) & 0xfff;
+					uint32_t address = *reg_base + imm12;
+					if (machine_transfer(machine, address, transfer_type, reg_target, width, flag_signed)) {
+						return ERR_MEM;
+					}
+				}
+
+			} else {
+				if (((hw2 >> 6) & 0b111111) == 0b000000) {
+					// T2: LDR.W / STR.W (register)
+					uint32_t *reg_off = &machine->regs[(hw2 >> 0) & 0b1111];
+					uint32_t shift = (hw2 >> 4) & 0b11;
+					uint32_t address = *reg_base + (*reg_off << shift);
+					if (machine_transfer(machine, address, transfer_type, reg_target, width, flag_signed)) {
+						return ERR_MEM;
+					}
+
+				} else if (((hw2 >> 11) & 0b1) == 0b1) {
+					// T4: LDR.W / STR.W (immediate)
+					bool flag_index = (hw2 >> 10) & 0b1;
+					bool flag_add   = (hw2 >> 9)  & 0b1;
+					bool flag_wback = (hw2 >> 8)  & 0b1;
+					uint32_t imm8   = (hw2 >> 0)  & 0xff;
+					uint32_t offset_addr = flag_add ? *reg_base + imm8 : *reg_base - imm8;
+					uint32_t address = flag_index ? offset_addr : *reg_base;
+					if (flag_wback) {
+						*reg_base = offset_addr;
+					}
+					if (machine_transfer(machine, address, transfer_type, reg_target, width, flag_signed)) {
+						return ERR_MEM;
+					}
+
+				} else {
+					*pc -= 2; // undo 32-bit change
+					return ERR_UNDEFINED;
+				}
+			}
+
+		} else if ((hw1 >> 9) == 0b1111101 && machine_versioncheck(machine, CORTEX_M4)) {
+			// Data processing instructions, non-immediate
+			// (except for Data processing: constant shift)
+			uint32_t *reg_dst  = &machine->regs[(hw2 >> 8) & 0b1111]; // Rd
+			uint32_t *reg_src  = &machine->regs[(hw1 >> 0) & 0b1111]; // Rn
+			uint32_t *reg_src2 = &machine->regs[(hw2 >> 0) & 0b1111]; // Rm
+			if ((hw1 >> 7) == 0b111110100 && ((hw2 >> 7) & 0b111100001) == 0b111100000) {
+				// Register-controlled shift.
+				uint32_t op       = (hw1 >> 5) & 0b11;
+				bool     flag_set = (hw1 >> 4) & 0b1;
+				uint32_t op2      = (hw2 >> 4) & 0b111;
+				if (op2 != 0b000) {
+					*pc -= 2; // undo 32-bit change
+					return ERR_UNDEFINED;
+				}
+				if (op == 0b00) {
+					*reg_dst = machine_instr_lsl(machine, *reg_src, *reg_src2 & 0xff, flag_set);
+				} else if (op == 0b01) {
+					*reg_dst = machine_instr_lsr(machine, *reg_src, *reg_src2 & 0xff, flag_set);
+				} else if (op == 0b10) {
+					*reg_dst = machine_instr_asr(machine, *reg_src, *reg_src2 & 0xff, flag_set);
+				} else {
+					// ROR
+					*pc -= 2; // undo 32-bit change
+					return ERR_UNDEFINED;
+				}
+				if (flag_set) {
+					machine->psr.n = (int32_t)*reg_dst < 0;
+					machine->psr.z = *reg_dst == 0;
+				}
+
+			} else if ((hw1 >> 7) == 0b111110100 && ((hw2 >> 7) & 0b111100001) == 0b111100001) {
+				// Sign or zero extension, with optional addition.
+				uint32_t op       = (hw1 >> 4) & 0b111;
+				uint32_t rot      = (hw2 >> 4) & 0b11;
+				uint32_t rotate = rot << 3;
+
+				if (op == 0b101 && reg_src == pc) {
+					*reg_dst = (*reg_src2) >> rotate;
+				} else {
+					*pc -= 2; // undo 32-bit change
+					return ERR_UNDEFINED;
+				}
+
+			} else if ((hw1 >> 7) == 0b111110101 && ((hw2 >> 7) & 0b111100001) == 0b111100001) {
+				// Other three register data processing
+				uint32_t op       = (hw1 >> 4) & 0b111;
+				uint32_t op2      = (hw2 >> 4) & 0b111;
+				if (op == 0b011 && op2 == 0b000) {
+					// CLZ: count leading zeroes
+					if (*reg_src2 == 0) {
+						// __builtin_clz is undefined when *reg_src2 is
+						// zero.
+						*reg_dst = 32;
+					} else {
+						if (sizeof(int) == sizeof(uint32_t)) {
+							*reg_dst = __builtin_clz(*reg_src2);
+						} else {
+							// Fallback for non-32bit integers.
+							for (*reg_dst = 0; *reg_dst < 32; *reg_dst += 1) {
+								if (*reg_src2 & (1 << (31 - *reg_dst))) {
+									break;
+								}
+							}
+						}
+					}
+				} else {
+					*pc -= 2; // undo 32-bit change
+					return ERR_UNDEFINED;
+				}
+
+			} else if ((hw1 >> 7) == 0b111110110) {
+				// 32-bit multiplies and sum of absolute differences, with
+				// or without accumulate.
+				uint32_t op = (hw1 >> 4) & 0b111;
+				uint32_t op2 = (hw2 >> 4) & 0b1111;
+				uint32_t *reg_acc = &machine->regs[(hw2 >> 12) & 0b1111]; // Ra
+				if (op == 0b000 && op2 == 0b0000) {
+					if (reg_acc == pc) {
+						// MUL
+						*reg_dst = *reg_src * *reg_src2;
+					} else {
+						// MLA
+						*reg_dst = *reg_src * *reg_src2 + *reg_acc;
+					}
+				} else if (op == 0b000 && op2 == 0b0001 && reg_acc != pc) {
+					// MLS
+					*reg_dst = *reg_acc - *reg_src * *reg_src2;
+				} else {
+					*pc -= 2; // undo 32-bit change
+					return ERR_UNDEFINED;
+				}
+
+			} else if ((hw1 >> 7) == 0b111110111) {
+				// 64-bit multiply, multiply-accumulate, and divide
+				// instructions.
+				uint32_t op = (hw1 >> 4) & 0b111;
+				uint32_t op2 = (hw2 >> 4) & 0b1111;
+				uint32_t *reg_dst_hi = reg_dst; // RdHi
+				uint32_t *reg_dst_lo = &machine->regs[(hw2 >> 12) & 0b1111]; // RdLo
+				if (op == 0b000 && op2 == 0b0000) {
+					// SMULL
+					int64_t result = (int64_t)*reg_src * (int64_t)*reg_src2;
+					*reg_dst_lo = (uint32_t)result;
+					*reg_dst_hi = (uint32_t)(result >> 32);
+				} else if (op == 0b010 && op2 == 0b0000) {
+					// UMULL
+					uint64_t result = (uint64_t)*reg_src * (uint64_t)*reg_src2;
+					*reg_dst_lo = (uint32_t)result;
+					*reg_dst_hi = (uint32_t)(result >> 32);
+				} else if (op == 0b001 && op2 == 0b1111) {
+					// SDIV
+					if (*reg_src2 == 0) {
+						// TODO: this shouldn't always trap
+						*pc -= 2; // undo 32-bit change
+						return ERR_DIVZERO;
+					}
+					*reg_dst = (int32_t)*reg_src / (int32_t)*reg_src2;
+				} else if (op == 0b011 && op2 == 0b1111) {
+					// UDIV
+					if (*reg_src2 == 0) {
+						// TODO: this shouldn't always trap
+						*pc -= 2; // undo 32-bit change
+						return ERR_DIVZERO;
+					}
+					*reg_dst = *reg_src / *reg_src2;
+				} else {
+					*pc -= 2; // undo 32-bit change
+					return ERR_UNDEFINED;
+				}
+
+			} else {
+				*pc -= 2; // undo 32-bit change
+				return ERR_UNDEFINED;
+			}
+
+		} else {
+			*pc -= 2; // undo 32-bit change
+			return ERR_UNDEFINED;
+		}
+
+	} else {
+		return ERR_UNDEFINED;
+	}
+
+	return ERR_OK;
+}
+
+// Record the undefined instruction at instruction_pc, for the report of
+// instructions that still need to be implemented.
+static void machine_record_undefined(machine_t *machine) {
+	uint32_t pc = machine->instruction_pc;
+	uint16_t hw1 = machine_fetch16(machine, pc);
+	uint16_t hw2 = 0;
+	if (disasm_is_32bit(hw1) && machine_code_offset(machine, pc) + 2 < machine->image_size) {
+		hw2 = machine_fetch16(machine, pc + 2);
+	}
+	for (size_t i=0; i<machine->num_undefined; i++) {
+		undefined_instr_t *instr = &machine->undefined[i];
+		if (instr->hw1 == hw1 && instr->hw2 == hw2) {
+			if (instr->count < MACHINE_UNDEFINED_PCS) {
+				instr->pcs[instr->count] = pc;
+			}
+			instr->count++;
+			return;
+		}
+	}
+	if (machine->num_undefined < MACHINE_UNDEFINED_INSTRS) {
+		undefined_instr_t *instr = &machine->undefined[machine->num_undefined++];
+		instr->hw1 = hw1;
+		instr->hw2 = hw2;
+		instr->count = 1;
+		instr->pcs[0] = pc;
+	}
+}
+
+// Execute a single instruction on the executing core. Undefined instructions
+// are recorded here, before the error reaches the caller, so that all of them
+// are counted, also while single-stepping.
+static int machine_step_core(machine_t *machine) {
+	int err = machine_execute(machine);
+	if (err == ERR_UNDEFINED) {
+		machine_record_undefined(machine);
+	}
+	return err;
+}
+
+// Execute a single instruction on one of the two cores of the RP2040. The
+// cores take turns: core 0 runs up to MACHINE_CORE_QUANTUM cycles ahead, then
+// core 1 catches up. The cycle counter is the time of core 0, and the cycles
+// that core 1 spends are only counted in core1_cycles, so that both cores run
+// at the full clock speed. Core 1 sees the time of core 0, which is at most a
+// quantum ahead, so that time never goes backwards for the peripherals. When
+// an instruction stops the machine, the core that executed it stays the
+// executing core.
+static int machine_rp2040_step(machine_t *machine) {
+	if (machine->rp2040.core == 1) {
+		if (!machine->rp2040.core1_running || machine->rp2040.core1_cycles >= machine->stats.cycles) {
+			machine_rp2040_switch_core(machine);
+		}
+	} else if (machine->rp2040.core1_running && machine->stats.cycles - machine->rp2040.core1_cycles >= MACHINE_CORE_QUANTUM) {
+		machine_rp2040_switch_core(machine);
+	}
+	if (machine->rp2040.core == 0) {
+		return machine_step_core(machine);
+	}
+
+	uint64_t cycles = machine->stats.cycles;
+	uint64_t cycles_state[3];
+	memcpy(cycles_state, machine->stats.cycles_state, sizeof(cycles_state));
+	int err = machine_step_core(machine);
+	machine->rp2040.core1_cycles += machine->stats.cycles - cycles;
+	machine->stats.cycles = cycles;
+	memcpy(machine->stats.cycles_state, cycles_state, sizeof(cycles_state));
+	if (machine->sleep != SLEEP_NONE && machine->rp2040.core1_cycles < cycles) {
+		// Asleep: nothing to catch up on until it wakes up.
+		machine->rp2040.core1_cycles = cycles;
+	}
+	return err;
+}
+
+// Execute a single instruction. On the RP2040, the other core runs along
+// until the executing core has executed an instruction, so that a debugger
+// can step through the code of either core.
+int machine_step(machine_t *machine) {
+	if (machine->family != FAMILY_RP2040) {
+		return machine_step_core(machine);
+	}
+	uint32_t core = machine->rp2040.core;
+	while (1) {
+		int err = machine_rp2040_step(machine);
+		if (err != ERR_OK || machine->rp2040.core == core) {
+			return err;
+		}
+	}
+}
+
+void machine_print_registers(machine_t *machine) {
+	machine_log(machine, LOG_ERROR, "\n[ ");
+	for (size_t i=0; i<8; i++) {
+		machine_log(machine, LOG_ERROR, "%8x ", machine->regs[i]);
+	}
+	machine_log(machine, LOG_ERROR, ".. %8x ", machine->sp);     // sp
+	machine_log(machine, LOG_ERROR, "%8x ",    machine->lr - 1); // lr, not entirely correct
+	machine_log(machine, LOG_ERROR, "%8x ",    machine->pc - 1); // pc, not entirely correct
+	machine_log(machine, LOG_ERROR, "%c%c%c%c ", machine->psr.n ? 'N' : '_', machine->psr.z ? 'Z' : '_', machine->psr.c ? 'C' : '_', machine->psr.v ? 'V' : '_');
+	machine_log(machine, LOG_ERROR, "]\n");
+}
+
+// Unique ID of a new machine, which reads as "Emul" and "ator" in 32-bit hex
+// dumps. Its first 6 bytes are also the Bluetooth device address, a random
+// static address.
+static const uint8_t machine_default_device_id[12] = {0x6c, 0x75, 0x6d, 0x45, 0xde, 0xc0, 0xff, 0xff, 0x72, 0x6f, 0x74, 0x61};
+
+KEEPALIVE
+machine_t * machine_create(size_t image_size, size_t pagesize, size_t ram_size, int loglevel) {
+	if (image_size < 16 * 4) {
+#if !defined(__EMSCRIPTEN__)
+		if (loglevel >= LOG_ERROR) {
+			fprintf(stderr, "\nERROR: image is too small to contain an executable\n");
+		}
+#endif
+		return NULL;
+	}
+
+	machine_t *machine = calloc(sizeof(machine_t), 1);
+	machine->pagesize = pagesize;
+	machine->call_depth = 1;
+	machine->loglevel = loglevel;
+	machine->image_size = image_size;
+	machine->mem_size = ram_size;
+	machine->psr.t = 1; // Thumb mode
+	machine->wakeup_latency[SLEEP_LIGHT] = 16;
+	machine->wakeup_latency[SLEEP_DEEP] = 1024;
+	machine->clock = 16000000;
+	machine->permissions[PERM_WRITE_FLASH] = ACCESS_FAULT;
+	machine->host_start_us = machine_host_time_us();
+	machine->time_paused = true; // until it runs
+#ifdef __EMSCRIPTEN__
+	machine->deterministic = true;
+#endif
+
+	// Flash is erased (0xff), and only backed where it is written to.
+	uint32_t *image = machine_alloc_region(image_size);
+	machine_erase_region(image, 0, image_size);
+	memset(machine->uicr, 0xff, sizeof(machine->uicr));
+	for (int i = 0; i < MACHINE_NUM_UARTS; i++) {
+		uart_t *uart = &machine->uart[i];
+		uart->index = i;
+		uart->cts = true;
+		uart->tx_held = -1;
+		uart->inject_size = 256;
+		uart->inject = malloc(uart->inject_size);
+	}
+	memcpy(machine->device.id, machine_default_device_id, sizeof(machine->device.id));
+	memcpy(machine->device.addr, machine_default_device_id, sizeof(machine->device.addr));
+	machine->device.temperature = 2500;
+	machine->image32 = image;
+	machine->flash_erase_counts = calloc(image_size / pagesize, sizeof(uint32_t));
+	machine->random_state = 1;
+
+	// TODO: put random data in here to make a better simulation
+	machine->mem = machine_alloc_region(ram_size);
+
+	return machine;
+}
+
+void machine_load(machine_t *machine, uint8_t *image, size_t image_size) {
+	// caller should check this, but at least fail in a reasonable way
+	if (image_size > machine->image_size) {
+		image_size = machine->image_size;
+	}
+	memcpy(machine->image8, image, image_size);
+	machine_erase_region(machine->image8, image_size, machine->image_size - image_size); // erase the rest
+}
+
+KEEPALIVE
+uint8_t * machine_get_image(machine_t *machine) {
+	return machine->image8;
+}
+
+// Map a flash file over the flash of the machine. The mapping is private
+// (copy-on-write): only the pages that are written to are copied, and the file
+// itself isn't changed. The file must be at least as large as the flash. It
+// returns false if this isn't supported by the host, or on error.
+bool machine_map_image(machine_t *machine, int fd) {
+#if defined(__EMSCRIPTEN__) || defined(_WIN32)
+	return false;
+#else
+	return mmap(machine->image, machine->image_size, PROT_READ | PROT_WRITE, MAP_PRIVATE | MAP_FIXED, fd, 0) != MAP_FAILED;
+#endif
+}
+
+void machine_free(machine_t *machine) {
+	machine_free_region(machine->image, machine->image_size);
+	machine->image = NULL;
+	free(machine->flash_erase_counts);
+	machine->flash_erase_counts = NULL;
+	free(machine->qspi_flash.data);
+	machine->qspi_flash.data = NULL;
+	free(machine->coverage);
+	machine->coverage = NULL;
+	free(machine->trace_ring.events);
+	machine->trace_ring.events = NULL;
+	free(machine->executed);
+	machine->executed = NULL;
+	free(machine->breakpoints);
+	machine->breakpoints = NULL;
+	free(machine->ram_breakpoints);
+	machine->ram_breakpoints = NULL;
+	for (int i = 0; i < MACHINE_NUM_UARTS; i++) {
+		free(machine->uart[i].inject);
+		machine->uart[i].inject = NULL;
+	}
+	free(machine->histogram);
+	machine->histogram = NULL;
+	machine_free_region(machine->mem, machine->mem_size);
+	machine->mem = NULL;
+	for (size_t i = 0; i < machine->num_ext_ram; i++) {
+		machine_free_region(machine->ext_ram[i].data, machine->ext_ram[i].size);
+	}
+	machine->num_ext_ram = 0;
+	machine_clear_debug_info(machine);
+	free(machine);
+}
+
+// Return the cycle of the next scheduled event, which may wake up the core,
+// or UINT64_MAX if no event is scheduled.
+static uint64_t machine_next_event(machine_t *machine) {
+	if (machine->events.dirty != 0) {
+		machine_events_update(machine);
+	}
+	if (machine->events.len == 0) {
+		return UINT64_MAX;
+	}
+	uint64_t cycle = machine->events.heap[0].cycle;
+	return cycle < machine->stats.cycles ? machine->stats.cycles : cycle;
+}
+
+// Whether core 1 of the RP2040 (which isn't executing) sleeps without a
+// reason to wake up, so that skipping time doesn't skip its code.
+static bool machine_rp2040_core1_idle(machine_t *machine) {
+	if (machine->rp2040.core != 0 || machine->rp2040.other.sleep == SLEEP_NONE) {
+		return false;
+	}
+	machine_rp2040_switch_core(machine);
+	bool idle = !machine_wakeup_pending(machine, machine->sleep_wfe);
+	machine_rp2040_switch_core(machine);
+	return idle;
+}
+
+// Skip ahead to the next event when the core is idle: asleep in WFI or WFE, or
+// in a branch to itself that only an interrupt gets it out of. Nothing happens
+// in between, so this is the same as running these cycles one by one, only
+// much faster. When following the host clock, the clock is moved forward too.
+// It returns whether anything was skipped.
+static bool machine_fast_forward(machine_t *machine) {
+	bool idle_loop = machine->sleep == SLEEP_NONE;
+	if (!idle_loop && machine_wakeup_pending(machine, machine->sleep_wfe)) {
+		return false;
+	}
+	if (machine->family == FAMILY_RP2040 && machine->rp2040.core1_running && !machine_rp2040_core1_idle(machine)) {
+		return false;
+	}
+	if (idle_loop) {
+		uint32_t code_offset = machine_code_offset(machine, machine->pc - 1);
+		if (code_offset >= machine->image_size || machine->image16[code_offset / 2] != 0xe7fe) { // b .
+			return false;
+		}
+		if (machine->psr.it2 != 0 || machine_pending_exception(machine) != 0 || !machine_interruptible(machine) || machine_loglevel(machine) >= LOG_INSTRS) {
+			return false;
+		}
+		if (machine->breakpoints != NULL && machine->breakpoints[code_offset / 16] & (1 << (code_offset / 2 % 8))) {
+			return false;
+		}
+	}
+	uint64_t now = machine->stats.cycles;
+	uint64_t cycle = machine_next_event(machine);
+	if (machine->deadline != 0) {
+		machine_min_cycle(&cycle, machine->deadline);
+	}
+	if (idle_loop && machine->instruction_limit != 0) {
+		machine_min_cycle(&cycle, now + machine->instruction_limit - machine->stats.instructions);
+	}
+	if (cycle == UINT64_MAX || cycle - now < 16) {
+		// Nothing to skip to, or not worth it.
+		return false;
+	}
+
+	// Account for the cycles in between, as if they ran.
+	uint64_t cycles = cycle - now;
+	machine->stats.cycles = cycle;
+	if (idle_loop) {
+		// Each iteration is a single instruction of a single cycle.
+		machine->stats.instructions += cycles;
+		machine->stats.cycles_state[SLEEP_NONE] += cycles;
+		if (machine->histogram != NULL) {
+			machine->histogram[0xe7fe] += cycles;
+		}
+	} else {
+		machine->stats.cycles_state[machine->sleep] += cycles;
+	}
+	if (!machine->deterministic && !machine->time_paused) {
+		machine->host_start_us -= (cycles * 1000000 + machine->clock - 1) / machine->clock;
+	}
+	machine->stats.fast_forwarded += cycles;
+	return true;
+}
+
+// Run the machine until it stops.
+static int machine_run_loop(machine_t *machine) {
+	while (1) {
+		// These flags may be set from another thread. They are checked before
+		// every instruction, so that a halt takes effect right away.
+		if (machine_halt_requested(machine)) {
+			machine_cancel_halt(machine);
+			machine_rp2040_select_core0(machine);
+			return ERR_HALT;
+		}
+		if (__atomic_load_n(&machine->external_pending, __ATOMIC_ACQUIRE)) {
+			__atomic_store_n(&machine->external_pending, false, __ATOMIC_RELAXED);
+			machine->external_poll(machine);
+		}
+		if (machine->deadline != 0 && machine->stats.cycles >= machine->deadline) {
+			machine_rp2040_select_core0(machine);
+			return ERR_DEADLINE;
+		}
+		if (machine->input_eof) {
+			machine->input_eof = false;
+			return ERR_EOF;
+		}
+		if (machine->instruction_limit != 0 && machine->stats.instructions >= machine->instruction_limit) {
+			machine_rp2040_select_core0(machine);
+			return ERR_LIMIT;
+		}
+		if ((machine->deterministic || machine->fast_forward) && machine_fast_forward(machine)) {
+			// Check the above again at the new time.
+			continue;
+		}
+
+		// Print registers
+		if (machine_loglevel(machine) >= LOG_INSTRS || (machine_loglevel(machine) >= LOG_CALLS_SP && machine->sp != machine->last_sp)) {
+			machine->last_sp = machine->sp;
+			machine_print_registers(machine);
+		}
+#if !defined(__EMSCRIPTEN__)
+		if (machine_loglevel(machine) >= LOG_INSTRS) {
+			char instr[80];
+			char name[128];
+			machine_disasm(machine, machine->pc - 1, instr, sizeof(instr));
+			machine_log(machine, LOG_INSTRS, "%8x:  %-32s%s\n", machine->pc - 1, instr, machine_symbol_name(machine, machine->pc - 1, name, sizeof(name)));
+		}
+#endif
+
+		// Execute a single instruction
+		int err = machine->family == FAMILY_RP2040 ? machine_rp2040_step(machine) : machine_step_core(machine);
+		if (machine->interrupted) {
+			// The instruction was waiting for input when the machine was
+			// halted. Undo it, so that it is executed again after the halt.
+			machine->interrupted = false;
+			memcpy(machine->regs, machine->interrupted_regs, sizeof(machine->regs));
+			machine->pc = machine->instruction_pc + 1;
+			machine_cancel_halt(machine);
+			return ERR_HALT;
+		}
+		if (err == ERR_SEMIHOSTING || err == ERR_HANG) {
+			// Handled and reported by the caller.
+			return err;
+		}
+		if (err == ERR_BREAK && machine->break_skip) {
+			// Stopped at a breakpoint set by the debugger (not a BKPT
+			// instruction), which reports it itself.
+			return err;
+		}
+		switch (err) {
+			case ERR_OK:
+				break; // no error
+			case ERR_HALT:
+				// expected
+				break;
+			case ERR_EXIT:
+				return 0;
+			case ERR_BREAK:
+				machine_log(machine, LOG_ERROR, "\nhit breakpoint at address %x\n", machine->pc - 1);
+				break;
+			case ERR_MEM:
+				// already printed
+				break;
+			case ERR_PC:
+				machine_log(machine, LOG_ERROR, "\nERROR: invalid PC address: 0x%08x\n", machine->pc);
+				break;
+			case ERR_UNDEFINED:
+				machine_log(machine, LOG_ERROR, "\nERROR: unknown instruction %04x at address %x\n", machine_fetch16(machine, machine->pc - 2), machine->pc - 3);
+				break;
+			default:
+				machine_log(machine, LOG_ERROR, "\nERROR: unknown error: %d\n", err);
+				break;
+		}
+		if (err != 0) {
+			if (err != ERR_BREAK && err != ERR_HALT) {
+				machine->stats.faults++;
+			}
+			if (machine_loglevel(machine) < LOG_INSTRS) { // don't double-log
+				machine_print_registers(machine);
+			}
+#if !defined(__EMSCRIPTEN__)
+			if (err != ERR_BREAK && err != ERR_PC && machine_loglevel(machine) >= LOG_ERROR) {
+				char instr[80];
+				char name[128];
+				machine_disasm(machine, machine->instruction_pc, instr, sizeof(instr));
+				machine_log(machine, LOG_ERROR, "Instruction: %8x:  %s%s\n", machine->instruction_pc, instr, machine_symbol_name(machine, machine->instruction_pc, name, sizeof(name)));
+			}
+#endif
+			machine_add_backtrace(machine, machine->pc, machine->sp);
+			machine_log(machine, LOG_ERROR, "Backtrace:\n");
+			for (int i = 1; i < machine->call_depth; i++) {
+				if (i >= MACHINE_BACKTRACE_LEN) {
+					machine_log(machine, LOG_ERROR, " %3d. (too much recursion)\n", i);
+					break;
+				}
+				char name[128];
+				machine_log(machine, LOG_ERROR, " %3d. %8x (SP: %x)%s\n", i, machine->backtrace[i].pc, machine->backtrace[i].sp, machine_symbol_name(machine, machine->backtrace[i].pc, name, sizeof(name)));
+			}
+			return err;
+		}
+	}
+}
+
+// Run the machine until it stops, with the host clock running.
+KEEPALIVE
+int machine_run(machine_t *machine) {
+	machine_time_resume(machine);
+	int err = machine_run_loop(machine);
+	machine_time_pause(machine);
+	return err;
+}
+
+void machine_readmem(machine_t *machine, void *buf, size_t address, size_t length) {
+	// Debugger reads don't count as accesses by the firmware.
+	uint32_t transfer_address = machine->transfer_address;
+	if (address % 4 == 0 && length % 4 == 0) {
+		for (size_t i=0; i<length; i += 4) {
+			uint32_t reg;
+			machine_transfer(machine, address + i, LOAD, &reg, WIDTH_32, false);
+			((uint32_t*)buf)[i / 4] = reg;
+		}
+	} else {
+		for (size_t i=0; i<length; i++) {
+			uint32_t reg;
+			machine_transfer(machine, address + i, LOAD, &reg, WIDTH_8, false);
+			((uint8_t*)buf)[i] = reg;
+		}
+	}
+	machine->transfer_address = transfer_address;
+}
+
+void machine_readregs(machine_t *machine, uint32_t *regs, size_t num) {
+	if (num < sizeof(machine->regs) / sizeof(machine->regs[0])) {
+		num = sizeof(machine->regs) / sizeof(machine->regs[0]);
+	}
+	for (size_t i=0; i<num; i++) {
+		regs[i] = machine->regs[i];
+	}
+}
 
-			} else if ((hw1 >> 7) == 0b111110100 && ((hw2 >> 7) & 0b111100001) == 0b111100001) {
-				// Sign or zero extension, with optional addition.
-				uint32_t op       = (hw1 >> 4) & 0b111;
-				uint32_t rot      = (hw2 >> 4) & 0b11;
-				uint32_t rotate = rot << 3;
+KEEPALIVE
+// Write to memory like a debugger would: flash and RAM are written directly
+// (even when flash is not writable), other addresses go through the bus.
+void machine_writemem(machine_t *machine, const void *buf, size_t address, size_t length) {
+	const uint8_t *data = buf;
+	uint32_t transfer_address = machine->transfer_address;
+	for (size_t i=0; i<length; i++) {
+		size_t a = address + i;
+		if (machine_code_offset(machine, a) < machine->image_size) {
+			machine->image8[machine_code_offset(machine, a)] = data[i];
+		} else if (a >= 0x20000000 && a - 0x20000000 < machine->mem_size) {
+			machine->mem8[a - 0x20000000] = data[i];
+		} else {
+			uint32_t reg = data[i];
+			machine_transfer(machine, a, STORE, &reg, WIDTH_8, false);
+		}
+	}
+	machine->transfer_address = transfer_address;
+}
 
-				if (op == 0b101 && reg_src == pc) {
-					*reg_dst = (*reg_src2) >> rotate;
-				} else {
-					*pc -= 2; // undo 32-bit change
-					return ERR_UNDEFINED;
-				}
+// Make a single access on the bus, like the MEM-AP of a debug probe does:
+// unlike machine_writemem, stores to flash go through the flash controller.
+// It returns the error of the access, like ERR_MEM.
+int machine_bus_transfer(machine_t *machine, uint32_t address, bool store, uint32_t *value, width_t width) {
+	uint32_t transfer_address = machine->transfer_address;
+	int err = machine_transfer(machine, address, store ? STORE : LOAD, value, width, false);
+	machine->transfer_address = transfer_address;
+	return err;
+}
 
-			} else if ((hw1 >> 7) == 0b111110101 && ((hw2 >> 7) & 0b111100001) == 0b111100001) {
-				// Other three register data processing
-				uint32_t op       = (hw1 >> 4) & 0b111;
-				uint32_t op2      = (hw2 >> 4) & 0b111;
-				if (op == 0b011 && op2 == 0b000) {
-					// CLZ: count leading zeroes
-					if (*reg_src2 == 0) {
-						// __builtin_clz is undefined when *reg_src2 is
-						// zero.
-						*reg_dst = 32;
-					} else {
-						if (sizeof(int) == sizeof(uint32_t)) {
-							*reg_dst = __builtin_clz(*reg_src2);
-						} else {
-							// Fallback for non-32bit integers.
-							for (*reg_dst = 0; *reg_dst < 32; *reg_dst += 1) {
-								if (*reg_src2 & (1 << (31 - *reg_dst))) {
-									break;
-								}
-							}
-						}
-					}
-				} else {
-					*pc -= 2; // undo 32-bit change
-					return ERR_UNDEFINED;
-				}
+// Set the value of a register, using the same numbering as machine_readreg.
+void machine_writereg(machine_t *machine, size_t reg, uint32_t value) {
+	if (reg >= sizeof(machine->regs) / sizeof(machine->regs[0])) {
+		return;
+	}
+	machine->regs[reg] = value;
+}
 
-			} else if ((hw1 >> 7) == 0b111110110) {
-				// 32-bit multiplies and sum of absolute differences, with
-				// or without accumulate.
-				uint32_t op = (hw1 >> 4) & 0b111;
-				uint32_t op2 = (hw2 >> 4) & 0b1111;
-				uint32_t *reg_acc = &machine->regs[(hw2 >> 12) & 0b1111]; // Ra
-				if (op == 0b000 && op2 == 0b0000) {
-					if (reg_acc == pc) {
-						// MUL
-						*reg_dst = *reg_src * *reg_src2;
-					} else {
-						// MLA
-						*reg_dst = *reg_src * *reg_src2 + *reg_acc;
-					}
-				} else if (op == 0b000 && op2 == 0b0001 && reg_acc != pc) {
-					// MLS
-					*reg_dst = *reg_acc - *reg_src * *reg_src2;
-				} else {
-					*pc -= 2; // undo 32-bit change
-					return ERR_UNDEFINED;
-				}
+KEEPALIVE
+uint32_t machine_readreg(machine_t *machine, size_t reg) {
+	if (reg >= sizeof(machine->regs) / sizeof(machine->regs[0])) {
+		return 0;
+	}
+	return machine->regs[reg];
+}
 
-			} else if ((hw1 >> 7) == 0b111110111) {
-				// 64-bit multiply, multiply-accumulate, and divide
-				// instructions.
-				uint32_t op = (hw1 >> 4) & 0b111;
-				uint32_t op2 = (hw2 >> 4) & 0b1111;
-				uint32_t *reg_dst_hi = reg_dst; // RdHi
-				uint32_t *reg_dst_lo = &machine->regs[(hw2 >> 12) & 0b1111]; // RdLo
-				if (op == 0b000 && op2 == 0b0000) {
-					// SMULL
-					int64_t result = (int64_t)*reg_src * (int64_t)*reg_src2;
-					*reg_dst_lo = (uint32_t)result;
-					*reg_dst_hi = (uint32_t)(result >> 32);
-				} else if (op == 0b010 && op2 == 0b0000) {
-					// UMULL
-					uint64_t result = (uint64_t)*reg_src * (uint64_t)*reg_src2;
-					*reg_dst_lo = (uint32_t)result;
-					*reg_dst_hi = (uint32_t)(result >> 32);
-				} else if (op == 0b001 && op2 == 0b1111) {
-					// SDIV
-					if (*reg_src2 == 0) {
-						// TODO: this shouldn't always trap
-						*pc -= 2; // undo 32-bit change
-						return ERR_DIVZERO;
-					}
-					*reg_dst = (int32_t)*reg_src / (int32_t)*reg_src2;
-				} else if (op == 0b011 && op2 == 0b1111) {
-					// UDIV
-					if (*reg_src2 == 0) {
-						// TODO: this shouldn't always trap
-						*pc -= 2; // undo 32-bit change
-						return ERR_DIVZERO;
-					}
-					*reg_dst = *reg_src / *reg_src2;
-				} else {
-					*pc -= 2; // undo 32-bit change
-					return ERR_UNDEFINED;
-				}
+// Read the registers and any number of memory ranges in one call, so that a
+// debugger needs a single call per stop instead of one per register. The
+// registers are those of MACHINE_STATE_REGS as a debugger sees them: the PC
+// without the Thumb bit. Either regs or ranges may be NULL.
+void machine_read_state(machine_t *machine, uint32_t *regs, machine_range_t *ranges, size_t num_ranges) {
+	if (regs != NULL) {
+		for (size_t i=0; i<16; i++) {
+			regs[i] = machine->regs[i];
+		}
+		regs[15] -= 1; // remove the Thumb bit
+		regs[16] = machine_get_xpsr(machine);
+	}
+	for (size_t i=0; i<num_ranges; i++) {
+		machine_readmem(machine, ranges[i].data, ranges[i].address, ranges[i].length);
+	}
+}
+
+// Write the registers and memory ranges in one call, the counterpart of
+// machine_read_state. The memory is written like machine_writemem does.
+void machine_write_state(machine_t *machine, const uint32_t *regs, const machine_range_t *ranges, size_t num_ranges) {
+	if (regs != NULL) {
+		for (size_t i=0; i<15; i++) {
+			machine->regs[i] = regs[i];
+		}
+		machine->pc = regs[15] | 1; // Thumb mode
+		machine_set_xpsr(machine, regs[16]);
+	}
+	for (size_t i=0; i<num_ranges; i++) {
+		machine_writemem(machine, ranges[i].data, ranges[i].address, ranges[i].length);
+	}
+}
+
+// A snapshot starts with this header, followed by machine_t and the memory.
+// As machine_t is copied as a whole, a snapshot can only be restored by a
+// build with the same machine_t: increment SNAPSHOT_VERSION whenever it or the
+// data after it changes.
+#define SNAPSHOT_MAGIC   0x4b434d45 // "EMCK"
+#define SNAPSHOT_VERSION 3
+
+typedef struct {
+	uint32_t magic;
+	uint32_t version;
+	uint32_t state_size;   // sizeof(machine_t)
+	uint32_t pointer_size; // sizeof(void *)
+} snapshot_header_t;
+
+// Return the size of a snapshot of this machine, see machine_save_snapshot.
+size_t machine_snapshot_size(machine_t *machine) {
+	size_t size = sizeof(snapshot_header_t) + sizeof(machine_t) + machine->mem_size + machine->image_size;
+	size += machine->image_size / machine->pagesize * sizeof(uint32_t);
+	for (size_t i = 0; i < machine->num_ext_ram; i++) {
+		size += machine->ext_ram[i].size;
+	}
+	if (machine->qspi_flash.data != NULL) {
+		size += machine->qspi_flash.size;
+	}
+	return size;
+}
+
+// Save the complete state of the machine, with all of its memory, into buf of
+// machine_snapshot_size bytes. The machine must not be running. The snapshot
+// can only be restored in the same build of the emulator, into a machine with
+// the same memory layout.
+void machine_save_snapshot(machine_t *machine, uint8_t *buf) {
+	machine_t state = *machine;
+	// Time continues from the same point after a restore, also when it follows
+	// the host clock.
+	state.paused_us = machine_host_us(machine);
+	state.paused_cycles = machine->stats.cycles;
+	state.time_paused = true;
+	snapshot_header_t header = {SNAPSHOT_MAGIC, SNAPSHOT_VERSION, sizeof(machine_t), sizeof(void *)};
+	memcpy(buf, &header, sizeof(header));
+	buf += sizeof(header);
+	memcpy(buf, &state, sizeof(machine_t));
+	buf += sizeof(machine_t);
+	memcpy(buf, machine->mem, machine->mem_size);
+	buf += machine->mem_size;
+	memcpy(buf, machine->image, machine->image_size);
+	buf += machine->image_size;
+	size_t counts = machine->image_size / machine->pagesize * sizeof(uint32_t);
+	memcpy(buf, machine->flash_erase_counts, counts);
+	buf += counts;
+	for (size_t i = 0; i < machine->num_ext_ram; i++) {
+		memcpy(buf, machine->ext_ram[i].data, machine->ext_ram[i].size);
+		buf += machine->ext_ram[i].size;
+	}
+	if (machine->qspi_flash.data != NULL) {
+		memcpy(buf, machine->qspi_flash.data, machine->qspi_flash.size);
+	}
+}
+
+// Restore a snapshot made by machine_save_snapshot. Everything the host set up
+// is kept: callbacks, debug information, breakpoints, watches, limits and
+// other options. The machine isn't changed when the snapshot was made by
+// another build of the emulator (SNAPSHOT_INVALID) or doesn't fit this machine
+// (SNAPSHOT_MISMATCH).
+snapshot_result_t machine_restore_snapshot(machine_t *machine, const uint8_t *buf, size_t len) {
+	snapshot_header_t header;
+	if (len < sizeof(header)) {
+		return SNAPSHOT_INVALID;
+	}
+	memcpy(&header, buf, sizeof(header));
+	if (header.magic != SNAPSHOT_MAGIC || header.version != SNAPSHOT_VERSION || header.state_size != sizeof(machine_t) || header.pointer_size != sizeof(void *)) {
+		return SNAPSHOT_INVALID;
+	}
+	if (len != machine_snapshot_size(machine)) {
+		return SNAPSHOT_MISMATCH;
+	}
+	buf += sizeof(header);
+	machine_t *state = malloc(sizeof(machine_t));
+	memcpy(state, buf, sizeof(machine_t));
+	bool fits = state->mem_size == machine->mem_size &&
+		state->image_size == machine->image_size &&
+		state->pagesize == machine->pagesize &&
+		state->flash_base == machine->flash_base &&
+		state->num_ext_ram == machine->num_ext_ram &&
+		state->qspi_flash.size == machine->qspi_flash.size &&
+		(state->qspi_flash.data == NULL) == (machine->qspi_flash.data == NULL);
+	for (size_t i = 0; fits && i < machine->num_ext_ram; i++) {
+		fits = state->ext_ram[i].start == machine->ext_ram[i].start && state->ext_ram[i].size == machine->ext_ram[i].size;
+	}
+	if (!fits) {
+		free(state);
+		return SNAPSHOT_MISMATCH;
+	}
+
+	// Keep the memory of this machine and what the host set up.
+	for (size_t i = 0; i < machine->num_ext_ram; i++) {
+		state->ext_ram[i].data = machine->ext_ram[i].data;
+	}
+	state->image = machine->image;
+	state->image_writable = machine->image_writable;
+	state->flash_erase_counts = machine->flash_erase_counts;
+	state->flash_cut_erase = machine->flash_cut_erase;
+	state->flash_cut_write = machine->flash_cut_write;
+	state->mem = machine->mem;
+	for (int i = 0; i < MACHINE_NUM_UARTS; i++) {
+		uart_t *uart = &state->uart[i];
+		uart->mute = machine->uart[i].mute;
+		uart->output = machine->uart[i].output;
+		uart->receive = machine->uart[i].receive;
+		uart->input = machine->uart[i].input;
+		uart->input_len = machine->uart[i].input_len;
+		if (uart->input_pos > uart->input_len) {
+			uart->input_pos = uart->input_len;
+		}
+		uart->timing = machine->uart[i].timing;
+		uart->host_baud = machine->uart[i].host_baud;
+		uart->pacing = machine->uart[i].pacing;
+		// Input that the host has queued is still received.
+		uart->inject = machine->uart[i].inject;
+		uart->inject_size = machine->uart[i].inject_size;
+		uart->inject_pos = machine->uart[i].inject_pos;
+		uart->inject_len = machine->uart[i].inject_len;
+	}
+	state->qspi_flash.data = machine->qspi_flash.data;
+	state->sdcard.io = machine->sdcard.io;
+	state->ws2812.frame = machine->ws2812.frame;
+	state->ws2812.pin = machine->ws2812.pin;
+	state->probe = machine->probe;
+	state->audio = machine->audio;
+	state->analog = machine->analog;
+	state->can = machine->can;
+	state->radio = machine->radio;
+	state->stubs = machine->stubs;
+	// The host doesn't save what its timer is for, like the advertising of a
+	// SoftDevice, so the timer isn't restored either.
+	state->host_timer = machine->host_timer;
+	state->boot_vectors = machine->boot_vectors;
+	state->periph_trace = machine->periph_trace;
+	state->exception_trace = machine->exception_trace;
+	state->trace_ring = machine->trace_ring;
+	state->watch = machine->watch;
+	memcpy(state->permissions, machine->permissions, sizeof(state->permissions));
+	// The stack guards point into the stack frame table, which is rebuilt from
+	// the same firmware but lives elsewhere now.
+	if (state->stack_guard.num_frames == machine->stack_guard.num_frames) {
+		for (size_t i = 0; i < state->stack_guard.count; i++) {
+			size_t index = ((uintptr_t)state->stack_guard.guards[i].frame - (uintptr_t)state->stack_guard.frames) / sizeof(stack_frame_t);
+			state->stack_guard.guards[i].frame = &machine->stack_guard.frames[index];
+		}
+	} else {
+		state->stack_guard.count = 0;
+	}
+	state->stack_guard.enabled = machine->stack_guard.enabled;
+	state->stack_guard.check_return = machine->stack_guard.check_return;
+	state->stack_guard.frames = machine->stack_guard.frames;
+	state->stack_guard.num_frames = machine->stack_guard.num_frames;
+	if (!state->stack_guard.enabled) {
+		state->stack_guard.count = 0;
+	}
+	state->hang.cycles = machine->hang.cycles;
+	state->bus.io = machine->bus.io;
+	state->bus.trace = machine->bus.trace;
+	memcpy(state->bus.spi_cs, machine->bus.spi_cs, sizeof(state->bus.spi_cs));
+	state->bus.spi_devices = machine->bus.spi_devices;
+	state->symbols = machine->symbols;
+	state->num_symbols = machine->num_symbols;
+	state->symbols_filtered = machine->symbols_filtered;
+	state->lines = machine->lines;
+	state->num_lines = machine->num_lines;
+	state->lines_capacity = machine->lines_capacity;
+	state->source_files = machine->source_files;
+	state->num_source_files = machine->num_source_files;
+	state->breakpoints = machine->breakpoints;
+	state->ram_breakpoints = machine->ram_breakpoints;
+	state->break_skip = machine->break_skip;
+	state->histogram = machine->histogram;
+	memcpy(state->periph_faults, machine->periph_faults, sizeof(state->periph_faults));
+	state->num_periph_faults = machine->num_periph_faults;
+	memcpy(state->external_periphs, machine->external_periphs, sizeof(state->external_periphs));
+	state->num_external_periphs = machine->num_external_periphs;
+	state->external_transfer = machine->external_transfer;
+	state->external_poll = machine->external_poll;
+	state->external_pending = machine->external_pending;
+	state->deadline = machine->deadline;
+	state->instruction_limit = machine->instruction_limit;
+	state->coverage = machine->coverage;
+	state->coverage_size = machine->coverage_size;
+	state->executed = machine->executed;
+	state->loglevel = machine->loglevel;
+	state->halt = machine->halt;
+	state->deterministic = machine->deterministic;
+	state->fast_forward = machine->fast_forward;
+	state->time_while_halted = machine->time_while_halted;
+
+	buf += sizeof(machine_t);
+	memcpy(state->mem, buf, state->mem_size);
+	buf += state->mem_size;
+	memcpy(state->image, buf, state->image_size);
+	buf += state->image_size;
+	size_t counts = state->image_size / state->pagesize * sizeof(uint32_t);
+	memcpy(state->flash_erase_counts, buf, counts);
+	buf += counts;
+	for (size_t i = 0; i < state->num_ext_ram; i++) {
+		memcpy(state->ext_ram[i].data, buf, state->ext_ram[i].size);
+		buf += state->ext_ram[i].size;
+	}
+	if (state->qspi_flash.data != NULL) {
+		memcpy(state->qspi_flash.data, buf, state->qspi_flash.size);
+	}
+	memcpy(machine, state, sizeof(machine_t));
+	free(state);
+	return SNAPSHOT_OK;
+}
+
+// Request machine_run to stop before the next instruction. This may be called
+// from another thread.
+void machine_halt(machine_t *machine) {
+	__atomic_store_n(&machine->halt, true, __ATOMIC_RELEASE);
+}
+
+// Withdraw a halt request that machine_run hasn't acted on.
+void machine_cancel_halt(machine_t *machine) {
+	__atomic_store_n(&machine->halt, false, __ATOMIC_RELAXED);
+}
+
+// Start counting executed instructions per first halfword.
+void machine_enable_histogram(machine_t *machine) {
+	if (machine->histogram == NULL) {
+		machine->histogram = calloc(65536, sizeof(uint64_t));
+	}
+}
+
+// Set or clear a breakpoint at the given address. Breakpoints can be set in
+// the image and in RAM, the places code can be executed from. They don't
+// change memory, so they also work in flash and are invisible to the firmware.
+bool machine_set_breakpoint(machine_t *machine, uint32_t address, bool set) {
+	if (address % 2 != 0) {
+		return false;
+	}
+	uint8_t **bitmap = &machine->breakpoints;
+	size_t size = machine->image_size;
+	uint32_t offset = machine_code_offset(machine, address);
+	if (offset >= machine->image_size) {
+		if (address >> 29 != 1 || (address & 0x1fffffff) >= machine->mem_size) {
+			return false;
+		}
+		bitmap = &machine->ram_breakpoints;
+		size = machine->mem_size;
+		offset = address & 0x1fffffff;
+	}
+	if (*bitmap == NULL) {
+		if (!set) {
+			return true;
+		}
+		*bitmap = calloc(size / 16 + 1, 1);
+	}
+	uint32_t index = offset / 2;
+	if (set) {
+		(*bitmap)[index / 8] |= 1 << (index % 8);
+	} else {
+		(*bitmap)[index / 8] &= ~(1 << (index % 8));
+	}
+	return true;
+}
+
+// Mark the given external interrupt as pending. It will be taken when it is
+// enabled and has a high enough priority.
+KEEPALIVE
+void machine_pend_irq(machine_t *machine, uint32_t irq) {
+	if (irq >= MACHINE_NUM_IRQS) {
+		return;
+	}
+	machine->nvic.pending |= 1 << irq;
+	if (machine->scb.scr & (1 << 4)) { // SEVONPEND
+		machine->event = true;
+	}
+	if (machine->family == FAMILY_RP2040) {
+		// Interrupts go to the NVIC of both cores.
+		machine_rp2040_pend_irq(machine, machine->rp2040.core ^ 1, irq);
+	}
+}
+
+// Set the number of cycles it takes to wake up from (deep) sleep.
+void machine_set_wakeup_latency(machine_t *machine, uint32_t light, uint32_t deep) {
+	machine->wakeup_latency[SLEEP_LIGHT] = light;
+	machine->wakeup_latency[SLEEP_DEEP] = deep;
+}
+
+// Return the number of cycles the given peripheral has been turned on.
+uint64_t machine_periph_cycles(machine_t *machine, periph_t periph) {
+	uint64_t cycles = machine->stats.cycles_periph[periph];
+	if (machine->periph_on[periph]) {
+		cycles += machine->stats.cycles - machine->periph_since[periph];
+	}
+	return cycles;
+}
+
+// Stop machine_run with ERR_DEADLINE once the given cycle has been reached. A
+// cycle of 0 removes the deadline.
+void machine_set_deadline(machine_t *machine, uint64_t cycle) {
+	machine->deadline = cycle;
+}
+
+// Stop machine_run with ERR_LIMIT once the given number of instructions has
+// been executed. A limit of 0 removes the limit.
+void machine_set_instruction_limit(machine_t *machine, uint64_t limit) {
+	machine->instruction_limit = limit;
+}
+
+// Stop machine_run with ERR_HANG when the firmware runs a loop of at most
+// MACHINE_HANG_SPAN bytes of code for the given number of cycles, while the loop
+// doesn't store to memory or access peripherals and interrupts can't be taken.
+// A value of 0 disables this check.
+void machine_set_hang_cycles(machine_t *machine, uint64_t cycles) {
+	machine->hang.cycles = cycles;
+	machine->hang.side_effect = true;
+}
+
+// Stop with ERR_MEM when the firmware stores into the registers that a
+// function on the stack saved in its prologue, like the return address, as
+// happens when a buffer on the stack overflows. Only calls to functions added
+// with machine_add_stack_frame are guarded. With check_return, the return
+// address is also checked when it is loaded, to catch it being changed in
+// another way (like by DMA).
+void machine_enable_stack_guard(machine_t *machine, bool check_return) {
+	machine->stack_guard.enabled = true;
+	machine->stack_guard.check_return = check_return;
+}
+
+// Set what to do when the firmware accesses memory against the permissions of
+// its region. By default, code can run from RAM and stores to flash fault.
+void machine_set_permission(machine_t *machine, permission_t permission, access_action_t action) {
+	machine->permissions[permission] = action;
+}
+
+// Return the current value of the xPSR register.
+uint32_t machine_read_xpsr(machine_t *machine) {
+	return machine_get_xpsr(machine);
+}
+
+// Flip a single bit in RAM or flash, bypassing the flash controller.
+bool machine_flip_bit(machine_t *machine, uint32_t address, uint32_t bit) {
+	uint8_t *ptr;
+	if (machine_code_offset(machine, address) < machine->image_size) {
+		ptr = &machine->image8[machine_code_offset(machine, address)];
+	} else if (address >= 0x20000000 && address - 0x20000000 < machine->mem_size) {
+		ptr = &machine->mem8[address - 0x20000000];
+	} else {
+		return false;
+	}
+	*ptr ^= 1 << (bit % 8);
+	return true;
+}
+
+// Make a peripheral register either return a fixed value (ignoring writes), or
+// cause a bus error when accessed.
+bool machine_inject_periph_fault(machine_t *machine, uint32_t address, uint32_t value, bool buserror) {
+	if (machine->num_periph_faults >= MACHINE_PERIPH_FAULTS) {
+		return false;
+	}
+	periph_fault_t *fault = &machine->periph_faults[machine->num_periph_faults++];
+	fault->address = address;
+	fault->value = value;
+	fault->buserror = buserror;
+	return true;
+}
+
+// Set the callbacks for peripherals implemented by the host. They must be set
+// before adding such a peripheral.
+void machine_set_external_handlers(machine_t *machine, external_transfer_t transfer, external_poll_t poll) {
+	machine->external_transfer = transfer;
+	machine->external_poll = poll;
+}
+
+// Let the host handle all accesses to the given address range in the
+// peripheral region. It returns the index of the peripheral that is passed to
+// the transfer callback, or -1 if there are too many.
+int machine_add_external_periph(machine_t *machine, uint32_t start, uint32_t size) {
+	if (machine->num_external_periphs >= MACHINE_EXTERNAL_PERIPHS) {
+		return -1;
+	}
+	external_periph_t *periph = &machine->external_periphs[machine->num_external_periphs];
+	periph->start = start;
+	periph->size = size;
+	return machine->num_external_periphs++;
+}
+
+// Request a call to the poll callback from machine_run. This may be called
+// from another thread, like machine_halt.
+void machine_external_notify(machine_t *machine) {
+	__atomic_store_n(&machine->external_pending, true, __ATOMIC_RELEASE);
+}
+
+// Simulate a brownout: the supply voltage drops so far that the chip does a
+// power-on reset, losing the retained registers.
+void machine_brownout(machine_t *machine) {
+	machine_log(machine, LOG_CALLS, "BROWNOUT at %x\n", machine->pc - 1);
+	machine_reset_cause(machine, RESET_POWERON);
+}
+
+// Seed the pseudo-random number generator used by the machine.
+void machine_seed(machine_t *machine, uint32_t seed) {
+	if (seed == 0) {
+		seed = 1; // xorshift gets stuck at zero
+	}
+	machine->random_state = seed;
+}
+
+// Set the probability that a flash erase or write is interrupted by a power
+// cut, leaving the page partially erased or programmed.
+void machine_set_flash_cut(machine_t *machine, double erase, double write) {
+	machine->flash_cut_erase = erase;
+	machine->flash_cut_write = write;
+}
+
+// Return how often the given flash page has been erased.
+uint32_t machine_flash_erase_count(machine_t *machine, size_t page) {
+	if (page >= machine->image_size / machine->pagesize) {
+		return 0;
+	}
+	return machine->flash_erase_counts[page];
+}
+
+// Feed UART0 from the given buffer instead of the terminal. Once the buffer
+// is exhausted, machine_run returns ERR_EOF. The buffer must stay valid while
+// the machine runs. Passing NULL reads from the terminal again.
+void machine_set_uart_input(machine_t *machine, const uint8_t *input, size_t length) {
+	uart_t *uart = &machine->uart[0];
+	uart->input = input;
+	uart->input_len = length;
+	uart->input_pos = 0;
+	machine->input_eof = false;
+}
+
+// Make characters on the UARTs take as long as on a real line, at the baud
+// rate that the firmware configured, and set the baud rate of the host (0 to
+// accept any). Characters are received with framing errors when the firmware
+// uses a different baud rate.
+void machine_set_uart_timing(machine_t *machine, bool timing, uint32_t host_baud) {
+	for (int i = 0; i < MACHINE_NUM_UARTS; i++) {
+		machine->uart[i].timing = timing;
+		machine->uart[i].host_baud = host_baud;
+	}
+}
+
+// Make received characters arrive at least pacing ns apart, like when they are
+// typed or sent by a script, so that the firmware gets an RX interrupt for
+// each of them. 0 disables pacing.
+void machine_set_uart_pacing(machine_t *machine, uint32_t pacing) {
+	for (int i = 0; i < MACHINE_NUM_UARTS; i++) {
+		machine->uart[i].pacing = pacing;
+	}
+}
+
+// Set the depth of the input queue of the UARTs, which holds injected input
+// until the firmware receives it, also while the machine is halted. Queued
+// characters that don't fit in the new depth are dropped.
+void machine_set_uart_queue(machine_t *machine, size_t depth) {
+	for (int n = 0; n < MACHINE_NUM_UARTS; n++) {
+		uart_t *uart = &machine->uart[n];
+		uint8_t *queue = malloc(depth);
+		uint32_t len = uart->inject_len < depth ? uart->inject_len : depth;
+		for (uint32_t i = 0; i < len; i++) {
+			queue[i] = uart->inject[(uart->inject_pos + i) % uart->inject_size];
+		}
+		free(uart->inject);
+		uart->inject = queue;
+		uart->inject_size = depth;
+		uart->inject_pos = 0;
+		uart->inject_len = len;
+	}
+}
+
+// Give the next character that a UART receives the given errors, see
+// UART_ERROR_*. A break is received as a NUL character before any other input.
+// An overrun happens right away.
+void machine_uart_inject_error(machine_t *machine, uint32_t index, uint32_t errors) {
+	if (index >= MACHINE_NUM_UARTS) {
+		return;
+	}
+	uart_t *uart = &machine->uart[index];
+	if ((errors & UART_ERROR_BREAK) && uart->inject_len < uart->inject_size) {
+		uart->inject_pos = (uart->inject_pos + uart->inject_size - 1) % uart->inject_size;
+		uart->inject[uart->inject_pos] = 0;
+		uart->inject_len++;
+		errors |= UART_ERROR_FRAMING;
+	}
+	if (errors & UART_ERROR_OVERRUN) {
+		machine->stats.uart_overruns++;
+		uart->rx_overrun = true;
+		uart->errors |= UART_ERROR_OVERRUN;
+		if (uart->rx_len != 0) {
+			uart->rx_errors[(uart->rx_head + uart->rx_len - 1) % MACHINE_UART_FIFO] |= UART_ERROR_OVERRUN;
+		}
+		errors &= ~UART_ERROR_OVERRUN;
+	}
+	uart->inject_errors |= errors;
+}
+
+// Set the CTS input of a UART of the chip, with which the host lets it send.
+// A character that was held back is sent once CTS is asserted.
+void machine_uart_set_cts(machine_t *machine, uint32_t index, bool cts) {
+	if (index >= MACHINE_NUM_UARTS || cts == machine->uart[index].cts) {
+		return;
+	}
+	uart_t *uart = &machine->uart[index];
+	uart->cts = cts;
+	uart->cts_changed = true;
+	machine_reschedule(machine, EVENT_UART);
+	if (machine->family == FAMILY_NRF && uart->enable != 0) {
+		machine_nrf_event(machine, &uart->periph, nrf_uart_base[uart->index], nrf_uart_irq[uart->index], cts ? 0 : 1); // CTS, NCTS
+	}
+	if (cts && uart->tx_held >= 0) {
+		uint8_t c = uart->tx_held;
+		uart->tx_held = -1;
+		machine_uart_send(machine, uart, c);
+	}
+}
+
+// Add bytes to the input of a UART, as if they were received on the RX line.
+// They are read before any input from the terminal or input buffer. Returns
+// the number of bytes that fit in the input queue.
+size_t machine_uart_inject(machine_t *machine, uint32_t index, const uint8_t *data, size_t length) {
+	if (index >= MACHINE_NUM_UARTS) {
+		return 0;
+	}
+	uart_t *uart = &machine->uart[index];
+	size_t n = 0;
+	while (n < length && uart->inject_len < uart->inject_size) {
+		uint32_t pos = (uart->inject_pos + uart->inject_len) % uart->inject_size;
+		uart->inject[pos] = data[n++];
+		uart->inject_len++;
+	}
+	return n;
+}
+
+// Enable edge coverage collection in a map of the given size (which must be a
+// power of two). Returns the coverage map.
+uint8_t * machine_enable_coverage(machine_t *machine, size_t size) {
+	free(machine->coverage);
+	machine->coverage = calloc(size, 1);
+	machine->coverage_size = size;
+	machine->coverage_prev_location = 0;
+	return machine->coverage;
+}
+
+// Start recording which instructions in flash are executed, in a bitmap with
+// a bit per halfword. Returns the bitmap, which has image_size / 16 bytes.
+uint8_t * machine_enable_executed(machine_t *machine) {
+	if (machine->executed == NULL) {
+		machine->executed = calloc(machine->image_size / 16, 1);
+	}
+	return machine->executed;
+}
+
+// Do a power-on reset after power has been removed: RAM and all retained
+// registers are lost.
+void machine_power_cycle(machine_t *machine) {
+	machine_clear_region(machine->mem, machine->mem_size);
+	for (size_t i = 0; i < machine->num_ext_ram; i++) {
+		machine_clear_region(machine->ext_ram[i].data, machine->ext_ram[i].size);
+	}
+	machine->coverage_prev_location = 0;
+	machine_reset_cause(machine, RESET_POWERON);
+}
 
-			} else {
-				*pc -= 2; // undo 32-bit change
-				return ERR_UNDEFINED;
-			}
+// Set the CPU clock frequency in Hz, used to convert cycles to time.
+void machine_set_clock(machine_t *machine, uint32_t clock) {
+	machine->clock = clock;
+	machine_reschedule_all(machine);
+}
 
-		} else {
-			*pc -= 2; // undo 32-bit change
-			return ERR_UNDEFINED;
-		}
+// Schedule all events again, after the state of peripherals was changed from
+// outside the emulated core, like by restoring it.
+void machine_reschedule_all(machine_t *machine) {
+	machine->events.dirty = (1u << EVENT_NUM) - 1;
+}
 
-	} else {
-		return ERR_UNDEFINED;
+// Select the family of chips to emulate. This must be done before the machine
+// is reset.
+void machine_set_family(machine_t *machine, family_t family) {
+	machine->family = family;
+	switch (family) {
+	case FAMILY_STM32:
+		machine->flash_base = 0x08000000;
+		break;
+	case FAMILY_RP2040:
+		machine->flash_base = 0x10000000;
+		break;
+	default:
+		machine->flash_base = 0;
 	}
+	// The functions of the RP2040 boot ROM are stubs. Stubs that the host adds
+	// later in this range replace them.
+	bool rom = false;
+	for (uint32_t i = 0; i < machine->stubs.num_ranges; i++) {
+		rom = rom || machine->stubs.handler[i] == machine_rp2040_rom_call;
+	}
+	if (family == FAMILY_RP2040 && !rom) {
+		machine_add_stub_handler(machine, 0, 0x4000, machine_rp2040_rom_call);
+	}
+}
 
-	return ERR_OK;
+// Set the factory information of the chip: the unique ID, the Bluetooth device
+// address (least significant byte first) and the die temperature in 0.01 °C.
+// This must be done before the machine is reset.
+void machine_set_device_info(machine_t *machine, const uint8_t id[12], const uint8_t addr[6], int32_t temperature) {
+	memcpy(machine->device.id, id, sizeof(machine->device.id));
+	memcpy(machine->device.addr, addr, sizeof(machine->device.addr));
+	machine->device.temperature = temperature;
 }
 
-void machine_print_registers(machine_t *machine) {
-	machine_log(machine, LOG_ERROR, "\n[ ");
-	for (size_t i=0; i<8; i++) {
-		machine_log(machine, LOG_ERROR, "%8x ", machine->regs[i]);
+// Attach an external SPI flash of the given size to the QSPI peripheral of an
+// nRF52840, with the given initial contents. The rest of it is erased.
+void machine_set_qspi_flash(machine_t *machine, const uint8_t *data, size_t length, size_t size) {
+	if (length > size) {
+		length = size;
 	}
-	machine_log(machine, LOG_ERROR, ".. %8x ", machine->sp);     // sp
-	machine_log(machine, LOG_ERROR, "%8x ",    machine->lr - 1); // lr, not entirely correct
-	machine_log(machine, LOG_ERROR, "%8x ",    machine->pc - 1); // pc, not entirely correct
-	machine_log(machine, LOG_ERROR, "%c%c%c%c ", machine->psr.n ? 'N' : '_', machine->psr.z ? 'Z' : '_', machine->psr.c ? 'C' : '_', machine->psr.v ? 'V' : '_');
-	machine_log(machine, LOG_ERROR, "]\n");
+	free(machine->qspi_flash.data);
+	machine->qspi_flash.data = malloc(size);
+	machine->qspi_flash.size = size;
+	memcpy(machine->qspi_flash.data, data, length);
+	memset(machine->qspi_flash.data + length, 0xff, size - length);
 }
 
-KEEPALIVE
-machine_t * machine_create(size_t image_size, size_t pagesize, size_t ram_size, int loglevel) {
-	if (image_size < 16 * 4) {
-#if !defined(__EMSCRIPTEN__)
-		if (loglevel >= LOG_ERROR) {
-			fprintf(stderr, "\nERROR: image is too small to contain an executable\n");
+// Add a region of external RAM, which must lie in the external RAM area at
+// 0x60000000..0x9fffffff and is zero at power-on. It returns the index of the
+// region, or -1 if it can't be added.
+int machine_add_ram(machine_t *machine, uint32_t start, size_t size) {
+	if (machine->num_ext_ram >= MACHINE_EXT_RAMS || start < 0x60000000 || size == 0 || size > 0xa0000000 - start) {
+		return -1;
+	}
+	for (size_t i = 0; i < machine->num_ext_ram; i++) {
+		if (start < machine->ext_ram[i].start + machine->ext_ram[i].size && machine->ext_ram[i].start < start + size) {
+			return -1; // overlaps
 		}
-#endif
-		return NULL;
 	}
+	uint8_t *data = machine_alloc_region(size);
+	if (data == NULL) {
+		return -1;
+	}
+	machine->ext_ram[machine->num_ext_ram].start = start;
+	machine->ext_ram[machine->num_ext_ram].size = size;
+	machine->ext_ram[machine->num_ext_ram].data = data;
+	return machine->num_ext_ram++;
+}
 
-	machine_t *machine = calloc(sizeof(machine_t), 1);
-	machine->pagesize = pagesize;
-	machine->call_depth = 1;
-	machine->loglevel = loglevel;
-	machine->image_size = image_size;
-	machine->mem_size = ram_size;
-	machine->psr.t = 1; // Thumb mode
-
-	uint32_t *image = malloc(image_size);
-	memset(image, 0xff, image_size); // erase flash
-	machine->image32 = image;
+// Insert an SD card with the given number of 512-byte blocks into the SPI
+// bus. Blocks are read and written with io. The chip select pin is
+// port * 32 + pin (PA4 is 4 on the STM32), or -1 if the card is always
+// selected.
+void machine_set_sdcard(machine_t *machine, sdcard_io_t io, uint32_t blocks, int32_t cs) {
+	machine->sdcard.io = io;
+	machine->sdcard.blocks = blocks;
+	machine->sdcard.cs = cs;
+}
 
-	// TODO: put random data in here to make a better simulation
-	uint32_t *ram = calloc(ram_size, 1);
-	machine->mem32 = ram;
+// Attach I2C and SPI devices implemented by the host. All I2C controllers
+// forward their bus operations to io, SPI controllers only do so for devices
+// added with machine_add_spi_device.
+void machine_set_bus_handler(machine_t *machine, bus_io_t io) {
+	machine->bus.io = io;
+}
 
-	return machine;
+// Report all I2C and SPI bus operations and UART characters to trace, to log
+// the traffic. SPI transactions are only delimited for the chip select pins
+// of devices added with machine_add_spi_device, which may be added for
+// tracing only, without a bus handler.
+void machine_set_bus_trace(machine_t *machine, bus_trace_t trace) {
+	machine->bus.trace = trace;
 }
 
-void machine_load(machine_t *machine, uint8_t *image, size_t image_size) {
-	// caller should check this, but at least fail in a reasonable way
-	if (image_size > machine->image_size) {
-		image_size = machine->image_size;
+// Add an SPI device of the host with the given chip select pin (port * 32 +
+// pin). Returns the index of the device that is passed to the bus handler, or
+// -1 if there are too many devices.
+int machine_add_spi_device(machine_t *machine, int32_t cs) {
+	if (machine->bus.spi_devices >= MACHINE_SPI_DEVICES) {
+		return -1;
 	}
-	memcpy(machine->image8, image, image_size);
+	machine->bus.spi_cs[machine->bus.spi_devices] = cs;
+	return machine->bus.spi_devices++;
 }
 
-KEEPALIVE
-uint8_t * machine_get_image(machine_t *machine) {
-	return machine->image8;
+// Return the output level of a GPIO pin (port * 32 + pin), 0 or 1, or -1 if
+// the pin isn't configured as an output. It is for displays of the pin state
+// on the host, like LEDs.
+int machine_gpio_level(machine_t *machine, uint32_t pin) {
+	if (!machine_gpio_is_output(machine, pin)) {
+		return -1;
+	}
+	return machine_gpio_output(machine, pin);
 }
 
-void machine_free(machine_t *machine) {
-	free(machine->image);
-	machine->image = NULL;
-	free(machine->mem);
-	machine->mem = NULL;
-	free(machine);
+// Drive a GPIO pin (port * 32 + pin) from the host, like a button or another
+// chip would: high when level is 1, low when it is 0. A negative level
+// releases the pin so that it floats again. Edges generate interrupts and
+// events like they would on the real chip.
+void machine_set_gpio_input(machine_t *machine, uint32_t pin, int level) {
+	uint32_t port = pin / 32, bit = 1u << (pin % 32);
+	if (port >= MACHINE_GPIO_PORTS) {
+		return;
+	}
+	if (!machine->gpio_input.used) {
+		machine->gpio_input.used = true;
+		machine_gpio_inputs_sync(machine);
+	}
+	machine->gpio_input.driven[port] &= ~bit;
+	machine->gpio_input.high[port] &= ~bit;
+	if (level >= 0) {
+		machine->gpio_input.driven[port] |= bit;
+		machine->gpio_input.high[port] |= level ? bit : 0;
+	}
+	machine_gpio_inputs_update(machine);
+	machine_probe_update(machine);
 }
 
-KEEPALIVE
-int machine_run(machine_t *machine) {
-	while (1) {
-		if (machine->halt) {
-			machine->halt = false;
-			return ERR_HALT;
+// Connect two GPIO pins (port * 32 + pin) with each other, like a pressed key
+// of a keypad does, or disconnect them again. An input pin that is connected
+// to an output reads the level of that output. Returns -1 if there are too
+// many connections.
+int machine_connect_gpio(machine_t *machine, uint32_t a, uint32_t b, bool connected) {
+	for (uint32_t i = 0; i < machine->gpio_input.num_links; i++) {
+		uint16_t *link = machine->gpio_input.links[i];
+		if ((link[0] == a && link[1] == b) || (link[0] == b && link[1] == a)) {
+			if (!connected) {
+				machine->gpio_input.num_links--;
+				memcpy(link, machine->gpio_input.links[machine->gpio_input.num_links], sizeof(machine->gpio_input.links[0]));
+				machine_gpio_inputs_update(machine);
+				machine_probe_update(machine);
+			}
+			return 0;
 		}
+	}
+	if (!connected) {
+		return 0;
+	}
+	if (machine->gpio_input.num_links >= MACHINE_GPIO_LINKS) {
+		return -1;
+	}
+	if (!machine->gpio_input.used) {
+		machine->gpio_input.used = true;
+		machine_gpio_inputs_sync(machine);
+	}
+	machine->gpio_input.links[machine->gpio_input.num_links][0] = a;
+	machine->gpio_input.links[machine->gpio_input.num_links][1] = b;
+	machine->gpio_input.num_links++;
+	machine_gpio_inputs_update(machine);
+	machine_probe_update(machine);
+	return 0;
+}
 
-		// Print registers
-		if (machine_loglevel(machine) >= LOG_INSTRS || (machine_loglevel(machine) >= LOG_CALLS_SP && machine->sp != machine->last_sp)) {
-			machine->last_sp = machine->sp;
-			machine_print_registers(machine);
+// Decode the waveform on the given GPIO pin (port * 32 + pin) as the data line
+// of WS2812 LEDs, calling frame with the data of each frame. The pin can be
+// driven by the firmware directly or by a PWM peripheral of an nRF52.
+void machine_set_ws2812(machine_t *machine, ws2812_frame_t frame, int32_t pin) {
+	machine->ws2812.frame = frame;
+	machine->ws2812.pin = pin;
+	machine->ws2812.level = false;
+	machine->ws2812.bits = 0;
+}
+
+// Probe the given GPIO pins (port * 32 + pin), calling changed whenever the
+// level of one of them changes, like a logic analyzer. Their current levels
+// are in probe.levels afterwards. Returns false if there are too many pins.
+bool machine_set_probes(machine_t *machine, probe_changed_t changed, const uint32_t *pins, size_t count) {
+	if (count > MACHINE_PROBES) {
+		return false;
+	}
+	for (size_t i = 0; i < count; i++) {
+		machine->probe.pins[i] = pins[i];
+	}
+	machine->probe.count = count;
+	machine->probe.changed = changed;
+	machine->probe.levels = machine_probe_levels(machine);
+	return true;
+}
+
+// Exchange the samples of the I2S and PDM peripherals of an nRF52 with the
+// host, see audio_io_t.
+void machine_set_audio(machine_t *machine, audio_io_t io) {
+	machine->audio.io = io;
+}
+
+// Take the voltages on the analog inputs of the nRF52 SAADC from the host,
+// see analog_input_t.
+void machine_set_analog(machine_t *machine, analog_input_t input) {
+	machine->analog.input = input;
+}
+
+// Send the CAN frames of the firmware to the host. Without a callback, frames
+// are acknowledged but go nowhere.
+void machine_set_can(machine_t *machine, can_send_t send) {
+	machine->can.send = send;
+}
+
+// Pass the packets the radio of an nRF sends to the host.
+void machine_set_radio(machine_t *machine, radio_send_t send) {
+	machine->radio.send = send;
+}
+
+// Send a packet on the air like the radio does: count and log it, and pass it
+// to the host. This is for stubs that use the radio themselves, like the
+// advertising of a SoftDevice. The arguments are those of radio_send_t.
+void machine_radio_send(machine_t *machine, const uint8_t *packet, uint32_t length, uint32_t frequency, uint32_t mode, uint64_t address) {
+	machine->stats.radio_tx_packets++;
+	if (machine->loglevel >= LOG_CALLS) {
+		char hex[2 * (3 + 255 + 255) + 1];
+		uint32_t n = length < 3 + 255 + 255 ? length : 3 + 255 + 255;
+		for (uint32_t i = 0; i < n; i++) {
+			snprintf(hex + 2 * i, 3, "%02x", packet[i]);
 		}
+		hex[2 * n] = 0;
+		machine_log(machine, LOG_CALLS, "radio: TX at %u MHz: %s\n", ((frequency >> 8) & 1 ? 2360 : 2400) + (frequency & 0x7f), hex);
+	}
+	if (machine->radio.send != NULL) {
+		machine->radio.send(machine, packet, length, frequency, mode, address);
+	}
+}
 
-		// Execute a single instruction
-		int err = machine_step(machine);
-		switch (err) {
-			case ERR_OK:
-				break; // no error
-			case ERR_HALT:
-				// expected
-				break;
-			case ERR_EXIT:
-				return 0;
-			case ERR_BREAK:
-				machine_log(machine, LOG_ERROR, "\nhit breakpoint at address %x\n", machine->pc - 3);
-				break;
-			case ERR_MEM:
-				// already printed
-				break;
-			case ERR_PC:
-				machine_log(machine, LOG_ERROR, "\nERROR: invalid PC address: 0x%08x\n", machine->pc);
-				break;
-			case ERR_UNDEFINED:
-				machine_log(machine, LOG_ERROR, "\nERROR: unknown instruction %04x at address %x\n", machine->image16[machine->pc/2 - 1], machine->pc - 3);
-				break;
-			default:
-				machine_log(machine, LOG_ERROR, "\nERROR: unknown error: %d\n", err);
-				break;
+// Deliver a packet from another radio, which is received if the radio is
+// receiving on the same frequency and mode and one of the addresses enabled
+// in RXADDRESSES matches. Like a sent packet, it starts with the S0, LENGTH
+// and S1 fields, and the END event happens once it would have been received
+// completely. It returns whether the packet was received.
+bool machine_radio_receive(machine_t *machine, const uint8_t *packet, uint32_t length, uint32_t frequency, uint32_t mode, uint64_t address) {
+	uint32_t *regs = machine->nrf.radio.regs;
+	if (machine->family != FAMILY_NRF || machine->nrf.radio.state != RADIO_RX || machine->nrf.radio.pending) {
+		return false;
+	}
+	if ((regs[(0x508 - 0x500) / 4] & 0x17f) != frequency || (regs[(0x510 - 0x500) / 4] & 0xf) != mode) {
+		return false;
+	}
+	uint32_t rxaddresses = regs[(0x530 - 0x500) / 4];
+	for (uint32_t logical = 0; logical < 8; logical++) {
+		if (!(rxaddresses & (1 << logical)) || machine_radio_address(machine, logical) != address) {
+			continue;
 		}
-		if (err != 0) {
-			if (machine_loglevel(machine) < LOG_INSTRS) { // don't double-log
-				machine_print_registers(machine);
-			}
-			machine_add_backtrace(machine, machine->pc, machine->sp);
-			machine_log(machine, LOG_ERROR, "Backtrace:\n");
-			for (int i = 1; i < machine->call_depth; i++) {
-				if (i >= MACHINE_BACKTRACE_LEN) {
-					machine_log(machine, LOG_ERROR, " %3d. (too much recursion)\n", i);
-					break;
-				}
-				machine_log(machine, LOG_ERROR, " %3d. %8x (SP: %x)\n", i, machine->backtrace[i].pc, machine->backtrace[i].sp);
-			}
-			return err;
+		uint32_t maxlen = 3 + (regs[(0x518 - 0x500) / 4] & 0xff); // header and PCNF1.MAXLEN
+		if (length > maxlen) {
+			length = maxlen;
 		}
+		machine_dma_write(machine, regs[(0x504 - 0x500) / 4], packet, length); // PACKETPTR
+		machine->nrf.radio.rxmatch = logical;
+		machine_radio_event(machine, RADIO_EVENT_ADDRESS);
+		machine_radio_schedule(machine, RADIO_EVENT_END, machine_radio_airtime(machine, length));
+		return true;
 	}
+	return false;
 }
 
-void machine_readmem(machine_t *machine, void *buf, size_t address, size_t length) {
-	if (address % 4 == 0 && length % 4 == 0) {
-		for (size_t i=0; i<length; i += 4) {
-			uint32_t reg;
-			machine_transfer(machine, address + i, LOAD, &reg, WIDTH_32, false);
-			((uint32_t*)buf)[i / 4] = reg;
-		}
-	} else {
-		for (size_t i=0; i<length; i++) {
-			uint32_t reg;
-			machine_transfer(machine, address + i, LOAD, &reg, WIDTH_8, false);
-			((uint8_t*)buf)[i] = reg;
+// Return whether the radio is waiting for a packet, and if so the frequency,
+// mode and address (of the first enabled logical address) that a packet must
+// have to be received with machine_radio_receive.
+bool machine_radio_listening(machine_t *machine, uint32_t *frequency, uint32_t *mode, uint64_t *address) {
+	uint32_t *regs = machine->nrf.radio.regs;
+	if (machine->family != FAMILY_NRF || machine->nrf.radio.state != RADIO_RX || machine->nrf.radio.pending) {
+		return false;
+	}
+	uint32_t rxaddresses = regs[(0x530 - 0x500) / 4] & 0xff;
+	if (rxaddresses == 0) {
+		return false;
+	}
+	*frequency = regs[(0x508 - 0x500) / 4] & 0x17f;
+	*mode = regs[(0x510 - 0x500) / 4] & 0xf;
+	*address = machine_radio_address(machine, __builtin_ctz(rxaddresses));
+	return true;
+}
+
+// Send the output of a UART to the host instead of the terminal. The terminal
+// isn't read either: input only comes from machine_uart_inject, or from the
+// receive callback.
+void machine_set_uart_output(machine_t *machine, uint32_t index, uart_output_t output) {
+	if (index < MACHINE_NUM_UARTS) {
+		machine->uart[index].output = output;
+	}
+}
+
+// Receive the input of a UART from the host instead of the terminal, after
+// the input from machine_uart_inject. Output then only goes to the output
+// callback, if any.
+void machine_set_uart_receive(machine_t *machine, uint32_t index, uart_receive_t receive) {
+	if (index < MACHINE_NUM_UARTS) {
+		machine->uart[index].receive = receive;
+	}
+}
+
+// Report every access of the CPU to a peripheral register (0x40000000 ..
+// 0x5fffffff and the RP2040 SIO) to the host, or stop doing so with NULL.
+void machine_set_periph_trace(machine_t *machine, periph_trace_t trace) {
+	machine->periph_trace = trace;
+}
+
+// Allocate a ring buffer of size trace events (a power of two). Callbacks like
+// machine_trace_ring_periph then record events in it, which the host reads in
+// batches. When the ring is full, flush is called to make room.
+bool machine_enable_trace_ring(machine_t *machine, uint32_t size, trace_flush_t flush) {
+	if (size == 0 || (size & (size - 1)) != 0 || machine->trace_ring.events != NULL) {
+		return false;
+	}
+	machine->trace_ring.events = calloc(size, sizeof(trace_event_t));
+	if (machine->trace_ring.events == NULL) {
+		return false;
+	}
+	machine->trace_ring.size = size;
+	machine->trace_ring.flush = flush;
+	return true;
+}
+
+// Add an event to the trace ring.
+static void machine_trace_event(machine_t *machine, trace_event_type_t type, uint32_t pc, uint32_t address, uint32_t value, uint64_t data) {
+	uint64_t head = machine->trace_ring.head;
+	if (head - __atomic_load_n(&machine->trace_ring.tail, __ATOMIC_ACQUIRE) >= machine->trace_ring.size) {
+		machine->trace_ring.flush(machine);
+	}
+	trace_event_t *event = &machine->trace_ring.events[head & (machine->trace_ring.size - 1)];
+	event->cycle = machine->stats.cycles;
+	event->type = type;
+	event->pc = pc;
+	event->address = address;
+	event->value = value;
+	event->data = data;
+	__atomic_store_n(&machine->trace_ring.head, head + 1, __ATOMIC_RELEASE);
+}
+
+// A periph_trace_t that records the accesses in the trace ring, for use with
+// machine_set_periph_trace.
+void machine_trace_ring_periph(machine_t *machine, uint32_t address, bool store, uint32_t value, uint32_t pc) {
+	machine_trace_event(machine, store ? TRACE_PERIPH_STORE : TRACE_PERIPH_LOAD, pc, address, value, 0);
+}
+
+// A bus_trace_t that records the bus operations in the trace ring, for use
+// with machine_set_bus_trace. The time is recorded as the host clock may be
+// used for it.
+void machine_trace_ring_bus(machine_t *machine, bus_op_t op, uint32_t device, uint8_t out, uint8_t in, bool ack) {
+	uint32_t value = (uint32_t)op | (uint32_t)out << 8 | (uint32_t)in << 16 | (uint32_t)ack << 24;
+	machine_trace_event(machine, TRACE_BUS, machine->instruction_pc, device, value, machine_time_us(machine));
+}
+
+// A watch_t that records the new value of each range that was stored to in the
+// trace ring, for use with machine_set_watches. Ranges are at most 8 bytes.
+void machine_trace_ring_watch(machine_t *machine, uint32_t watches, uint32_t pc) {
+	for (size_t i = 0; i < machine->watch.count; i++) {
+		if ((watches & (1u << i)) == 0) {
+			continue;
 		}
+		uint32_t buf[2] = {0};
+		uint32_t size = machine->watch.size[i] < sizeof(buf) ? machine->watch.size[i] : sizeof(buf);
+		machine_readmem(machine, buf, machine->watch.address[i], size);
+		machine_trace_event(machine, TRACE_WATCH, pc, machine->watch.address[i], size, buf[0] | (uint64_t)buf[1] << 32);
 	}
 }
 
-void machine_readregs(machine_t *machine, uint32_t *regs, size_t num) {
-	if (num < sizeof(machine->regs) / sizeof(machine->regs[0])) {
-		num = sizeof(machine->regs) / sizeof(machine->regs[0]);
+// An exception_trace_t that records exception entries and returns in the trace
+// ring, for use with machine_set_exception_trace. The word at the address of
+// machine_set_trace_sample is recorded with them, as the host reads the events
+// later.
+void machine_trace_ring_exception(machine_t *machine, uint32_t exception, bool enter) {
+	uint32_t word = 0;
+	if (machine->trace_ring.sample != 0) {
+		machine_readmem(machine, &word, machine->trace_ring.sample, 4);
 	}
-	for (size_t i=0; i<num; i++) {
-		regs[i] = machine->regs[i];
+	machine_trace_event(machine, enter ? TRACE_EXCEPTION_ENTER : TRACE_EXCEPTION_RETURN, machine->instruction_pc, 0, exception, word);
+}
+
+// Record the word at this address with exception events in the trace ring,
+// like the pointer to the running task of an RTOS. 0 records nothing.
+void machine_set_trace_sample(machine_t *machine, uint32_t address) {
+	machine->trace_ring.sample = address;
+}
+
+// Report every exception entry and return to the host, or stop doing so with
+// NULL. A return is reported once the state of the interrupted code has been
+// restored.
+void machine_set_exception_trace(machine_t *machine, exception_trace_t trace) {
+	machine->exception_trace = trace;
+}
+
+// Let the host implement functions of a ROM and supervisor calls, or stop
+// doing so with NULL. Calls to addresses in the ranges of
+// machine_add_stub_range and SVC instructions with a number set with
+// machine_set_svc_stub go to the callback instead of running code. Other SVC
+// instructions take the SVCall exception.
+void machine_set_stub_handler(machine_t *machine, stub_call_t call) {
+	machine->stubs.call = call;
+}
+
+// Add an address range (start..end) in which code is implemented by the stubs
+// of the given handler, or of the host (machine_set_stub_handler) if it is
+// NULL. It returns false if there are too many ranges.
+static bool machine_add_stub_handler(machine_t *machine, uint32_t start, uint32_t end, stub_call_t handler) {
+	if (machine->stubs.num_ranges >= MACHINE_STUB_RANGES) {
+		return false;
 	}
+	machine->stubs.start[machine->stubs.num_ranges] = start;
+	machine->stubs.end[machine->stubs.num_ranges] = end;
+	machine->stubs.handler[machine->stubs.num_ranges] = handler;
+	machine->stubs.num_ranges++;
+	return true;
 }
 
-KEEPALIVE
-uint32_t machine_readreg(machine_t *machine, size_t reg) {
-	if (reg >= sizeof(machine->regs) / sizeof(machine->regs[0])) {
-		return 0;
+// Add an address range (start..end) in which code is implemented by stubs of
+// the host. It returns false if there are too many ranges.
+bool machine_add_stub_range(machine_t *machine, uint32_t start, uint32_t end) {
+	return machine_add_stub_handler(machine, start, end, NULL);
+}
+
+// Set whether an SVC number is implemented by a stub.
+void machine_set_svc_stub(machine_t *machine, uint32_t number, bool stub) {
+	if (number >= 256) {
+		return;
+	}
+	if (stub) {
+		machine->stubs.svc[number / 32] |= 1u << (number % 32);
+	} else {
+		machine->stubs.svc[number / 32] &= ~(1u << (number % 32));
 	}
-	return machine->regs[reg];
 }
 
-void machine_halt(machine_t *machine) {
-	machine->halt = true;
+// Call fire once the machine reaches the given cycle, replacing the timer that
+// was set before. A NULL fire stops the timer. Like the events of peripherals,
+// the callback runs before the first instruction at or after that cycle, also
+// when the core is asleep.
+void machine_set_host_timer(machine_t *machine, host_timer_t fire, uint64_t cycle) {
+	machine->host_timer.fire = fire;
+	machine->host_timer.cycle = cycle;
+	machine_reschedule(machine, EVENT_HOST);
+}
+
+// Start from the vector table at this offset in flash after a reset instead of
+// the one at the start of flash, and point VTOR at it. This is for firmware
+// that a boot loader would start, like an application after the MBR and
+// SoftDevice of an nRF chip.
+void machine_set_boot_vectors(machine_t *machine, uint32_t offset) {
+	machine->boot_vectors = offset;
+}
+
+// Put the core to sleep like WFE does, for stubs that wait for an event like
+// sd_app_evt_wait. The core continues after the call once it wakes up.
+void machine_wait_for_event(machine_t *machine) {
+	machine_sleep(machine, true);
 }
 
-bool machine_break(machine_t *machine, size_t num, uint32_t addr) {
-	if (num >= sizeof(machine->hwbreak) / sizeof(machine->hwbreak[0])) {
+// Watch the given memory ranges: after an instruction stores to one of them,
+// changed is called so the host can check whether the value changed. This
+// replaces the previously watched ranges. It returns false if there are too
+// many.
+bool machine_set_watches(machine_t *machine, watch_t changed, const uint32_t *address, const uint32_t *size, size_t count) {
+	if (count > MACHINE_WATCHES) {
 		return false;
 	}
-	machine->hwbreak[num] = addr;
+	machine->watch.changed = changed;
+	for (size_t i = 0; i < count; i++) {
+		machine->watch.address[i] = address[i];
+		machine->watch.size[i] = size[i];
+	}
+	machine->watch.count = count;
+	machine->watch.hit = 0;
 	return true;
 }
+
+// Deliver a CAN frame from the bus to the CAN controller. It returns whether
+// the frame passed the filters and was stored. Only bxCAN of the STM32 is
+// supported.
+bool machine_can_receive(machine_t *machine, const can_frame_t *frame) {
+	if (machine->family != FAMILY_STM32) {
+		return false;
+	}
+	return machine_stm32_can_receive(machine, frame);
+}
+
+// Return the time since the machine was created in microseconds, like the
+// timers of the emulated chip see it.
+uint64_t machine_time_us(machine_t *machine) {
+	return machine_ticks(machine, 1000000);
+}
+
+// Let the machine skip idle time while it follows the host clock, see
+// machine_fast_forward. In deterministic mode this is always done, as it
+// doesn't change what the firmware sees.
+void machine_set_fast_forward(machine_t *machine, bool enabled) {
+	machine->fast_forward = enabled;
+}
+
+// In deterministic mode, all time sources are derived from the cycle counter
+// instead of the host clock so that runs are reproducible.
+void machine_set_deterministic(machine_t *machine, bool deterministic) {
+	machine->deterministic = deterministic;
+}
+
+// Let the debugger mask all interrupts and exceptions that could become
+// pending, like the C_MASKINTS bit of DHCSR. They stay pending and are taken
+// once the mask is removed. Sleep still ends when they become pending.
+void machine_set_debug_mask(machine_t *machine, bool mask) {
+	machine->debug_mask = mask;
+}
+
+// Keep the host clock running while the machine isn't running, like the
+// timers of a real chip do while it is halted by a debugger. By default time
+// stands still, so that breakpoints don't make every timeout expire.
+void machine_set_time_while_halted(machine_t *machine, bool enabled) {
+	machine->time_while_halted = enabled;
+	if (enabled) {
+		machine_time_resume(machine);
+	}
+}
+
+#if !defined(__EMSCRIPTEN__)
+// Disassemble the instruction at the given address into buf. Returns the size
+// of the instruction in bytes.
+int machine_disasm(machine_t *machine, uint32_t address, char *buf, size_t len) {
+	uint16_t hw[2];
+	machine_readmem(machine, hw, address & ~1, 4);
+	return disasm_thumb(address & ~1, hw[0], hw[1], buf, len);
+}
+
+// Return a newly allocated copy of the string (strdup is not part of C11).
+static char * machine_strdup(const char *s) {
+	size_t len = strlen(s) + 1;
+	char *copy = malloc(len);
+	memcpy(copy, s, len);
+	return copy;
+}
+
+// Remove all symbols and line information, for example before loading a new
+// firmware image.
+void machine_clear_debug_info(machine_t *machine) {
+	for (size_t i=0; i<machine->num_symbols; i++) {
+		free(machine->symbols[i].name);
+	}
+	free(machine->symbols);
+	machine->symbols = NULL;
+	machine->num_symbols = 0;
+	machine->symbols_filtered = false;
+	for (size_t i=0; i<machine->num_source_files; i++) {
+		free(machine->source_files[i]);
+	}
+	free(machine->source_files);
+	machine->source_files = NULL;
+	machine->num_source_files = 0;
+	free(machine->lines);
+	machine->lines = NULL;
+	machine->num_lines = 0;
+	machine->lines_capacity = 0;
+	free(machine->stack_guard.frames);
+	machine->stack_guard.frames = NULL;
+	machine->stack_guard.num_frames = 0;
+	machine->stack_guard.count = 0;
+}
+
+// Add a symbol that is used to make call logs readable. When log is false for
+// any symbol, only calls to symbols with log set are logged.
+void machine_add_symbol(machine_t *machine, uint32_t address, uint32_t size, const char *name, bool log) {
+	machine->symbols = realloc(machine->symbols, (machine->num_symbols + 1) * sizeof(symbol_t));
+	// Keep the symbol table sorted by address.
+	size_t i = machine->num_symbols;
+	while (i > 0 && machine->symbols[i - 1].address > address) {
+		i--;
+	}
+	memmove(&machine->symbols[i + 1], &machine->symbols[i], (machine->num_symbols - i) * sizeof(symbol_t));
+	machine->num_symbols++;
+	symbol_t *symbol = &machine->symbols[i];
+	symbol->address = address;
+	symbol->size = size;
+	symbol->name = machine_strdup(name);
+	symbol->log = log;
+	if (!log) {
+		machine->symbols_filtered = true;
+	}
+}
+
+// Add a source file name for the line table. Returns its index.
+uint32_t machine_add_source_file(machine_t *machine, const char *name) {
+	machine->source_files = realloc(machine->source_files, (machine->num_source_files + 1) * sizeof(char*));
+	machine->source_files[machine->num_source_files] = machine_strdup(name);
+	return machine->num_source_files++;
+}
+
+// Add the registers that the function at the given address saves in its
+// prologue, for machine_enable_stack_guard. The prologue ends at prologue_end,
+// and the saved registers are at saved_offset bytes below the SP at the call,
+// with the return address at lr_offset bytes below it (0 if it isn't saved).
+void machine_add_stack_frame(machine_t *machine, uint32_t address, uint32_t prologue_end, uint32_t saved_offset, uint32_t saved_size, uint32_t lr_offset) {
+	machine->stack_guard.frames = realloc(machine->stack_guard.frames, (machine->stack_guard.num_frames + 1) * sizeof(stack_frame_t));
+	// Keep the frames sorted by address.
+	size_t i = machine->stack_guard.num_frames;
+	while (i > 0 && machine->stack_guard.frames[i - 1].address > address) {
+		i--;
+	}
+	memmove(&machine->stack_guard.frames[i + 1], &machine->stack_guard.frames[i], (machine->stack_guard.num_frames - i) * sizeof(stack_frame_t));
+	machine->stack_guard.num_frames++;
+	stack_frame_t *frame = &machine->stack_guard.frames[i];
+	frame->address = address;
+	frame->prologue_end = prologue_end;
+	frame->saved_offset = saved_offset;
+	frame->saved_size = saved_size;
+	frame->lr_offset = lr_offset;
+}
+
+// Add a row to the line table. A line of 0 marks the end of a sequence of
+// instructions. Rows should be added in order of address.
+void machine_add_line(machine_t *machine, uint32_t address, uint32_t file, uint32_t line) {
+	// Grow the line table geometrically, as firmware has many thousands of
+	// rows.
+	if (machine->num_lines == machine->lines_capacity) {
+		machine->lines_capacity = machine->lines_capacity ? machine->lines_capacity * 2 : 256;
+		machine->lines = realloc(machine->lines, machine->lines_capacity * sizeof(line_t));
+	}
+	// Keep the line table sorted by address, in case rows are out of order.
+	// Rows at the same address stay in the order in which they were added.
+	size_t low = 0;
+	size_t high = machine->num_lines;
+	while (low < high) {
+		size_t mid = (low + high) / 2;
+		if (machine->lines[mid].address <= address) {
+			low = mid + 1;
+		} else {
+			high = mid;
+		}
+	}
+	memmove(&machine->lines[low + 1], &machine->lines[low], (machine->num_lines - low) * sizeof(line_t));
+	machine->num_lines++;
+	machine->lines[low].address = address;
+	machine->lines[low].file = file;
+	machine->lines[low].line = line;
+}
+#endif
@@ -1,19 +1,98 @@
 package main
 
 import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"unsafe"
 )
 
+// #cgo LDFLAGS: -lm
 // #include "machine.h"
 import "C"
 
+// A Machine is used from several goroutines: the run loop executes it, while
+// GDB, the control socket and the console inspect and change it. The run loop
+// holds lock whenever it uses the C machine, and only releases it while the
+// machine is halted. Other goroutines use the machine through Pause, which
+// halts it at the next instruction boundary and takes the lock.
 type Machine struct {
 	machine *C.machine_t
-	halted  bool
+	lock    sync.Mutex // held by whoever uses the C machine
 	runChan chan struct{}
+	debug   *debugInfo
+	stop    *StopError // why the machine last stopped
+
+	stateLock   sync.Mutex    // protects the fields below
+	halted      bool          // whether the run loop waits to be continued
+	stopped     chan struct{} // closed when the machine halts
+	resumedFrom *StopError    // the stop reason when it was last continued
+
+	breakpoints *breakpointManager
+	watches     *watchManager // values printed when they change
+	trace       traceState    // GDB tracepoints and collected trace frames
+	inputs      *inputManager // buttons, keypads and encoders, if any
+	timeline    *timeline     // the steps of -script, if any
+	checkpoints *checkpointer // saves the machine state, see -checkpoint-interval
+	maskISR     string        // when interrupts are masked, see SetMaskISR
+	panics      bool          // whether fatal error handlers stop the machine
+
+	// What the GDB kill packet does ("exit" or "reset") and what happens to
+	// the machine when GDB detaches ("resume" or "halt"). See -gdb-kill and
+	// -gdb-detach.
+	gdbKill   string
+	gdbDetach string
+
+	// Semihosting state.
+	console       io.Writer // where semihosting console output goes
+	consoleInput  io.Reader // where semihosting console input comes from
+	hostFiles     map[uint32]*os.File
+	semihostErrno int
+
+	// File-I/O calls that should be forwarded to GDB, while continuing is
+	// set.
+	fileIO     chan *fileIOCall
+	continuing int32
+
+	// State needed to restart the program from GDB in extended-remote mode.
+	firmware  string // path of the firmware image
+	logFilter *regexp.Regexp
+	cmdline   string // command line set with vRun, for SYS_GET_CMDLINE
+	extended  int32  // whether GDB is in extended-remote mode
+	exited    bool   // whether the program has exited
+	exitCode  int
+}
+
+func NewMachine(machine *C.machine_t, runChan chan struct{}, debug *debugInfo) *Machine {
+	m := &Machine{
+		machine:      machine,
+		runChan:      runChan,
+		debug:        debug,
+		stopped:      make(chan struct{}),
+		console:      os.Stdout,
+		consoleInput: terminalReader{machine},
+		hostFiles:    make(map[uint32]*os.File),
+		fileIO:       make(chan *fileIOCall),
+		maskISR:      "off",
+		gdbKill:      "reset",
+		gdbDetach:    "resume",
+	}
+	m.trace.selected = -1
+	m.breakpoints = newBreakpointManager(machine, func(address uint32) string {
+		return m.debug.describe(address)
+	})
+	m.watches = newWatchManager(m)
+	return m
 }
 
 func (m *Machine) Halted() bool {
+	m.stateLock.Lock()
+	defer m.stateLock.Unlock()
 	return m.halted
 }
 
@@ -21,52 +100,395 @@ func (m *Machine) Running() bool {
 	return !m.Halted()
 }
 
-func (m *Machine) Halt() {
-	if m.halted {
-		panic("machine is already halted")
+// Mark the machine as halted, waking up everyone waiting for it to stop.
+func (m *Machine) setHalted() {
+	m.stateLock.Lock()
+	defer m.stateLock.Unlock()
+	if !m.halted {
+		m.halted = true
+		close(m.stopped)
 	}
-	C.machine_halt(m.machine)
+}
+
+// Return a channel that is closed once the machine is halted.
+func (m *Machine) stoppedChan() chan struct{} {
+	m.stateLock.Lock()
+	defer m.stateLock.Unlock()
+	return m.stopped
+}
+
+// Called by the run loop when the machine stopped: mark it as halted and wait
+// until it is continued. The machine lock is released while waiting.
+func (m *Machine) wait() {
+	m.setHalted()
+	m.lock.Unlock()
 	<-m.runChan
-	m.halted = true
+	m.lock.Lock()
 }
 
-func (m *Machine) Step() int {
-	return int(C.machine_step(m.machine))
+// Halt stops the machine at the next instruction boundary and waits until it
+// has stopped. It does nothing if the machine is already halted. It must not
+// be called with the machine lock held, as the run loop needs it to stop.
+func (m *Machine) Halt() {
+	stopped := m.stoppedChan()
+	if m.Halted() {
+		return
+	}
+	haltMachine(m.machine)
+	for {
+		select {
+		case <-stopped:
+			if m.stop != nil && m.stop.Reason != StopHalt {
+				// The machine had already stopped by itself, so the halt
+				// request is still pending. Drop it.
+				C.machine_cancel_halt(m.machine)
+			}
+			return
+		case call := <-m.fileIO:
+			// The machine was waiting on a File-I/O call, interrupt it.
+			call.result <- fileIOResult{ret: -1, errno: fileIOEINTR}
+		}
+	}
+}
+
+// Request the machine to halt, from any goroutine. It stops before the next
+// instruction, or right away if it waits for terminal input.
+func haltMachine(machine *C.machine_t) {
+	C.machine_halt(machine)
+	terminalInterrupt()
 }
 
+// Take the machine lock, halting the machine first if it runs. It returns
+// whether the machine was running.
+func (m *Machine) lockHalted() bool {
+	running := false
+	for {
+		if m.Running() {
+			m.Halt()
+			running = true
+		}
+		m.lock.Lock()
+		if m.Halted() {
+			return running
+		}
+		// Something continued the machine before the lock was taken.
+		m.lock.Unlock()
+	}
+}
+
+// Pause runs f with exclusive access to the machine, which is halted for the
+// call and continued afterwards if it was running. This is how goroutines
+// other than the run loop use the machine. The machine may be halted,
+// continued or single-stepped by f, but f must not call Pause or Halt.
+// Halting for the call isn't a reason the machine stopped, so the previous
+// stop reason is kept. If the machine had stopped by itself at the same time,
+// for example on a breakpoint, it stays halted and f is told it wasn't
+// running.
+func (m *Machine) Pause(f func(running bool) error) error {
+	var err error
+	m.Debug(func(running bool) bool {
+		err = f(running)
+		return running
+	})
+	return err
+}
+
+// Debug runs f like Pause, but f returns whether the machine should run
+// afterwards, like a debug probe that halts or resumes the core. A machine
+// that f halts should get the reason in m.stop.
+func (m *Machine) Debug(f func(running bool) bool) {
+	running := m.lockHalted()
+	defer m.lock.Unlock()
+	if running {
+		if m.stop != nil && m.stop.Reason == StopHalt {
+			m.stop = m.resumedFrom
+		} else {
+			running = false
+		}
+	}
+	if f(running) {
+		m.Continue()
+	}
+}
+
+// Whether GDB is continuing the machine, and is thus able to handle File-I/O
+// calls.
+func (m *Machine) gdbContinuing() bool {
+	return atomic.LoadInt32(&m.continuing) != 0
+}
+
+// Whether GDB is connected in extended-remote mode. When it is, the machine
+// waits for GDB after the program exits instead of exiting the emulator.
+func (m *Machine) ExtendedRemote() bool {
+	return atomic.LoadInt32(&m.extended) != 0
+}
+
+func (m *Machine) setExtendedRemote(extended bool) {
+	var value int32
+	if extended {
+		value = 1
+	}
+	atomic.StoreInt32(&m.extended, value)
+}
+
+// Restart the program with a power-on reset. If path is not empty, a new
+// firmware image is loaded from this path first. The machine must be halted.
+func (m *Machine) Restart(path string, args []string) error {
+	if path == "" {
+		path = m.firmware
+	}
+	firmware, debug, release, err := loadFirmware(path, uint32(m.machine.flash_base), int(m.machine.image_size))
+	if err != nil {
+		return err
+	}
+	loadImage(m.machine, firmware)
+	release()
+	C.machine_clear_debug_info(m.machine)
+	addDebugInfo(m.machine, debug, m.logFilter)
+	m.firmware = path
+	m.debug = debug
+	m.cmdline = strings.Join(args, " ")
+	for fd, f := range m.hostFiles {
+		f.Close()
+		delete(m.hostFiles, fd)
+	}
+	C.machine_power_cycle(m.machine)
+	m.stop = nil
+	m.exited = false
+	m.exitCode = 0
+	return nil
+}
+
+// Reload writes a new firmware image to flash and resets the core, like
+// flashing a board with a debug probe. If path is empty the current firmware
+// image is loaded again. Unlike Restart, everything around the core stays as
+// it is: attached peripherals and sensors, UART backends, the GDB connection
+// and RAM. Only the flash pages that the new image covers are erased, so that
+// a settings page keeps its contents. The machine must be halted.
+func (m *Machine) Reload(path string) (int, error) {
+	if path == "" {
+		path = m.firmware
+	}
+	flashBase := uint32(m.machine.flash_base)
+	flashSize := int(m.machine.image_size)
+	firmware, debug, release, err := loadFirmware(path, flashBase, flashSize)
+	if err != nil {
+		return 0, err
+	}
+	flash := flashImage(m.machine)
+	copy(flash, firmware)
+	pageSize := int(m.machine.pagesize)
+	for i := len(firmware); i%pageSize != 0 && i < flashSize; i++ {
+		flash[i] = 0xff
+	}
+	release()
+	if m.machine.executed != nil {
+		// The coverage of the old image doesn't apply to the new one.
+		executed := unsafe.Slice((*byte)(m.machine.executed), flashSize/16)
+		for i := range executed {
+			executed[i] = 0
+		}
+	}
+
+	// The symbols have moved, so the breakpoints on the fatal error handlers
+	// and exit functions are set again.
+	C.machine_clear_debug_info(m.machine)
+	addDebugInfo(m.machine, debug, m.logFilter)
+	m.firmware = path
+	m.debug = debug
+	m.breakpoints.DeleteFunc(func(bp *Breakpoint) bool {
+		return bp.Owner == BreakpointPanic || bp.Owner == BreakpointExit
+	})
+	if err := m.addExitBreakpoints(); err != nil {
+		return 0, err
+	}
+	if m.panics {
+		if err := m.addPanicBreakpoints(); err != nil {
+			return 0, err
+		}
+	}
+	C.machine_reset_cause(m.machine, C.RESET_SREQ)
+	m.stop = nil
+	m.exited = false
+	m.exitCode = 0
+	return len(firmware), nil
+}
+
+// Run the machine until it stops, and return why it stopped.
+func (m *Machine) Run() *StopError {
+	code := C.machine_run(m.machine)
+	drainTraceRing(m.machine)
+	return newStopError(m.machine, code)
+}
+
+// Execute a single instruction. It returns nil if the instruction executed
+// normally.
+func (m *Machine) Step() *StopError {
+	if m.maskISR == "steponly" {
+		C.machine_set_debug_mask(m.machine, true)
+		defer C.machine_set_debug_mask(m.machine, false)
+	}
+	code := C.machine_step(m.machine)
+	drainTraceRing(m.machine)
+	if code == C.ERR_OK {
+		return nil
+	}
+	return newStopError(m.machine, code)
+}
+
+// StepRange single-steps while the PC stays within start..end, for the range
+// stepping of GDB: one request steps over a whole source line instead of one
+// instruction at a time. It returns nil once the PC leaves the range, and the
+// reason if the machine stops otherwise, like at a breakpoint. Breakpoints
+// are counted like while the machine runs, so that one whose condition is
+// false or that is ignored a number of times is stepped over. The interrupt
+// function is polled now and then, so that an endless loop in the range can
+// be interrupted.
+func (m *Machine) StepRange(start, end uint32, interrupt func() bool) *StopError {
+	for i := 1; ; i++ {
+		if stop := m.Step(); stop != nil {
+			if stop.Reason != StopBreakpoint {
+				return stop
+			}
+			if _, report := m.breakpoints.hit(stop.PC); report {
+				return stop
+			}
+			// The next step executes the instruction at the breakpoint.
+			continue
+		}
+		pc := uint32(C.machine_readreg(m.machine, 15)) - 1
+		if pc < start || pc >= end {
+			return nil
+		}
+		if i%1024 == 0 && (interrupt() || bool(C.machine_halt_requested(m.machine))) {
+			C.machine_cancel_halt(m.machine)
+			return &StopError{Reason: StopHalt, PC: pc}
+		}
+	}
+}
+
+// SetMaskISR sets when interrupts are masked, like the maskisr command of
+// OpenOCD: never ("off"), always ("on") or only while single-stepping
+// ("steponly"), so that stepping doesn't keep ending up in interrupt handlers.
+// Masked interrupts stay pending until they are unmasked.
+func (m *Machine) SetMaskISR(mode string) error {
+	switch mode {
+	case "off", "steponly":
+		C.machine_set_debug_mask(m.machine, false)
+	case "on":
+		C.machine_set_debug_mask(m.machine, true)
+	default:
+		return fmt.Errorf("unknown maskisr mode %#v, expected on, off or steponly", mode)
+	}
+	m.maskISR = mode
+	return nil
+}
+
+// Continue resumes a halted machine. It does nothing if the machine is
+// already running.
 func (m *Machine) Continue() {
+	m.stateLock.Lock()
 	if !m.halted {
-		panic("machine is already running")
+		m.stateLock.Unlock()
+		return
 	}
 	m.halted = false
+	m.stopped = make(chan struct{})
+	m.resumedFrom = m.stop
+	m.stateLock.Unlock()
 	m.runChan <- struct{}{}
 }
 
-func (m *Machine) SetBreakpoint(num int, address uint32) bool {
-	return bool(C.machine_break(m.machine, C.size_t(num), C.uint32_t(address)))
-}
-
 func (m *Machine) ReadRegister(register int) uint32 {
 	return uint32(C.machine_readreg(m.machine, C.size_t(register)))
 }
 
-func (m *Machine) ReadRegisters(num int) []byte {
-	length := num * 4
-	cregs := C.malloc(C.size_t(length))
-	regs := (*[1 << 30]byte)(unsafe.Pointer(cregs))[:length:length]
-	C.machine_readregs(m.machine, (*C.uint32_t)(cregs), C.size_t(num))
-	buf := make([]byte, length)
-	copy(buf, regs)
-	C.free(cregs)
-	return buf
+// DebugRegisters returns r0-r15 and xPSR as a debugger sees them, in the
+// register order of GDB's Cortex-M target description. The PC is returned
+// without the Thumb bit.
+func (m *Machine) DebugRegisters() [17]uint32 {
+	return debugRegisters(m.machine)
+}
+
+func debugRegisters(machine *C.machine_t) [17]uint32 {
+	var regs [17]uint32
+	readState(machine, &regs)
+	return regs
+}
+
+// MemoryRange is a range of memory for ReadState and WriteState.
+type MemoryRange struct {
+	Address uint32
+	Data    []byte // ReadState reads len(Data) bytes into Data
+}
+
+// ReadState returns the registers like DebugRegisters and reads each of the
+// memory ranges, all in a single call into the C core. Use it when a debugger
+// stops, instead of reading registers and memory one by one.
+func (m *Machine) ReadState(ranges ...MemoryRange) [17]uint32 {
+	var regs [17]uint32
+	readState(m.machine, &regs, ranges...)
+	return regs
+}
+
+// WriteState writes the registers (when regs is not nil), in the same order
+// as DebugRegisters, and the memory ranges in a single call into the C core.
+// Memory is written like WriteMemory does.
+func (m *Machine) WriteState(regs *[17]uint32, ranges ...MemoryRange) {
+	cranges, pinner := pinRanges(ranges)
+	defer pinner.Unpin()
+	var cregs *C.uint32_t
+	if regs != nil {
+		cregs = (*C.uint32_t)(unsafe.Pointer(&regs[0]))
+	}
+	C.machine_write_state(m.machine, cregs, unsafe.SliceData(cranges), C.size_t(len(cranges)))
+}
+
+// Read the registers (when regs is not nil) and memory ranges with a single
+// call to machine_read_state.
+func readState(machine *C.machine_t, regs *[C.MACHINE_STATE_REGS]uint32, ranges ...MemoryRange) {
+	cranges, pinner := pinRanges(ranges)
+	defer pinner.Unpin()
+	var cregs *C.uint32_t
+	if regs != nil {
+		cregs = (*C.uint32_t)(unsafe.Pointer(&regs[0]))
+	}
+	C.machine_read_state(machine, cregs, unsafe.SliceData(cranges), C.size_t(len(cranges)))
+}
+
+// Convert memory ranges for the C core. The data of each range is pinned, as
+// the C core gets it through a pointer in Go memory.
+func pinRanges(ranges []MemoryRange) ([]C.machine_range_t, *runtime.Pinner) {
+	pinner := new(runtime.Pinner)
+	var cranges []C.machine_range_t
+	for _, r := range ranges {
+		if len(r.Data) == 0 {
+			continue
+		}
+		pinner.Pin(&r.Data[0])
+		cranges = append(cranges, C.machine_range_t{
+			address: C.uint32_t(r.Address),
+			length:  C.uint32_t(len(r.Data)),
+			data:    (*C.uint8_t)(unsafe.Pointer(&r.Data[0])),
+		})
+	}
+	return cranges, pinner
 }
 
 func (m *Machine) ReadMemory(addr, length int) []byte {
-	cmem := C.malloc(C.size_t(length))
-	mem := (*[1 << 30]byte)(unsafe.Pointer(cmem))[:length:length]
-	C.machine_readmem(m.machine, cmem, C.size_t(addr), C.size_t(length))
 	buf := make([]byte, length)
-	copy(buf, mem)
-	C.free(cmem)
+	readState(m.machine, nil, MemoryRange{uint32(addr), buf})
 	return buf
 }
+
+// Disassemble the instruction at the given address. It returns the instruction
+// text and its size in bytes.
+func (m *Machine) Disassemble(address uint32) (string, int) {
+	var buf [80]C.char
+	size := C.machine_disasm(m.machine, C.uint32_t(address), &buf[0], C.size_t(len(buf)))
+	return C.GoString(&buf[0]), int(size)
+}
+
+func (m *Machine) WriteMemory(addr int, data []byte) {
+	m.WriteState(nil, MemoryRange{uint32(addr), data})
+}
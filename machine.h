@@ -5,6 +5,8 @@
 #include <stdbool.h>
 #include <stdlib.h>
 
+#include "crypto.h"
+
 typedef struct {
 	uint32_t     : 4;
 	uint32_t t   : 1; // Thumb mode
@@ -25,7 +27,551 @@ typedef struct {
 
 #define MACHINE_BACKTRACE_LEN (100)
 
+// Number of external interrupts supported by the NVIC.
+#define MACHINE_NUM_IRQS (32)
+
+// Number of GPIO ports whose inputs can be driven by the host, like GPIOA..
+// GPIOK of the STM32. Pins are numbered port * 32 + pin.
+#define MACHINE_GPIO_PORTS (11)
+
+// Maximum number of connections between GPIO pins, see machine_connect_gpio.
+#define MACHINE_GPIO_LINKS (32)
+
+// Maximum number of injected peripheral faults.
+#define MACHINE_PERIPH_FAULTS (8)
+
+// An injected peripheral fault: either a register that is stuck at a given
+// value, or a register that causes a bus error on access.
+typedef struct {
+	uint32_t address;
+	uint32_t value;
+	bool     buserror;
+} periph_fault_t;
+
+// Maximum number of watched memory ranges, see machine_set_watches.
+#define MACHINE_WATCHES (32)
+
+// Maximum number of stack frames guarded at the same time, see
+// machine_enable_stack_guard.
+#define MACHINE_STACK_GUARDS (64)
+
+// Maximum size in bytes of the code of a loop found by machine_set_hang_cycles.
+#define MACHINE_HANG_SPAN (64)
+
+// Maximum number of cycles that core 1 of the RP2040 runs behind core 0, see
+// machine_rp2040_step.
+#define MACHINE_CORE_QUANTUM (64)
+
+// Maximum number of peripherals implemented by the host.
+#define MACHINE_EXTERNAL_PERIPHS (8)
+
+// Maximum number of external RAM regions, see machine_add_ram.
+#define MACHINE_EXT_RAMS (4)
+
+// Maximum number of address ranges with stubs, see machine_add_stub_range.
+#define MACHINE_STUB_RANGES (8)
+
+struct machine;
+
+// Callbacks for peripherals implemented by the host, see
+// machine_add_external_periph. The transfer callback handles a 32-bit
+// register access at the given offset into peripheral index and returns
+// ERR_OK or ERR_MEM. The poll callback is called from machine_run after
+// machine_external_notify, to handle asynchronous events like interrupts.
+typedef int (*external_transfer_t)(struct machine *machine, size_t index, uint32_t offset, bool store, uint32_t *value);
+typedef void (*external_poll_t)(struct machine *machine);
+
+// Callback to read or write a 512-byte block of the SD card image, see
+// machine_set_sdcard. It returns ERR_OK or ERR_MEM.
+typedef int (*sdcard_io_t)(struct machine *machine, uint32_t block, uint8_t *data, bool write);
+
+// Maximum number of SPI devices implemented by the host.
+#define MACHINE_SPI_DEVICES (8)
+
+// Bus operations that are forwarded to devices implemented by the host, see
+// machine_set_bus_handler. For I2C, the device is always 0 and the bus handler
+// has to track which device was addressed. For SPI, it is the index returned
+// by machine_add_spi_device.
+typedef enum {
+	BUS_I2C_START,    // (repeated) start, data is address << 1 | read
+	BUS_I2C_WRITE,    // write the byte in data
+	BUS_I2C_READ,     // read a byte into data
+	BUS_I2C_STOP,
+	BUS_SPI_SELECT,   // the chip select pin was driven low
+	BUS_SPI_TRANSFER, // exchange the byte in data
+	BUS_SPI_DESELECT, // the chip select pin was released
+	BUS_UART_SEND,    // the UART sent a character (only traced)
+	BUS_UART_RECEIVE, // the UART received a character (only traced)
+} bus_op_t;
+
+// Callback for I2C and SPI devices implemented by the host. The start and
+// write operations return ERR_OK when the byte was acknowledged.
+typedef int (*bus_io_t)(struct machine *machine, bus_op_t op, uint32_t device, uint8_t *data);
+
+// Callback for each bus operation, see machine_set_bus_trace. It sees all
+// traffic, also to devices of the chip itself like the SD card. The byte that
+// the chip sent is in out and the byte it received in in; ack tells whether
+// an I2C address or write was acknowledged. For SPI transfers, device is the
+// bitmap of selected SPI devices of the host, for UART characters the UART.
+typedef void (*bus_trace_t)(struct machine *machine, bus_op_t op, uint32_t device, uint8_t out, uint8_t in, bool ack);
+
+// UART receive errors, in the bit order of ERRORSRC on the nRF52.
+#define UART_ERROR_OVERRUN (1 << 0)
+#define UART_ERROR_PARITY  (1 << 1)
+#define UART_ERROR_FRAMING (1 << 2)
+#define UART_ERROR_BREAK   (1 << 3)
+
+// Size of the UART receive FIFO, the deepest of all chips (the RP2040).
+#define MACHINE_UART_FIFO (32)
+
+// Number of UARTs: UART0 and UART1 of the nRF52840 and RP2040, and USART1 and
+// USART2 of the STM32.
+#define MACHINE_NUM_UARTS (2)
+
+// Maximum number of bytes in a frame of WS2812 LEDs: 1365 RGB LEDs.
+#define MACHINE_WS2812_BYTES (4096)
+
+// Callback for each frame of WS2812 LEDs, see machine_set_ws2812. The data
+// is in the order it was sent, usually GRB.
+typedef void (*ws2812_frame_t)(struct machine *machine, const uint8_t *data, uint32_t len);
+
+// Maximum number of GPIO pins that can be probed, see machine_set_probes.
+#define MACHINE_PROBES (16)
+
+// Callback when the level of a probed GPIO pin changes, see
+// machine_set_probes. Bit n of levels is the level of probe n.
+typedef void (*probe_changed_t)(struct machine *machine, uint64_t cycle, uint32_t levels);
+
+// Maximum number of audio samples passed to the audio callback at once.
+#define MACHINE_AUDIO_CHUNK (256)
+
+// Callback for a chunk of audio samples, see machine_set_audio. Output
+// samples were played by the firmware, input samples are to be filled in by
+// the host (they are zero, silence, to start with). Samples are left aligned
+// in 32 bits, so that the sign is bit 31 whatever their width, and the
+// channels of each frame are interleaved. The time of the first frame is
+// given in samples since the machine started, see machine_time_us.
+typedef void (*audio_io_t)(struct machine *machine, bool input, uint64_t time, int32_t *samples, uint32_t frames, uint32_t channels, uint32_t rate, uint32_t bits);
+
+// Callback for the voltage on an analog input, see machine_set_analog. The
+// input is 0..7 for AIN0..AIN7 and the result is in volts.
+typedef double (*analog_input_t)(struct machine *machine, uint32_t input);
+
+// A classic CAN frame, see machine_set_can.
+typedef struct {
+	uint32_t id;     // 11-bit standard or 29-bit extended identifier
+	bool extended;
+	bool remote;     // remote transmission request, which carries no data
+	uint8_t dlc;     // data length code, 0..8
+	uint8_t data[8];
+} can_frame_t;
+
+// Callback for each CAN frame the firmware sends, see machine_set_can.
+typedef void (*can_send_t)(struct machine *machine, const can_frame_t *frame);
+
+// Callback for each packet the radio sends, see machine_set_radio. The
+// frequency and mode are the FREQUENCY and MODE registers, the address is the
+// prefix byte followed by the base address (see machine_radio_receive).
+typedef void (*radio_send_t)(struct machine *machine, const uint8_t *packet, uint32_t length, uint32_t frequency, uint32_t mode, uint64_t address);
+
+// Called when the timer of the host expires, see machine_set_host_timer.
+typedef void (*host_timer_t)(struct machine *machine);
+
+// Callback for each character a UART sends, see machine_set_uart_output.
+typedef void (*uart_output_t)(struct machine *machine, uint32_t uart, uint8_t c);
+
+// Callback that returns the next character that the host sends to a UART, or
+// -1 if there is none yet. The character is only taken when take is true. See
+// machine_set_uart_receive.
+typedef int (*uart_receive_t)(struct machine *machine, uint32_t uart, bool take);
+
+// Callback for each peripheral register access of the CPU, see
+// machine_set_periph_trace. The value is the one that was read or written.
+typedef void (*periph_trace_t)(struct machine *machine, uint32_t address, bool store, uint32_t value, uint32_t pc);
+
+// An event in the trace ring, see machine_enable_trace_ring.
+typedef enum {
+	TRACE_PERIPH_LOAD,      // address and value of the access
+	TRACE_PERIPH_STORE,     // address and value of the access
+	TRACE_BUS,              // device in address, op | out << 8 | in << 16 | ack << 24 in value, time in µs in data
+	TRACE_WATCH,            // address and size (in value) of a watched range, its new value in data
+	TRACE_EXCEPTION_ENTER,  // exception in value, the word at the sample address in data
+	TRACE_EXCEPTION_RETURN, // exception in value, the word at the sample address in data
+} trace_event_type_t;
+
+typedef struct {
+	uint64_t cycle;
+	uint32_t type; // trace_event_type_t
+	uint32_t pc;
+	uint32_t address;
+	uint32_t value;
+	uint64_t data;
+} trace_event_t;
+
+// Callback when the trace ring is full, see machine_enable_trace_ring. The
+// host must read at least one event before it returns.
+typedef void (*trace_flush_t)(struct machine *machine);
+
+// Callback when the CPU enters or returns from an exception handler, see
+// machine_set_exception_trace.
+typedef void (*exception_trace_t)(struct machine *machine, uint32_t exception, bool enter);
+
+// Callback after an instruction stored to a watched memory range, see
+// machine_set_watches. The bits of watches are those of the ranges it stored
+// to, and pc is the address of the instruction.
+typedef void (*watch_t)(struct machine *machine, uint32_t watches, uint32_t pc);
+
+// What a stub of the host implements, see machine_set_stub_handler.
+typedef enum {
+	STUB_ROM, // a function at an address in a stub range
+	STUB_SVC, // a supervisor call (the SVC instruction)
+} stub_kind_t;
+
+// Callback for a call to a stub, see machine_set_stub_handler. The id is the
+// address of the function (without the Thumb bit) or the SVC number. It
+// returns ERR_OK to continue running, or the reason to stop.
+typedef int (*stub_call_t)(struct machine *machine, stub_kind_t kind, uint32_t id);
+
+// Accesses that go against the permissions of a memory region, see
+// machine_set_permission.
+typedef enum {
+	PERM_EXEC_RAM,    // executing code from RAM
+	PERM_WRITE_FLASH, // storing to flash that the flash controller didn't make writable
+	PERM_NUM,
+} permission_t;
+
+// What to do on such an access.
+typedef enum {
+	ACCESS_ALLOW, // execute or store like any other access
+	ACCESS_WARN,  // log the access, but stores to flash are ignored
+	ACCESS_FAULT, // stop with a memory error
+} access_action_t;
+
+// The registers a function saves on the stack, from the DWARF call frame
+// information, see machine_add_stack_frame. Offsets are in bytes below the SP
+// at the call.
+typedef struct {
+	uint32_t address;      // start of the function
+	uint32_t prologue_end; // address after the last instruction that saves a register
+	uint16_t saved_offset; // the saved registers start at entry SP - saved_offset
+	uint16_t saved_size;
+	uint16_t lr_offset;    // the return address is at entry SP - lr_offset, or 0 if not saved
+} stack_frame_t;
+
+// A call to a function with a stack_frame_t, while it hasn't returned.
+typedef struct {
+	const stack_frame_t *frame;
+	uint32_t entry_sp; // SP at the call
+	uint32_t ipsr;     // exception that made the call, 0 in thread mode
+	bool armed;        // the prologue has saved all registers
+	uint32_t lr;       // return address as saved by the prologue
+} stack_guard_t;
+
+// The state of the SD card protocol, besides receiving commands.
+typedef enum {
+	SDCARD_IDLE,       // waiting for a command
+	SDCARD_READ,       // sending blocks after CMD18, until CMD12
+	SDCARD_WRITE,      // waiting for a data token after CMD24 or CMD25
+	SDCARD_WRITE_DATA, // receiving a block and its CRC
+} sdcard_state_t;
+
+// An address range in the peripheral region that is handled by the host.
+typedef struct {
+	uint32_t start;
+	uint32_t size;
+} external_periph_t;
+
+typedef enum {
+	SLEEP_NONE,  // running
+	SLEEP_LIGHT, // sleeping after WFI/WFE
+	SLEEP_DEEP,  // sleeping after WFI/WFE with SCR.SLEEPDEEP set
+} sleep_state_t;
+
+// Peripherals that are tracked for power estimation.
+typedef enum {
+	PERIPH_UART,
+	PERIPH_RNG,
+	PERIPH_RADIO,
+	PERIPH_NUM,
+} periph_t;
+
+// The state shared by all nRF peripherals: events, shortcuts and interrupts.
+typedef struct {
+	uint32_t events; // EVENTS_* registers that are set, bit n is at offset 0x100 + 4*n
+	uint32_t inten;  // enabled interrupts, with the same layout as events
+	uint32_t shorts; // SHORTS register
+} nrf_periph_t;
+
+// The state of a UART and of the line to the host that it is connected to.
+// UART0 is connected to the terminal until the host sets its callbacks, other
+// UARTs only to the callbacks and injected input.
+typedef struct {
+	uint32_t index; // 0 for UART0, 1 for UART1
+	bool rx_started;
+	bool tx_started;
+	bool mute; // don't write output to the terminal
+	uart_output_t output;   // send output here instead of to the terminal
+	uart_receive_t receive; // read input from here instead of from the terminal
+	const uint8_t *input; // read input from here instead of the terminal
+	size_t input_len;
+	size_t input_pos;
+	uint8_t *inject;      // injected input, read before any other input (a ring buffer)
+	uint32_t inject_size; // depth of the input queue, see machine_set_uart_queue
+	uint32_t inject_pos;
+	uint32_t inject_len;
+	nrf_periph_t periph; // UARTE events and interrupts
+	uint32_t enable;     // ENABLE: 4 for UART, 8 for UARTE
+	uint32_t rx_ptr;     // UARTE RXD.PTR, RXD.MAXCNT and RXD.AMOUNT
+	uint32_t rx_maxcnt;
+	uint32_t rx_amount;
+	uint32_t tx_ptr;     // UARTE TXD.PTR, TXD.MAXCNT and TXD.AMOUNT
+	uint32_t tx_maxcnt;
+	uint32_t tx_amount;
+	uint32_t rx_buf;     // UARTE: RXD.PTR and RXD.MAXCNT, latched at RXSTARTED
+	uint32_t rx_buf_len;
+	uint32_t tx_buf;     // UARTE: TXD.PTR and TXD.MAXCNT, latched at TXSTARTED
+	uint32_t tx_buf_len;
+	bool tx_waiting;     // UARTE: STARTTX waits for CTS
+	bool tx_busy;        // UARTE: ENDTX happens at tx_done
+	uint32_t errorsrc;   // ERRORSRC
+	uint32_t baudrate;   // BAUDRATE
+	uint32_t config;     // CONFIG: HWFC, PARITY and STOP
+
+	// The line to the host, shared by the UARTs of all chips. See
+	// machine_uart_receive.
+	bool timing;         // characters take as long as on a real line (-uart-timing)
+	uint32_t host_baud;  // baud rate of the host, or 0 to accept any
+	uint32_t pacing;     // minimum time between received characters in ns (-uart-pacing)
+	bool baud_warned;    // a baud rate mismatch was reported
+	bool cts;            // the host lets the chip send: its CTS input is asserted
+	bool cts_changed;    // STM32: SR.CTS
+	uint32_t baud;       // configured by the firmware, 0 if unknown
+	uint32_t frame_bits; // start, data, parity and stop bits of a character
+	bool rtsflow;        // the host only sends while the receive FIFO has room (RTS)
+	bool ctsflow;        // the chip only sends while CTS is asserted
+	uint32_t depth;      // FIFO depth of the chip, at most MACHINE_UART_FIFO
+	uint8_t rx_fifo[MACHINE_UART_FIFO];   // received characters that were not read yet
+	uint8_t rx_errors[MACHINE_UART_FIFO]; // their errors, UART_ERROR_*
+	uint32_t rx_head;
+	uint32_t rx_len;
+	uint64_t rx_next;    // cycle at which the next character can arrive
+	bool rx_overrun;     // STM32 SR.ORE, RP2040 UARTRSR.OE
+	uint32_t errors;     // errors that were not reported yet (nRF)
+	uint32_t inject_errors; // errors of the next character, see machine_uart_inject_error
+	uint64_t tx_done;    // cycle at which the last character has been sent
+	int32_t tx_held;     // character held back while CTS is deasserted, or -1
+} uart_t;
+
+// The state of an nRF RTC peripheral.
+typedef struct {
+	nrf_periph_t periph;
+	bool running;
+	uint32_t prescaler;
+	uint32_t counter;     // counter value at start_ticks
+	uint64_t start_ticks; // 32.768kHz ticks when counter was last set
+	uint64_t last;        // counter value (not wrapped) at the last update
+	uint32_t evten;       // events routed to the PPI
+	uint32_t cc[4];       // compare registers
+} rtc_t;
+
+// The state of an nRF TIMER peripheral.
+typedef struct {
+	nrf_periph_t periph;
+	bool running;
+	uint32_t mode;        // MODE: 0 for timer, otherwise counter
+	uint32_t bitmode;     // BITMODE: 16, 8, 24 or 32 bits
+	uint32_t prescaler;
+	uint64_t counter;     // counter value at start_ticks
+	uint64_t start_ticks; // ticks of the prescaled clock when counter was last set
+	uint64_t last;        // counter value (not wrapped) at the last update
+	uint32_t cc[6];       // capture/compare registers
+} nrf_timer_t;
+
+// Number of TIMER peripherals and programmable PPI channels.
+#define NRF_NUM_TIMERS (5)
+#define NRF_PPI_CHANNELS (20)
+
+// States of the nRF RADIO, as in the STATE register.
+typedef enum {
+	RADIO_DISABLED   = 0,
+	RADIO_RXRU       = 1,
+	RADIO_RXIDLE     = 2,
+	RADIO_RX         = 3,
+	RADIO_RXDISABLE  = 4,
+	RADIO_TXRU       = 9,
+	RADIO_TXIDLE     = 10,
+	RADIO_TX         = 11,
+	RADIO_TXDISABLE  = 12,
+} radio_state_t;
+
+// Events that peripherals schedule at a cycle, see machine_schedule. Each is
+// scheduled at most once.
+typedef enum {
+	EVENT_SYSTICK,      // SysTick reaches zero
+	EVENT_RTC0,         // TICK, OVRFLW or COMPARE event of RTC0..RTC2
+	EVENT_RTC1,
+	EVENT_RTC2,
+	EVENT_TIMER0,       // COMPARE event of TIMER0..TIMER4
+	EVENT_TIMER1,
+	EVENT_TIMER2,
+	EVENT_TIMER3,
+	EVENT_TIMER4,
+	EVENT_RADIO,        // the pending RADIO event
+	EVENT_I2S,          // the I2S buffers have been played
+	EVENT_PDM,          // the PDM buffer has been recorded
+	EVENT_SAADC,        // the SAADC samples with its internal timer
+	EVENT_UART,         // nRF UART: ENDTX, or polling for received data
+	EVENT_RP2040_TIMER, // alarm of the RP2040 TIMER
+	EVENT_WS2812,       // the WS2812 data line has been low long enough to latch
+	EVENT_HOST,         // the timer of the host, see machine_set_host_timer
+	EVENT_NUM,
+} event_t;
+
+// The family of chips that is emulated. It determines where flash is mapped
+// and which peripherals are built in.
+typedef enum {
+	FAMILY_NRF,    // nRF51/nRF52: flash at 0
+	FAMILY_STM32,  // STM32F1/F4: flash at 0x08000000, aliased at 0
+	FAMILY_RP2040, // RP2040: boot ROM at 0, flash (XIP) at 0x10000000
+} family_t;
+
+// A peripheral built into the core, at an address range of a family. The
+// peripheral decoders find the peripheral at an address in these tables, see
+// machine_builtin_peripherals.
+typedef struct {
+	uint32_t start;
+	uint32_t size;
+	uint8_t id;       // which peripheral model handles it, internal to machine.c
+	uint8_t index;    // instance of the model, like 1 for TIMER1
+	const char *name; // like "UART0, UARTE0"
+} builtin_periph_t;
+
+// A symbol from the firmware, used to make call logs readable.
+typedef struct {
+	uint32_t address;
+	uint32_t size;  // 0 if unknown
+	char *name;
+	bool log;       // log calls to this symbol
+} symbol_t;
+
+// A row of the line table: the instructions starting at this address belong
+// to the given source line.
+typedef struct {
+	uint32_t address;
+	uint32_t file; // index into the source file names
+	uint32_t line; // 0 for the end of a sequence of instructions
+} line_t;
+
+// Execution statistics, updated while the machine runs.
+typedef struct {
+	uint64_t instructions;    // number of executed instructions
+	uint64_t cycles;          // total number of cycles (including sleep)
+	uint64_t cycles_state[3]; // cycles spent in each sleep_state_t
+	uint64_t wakeups;         // number of times the core woke up from sleep
+	uint64_t fast_forwarded;  // idle cycles that were skipped, see machine_set_fast_forward
+	uint64_t exceptions;      // number of exceptions (interrupts) taken
+	uint64_t cycles_periph[PERIPH_NUM]; // cycles each peripheral was turned on
+	uint64_t flash_erases;    // number of flash page erases
+	uint64_t flash_writes;    // number of flash word writes
+	uint64_t power_cuts;      // number of simulated power cuts during flash operations
+	uint64_t exceptions_by_number[16 + MACHINE_NUM_IRQS]; // exceptions taken, by exception number
+	uint64_t exception_cycles[16 + MACHINE_NUM_IRQS]; // cycles in each handler, not counting handlers that preempted it
+	uint64_t exception_latency[16 + MACHINE_NUM_IRQS]; // total cycles from becoming pending to entering the handler
+	uint64_t exception_latency_max[16 + MACHINE_NUM_IRQS]; // longest time from becoming pending to entering the handler
+	uint32_t exception_nesting_max[16 + MACHINE_NUM_IRQS]; // most active exceptions when it was entered, itself included
+	uint64_t uart_tx_bytes;   // number of bytes sent over the UART
+	uint64_t uart_rx_bytes;   // number of bytes received over the UART
+	uint64_t uart_overruns;   // number of bytes lost because the UART receive FIFO was full
+	uint64_t uart_rx_errors;  // number of bytes received with a framing or parity error, or a break
+	uint64_t radio_tx_packets; // number of packets sent by the radio
+	uint64_t faults;          // number of times the machine stopped with an error
+	uint64_t ws2812_frames;   // number of frames sent to WS2812 LEDs
+	uint64_t ws2812_errors;   // number of WS2812 bits with a timing outside the datasheet limits
+	uint64_t audio_out;       // number of audio frames played by I2S
+	uint64_t audio_in;        // number of audio frames recorded by I2S and PDM
+	uint64_t can_tx;          // number of CAN frames sent
+	uint64_t can_rx;          // number of CAN frames accepted by a filter
+} machine_stats_t;
+
+// Maximum number of distinct undefined instructions that are recorded, and the
+// number of example addresses recorded for each.
+#define MACHINE_UNDEFINED_INSTRS (32)
+#define MACHINE_UNDEFINED_PCS (4)
+
+// An undefined (or unimplemented) instruction that was executed.
+typedef struct {
+	uint16_t hw1;
+	uint16_t hw2; // second halfword of a 32-bit instruction, or 0
+	uint32_t count;
+	uint32_t pcs[MACHINE_UNDEFINED_PCS]; // the first addresses where it was hit
+} undefined_instr_t;
+
+// Number of registers that machine_read_state and machine_write_state move:
+// r0-r15 and xPSR, in the register order of GDB's Cortex-M target description.
+#define MACHINE_STATE_REGS (17)
+
+// A memory range that machine_read_state reads into or machine_write_state
+// writes from.
+typedef struct {
+	uint32_t address;
+	uint32_t length;
+	uint8_t  *data;
+} machine_range_t;
+
+// The NVIC peripheral
+typedef struct {
+	uint32_t enabled; // interrupt set-enable register
+	uint32_t pending; // interrupt set-pending register
+	uint8_t ip[8 * 4]; // interrupt priority
+} nvic_t;
+
 typedef struct {
+	uint32_t cpacr; // coprocessor access control register
+	uint32_t vtor;  // vector table offset register
+	uint32_t scr;   // system control register
+	uint32_t shpr[2]; // system handler priority registers 2 and 3
+	bool pendsv;    // PendSV is pending
+	bool pendst;    // SysTick is pending
+} scb_t;
+
+typedef struct {
+	uint32_t csr;   // control and status register (without COUNTFLAG)
+	uint32_t rvr;   // reload value
+	bool countflag; // the counter reached zero since the last read of csr
+	uint64_t base;  // cycle at which the counter last reached zero
+} systick_t;
+
+// The state of the RP2040 core that isn't executing. The cores take turns:
+// the state of the executing core is in machine_t, and
+// machine_rp2040_switch_core exchanges it with this. Everything else, like
+// memory and the peripherals, is shared.
+typedef struct {
+	uint32_t regs[17];
+	nvic_t nvic;
+	scb_t scb;
+	systick_t systick;
+	uint32_t ipsr;
+	uint64_t active;
+	bool primask;
+	bool event;
+	sleep_state_t sleep;
+	bool sleep_wfe;
+	uint64_t pending_seen;
+	uint64_t pended_at[16 + MACHINE_NUM_IRQS];
+	uint64_t handler_since;
+	int call_depth;
+	backtrace_item_t backtrace[MACHINE_BACKTRACE_LEN];
+	uint32_t last_sp;
+	uint32_t instruction_pc;
+	bool break_skip;
+	uint32_t coverage_prev_location;
+	uint32_t coverage_prev_pc;
+	stack_guard_t stack_guards[MACHINE_STACK_GUARDS];
+	size_t stack_guard_count;
+	uint32_t dividend, divisor, quotient, remainder; // SIO hardware divider
+} core_state_t;
+
+typedef struct machine {
 	// Regular registers (r0 .. r15)
 	union {
 		struct {
@@ -59,6 +605,15 @@ typedef struct {
 		uint32_t regs[17];
 	};
 
+	// External RAM, like SDRAM or PSRAM behind a memory controller, in the
+	// external RAM area at 0x60000000..0x9fffffff. See machine_add_ram.
+	struct {
+		uint32_t start;
+		size_t size;
+		uint8_t *data;
+	} ext_ram[MACHINE_EXT_RAMS];
+	size_t num_ext_ram;
+
 	// ROM/flash area
 	union {
 		uint32_t *image32;
@@ -67,8 +622,12 @@ typedef struct {
 		void     *image;
 	};
 	size_t image_size;
+	uint32_t flash_base; // address of flash, which is also mapped at 0 except on the RP2040
 	bool image_writable;
 	size_t pagesize;
+	uint32_t *flash_erase_counts; // number of erases per page
+	double flash_cut_erase;       // probability of a power cut during erase
+	double flash_cut_write;       // probability of a power cut during write
 
 	// RAM area
 	union {
@@ -79,18 +638,416 @@ typedef struct {
 	};
 	size_t mem_size;
 
-	// The NVIC peripheral
+	nvic_t nvic;
+	scb_t scb;
+
+	uart_t uart[MACHINE_NUM_UARTS];
+
+	rtc_t rtc[3];
+
+	// Other nRF52 peripherals.
+	struct {
+		int ppi_depth;        // nesting of events triggering tasks through PPI
+		struct {
+			nrf_periph_t periph;
+			bool hfclk_running;
+			bool lfclk_running;
+			uint32_t lfclksrc;
+			uint32_t lfclksrccopy;
+		} clock;
+		nrf_timer_t timer[NRF_NUM_TIMERS];
+		struct {
+			uint32_t chen;
+			uint32_t eep[NRF_PPI_CHANNELS];
+			uint32_t tep[NRF_PPI_CHANNELS];
+			uint32_t fork_tep[32];
+			uint32_t chg[6];
+		} ppi;
+		struct {
+			nrf_periph_t periph;
+			uint32_t config[8];
+			bool detect;          // the DETECT signal of the GPIO ports, for the PORT event
+		} gpiote;
+		struct {
+			uint32_t out;
+			uint32_t pin_cnf[32];
+			uint32_t latch;       // pins that met their SENSE condition
+		} gpio[2];
+		struct {
+			nrf_periph_t periph;
+			radio_state_t state;
+			uint32_t regs[64];    // configuration registers 0x500..0x5fc
+			bool pending;         // pending_event will happen at pending_at
+			int pending_event;
+			uint64_t pending_at;  // in microseconds, see machine_ticks
+			uint32_t power;       // POWER register
+			uint32_t rxmatch;     // RXMATCH: logical address of the last received packet
+		} radio;
+		struct {
+			nrf_periph_t periph;
+			uint32_t regs[82];    // configuration registers 0x500..0x644
+		} qspi;
+		struct {
+			nrf_periph_t periph;
+			uint32_t regs[50];    // configuration registers 0x500..0x5c4
+			uint8_t rxd;          // RXD of the legacy SPI and TWI peripherals
+			bool rxd_pending;     // TWI: RXD holds a byte that was not read yet
+			bool twi_active;      // TWI, TWIM: between a start and stop condition
+			bool twi_read;        // TWI, TWIM: the current transfer is a read
+			bool twi_suspended;   // TWIM: suspended after the last byte was sent
+			uint32_t errorsrc;    // TWI, TWIM: ERRORSRC
+		} spi[4]; // SPI0/SPIM0/TWI0, SPI1/SPIM1/TWI1, SPI2/SPIM2 and SPIM3
+		struct {
+			nrf_periph_t periph;
+			uint32_t regs[28];    // configuration registers 0x500..0x56c
+		} pwm[4];
+		struct {
+			nrf_periph_t periph;
+			uint32_t regs[29];    // configuration registers 0x500..0x570
+			bool started;
+			uint32_t rate;        // sample rate, fixed at TASKS_START
+			uint32_t rxd_ptr;     // buffers in use, latched at the RXPTRUPD and TXPTRUPD events
+			uint32_t txd_ptr;
+			uint64_t start;       // start of the buffers in use, in samples (see machine_ticks)
+		} i2s;
+		struct {
+			nrf_periph_t periph;
+			uint32_t regs[26];    // configuration registers 0x500..0x564
+			bool started;
+			uint32_t rate;        // sample rate, fixed at TASKS_START
+			uint32_t ptr;         // buffer in use, latched at the STARTED event
+			uint64_t start;       // start of the buffer in use, in samples (see machine_ticks)
+		} pdm;
+		struct {
+			nrf_periph_t periph;
+			uint32_t regs[78];    // configuration registers 0x500..0x634
+			bool started;         // a buffer is in use
+			bool sampling;        // sampling with the internal timer, see SAMPLERATE
+			uint32_t ptr;         // buffer in use, latched at the STARTED event
+			uint32_t maxcnt;
+			uint32_t amount;      // samples written to the buffer in use
+			uint64_t next;        // next sample of the internal timer, in 16MHz ticks
+		} saadc;
+		nrf_periph_t egu[6];
+		struct {
+			nrf_periph_t periph;
+			uint32_t ecbdataptr;
+		} ecb;
+		struct {
+			nrf_periph_t periph;
+			uint32_t regs[8];     // configuration registers 0x500..0x51c
+			uint32_t micstatus;
+		} ccm;
+		struct {
+			nrf_periph_t periph;
+			int32_t temp;         // TEMP, in 0.25 °C
+			uint32_t regs[17];    // calibration registers A0..A5, B0..B5 and T0..T4 at 0x520..0x560
+		} temp;
+	} nrf;
+
+	systick_t systick;
+
+	// Events that peripherals scheduled, in a binary heap ordered by cycle.
+	// See machine_schedule.
+	struct {
+		struct {
+			uint64_t cycle;
+			event_t event;
+		} heap[EVENT_NUM];
+		uint32_t len;
+		uint8_t pos[EVENT_NUM]; // index + 1 of each event in heap, 0 if it isn't scheduled
+		uint32_t dirty;         // events to schedule again before the next instruction
+	} events;
+
+	// Which peripherals are turned on, and since which cycle.
+	bool periph_on[PERIPH_NUM];
+	uint64_t periph_since[PERIPH_NUM];
+
+	// Exception state
+	uint32_t ipsr;     // current exception number, 0 in thread mode
+	uint64_t active;   // bitmap of active exceptions
+	bool primask;      // interrupts disabled with CPSID
+	bool event;        // event register, for WFE/SEV
+	sleep_state_t sleep; // current sleep state
+	bool sleep_wfe;    // sleeping in WFE (instead of WFI)
+	bool debug_mask;   // interrupts are masked by the debugger, see machine_set_debug_mask
+	uint32_t wakeup_latency[3]; // cycles to wake up from each sleep state
+	uint64_t pending_seen;  // bitmap of exceptions that were pending at the previous instruction
+	uint64_t pended_at[16 + MACHINE_NUM_IRQS]; // cycle at which each of those became pending
+	uint64_t handler_since; // cycle at which the current handler was entered or resumed
+
+	family_t family;
+
+	// Built-in STM32 peripherals. Those of the F1 and F4 series are at
+	// different addresses, so both are present.
+	struct {
+		uint32_t rcc_f1[16]; // RCC at 0x40021000
+		uint32_t rcc_f4[40]; // RCC at 0x40023800
+		uint32_t pwr[2];     // PWR.CR and PWR.CSR
+		uint32_t flash[2][8]; // FLASH interface of the F1 and F4
+		uint32_t gpio_f1[7][7];  // GPIOA..GPIOG at 0x40010800
+		uint32_t gpio_f4[11][10]; // GPIOA..GPIOK at 0x40020000
+		uint32_t usart[2][5]; // USART1 and USART2: BRR, CR1, CR2, CR3 and GTPR
+		uint32_t spi[3][9];   // SPI1, SPI2 and SPI3: CR1, CR2, SR, DR etc.
+		struct {
+			uint32_t regs[10]; // CR1, CR2, OAR1, OAR2, DR, SR1, SR2, CCR, TRISE and FLTR
+			uint8_t rx[2];     // received bytes: DR and the shift register
+			uint32_t rx_len;
+			bool active;       // between a start and stop condition
+			bool read;
+		} i2c[3]; // I2C1, I2C2 and I2C3
+		uint32_t exti[6];    // EXTI: IMR, EMR, RTSR, FTSR, SWIER and PR
+		uint32_t syscfg[9];  // AFIO (F1) or SYSCFG (F4), both with EXTICR1..4 at 0x08
+		struct {
+			uint32_t regs[8];     // MCR, MSR, TSR, RF0R, RF1R, IER, ESR and BTR
+			uint32_t tx[3][4];    // transmit mailboxes: TIR, TDTR, TDLR and TDHR
+			uint32_t rx[2][3][4]; // receive FIFOs of three messages: RIR, RDTR, RDLR and RDHR
+			uint32_t filter[5];   // FMR, FM1R, FS1R, FFA1R and FA1R
+			uint32_t fr[28][2];   // filter banks: FR1 and FR2
+		} can; // bxCAN (CAN1)
+		uint32_t crc[6];     // CRC: DR, IDR, CR, (reserved), INIT and POL
+		struct {
+			uint32_t cr;
+			uint32_t str;
+			uint32_t imr;
+			uint32_t sr;
+			hash_t hash;
+			uint32_t din;      // the last word written to DIN, which may be partial
+			bool din_pending;  // din has not been hashed yet
+			uint32_t hr[8];    // digest
+		} hash;
+		uint32_t info_f1[5]; // system memory at 0x1ffff7e0: F_SIZE and the unique ID (F1)
+		uint32_t info_f4[8]; // system memory at 0x1fff7a10: unique ID, F_SIZE and calibration values (F4)
+	} stm32;
+
+	// Built-in RP2040 peripherals, and the state of its second core.
+	struct {
+		uint8_t rom[0x300]; // boot ROM stub, see machine_rp2040_rom_init
+		struct {
+			uint32_t address; // address | 1, or 0 if unused
+			uint32_t value;
+		} regs[512]; // peripherals that only store their registers
+		uint32_t gpio_out;
+		uint32_t gpio_oe;
+		uint32_t gpio_intr[4]; // edge bits of IO_BANK0.INTR0..3
+		struct {
+			uint32_t data[8];
+			uint32_t len;
+		} fifo[2]; // inter-core FIFOs, fifo[n] is read by core n
+		uint32_t fifo_errors[2]; // sticky WOF and ROE bits of FIFO_ST, per core
+		uint32_t launch_seq; // position in the core 1 launch sequence
+		uint32_t launch[6];  // words of the launch sequence
+		uint32_t core;       // the core that is executing
+		bool core1_running;  // core 1 left its boot ROM to run the firmware
+		uint64_t core1_cycles; // time of core 1, behind the cycle counter, see machine_rp2040_step
+		core_state_t other;  // the core that isn't executing
+		uint32_t spinlocks;
+		uint32_t dividend, divisor, quotient, remainder;
+		uint8_t ssi_rx[16]; // XIP SSI receive FIFO
+		uint32_t ssi_rx_len;
+		struct {
+			uint8_t rx[8]; // receive FIFO
+			uint32_t rx_len;
+		} spi[2];
+		struct {
+			uint8_t rx[16]; // receive FIFO
+			uint32_t rx_len;
+			bool active;    // between a start and stop condition
+			bool read;
+			uint32_t raw_intr;     // TX_ABRT and STOP_DET of IC_RAW_INTR_STAT
+			uint32_t abort_source; // IC_TX_ABRT_SOURCE
+		} i2c[2];
+		struct {
+			uint64_t offset;   // added to the time since start, in µs
+			uint32_t timehw;   // written to TIMEHW, used when TIMELW is written
+			uint32_t latched;  // high word latched by reading TIMELR
+			uint32_t alarm[4];
+			uint32_t armed;
+			uint32_t intr;
+			uint32_t inte;
+			uint32_t intf;
+		} timer;
+	} rp2040;
+
+	// External SPI NOR flash, behind the nRF52840 QSPI peripheral or the
+	// RP2040 XIP SSI. On the RP2040 its contents are the flash image.
+	struct {
+		uint8_t *data;     // erased to all ones, not used on the RP2040
+		size_t size;
+		bool selected;     // chip select is active
+		bool powered_down; // in deep power-down mode
+		uint8_t command;   // first byte after chip select
+		uint32_t pos;      // number of bytes transferred since chip select
+		uint32_t address;  // address sent after the command
+		uint8_t status[2]; // status registers 1 (with WEL) and 2
+	} qspi_flash;
+
+	// SDHC card in SPI mode, attached to all SPI peripherals. Chip select is
+	// a GPIO pin, which the firmware drives low to talk to the card.
+	struct {
+		sdcard_io_t io;       // NULL if there is no card
+		uint32_t blocks;      // capacity in 512-byte blocks
+		int32_t cs;           // chip select pin (port * 32 + pin), or -1 if always selected
+		sdcard_state_t state;
+		bool app_cmd;         // the previous command was CMD55
+		uint8_t cmd[6];       // command being received
+		uint32_t cmd_len;
+		uint32_t block;       // next block to read or write
+		uint8_t data[514];    // block being written, with its CRC
+		uint32_t data_len;
+		uint8_t response[520]; // bytes to send: a response, maybe followed by a data block
+		uint32_t response_len;
+		uint32_t response_pos;
+	} sdcard;
+
+	// Decoder of the waveform on the data pin of WS2812 (NeoPixel) LEDs.
+	struct {
+		ws2812_frame_t frame; // NULL if there is no decoder
+		int32_t pin;          // data pin (port * 32 + pin)
+		bool level;           // current level of the data pin
+		uint64_t edge;        // cycle of the last edge, which may be in the future after a PWM sequence
+		uint8_t data[MACHINE_WS2812_BYTES]; // the frame being received
+		uint32_t bits;        // number of bits received in this frame
+	} ws2812;
+
+	// GPIO pins whose levels are reported to the host, like a logic analyzer.
+	struct {
+		probe_changed_t changed; // NULL if no pins are probed
+		uint16_t pins[MACHINE_PROBES]; // port * 32 + pin
+		uint32_t count;
+		uint32_t levels;         // last reported levels, a bit per probe
+	} probe;
+
+	// Audio samples of the I2S and PDM peripherals go to and come from the
+	// host. Without a callback, output is dropped and input is silence.
+	struct {
+		audio_io_t io;
+	} audio;
+
+	// Voltages on the analog inputs of the nRF52 SAADC come from the host.
+	// Without a callback, they are 0V.
+	struct {
+		analog_input_t input;
+	} analog;
+
+	// CAN frames sent by the firmware go to the host.
+	struct {
+		can_send_t send;
+	} can;
+
+	// Radio packets sent by the firmware go to the host.
 	struct {
-		uint8_t ip[8 * 4]; // interrupt priority
-	} nvic;
+		radio_send_t send;
+	} radio;
+
+	// Peripheral register accesses are reported to the host, if set.
+	periph_trace_t periph_trace;
+
+	// Exception entries and returns are reported to the host, if set.
+	exception_trace_t exception_trace;
+
+	// Functions of a ROM and supervisor calls that the host implements, see
+	// machine_set_stub_handler.
+	struct {
+		stub_call_t call; // NULL if there are no stubs
+		uint32_t start[MACHINE_STUB_RANGES];
+		uint32_t end[MACHINE_STUB_RANGES];
+		stub_call_t handler[MACHINE_STUB_RANGES]; // NULL for call, or a stub of the C core like the RP2040 boot ROM
+		uint32_t num_ranges;
+		uint32_t svc[256 / 32]; // bitmap of SVC numbers with a stub
+	} stubs;
+
+	// A timer of the host, for things that stubs do at a later time like
+	// the advertising of a SoftDevice. See machine_set_host_timer.
+	struct {
+		host_timer_t fire; // NULL if the timer isn't set
+		uint64_t cycle;
+	} host_timer;
+
+	// Offset in flash of the vector table that a reset starts from, see
+	// machine_set_boot_vectors.
+	uint32_t boot_vectors;
+
+	// Ring buffer of trace events, so that frequent events don't need a call
+	// into the host each. The core writes at head and the host reads at tail,
+	// possibly from another thread; both only increase.
+	struct {
+		trace_event_t *events;
+		uint32_t size; // a power of two
+		uint64_t head;
+		uint64_t tail;
+		trace_flush_t flush;
+		uint32_t sample; // address of the word recorded with exceptions, or 0
+	} trace_ring;
+
+	// Memory ranges that the host watches for stores.
+	struct {
+		watch_t  changed;
+		uint32_t address[MACHINE_WATCHES];
+		uint32_t size[MACHINE_WATCHES];
+		size_t   count;
+		uint32_t hit; // bitmap of ranges stored to by the last instruction
+	} watch;
+
+	// What to do on accesses that go against the permissions of a region.
+	access_action_t permissions[PERM_NUM];
 
+	// Stores into the registers saved by the functions on the stack, see
+	// machine_enable_stack_guard.
 	struct {
-		uint32_t cpacr; // coprocessor access control register
-	} scb;
+		bool enabled;
+		bool check_return;     // also check return addresses when they are loaded
+		stack_frame_t *frames; // sorted by address
+		size_t num_frames;
+		stack_guard_t guards[MACHINE_STACK_GUARDS]; // innermost call last
+		size_t count;
+	} stack_guard;
 
+	// Detection of a tight loop that the firmware can't get out of.
 	struct {
-		uint32_t pselreset[2];
-	} uicr;
+		uint64_t cycles; // stop after this many cycles in the loop (if nonzero)
+		uint64_t start;  // cycle counter at the start of the loop
+		uint32_t low;    // lowest and highest PC of the loop
+		uint32_t high;
+		bool side_effect; // the last instruction stored to memory or accessed a peripheral
+	} hang;
+
+	// Inputs of GPIO pins driven by devices of the host, like buttons.
+	struct {
+		bool used;                           // the host drives or connects pins
+		uint32_t driven[MACHINE_GPIO_PORTS]; // pins driven by the host
+		uint32_t high[MACHINE_GPIO_PORTS];   // levels of the driven pins
+		uint32_t in[MACHINE_GPIO_PORTS];     // last input levels, to detect edges
+		uint16_t links[MACHINE_GPIO_LINKS][2]; // connected pins, like a pressed key of a keypad
+		uint32_t num_links;
+	} gpio_input;
+
+	// I2C and SPI devices implemented by the host, like sensors. They are
+	// attached to all I2C and SPI controllers.
+	struct {
+		bus_io_t io;           // NULL if there are no devices
+		bus_trace_t trace;     // NULL if bus operations aren't traced
+		int32_t spi_cs[MACHINE_SPI_DEVICES]; // chip select pin of each SPI device
+		uint32_t spi_devices;  // number of SPI devices
+		uint32_t spi_selected; // bitmap of SPI devices whose chip select is low
+	} bus;
+
+	// UICR, 0x10001000..0x100013ff. Like flash, it is erased to all ones.
+	uint32_t uicr[256];
+
+	// Factory information, see machine_set_device_info.
+	struct {
+		uint8_t id[12];      // unique ID: DEVICEID (nRF, 64 bits) or UID (STM32, 96 bits)
+		uint8_t addr[6];     // Bluetooth device address (nRF), least significant byte first
+		int32_t temperature; // die temperature in 0.01 °C
+	} device;
+
+	// The POWER peripheral. These registers are retained across a reset
+	// (but not across a power cycle).
+	struct {
+		uint32_t resetreas;   // reset reason, see RESET_*
+		uint32_t gpregret[2]; // general purpose retention registers
+	} power;
 
 	// Statistics and backtrace depth.
 	// Warning: call_depth may not fit in the backtrace! So check before
@@ -98,12 +1055,80 @@ typedef struct {
 	int call_depth;
 	backtrace_item_t backtrace[MACHINE_BACKTRACE_LEN];
 	uint32_t last_sp;
+	uint32_t instruction_pc; // address of the last fetched instruction
+	uint32_t transfer_address; // address of the last memory access by the firmware, the faulting address after ERR_MEM
+
+	// Symbol table sorted by address, for call logging.
+	symbol_t *symbols;
+	size_t num_symbols;
+	bool symbols_filtered; // only log calls to symbols with log set
+
+	// Line table sorted by address, for source locations in traces.
+	line_t *lines;
+	size_t num_lines;
+	size_t lines_capacity; // rows allocated in lines
+	char **source_files;
+	size_t num_source_files;
+
+	// Breakpoints, as a bitmap with one bit per halfword in the image. It is
+	// allocated when the first breakpoint is set. Breakpoints in code that runs
+	// from RAM are in a bitmap with one bit per halfword of RAM.
+	uint8_t *breakpoints;
+	uint8_t *ram_breakpoints;
+	bool break_skip; // resuming from a breakpoint, don't stop at it again
 
-	volatile uint32_t hwbreak[4];
+	// Number of executed instructions per first halfword, if enabled with
+	// machine_enable_histogram.
+	uint64_t *histogram;
+
+	// Undefined instructions, recorded when they are executed (also while
+	// single-stepping).
+	undefined_instr_t undefined[MACHINE_UNDEFINED_INSTRS];
+	size_t num_undefined;
+
+	// Fault injection
+	periph_fault_t periph_faults[MACHINE_PERIPH_FAULTS];
+	size_t num_periph_faults;
+
+	// Peripherals implemented by the host.
+	external_periph_t external_periphs[MACHINE_EXTERNAL_PERIPHS];
+	size_t num_external_periphs;
+	external_transfer_t external_transfer;
+	external_poll_t external_poll;
+	bool external_pending; // call external_poll soon, set from any thread
+
+	uint64_t deadline;          // stop running at this cycle (if nonzero)
+	uint64_t instruction_limit; // stop running after this many instructions (if nonzero)
+	bool input_eof;             // the firmware is waiting for input that will never come
+
+	// Edge coverage map, if enabled.
+	uint8_t *coverage;
+	size_t coverage_size;
+	uint32_t coverage_prev_location;
+	uint32_t coverage_prev_pc;
+
+	// A bit per halfword of flash, set when an instruction starts there, if
+	// enabled. Used for line coverage.
+	uint8_t *executed;
+
+	machine_stats_t stats;
 
 	// misc
 	int loglevel;
-	volatile bool halt;
+	bool halt;                     // halt requested, set from any thread
+	bool interrupted;              // the current instruction was interrupted by a halt
+	uint32_t interrupted_regs[17]; // the registers when it was interrupted
+	bool reset_request; // SYSRESETREQ was written to AIRCR
+	bool power_cut;     // a power cut was simulated during a flash operation
+	uint32_t random_state;
+	uint32_t clock;         // CPU clock frequency in Hz
+	bool deterministic;     // derive all time from the cycle counter
+	bool fast_forward;      // skip idle time, also when following the host clock
+	uint64_t host_start_us; // host time at which the machine was at time 0, while it runs
+	bool time_paused;       // time only advances with the cycle counter: the machine isn't running
+	bool time_while_halted; // the host clock keeps running while the machine isn't
+	uint64_t paused_us;     // time at which it was paused
+	uint64_t paused_cycles; // cycle counter at which it was paused
 } machine_t;
 
 typedef enum {
@@ -118,16 +1143,28 @@ typedef enum {
 } transfer_type_t;
 
 enum {
-	ERR_OK,        // no error
-	ERR_HALT,      // program has paused after a request
-	ERR_EXIT,      // program has exited (should not normally happen on a MCU)
-	ERR_BREAK,     // hit a breakpoint
-	ERR_DIVZERO,   // divide by zero
-	ERR_MEM,       // memory error
-	ERR_PC,        // invalid PC
-	ERR_UNDEFINED, // undefined instruction
+	ERR_OK,          // no error
+	ERR_HALT,        // program has paused after a request
+	ERR_EXIT,        // program has exited (should not normally happen on a MCU)
+	ERR_BREAK,       // hit a breakpoint
+	ERR_DIVZERO,     // divide by zero
+	ERR_MEM,         // memory error
+	ERR_PC,          // invalid PC
+	ERR_UNDEFINED,   // undefined instruction
+	ERR_DEADLINE,    // reached the cycle deadline set with machine_set_deadline
+	ERR_EOF,         // waiting for input after the input buffer was exhausted
+	ERR_LIMIT,       // reached the instruction limit set with machine_set_instruction_limit
+	ERR_SEMIHOSTING, // semihosting call (BKPT 0xab) that must be handled by the caller
+	ERR_HANG,        // stuck in a loop, see machine_set_hang_cycles
 };
 
+// Result of machine_restore_snapshot.
+typedef enum {
+	SNAPSHOT_OK,
+	SNAPSHOT_INVALID,  // not a snapshot, or one made by another build of the emulator
+	SNAPSHOT_MISMATCH, // made by a machine with another memory layout
+} snapshot_result_t;
+
 enum {
 	LOG_NONE,     // don't log anything
 	LOG_ERROR,    // only log critical errors
@@ -137,19 +1174,123 @@ enum {
 	LOG_INSTRS,   // log everything
 };
 
+// Reset reasons, as reported in the RESETREAS register of the POWER
+// peripheral. Reasons accumulate until the firmware clears them.
 enum {
+	RESET_POWERON = 0,      // power-on reset: clears RESETREAS and GPREGRET
+	RESET_PIN     = 1 << 0, // reset from the reset pin
+	RESET_DOG     = 1 << 1, // reset from the watchdog
+	RESET_SREQ    = 1 << 2, // soft reset (SYSRESETREQ)
+	RESET_LOCKUP  = 1 << 3, // reset from CPU lockup
+};
+
+typedef enum {
 	CORTEX_M0,
 	CORTEX_M4,
 } machine_core_t;
 
 machine_t * machine_create(size_t image_size, size_t pagesize, size_t ram_size, int loglevel);
 void machine_load(machine_t *machine, uint8_t *image, size_t image_size);
+uint8_t * machine_get_image(machine_t *machine);
+bool machine_map_image(machine_t *machine, int fd);
 void machine_readmem(machine_t *machine, void *buf, size_t offset, size_t length);
 void machine_readregs(machine_t *machine, uint32_t *regs, size_t num);
 uint32_t machine_readreg(machine_t *machine, size_t reg);
+void machine_writemem(machine_t *machine, const void *buf, size_t address, size_t length);
+int machine_bus_transfer(machine_t *machine, uint32_t address, bool store, uint32_t *value, width_t width);
+void machine_writereg(machine_t *machine, size_t reg, uint32_t value);
+void machine_read_state(machine_t *machine, uint32_t *regs, machine_range_t *ranges, size_t num_ranges);
+void machine_write_state(machine_t *machine, const uint32_t *regs, const machine_range_t *ranges, size_t num_ranges);
+size_t machine_snapshot_size(machine_t *machine);
+void machine_save_snapshot(machine_t *machine, uint8_t *buf);
+snapshot_result_t machine_restore_snapshot(machine_t *machine, const uint8_t *buf, size_t len);
 void machine_reset(machine_t *machine);
+void machine_reset_cause(machine_t *machine, uint32_t reason);
 int machine_step(machine_t *machine);
 int machine_run(machine_t *machine);
 void machine_halt(machine_t *machine);
-bool machine_break(machine_t *machine, size_t num, uint32_t addr);
+void machine_cancel_halt(machine_t *machine);
+bool machine_halt_requested(machine_t *machine);
+bool machine_set_breakpoint(machine_t *machine, uint32_t address, bool set);
+void machine_enable_histogram(machine_t *machine);
+void machine_pend_irq(machine_t *machine, uint32_t irq);
+void machine_set_wakeup_latency(machine_t *machine, uint32_t light, uint32_t deep);
+uint64_t machine_periph_cycles(machine_t *machine, periph_t periph);
+void machine_set_deadline(machine_t *machine, uint64_t cycle);
+void machine_set_instruction_limit(machine_t *machine, uint64_t limit);
+void machine_set_hang_cycles(machine_t *machine, uint64_t cycles);
+void machine_set_permission(machine_t *machine, permission_t permission, access_action_t action);
+void machine_enable_stack_guard(machine_t *machine, bool check_return);
+uint32_t machine_read_xpsr(machine_t *machine);
+int machine_disasm(machine_t *machine, uint32_t address, char *buf, size_t len);
+void machine_add_symbol(machine_t *machine, uint32_t address, uint32_t size, const char *name, bool log);
+uint32_t machine_add_source_file(machine_t *machine, const char *name);
+void machine_add_line(machine_t *machine, uint32_t address, uint32_t file, uint32_t line);
+void machine_add_stack_frame(machine_t *machine, uint32_t address, uint32_t prologue_end, uint32_t saved_offset, uint32_t saved_size, uint32_t lr_offset);
+void machine_clear_debug_info(machine_t *machine);
+bool machine_flip_bit(machine_t *machine, uint32_t address, uint32_t bit);
+bool machine_inject_periph_fault(machine_t *machine, uint32_t address, uint32_t value, bool buserror);
+void machine_brownout(machine_t *machine);
+void machine_set_external_handlers(machine_t *machine, external_transfer_t transfer, external_poll_t poll);
+int machine_add_external_periph(machine_t *machine, uint32_t start, uint32_t size);
+int machine_add_ram(machine_t *machine, uint32_t start, size_t size);
+void machine_external_notify(machine_t *machine);
+void machine_seed(machine_t *machine, uint32_t seed);
+void machine_set_flash_cut(machine_t *machine, double erase, double write);
+uint32_t machine_flash_erase_count(machine_t *machine, size_t page);
+void machine_set_uart_input(machine_t *machine, const uint8_t *input, size_t length);
+size_t machine_uart_inject(machine_t *machine, uint32_t index, const uint8_t *data, size_t length);
+void machine_uart_inject_error(machine_t *machine, uint32_t index, uint32_t errors);
+void machine_uart_set_cts(machine_t *machine, uint32_t index, bool cts);
+void machine_set_uart_timing(machine_t *machine, bool timing, uint32_t host_baud);
+void machine_set_uart_pacing(machine_t *machine, uint32_t pacing);
+void machine_set_uart_queue(machine_t *machine, size_t depth);
+uint8_t * machine_enable_coverage(machine_t *machine, size_t size);
+uint8_t * machine_enable_executed(machine_t *machine);
+void machine_power_cycle(machine_t *machine);
+void machine_set_clock(machine_t *machine, uint32_t clock);
+void machine_reschedule_all(machine_t *machine);
+void machine_set_family(machine_t *machine, family_t family);
+size_t machine_builtin_peripherals(family_t family, const builtin_periph_t **periphs);
+void machine_set_device_info(machine_t *machine, const uint8_t id[12], const uint8_t addr[6], int32_t temperature);
+void machine_set_qspi_flash(machine_t *machine, const uint8_t *data, size_t length, size_t size);
+void machine_set_sdcard(machine_t *machine, sdcard_io_t io, uint32_t blocks, int32_t cs);
+void machine_set_bus_handler(machine_t *machine, bus_io_t io);
+void machine_set_bus_trace(machine_t *machine, bus_trace_t trace);
+int machine_add_spi_device(machine_t *machine, int32_t cs);
+void machine_set_ws2812(machine_t *machine, ws2812_frame_t frame, int32_t pin);
+bool machine_set_probes(machine_t *machine, probe_changed_t changed, const uint32_t *pins, size_t count);
+void machine_set_audio(machine_t *machine, audio_io_t io);
+void machine_set_analog(machine_t *machine, analog_input_t input);
+void machine_set_can(machine_t *machine, can_send_t send);
+void machine_set_periph_trace(machine_t *machine, periph_trace_t trace);
+void machine_set_exception_trace(machine_t *machine, exception_trace_t trace);
+void machine_set_stub_handler(machine_t *machine, stub_call_t call);
+bool machine_add_stub_range(machine_t *machine, uint32_t start, uint32_t end);
+void machine_set_svc_stub(machine_t *machine, uint32_t number, bool stub);
+void machine_set_host_timer(machine_t *machine, host_timer_t fire, uint64_t cycle);
+void machine_set_boot_vectors(machine_t *machine, uint32_t offset);
+void machine_wait_for_event(machine_t *machine);
+bool machine_enable_trace_ring(machine_t *machine, uint32_t size, trace_flush_t flush);
+void machine_trace_ring_periph(machine_t *machine, uint32_t address, bool store, uint32_t value, uint32_t pc);
+void machine_trace_ring_bus(machine_t *machine, bus_op_t op, uint32_t device, uint8_t out, uint8_t in, bool ack);
+void machine_trace_ring_watch(machine_t *machine, uint32_t watches, uint32_t pc);
+void machine_trace_ring_exception(machine_t *machine, uint32_t exception, bool enter);
+void machine_set_trace_sample(machine_t *machine, uint32_t address);
+bool machine_set_watches(machine_t *machine, watch_t changed, const uint32_t *address, const uint32_t *size, size_t count);
+void machine_set_radio(machine_t *machine, radio_send_t send);
+bool machine_radio_receive(machine_t *machine, const uint8_t *packet, uint32_t length, uint32_t frequency, uint32_t mode, uint64_t address);
+bool machine_radio_listening(machine_t *machine, uint32_t *frequency, uint32_t *mode, uint64_t *address);
+void machine_radio_send(machine_t *machine, const uint8_t *packet, uint32_t length, uint32_t frequency, uint32_t mode, uint64_t address);
+void machine_set_uart_output(machine_t *machine, uint32_t index, uart_output_t output);
+void machine_set_uart_receive(machine_t *machine, uint32_t index, uart_receive_t receive);
+bool machine_can_receive(machine_t *machine, const can_frame_t *frame);
+uint64_t machine_time_us(machine_t *machine);
+int machine_gpio_level(machine_t *machine, uint32_t pin);
+void machine_set_gpio_input(machine_t *machine, uint32_t pin, int level);
+int machine_connect_gpio(machine_t *machine, uint32_t a, uint32_t b, bool connected);
+void machine_set_deterministic(machine_t *machine, bool deterministic);
+void machine_set_fast_forward(machine_t *machine, bool enabled);
+void machine_set_time_while_halted(machine_t *machine, bool enabled);
+void machine_set_debug_mask(machine_t *machine, bool mask);
 void machine_free(machine_t *machine);
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// #include "machine.h"
+// void machineUARTOutput(machine_t *machine, uint32_t uart, uint8_t c);
+// int machineUARTReceive(machine_t *machine, uint32_t uart, bool take);
+import "C"
+
+// This file contains what is needed to run several machines in one process,
+// each with its own GDB server and peripherals. The C core calls back into Go
+// with only the machine as context, so the Go state of a machine is looked up
+// in a machineMap. Machines run on different goroutines, so these maps are
+// locked.
+
+// A map from a C machine to its Go state of some kind, safe for concurrent use.
+type machineMap[T any] struct {
+	lock   sync.RWMutex
+	values map[*C.machine_t]T
+}
+
+// Return the value for this machine, or the zero value if there is none.
+func (mm *machineMap[T]) get(machine *C.machine_t) T {
+	mm.lock.RLock()
+	defer mm.lock.RUnlock()
+	return mm.values[machine]
+}
+
+func (mm *machineMap[T]) set(machine *C.machine_t, value T) {
+	mm.lock.Lock()
+	defer mm.lock.Unlock()
+	if mm.values == nil {
+		mm.values = make(map[*C.machine_t]T)
+	}
+	mm.values[machine] = value
+}
+
+func (mm *machineMap[T]) delete(machine *C.machine_t) {
+	mm.lock.Lock()
+	defer mm.lock.Unlock()
+	delete(mm.values, machine)
+}
+
+// Machines with their own UART output or input, see SetUARTOutput and
+// SetUARTInput.
+var (
+	uartOutputs machineMap[[C.MACHINE_NUM_UARTS]io.Writer]
+	uartInputs  machineMap[[C.MACHINE_NUM_UARTS]*uartInput]
+)
+
+// SetUARTOutput sends the output of a UART of this machine to w, instead of to
+// the terminal that is shared by all machines in the process. The UART then
+// only receives input that is injected, for example through the control
+// socket, or that is set with SetUARTInput. This must be called before the
+// machine starts running.
+func (m *Machine) SetUARTOutput(uart int, w io.Writer) {
+	outputs := uartOutputs.get(m.machine)
+	outputs[uart] = w
+	uartOutputs.set(m.machine, outputs)
+	C.machine_set_uart_output(m.machine, C.uint32_t(uart), C.uart_output_t(C.machineUARTOutput))
+}
+
+// UARTOutput returns the writer that SetUARTOutput set for a UART, or nil.
+func (m *Machine) UARTOutput(uart int) io.Writer {
+	return uartOutputs.get(m.machine)[uart]
+}
+
+// SetUARTInput makes a UART of this machine receive what is read from r,
+// instead of input from the terminal. Output of the UART then only goes to
+// what SetUARTOutput set. This must be called before the machine starts
+// running.
+func (m *Machine) SetUARTInput(uart int, r io.Reader) {
+	inputs := uartInputs.get(m.machine)
+	inputs[uart] = newUARTInput(r, terminalQueue)
+	uartInputs.set(m.machine, inputs)
+	C.machine_set_uart_receive(m.machine, C.uint32_t(uart), C.uart_receive_t(C.machineUARTReceive))
+}
+
+//export machineUARTOutput
+func machineUARTOutput(machine *C.machine_t, uart C.uint32_t, c C.uint8_t) {
+	uartOutputs.get(machine)[uart].Write([]byte{byte(c)})
+}
+
+//export machineUARTReceive
+func machineUARTReceive(machine *C.machine_t, uart C.uint32_t, take C.bool) C.int {
+	return C.int(uartInputs.get(machine)[uart].next(bool(take)))
+}
+
+// Close frees the machine and everything that is attached to it. The machine
+// must not be running.
+func (m *Machine) Close() {
+	machine := m.machine
+	for _, f := range m.hostFiles {
+		f.Close()
+	}
+	if f := sdcardImages.get(machine); f != nil {
+		f.Close()
+	}
+	if r := traceRings.get(machine); r != nil {
+		r.close()
+	}
+	analogMachines.delete(machine)
+	audioMachines.delete(machine)
+	busLogs.delete(machine)
+	canBuses.delete(machine)
+	displays.delete(machine)
+	peripheralBuses.delete(machine)
+	periphTraceMachines.delete(machine)
+	probeCaptures.delete(machine)
+	rtosTracers.delete(machine)
+	sdcardImages.delete(machine)
+	sensorBuses.delete(machine)
+	softDevices.delete(machine)
+	stubSets.delete(machine)
+	swarmNodes.delete(machine)
+	traceRings.delete(machine)
+	uartInputs.delete(machine)
+	uartOutputs.delete(machine)
+	watchManagers.delete(machine)
+	ws2812Outputs.delete(machine)
+	C.machine_free(machine)
+	m.machine = nil
+}
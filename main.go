@@ -1,25 +1,197 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math/rand"
 	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 	"unsafe"
 )
 
 // #include "machine.h"
-// #include "terminal.h"
 import "C"
 
 var (
 	flagRAMSize       int
 	flagFlashSize     int
+	flagQSPIFlash     int
+	flagQSPIImage     string
+	flagExtRAM        stringList
+	flagSDCard        string
+	flagSDCardCS      string
+	flagSensors       stringList
+	flagDisplays      stringList
+	flagScreenshot    stringList
 	flagFlashPageSize int
+	flagFlashFile     string
+	flagFLM           string
+	flagConfig        string
 	flagLoglevel      string
 	flagGdbServer     string
+	flagGdbKill       string
+	flagGdbWait       bool
+	flagGdbDetach     string
+	flagWatchFirmware bool
+	flagControl       string
+	flagCMSISDAP      string
+	flagMetrics       string
+	flagTop           string
+	flagTopRate       int
+	flagTUI           bool
+	flagResetReason   string
+	flagStats         bool
+	flagHistogram     bool
+	flagCosim         string
+	flagCosimReset    string
+	flagCosimInterval int
+	flagGolden        string
+	flagGoldenEvery   uint64
+	flagVerify        string
+	flagPeripherals   stringList
+	flagPlatform      string
+	flagSVD           string
+	flagSwarm         int
+	flagSwarmUART     stringList
+	flagSwarmQuantum  time.Duration
+	flagSwarmDuration time.Duration
+	flagPeriphTrace   bool
+	flagRTOSTrace     string
+	flagRTOS          string
+	flagMachine       string
+	flagSoftDevice    string
+	flagStubs         stringList
+	flagWakeupLatency [2]int
+	flagClock         int
+	flagDeterministic bool
+	flagFastForward   bool
+	flagHaltedTime    bool
+	flagPower         bool
+	flagPowerModel    string
+	flagBattery       float64
+	flagFaults        stringList
+	flagFaultSeed     int64
+	flagInputs        stringList
+	flagAnalog        stringList
+	flagCAN           stringList
+	flagDevice        stringList
+	flagScript        string
+	flagWS2812        string
+	flagWS2812Format  string
+	flagWS2812Output  string
+	flagProbes        stringList
+	flagProbeOutput   string
+	flagProbeRate     int
+	flagBusLog        stringList
+	flagBusLogOutput  string
+	flagAudioOut      string
+	flagAudioIn       string
+	flagFlashCut      [2]float64
+	flagUARTInput     string
+	flagUARTTiming    bool
+	flagUARTBaud      int
+	flagUARTQueue     int
+	flagUARTPacing    time.Duration
+	flagUART          [C.MACHINE_NUM_UARTS]string
+	flagFuzz          string
+	flagFuzzArtifacts string
+	flagFuzzRuns      int
+	flagFuzzTimeout   uint64
+	flagFuzzMaxLen    int
+	flagFuzzChannel   string
+	flagFuzzReplay    string
+	flagMaxInstrs     uint64
+	flagCheckpoints   uint64
+	flagCheckpointDir string
+	flagCheckpointN   int
+	flagRestore       string
+	flagTimeout       time.Duration
+	flagDump          bool
+	flagBreak         stringList
+	flagWatch         stringList
+	flagPanics        bool
+	flagHangs         uint64
+	flagPermissions   string
+	flagCoverage      string
+	flagBatchJobs     int
+	flagBatchReport   string
+	flagStackGuard    bool
+	flagStackGuardRet bool
+	flagRunUntil      string
+	flagLogFilter     string
 )
 
+// Exit status when stopped by -max-instructions, -timeout or -detect-hangs, the
+// same as the timeout(1) command uses.
+const exitTimeout = 124
+
+// A chip family, chip or board that can be selected with -machine, with the
+// flag defaults that match it. Zero values keep the default of the flag.
+type machinePreset struct {
+	family    C.family_t
+	base      string // the family preset of a chip or board
+	flashBase uint32
+	flash     int // kB
+	ram       int // kB
+	pageSize  int
+	clock     int // Hz
+}
+
+// Chip presets, see machinePresets.
+var (
+	presetNRF51822  = machinePreset{family: C.FAMILY_NRF, base: "nrf", flash: 256, ram: 16}
+	presetNRF52832  = machinePreset{family: C.FAMILY_NRF, base: "nrf", flash: 512, ram: 64, pageSize: 4096, clock: 64000000}
+	presetNRF52833  = machinePreset{family: C.FAMILY_NRF, base: "nrf", flash: 512, ram: 128, pageSize: 4096, clock: 64000000}
+	presetNRF52840  = machinePreset{family: C.FAMILY_NRF, base: "nrf", flash: 1024, ram: 256, pageSize: 4096, clock: 64000000}
+	presetSTM32F103 = machinePreset{family: C.FAMILY_STM32, base: "stm32", flashBase: 0x08000000, flash: 64, ram: 20, pageSize: 1024, clock: 72000000}
+	presetRP2040    = machinePreset{family: C.FAMILY_RP2040, base: "rp2040", flashBase: 0x10000000, flash: 2048, ram: 264, pageSize: 4096, clock: 125000000}
+)
+
+// The chip families, and the chips and boards that are named like their
+// TinyGo targets so that a TinyGo target can pass its name to -machine. The
+// boards at the end are named like the BOARD of the nrf port of MicroPython,
+// for the boards that have their REPL on the UART.
+var machinePresets = map[string]machinePreset{
+	"nrf":    {family: C.FAMILY_NRF},
+	"stm32":  {family: C.FAMILY_STM32, flashBase: 0x08000000},
+	"rp2040": presetRP2040,
+
+	"nrf51822":              presetNRF51822,
+	"microbit":              presetNRF51822,
+	"nrf52832":              presetNRF52832,
+	"pca10040":              presetNRF52832,
+	"nrf52833":              presetNRF52833,
+	"microbit-v2":           presetNRF52833,
+	"pca10100":              presetNRF52833,
+	"nrf52840":              presetNRF52840,
+	"pca10056":              presetNRF52840,
+	"pca10059":              presetNRF52840,
+	"feather-nrf52840":      presetNRF52840,
+	"itsybitsy-nrf52840":    presetNRF52840,
+	"circuitplay-bluefruit": presetNRF52840,
+	"nrf52840-mdk":          presetNRF52840,
+	"stm32f103":             presetSTM32F103,
+	"bluepill":              presetSTM32F103,
+	"pico":                  presetRP2040,
+
+	"MICROBIT":      presetNRF51822,
+	"PCA10040":      presetNRF52832,
+	"FEATHER52":     presetNRF52832,
+	"ARDUINO_PRIMO": presetNRF52832,
+	"EVK_NINA_B1":   presetNRF52832,
+	"DVK_BL652":     presetNRF52832,
+	"PCA10056":      presetNRF52840,
+}
+
 var loglevels = map[string]int{
 	"none":    C.LOG_NONE,
 	"error":   C.LOG_ERROR,
@@ -30,22 +202,226 @@ var loglevels = map[string]int{
 	"instrs":  C.LOG_INSTRS,
 }
 
+var resetReasons = map[string]uint32{
+	"poweron": C.RESET_POWERON,
+	"pin":     C.RESET_PIN,
+	"dog":     C.RESET_DOG,
+	"sreq":    C.RESET_SREQ,
+	"lockup":  C.RESET_LOCKUP,
+}
+
 func isPowerOfTwo(n int) bool {
 	// https://stackoverflow.com/a/600306/559350
 	return n >= 0 && (n&(n-1)) == 0
 }
 
+// Parse an -ext-ram region: ADDRESS:SIZE, with the size in kB.
+func parseExtRAM(spec string) (start uint32, size int, err error) {
+	address, kb, ok := strings.Cut(spec, ":")
+	if !ok {
+		return 0, 0, fmt.Errorf("expected ADDRESS:SIZE, got %#v", spec)
+	}
+	n, err := strconv.ParseUint(address, 0, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid address in %#v", spec)
+	}
+	size, err = strconv.Atoi(kb)
+	if err != nil || size <= 0 {
+		return 0, 0, fmt.Errorf("invalid size in %#v", spec)
+	}
+	return uint32(n), size * 1024, nil
+}
+
 func main() {
+	arguments := os.Args[1:]
+	command := ""
+	if len(arguments) != 0 {
+		if _, ok := commands[arguments[0]]; ok {
+			command = arguments[0]
+			arguments = arguments[1:]
+		}
+	}
+	if command == "flash" {
+		os.Exit(runFlashCommand(arguments, os.Stdout))
+	}
+
 	flag.IntVar(&flagRAMSize, "ram", 32, "RAM size in kB")
 	flag.IntVar(&flagFlashSize, "flash", 256, "flash size in kB")
 	flag.IntVar(&flagFlashPageSize, "pagesize", 1024, "flash page size in bytes")
+	flag.StringVar(&flagFlashFile, "flash-file", "", "keep the flash contents in this file across runs: it is loaded under the firmware at start and written at exit (see \"emculator flash\")")
+	flag.StringVar(&flagFLM, "flm", "", "program the firmware into flash with this CMSIS-Pack flash algorithm (FLM file) and check the result, instead of running it")
+	flag.IntVar(&flagQSPIFlash, "qspi-flash", 0, "size in kB of the external flash behind the nRF52840 QSPI peripheral (0 means none)")
+	flag.StringVar(&flagQSPIImage, "qspi-image", "", "initial contents of the -qspi-flash external flash, like a littlefs image")
+	flag.Var(&flagExtRAM, "ext-ram", "add external RAM, like SDRAM or PSRAM, as ADDRESS:SIZE with the size in kB, like 0x60000000:8192 (repeatable)")
+	flag.StringVar(&flagSDCard, "sdcard", "", "attach an SD card to the SPI bus, backed by this disk image (which is modified)")
+	flag.StringVar(&flagSDCardCS, "sdcard-cs", "", "chip select pin of the SD card, like P0.22 (nRF), PA4 (STM32) or 17 (RP2040); empty means always selected")
+	flag.Var(&flagSensors, "sensor", "attach a sensor like \"bme280@0x76 temperature=sine(20,5,10s)\" or \"bmi160@spi:P0.10 file=motion.csv\" (repeatable)")
+	flag.Var(&flagDisplays, "display", "attach an SPI display like \"st7789@spi:P0.10 dc=P0.11\" or \"ili9341@spi:PA4 dc=PA3 rotate=90\" (repeatable)")
+	flag.Var(&flagScreenshot, "screenshot", "save the image of the -display as a PNG file when the firmware stops, as PATH or NAME=PATH (repeatable)")
+	flag.Var(&flagAnalog, "analog", "set the voltage on an analog input of the nRF52 SAADC, like AIN0=1.65 or AIN1=sine(1.5,1,20ms) (repeatable)")
+	flag.Var(&flagInputs, "input", "attach an input device like \"button:b1 pin=P0.13 key=b\", \"encoder:knob a=P0.2 b=P0.3\" or \"keypad:keys rows=PA0,PA1,PA2,PA3 cols=PA4,PA5,PA6\" (repeatable)")
+	flag.StringVar(&flagScript, "script", "", "run the TIME COMMAND lines in this file in emulated time, like \"100ms click b1\", \"1s uart AT\\r\" or \"1s expect OK within 500ms\"")
+	flag.StringVar(&flagScript, "input-script", "", "old name of -script")
+	flag.StringVar(&flagWS2812, "ws2812", "", "decode the data line of WS2812 (NeoPixel) LEDs on this pin, like P0.16")
+	flag.StringVar(&flagWS2812Format, "ws2812-format", "grb", "byte order of the -ws2812 LEDs: grb, rgb or grbw")
+	flag.StringVar(&flagWS2812Output, "ws2812-output", "term", "where -ws2812 frames go: term (colored blocks) or json:PATH (an object per line, - for stdout)")
+	flag.Var(&flagProbes, "probe", "record the level of a GPIO pin like a logic analyzer, like P0.26 or sda=P0.26 (repeatable)")
+	flag.StringVar(&flagProbeOutput, "probe-output", "probe.sr", "sigrok session file (for PulseView and sigrok-cli) to write the -probe levels to")
+	flag.IntVar(&flagProbeRate, "probe-rate", 4000000, "sample rate of -probe in Hz")
+	flag.Var(&flagBusLog, "buslog", "log bus transactions: i2c, i2c:ADDRESS, spi:PIN (chip select, optionally NAME=PIN) or uart (repeatable)")
+	flag.StringVar(&flagBusLogOutput, "buslog-output", "", "write the -buslog transactions to this file instead of stderr")
+	flag.Var(&flagCAN, "can", "attach an endpoint to the CAN bus: log, log:PATH (candump format) or socketcan:IFACE like socketcan:vcan0 (repeatable)")
+	flag.StringVar(&flagAudioOut, "audio-out", "", "write the samples that the firmware plays over I2S to this WAV file")
+	flag.StringVar(&flagAudioIn, "audio-in", "", "feed this WAV file to the I2S and PDM (microphone) inputs, as a recording that starts with the machine")
 	flag.StringVar(&flagLoglevel, "loglevel", "error", "error, warning, calls, instrs")
-	flag.StringVar(&flagGdbServer, "gdb", "localhost:7333", "GDB target port")
-	flag.Parse()
+	flag.StringVar(&flagGdbServer, "gdb", "localhost:7333", "GDB target port: host:port, unix:PATH or stdio")
+	flag.StringVar(&flagGdbDetach, "gdb-detach", "resume", "what happens when GDB detaches or disconnects: resume (let the firmware run) or halt (keep it halted until GDB connects again)")
+	flag.BoolVar(&flagGdbWait, "wait-for-debugger", false, "keep the machine halted at the reset vector until GDB connects and continues it, like \"reset halt\" on a debug probe")
+	flag.BoolVar(&flagWatchFirmware, "watch-firmware", false, "reload the firmware image and reset when the file changes, like after a new build, and keep running when the firmware exits or crashes")
+	flag.StringVar(&flagControl, "control", "", "serve a JSON-RPC control socket at this path")
+	flag.StringVar(&flagCMSISDAP, "cmsis-dap", "", "serve a virtual CMSIS-DAP debug probe (for pyOCD, probe-rs or OpenOCD) over USB/IP at this address, like localhost:3240")
+	flag.StringVar(&flagCosim, "cosim", "", "run in lock-step with a real chip behind this GDB server (like localhost:3333) and report the first divergence")
+	flag.StringVar(&flagCosimReset, "cosim-reset", "reset halt", "monitor command that resets and halts the chip before co-simulation")
+	flag.IntVar(&flagCosimInterval, "cosim-interval", 1, "compare registers every this many instructions during co-simulation")
+	flag.StringVar(&flagGolden, "golden", "", "run for -max-instructions instructions and write a digest of the registers and output to this JSON file")
+	flag.Uint64Var(&flagGoldenEvery, "golden-interval", 10000, "hash the registers every this many instructions for -golden")
+	flag.StringVar(&flagVerify, "verify", "", "run like the golden trace in this JSON file was recorded and fail if the firmware behaves differently")
+	flag.Var(&flagDevice, "device", "set factory information: id=HEX, addr=XX:XX:XX:XX:XX:XX, temperature=DEGREES or uicr:OFFSET=VALUE (repeatable)")
+	flag.StringVar(&flagMachine, "machine", "nrf", "chip family: nrf, stm32 (STM32F1/F4 with flash at 0x08000000) or rp2040 (both cores, flash at 0x10000000), or a chip or TinyGo or MicroPython board like nrf52840, pca10040, pico or FEATHER52")
+	flag.StringVar(&flagSoftDevice, "softdevice", "", "run an application built for a SoftDevice, which is emulated: s132 or s140, optionally with the application start like s140:0x27000")
+	flag.Var(&flagStubs, "stub", "implement a ROM function or supervisor call, like 0x1fff1ff1=return:0 or svc:0x10=return (repeatable)")
+	flag.StringVar(&flagPlatform, "platform", "", "take the flash and RAM size and peripheral placement from this Renode platform description (.repl)")
+	flag.StringVar(&flagSVD, "svd", "", "name the peripheral registers in -periphtrace after this CMSIS-SVD file")
+	flag.BoolVar(&flagPeriphTrace, "periphtrace", false, "log every peripheral register access, named after -svd and -platform")
+	flag.StringVar(&flagRTOSTrace, "rtos-trace", "", "write the task switches and interrupt handlers to this file, in the Trace Event Format of Perfetto")
+	flag.StringVar(&flagRTOS, "rtos", "freertos", "how -rtos-trace finds the running task: freertos, or SYMBOL[:OFFSET] for a pointer to it with the name at OFFSET")
+	flag.Var(&flagPeripherals, "peripheral", "map an external peripheral model, like 0x40010000:0x1000:exec:./model or START:SIZE:plugin:model.so or START:SIZE:tcp:PORT (repeatable)")
+	flag.StringVar(&flagMetrics, "metrics", "", "serve Prometheus metrics over HTTP on this address, like localhost:9100")
+	flag.StringVar(&flagTop, "top", "", "show the functions where the firmware spends its time in a live table on this terminal or file (- for stderr)")
+	flag.IntVar(&flagTopRate, "top-rate", 1000, "PC samples per second of host time for -top")
+	flag.BoolVar(&flagTUI, "tui", false, "show a dashboard with the registers, the code, GPIO, the UART and a command line on the terminal")
+	flag.StringVar(&flagGdbKill, "gdb-kill", "exit", "what the GDB kill command does: exit (stop the emulator) or reset (restart the program)")
+	flag.StringVar(&flagResetReason, "resetreason", "poweron", "initial reset reason: poweron, pin, dog, sreq, lockup")
+	flag.BoolVar(&flagStats, "stats", false, "print execution and sleep statistics at exit")
+	flag.BoolVar(&flagHistogram, "histogram", false, "print a histogram of executed instructions and the undefined instructions that were hit at exit")
+	flag.IntVar(&flagWakeupLatency[0], "wakeup-latency", 16, "cycles needed to wake up from sleep")
+	flag.IntVar(&flagWakeupLatency[1], "deepsleep-latency", 1024, "cycles needed to wake up from deep sleep")
+	flag.IntVar(&flagClock, "clock", 16000000, "CPU clock frequency in Hz")
+	flag.BoolVar(&flagDeterministic, "deterministic", false, "derive all time and randomness from the cycle counter and -fault-seed")
+	flag.BoolVar(&flagFastForward, "fast-forward", false, "skip the time that the firmware sleeps or idles until the next timer event, instead of waiting for it with the host clock (always done with -deterministic)")
+	flag.BoolVar(&flagHaltedTime, "time-while-halted", false, "keep timers running with the host clock while the machine is halted in the debugger, like on real hardware")
+	flag.BoolVar(&flagPower, "power", false, "print a power consumption estimate at exit")
+	flag.StringVar(&flagPowerModel, "power-model", defaultPowerModel, "current per CPU state and per peripheral")
+	flag.Float64Var(&flagBattery, "battery", 0, "battery capacity in mAh, for a battery life estimate")
+	flag.Var(&flagFaults, "fault-inject", "inject a fault, like flip:ADDR:BIT@TIME or brownout@TIME (repeatable)")
+	flag.Int64Var(&flagFaultSeed, "fault-seed", 1, "random seed for fault injection and sensor noise (and the RNG with -deterministic)")
+	flag.Float64Var(&flagFlashCut[0], "flash-cut-erase", 0, "probability (0..1) that a flash page erase is interrupted by a power cut")
+	flag.Float64Var(&flagFlashCut[1], "flash-cut-write", 0, "probability (0..1) that a flash write is interrupted by a power cut")
+	flag.StringVar(&flagUART[0], "uart0", "stdio", "UART0 backend: stdio or telnet:PORT")
+	for i := 1; i < len(flagUART); i++ {
+		flag.StringVar(&flagUART[i], fmt.Sprintf("uart%d", i), "none", fmt.Sprintf("UART%d backend: none or telnet:PORT", i))
+	}
+	flag.StringVar(&flagUARTInput, "uart-input", "", "read UART input from this file instead of the terminal")
+	flag.BoolVar(&flagUARTTiming, "uart-timing", false, "make UART characters take as long as at the baud rate of the firmware, so that the receive FIFO can overrun")
+	flag.IntVar(&flagUARTBaud, "uart-baud", 0, "baud rate of the host side of the UART: characters are received with framing errors when the firmware uses another (0 means any)")
+	flag.IntVar(&flagUARTQueue, "uart-queue", 256, "depth of the UART input queue, which holds input until the firmware receives it, also while the machine is halted")
+	flag.DurationVar(&flagUARTPacing, "uart-pacing", 0, "minimum emulated time between received UART characters, like 1ms, so that each raises its own RX interrupt")
+	flag.IntVar(&flagSwarm, "swarm", 0, "run this many machines in lockstep, with one firmware image for all or one each, sharing the air for their radios")
+	flag.Var(&flagSwarmUART, "swarm-uart", "connect the UARTs of two machines of the swarm, like 0-1 (repeatable)")
+	flag.DurationVar(&flagSwarmQuantum, "swarm-quantum", 100*time.Microsecond, "emulated time each machine of the swarm runs before the others catch up")
+	flag.DurationVar(&flagSwarmDuration, "swarm-duration", 0, "stop the swarm after this much emulated time (0 means when all machines stopped)")
+	flag.StringVar(&flagFuzz, "fuzz", "", "fuzz the input of -fuzz-channel, using this corpus directory")
+	flag.StringVar(&flagFuzzArtifacts, "fuzz-artifacts", ".", "directory to store crashing fuzz inputs")
+	flag.IntVar(&flagFuzzRuns, "fuzz-runs", 0, "number of fuzz inputs to try (0 means no limit)")
+	flag.Uint64Var(&flagFuzzTimeout, "fuzz-timeout", 10000000, "maximum number of cycles per fuzz input")
+	flag.IntVar(&flagFuzzMaxLen, "fuzz-maxlen", 4096, "maximum length of a fuzz input")
+	flag.StringVar(&flagFuzzChannel, "fuzz-channel", "uart", "where fuzz inputs go: uart, radio (packets that each start with their length) or i2c@ADDRESS (a device that returns a byte per read)")
+	flag.StringVar(&flagFuzzReplay, "fuzz-replay", "", "run a single fuzz input from this file, like -fuzz does")
+	flag.Uint64Var(&flagMaxInstrs, "max-instructions", 0, "stop after this many instructions and exit with status 124 (0 means no limit)")
+	flag.Uint64Var(&flagCheckpoints, "checkpoint-interval", 0, "save the machine state every this many million instructions, to restore it later with -restore (0 disables this)")
+	flag.StringVar(&flagCheckpointDir, "checkpoint-dir", "checkpoints", "directory to save the -checkpoint-interval checkpoints in")
+	flag.IntVar(&flagCheckpointN, "checkpoint-keep", 3, "number of -checkpoint-interval checkpoints to keep, the oldest are removed")
+	flag.StringVar(&flagRestore, "restore", "", "start from the machine state in this checkpoint file instead of from reset, with the same firmware and memory flags as when it was saved")
+	flag.DurationVar(&flagTimeout, "timeout", 0, "stop after this much host time and exit with status 124 (0 means no timeout)")
+	flag.BoolVar(&flagDump, "dump", false, "print registers and stack when stopped by -max-instructions, -timeout, a signal or a breakpoint")
+	flag.BoolVar(&flagPanics, "detect-panics", true, "stop when the firmware calls a fatal error handler like abort, __assert_func or the TinyGo and Zephyr panic handlers, and print its message")
+	flag.Uint64Var(&flagHangs, "detect-hangs", 100, "stop when the firmware runs a tight loop with interrupts disabled for this many million cycles (0 disables this)")
+	flag.BoolVar(&flagStackGuard, "stack-guard", false, "stop when the firmware stores into the registers a function saved on the stack, like its return address (needs .debug_frame in the ELF file)")
+	flag.BoolVar(&flagStackGuardRet, "stack-guard-return", false, "like -stack-guard, and also stop when a function returns to another address than was saved")
+	flag.StringVar(&flagPermissions, "permissions", "", "what to do when the firmware runs code from RAM or writes to flash without the flash controller, like \"exec-ram=warn,write-flash=fault\" (allow, warn or fault)")
+	flag.Var(&flagWatch, "watch", "print a value whenever it changes, like \"0x20001234 u32 as ticks\" or a symbol name (repeatable)")
+	flag.Var(&flagBreak, "break", "stop at this symbol or address, optionally with a condition and actions like \"putc if r0 == 10 do log newline; continue\" (repeatable)")
+	flag.StringVar(&flagRunUntil, "run-until", "", "run until this symbol or address is reached, then stop")
+	flag.StringVar(&flagLogFilter, "log-filter", "", "with -loglevel=calls, only log calls to functions matching this regular expression")
+	flag.StringVar(&flagCoverage, "coverage", "", "write the line and function coverage to this lcov tracefile at exit (a directory for batch)")
+	flag.IntVar(&flagBatchJobs, "batch-jobs", 1, "number of firmware images that batch runs at the same time")
+	flag.StringVar(&flagBatchReport, "batch-report", "", "write the results of batch to this file: JUnit XML if it ends in .xml, JSON otherwise")
+	flag.StringVar(&flagConfig, "config", defaultConfigFile, "read defaults for these flags and the firmware image from this TOML file, if it exists")
+	flag.Usage = printUsage
+	flag.CommandLine.Parse(arguments)
 
-	if flag.NArg() != 1 {
+	// Tests and batches run each firmware in a process of its own, which reads
+	// the configuration file itself: only the command line is passed on.
+	if command == "test" {
+		os.Exit(runTests(flag.Args(), commandLineFlags(), os.Stdout))
+	}
+	if command == "batch" {
+		os.Exit(runBatch(flag.Args(), commandLineFlags("batch-jobs", "batch-report", "coverage"), os.Stdout))
+	}
+
+	args := flag.Args()
+	configFirmware, err := applyConfig(flagConfig, flagConfig != defaultConfigFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: config:", err)
+		os.Exit(1)
+	}
+	if len(args) == 0 {
+		args = configFirmware
+	}
+	if len(args) != 1 && !(flagSwarm > 1 && len(args) == flagSwarm) {
 		fmt.Fprintln(os.Stderr, "error: provide a firmware image")
-		flag.PrintDefaults()
+		printUsage()
+		os.Exit(1)
+	}
+	if err := setCommandDefaults(command); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+	if flagGdbWait && flagGdbServer == "" {
+		fmt.Fprintln(os.Stderr, "error: -wait-for-debugger needs a GDB server, set -gdb")
+		os.Exit(1)
+	}
+
+	preset, ok := machinePresets[flagMachine]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "error: unknown -machine:", flagMachine)
+		os.Exit(1)
+	}
+	// Flags that are set explicitly override the machine preset and the
+	// platform.
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	if preset.flash != 0 && !set["flash"] {
+		flagFlashSize = preset.flash
+	}
+	if preset.ram != 0 && !set["ram"] {
+		flagRAMSize = preset.ram
+	}
+	if preset.pageSize != 0 && !set["pagesize"] {
+		flagFlashPageSize = preset.pageSize
+	}
+	if preset.clock != 0 && !set["clock"] {
+		flagClock = preset.clock
+	}
+
+	if flagQSPIFlash < 0 || (flagQSPIFlash != 0 && preset.family != C.FAMILY_NRF) {
+		fmt.Fprintln(os.Stderr, "error: -qspi-flash is only supported with -machine=nrf")
+		os.Exit(1)
+	}
+	if flagQSPIImage != "" && flagQSPIFlash == 0 {
+		fmt.Fprintln(os.Stderr, "error: -qspi-image needs -qspi-flash")
 		os.Exit(1)
 	}
 
@@ -61,56 +437,835 @@ func main() {
 		os.Exit(1)
 	}
 
-	f, err := os.Open(flag.Arg(0))
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "cannot open firmware image:", err)
+	if _, ok := resetReasons[flagResetReason]; !ok {
+		fmt.Fprintln(os.Stderr, "error: resetreason must be one of: poweron, pin, dog, sreq, lockup")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if flagGdbKill != "exit" && flagGdbKill != "reset" {
+		fmt.Fprintln(os.Stderr, "error: gdb-kill must be one of: exit, reset")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if flagGdbDetach != "resume" && flagGdbDetach != "halt" {
+		fmt.Fprintln(os.Stderr, "error: gdb-detach must be one of: resume, halt")
+		flag.PrintDefaults()
 		os.Exit(1)
 	}
-	defer f.Close()
-	st, err := f.Stat()
+
+	if _, err := parsePermissions(flagPermissions); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+
+	if flagClock <= 0 {
+		fmt.Fprintln(os.Stderr, "error: clock must be positive")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	powerModel, err := parsePowerModel(flagPowerModel)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "cannot stat firmware image:", err)
+		fmt.Fprintln(os.Stderr, "error:", err)
 		os.Exit(1)
 	}
-	if st.Size() > int64(flagFlashSize*1024) {
-		fmt.Fprintln(os.Stderr, "firmware does not fit in flash")
+
+	faults, err := parseFaults(flagFaults, flagClock, rand.New(rand.NewSource(flagFaultSeed)))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
 		os.Exit(1)
 	}
-	cfirmware := C.malloc(C.size_t(st.Size()))
-	defer C.free(cfirmware)
-	firmware := (*[1 << 30]byte)(unsafe.Pointer(cfirmware))[:st.Size():st.Size()]
-	_, err = io.ReadFull(f, firmware)
+
+	var plat *platform
+	if flagPlatform != "" {
+		plat, err = loadPlatform(flagPlatform, preset.flashBase)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: platform:", err)
+			os.Exit(1)
+		}
+		if plat.flashSize != 0 && !set["flash"] {
+			flagFlashSize = int((plat.flashSize + 1023) / 1024)
+		}
+		if plat.ramSize != 0 && !set["ram"] {
+			flagRAMSize = int((plat.ramSize + 1023) / 1024)
+		}
+	}
+
+	firmware, debug, releaseFirmware, err := loadFirmware(args[0], preset.flashBase, flagFlashSize*1024)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "cannot read firmware image:", err)
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	if command == "inspect" {
+		if err := inspectFirmware(os.Stdout, args[0], firmware, debug, preset.flashBase, flagFlashSize*1024); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	var symbols map[string]symbol
+	if debug != nil {
+		symbols = debug.symbols
+	}
+
+	var logFilter *regexp.Regexp
+	if flagLogFilter != "" {
+		logFilter, err = regexp.Compile(flagLogFilter)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: invalid -log-filter:", err)
+			os.Exit(1)
+		}
+	}
+
+	var breakpoints []Breakpoint
+	for _, s := range flagBreak {
+		bp, err := parseBreakpoint(s, symbols)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+		breakpoints = append(breakpoints, bp)
+	}
+	var watches []Watch
+	for _, s := range flagWatch {
+		w, err := parseWatch(s, symbols)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+		watches = append(watches, w)
+	}
+	var runUntil uint32
+	if flagRunUntil != "" {
+		runUntil, err = resolveAddress(flagRunUntil, symbols)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+	}
+
+	if flagFuzz != "" || flagFuzzReplay != "" {
+		if flagFlashFile != "" {
+			firmware, err = loadFlashFile(flagFlashFile, firmware, flagFlashSize*1024)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "error: flash file:", err)
+				os.Exit(1)
+			}
+		}
+		config := FuzzConfig{
+			Machine:     flagMachine,
+			FlashSize:   flagFlashSize * 1024,
+			PageSize:    flagFlashPageSize,
+			RAMSize:     flagRAMSize * 1024,
+			Clock:       flagClock,
+			Permissions: flagPermissions,
+			Timeout:     flagFuzzTimeout,
+		}
+		config.Channel, config.I2CAddress, err = parseFuzzChannel(flagFuzzChannel)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+		var crashed bool
+		if flagFuzzReplay != "" {
+			crashed, err = replayFuzzInput(firmware, config, flagFuzzReplay)
+		} else {
+			crashed, err = runFuzzer(firmware, args[0], config, flagFuzz, flagFuzzArtifacts, flagFuzzRuns, flagFuzzMaxLen, flagFaultSeed)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "fuzz error:", err)
+			os.Exit(1)
+		}
+		if crashed {
+			os.Exit(1)
+		}
+		return
+	}
+	if flagSwarm > 0 {
+		status, err := runSwarm(args, os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "swarm error:", err)
+			os.Exit(1)
+		}
+		os.Exit(status)
+	}
+	if flagGolden != "" || flagVerify != "" {
+		// Golden traces can only be reproduced if time and randomness are.
+		flagDeterministic = true
+	}
 
 	// This is where the MCU is actually started.
 	machine := C.machine_create(C.size_t(flagFlashSize*1024), C.size_t(flagFlashPageSize), C.size_t(flagRAMSize*1024), C.int(loglevels[flagLoglevel]))
-	C.machine_load(machine, (*C.uint8_t)(cfirmware), C.size_t(len(firmware)))
+	C.machine_set_family(machine, preset.family)
+	if err := setDeviceInfo(machine, flagDevice); err != nil {
+		fmt.Fprintln(os.Stderr, "error: device:", err)
+		os.Exit(1)
+	}
+	flashed, flmImage := firmware, []byte(nil)
+	if flagFLM != "" {
+		// The flash algorithm writes the firmware, see runFLM.
+		flashed, flmImage = nil, append([]byte(nil), firmware...)
+	}
+	if err := loadFirmwareWithFlashFile(machine, flashed, flagFlashFile); err != nil {
+		fmt.Fprintln(os.Stderr, "error: flash file:", err)
+		os.Exit(1)
+	}
+	releaseFirmware()
+	addDebugInfo(machine, debug, logFilter)
+	if flagStackGuard || flagStackGuardRet {
+		if err := setStackGuard(machine, debug, flagStackGuardRet); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+	}
+	if flagCoverage != "" {
+		if err := enableCoverage(machine, debug); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+	}
+	C.machine_set_wakeup_latency(machine, C.uint32_t(flagWakeupLatency[0]), C.uint32_t(flagWakeupLatency[1]))
+	C.machine_set_clock(machine, C.uint32_t(flagClock))
+	C.machine_set_deterministic(machine, C.bool(flagDeterministic))
+	C.machine_set_fast_forward(machine, C.bool(flagFastForward))
+	C.machine_set_time_while_halted(machine, C.bool(flagHaltedTime))
+	setPermissions(machine, flagPermissions) // checked above
+	if flagHistogram {
+		C.machine_enable_histogram(machine)
+	}
+	if flagDeterministic {
+		C.machine_seed(machine, C.uint32_t(flagFaultSeed))
+	} else {
+		C.machine_seed(machine, C.uint32_t(time.Now().UnixNano()))
+	}
+	C.machine_set_flash_cut(machine, C.double(flagFlashCut[0]), C.double(flagFlashCut[1]))
+	if flagQSPIFlash != 0 {
+		var image []byte
+		if flagQSPIImage != "" {
+			image, err = ioutil.ReadFile(flagQSPIImage)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "cannot read QSPI flash image:", err)
+				os.Exit(1)
+			}
+			if len(image) > flagQSPIFlash*1024 {
+				fmt.Fprintln(os.Stderr, "error: QSPI flash image does not fit in -qspi-flash")
+				os.Exit(1)
+			}
+		}
+		cimage := C.CBytes(image)
+		C.machine_set_qspi_flash(machine, (*C.uint8_t)(cimage), C.size_t(len(image)), C.size_t(flagQSPIFlash*1024))
+		C.free(cimage)
+	}
+	for _, spec := range flagExtRAM {
+		start, size, err := parseExtRAM(spec)
+		if err == nil && C.machine_add_ram(machine, C.uint32_t(start), C.size_t(size)) < 0 {
+			err = fmt.Errorf("cannot add %s: external RAM must be in 0x60000000..0x9fffffff, without overlapping another region, and there can be %d regions", spec, C.MACHINE_EXT_RAMS)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: -ext-ram:", err)
+			os.Exit(1)
+		}
+	}
+	if flagUARTBaud < 0 {
+		fmt.Fprintln(os.Stderr, "error: -uart-baud must not be negative")
+		os.Exit(1)
+	}
+	C.machine_set_uart_timing(machine, C.bool(flagUARTTiming), C.uint32_t(flagUARTBaud))
+	if err := setUARTQueue(machine, flagUARTQueue, flagUARTPacing); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+	terminalQueue = flagUARTQueue
+	if flagUARTInput != "" {
+		input, err := ioutil.ReadFile(flagUARTInput)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "cannot read UART input:", err)
+			os.Exit(1)
+		}
+		cinput := C.CBytes(input)
+		defer C.free(cinput)
+		C.machine_set_uart_input(machine, (*C.uint8_t)(cinput), C.size_t(len(input)))
+	}
 
 	runChan := make(chan struct{})
-	if flagGdbServer != "" {
+	m := NewMachine(machine, runChan, debug)
+	m.firmware = args[0]
+	m.logFilter = logFilter
+	m.gdbKill = flagGdbKill
+	m.gdbDetach = flagGdbDetach
+	for i, spec := range flagUART {
+		if err := startUARTBackend(m, i, spec); err != nil {
+			fmt.Fprintf(os.Stderr, "error: uart%d: %v\n", i, err)
+			os.Exit(1)
+		}
+	}
+	if flagGdbWait {
+		// Start halted, like after "reset halt" on a debug probe. This must be
+		// set before the GDB server starts.
+		m.setHalted()
+	}
+	for _, spec := range flagPeripherals {
+		if err := addPeripheral(m, spec, plat); err != nil {
+			fmt.Fprintln(os.Stderr, "error: peripheral:", err)
+			os.Exit(1)
+		}
+	}
+	if err := addStubFlags(m, flagStubs); err != nil {
+		fmt.Fprintln(os.Stderr, "error: stub:", err)
+		os.Exit(1)
+	}
+	if flagSoftDevice != "" {
+		if err := addSoftDevice(m, flagSoftDevice); err != nil {
+			fmt.Fprintln(os.Stderr, "error: softdevice:", err)
+			os.Exit(1)
+		}
+	}
+	if flagSDCard != "" {
+		if err := attachSDCard(m, flagSDCard, flagSDCardCS); err != nil {
+			fmt.Fprintln(os.Stderr, "error: sdcard:", err)
+			os.Exit(1)
+		}
+	}
+	sensorRNG := rand.New(rand.NewSource(flagFaultSeed))
+	for _, spec := range flagSensors {
+		if err := addSensor(m, spec, sensorRNG); err != nil {
+			fmt.Fprintln(os.Stderr, "error: sensor:", err)
+			os.Exit(1)
+		}
+	}
+	for _, spec := range flagDisplays {
+		if err := addDisplay(m, spec); err != nil {
+			fmt.Fprintln(os.Stderr, "error: display:", err)
+			os.Exit(1)
+		}
+	}
+	if len(flagAnalog) != 0 {
+		if err := attachAnalog(m, flagAnalog, sensorRNG); err != nil {
+			fmt.Fprintln(os.Stderr, "error: analog:", err)
+			os.Exit(1)
+		}
+	}
+	if len(flagBusLog) != 0 {
+		// This must come after the sensors and displays, see attachBusLog.
+		if err := attachBusLog(m, flagBusLog, flagBusLogOutput); err != nil {
+			fmt.Fprintln(os.Stderr, "error: buslog:", err)
+			os.Exit(1)
+		}
+	}
+	if flagWS2812 != "" {
+		if err := attachWS2812(m, flagWS2812, flagWS2812Format, flagWS2812Output); err != nil {
+			fmt.Fprintln(os.Stderr, "error: ws2812:", err)
+			os.Exit(1)
+		}
+	}
+	if len(flagProbes) != 0 {
+		if err := attachProbes(m, flagProbes, flagProbeOutput, flagProbeRate); err != nil {
+			fmt.Fprintln(os.Stderr, "error: probe:", err)
+			os.Exit(1)
+		}
+	}
+	if len(flagCAN) != 0 {
+		if err := attachCAN(m, flagCAN); err != nil {
+			fmt.Fprintln(os.Stderr, "error: can:", err)
+			os.Exit(1)
+		}
+	}
+	if flagAudioOut != "" || flagAudioIn != "" {
+		if err := attachAudio(m, flagAudioOut, flagAudioIn); err != nil {
+			fmt.Fprintln(os.Stderr, "error: audio:", err)
+			os.Exit(1)
+		}
+	}
+	if flagRTOSTrace != "" {
+		if err := attachRTOSTrace(m, flagRTOSTrace, flagRTOS); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+	}
+	if len(flagInputs) != 0 {
+		m.inputs = newInputManager(machine, flagClock, rand.New(rand.NewSource(flagFaultSeed)))
+		for _, spec := range flagInputs {
+			if err := m.inputs.add(spec); err != nil {
+				fmt.Fprintln(os.Stderr, "error: input:", err)
+				os.Exit(1)
+			}
+		}
+	}
+	if flagPeriphTrace {
+		names := &registerNames{}
+		if flagSVD != "" {
+			if err := names.loadSVD(flagSVD); err != nil {
+				fmt.Fprintln(os.Stderr, "error: svd:", err)
+				os.Exit(1)
+			}
+		}
+		if plat != nil {
+			names.addPlatform(plat)
+		}
+		attachPeriphTrace(m, names, os.Stderr)
+	} else if flagSVD != "" {
+		fmt.Fprintln(os.Stderr, "error: -svd needs -periphtrace")
+		os.Exit(1)
+	}
+	if plat != nil {
+		plat.reportMissing(os.Stderr, m)
+	}
+	if flagCosim != "" {
+		C.machine_set_instruction_limit(machine, C.uint64_t(flagMaxInstrs))
+		C.machine_reset_cause(machine, C.uint32_t(resetReasons[flagResetReason]))
+		err := runCosim(m, flagCosim, flagCosimReset, flagCosimInterval, os.Stderr)
+		terminalDisableRaw()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: cosim:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if flagFLM != "" {
+		C.machine_reset_cause(machine, C.uint32_t(resetReasons[flagResetReason]))
+		err := runFLM(m, flagFLM, flmImage, preset.flashBase, flagClock, os.Stdout)
+		if flagFlashFile != "" {
+			saveFlashFile(machine, flagFlashFile)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: flm:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if flagGolden != "" || flagVerify != "" {
+		C.machine_reset_cause(machine, C.uint32_t(resetReasons[flagResetReason]))
+		var err error
+		if flagGolden != "" {
+			err = recordGolden(m, flagGolden, flagMaxInstrs, flagGoldenEvery, os.Stderr)
+		} else {
+			err = verifyGolden(m, flagVerify, os.Stderr)
+		}
+		terminalDisableRaw()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: golden:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if flagTUI {
+		if flagUART[0] != "stdio" || flagGdbServer == "stdio" {
+			fmt.Fprintln(os.Stderr, "error: tui: the UART must be on the terminal, and GDB can't be")
+			os.Exit(1)
+		}
+		if err := startTUI(m); err != nil {
+			fmt.Fprintln(os.Stderr, "error: tui:", err)
+			os.Exit(1)
+		}
+	} else if flagUART[0] == "stdio" && flagGdbServer != "stdio" {
+		if err := startConsole(m); err != nil {
+			fmt.Fprintln(os.Stderr, "error: console:", err)
+			os.Exit(1)
+		}
+	}
+	if flagGdbServer == "stdio" {
+		go gdbServeStdio(m, gdbStdio(m))
+	} else if flagGdbServer != "" {
 		go func() {
-			err := gdbServer(machine, flagGdbServer, runChan)
+			err := gdbServer(m, flagGdbServer)
 			if err != nil {
 				fmt.Fprintln(os.Stderr, "gdb server error:", err)
 			}
 		}()
 	}
 
-	C.machine_reset(machine)
+	if flagScript != "" {
+		// This must come after the inputs, and after the console and GDB
+		// have set up the output that is checked.
+		timeline, err := loadTimeline(m, flagScript, flagClock)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: script:", err)
+			os.Exit(1)
+		}
+		m.timeline = timeline
+		terminalOutput = io.MultiWriter(terminalOutput, timeline.output(0))
+		m.console = io.MultiWriter(m.console, timeline.output(-1))
+		for uart := 1; uart < C.MACHINE_NUM_UARTS; uart++ {
+			w := m.UARTOutput(uart)
+			if w == nil {
+				w = io.Discard
+			}
+			m.SetUARTOutput(uart, io.MultiWriter(w, timeline.output(uart)))
+		}
+	}
+
+	if flagControl != "" {
+		go func() {
+			err := controlServer(m, flagControl)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "control server error:", err)
+			}
+		}()
+	}
+
+	if flagCMSISDAP != "" {
+		go func() {
+			err := dapServer(m, flagCMSISDAP)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "cmsis-dap server error:", err)
+			}
+		}()
+	}
+
+	if flagMetrics != "" {
+		go func() {
+			err := serveMetrics(m, flagMetrics)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "metrics server error:", err)
+			}
+		}()
+	}
+
+	if flagWatchFirmware {
+		go watchFirmware(m, args[0])
+	}
+
+	if flagTop != "" {
+		if err := startTop(m, flagTop, flagTopRate); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+	}
+
+	C.machine_set_instruction_limit(machine, C.uint64_t(flagMaxInstrs))
+	if flagCheckpoints != 0 {
+		checkpoints, err := newCheckpointer(flagCheckpointDir, flagCheckpoints*1000000, flagCheckpointN)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: checkpoint:", err)
+			os.Exit(1)
+		}
+		m.checkpoints = checkpoints
+	}
+	C.machine_set_hang_cycles(machine, C.uint64_t(flagHangs*1000000))
+	for _, bp := range breakpoints {
+		if _, err := m.breakpoints.Add(bp); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+	}
+	for _, w := range watches {
+		if _, err := m.watches.Add(w); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+	}
+	if err := m.addExitBreakpoints(); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+	if flagPanics {
+		if err := m.addPanicBreakpoints(); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+	}
+	if flagRunUntil != "" {
+		if _, err := m.breakpoints.Add(Breakpoint{Address: runUntil, Temporary: true}); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+	}
+	var timedOut int32
+	if flagTimeout != 0 {
+		time.AfterFunc(flagTimeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			haltMachine(machine)
+		})
+	}
+
+	// Stop cleanly on SIGINT and SIGTERM: halt the machine, restore the
+	// terminal and print a summary. If the machine doesn't stop in time (for
+	// example because it is waiting for terminal input), exit anyway.
+	var signalled int32
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := (<-signals).(syscall.Signal)
+		atomic.StoreInt32(&signalled, int32(sig))
+		haltMachine(machine)
+		time.Sleep(time.Second)
+		terminalDisableRaw()
+		fmt.Fprintf(os.Stderr, "\nreceived %s, exiting\n", sig)
+		os.Exit(128 + int(sig))
+	}()
+
+	// Whether something can resume the machine after the firmware stopped, so
+	// that the emulator shouldn't exit.
+	canResume := flagGdbServer != "" || flagControl != "" || flagCMSISDAP != "" || flagWatchFirmware || flagTUI
+
+	if flagRestore != "" {
+		if err := restoreCheckpoint(machine, flagRestore); err != nil {
+			fmt.Fprintln(os.Stderr, "error: restore:", err)
+			os.Exit(1)
+		}
+		// Faults before the checkpoint were injected already.
+		for len(faults) != 0 && faults[0].cycle < uint64(machine.stats.cycles) {
+			faults = faults[1:]
+		}
+	} else {
+		C.machine_reset_cause(machine, C.uint32_t(resetReasons[flagResetReason]))
+	}
+	// The run loop holds the machine lock, except while the machine is halted.
+	m.lock.Lock()
+	if m.Halted() {
+		// Wait until GDB continues the machine.
+		m.wait()
+	}
 	for {
-		if C.machine_run(machine) == 0 {
-			return
+		// Inject all faults that are due.
+		for len(faults) != 0 && faults[0].cycle <= uint64(machine.stats.cycles) {
+			fmt.Fprintf(os.Stderr, "\ninjecting fault %s at cycle %d (PC: %x)\n", faults[0].spec, uint64(machine.stats.cycles), C.machine_readreg(machine, 15)-1)
+			if err := faults[0].inject(machine); err != nil {
+				fmt.Fprintln(os.Stderr, "fault injection failed:", err)
+			}
+			faults = faults[1:]
+		}
+		// Run the script steps and apply the input changes that are due, and
+		// stop at the next fault, script step or input change.
+		var deadline uint64
+		if m.timeline != nil {
+			next, stop := m.timeline.update()
+			if stop != nil {
+				terminalDisableRaw()
+				fmt.Fprintf(os.Stderr, "\n%s\n", stop.message)
+				printReports(m, powerModel)
+				os.Exit(stop.status)
+			}
+			deadline = next
+		}
+		if m.inputs != nil {
+			if next := m.inputs.update(); next != 0 && (deadline == 0 || next < deadline) {
+				deadline = next
+			}
+		}
+		if len(faults) != 0 && (deadline == 0 || faults[0].cycle < deadline) {
+			deadline = faults[0].cycle
+		}
+		C.machine_set_deadline(machine, C.uint64_t(deadline))
+		if m.checkpoints != nil {
+			C.machine_set_instruction_limit(machine, C.uint64_t(m.checkpoints.limit(machine, flagMaxInstrs)))
 		}
-		C.terminal_disable_raw()
 
-		// send "machine has stopped"
-		runChan <- struct{}{}
+		err := m.Run()
+		if err.Reason == StopLimit && m.checkpoints != nil && m.checkpoints.due(machine, flagMaxInstrs) {
+			if err := m.checkpoints.save(machine); err != nil {
+				fmt.Fprintln(os.Stderr, "error: checkpoint:", err)
+			}
+			continue
+		}
+		var breakpoint *Breakpoint
+		if err.Reason == StopBreakpoint {
+			var stop bool
+			breakpoint, stop = m.breakpoints.hit(err.PC)
+			if !stop {
+				continue
+			}
+		}
+		if err.Reason == StopDeadline {
+			continue
+		}
+		exit, code := false, 0
+		if err.Reason == StopSemihosting {
+			exit, code = m.semihost()
+			if !exit {
+				continue
+			}
+		} else if breakpoint != nil && breakpoint.Owner == BreakpointExit {
+			code, exit = m.exitCalled(err.PC)
+		}
+		if exit {
+			printReports(m, powerModel)
+			if m.ExtendedRemote() || flagWatchFirmware {
+				// Let GDB decide whether to restart the program, or wait
+				// for the next build.
+				m.stop = &StopError{Reason: StopExit, PC: err.PC, ExitCode: code}
+				if flagWatchFirmware {
+					fmt.Fprintf(os.Stderr, "\nexited with code %d, waiting for a new build\n", code)
+				}
+				m.exited = true
+				m.exitCode = code
+				m.wait()
+				continue
+			}
+			terminalDisableRaw()
+			os.Exit(code)
+		}
+		if sig := syscall.Signal(atomic.LoadInt32(&signalled)); err.Reason == StopHalt && sig != 0 {
+			terminalDisableRaw()
+			fmt.Fprintln(os.Stderr)
+			printSummary(os.Stderr, machine, m.debug, "received "+sig.String())
+			if flagDump {
+				dumpState(os.Stderr, machine)
+			}
+			printReports(m, powerModel)
+			os.Exit(128 + int(sig))
+		}
+		if err.Reason == StopLimit || (err.Reason == StopHalt && atomic.LoadInt32(&timedOut) != 0) {
+			terminalDisableRaw()
+			if err.Reason == StopLimit {
+				fmt.Fprintf(os.Stderr, "\nstopped: executed %d instructions\n", uint64(machine.stats.instructions))
+			} else {
+				fmt.Fprintf(os.Stderr, "\nstopped: timeout of %s exceeded\n", flagTimeout)
+			}
+			if flagDump {
+				dumpState(os.Stderr, machine)
+			}
+			printReports(m, powerModel)
+			os.Exit(exitTimeout)
+		}
+		m.stop = err
+		if err.Reason == StopExit || err.Reason == StopInputEOF {
+			printReports(m, powerModel)
+			if m.ExtendedRemote() || flagWatchFirmware {
+				if flagWatchFirmware {
+					fmt.Fprintln(os.Stderr, "\nexited, waiting for a new build")
+				}
+				m.exited = true
+				m.exitCode = 0
+				m.wait()
+				continue
+			}
+			break
+		}
+		if !flagTUI {
+			// Leave raw mode for the messages below. The TUI shows them in
+			// its messages pane instead.
+			terminalDisableRaw()
+		}
+		if breakpoint != nil && breakpoint.Owner == BreakpointPanic {
+			fmt.Fprintf(os.Stderr, "\n%s\n", m.describePanic(err.PC))
+			if !canResume {
+				printSummary(os.Stderr, machine, m.debug, "panic")
+				if flagDump {
+					dumpState(os.Stderr, machine)
+				}
+				printReports(m, powerModel)
+				os.Exit(exitPanic)
+			}
+		}
+		if err.Reason == StopHang {
+			fmt.Fprintf(os.Stderr, "\nstuck in a loop at %s..0x%x: no stores, peripheral accesses or interrupts for %d cycles\n", m.debug.describe(uint32(machine.hang.low)), uint32(machine.hang.high), flagHangs*1000000)
+			if !canResume {
+				printSummary(os.Stderr, machine, m.debug, "stuck in a loop")
+				if flagDump {
+					dumpState(os.Stderr, machine)
+				}
+				printReports(m, powerModel)
+				os.Exit(exitTimeout)
+			}
+		}
+		if breakpoint != nil && breakpoint.Owner == BreakpointUser {
+			fmt.Fprintf(os.Stderr, "\nstopped at %s\n", m.debug.describe(err.PC))
+			if flagDump {
+				dumpState(os.Stderr, machine)
+			}
+			if flagGdbServer == "" {
+				if flagRunUntil != "" && err.PC == runUntil {
+					printReports(m, powerModel)
+					break
+				}
+				continue
+			}
+		}
+		if err.Reason != StopHalt && !canResume {
+			// Nothing can resume the machine, so exit like a crashed process
+			// would.
+			fmt.Fprintln(os.Stderr)
+			printSummary(os.Stderr, machine, m.debug, err.Error())
+			if flagDump {
+				dumpState(os.Stderr, machine)
+			}
+			printReports(m, powerModel)
+			os.Exit(err.ExitStatus())
+		}
+		if err.Reason != StopHalt && flagWatchFirmware {
+			fmt.Fprintln(os.Stderr)
+			printSummary(os.Stderr, machine, m.debug, err.Error())
+			fmt.Fprintln(os.Stderr, "waiting for a new build")
+		}
+
+		// Wait until the machine is continued.
+		m.wait()
+	}
+	m.Close()
+	terminalDisableRaw()
+}
 
-		// wait until we may resume again
-		<-runChan
+// Print the statistics and power reports, if requested, and save the flash
+// for -flash-file, the coverage for -coverage and the screenshots for
+// -screenshot. This is called when the firmware stops for good.
+func printReports(m *Machine, powerModel *powerModel) {
+	machine := m.machine
+	if m.checkpoints != nil && m.checkpoints.last() != "" {
+		fmt.Fprintf(os.Stderr, "last checkpoint: %s (replay from there with -restore)\n", m.checkpoints.last())
 	}
-	C.machine_free(machine)
+	if flagFlashFile != "" {
+		saveFlashFile(machine, flagFlashFile)
+	}
+	if flagCoverage != "" {
+		saveCoverage(m, flagCoverage)
+	}
+	saveProbes(m)
+	saveBusLog(machine)
+	saveScreenshots(m, flagScreenshot)
+	if flagStats {
+		printStats(os.Stderr, machine)
+	}
+	if flagPower {
+		printPowerReport(os.Stderr, machine, powerModel, flagClock, flagBattery)
+	}
+	if flagHistogram {
+		printHistogram(os.Stderr, machine)
+	}
+}
+
+// Read a firmware image, which is either a raw binary or an ELF file. Debug
+// information is only returned for ELF files. The file is mapped into memory
+// instead of read: a raw binary is returned as it is mapped, so it is only
+// copied once, into the flash of the machine. The returned function must be
+// called once the firmware image isn't needed anymore.
+func loadFirmware(path string, flashBase uint32, flashSize int) ([]byte, *debugInfo, func(), error) {
+	data, release, err := mapFile(path)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("cannot read firmware image: %v", err)
+	}
+	firmware := data
+	var debug *debugInfo
+	if isELF(data) {
+		firmware, debug, err = loadELF(data, flashBase, flashSize)
+		release()
+		release = func() {}
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("cannot load ELF file: %v", err)
+		}
+	} else if isUF2(data) {
+		firmware, err = loadUF2(data, flashBase, flashSize)
+		release()
+		release = func() {}
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("cannot load UF2 file: %v", err)
+		}
+	}
+	if len(firmware) > flashSize {
+		release()
+		return nil, nil, nil, errors.New("firmware does not fit in flash")
+	}
+	return firmware, debug, release, nil
+}
+
+// Write a firmware image to the start of flash and erase the rest of it.
+func loadImage(machine *C.machine_t, firmware []byte) {
+	C.machine_load(machine, (*C.uint8_t)(unsafe.SliceData(firmware)), C.size_t(len(firmware)))
+}
+
+// Return the flash contents of the machine, which can be written to directly.
+func flashImage(machine *C.machine_t) []byte {
+	return unsafe.Slice((*byte)(C.machine_get_image(machine)), int(machine.image_size))
 }
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unsafe"
+)
+
+// #include "machine.h"
+import "C"
+
+// This file describes the address space of a machine to debuggers: the GDB
+// memory map (qXfer:memory-map:read) and the LLDB qMemoryRegionInfo packet.
+// The regions follow the machine as it was set up: the flash and its aliases,
+// the boot ROM, ROM stubs, the factory information, the external QSPI flash,
+// internal and external RAM, and the peripherals that are emulated (built in
+// or external). GDB refuses to access memory outside of the map, so addresses
+// that the emulator doesn't handle are left out.
+
+// A region of the address space.
+type memoryRegion struct {
+	start, size uint64
+	kind        string // flash, rom, ram or io
+	blockSize   uint32 // erase size, for flash
+	permissions string // for LLDB, like "rx"
+}
+
+// Return the memory regions of a machine, sorted by address. Regions don't
+// overlap.
+func memoryRegions(machine *Machine) []memoryRegion {
+	m := machine.machine
+	flash := uint64(m.image_size)
+	var regions []memoryRegion
+	add := func(r memoryRegion) {
+		if r.size == 0 {
+			return
+		}
+		for _, other := range regions {
+			if r.start < other.start+other.size && other.start < r.start+r.size {
+				return // the first region wins, like the order of the decoder
+			}
+		}
+		regions = append(regions, r)
+	}
+	switch m.family {
+	case C.FAMILY_RP2040:
+		add(memoryRegion{start: 0, size: 0x4000, kind: "rom", permissions: "rx"}) // boot ROM
+		add(memoryRegion{start: 0x10000000, size: flash, kind: "flash", blockSize: uint32(m.pagesize), permissions: "rx"})
+		for alias := uint64(0x11000000); alias < 0x14000000; alias += 0x01000000 {
+			// The XIP variants: no allocate, no cache and neither.
+			add(memoryRegion{start: alias, size: flash, kind: "rom", permissions: "rx"})
+		}
+		add(memoryRegion{start: 0x14000000, size: 0x0c000000, kind: "io", permissions: "rw"}) // XIP_CTRL and XIP_SSI
+	case C.FAMILY_STM32:
+		add(memoryRegion{start: uint64(m.flash_base), size: flash, kind: "flash", blockSize: uint32(m.pagesize), permissions: "rx"})
+		add(memoryRegion{start: 0, size: flash, kind: "rom", permissions: "rx"}) // boot alias
+		add(memoryRegion{start: 0x1ffff7e0, size: uint64(unsafe.Sizeof(m.stm32.info_f1)), kind: "rom", permissions: "r"})
+		add(memoryRegion{start: 0x1fff7a10, size: uint64(unsafe.Sizeof(m.stm32.info_f4)), kind: "rom", permissions: "r"})
+	default:
+		add(memoryRegion{start: 0, size: flash, kind: "flash", blockSize: uint32(m.pagesize), permissions: "rx"})
+		add(memoryRegion{start: 0x10000000, size: 0x1000, kind: "rom", permissions: "r"}) // FICR
+		add(memoryRegion{start: 0x10001000, size: uint64(unsafe.Sizeof(m.uicr)), kind: "flash", blockSize: uint32(unsafe.Sizeof(m.uicr)), permissions: "r"})
+		// The external flash, when QSPI maps it with XIP. Code can run
+		// from there too, see machine_check_execute.
+		add(memoryRegion{start: 0x12000000, size: uint64(m.qspi_flash.size), kind: "rom", permissions: "rx"})
+	}
+	for i := 0; i < int(m.stubs.num_ranges); i++ {
+		add(memoryRegion{start: uint64(m.stubs.start[i]), size: uint64(m.stubs.end[i] - m.stubs.start[i]), kind: "rom", permissions: "rx"})
+	}
+	add(memoryRegion{start: 0x20000000, size: uint64(m.mem_size), kind: "ram", permissions: "rwx"})
+	for _, ram := range m.ext_ram[:m.num_ext_ram] {
+		// Code can't run from external RAM, only from internal RAM.
+		add(memoryRegion{start: uint64(ram.start), size: uint64(ram.size), kind: "ram", permissions: "rw"})
+	}
+
+	// Peripherals, with adjacent ranges merged.
+	var periphs []memoryRegion
+	for _, p := range builtinPeripherals(machine) {
+		periphs = append(periphs, memoryRegion{start: uint64(p.start), size: uint64(p.size)})
+	}
+	for _, p := range m.external_periphs[:m.num_external_periphs] {
+		periphs = append(periphs, memoryRegion{start: uint64(p.start), size: uint64(p.size)})
+	}
+	sort.Slice(periphs, func(i, j int) bool { return periphs[i].start < periphs[j].start })
+	for i := 0; i < len(periphs); i++ {
+		r := periphs[i]
+		for i+1 < len(periphs) && periphs[i+1].start <= r.start+r.size {
+			if end := periphs[i+1].start + periphs[i+1].size; end > r.start+r.size {
+				r.size = end - r.start
+			}
+			i++
+		}
+		r.kind, r.permissions = "io", "rw"
+		add(r)
+	}
+
+	sort.Slice(regions, func(i, j int) bool { return regions[i].start < regions[j].start })
+	return regions
+}
+
+// Return the memory map annex for GDB. GDB has no type for peripherals, so
+// they are described as RAM.
+func gdbMemoryMap(machine *Machine) string {
+	var b strings.Builder
+	b.WriteString("<memory-map>\n")
+	for _, r := range memoryRegions(machine) {
+		switch r.kind {
+		case "flash":
+			fmt.Fprintf(&b, "<memory type=\"flash\" start=\"0x%x\" length=\"0x%x\">\n<property name=\"blocksize\">0x%x</property>\n</memory>\n", r.start, r.size, r.blockSize)
+		case "io":
+			fmt.Fprintf(&b, "<memory type=\"ram\" start=\"0x%x\" length=\"0x%x\"/>\n", r.start, r.size)
+		default:
+			fmt.Fprintf(&b, "<memory type=\"%s\" start=\"0x%x\" length=\"0x%x\"/>\n", r.kind, r.start, r.size)
+		}
+	}
+	b.WriteString("</memory-map>\n")
+	return b.String()
+}
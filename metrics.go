@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// #include "machine.h"
+import "C"
+
+// This file implements an HTTP endpoint with metrics in the Prometheus text
+// format, for observing long-running tests.
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+//
+// The statistics are read while the machine is running, so they may be
+// slightly out of date but never go backwards.
+
+type metricsServer struct {
+	m     *Machine
+	start time.Time
+
+	// Values at the previous scrape, to calculate the emulation speed.
+	lock             sync.Mutex
+	lastTime         time.Time
+	lastInstructions uint64
+	lastCycles       uint64
+}
+
+// Serve metrics at /metrics on the given address, like localhost:9100.
+func serveMetrics(m *Machine, address string) error {
+	now := time.Now()
+	s := &metricsServer{m: m, start: now, lastTime: now}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.handle)
+	return http.ListenAndServe(address, mux)
+}
+
+func (s *metricsServer) handle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.write(w)
+}
+
+// Write all metrics.
+func (s *metricsServer) write(w io.Writer) {
+	stats := s.m.machine.stats
+	clock := float64(s.m.machine.clock)
+	instructions := uint64(stats.instructions)
+	cycles := uint64(stats.cycles)
+
+	counter := func(name, help string, value uint64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+	}
+	gauge := func(name, help string, value float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", name, help, name, name, value)
+	}
+
+	counter("emculator_instructions_total", "Number of executed instructions.", instructions)
+	counter("emculator_cycles_total", "Number of CPU cycles, including sleep.", cycles)
+	fmt.Fprintf(w, "# HELP emculator_sleep_cycles_total Number of CPU cycles per sleep state.\n# TYPE emculator_sleep_cycles_total counter\n")
+	for state, name := range []string{"run", "sleep", "deepsleep"} {
+		fmt.Fprintf(w, "emculator_sleep_cycles_total{state=%q} %d\n", name, uint64(stats.cycles_state[state]))
+	}
+	counter("emculator_wakeups_total", "Number of wakeups from sleep.", uint64(stats.wakeups))
+	counter("emculator_fast_forwarded_cycles_total", "Number of idle CPU cycles that were skipped.", uint64(stats.fast_forwarded))
+	counter("emculator_exceptions_total", "Number of exceptions taken.", uint64(stats.exceptions))
+	fmt.Fprintf(w, "# HELP emculator_irqs_total Number of external interrupts taken per IRQ.\n# TYPE emculator_irqs_total counter\n")
+	for irq := 0; irq < C.MACHINE_NUM_IRQS; irq++ {
+		if count := uint64(stats.exceptions_by_number[16+irq]); count != 0 {
+			fmt.Fprintf(w, "emculator_irqs_total{irq=\"%d\"} %d\n", irq, count)
+		}
+	}
+	fmt.Fprintf(w, "# HELP emculator_irq_cycles_total Number of cycles spent in the handler of each IRQ, not counting handlers that preempted it.\n# TYPE emculator_irq_cycles_total counter\n")
+	for irq := 0; irq < C.MACHINE_NUM_IRQS; irq++ {
+		if stats.exceptions_by_number[16+irq] != 0 {
+			fmt.Fprintf(w, "emculator_irq_cycles_total{irq=\"%d\"} %d\n", irq, uint64(stats.exception_cycles[16+irq]))
+		}
+	}
+	fmt.Fprintf(w, "# HELP emculator_irq_latency_max_cycles Longest time in cycles from an IRQ becoming pending to entering its handler.\n# TYPE emculator_irq_latency_max_cycles gauge\n")
+	for irq := 0; irq < C.MACHINE_NUM_IRQS; irq++ {
+		if stats.exceptions_by_number[16+irq] != 0 {
+			fmt.Fprintf(w, "emculator_irq_latency_max_cycles{irq=\"%d\"} %d\n", irq, uint64(stats.exception_latency_max[16+irq]))
+		}
+	}
+	counter("emculator_uart_tx_bytes_total", "Number of bytes sent over the UART.", uint64(stats.uart_tx_bytes))
+	counter("emculator_uart_rx_bytes_total", "Number of bytes received over the UART.", uint64(stats.uart_rx_bytes))
+	counter("emculator_uart_overruns_total", "Number of bytes lost because the UART receive FIFO was full.", uint64(stats.uart_overruns))
+	counter("emculator_uart_rx_errors_total", "Number of bytes received over the UART with a framing or parity error, or a break.", uint64(stats.uart_rx_errors))
+	counter("emculator_flash_erases_total", "Number of flash page erases.", uint64(stats.flash_erases))
+	counter("emculator_flash_writes_total", "Number of flash word writes.", uint64(stats.flash_writes))
+	counter("emculator_power_cuts_total", "Number of simulated power cuts during flash operations.", uint64(stats.power_cuts))
+	counter("emculator_faults_total", "Number of times the firmware stopped with an error.", uint64(stats.faults))
+
+	// Emulation speed since the previous scrape.
+	s.lock.Lock()
+	now := time.Now()
+	elapsed := now.Sub(s.lastTime).Seconds()
+	var ips, realtime float64
+	if elapsed > 0 {
+		ips = float64(instructions-s.lastInstructions) / elapsed
+		realtime = float64(cycles-s.lastCycles) / clock / elapsed
+	}
+	s.lastTime = now
+	s.lastInstructions = instructions
+	s.lastCycles = cycles
+	s.lock.Unlock()
+	gauge("emculator_uptime_seconds", "Host time since the emulator started.", now.Sub(s.start).Seconds())
+	gauge("emculator_emulated_seconds", "Emulated time since the emulator started.", float64(cycles)/clock)
+	gauge("emculator_instructions_per_second", "Emulation speed since the previous scrape.", ips)
+	gauge("emculator_realtime_ratio", "Emulated time divided by host time since the previous scrape.", realtime)
+}
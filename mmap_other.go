@@ -0,0 +1,13 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package main
+
+import "io/ioutil"
+
+// Read a file into memory. Memory mapping is not used on this operating
+// system.
+func mapFile(path string) ([]byte, func(), error) {
+	data, err := ioutil.ReadFile(path)
+	return data, func() {}, err
+}
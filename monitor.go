@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// This file implements the monitor: commands to inspect the machine, which
+// are run with "monitor <command>" from GDB.
+
+// A single monitor command.
+type monitorCommand struct {
+	usage string
+	help  string
+	run   func(m *Machine, args []string, w io.Writer) error
+}
+
+var monitorCommands map[string]monitorCommand
+
+func init() {
+	monitorCommands = map[string]monitorCommand{
+		"help":  {"help", "list all monitor commands", monitorHelp},
+		"disas": {"disas ADDR[,COUNT]", "disassemble COUNT instructions (default 10) at the address or symbol", monitorDisas},
+		"x":     {"x ADDR[,COUNT]", "print COUNT words of memory (default 8) at the address or symbol", monitorExamine},
+		"print": {"print VAR", "print a variable, like \"print config.mode\" or \"print buffer[3]\"", monitorPrint},
+		"set":   {"set VAR = VALUE", "set a variable of a basic type, like \"set counter = 5\"", monitorSet},
+
+		"break":       {"break ADDR [if COND] [do ACTIONS]", "set a breakpoint at the address or symbol", monitorBreak(Breakpoint{})},
+		"tbreak":      {"tbreak ADDR", "set a breakpoint that is deleted when it stops", monitorBreak(Breakpoint{Temporary: true})},
+		"hbreak":      {"hbreak ADDR", "set a hardware breakpoint", monitorBreak(Breakpoint{Kind: BreakpointHardware})},
+		"delete":      {"delete ID", "delete a breakpoint", monitorDelete},
+		"enable":      {"enable ID", "enable a breakpoint", monitorEnable(true)},
+		"disable":     {"disable ID", "disable a breakpoint", monitorEnable(false)},
+		"ignore":      {"ignore ID COUNT", "don't stop at the next COUNT hits of a breakpoint", monitorIgnore},
+		"breakpoints": {"breakpoints", "list all breakpoints with their hit counts", monitorBreakpoints},
+		"watch":       {"watch ADDR [TYPE] [as NAME]", "print a value whenever it changes, like \"watch 0x20001234 u32 as ticks\"", monitorWatch},
+		"unwatch":     {"unwatch ID", "delete a watch", monitorUnwatch},
+		"watches":     {"watches", "list all watches with their values", monitorWatches},
+		"maskisr":     {"maskisr [on|off|steponly]", "mask interrupts always, never or while single-stepping", monitorMaskISR},
+
+		"input": {"input COMMAND", "operate a button, keypad or encoder, like \"input click button1\"", monitorInput},
+		"can":   {"can FRAME", "send a frame on the CAN bus, like \"can 123#DEADBEEF\"", monitorCAN},
+		"uart":  {"uart [N] [cts on|off | error KIND]", "show the line of UART0 or UART N, set its CTS input or receive the next character with an error (framing, parity, break or overrun)", monitorUART},
+
+		"screenshot": {"screenshot [NAME] PATH", "save the image of a display as a PNG file", monitorScreenshot},
+
+		"periph": {"periph [NAME [JSON]]", "print the state of a peripheral as JSON, restore it from JSON, or list the peripherals", monitorPeriph},
+
+		"reload": {"reload [PATH]", "write the firmware image (or another one) to flash and reset, keeping peripherals and connections", monitorReload},
+	}
+}
+
+// Run a single monitor command and write its output to w.
+func runMonitorCommand(m *Machine, line string, w io.Writer) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return monitorHelp(m, nil, w)
+	}
+	command, ok := monitorCommands[fields[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %#v, try \"help\"", fields[0])
+	}
+	return command.run(m, fields[1:], w)
+}
+
+func monitorHelp(m *Machine, args []string, w io.Writer) error {
+	var names []string
+	for name := range monitorCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		command := monitorCommands[name]
+		fmt.Fprintf(w, "%-20s %s\n", command.usage, command.help)
+	}
+	return nil
+}
+
+// The largest COUNT of the x and disas commands, so that a typo can't make
+// them read gigabytes of memory.
+const monitorMaxCount = 4096
+
+// Parse an argument of the form ADDR[,COUNT] where ADDR may be a symbol.
+func parseAddressCount(m *Machine, args []string, defaultCount int) (uint32, int, error) {
+	if len(args) != 1 {
+		return 0, 0, errors.New("expected ADDR[,COUNT]")
+	}
+	parts := strings.SplitN(args[0], ",", 2)
+	var symbols map[string]symbol
+	if m.debug != nil {
+		symbols = m.debug.symbols
+	}
+	address, err := resolveAddress(parts[0], symbols)
+	if err != nil {
+		return 0, 0, err
+	}
+	count := defaultCount
+	if len(parts) == 2 {
+		count, err = strconv.Atoi(parts[1])
+		if err != nil || count <= 0 {
+			return 0, 0, fmt.Errorf("invalid count: %s", parts[1])
+		}
+		if count > monitorMaxCount {
+			return 0, 0, fmt.Errorf("count %d is more than %d", count, monitorMaxCount)
+		}
+	}
+	return address, count, nil
+}
+
+func monitorDisas(m *Machine, args []string, w io.Writer) error {
+	address, count, err := parseAddressCount(m, args, 10)
+	if err != nil {
+		return err
+	}
+	pc := m.ReadRegister(15) - 1
+	lastLocation := ""
+	for i := 0; i < count; i++ {
+		if location := m.debug.location(address); location != lastLocation && location != "" {
+			fmt.Fprintf(w, "%s:\n", location)
+			lastLocation = location
+		}
+		text, size := m.Disassemble(address)
+		marker := "  "
+		if address == pc {
+			marker = "=>"
+		}
+		fmt.Fprintf(w, "%s %08x: %s\n", marker, address, text)
+		address += uint32(size)
+	}
+	return nil
+}
+
+func monitorExamine(m *Machine, args []string, w io.Writer) error {
+	address, count, err := parseAddressCount(m, args, 8)
+	if err != nil {
+		return err
+	}
+	address &^= 3
+	mem := m.ReadMemory(int(address), count*4)
+	for i := 0; i < count; i++ {
+		if i%4 == 0 {
+			if i != 0 {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintf(w, "%08x:", address+uint32(i*4))
+		}
+		fmt.Fprintf(w, " %08x", binary.LittleEndian.Uint32(mem[i*4:]))
+	}
+	fmt.Fprintln(w)
+	return nil
+}
+
+// Return a command that sets a breakpoint like the template at the given
+// address.
+func monitorBreak(template Breakpoint) func(m *Machine, args []string, w io.Writer) error {
+	return func(m *Machine, args []string, w io.Writer) error {
+		if len(args) == 0 {
+			return errors.New("expected ADDR [if COND] [do ACTIONS]")
+		}
+		var symbols map[string]symbol
+		if m.debug != nil {
+			symbols = m.debug.symbols
+		}
+		bp, err := parseBreakpoint(strings.Join(args, " "), symbols)
+		if err != nil {
+			return err
+		}
+		bp.Kind = template.Kind
+		bp.Temporary = template.Temporary
+		bp, err = m.breakpoints.Add(bp)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "breakpoint %d at %s\n", bp.ID, m.debug.describe(bp.Address))
+		return nil
+	}
+}
+
+// Parse a breakpoint ID argument.
+func parseBreakpointID(arg string) (int, error) {
+	id, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, fmt.Errorf("invalid breakpoint ID: %s", arg)
+	}
+	return id, nil
+}
+
+func monitorDelete(m *Machine, args []string, w io.Writer) error {
+	if len(args) != 1 {
+		return errors.New("expected ID")
+	}
+	id, err := parseBreakpointID(args[0])
+	if err != nil {
+		return err
+	}
+	return m.breakpoints.Delete(id)
+}
+
+// Return a command that enables or disables a breakpoint.
+func monitorEnable(enable bool) func(m *Machine, args []string, w io.Writer) error {
+	return func(m *Machine, args []string, w io.Writer) error {
+		if len(args) != 1 {
+			return errors.New("expected ID")
+		}
+		id, err := parseBreakpointID(args[0])
+		if err != nil {
+			return err
+		}
+		return m.breakpoints.Modify(id, func(bp *Breakpoint) {
+			bp.Disabled = !enable
+		})
+	}
+}
+
+func monitorIgnore(m *Machine, args []string, w io.Writer) error {
+	if len(args) != 2 {
+		return errors.New("expected ID COUNT")
+	}
+	id, err := parseBreakpointID(args[0])
+	if err != nil {
+		return err
+	}
+	count, err := strconv.Atoi(args[1])
+	if err != nil || count < 0 {
+		return fmt.Errorf("invalid count: %s", args[1])
+	}
+	return m.breakpoints.Modify(id, func(bp *Breakpoint) {
+		bp.IgnoreCount = count
+	})
+}
+
+func monitorMaskISR(m *Machine, args []string, w io.Writer) error {
+	switch len(args) {
+	case 0:
+		fmt.Fprintf(w, "maskisr: %s\n", m.maskISR)
+		return nil
+	case 1:
+		return m.SetMaskISR(args[0])
+	default:
+		return errors.New("expected on, off or steponly")
+	}
+}
+
+func monitorWatch(m *Machine, args []string, w io.Writer) error {
+	var symbols map[string]symbol
+	if m.debug != nil {
+		symbols = m.debug.symbols
+	}
+	watch, err := parseWatch(strings.Join(args, " "), symbols)
+	if err != nil {
+		return err
+	}
+	watch, err = m.watches.Add(watch)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "watch %d at 0x%x\n", watch.ID, watch.Address)
+	return nil
+}
+
+func monitorUnwatch(m *Machine, args []string, w io.Writer) error {
+	if len(args) != 1 {
+		return errors.New("expected a watch ID")
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid watch ID: %s", args[0])
+	}
+	return m.watches.Delete(id)
+}
+
+func monitorWatches(m *Machine, args []string, w io.Writer) error {
+	list := m.watches.List()
+	if len(list) == 0 {
+		fmt.Fprintln(w, "no watches")
+		return nil
+	}
+	for _, watch := range list {
+		fmt.Fprintf(w, "%-3d 0x%08x %-4s %s = %s\n", watch.ID, watch.Address, watch.Type, watch.Name, formatWatchValue(watch.Type, watch.value))
+	}
+	return nil
+}
+
+func monitorPrint(m *Machine, args []string, w io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("expected a variable")
+	}
+	expr := strings.Join(args, " ")
+	value, err := m.printVariable(expr)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s = %s\n", expr, value)
+	return nil
+}
+
+func monitorSet(m *Machine, args []string, w io.Writer) error {
+	return m.setVariable(strings.Join(args, " "))
+}
+
+func monitorBreakpoints(m *Machine, args []string, w io.Writer) error {
+	list := m.breakpoints.List()
+	if len(list) == 0 {
+		fmt.Fprintln(w, "no breakpoints")
+		return nil
+	}
+	fmt.Fprintln(w, "ID  type  owner  enabled  hits  location")
+	for _, bp := range list {
+		kind := bp.Kind.String()
+		if bp.Temporary {
+			kind = "t" + kind
+		}
+		owner := "user"
+		if bp.Owner == BreakpointGDB {
+			owner = "gdb"
+		} else if bp.Owner == BreakpointPanic {
+			owner = "panic"
+		} else if bp.Owner == BreakpointExit {
+			owner = "exit"
+		} else if bp.Owner == BreakpointProbe {
+			owner = "probe"
+		}
+		enabled := "y"
+		if bp.Disabled {
+			enabled = "n"
+		}
+		fmt.Fprintf(w, "%-3d %-5s %-6s %-8s %-5d %s", bp.ID, kind, owner, enabled, bp.Hits, m.debug.describe(bp.Address))
+		if bp.Condition != "" {
+			fmt.Fprintf(w, " if %s", bp.Condition)
+		}
+		if bp.Actions != "" {
+			fmt.Fprintf(w, " do %s", bp.Actions)
+		}
+		if bp.IgnoreCount != 0 {
+			fmt.Fprintf(w, " (ignore next %d hits)", bp.IgnoreCount)
+		}
+		fmt.Fprintln(w)
+	}
+	return nil
+}
+
+func monitorInput(m *Machine, args []string, w io.Writer) error {
+	if m.inputs == nil {
+		return errors.New("no input devices, see -input")
+	}
+	if len(args) == 0 {
+		return errors.New("expected press, release, click, glitch or rotate")
+	}
+	return m.inputs.command(strings.Join(args, " "))
+}
+
+func monitorUART(m *Machine, args []string, w io.Writer) error {
+	return uartCommand(m.machine, args, w)
+}
+
+func monitorCAN(m *Machine, args []string, w io.Writer) error {
+	if len(args) != 1 {
+		return errors.New("expected a frame like 123#DEADBEEF")
+	}
+	accepted, err := m.canSend(args[0])
+	if err != nil {
+		return err
+	}
+	if !accepted {
+		fmt.Fprintln(w, "the frame was not accepted by the CAN controller")
+	}
+	return nil
+}
+
+func monitorPeriph(m *Machine, args []string, w io.Writer) error {
+	switch len(args) {
+	case 0:
+		fmt.Fprintln(w, strings.Join(periphNames(m.machine), " "))
+		return nil
+	case 1:
+		state, err := dumpPeriph(m.machine, args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, state)
+		return nil
+	}
+	return restorePeriph(m.machine, args[0], strings.Join(args[1:], " "))
+}
+
+func monitorScreenshot(m *Machine, args []string, w io.Writer) error {
+	switch len(args) {
+	case 1:
+		return m.SaveScreenshot("", args[0])
+	case 2:
+		return m.SaveScreenshot(args[0], args[1])
+	}
+	return errors.New("expected screenshot [NAME] PATH")
+}
+
+func monitorReload(m *Machine, args []string, w io.Writer) error {
+	if len(args) > 1 {
+		return errors.New("expected at most one firmware image")
+	}
+	path := ""
+	if len(args) == 1 {
+		path = args[0]
+	}
+	size, err := m.Reload(path)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "loaded %d bytes from %s, halted at the reset vector\n", size, m.firmware)
+	return nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// This file detects panics and failed assertions of the firmware, which would
+// otherwise look like it hangs: most runtimes loop forever after a fatal
+// error. A breakpoint is set on the well-known fatal error handlers that the
+// firmware contains. When one is called, the message is read from the
+// arguments and printed with the caller, and the emulator exits like abort(3)
+// would. With GDB or the control socket, the machine stops instead.
+
+// Exit status after a panic: 128 plus SIGABRT, as a shell would report it.
+const exitPanic = 128 + 6
+
+// A fatal error handler, and how to describe the call from its arguments.
+type panicHandler struct {
+	symbol   string
+	describe func(m *Machine, args [4]uint32) string
+}
+
+var panicHandlers = []panicHandler{
+	// TinyGo. Other panics print their message before calling abort.
+	{"runtime.runtimePanic", func(m *Machine, args [4]uint32) string {
+		return "panic: runtime error: " + m.readGoString(args[0], args[1])
+	}},
+	{"runtime.runtimePanicAt", func(m *Machine, args [4]uint32) string {
+		return fmt.Sprintf("panic: runtime error at %s: %s", m.debug.describe(args[0]&^1), m.readGoString(args[1], args[2]))
+	}},
+	{"runtime.abort", func(m *Machine, args [4]uint32) string {
+		return "runtime.abort called"
+	}},
+
+	// Zephyr.
+	{"z_fatal_error", func(m *Machine, args [4]uint32) string {
+		s := "fatal error: " + zephyrFatalReason(args[0])
+		if args[1] != 0 {
+			// The exception frame: r0-r3, r12, lr, pc and xpsr.
+			pc := binary.LittleEndian.Uint32(m.ReadMemory(int(args[1])+24, 4))
+			s += " at " + m.debug.describe(pc&^1)
+		}
+		return s
+	}},
+	{"k_fatal_halt", func(m *Machine, args [4]uint32) string {
+		return "fatal error: " + zephyrFatalReason(args[0])
+	}},
+	{"assert_post_action", func(m *Machine, args [4]uint32) string {
+		if args[0] == 0 {
+			return "assertion failed"
+		}
+		return fmt.Sprintf("assertion failed at %s:%d", m.readCString(args[0]), args[1])
+	}},
+
+	// Newlib and picolibc.
+	{"__assert_func", func(m *Machine, args [4]uint32) string {
+		return fmt.Sprintf("assertion %s failed: file %s, line %d, function: %s", strconv.Quote(m.readCString(args[3])), strconv.Quote(m.readCString(args[0])), int32(args[1]), m.readCString(args[2]))
+	}},
+	{"__stack_chk_fail", func(m *Machine, args [4]uint32) string {
+		return "stack smashing detected"
+	}},
+	{"abort", func(m *Machine, args [4]uint32) string {
+		return "abort called"
+	}},
+}
+
+// Functions that end the program with the exit code in r0. TinyGo calls
+// runtime.abort from runtime.exit on chips without semihosting, so a program
+// that calls os.Exit or returns from main would otherwise look like it
+// panicked.
+var exitHandlers = []string{"runtime.exit"}
+
+// Names of the reasons of a Zephyr fatal error, see k_fatal_error_reason.
+var zephyrFatalReasons = []string{
+	"K_ERR_CPU_EXCEPTION",
+	"K_ERR_SPURIOUS_IRQ",
+	"K_ERR_STACK_CHK_FAIL",
+	"K_ERR_KERNEL_OOPS",
+	"K_ERR_KERNEL_PANIC",
+}
+
+func zephyrFatalReason(reason uint32) string {
+	if int(reason) < len(zephyrFatalReasons) {
+		return zephyrFatalReasons[reason]
+	}
+	return fmt.Sprintf("reason %d", reason)
+}
+
+// Maximum length of a panic message that is read from memory.
+const maxPanicMessage = 256
+
+// Read a NUL-terminated string.
+func (m *Machine) readCString(address uint32) string {
+	if address == 0 {
+		return "(null)"
+	}
+	data := m.ReadMemory(int(address), maxPanicMessage)
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		data = data[:i]
+	}
+	return string(data)
+}
+
+// Read a Go string, given its pointer and length.
+func (m *Machine) readGoString(address, length uint32) string {
+	if length > maxPanicMessage {
+		length = maxPanicMessage
+	}
+	if length == 0 {
+		return ""
+	}
+	return string(m.ReadMemory(int(address), int(length)))
+}
+
+// Set breakpoints on the fatal error handlers in the firmware.
+func (m *Machine) addPanicBreakpoints() error {
+	m.panics = true
+	if m.debug == nil {
+		return nil
+	}
+	for _, handler := range panicHandlers {
+		sym, ok := m.debug.symbols[handler.symbol]
+		if !ok {
+			continue
+		}
+		if _, err := m.breakpoints.Add(Breakpoint{Address: sym.Address, Owner: BreakpointPanic}); err != nil {
+			return fmt.Errorf("cannot detect calls to %s: %v", handler.symbol, err)
+		}
+	}
+	return nil
+}
+
+// Set breakpoints on the exitHandlers in the firmware. This is independent of
+// the detection of panics, as the firmware would otherwise hang or panic
+// after it exits.
+func (m *Machine) addExitBreakpoints() error {
+	if m.debug == nil {
+		return nil
+	}
+	for _, name := range exitHandlers {
+		sym, ok := m.debug.symbols[name]
+		if !ok {
+			continue
+		}
+		if _, err := m.breakpoints.Add(Breakpoint{Address: sym.Address, Owner: BreakpointExit}); err != nil {
+			return fmt.Errorf("cannot detect calls to %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Return the exit code if the machine stopped at one of the exitHandlers.
+func (m *Machine) exitCalled(address uint32) (code int, ok bool) {
+	for _, name := range exitHandlers {
+		if sym, found := m.debug.symbols[name]; found && sym.Address == address {
+			return int(int32(m.ReadRegister(0))), true
+		}
+	}
+	return 0, false
+}
+
+// Describe the call to a fatal error handler that the machine stopped at, with
+// the message and where it was called from.
+func (m *Machine) describePanic(address uint32) string {
+	var handler panicHandler
+	for _, h := range panicHandlers {
+		if sym, ok := m.debug.symbols[h.symbol]; ok && sym.Address == address {
+			handler = h
+			break
+		}
+	}
+	var args [4]uint32
+	for i := range args {
+		args[i] = m.ReadRegister(i)
+	}
+	s := handler.describe(m, args)
+
+	// The return address is after a BL (4 bytes) or BLX (2 bytes).
+	lr := m.ReadRegister(14) &^ 1
+	caller := lr - 2
+	if hw1 := binary.LittleEndian.Uint16(m.ReadMemory(int(lr)-4, 2)); hw1&0xf800 == 0xf000 {
+		caller = lr - 4
+	}
+	return fmt.Sprintf("%s\n  called from %s", s, m.debug.describe(caller))
+}
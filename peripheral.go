@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"plugin"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// #include "machine.h"
+// int peripheralTransfer(machine_t *machine, size_t index, uint32_t offset, bool store, uint32_t *value);
+// void peripheralPoll(machine_t *machine);
+import "C"
+
+// This file implements peripherals that are not part of the emulator itself,
+// so that device models can be shipped without forking the emulator. A model
+// is either a Go plugin or a separate process that speaks a simple line-based
+// protocol over its stdin/stdout or a TCP connection.
+//
+// A Go plugin (built with -buildmode=plugin) must export this function:
+//
+//     func NewPeripheral(args string, host interface {
+//         RaiseIRQ(irq int)
+//         ReadMemory(address uint32, length int) []byte
+//         WriteMemory(address uint32, data []byte)
+//         Do(f func())
+//     }) (interface {
+//         ReadRegister(offset uint32) (uint32, error)
+//         WriteRegister(offset, value uint32) error
+//     }, error)
+//
+// The protocol for other models consists of lines with space separated words.
+// All numbers and data are in hexadecimal. The emulator sends register
+// accesses:
+//
+//     read OFFSET
+//     write OFFSET VALUE
+//
+// which the model answers with "ok VALUE" (for reads), "ok" (for writes) or
+// "error MESSAGE", which causes a bus fault. At any time (also while
+// answering a register access), the model may send:
+//
+//     irq NUMBER            - set an interrupt pending
+//     dma-read ADDRESS LEN  - read memory, answered with "data BYTES"
+//     dma-write ADDRESS BYTES
+
+// Peripheral is a memory-mapped peripheral implemented outside the emulator.
+// Registers are 32 bits wide and addressed by their offset from the base
+// address of the peripheral. Returning an error causes a bus fault.
+type Peripheral = interface {
+	ReadRegister(offset uint32) (uint32, error)
+	WriteRegister(offset, value uint32) error
+}
+
+// PeripheralHost is the part of the machine a peripheral can use. ReadMemory
+// and WriteMemory may only be used while handling a register access or from a
+// function passed to Do. RaiseIRQ and Do may be used from any goroutine.
+type PeripheralHost = interface {
+	RaiseIRQ(irq int)
+	ReadMemory(address uint32, length int) []byte
+	WriteMemory(address uint32, data []byte)
+	Do(f func())
+}
+
+// A peripheral together with where it is mapped.
+type mappedPeripheral struct {
+	Peripheral
+	start uint32
+	size  uint32
+}
+
+// peripheralBus dispatches accesses from the C core to the peripherals of one
+// machine. It implements PeripheralHost.
+type peripheralBus struct {
+	m           *Machine
+	peripherals []mappedPeripheral
+	lock        sync.Mutex
+	pending     []func() // functions passed to Do
+}
+
+// The peripheral bus of each machine that has external peripherals. It is
+// only modified before the machine starts running.
+var peripheralBuses machineMap[*peripheralBus]
+
+// Parse a peripheral description of the form START:SIZE:KIND:ARG, create the
+// peripheral and map it into the address space of the machine. With a
+// platform description, NAME:KIND:ARG places it like the named peripheral of
+// the platform. KIND is one of:
+//
+//	plugin:PATH[,ARGS]  load a Go plugin and pass ARGS to NewPeripheral
+//	exec:COMMAND ARGS   start a process and talk to it over stdin/stdout
+//	tcp:ADDRESS         connect to a model listening on ADDRESS
+func addPeripheral(m *Machine, spec string, plat *platform) error {
+	var start, size uint64
+	var parts []string
+	var err error
+	if name := strings.SplitN(spec, ":", 2)[0]; plat != nil && plat.peripherals[name] != nil {
+		var ok bool
+		start, size, ok = plat.peripheralRange(name)
+		if !ok {
+			return fmt.Errorf("peripheral %s is not on the system bus", name)
+		}
+		parts = append([]string{"", ""}, strings.SplitN(spec, ":", 3)[1:]...)
+	} else {
+		parts = strings.SplitN(spec, ":", 4)
+		if len(parts) == 4 {
+			start, err = strconv.ParseUint(parts[0], 0, 32)
+			if err != nil {
+				return fmt.Errorf("invalid peripheral address %#v", parts[0])
+			}
+			size, err = strconv.ParseUint(parts[1], 0, 32)
+			if err != nil || size == 0 {
+				return fmt.Errorf("invalid peripheral size %#v", parts[1])
+			}
+		}
+	}
+	if len(parts) != 4 {
+		return fmt.Errorf("invalid peripheral %#v, expected START:SIZE:KIND:ARG", spec)
+	}
+	if start < 0x40000000 || start+size > 0x60000000 {
+		return errors.New("peripherals must be in the peripheral region 0x40000000..0x5fffffff")
+	}
+
+	bus := getPeripheralBus(m)
+	var periph Peripheral
+	switch kind, arg := parts[2], parts[3]; kind {
+	case "plugin":
+		periph, err = loadPeripheralPlugin(arg, bus)
+	case "exec":
+		periph, err = startPeripheralProcess(arg, bus)
+	case "tcp":
+		periph, err = dialPeripheral(arg, bus)
+	default:
+		err = fmt.Errorf("unknown peripheral kind %#v, expected plugin, exec or tcp", kind)
+	}
+	if err != nil {
+		return err
+	}
+	if C.machine_add_external_periph(m.machine, C.uint32_t(start), C.uint32_t(size)) < 0 {
+		return fmt.Errorf("too many peripherals, at most %d are supported", C.MACHINE_EXTERNAL_PERIPHS)
+	}
+	bus.peripherals = append(bus.peripherals, mappedPeripheral{periph, uint32(start), uint32(size)})
+	return nil
+}
+
+// Return the peripheral bus of a machine, creating it when needed. Other
+// models of the host that receive data on another goroutine, like the CAN bus,
+// use its Do method too.
+func getPeripheralBus(m *Machine) *peripheralBus {
+	bus := peripheralBuses.get(m.machine)
+	if bus == nil {
+		bus = &peripheralBus{m: m}
+		peripheralBuses.set(m.machine, bus)
+		C.machine_set_external_handlers(m.machine, C.external_transfer_t(C.peripheralTransfer), C.external_poll_t(C.peripheralPoll))
+	}
+	return bus
+}
+
+// Whether an external peripheral is mapped at the given address.
+func hasExternalPeripheral(m *Machine, address uint64) bool {
+	if bus := peripheralBuses.get(m.machine); bus != nil {
+		for _, periph := range bus.peripherals {
+			if address-uint64(periph.start) < uint64(periph.size) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Handle a register access from the C core.
+//
+//export peripheralTransfer
+func peripheralTransfer(machine *C.machine_t, index C.size_t, offset C.uint32_t, store C.bool, value *C.uint32_t) C.int {
+	bus := peripheralBuses.get(machine)
+	periph := bus.peripherals[index]
+	var err error
+	if store {
+		err = periph.WriteRegister(uint32(offset), uint32(*value))
+	} else {
+		var result uint32
+		result, err = periph.ReadRegister(uint32(offset))
+		*value = C.uint32_t(result)
+	}
+	// Interrupts raised while handling the access take effect right away.
+	bus.runPending()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nperipheral at 0x%08x: %v\n", periph.start+uint32(offset), err)
+		return C.ERR_MEM
+	}
+	return C.ERR_OK
+}
+
+// Run the functions passed to Do, on the goroutine that runs the machine.
+//
+//export peripheralPoll
+func peripheralPoll(machine *C.machine_t) {
+	peripheralBuses.get(machine).runPending()
+}
+
+func (b *peripheralBus) runPending() {
+	b.lock.Lock()
+	pending := b.pending
+	b.pending = nil
+	b.lock.Unlock()
+	for _, f := range pending {
+		f()
+	}
+}
+
+func (b *peripheralBus) Do(f func()) {
+	b.lock.Lock()
+	b.pending = append(b.pending, f)
+	b.lock.Unlock()
+	C.machine_external_notify(b.m.machine)
+}
+
+func (b *peripheralBus) RaiseIRQ(irq int) {
+	b.Do(func() {
+		C.machine_pend_irq(b.m.machine, C.uint32_t(irq))
+	})
+}
+
+func (b *peripheralBus) ReadMemory(address uint32, length int) []byte {
+	return b.m.ReadMemory(int(address), length)
+}
+
+func (b *peripheralBus) WriteMemory(address uint32, data []byte) {
+	b.m.WriteMemory(int(address), data)
+}
+
+// Load a peripheral from a Go plugin. The argument is the path of the plugin,
+// optionally followed by a comma and arguments for the plugin.
+func loadPeripheralPlugin(arg string, host PeripheralHost) (Peripheral, error) {
+	path, args := arg, ""
+	if i := strings.IndexByte(arg, ','); i >= 0 {
+		path, args = arg[:i], arg[i+1:]
+	}
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	sym, err := p.Lookup("NewPeripheral")
+	if err != nil {
+		return nil, err
+	}
+	newPeripheral, ok := sym.(func(string, PeripheralHost) (Peripheral, error))
+	if !ok {
+		return nil, fmt.Errorf("%s: NewPeripheral has the wrong type %T", path, sym)
+	}
+	return newPeripheral(args, host)
+}
+
+// Start a peripheral model as a child process that talks the peripheral
+// protocol over its stdin and stdout.
+func startPeripheralProcess(command string, host PeripheralHost) (Peripheral, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errors.New("no peripheral command specified")
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return newRemotePeripheral(stdout, stdin, host), nil
+}
+
+// Connect to a peripheral model that listens on the given TCP address.
+func dialPeripheral(address string, host PeripheralHost) (Peripheral, error) {
+	if !strings.Contains(address, ":") {
+		address = "localhost:" + address
+	}
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return newRemotePeripheral(conn, conn, host), nil
+}
+
+// remotePeripheral is a peripheral model in another process.
+type remotePeripheral struct {
+	host  PeripheralHost
+	w     *bufio.Writer
+	lines chan string // closed when the connection is closed
+}
+
+func newRemotePeripheral(r io.Reader, w io.Writer, host PeripheralHost) *remotePeripheral {
+	p := &remotePeripheral{
+		host:  host,
+		w:     bufio.NewWriter(w),
+		lines: make(chan string, 16),
+	}
+	go func() {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			p.lines <- scanner.Text()
+			// Handle the line on the machine goroutine, if it wasn't the
+			// answer to a register access.
+			host.Do(p.poll)
+		}
+		close(p.lines)
+	}()
+	return p
+}
+
+func (p *remotePeripheral) ReadRegister(offset uint32) (uint32, error) {
+	reply, err := p.request("read %x", offset)
+	if err != nil {
+		return 0, err
+	}
+	value, err := strconv.ParseUint(reply, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid read reply %#v", reply)
+	}
+	return uint32(value), nil
+}
+
+func (p *remotePeripheral) WriteRegister(offset, value uint32) error {
+	_, err := p.request("write %x %x", offset, value)
+	return err
+}
+
+// Send a register access and wait for the reply, handling other messages in
+// the meantime. It returns the rest of the "ok" line.
+func (p *remotePeripheral) request(format string, args ...interface{}) (string, error) {
+	if err := p.send(format, args...); err != nil {
+		return "", err
+	}
+	for line := range p.lines {
+		word, rest := splitWord(line)
+		switch word {
+		case "ok":
+			return rest, nil
+		case "error":
+			return "", errors.New(rest)
+		default:
+			if err := p.handle(word, rest); err != nil {
+				return "", err
+			}
+		}
+	}
+	return "", errors.New("peripheral model exited")
+}
+
+// Handle messages that arrived outside a register access.
+func (p *remotePeripheral) poll() {
+	for {
+		select {
+		case line, ok := <-p.lines:
+			if !ok {
+				return
+			}
+			word, rest := splitWord(line)
+			if err := p.handle(word, rest); err != nil {
+				fmt.Fprintln(os.Stderr, "peripheral:", err)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// Handle a message from the model other than a reply to a register access.
+func (p *remotePeripheral) handle(word, rest string) error {
+	args := strings.Fields(rest)
+	switch {
+	case word == "irq" && len(args) == 1:
+		irq, err := strconv.ParseUint(args[0], 16, 32)
+		if err != nil || irq >= C.MACHINE_NUM_IRQS {
+			return fmt.Errorf("invalid IRQ %#v", args[0])
+		}
+		p.host.RaiseIRQ(int(irq))
+	case word == "dma-read" && len(args) == 2:
+		address, err1 := strconv.ParseUint(args[0], 16, 32)
+		length, err2 := strconv.ParseUint(args[1], 16, 16)
+		if err1 != nil || err2 != nil {
+			return fmt.Errorf("invalid message %#v", word+" "+rest)
+		}
+		data := p.host.ReadMemory(uint32(address), int(length))
+		return p.send("data %s", hex.EncodeToString(data))
+	case word == "dma-write" && len(args) == 2:
+		address, err1 := strconv.ParseUint(args[0], 16, 32)
+		data, err2 := hex.DecodeString(args[1])
+		if err1 != nil || err2 != nil {
+			return fmt.Errorf("invalid message %#v", word+" "+rest)
+		}
+		p.host.WriteMemory(uint32(address), data)
+	case word == "ok" || word == "error":
+		return fmt.Errorf("unexpected reply %#v", word+" "+rest)
+	default:
+		return fmt.Errorf("unknown message %#v", word+" "+rest)
+	}
+	return nil
+}
+
+func (p *remotePeripheral) send(format string, args ...interface{}) error {
+	fmt.Fprintf(p.w, format+"\n", args...)
+	return p.w.Flush()
+}
+
+// Split off the first word of a line.
+func splitWord(line string) (string, string) {
+	line = strings.TrimSpace(line)
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		return line[:i], strings.TrimSpace(line[i+1:])
+	}
+	return line, ""
+}
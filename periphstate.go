@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// #include "machine.h"
+import "C"
+
+// This file implements the periph monitor command and the Periph and
+// PeriphRestore control calls, which dump the internal state of a peripheral
+// as JSON and restore it, for example:
+//
+//	(gdb) monitor periph timer1
+//	{
+//	  "periph": {
+//	    "events": 0,
+//	    "inten": 65536,
+//	    "shorts": 1
+//	  },
+//	  "running": true,
+//	  ...
+//	  "cc": [1000, 0, 0, 0, 0, 0]
+//	}
+//
+// The state is read directly from the structs of the C core, so the names are
+// those of the fields in machine.h. It includes registers that aren't visible
+// to the firmware, like received bytes in a FIFO, pending events and the time
+// at which a timer was started. Fields that are missing in restored JSON are
+// kept as they are.
+
+// A peripheral whose state can be dumped and restored. It is either a struct
+// or array of the C core, or a group of loose fields.
+type periphState struct {
+	fields []periphField     // a single field without name for a struct
+	skip   map[string]bool   // fields that belong to the host, not the chip
+	limits map[string]uint64 // maximum values of fields that are used as an index
+}
+
+// A part of the state of a peripheral.
+type periphField struct {
+	name string
+	ptr  any // pointer into the machine
+}
+
+// Fields of the UART that describe the host side, which a restore mustn't
+// change. Pointers are never part of the state.
+var periphUARTHost = map[string]bool{
+	"mute": true, "input_len": true, "input_pos": true, "inject_size": true,
+	"inject_pos": true, "inject_len": true, "timing": true, "host_baud": true,
+	"pacing": true, "baud_warned": true,
+}
+
+// Return the peripherals of a machine by name.
+func periphStates(m *C.machine_t) map[string]periphState {
+	single := func(ptr any) periphState {
+		return periphState{fields: []periphField{{"", ptr}}}
+	}
+	states := map[string]periphState{
+		"nvic":    single(&m.nvic),
+		"scb":     single(&m.scb),
+		"systick": single(&m.systick),
+		"uart": {
+			fields: []periphField{{"", &m.uart}},
+			skip:   periphUARTHost,
+			limits: map[string]uint64{"rx_head": C.MACHINE_UART_FIFO - 1, "rx_len": C.MACHINE_UART_FIFO, "depth": C.MACHINE_UART_FIFO},
+		},
+	}
+	switch m.family {
+	case C.FAMILY_NRF:
+		for i := range m.rtc {
+			states[fmt.Sprintf("rtc%d", i)] = single(&m.rtc[i])
+		}
+		for i := range m.nrf.timer {
+			states[fmt.Sprintf("timer%d", i)] = single(&m.nrf.timer[i])
+		}
+		for i := range m.nrf.gpio {
+			states[fmt.Sprintf("p%d", i)] = single(&m.nrf.gpio[i])
+		}
+		for i := range m.nrf.spi {
+			// Also TWI and TWIM, which share the instance.
+			states[fmt.Sprintf("spi%d", i)] = single(&m.nrf.spi[i])
+		}
+		for i := range m.nrf.pwm {
+			states[fmt.Sprintf("pwm%d", i)] = single(&m.nrf.pwm[i])
+		}
+		states["clock"] = single(&m.nrf.clock)
+		states["ppi"] = single(&m.nrf.ppi)
+		states["gpiote"] = single(&m.nrf.gpiote)
+		states["radio"] = single(&m.nrf.radio)
+		states["qspi"] = single(&m.nrf.qspi)
+		states["i2s"] = single(&m.nrf.i2s)
+		states["pdm"] = single(&m.nrf.pdm)
+		states["saadc"] = single(&m.nrf.saadc)
+		for i := range m.nrf.egu {
+			states[fmt.Sprintf("egu%d", i)] = single(&m.nrf.egu[i])
+		}
+		states["ecb"] = single(&m.nrf.ecb)
+		states["ccm"] = single(&m.nrf.ccm)
+		states["temp"] = single(&m.nrf.temp)
+	case C.FAMILY_STM32:
+		s := &m.stm32
+		for i := range s.usart {
+			states[fmt.Sprintf("usart%d", i+1)] = single(&s.usart[i])
+		}
+		for i := range s.spi {
+			states[fmt.Sprintf("spi%d", i+1)] = single(&s.spi[i])
+		}
+		for i := range s.i2c {
+			states[fmt.Sprintf("i2c%d", i+1)] = periphState{
+				fields: []periphField{{"", &s.i2c[i]}},
+				limits: map[string]uint64{"rx_len": uint64(len(s.i2c[i].rx))},
+			}
+		}
+		states["rcc"] = periphState{fields: []periphField{{"rcc_f1", &s.rcc_f1}, {"rcc_f4", &s.rcc_f4}}}
+		states["gpio"] = periphState{fields: []periphField{{"gpio_f1", &s.gpio_f1}, {"gpio_f4", &s.gpio_f4}}}
+		states["pwr"] = single(&s.pwr)
+		states["flash"] = single(&s.flash)
+		states["exti"] = single(&s.exti)
+		states["syscfg"] = single(&s.syscfg)
+		states["can"] = single(&s.can)
+		states["crc"] = single(&s.crc)
+		states["hash"] = single(&s.hash)
+	case C.FAMILY_RP2040:
+		r := &m.rp2040
+		for i := range r.spi {
+			states[fmt.Sprintf("spi%d", i)] = periphState{
+				fields: []periphField{{"", &r.spi[i]}},
+				limits: map[string]uint64{"rx_len": uint64(len(r.spi[i].rx))},
+			}
+		}
+		for i := range r.i2c {
+			states[fmt.Sprintf("i2c%d", i)] = periphState{
+				fields: []periphField{{"", &r.i2c[i]}},
+				limits: map[string]uint64{"rx_len": uint64(len(r.i2c[i].rx))},
+			}
+		}
+		states["gpio"] = periphState{fields: []periphField{{"gpio_out", &r.gpio_out}, {"gpio_oe", &r.gpio_oe}, {"gpio_intr", &r.gpio_intr}}}
+		states["sio"] = periphState{
+			fields: []periphField{{"fifo", &r.fifo}, {"fifo_errors", &r.fifo_errors}, {"launch_seq", &r.launch_seq}, {"spinlocks", &r.spinlocks},
+				{"dividend", &r.dividend}, {"divisor", &r.divisor}, {"quotient", &r.quotient}, {"remainder", &r.remainder}},
+			limits: map[string]uint64{"fifo[0].len": uint64(len(r.fifo[0].data)), "fifo[1].len": uint64(len(r.fifo[1].data)), "launch_seq": 5},
+		}
+		states["ssi"] = periphState{
+			fields: []periphField{{"ssi_rx", &r.ssi_rx}, {"ssi_rx_len", &r.ssi_rx_len}},
+			limits: map[string]uint64{"ssi_rx_len": uint64(len(r.ssi_rx))},
+		}
+		states["timer"] = single(&r.timer)
+	}
+	return states
+}
+
+// Return the names of the peripherals of a machine, sorted.
+func periphNames(m *C.machine_t) []string {
+	var names []string
+	for name := range periphStates(m) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Look up a peripheral by name.
+func lookupPeriph(m *C.machine_t, name string) (periphState, error) {
+	state, ok := periphStates(m)[name]
+	if !ok {
+		return state, fmt.Errorf("unknown peripheral %#v, expected one of %s", name, strings.Join(periphNames(m), ", "))
+	}
+	return state, nil
+}
+
+// Return the state of a peripheral as JSON.
+func dumpPeriph(m *C.machine_t, name string) (string, error) {
+	state, err := lookupPeriph(m, name)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if state.fields[0].name == "" {
+		state.encode(&buf, reflect.ValueOf(state.fields[0].ptr).Elem(), "", "")
+	} else {
+		buf.WriteString("{\n")
+		for i, field := range state.fields {
+			fmt.Fprintf(&buf, "  %q: ", field.name)
+			state.encode(&buf, reflect.ValueOf(field.ptr).Elem(), field.name, "  ")
+			if i != len(state.fields)-1 {
+				buf.WriteByte(',')
+			}
+			buf.WriteByte('\n')
+		}
+		buf.WriteString("}")
+	}
+	return buf.String(), nil
+}
+
+// Restore the state of a peripheral from JSON, like dumpPeriph returns. The
+// state is only changed if all of it is valid.
+func restorePeriph(m *C.machine_t, name, data string) error {
+	state, err := lookupPeriph(m, name)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(strings.NewReader(data))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	if decoder.More() {
+		return errors.New("invalid JSON: data after the value")
+	}
+
+	// Decode into copies, so that an error leaves the state unchanged.
+	values := make([]reflect.Value, len(state.fields))
+	for i, field := range state.fields {
+		values[i] = reflect.New(reflect.TypeOf(field.ptr).Elem()).Elem()
+		values[i].Set(reflect.ValueOf(field.ptr).Elem())
+	}
+	if state.fields[0].name == "" {
+		err = state.decode(values[0], value, "")
+	} else {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return errors.New("expected an object")
+		}
+		for key := range object {
+			if !state.hasField(key) {
+				return fmt.Errorf("unknown field %#v", key)
+			}
+		}
+		for i, field := range state.fields {
+			if v, ok := object[field.name]; ok && err == nil {
+				err = state.decode(values[i], v, field.name)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	for i, field := range state.fields {
+		reflect.ValueOf(field.ptr).Elem().Set(values[i])
+	}
+	C.machine_reschedule_all(m)
+	return nil
+}
+
+// Return whether a peripheral that is a group of fields has one by this name.
+func (state periphState) hasField(name string) bool {
+	for _, field := range state.fields {
+		if field.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Return whether a value of this type is part of the state. Pointers (to
+// data of the host or callbacks) are not.
+func periphStateType(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Int,
+		reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uint, reflect.Uintptr:
+		return true
+	case reflect.Array:
+		return periphStateType(t.Elem())
+	case reflect.Struct:
+		return true
+	}
+	return false
+}
+
+// Return the fields of a C struct that are part of the state, with their
+// names in JSON.
+func (state periphState) structFields(t reflect.Type, path string) (fields []int, names []string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Name == "_" || !periphStateType(f.Type) {
+			continue // padding or a pointer
+		}
+		// cgo prefixes names that are Go keywords with an underscore.
+		name := strings.TrimPrefix(f.Name, "_")
+		if state.skip[periphPath(path, name)] {
+			continue
+		}
+		fields = append(fields, i)
+		names = append(names, name)
+	}
+	return fields, names
+}
+
+// Return the path of a field in a struct at path, as used in skip and limits.
+func periphPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// Write a value as JSON: structs with a field per line, arrays on a single
+// line.
+func (state periphState) encode(w io.Writer, v reflect.Value, path, indent string) {
+	switch v.Kind() {
+	case reflect.Bool:
+		fmt.Fprint(w, v.Bool())
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Int:
+		fmt.Fprint(w, v.Int())
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uint, reflect.Uintptr:
+		fmt.Fprint(w, v.Uint())
+	case reflect.Array:
+		io.WriteString(w, "[")
+		for i := 0; i < v.Len(); i++ {
+			if i != 0 {
+				io.WriteString(w, ", ")
+			}
+			state.encode(w, v.Index(i), fmt.Sprintf("%s[%d]", path, i), indent)
+		}
+		io.WriteString(w, "]")
+	case reflect.Struct:
+		fields, names := state.structFields(v.Type(), path)
+		io.WriteString(w, "{\n")
+		for i, field := range fields {
+			fmt.Fprintf(w, "%s  %q: ", indent, names[i])
+			state.encode(w, v.Field(field), periphPath(path, names[i]), indent+"  ")
+			if i != len(fields)-1 {
+				io.WriteString(w, ",")
+			}
+			io.WriteString(w, "\n")
+		}
+		fmt.Fprintf(w, "%s}", indent)
+	}
+}
+
+// Store a decoded JSON value in v, which must be addressable.
+func (state periphState) decode(v reflect.Value, value any, path string) error {
+	name := path
+	if name == "" {
+		name = "value"
+	}
+	// The fields of cgo structs are unexported, so they can't be set through
+	// reflection directly.
+	settable := reflect.NewAt(v.Type(), unsafe.Pointer(v.UnsafeAddr())).Elem()
+	switch v.Kind() {
+	case reflect.Bool:
+		b, ok := value.(bool)
+		if !ok {
+			return fmt.Errorf("%s: expected a boolean", name)
+		}
+		settable.SetBool(b)
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Int:
+		n, ok := value.(json.Number)
+		if !ok {
+			return fmt.Errorf("%s: expected a number", name)
+		}
+		i, err := strconv.ParseInt(string(n), 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%s: invalid value %s", name, n)
+		}
+		settable.SetInt(i)
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uint, reflect.Uintptr:
+		n, ok := value.(json.Number)
+		if !ok {
+			return fmt.Errorf("%s: expected a number", name)
+		}
+		u, err := strconv.ParseUint(string(n), 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%s: invalid value %s", name, n)
+		}
+		if limit, ok := state.limits[path]; ok && u > limit {
+			return fmt.Errorf("%s: value %d is larger than %d", name, u, limit)
+		}
+		settable.SetUint(u)
+	case reflect.Array:
+		list, ok := value.([]any)
+		if !ok || len(list) != v.Len() {
+			return fmt.Errorf("%s: expected an array of %d elements", name, v.Len())
+		}
+		for i, elem := range list {
+			if err := state.decode(v.Index(i), elem, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		object, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: expected an object", name)
+		}
+		fields, names := state.structFields(v.Type(), path)
+		byName := make(map[string]int, len(fields))
+		for i, field := range fields {
+			byName[names[i]] = field
+		}
+		for key, elem := range object {
+			field, ok := byName[key]
+			if !ok {
+				return fmt.Errorf("unknown field %#v", periphPath(path, key))
+			}
+			if err := state.decode(v.Field(field), elem, periphPath(path, key)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// #include "machine.h"
+import "C"
+
+// This file sets the permissions of memory regions with -permissions: whether
+// the firmware may run code from RAM and store to flash without going through
+// the flash controller. Running code from the peripheral and system regions
+// always faults, as they are execute-never on Cortex-M.
+
+// Memory permissions that -permissions sets, and what the machine can do when
+// the firmware goes against them.
+var permissionNames = map[string]C.permission_t{
+	"exec-ram":    C.PERM_EXEC_RAM,
+	"write-flash": C.PERM_WRITE_FLASH,
+}
+
+var accessActions = map[string]C.access_action_t{
+	"allow": C.ACCESS_ALLOW,
+	"warn":  C.ACCESS_WARN,
+	"fault": C.ACCESS_FAULT,
+}
+
+// Parse a list of permissions like "exec-ram=fault,write-flash=warn".
+func parsePermissions(spec string) (map[C.permission_t]C.access_action_t, error) {
+	permissions := map[C.permission_t]C.access_action_t{}
+	if spec == "" {
+		return permissions, nil
+	}
+	for _, field := range strings.Split(spec, ",") {
+		name, action, ok := strings.Cut(field, "=")
+		permission, known := permissionNames[name]
+		if !ok || !known {
+			return nil, fmt.Errorf("invalid permission %#v, expected exec-ram=ACTION or write-flash=ACTION", field)
+		}
+		if _, ok := accessActions[action]; !ok {
+			return nil, fmt.Errorf("invalid action %#v for %s, expected allow, warn or fault", action, name)
+		}
+		permissions[permission] = accessActions[action]
+	}
+	return permissions, nil
+}
+
+// Set the permissions of a list like "exec-ram=fault,write-flash=warn".
+func setPermissions(machine *C.machine_t, spec string) error {
+	permissions, err := parsePermissions(spec)
+	if err != nil {
+		return err
+	}
+	for permission, action := range permissions {
+		C.machine_set_permission(machine, permission, action)
+	}
+	return nil
+}
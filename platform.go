@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// #include "machine.h"
+import "C"
+
+// This file reads Renode platform descriptions (.repl files), so that existing
+// board definitions can be used to configure the emulator. Only the memory
+// map is used: the size of flash (where the firmware is loaded) and RAM (mapped
+// at 0x20000000), and where each peripheral is placed. Peripherals can then be
+// referred to by name with -peripheral, and peripherals that are neither
+// built in nor provided by an external model are reported.
+// Format:
+// https://renode.readthedocs.io/en/latest/advanced/platform_description_format.html
+
+// Size of a peripheral that doesn't specify its size.
+const platformDefaultPeripheralSize = 0x1000
+
+// platform is the memory map of a board.
+type platform struct {
+	flashSize   uint64
+	ramSize     uint64
+	peripherals map[string]*platformPeripheral
+}
+
+// A peripheral from a platform description.
+type platformPeripheral struct {
+	name       string
+	typ        string
+	address    uint64
+	size       uint64 // 0 if unknown
+	registered bool   // whether address is set (it is on the system bus)
+	irq        string // interrupt connection, like "nvic@2"
+}
+
+// Read a platform description, including the files it uses. Flash is the
+// memory at flashBase, where the firmware is loaded, or the largest memory
+// below RAM if there is none.
+func loadPlatform(path string, flashBase uint32) (*platform, error) {
+	p := &platform{peripherals: map[string]*platformPeripheral{}}
+	if err := p.load(path, "", nil); err != nil {
+		return nil, err
+	}
+	var flash *platformPeripheral
+	for _, periph := range p.peripherals {
+		if !periph.registered || !strings.HasPrefix(periph.typ, "Memory.") {
+			continue
+		}
+		if periph.address == 0x20000000 {
+			p.ramSize = periph.size
+		} else if uint64(flashBase)-periph.address < periph.size {
+			flash = periph
+		}
+	}
+	if flash == nil {
+		for _, periph := range p.peripherals {
+			if periph.registered && strings.HasPrefix(periph.typ, "Memory.") && periph.address < 0x20000000 && (flash == nil || periph.size > flash.size) {
+				flash = periph
+			}
+		}
+	}
+	if flash != nil {
+		p.flashSize = flash.size
+	}
+	return p, nil
+}
+
+// Parse a single file, prefixing all names with the given prefix. The parents
+// are the files that (indirectly) use it, to detect loops.
+func (p *platform) load(path, prefix string, parents []string) error {
+	for _, parent := range parents {
+		if parent == path {
+			return fmt.Errorf("%s uses itself", path)
+		}
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var current *platformPeripheral
+	for i, line := range strings.Split(string(data), "\n") {
+		if comment := strings.Index(line, "//"); comment >= 0 {
+			line = line[:comment]
+		}
+		text := strings.TrimSpace(line)
+		if text == "" {
+			continue
+		}
+		lineErr := func(format string, args ...interface{}) error {
+			return fmt.Errorf("%s:%d: %s", path, i+1, fmt.Sprintf(format, args...))
+		}
+
+		if line[0] != ' ' && line[0] != '\t' {
+			// A new entry, or a using statement.
+			current = nil
+			if strings.HasPrefix(text, "using ") {
+				// using "file" [prefixed "prefix"]
+				rest := strings.TrimSpace(text[len("using "):])
+				quoted, err := strconv.QuotedPrefix(rest)
+				if err != nil {
+					return lineErr("invalid using statement")
+				}
+				used, _ := strconv.Unquote(quoted)
+				usedPrefix := prefix
+				if rest = strings.TrimSpace(rest[len(quoted):]); strings.HasPrefix(rest, "prefixed ") {
+					extra, err := strconv.Unquote(strings.TrimSpace(rest[len("prefixed "):]))
+					if err != nil {
+						return lineErr("invalid using statement")
+					}
+					usedPrefix += extra
+				}
+				if !filepath.IsAbs(used) {
+					// Try relative to this file first, then relative to the
+					// current directory (like the Renode root).
+					if rel := filepath.Join(filepath.Dir(path), used); fileExists(rel) {
+						used = rel
+					}
+				}
+				if err := p.load(used, usedPrefix, append(parents, path)); err != nil {
+					return err
+				}
+				continue
+			}
+			colon := strings.IndexByte(text, ':')
+			if colon < 0 {
+				return lineErr("expected an entry like name: Type @ sysbus 0x40000000")
+			}
+			name := prefix + strings.TrimSpace(text[:colon])
+			current = p.peripherals[name]
+			if current == nil {
+				current = &platformPeripheral{name: name}
+				p.peripherals[name] = current
+			}
+			rest := text[colon+1:]
+			registration := ""
+			if at := strings.IndexByte(rest, '@'); at >= 0 {
+				rest, registration = rest[:at], rest[at+1:]
+			}
+			if typ := strings.TrimSpace(rest); typ != "" {
+				current.typ = typ
+			}
+			if err := current.register(registration); err != nil {
+				return lineErr("%v", err)
+			}
+			continue
+		}
+
+		// An attribute of the current entry.
+		if current == nil {
+			return lineErr("attribute outside an entry")
+		}
+		if strings.HasPrefix(text, "->") {
+			current.irq = strings.TrimSpace(text[2:])
+			continue
+		}
+		colon := strings.IndexByte(text, ':')
+		if colon < 0 {
+			// Connections of named interrupts, like "IRQ -> nvic@2".
+			if arrow := strings.Index(text, "->"); arrow >= 0 {
+				current.irq = strings.TrimSpace(text[arrow+2:])
+			}
+			continue
+		}
+		if key := strings.TrimSpace(text[:colon]); key == "size" {
+			size, err := parsePlatformNumber(text[colon+1:])
+			if err != nil {
+				return lineErr("invalid size")
+			}
+			current.size = size
+		}
+	}
+	return nil
+}
+
+// Parse the system bus registration of a peripheral, like "sysbus 0x40002000",
+// "sysbus <0x40002000, +0x400>" or "{ sysbus 0x40002000; ... }". Only the first
+// system bus address is used.
+func (periph *platformPeripheral) register(registration string) error {
+	registration = strings.Trim(strings.TrimSpace(registration), "{}")
+	for _, part := range strings.Split(registration, ";") {
+		fields := strings.Fields(part)
+		if len(fields) < 2 || fields[0] != "sysbus" {
+			continue
+		}
+		if strings.HasPrefix(fields[1], "<") {
+			// Address range: <start, +size>
+			inner := strings.Trim(strings.Join(fields[1:], ""), "<>")
+			bounds := strings.Split(inner, ",")
+			if len(bounds) != 2 || !strings.HasPrefix(bounds[1], "+") {
+				return fmt.Errorf("invalid address range %#v", part)
+			}
+			start, err1 := parsePlatformNumber(bounds[0])
+			size, err2 := parsePlatformNumber(bounds[1][1:])
+			if err1 != nil || err2 != nil {
+				return fmt.Errorf("invalid address range %#v", part)
+			}
+			periph.address, periph.size, periph.registered = start, size, true
+			return nil
+		}
+		address, err := parsePlatformNumber(fields[1])
+		if err != nil {
+			return fmt.Errorf("invalid address %#v", fields[1])
+		}
+		periph.address, periph.registered = address, true
+		return nil
+	}
+	return nil
+}
+
+func parsePlatformNumber(s string) (uint64, error) {
+	return strconv.ParseUint(strings.Replace(strings.TrimSpace(s), "_", "", -1), 0, 64)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Return the address range of the peripheral with the given name.
+func (p *platform) peripheralRange(name string) (start, size uint64, ok bool) {
+	periph := p.peripherals[name]
+	if periph == nil || !periph.registered {
+		return 0, 0, false
+	}
+	size = periph.size
+	if size == 0 {
+		size = platformDefaultPeripheralSize
+	}
+	return periph.address, size, true
+}
+
+// Report the peripherals in the platform that are not emulated: not built
+// into the emulator and not mapped to an external model. The CPU, memories and
+// interrupt controller are not reported.
+func (p *platform) reportMissing(w io.Writer, m *Machine) {
+	var names []string
+	for name, periph := range p.peripherals {
+		if !periph.registered || strings.HasPrefix(periph.typ, "Memory.") || strings.HasPrefix(periph.typ, "CPU.") || periph.address >= 0xe0000000 {
+			continue
+		}
+		if !isBuiltinPeripheral(m, periph.address) && !hasExternalPeripheral(m, periph.address) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		periph := p.peripherals[name]
+		irq := ""
+		if periph.irq != "" {
+			irq = ", interrupt " + periph.irq
+		}
+		fmt.Fprintf(w, "platform: %s (%s at 0x%08x%s) is not emulated\n", name, periph.typ, periph.address, irq)
+	}
+}
+
+// Return the peripherals built into the emulator core, from the same table as
+// the address decoder of machine.c.
+func builtinPeripherals(m *Machine) []C.builtin_periph_t {
+	var periphs *C.builtin_periph_t
+	n := C.machine_builtin_peripherals(m.machine.family, &periphs)
+	return unsafe.Slice(periphs, n)
+}
+
+// Return whether the emulator core emulates the peripheral at the given
+// address.
+func isBuiltinPeripheral(m *Machine, address uint64) bool {
+	for _, b := range builtinPeripherals(m) {
+		if address-uint64(b.start) < uint64(b.size) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// #include "machine.h"
+import "C"
+
+// The default energy model, roughly based on the nRF51822 datasheet.
+const defaultPowerModel = "run=4.1mA,sleep=2.6uA,deepsleep=0.6uA,uart=0.8mA,rng=0.5mA,radio=5.3mA"
+
+// Peripheral names as they can be used in the energy model.
+var powerPeripherals = map[string]C.periph_t{
+	"uart":  C.PERIPH_UART,
+	"rng":   C.PERIPH_RNG,
+	"radio": C.PERIPH_RADIO,
+}
+
+// A simple energy model: the current (in ampere) drawn in each CPU state plus
+// the extra current drawn by each peripheral while it is turned on.
+type powerModel struct {
+	run         float64
+	sleep       float64
+	deepSleep   float64
+	peripherals map[C.periph_t]float64
+}
+
+// Parse an energy model in the form "run=4mA,sleep=3uA,uart=1mA".
+func parsePowerModel(s string) (*powerModel, error) {
+	model := &powerModel{
+		peripherals: make(map[C.periph_t]float64),
+	}
+	for _, part := range strings.Split(s, ",") {
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid power model entry: %q", part)
+		}
+		current, err := parseCurrent(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		switch kv[0] {
+		case "run":
+			model.run = current
+		case "sleep":
+			model.sleep = current
+		case "deepsleep":
+			model.deepSleep = current
+		default:
+			periph, ok := powerPeripherals[kv[0]]
+			if !ok {
+				return nil, fmt.Errorf("unknown power model entry: %q", kv[0])
+			}
+			model.peripherals[periph] = current
+		}
+	}
+	return model, nil
+}
+
+// Parse a current like "4.5mA" into ampere.
+func parseCurrent(s string) (float64, error) {
+	units := []struct {
+		suffix string
+		factor float64
+	}{
+		{"nA", 1e-9},
+		{"uA", 1e-6},
+		{"mA", 1e-3},
+		{"A", 1},
+	}
+	for _, unit := range units {
+		if strings.HasSuffix(s, unit.suffix) {
+			value, err := strconv.ParseFloat(strings.TrimSuffix(s, unit.suffix), 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid current %q: %v", s, err)
+			}
+			return value * unit.factor, nil
+		}
+	}
+	return 0, errors.New("current must have a unit (nA, uA, mA, A): " + s)
+}
+
+// Print an estimate of the average current and battery life, based on the time
+// spent in each sleep state and the time peripherals were turned on.
+func printPowerReport(w io.Writer, machine *C.machine_t, model *powerModel, clock int, batteryCapacity float64) {
+	stats := machine.stats
+	seconds := func(cycles C.uint64_t) float64 {
+		return float64(cycles) / float64(clock)
+	}
+	total := seconds(stats.cycles)
+
+	// Charge used, in coulomb (ampere-seconds).
+	charge := seconds(stats.cycles_state[C.SLEEP_NONE])*model.run +
+		seconds(stats.cycles_state[C.SLEEP_LIGHT])*model.sleep +
+		seconds(stats.cycles_state[C.SLEEP_DEEP])*model.deepSleep
+	for periph, current := range model.peripherals {
+		charge += seconds(C.machine_periph_cycles(machine, periph)) * current
+	}
+
+	fmt.Fprintln(w, "power estimate:")
+	fmt.Fprintf(w, "  emulated time:   %.6fs (at %.3fMHz)\n", total, float64(clock)/1e6)
+	if total == 0 {
+		return
+	}
+	average := charge / total
+	fmt.Fprintf(w, "  average current: %s\n", formatCurrent(average))
+	if batteryCapacity > 0 && average > 0 {
+		hours := batteryCapacity * 1e-3 / average
+		fmt.Fprintf(w, "  battery life:    %.1fh (%.1f days) on a %gmAh battery\n", hours, hours/24, batteryCapacity)
+	}
+}
+
+// Format a current in ampere using an appropriate unit.
+func formatCurrent(current float64) string {
+	switch {
+	case current >= 1:
+		return fmt.Sprintf("%.3fA", current)
+	case current >= 1e-3:
+		return fmt.Sprintf("%.3fmA", current*1e3)
+	case current >= 1e-6:
+		return fmt.Sprintf("%.3fuA", current*1e6)
+	default:
+		return fmt.Sprintf("%.3fnA", current*1e9)
+	}
+}
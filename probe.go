@@ -0,0 +1,213 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"strings"
+	"unsafe"
+)
+
+// #include "machine.h"
+// void probeChanged(machine_t *machine, uint64_t cycle, uint32_t levels);
+import "C"
+
+// This file implements -probe, a logic analyzer on GPIO pins. The C core
+// reports every change of the levels of the probed pins, with the cycle at
+// which it happened. They are sampled at a fixed rate of emulated time and
+// written to a sigrok session file, which PulseView opens and which
+// sigrok-cli can run its protocol decoders on, for example:
+//
+//	emculator run -probe=sda=P0.26 -probe=scl=P0.27 firmware.elf
+//	sigrok-cli -i probe.sr -P i2c:scl=scl:sda=sda
+//
+// The session file is a zip archive with the samples in chunks of logic-1-N
+// files, a byte per sample (two with more than 8 probes). It is written while
+// the firmware runs and completed when the machine stops for good.
+// https://sigrok.org/wiki/File_format:Sigrok/v2
+
+// Size of a chunk of samples in the session file, like sigrok uses.
+const probeChunkSize = 4 << 20
+
+// A capture of the probed pins of a machine, being written to a session file.
+type probeCapture struct {
+	f        *os.File
+	zip      *zip.Writer
+	chunk    io.Writer // current logic-1-N file
+	chunks   int       // number of chunks started
+	inChunk  int       // bytes written to the current chunk
+	unitSize int       // bytes per sample
+	rate     uint64    // samples per second
+	levels   uint32    // levels since the last change
+	cycle    uint64    // cycle of the last written sample
+	clock    uint64    // clock frequency that cycle was counted at
+	fraction uint64    // part of a sample that wasn't written yet, in cycles * rate
+	err      error     // first write error
+}
+
+var probeCaptures machineMap[*probeCapture]
+
+// Probe GPIO pins like P0.26 (or sda=P0.26, to name the channel) and write
+// their levels to a sigrok session file at the given sample rate.
+func attachProbes(m *Machine, specs []string, path string, rate int) error {
+	if rate <= 0 {
+		return errors.New("the sample rate must be positive")
+	}
+	var names []string
+	var pins []C.uint32_t
+	for _, spec := range specs {
+		name, pinName := spec, spec
+		if i := strings.IndexByte(spec, '='); i >= 0 {
+			name, pinName = spec[:i], spec[i+1:]
+		}
+		pin, err := parseGPIOPin(pinName)
+		if err != nil {
+			return err
+		}
+		if pin < 0 || name == "" {
+			return fmt.Errorf("invalid probe %#v, expected a pin like P0.26 or a name and pin like sda=P0.26", spec)
+		}
+		names = append(names, name)
+		pins = append(pins, C.uint32_t(pin))
+	}
+	if len(pins) > C.MACHINE_PROBES {
+		return fmt.Errorf("too many probes, there can be %d", C.MACHINE_PROBES)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	p := &probeCapture{
+		f:        f,
+		zip:      zip.NewWriter(f),
+		unitSize: (len(pins) + 7) / 8,
+		rate:     uint64(rate),
+	}
+	p.writeFile("version", "2")
+	metadata := fmt.Sprintf("[global]\nsigrok version=0.5.2\n\n[device 1]\ncapturefile=logic-1\ntotal probes=%d\nsamplerate=%s\ntotal analog=0\n", len(names), probeRate(uint64(rate)))
+	for i, name := range names {
+		metadata += fmt.Sprintf("probe%d=%s\n", i+1, name)
+	}
+	metadata += fmt.Sprintf("unitsize=%d\n", p.unitSize)
+	p.writeFile("metadata", metadata)
+	if p.err != nil {
+		f.Close()
+		return p.err
+	}
+	probeCaptures.set(m.machine, p)
+	C.machine_set_probes(m.machine, C.probe_changed_t(C.probeChanged), unsafe.SliceData(pins), C.size_t(len(pins)))
+	p.levels = uint32(m.machine.probe.levels)
+	p.cycle = uint64(m.machine.stats.cycles)
+	p.clock = uint64(m.machine.clock)
+	return nil
+}
+
+// Format a sample rate the way sigrok does, like "4 MHz".
+func probeRate(rate uint64) string {
+	switch {
+	case rate%1000000000 == 0:
+		return fmt.Sprintf("%d GHz", rate/1000000000)
+	case rate%1000000 == 0:
+		return fmt.Sprintf("%d MHz", rate/1000000)
+	case rate%1000 == 0:
+		return fmt.Sprintf("%d kHz", rate/1000)
+	}
+	return fmt.Sprintf("%d Hz", rate)
+}
+
+// Add a small file to the session file.
+func (p *probeCapture) writeFile(name, data string) {
+	w, err := p.zip.Create(name)
+	if err == nil {
+		_, err = io.WriteString(w, data)
+	}
+	if err != nil && p.err == nil {
+		p.err = err
+	}
+}
+
+// Write samples with the last levels up to the given cycle.
+func (p *probeCapture) advance(machine *C.machine_t, cycle uint64) {
+	// Samples are counted in cycles * rate, which doesn't fit in 64 bits
+	// after a long time at a high sample rate.
+	hi, lo := bits.Mul64(cycle-p.cycle, p.rate)
+	lo, carry := bits.Add64(lo, p.fraction, 0)
+	n, rem := bits.Div64(hi+carry, lo, p.clock)
+	p.cycle = cycle
+	p.fraction = rem
+	if clock := uint64(machine.clock); clock != p.clock {
+		// The clock changed somewhere since the last change of the
+		// levels, which is counted at the old clock.
+		p.clock = clock
+		p.fraction = 0
+	}
+	p.write(n)
+}
+
+// Write n samples with the last levels.
+func (p *probeCapture) write(n uint64) {
+	var sample [4]byte
+	for i := range sample {
+		sample[i] = byte(p.levels >> (i * 8))
+	}
+	var buf [4096]byte
+	for i := 0; i < len(buf) && uint64(i) < n*uint64(p.unitSize); i += p.unitSize {
+		copy(buf[i:], sample[:p.unitSize])
+	}
+	for n != 0 && p.err == nil {
+		if p.chunk == nil || p.inChunk == probeChunkSize {
+			p.chunks++
+			p.chunk, p.err = p.zip.Create(fmt.Sprintf("logic-1-%d", p.chunks))
+			p.inChunk = 0
+			continue
+		}
+		size := uint64(probeChunkSize - p.inChunk)
+		if size > uint64(len(buf)) {
+			size = uint64(len(buf))
+		}
+		if size > n*uint64(p.unitSize) {
+			size = n * uint64(p.unitSize)
+		}
+		_, p.err = p.chunk.Write(buf[:size])
+		p.inChunk += int(size)
+		n -= size / uint64(p.unitSize)
+	}
+}
+
+// Write the samples up to now and complete the session file.
+func (p *probeCapture) close(machine *C.machine_t) error {
+	p.advance(machine, uint64(machine.stats.cycles))
+	if err := p.zip.Close(); err != nil && p.err == nil {
+		p.err = err
+	}
+	if err := p.f.Close(); err != nil && p.err == nil {
+		p.err = err
+	}
+	return p.err
+}
+
+// Save the -probe capture, if there is one. This is called when the firmware
+// stops for good.
+func saveProbes(m *Machine) {
+	p := probeCaptures.get(m.machine)
+	if p == nil {
+		return
+	}
+	probeCaptures.delete(m.machine)
+	C.machine_set_probes(m.machine, nil, nil, 0)
+	if err := p.close(m.machine); err != nil {
+		fmt.Fprintln(os.Stderr, "error: cannot save probes:", err)
+	}
+}
+
+// Record a change of the probed pins, for the C core.
+//
+//export probeChanged
+func probeChanged(machine *C.machine_t, cycle C.uint64_t, levels C.uint32_t) {
+	p := probeCaptures.get(machine)
+	p.advance(machine, uint64(cycle))
+	p.levels = uint32(levels)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// This file implements -watch-firmware: reload the firmware whenever a new
+// build appears, without restarting the emulator. The UART console, GDB and
+// everything else that is attached stays connected.
+
+// How often the firmware file is checked for changes.
+const firmwarePollInterval = 250 * time.Millisecond
+
+// Watch the firmware image at path and reload it when it changes. A new image
+// is only loaded once the file stopped changing, so that a half-written file
+// from a build that is still running isn't loaded. The firmware starts running
+// again after the reload, unless it was halted in the debugger.
+func watchFirmware(m *Machine, path string) {
+	stat := func() (time.Time, int64) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, -1
+		}
+		return info.ModTime(), info.Size()
+	}
+	loadedTime, loadedSize := stat()
+	lastTime, lastSize := loadedTime, loadedSize
+	for range time.Tick(firmwarePollInterval) {
+		modTime, size := stat()
+		changed := !modTime.Equal(lastTime) || size != lastSize
+		lastTime, lastSize = modTime, size
+		if changed || size < 0 || (modTime.Equal(loadedTime) && size == loadedSize) {
+			continue
+		}
+		loadedTime, loadedSize = modTime, size
+
+		m.Pause(func(running bool) error {
+			n, err := m.Reload(path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "\nwatch: cannot reload %s: %v\n", path, err)
+			} else {
+				fmt.Fprintf(os.Stderr, "\nwatch: reloaded %s (%d bytes)\n", path, n)
+			}
+			return nil
+		})
+	}
+}
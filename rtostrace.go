@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// #include "machine.h"
+import "C"
+
+// This file traces the scheduling of an RTOS with -rtos-trace: which task runs
+// when, and when interrupt handlers run. The trace is in the JSON array format
+// of the Trace Event Format, which Perfetto (https://ui.perfetto.dev) and
+// chrome://tracing show directly, and which can be converted for other tools
+// like Tracy or SystemView:
+// https://docs.google.com/document/d/1CvAClvFfyA5R-PhYUmn5OOQtYMH4h6I0nSsKchNAySU
+//
+// The running task is found through a pointer to it, like pxCurrentTCB of
+// FreeRTOS, which is checked every time an exception handler returns as that is
+// where RTOSes switch tasks on Cortex-M. The name of a task is read from its
+// task control block, at a fixed offset. The exceptions and the pointer are
+// recorded in the trace ring of the C core; names are read when the events are
+// handled, a little later.
+//
+// Events are written as they happen, so the closing bracket of the array is
+// missing. The format allows that, so the trace can be read while the firmware
+// is still running or after the emulator was killed.
+
+// Track ids of the trace.
+const (
+	rtosTraceTasks      = 1
+	rtosTraceInterrupts = 2
+)
+
+// The RTOSes that -rtos knows: where the pointer to the running task is and
+// where the name is in a task. The offset of pcTaskName in the TCB of FreeRTOS
+// is that of a build without MPU wrappers and list integrity checks.
+var rtosPresets = map[string]string{
+	"freertos": "pxCurrentTCB:52",
+}
+
+// Maximum length of a task name, like configMAX_TASK_NAME_LEN of FreeRTOS.
+const rtosTaskNameLength = 16
+
+type rtosTracer struct {
+	m          *Machine
+	w          io.Writer
+	current    uint32 // address of the current task pointer
+	nameOffset int    // offset of the task name in a task, or -1 if unknown
+	task       uint32 // task that was running at the last check
+	started    bool
+}
+
+var rtosTracers machineMap[*rtosTracer]
+
+// Write a scheduling trace of the RTOS described by spec (a preset of
+// rtosPresets, or SYMBOL[:NAMEOFFSET]) to the file at path.
+func attachRTOSTrace(m *Machine, path, spec string) error {
+	if preset, ok := rtosPresets[spec]; ok {
+		spec = preset
+	}
+	name, offset, hasOffset := strings.Cut(spec, ":")
+	t := &rtosTracer{m: m, nameOffset: -1}
+	if hasOffset {
+		n, err := strconv.Atoi(offset)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid task name offset in -rtos=%s", spec)
+		}
+		t.nameOffset = n
+	}
+	if m.debug == nil {
+		return fmt.Errorf("-rtos-trace needs an ELF file with symbols, to find %s", name)
+	}
+	sym, ok := m.debug.symbols[name]
+	if !ok {
+		return fmt.Errorf("-rtos-trace: symbol %s not found, set -rtos to the pointer to the running task", name)
+	}
+	t.current = sym.Address
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	ok = attachTraceRing(m.machine, func(event *C.trace_event_t) {
+		switch event._type {
+		case C.TRACE_EXCEPTION_ENTER, C.TRACE_EXCEPTION_RETURN:
+			t.exception(int(event.value), event._type == C.TRACE_EXCEPTION_ENTER, uint32(event.data), uint64(event.cycle))
+		}
+	}, nil)
+	if !ok {
+		f.Close()
+		return errors.New("cannot allocate the trace ring for -rtos-trace")
+	}
+	t.w = f
+	fmt.Fprintln(t.w, "[")
+	t.event(map[string]interface{}{"name": "process_name", "ph": "M", "pid": 1, "args": map[string]string{"name": "firmware"}})
+	t.event(map[string]interface{}{"name": "thread_name", "ph": "M", "pid": 1, "tid": rtosTraceTasks, "args": map[string]string{"name": "tasks"}})
+	t.event(map[string]interface{}{"name": "thread_name", "ph": "M", "pid": 1, "tid": rtosTraceInterrupts, "args": map[string]string{"name": "interrupts"}})
+	rtosTracers.set(m.machine, t)
+	C.machine_set_trace_sample(m.machine, C.uint32_t(t.current))
+	C.machine_set_exception_trace(m.machine, C.exception_trace_t(C.machine_trace_ring_exception))
+	return nil
+}
+
+// Write a single event, followed by a comma.
+func (t *rtosTracer) event(e map[string]interface{}) {
+	data, _ := json.Marshal(e)
+	fmt.Fprintf(t.w, "%s,\n", data)
+}
+
+// Write the start or end of a span on the given track, at the given cycle.
+func (t *rtosTracer) span(phase string, track int, name string, cycles uint64) {
+	us := float64(cycles) * 1e6 / float64(t.m.machine.clock)
+	t.event(map[string]interface{}{"name": name, "ph": phase, "pid": 1, "tid": track, "ts": us})
+}
+
+// Return the name of a task: the name in its task control block if it can be
+// read, or else its address.
+func (t *rtosTracer) taskName(task uint32) string {
+	if task == 0 {
+		return "(no task)"
+	}
+	if t.nameOffset >= 0 {
+		name := t.m.ReadMemory(int(task)+t.nameOffset, rtosTaskNameLength)
+		if i := bytes.IndexByte(name, 0); i >= 0 {
+			name = name[:i]
+		}
+		printable := len(name) != 0
+		for _, c := range name {
+			printable = printable && c >= ' ' && c <= '~'
+		}
+		if printable {
+			return string(name)
+		}
+	}
+	return fmt.Sprintf("0x%x", task)
+}
+
+// Check whether another task is running than at the previous check.
+func (t *rtosTracer) checkTask(task uint32, cycles uint64) {
+	if t.started && task == t.task {
+		return
+	}
+	if t.started {
+		t.span("E", rtosTraceTasks, t.taskName(t.task), cycles)
+	}
+	t.span("B", rtosTraceTasks, t.taskName(task), cycles)
+	t.task = task
+	t.started = true
+}
+
+// Trace an exception entry or return, with the running task at that time.
+func (t *rtosTracer) exception(exception int, enter bool, task uint32, cycles uint64) {
+	if !t.started {
+		t.checkTask(task, cycles)
+	}
+	name := exceptionName(exception)
+	if enter {
+		t.span("B", rtosTraceInterrupts, name, cycles)
+		return
+	}
+	t.span("E", rtosTraceInterrupts, name, cycles)
+	t.checkTask(task, cycles)
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This file implements "emculator test", which runs test scenarios. A
+// scenario is a small YAML file that says which firmware to run, what to type
+// on its UART and what it must print:
+//
+//	name: self test
+//	firmware: build/selftest.elf
+//	flags: [-machine=stm32, -sensor=bme280@0x76]
+//	input: "run\n"
+//	timeout: 10s
+//	expect:
+//	  - booting
+//	  - "PASS: 12 tests"
+//	exit: 0
+//
+// The expected strings must appear in the output (UART and emulator messages)
+// in this order, and the emulator must exit with the given status (0 by
+// default). The firmware path is relative to the scenario file. Each scenario
+// runs in its own "emculator run" process, with the flags of the test command
+// followed by those of the scenario.
+//
+// Firmware with a -display can be checked against a golden image, which is a
+// PNG file relative to the scenario (NAME=PATH for one of several displays):
+//
+//	screenshot: golden/menu.png
+//	tolerance: 8
+//
+// The image of the display when the emulator exits must match it, where color
+// components may differ by the tolerance (0 by default). A missing golden
+// image is created (and the scenario fails, so it is checked), and when the
+// images differ the screenshot is saved next to the golden image as
+// .actual.png, to inspect it or to replace the golden image.
+//
+// Interactions at set moments, like pressing buttons, typing and checking the
+// response in time, go in a -script file relative to the scenario:
+//
+//	script: menu.script
+
+// A test scenario read from a file.
+type scenario struct {
+	name     string
+	firmware string
+	flags    []string
+	input    *string
+	timeout  time.Duration
+	expect   []string
+	exit     int
+
+	screenshot string // golden image, as NAME=PATH or PATH
+	tolerance  int
+	script     string // see timeline.go
+}
+
+// Run the scenarios in the given files, with these extra flags, and return the
+// exit status: 1 if any of them failed.
+func runTests(paths []string, flags []string, w io.Writer) int {
+	if len(paths) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: emculator test [flags] SCENARIO...")
+		return 2
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	failed := 0
+	for _, path := range paths {
+		s, err := loadScenario(path)
+		if err != nil {
+			fmt.Fprintf(w, "FAIL %s: %v\n", path, err)
+			failed++
+			continue
+		}
+		start := time.Now()
+		output, err := s.run(exe, flags)
+		duration := time.Since(start).Round(time.Millisecond)
+		if err != nil {
+			fmt.Fprintf(w, "FAIL %s (%s): %v\n", s.name, duration, err)
+			printOutputTail(w, output, 20)
+			failed++
+			continue
+		}
+		fmt.Fprintf(w, "ok   %s (%s)\n", s.name, duration)
+	}
+	fmt.Fprintf(w, "%d passed, %d failed\n", len(paths)-failed, failed)
+	if failed != 0 {
+		return 1
+	}
+	return 0
+}
+
+// Run the scenario and check its output and exit status. The output is
+// returned so that it can be shown when the scenario fails.
+func (s *scenario) run(exe string, flags []string) ([]byte, error) {
+	args := []string{"run"}
+	args = append(args, flags...)
+	args = append(args, s.flags...)
+	args = append(args, "-timeout="+s.timeout.String())
+	if s.input != nil {
+		f, err := ioutil.TempFile("", "emculator-input-")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(f.Name())
+		_, err = f.WriteString(*s.input)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "-uart-input="+f.Name())
+	}
+	if s.script != "" {
+		args = append(args, "-script="+s.script)
+	}
+	var screenshot string
+	if s.screenshot != "" {
+		f, err := ioutil.TempFile("", "emculator-screenshot-*.png")
+		if err != nil {
+			return nil, err
+		}
+		screenshot = f.Name()
+		f.Close()
+		defer os.Remove(screenshot)
+		name, _ := splitScreenshotSpec(s.screenshot)
+		if name != "" {
+			name += "="
+		}
+		args = append(args, "-screenshot="+name+screenshot)
+	}
+	args = append(args, s.firmware)
+	var output bytes.Buffer
+	status, err := runEmulator(exe, args, &output, &output)
+	if err != nil {
+		return nil, err
+	}
+
+	rest := output.Bytes()
+	for _, expect := range s.expect {
+		i := bytes.Index(rest, []byte(expect))
+		if i < 0 {
+			return output.Bytes(), fmt.Errorf("expected %q in the output", expect)
+		}
+		rest = rest[i+len(expect):]
+	}
+	if status == exitTimeout && s.exit != exitTimeout {
+		return output.Bytes(), fmt.Errorf("timed out after %s", s.timeout)
+	}
+	if status != s.exit {
+		return output.Bytes(), fmt.Errorf("exit status %d, expected %d", status, s.exit)
+	}
+	if s.screenshot != "" {
+		if err := s.compareScreenshot(screenshot); err != nil {
+			return output.Bytes(), err
+		}
+	}
+	return output.Bytes(), nil
+}
+
+// Compare the screenshot that the emulator saved with the golden image.
+func (s *scenario) compareScreenshot(path string) error {
+	got, err := readPNG(path)
+	if err != nil {
+		return fmt.Errorf("no screenshot: %v", err)
+	}
+	_, golden := splitScreenshotSpec(s.screenshot)
+	if _, err := os.Stat(golden); os.IsNotExist(err) {
+		if err := writePNG(golden, got); err != nil {
+			return err
+		}
+		return fmt.Errorf("created the golden image %s, check it and run again", golden)
+	}
+	want, err := readPNG(golden)
+	if err != nil {
+		return err
+	}
+	if err := compareImages(got, want, s.tolerance); err != nil {
+		actual := strings.TrimSuffix(golden, filepath.Ext(golden)) + ".actual.png"
+		if saveErr := writePNG(actual, got); saveErr != nil {
+			return saveErr
+		}
+		return fmt.Errorf("screenshot differs from %s: %v (saved as %s)", golden, err, actual)
+	}
+	return nil
+}
+
+// Run the emulator in a new process and return its exit status.
+func runEmulator(exe string, args []string, stdout, stderr io.Writer) (int, error) {
+	cmd := exec.Command(exe, args...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode(), nil
+	}
+	return 0, err
+}
+
+// Print the last lines of the output of a failed scenario, indented.
+func printOutputTail(w io.Writer, output []byte, lines int) {
+	text := strings.Split(strings.TrimRight(string(output), "\n"), "\n")
+	if len(text) > lines {
+		fmt.Fprintf(w, "    ... (%d lines)\n", len(text)-lines)
+		text = text[len(text)-lines:]
+	}
+	for _, line := range text {
+		if line != "" {
+			fmt.Fprintf(w, "    %s\n", line)
+		}
+	}
+}
+
+// Read a scenario file. Only the subset of YAML shown above is supported:
+// keys with a scalar value or a list, either as [a, b] or as "- item" lines.
+func loadScenario(path string) (*scenario, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := &scenario{
+		name:    strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)),
+		timeout: 30 * time.Second,
+	}
+	scanner := bufio.NewScanner(f)
+	key := "" // key of the list that "- item" lines belong to
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimRight(stripConfigComment(scanner.Text()), " \t")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "- ") || trimmed == "-" {
+			if key == "" {
+				return nil, fmt.Errorf("%s:%d: list item without a key", path, lineno)
+			}
+			value, err := parseScenarioScalar(strings.TrimSpace(trimmed[1:]))
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, lineno, err)
+			}
+			if err := s.set(key, []string{value}); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, lineno, err)
+			}
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			return nil, fmt.Errorf("%s:%d: nested keys are not supported", path, lineno)
+		}
+		name, value, ok := strings.Cut(trimmed, ":")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected KEY: VALUE", path, lineno)
+		}
+		key = strings.TrimSpace(name)
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue // a list follows
+		}
+		var values []string
+		if strings.HasPrefix(value, "[") {
+			if !strings.HasSuffix(value, "]") {
+				return nil, fmt.Errorf("%s:%d: unterminated list", path, lineno)
+			}
+			rest := strings.TrimSpace(value[1 : len(value)-1])
+			for rest != "" {
+				var item string
+				item, rest, err = splitConfigItem(rest)
+				if err == nil {
+					item, err = parseScenarioScalar(item)
+				}
+				if err != nil {
+					return nil, fmt.Errorf("%s:%d: %v", path, lineno, err)
+				}
+				values = append(values, item)
+			}
+		} else {
+			item, err := parseScenarioScalar(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, lineno, err)
+			}
+			values = []string{item}
+		}
+		if err := s.set(key, values); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineno, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if s.firmware == "" {
+		return nil, fmt.Errorf("%s: no firmware", path)
+	}
+	if !filepath.IsAbs(s.firmware) {
+		s.firmware = filepath.Join(filepath.Dir(path), s.firmware)
+	}
+	if s.script != "" && !filepath.IsAbs(s.script) {
+		s.script = filepath.Join(filepath.Dir(path), s.script)
+	}
+	if name, golden := splitScreenshotSpec(s.screenshot); golden != "" && !filepath.IsAbs(golden) {
+		s.screenshot = filepath.Join(filepath.Dir(path), golden)
+		if name != "" {
+			s.screenshot = name + "=" + s.screenshot
+		}
+	}
+	return s, nil
+}
+
+// Set a key of the scenario. Values of list keys are appended.
+func (s *scenario) set(key string, values []string) error {
+	switch key {
+	case "flags":
+		s.flags = append(s.flags, values...)
+		return nil
+	case "expect":
+		s.expect = append(s.expect, values...)
+		return nil
+	}
+	if len(values) != 1 {
+		return fmt.Errorf("%s must be a single value", key)
+	}
+	value := values[0]
+	switch key {
+	case "name":
+		s.name = value
+	case "firmware":
+		s.firmware = value
+	case "input":
+		s.input = &value
+	case "timeout":
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid timeout %#v", value)
+		}
+		s.timeout = timeout
+	case "script":
+		s.script = value
+	case "screenshot":
+		s.screenshot = value
+	case "tolerance":
+		tolerance, err := strconv.Atoi(value)
+		if err != nil || tolerance < 0 || tolerance > 255 {
+			return fmt.Errorf("invalid tolerance %#v", value)
+		}
+		s.tolerance = tolerance
+	case "exit":
+		status, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid exit status %#v", value)
+		}
+		s.exit = status
+	default:
+		return fmt.Errorf("unknown key %#v", key)
+	}
+	return nil
+}
+
+// Parse a YAML scalar: a string in double quotes (with escapes), in single
+// quotes, or without quotes.
+func parseScenarioScalar(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		value, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid string %s", s)
+		}
+		return value, nil
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return "", fmt.Errorf("invalid string %s", s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case s == "":
+		return "", errors.New("empty value")
+	}
+	return s, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// When this is set, the test binary is the emulator that the scenarios run,
+// instead of running the tests.
+const testMainEnv = "EMCULATOR_TEST_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(testMainEnv) != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// Firmware that prints "hello" with semihosting and exits, so that scenarios
+// can run without the SDKs of tests/firmware.
+func helloFirmware() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, []uint32{
+		0x20001000, // initial stack pointer
+		0x00000009, // reset vector
+	})
+	binary.Write(&buf, binary.LittleEndian, []uint16{
+		0x2004, // movs r0, #4 (SYS_WRITE0)
+		0xa104, // adr r1, msg
+		0xbeab, // bkpt 0xab
+		0x2018, // movs r0, #0x18 (SYS_EXIT)
+		0x4901, // ldr r1, exit
+		0xbeab, // bkpt 0xab
+		0xe7fe, // b .
+		0xbf00, // nop
+	})
+	binary.Write(&buf, binary.LittleEndian, uint32(0x20026)) // exit: ADP_Stopped_ApplicationExit
+	buf.WriteString("hello\n\x00")                           // msg
+	return buf.Bytes()
+}
+
+// Write the files of a scenario to a temporary directory and return the path
+// of the scenario.
+func writeScenario(t *testing.T, yaml string) string {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "hello.bin"), helloFirmware(), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "hello.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRunScenario(t *testing.T) {
+	t.Setenv(testMainEnv, "1")
+	for _, tc := range []struct {
+		name   string
+		yaml   string
+		status int
+		report string
+	}{
+		{"pass", "name: hello\nfirmware: hello.bin\nexpect: [hel, \"lo\\n\"]\n", 0, "ok   hello"},
+		{"missing output", "name: hello\nfirmware: hello.bin\nexpect: [bye]\n", 1, `expected "bye" in the output`},
+		{"output out of order", "name: hello\nfirmware: hello.bin\nexpect: [lo, hel]\n", 1, `expected "hel" in the output`},
+		{"exit status", "name: hello\nfirmware: hello.bin\nexit: 3\n", 1, "exit status 0, expected 3"},
+		{"no firmware", "name: hello\nfirmware: missing.bin\n", 1, "FAIL hello"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := writeScenario(t, tc.yaml)
+			var report bytes.Buffer
+			status := runTests([]string{path}, nil, &report)
+			if status != tc.status {
+				t.Errorf("got status %d, expected %d:\n%s", status, tc.status, report.String())
+			}
+			if !strings.Contains(report.String(), tc.report) {
+				t.Errorf("expected %q in the report:\n%s", tc.report, report.String())
+			}
+		})
+	}
+}
+
+// The scenarios of tests/firmware need firmware that is built with external
+// SDKs, but they must at least be valid.
+func TestFirmwareScenarios(t *testing.T) {
+	paths, err := filepath.Glob("tests/firmware/*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no scenarios found")
+	}
+	for _, path := range paths {
+		s, err := loadScenario(path)
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+		if !strings.HasPrefix(s.firmware, filepath.Join("tests", "firmware", "build")+string(filepath.Separator)) {
+			t.Errorf("%s: firmware %s is not built by tests/firmware/build.sh", path, s.firmware)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// #include "machine.h"
+// int sdcardIO(machine_t *machine, uint32_t block, uint8_t *data, bool write);
+import "C"
+
+// This file connects the SD card model in the C core to a disk image on the
+// host. Writes go straight to the image file, so it can be inspected (or
+// mounted) after the firmware has run.
+
+// The disk image of each machine that has an SD card.
+var sdcardImages machineMap[*os.File]
+
+// Insert an SD card backed by the disk image at the given path. The chip
+// select pin is given as P0.22 or 22 on nRF chips, as PA4 on STM32 chips and
+// as 17 on the RP2040. An empty cs means the card is always selected.
+func attachSDCard(m *Machine, path, cs string) error {
+	pin, err := parseGPIOPin(cs)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if st.Size()%512 != 0 || st.Size() == 0 {
+		f.Close()
+		return errors.New("the image size must be a nonzero multiple of 512 bytes")
+	}
+	sdcardImages.set(m.machine, f)
+	C.machine_set_sdcard(m.machine, C.sdcard_io_t(C.sdcardIO), C.uint32_t(st.Size()/512), C.int32_t(pin))
+	return nil
+}
+
+// Parse a GPIO pin name like P0.22, 22 or PA4, and return port * 32 + pin. An
+// empty name results in -1.
+func parseGPIOPin(name string) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+	port, pin := 0, name
+	if len(name) >= 3 && name[0] == 'P' && name[1] >= 'A' && name[1] <= 'K' {
+		port, pin = int(name[1]-'A'), name[2:] // STM32: PA4
+	} else if strings.HasPrefix(name, "P") && strings.Contains(name, ".") {
+		parts := strings.SplitN(name[1:], ".", 2) // nRF: P0.22
+		n, err := strconv.Atoi(parts[0])
+		if err != nil || n < 0 || n > 1 {
+			return 0, fmt.Errorf("invalid GPIO port in %#v", name)
+		}
+		port, pin = n, parts[1]
+	}
+	n, err := strconv.Atoi(pin)
+	if err != nil || n < 0 || n >= 32 {
+		return 0, fmt.Errorf("invalid GPIO pin %#v", name)
+	}
+	return port*32 + n, nil
+}
+
+// Read or write a block of the SD card image, for the C core.
+//
+//export sdcardIO
+func sdcardIO(machine *C.machine_t, block C.uint32_t, data *C.uint8_t, write C.bool) C.int {
+	buf := (*[512]byte)(unsafe.Pointer(data))[:]
+	var err error
+	if write {
+		_, err = sdcardImages.get(machine).WriteAt(buf, int64(block)*512)
+	} else {
+		_, err = sdcardImages.get(machine).ReadAt(buf, int64(block)*512)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "\nSD card:", err)
+		return C.ERR_MEM
+	}
+	return C.ERR_OK
+}
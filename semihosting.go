@@ -0,0 +1,465 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// #include "machine.h"
+import "C"
+
+// This file implements ARM semihosting (BKPT 0xab) and the GDB File-I/O
+// protocol. Semihosting calls that access files are forwarded to GDB as
+// File-I/O requests while GDB is controlling the target, so that they run on
+// the machine where GDB runs. Otherwise they are executed on this host.
+// Semihosting specification:
+// https://github.com/ARM-software/abi-aa/blob/main/semihosting/semihosting.rst
+// File-I/O protocol:
+// https://sourceware.org/gdb/onlinedocs/gdb/File_002dI_002fO-Remote-Protocol-Extension.html
+
+// Semihosting operations.
+const (
+	semihostOpen         = 0x01
+	semihostClose        = 0x02
+	semihostWriteC       = 0x03
+	semihostWrite0       = 0x04
+	semihostWrite        = 0x05
+	semihostRead         = 0x06
+	semihostReadC        = 0x07
+	semihostIsError      = 0x08
+	semihostIsTTY        = 0x09
+	semihostSeek         = 0x0a
+	semihostFlen         = 0x0c
+	semihostRemove       = 0x0e
+	semihostRename       = 0x0f
+	semihostClock        = 0x10
+	semihostTime         = 0x11
+	semihostErrno        = 0x13
+	semihostGetCmdline   = 0x15
+	semihostExit         = 0x18
+	semihostExitExtended = 0x20
+)
+
+// Exit reason of SYS_EXIT for a normal exit.
+const semihostApplicationExit = 0x20026
+
+// File-I/O open flags, as used in the protocol.
+const (
+	fileIORead   = 0x0
+	fileIOWrite  = 0x1
+	fileIORdWr   = 0x2
+	fileIOAppend = 0x8
+	fileIOCreate = 0x200
+	fileIOTrunc  = 0x400
+)
+
+// File-I/O errno values, as used in the protocol. They differ from those of
+// the host, so host errors are converted with fileIOError.
+const (
+	fileIOEPERM        = 1
+	fileIOENOENT       = 2
+	fileIOEINTR        = 4
+	fileIOEBADF        = 9
+	fileIOEACCES       = 13
+	fileIOEFAULT       = 14
+	fileIOEBUSY        = 16
+	fileIOEEXIST       = 17
+	fileIOENODEV       = 19
+	fileIOENOTDIR      = 20
+	fileIOEISDIR       = 21
+	fileIOEINVAL       = 22
+	fileIOENFILE       = 23
+	fileIOEMFILE       = 24
+	fileIOEFBIG        = 27
+	fileIOENOSPC       = 28
+	fileIOESPIPE       = 29
+	fileIOEROFS        = 30
+	fileIOENAMETOOLONG = 91
+	fileIOEUNKNOWN     = 9999
+)
+
+// File-I/O errno values of host errors. Others are reported as
+// fileIOEUNKNOWN.
+var fileIOErrnos = map[syscall.Errno]int{
+	syscall.EPERM:        fileIOEPERM,
+	syscall.ENOENT:       fileIOENOENT,
+	syscall.EINTR:        fileIOEINTR,
+	syscall.EBADF:        fileIOEBADF,
+	syscall.EACCES:       fileIOEACCES,
+	syscall.EFAULT:       fileIOEFAULT,
+	syscall.EBUSY:        fileIOEBUSY,
+	syscall.EEXIST:       fileIOEEXIST,
+	syscall.ENODEV:       fileIOENODEV,
+	syscall.ENOTDIR:      fileIOENOTDIR,
+	syscall.EISDIR:       fileIOEISDIR,
+	syscall.EINVAL:       fileIOEINVAL,
+	syscall.ENFILE:       fileIOENFILE,
+	syscall.EMFILE:       fileIOEMFILE,
+	syscall.EFBIG:        fileIOEFBIG,
+	syscall.ENOSPC:       fileIOENOSPC,
+	syscall.ESPIPE:       fileIOESPIPE,
+	syscall.EROFS:        fileIOEROFS,
+	syscall.ENAMETOOLONG: fileIOENAMETOOLONG,
+}
+
+// File-I/O open flags for each semihosting open mode, which correspond to the
+// fopen modes "r", "rb", "r+", "r+b", "w", "wb", "w+", "w+b", "a", "ab", "a+"
+// and "a+b".
+var semihostOpenFlags = [12]uint32{
+	fileIORead, fileIORead,
+	fileIORdWr, fileIORdWr,
+	fileIOWrite | fileIOCreate | fileIOTrunc, fileIOWrite | fileIOCreate | fileIOTrunc,
+	fileIORdWr | fileIOCreate | fileIOTrunc, fileIORdWr | fileIOCreate | fileIOTrunc,
+	fileIOWrite | fileIOCreate | fileIOAppend, fileIOWrite | fileIOCreate | fileIOAppend,
+	fileIORdWr | fileIOCreate | fileIOAppend, fileIORdWr | fileIOCreate | fileIOAppend,
+}
+
+// Number of leading string arguments (pointer/length pairs) of each File-I/O
+// call.
+var fileIOStringArgs = map[string]int{
+	"open":   1,
+	"unlink": 1,
+	"rename": 2,
+}
+
+// A File-I/O system call. Pointers refer to target memory. A string argument
+// takes two entries: a pointer and the length including the terminating NUL
+// byte.
+type fileIOCall struct {
+	name   string
+	args   []uint32
+	result chan fileIOResult
+}
+
+// The result of a File-I/O call: the return value and an errno value.
+// Interrupted is set when the user interrupted the call in GDB, in which case
+// the target should halt afterwards.
+type fileIOResult struct {
+	ret         int64
+	errno       int
+	interrupted bool
+}
+
+// Format the call as a GDB File-I/O request packet, like
+// "Fopen,20001000/9,0,1a4".
+func (call *fileIOCall) packet() string {
+	var parts []string
+	args := call.args
+	for i := 0; i < fileIOStringArgs[call.name]; i++ {
+		parts = append(parts, fmt.Sprintf("%x/%x", args[0], args[1]))
+		args = args[2:]
+	}
+	for _, arg := range args {
+		parts = append(parts, strconv.FormatUint(uint64(arg), 16))
+	}
+	return "F" + call.name + "," + strings.Join(parts, ",")
+}
+
+// Handle a semihosting call after machine_run returned ERR_SEMIHOSTING. It
+// returns whether the firmware asked to exit, and with which exit code.
+func (m *Machine) semihost() (exit bool, code int) {
+	op := m.ReadRegister(0)
+	param := m.ReadRegister(1)
+	args := func(n int) []uint32 {
+		buf := m.ReadMemory(int(param), n*4)
+		words := make([]uint32, n)
+		for i := range words {
+			words[i] = binary.LittleEndian.Uint32(buf[i*4:])
+		}
+		return words
+	}
+	result := int64(-1)
+	switch op {
+	case semihostOpen:
+		a := args(3)
+		path := string(m.ReadMemory(int(a[0]), int(a[2])))
+		if path == ":tt" {
+			// The console: stdin for reading, stdout for writing and stderr
+			// for appending. Handles are file descriptors plus one, as a
+			// handle of 0 is not valid.
+			switch {
+			case a[1] < 4:
+				result = 1
+			case a[1] < 8:
+				result = 2
+			default:
+				result = 3
+			}
+		} else if a[1] < uint32(len(semihostOpenFlags)) {
+			result = m.fileIOCall("open", a[0], a[2]+1, semihostOpenFlags[a[1]], 0644)
+			if result >= 0 {
+				result++
+			}
+		}
+	case semihostClose:
+		a := args(1)
+		result = 0
+		if a[0] > 3 {
+			result = m.fileIOCall("close", a[0]-1)
+		}
+	case semihostWriteC:
+		result = m.fileIOCall("write", 1, param, 1)
+	case semihostWrite0:
+		length := uint32(0)
+		for m.ReadMemory(int(param+length), 1)[0] != 0 {
+			length++
+		}
+		result = m.fileIOCall("write", 1, param, length)
+	case semihostWrite:
+		// Returns the number of bytes that were not written.
+		a := args(3)
+		n := m.fileIOCall("write", a[0]-1, a[1], a[2])
+		result = int64(a[2])
+		if n > 0 {
+			result -= n
+		}
+	case semihostRead:
+		// Returns the number of bytes that were not read.
+		a := args(3)
+		n := m.fileIOCall("read", a[0]-1, a[1], a[2])
+		result = int64(a[2])
+		if n > 0 {
+			result -= n
+		}
+	case semihostReadC:
+		var buf [1]byte
+		if _, err := m.consoleInput.Read(buf[:]); err == nil {
+			result = int64(buf[0])
+		}
+	case semihostIsError:
+		if int32(args(1)[0]) < 0 {
+			result = 1
+		} else {
+			result = 0
+		}
+	case semihostIsTTY:
+		result = m.fileIOCall("isatty", args(1)[0]-1)
+	case semihostSeek:
+		a := args(2)
+		result = m.fileIOCall("lseek", a[0]-1, a[1], 0)
+		if result >= 0 {
+			result = 0
+		}
+	case semihostFlen:
+		// There is no fstat in semihosting, so seek to the end and back.
+		fd := args(1)[0] - 1
+		pos := m.fileIOCall("lseek", fd, 0, 1)
+		if pos >= 0 {
+			result = m.fileIOCall("lseek", fd, 0, 2)
+			m.fileIOCall("lseek", fd, uint32(pos), 0)
+		}
+	case semihostRemove:
+		a := args(2)
+		result = m.fileIOCall("unlink", a[0], a[1]+1)
+	case semihostRename:
+		a := args(4)
+		result = m.fileIOCall("rename", a[0], a[1]+1, a[2], a[3]+1)
+	case semihostClock:
+		// Centiseconds since the start of execution.
+		result = int64(uint64(m.machine.stats.cycles) * 100 / uint64(m.machine.clock))
+	case semihostTime:
+		if m.machine.deterministic {
+			result = int64(uint64(m.machine.stats.cycles) / uint64(m.machine.clock))
+		} else {
+			result = time.Now().Unix()
+		}
+	case semihostErrno:
+		result = int64(m.semihostErrno)
+	case semihostGetCmdline:
+		// The command line is set by GDB with the run command.
+		a := args(2)
+		if uint32(len(m.cmdline)) < a[1] {
+			m.WriteMemory(int(a[0]), append([]byte(m.cmdline), 0))
+			var buf [4]byte
+			binary.LittleEndian.PutUint32(buf[:], uint32(len(m.cmdline)))
+			m.WriteMemory(int(param)+4, buf[:])
+			result = 0
+		}
+	case semihostExit:
+		if param == semihostApplicationExit {
+			return true, 0
+		}
+		return true, 1
+	case semihostExitExtended:
+		a := args(2)
+		if a[0] == semihostApplicationExit {
+			return true, int(int32(a[1]))
+		}
+		return true, 1
+	default:
+		fmt.Fprintf(os.Stderr, "\nunknown semihosting operation 0x%x\n", op)
+	}
+	C.machine_writereg(m.machine, 0, C.uint32_t(result))
+	return false, 0
+}
+
+// Execute a File-I/O call, either through GDB or on this host. It returns the
+// result and stores the errno value for SYS_ERRNO.
+func (m *Machine) fileIOCall(name string, args ...uint32) int64 {
+	call := &fileIOCall{name: name, args: args}
+	var result fileIOResult
+	if m.gdbContinuing() {
+		call.result = make(chan fileIOResult)
+		m.fileIO <- call
+		result = <-call.result
+	} else {
+		result = m.hostFileIO(call)
+	}
+	if result.ret < 0 {
+		m.semihostErrno = result.errno
+	}
+	return result.ret
+}
+
+// Execute a File-I/O call on this host.
+func (m *Machine) hostFileIO(call *fileIOCall) fileIOResult {
+	str := func(ptr, length uint32) string {
+		if length == 0 {
+			return ""
+		}
+		return string(m.ReadMemory(int(ptr), int(length-1)))
+	}
+	file := func(fd uint32) io.ReadWriteSeeker {
+		switch fd {
+		case 0:
+			return consoleFile{r: m.consoleInput}
+		case 1:
+			return consoleFile{w: m.console}
+		case 2:
+			return consoleFile{w: os.Stderr}
+		}
+		if f, ok := m.hostFiles[fd]; ok {
+			return f
+		}
+		return nil
+	}
+	args := call.args
+	switch call.name {
+	case "open":
+		flags := 0
+		switch args[2] & 3 {
+		case fileIOWrite:
+			flags = os.O_WRONLY
+		case fileIORdWr:
+			flags = os.O_RDWR
+		}
+		if args[2]&fileIOAppend != 0 {
+			flags |= os.O_APPEND
+		}
+		if args[2]&fileIOCreate != 0 {
+			flags |= os.O_CREATE
+		}
+		if args[2]&fileIOTrunc != 0 {
+			flags |= os.O_TRUNC
+		}
+		f, err := os.OpenFile(str(args[0], args[1]), flags, os.FileMode(args[3]))
+		if err != nil {
+			return fileIOError(err)
+		}
+		fd := uint32(3)
+		for m.hostFiles[fd] != nil {
+			fd++
+		}
+		m.hostFiles[fd] = f
+		return fileIOResult{ret: int64(fd)}
+	case "close":
+		f, ok := m.hostFiles[args[0]]
+		if !ok {
+			return fileIOResult{ret: -1, errno: fileIOEBADF}
+		}
+		delete(m.hostFiles, args[0])
+		if err := f.Close(); err != nil {
+			return fileIOError(err)
+		}
+		return fileIOResult{}
+	case "read", "write":
+		f := file(args[0])
+		if f == nil {
+			return fileIOResult{ret: -1, errno: fileIOEBADF}
+		}
+		var n int
+		var err error
+		if call.name == "read" {
+			buf := make([]byte, args[2])
+			n, err = f.Read(buf)
+			m.WriteMemory(int(args[1]), buf[:n])
+			if err == io.EOF {
+				err = nil
+			}
+		} else {
+			n, err = f.Write(m.ReadMemory(int(args[1]), int(args[2])))
+		}
+		if err != nil && n == 0 {
+			return fileIOError(err)
+		}
+		return fileIOResult{ret: int64(n)}
+	case "lseek":
+		f := file(args[0])
+		if f == nil {
+			return fileIOResult{ret: -1, errno: fileIOEBADF}
+		}
+		pos, err := f.Seek(int64(int32(args[1])), int(args[2]))
+		if err != nil {
+			return fileIOError(err)
+		}
+		return fileIOResult{ret: pos}
+	case "isatty":
+		if args[0] < 3 {
+			return fileIOResult{ret: 1}
+		}
+		return fileIOResult{ret: 0}
+	case "unlink":
+		if err := os.Remove(str(args[0], args[1])); err != nil {
+			return fileIOError(err)
+		}
+		return fileIOResult{}
+	case "rename":
+		if err := os.Rename(str(args[0], args[1]), str(args[2], args[3])); err != nil {
+			return fileIOError(err)
+		}
+		return fileIOResult{}
+	}
+	return fileIOResult{ret: -1, errno: fileIOEUNKNOWN}
+}
+
+// Convert a Go error to a File-I/O result with a File-I/O errno value.
+func fileIOError(err error) fileIOResult {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		if n, ok := fileIOErrnos[errno]; ok {
+			return fileIOResult{ret: -1, errno: n}
+		}
+	}
+	return fileIOResult{ret: -1, errno: fileIOEUNKNOWN}
+}
+
+// consoleFile turns the console input or output into a non-seekable file.
+type consoleFile struct {
+	r io.Reader
+	w io.Writer
+}
+
+func (f consoleFile) Read(buf []byte) (int, error) {
+	if f.r == nil {
+		return 0, syscall.EBADF
+	}
+	return f.r.Read(buf)
+}
+
+func (f consoleFile) Write(buf []byte) (int, error) {
+	if f.w == nil {
+		return 0, syscall.EBADF
+	}
+	return f.w.Write(buf)
+}
+
+func (f consoleFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, syscall.ESPIPE
+}
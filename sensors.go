@@ -0,0 +1,848 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// #include "machine.h"
+// int busIO(machine_t *machine, bus_op_t op, uint32_t device, uint8_t *data);
+import "C"
+
+// This file implements a library of I2C and SPI sensors, whose readings come
+// from mathematical generators or from recorded data. Sensors are specified
+// on the command line like this:
+//
+//	bme280@0x76 temperature=sine(20,5,10s) humidity=40
+//	mpu6050 accel_x=noise(0,0.02) gyro_z=ramp(0,90,2s)+noise(0,0.5)
+//	bmi160@spi:P0.10 file=motion.csv
+//
+// The part after @ is the I2C address (the default address of the sensor if
+// left out) or spi: followed by the chip select pin. Each channel is set to a
+// stimulus:
+//
+//	25                        a constant
+//	sine(OFFSET,AMPLITUDE,PERIOD)
+//	square(LOW,HIGH,PERIOD)
+//	ramp(FROM,TO,DURATION)    linear change, after which TO is kept
+//	noise(MEAN,STDDEV)        Gaussian noise, seeded with -fault-seed
+//
+// Stimuli can be added together with +. Periods and durations are in seconds
+// or have a unit, like 10ms. With file=PATH, channels are played back from a
+// CSV file (with a header row) or a JSON file (an array of objects) that has
+// a time column in seconds and a column per channel. Values between two rows
+// are interpolated linearly. Time is the emulated time since start, so with
+// -deterministic the readings are the same on every run.
+
+// A source of sensor readings, as a function of the time in seconds.
+type stimulus interface {
+	value(t float64) float64
+}
+
+type constStimulus float64
+
+func (s constStimulus) value(t float64) float64 {
+	return float64(s)
+}
+
+type sineStimulus struct {
+	offset, amplitude, period float64
+}
+
+func (s sineStimulus) value(t float64) float64 {
+	return s.offset + s.amplitude*math.Sin(2*math.Pi*t/s.period)
+}
+
+type squareStimulus struct {
+	low, high, period float64
+}
+
+func (s squareStimulus) value(t float64) float64 {
+	if math.Mod(t, s.period) < s.period/2 {
+		return s.low
+	}
+	return s.high
+}
+
+type rampStimulus struct {
+	from, to, duration float64
+}
+
+func (s rampStimulus) value(t float64) float64 {
+	if t >= s.duration {
+		return s.to
+	}
+	return s.from + (s.to-s.from)*t/s.duration
+}
+
+type noiseStimulus struct {
+	mean, stddev float64
+	rng          *rand.Rand
+}
+
+func (s noiseStimulus) value(t float64) float64 {
+	return s.mean + s.stddev*s.rng.NormFloat64()
+}
+
+type sumStimulus []stimulus
+
+func (s sumStimulus) value(t float64) float64 {
+	sum := 0.0
+	for _, term := range s {
+		sum += term.value(t)
+	}
+	return sum
+}
+
+// A recorded channel, with the times in ascending order.
+type playbackStimulus struct {
+	times, values []float64
+}
+
+func (s *playbackStimulus) value(t float64) float64 {
+	i := sort.SearchFloat64s(s.times, t)
+	if i == 0 {
+		return s.values[0]
+	} else if i == len(s.times) {
+		return s.values[len(s.values)-1]
+	}
+	t0, t1 := s.times[i-1], s.times[i]
+	v0, v1 := s.values[i-1], s.values[i]
+	return v0 + (v1-v0)*(t-t0)/(t1-t0)
+}
+
+// Parse a stimulus expression like sine(20,5,10s)+noise(0,0.1).
+func parseStimulus(s string, rng *rand.Rand) (stimulus, error) {
+	var terms sumStimulus
+	depth, start := 0, 0
+	for i := 0; i <= len(s); i++ {
+		if i < len(s) {
+			switch s[i] {
+			case '(':
+				depth++
+				continue
+			case ')':
+				depth--
+				continue
+			case '+':
+				// Don't split exponents like 1e+3 or a leading sign.
+				if depth != 0 || i == start || s[i-1] == 'e' || s[i-1] == 'E' {
+					continue
+				}
+			default:
+				continue
+			}
+		}
+		term, err := parseStimulusTerm(s[start:i], rng)
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, term)
+		start = i + 1
+	}
+	if len(terms) == 1 {
+		return terms[0], nil
+	}
+	return terms, nil
+}
+
+func parseStimulusTerm(s string, rng *rand.Rand) (stimulus, error) {
+	open := strings.IndexByte(s, '(')
+	if open < 0 {
+		value, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid stimulus %q", s)
+		}
+		return constStimulus(value), nil
+	}
+	if !strings.HasSuffix(s, ")") {
+		return nil, fmt.Errorf("missing ) in %q", s)
+	}
+	name, args := s[:open], strings.Split(s[open+1:len(s)-1], ",")
+	if len(args) != map[string]int{"sine": 3, "square": 3, "ramp": 3, "noise": 2}[name] {
+		return nil, fmt.Errorf("invalid stimulus %q, expected sine(OFFSET,AMPLITUDE,PERIOD), square(LOW,HIGH,PERIOD), ramp(FROM,TO,DURATION) or noise(MEAN,STDDEV)", s)
+	}
+	var values [3]float64
+	for i, arg := range args {
+		var err error
+		if i == 2 {
+			values[i], err = parseSeconds(arg)
+			if err == nil && values[i] <= 0 {
+				err = fmt.Errorf("invalid stimulus %q: the period or duration must be positive", s)
+			}
+		} else {
+			values[i], err = strconv.ParseFloat(strings.TrimSpace(arg), 64)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch name {
+	case "sine":
+		return sineStimulus{values[0], values[1], values[2]}, nil
+	case "square":
+		return squareStimulus{values[0], values[1], values[2]}, nil
+	case "ramp":
+		return rampStimulus{values[0], values[1], values[2]}, nil
+	default:
+		return noiseStimulus{values[0], values[1], rng}, nil
+	}
+}
+
+// Parse a number of seconds, or a duration with a unit like 500ms.
+func parseSeconds(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if d, err := time.ParseDuration(s); err == nil {
+		return d.Seconds(), nil
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return value, nil
+}
+
+// Read the channels of a CSV or JSON playback file.
+func loadPlayback(path string) (map[string]*playbackStimulus, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rows []map[string]float64
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		if err := json.Unmarshal(data, &rows); err != nil {
+			return nil, err
+		}
+	} else {
+		records, err := csv.NewReader(strings.NewReader(string(data))).ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		if len(records) == 0 {
+			return nil, fmt.Errorf("%s: no header row", path)
+		}
+		for line, record := range records[1:] {
+			row := map[string]float64{}
+			for i, field := range record {
+				value, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+				if err != nil {
+					return nil, fmt.Errorf("%s:%d: invalid number %q", path, line+2, field)
+				}
+				row[strings.TrimSpace(records[0][i])] = value
+			}
+			rows = append(rows, row)
+		}
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("%s: no data", path)
+	}
+	channels := map[string]*playbackStimulus{}
+	for i, row := range rows {
+		t, ok := row["time"]
+		if !ok {
+			return nil, fmt.Errorf("%s: row %d has no time", path, i+1)
+		}
+		if i > 0 && t < rows[i-1]["time"] {
+			return nil, fmt.Errorf("%s: row %d goes back in time", path, i+1)
+		}
+		for name, value := range row {
+			if name == "time" {
+				continue
+			}
+			ch := channels[name]
+			if ch == nil {
+				ch = &playbackStimulus{}
+				channels[name] = ch
+			}
+			ch.times = append(ch.times, t)
+			ch.values = append(ch.values, value)
+		}
+	}
+	return channels, nil
+}
+
+// The registers of a sensor chip.
+type sensorModel interface {
+	// Take a new measurement, at the start of a read transfer. The values
+	// are indexed by channel name.
+	sample(t float64, values map[string]float64)
+	readRegister(reg uint8) uint8
+	writeRegister(reg, value uint8)
+}
+
+// A sensor chip that can be attached with -sensor.
+type sensorKind struct {
+	address  uint8              // default I2C address
+	channels map[string]float64 // channels with their default value
+	create   func() sensorModel
+	// Convert the first byte of an SPI transfer to a register address, or
+	// nil if the chip has no SPI interface. Bit 7 of the first byte is set
+	// for reads.
+	spiRegister func(b uint8) uint8
+}
+
+var imuChannels = map[string]float64{
+	"accel_x":     0, // in g
+	"accel_y":     0,
+	"accel_z":     1,
+	"gyro_x":      0, // in degrees per second
+	"gyro_y":      0,
+	"gyro_z":      0,
+	"temperature": 25, // in °C
+}
+
+var sensorKinds = map[string]sensorKind{
+	"mpu6050": {0x68, imuChannels, newMPU6050, nil},
+	"bmi160": {0x68, imuChannels, newBMI160, func(b uint8) uint8 {
+		return b & 0x7f
+	}},
+	"bme280": {0x76, map[string]float64{
+		"temperature": 25,     // in °C
+		"pressure":    101325, // in Pa
+		"humidity":    50,     // in %RH
+	}, newBME280, func(b uint8) uint8 {
+		return b | 0x80 // only 7 bits of the address are sent
+	}},
+}
+
+// A sensor attached to the I2C or SPI bus.
+type sensor struct {
+	kind     sensorKind
+	model    sensorModel
+	address  uint8 // I2C address, not used for SPI
+	channels map[string]stimulus
+	reg      uint8 // register to read or write next
+	pos      int   // bytes transferred since the start condition or chip select
+	write    bool  // the SPI transfer is a write
+}
+
+// Take a new measurement from the stimuli at the current emulated time.
+func (s *sensor) sample(machine *C.machine_t) {
+	t := float64(C.machine_time_us(machine)) / 1e6
+	values := make(map[string]float64, len(s.channels))
+	for name, ch := range s.channels {
+		values[name] = ch.value(t)
+	}
+	s.model.sample(t, values)
+}
+
+// The sensors of a machine, and the other I2C and SPI devices that are
+// implemented in Go.
+type sensorBus struct {
+	i2c     []*sensor
+	spi     []spiDevice // indexed by the SPI device index of the C core
+	current *sensor     // addressed I2C sensor
+}
+
+// A device on the SPI bus: a sensor or a display.
+type spiDevice interface {
+	// The chip select pin was driven low.
+	spiSelect()
+	// Exchange a byte: in is the byte from the controller (MOSI), and the
+	// result is the byte of the device (MISO).
+	spiTransfer(machine *C.machine_t, in uint8) uint8
+}
+
+var sensorBuses machineMap[*sensorBus]
+
+// Return the sensor bus of a machine, creating it when needed.
+func getSensorBus(m *Machine) *sensorBus {
+	b := sensorBuses.get(m.machine)
+	if b == nil {
+		b = &sensorBus{}
+		sensorBuses.set(m.machine, b)
+		C.machine_set_bus_handler(m.machine, C.bus_io_t(C.busIO))
+	}
+	return b
+}
+
+// Add a device with the given chip select pin to the SPI bus.
+func (b *sensorBus) addSPI(m *Machine, cs int, device spiDevice) error {
+	if C.machine_add_spi_device(m.machine, C.int32_t(cs)) < 0 {
+		return errors.New("too many SPI devices")
+	}
+	b.spi = append(b.spi, device)
+	return nil
+}
+
+// Attach a sensor to the machine, see the top of this file for the syntax of
+// spec.
+func addSensor(m *Machine, spec string, rng *rand.Rand) error {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return errors.New("empty sensor specification")
+	}
+	name, bus := fields[0], ""
+	if at := strings.IndexByte(name, '@'); at >= 0 {
+		name, bus = name[:at], name[at+1:]
+	}
+	kind, ok := sensorKinds[name]
+	if !ok {
+		var names []string
+		for name := range sensorKinds {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown sensor %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+	s := &sensor{kind: kind, model: kind.create(), address: kind.address, channels: map[string]stimulus{}}
+	cs := -1
+	if strings.HasPrefix(bus, "spi:") {
+		if kind.spiRegister == nil {
+			return fmt.Errorf("%s has no SPI interface", name)
+		}
+		pin, err := parseGPIOPin(bus[4:])
+		if err != nil {
+			return err
+		}
+		cs = pin
+	} else if bus != "" {
+		address, err := parseUint32(bus)
+		if err != nil || address >= 0x80 {
+			return fmt.Errorf("invalid I2C address %q", bus)
+		}
+		s.address = uint8(address)
+	}
+
+	// Channels from files are overridden by those set explicitly.
+	explicit := map[string]stimulus{}
+	for _, field := range fields[1:] {
+		eq := strings.IndexByte(field, '=')
+		if eq < 0 {
+			return fmt.Errorf("expected CHANNEL=STIMULUS, got %q", field)
+		}
+		channel, value := field[:eq], field[eq+1:]
+		if channel == "file" {
+			playback, err := loadPlayback(value)
+			if err != nil {
+				return err
+			}
+			for channel, ch := range playback {
+				if _, ok := kind.channels[channel]; !ok {
+					return fmt.Errorf("%s: %s has no channel %q", value, name, channel)
+				}
+				s.channels[channel] = ch
+			}
+			continue
+		}
+		if _, ok := kind.channels[channel]; !ok {
+			return fmt.Errorf("%s has no channel %q", name, channel)
+		}
+		stim, err := parseStimulus(value, rng)
+		if err != nil {
+			return err
+		}
+		explicit[channel] = stim
+	}
+	for channel, stim := range explicit {
+		s.channels[channel] = stim
+	}
+	for channel, value := range kind.channels {
+		if s.channels[channel] == nil {
+			s.channels[channel] = constStimulus(value)
+		}
+	}
+
+	b := getSensorBus(m)
+	if strings.HasPrefix(bus, "spi:") {
+		return b.addSPI(m, cs, s)
+	}
+	for _, other := range b.i2c {
+		if other.address == s.address {
+			return fmt.Errorf("I2C address 0x%02x is already in use", s.address)
+		}
+	}
+	b.i2c = append(b.i2c, s)
+	return nil
+}
+
+// Handle an I2C or SPI bus operation of the C core.
+//
+//export busIO
+func busIO(machine *C.machine_t, op C.bus_op_t, device C.uint32_t, data *C.uint8_t) C.int {
+	b := sensorBuses.get(machine)
+	switch op {
+	case C.BUS_I2C_START:
+		b.current = nil
+		for _, s := range b.i2c {
+			if s.address == uint8(*data>>1) {
+				b.current = s
+			}
+		}
+		if b.current == nil {
+			return C.ERR_MEM // NACK
+		}
+		b.current.pos = 0
+		if *data&1 != 0 {
+			b.current.sample(machine)
+		}
+	case C.BUS_I2C_WRITE:
+		s := b.current
+		if s == nil {
+			return C.ERR_MEM
+		}
+		if s.pos == 0 {
+			s.reg = uint8(*data)
+		} else {
+			s.model.writeRegister(s.reg, uint8(*data))
+			s.reg++
+		}
+		s.pos++
+	case C.BUS_I2C_READ:
+		if s := b.current; s != nil {
+			*data = C.uint8_t(s.model.readRegister(s.reg))
+			s.reg++
+		}
+	case C.BUS_I2C_STOP:
+		b.current = nil
+	case C.BUS_SPI_SELECT:
+		if int(device) < len(b.spi) {
+			b.spi[device].spiSelect()
+		}
+	case C.BUS_SPI_TRANSFER:
+		in := uint8(*data)
+		*data = 0xff
+		if int(device) >= len(b.spi) {
+			break // a device of -buslog, which doesn't drive MISO
+		}
+		*data = C.uint8_t(b.spi[device].spiTransfer(machine, in))
+	}
+	return C.ERR_OK
+}
+
+func (s *sensor) spiSelect() {
+	s.pos = 0
+}
+
+// Exchange a byte over SPI. The first byte after chip select is the register
+// address, with the direction in bit 7.
+func (s *sensor) spiTransfer(machine *C.machine_t, in uint8) uint8 {
+	out := uint8(0xff)
+	if s.pos == 0 {
+		s.reg = s.kind.spiRegister(in)
+		s.write = in&0x80 == 0
+		if !s.write {
+			s.sample(machine)
+		}
+	} else if s.write {
+		s.model.writeRegister(s.reg, in)
+		s.reg++
+	} else {
+		out = s.model.readRegister(s.reg)
+		s.reg++
+	}
+	s.pos++
+	return out
+}
+
+// Convert a reading to a 16-bit register value, saturating like the ADC of a
+// sensor would.
+func sensorInt16(value float64) uint16 {
+	return uint16(int16(math.Max(-32768, math.Min(32767, math.Round(value)))))
+}
+
+// InvenSense MPU-6050 6-axis IMU. The measurements are stored big-endian.
+type mpu6050 struct {
+	regs [128]uint8
+}
+
+func newMPU6050() sensorModel {
+	s := &mpu6050{}
+	s.reset()
+	return s
+}
+
+func (s *mpu6050) reset() {
+	s.regs = [128]uint8{}
+	s.regs[0x6b] = 0x40 // PWR_MGMT_1: SLEEP
+	s.regs[0x75] = 0x68 // WHO_AM_I
+}
+
+func (s *mpu6050) sample(t float64, values map[string]float64) {
+	accelScale := 16384 / float64(int(1)<<(s.regs[0x1c]>>3&3)) // ACCEL_CONFIG.AFS_SEL
+	gyroScale := 131 / float64(int(1)<<(s.regs[0x1b]>>3&3))    // GYRO_CONFIG.FS_SEL
+	measurements := []float64{
+		values["accel_x"] * accelScale,
+		values["accel_y"] * accelScale,
+		values["accel_z"] * accelScale,
+		(values["temperature"] - 36.53) * 340,
+		values["gyro_x"] * gyroScale,
+		values["gyro_y"] * gyroScale,
+		values["gyro_z"] * gyroScale,
+	}
+	for i, value := range measurements {
+		raw := sensorInt16(value)
+		s.regs[0x3b+i*2] = uint8(raw >> 8)
+		s.regs[0x3c+i*2] = uint8(raw)
+	}
+}
+
+func (s *mpu6050) readRegister(reg uint8) uint8 {
+	return s.regs[reg&0x7f]
+}
+
+func (s *mpu6050) writeRegister(reg, value uint8) {
+	reg &= 0x7f
+	if reg == 0x6b && value&0x80 != 0 { // PWR_MGMT_1.DEVICE_RESET
+		s.reset()
+	} else if reg != 0x75 && (reg < 0x3b || reg > 0x60) { // not WHO_AM_I or a measurement
+		s.regs[reg] = value
+	}
+}
+
+// Bosch BMI160 6-axis IMU. The measurements are stored little-endian, and
+// the accelerometer and gyroscope only measure after they have been started
+// with the CMD register.
+type bmi160 struct {
+	regs [128]uint8
+}
+
+func newBMI160() sensorModel {
+	s := &bmi160{}
+	s.reset()
+	return s
+}
+
+func (s *bmi160) reset() {
+	s.regs = [128]uint8{}
+	s.regs[0x00] = 0xd1 // CHIP_ID
+	s.regs[0x1b] = 0x10 // STATUS: nvm_rdy
+	s.regs[0x40] = 0x28 // ACC_CONF
+	s.regs[0x41] = 0x03 // ACC_RANGE: ±2g
+	s.regs[0x42] = 0x28 // GYR_CONF
+}
+
+func (s *bmi160) sample(t float64, values map[string]float64) {
+	put := func(reg int, value float64) {
+		raw := sensorInt16(value)
+		s.regs[reg] = uint8(raw)
+		s.regs[reg+1] = uint8(raw >> 8)
+	}
+	pmu := s.regs[0x03] // PMU_STATUS
+	if pmu>>4&3 != 0 {
+		scale := map[uint8]float64{3: 16384, 5: 8192, 8: 4096, 12: 2048}[s.regs[0x41]&0xf]
+		if scale == 0 {
+			scale = 16384
+		}
+		put(0x12, values["accel_x"]*scale)
+		put(0x14, values["accel_y"]*scale)
+		put(0x16, values["accel_z"]*scale)
+		s.regs[0x1b] |= 0x80 // drdy_acc
+	}
+	if pmu>>2&3 == 1 {
+		scale := 16.4 * float64(int(1)<<(s.regs[0x43]&7)) // GYR_RANGE
+		put(0x0c, values["gyro_x"]*scale)
+		put(0x0e, values["gyro_y"]*scale)
+		put(0x10, values["gyro_z"]*scale)
+		s.regs[0x1b] |= 0x40 // drdy_gyr
+	}
+	put(0x20, (values["temperature"]-23)*512)
+	sensortime := uint32(t / 39e-6) // 39µs per tick
+	s.regs[0x18] = uint8(sensortime)
+	s.regs[0x19] = uint8(sensortime >> 8)
+	s.regs[0x1a] = uint8(sensortime >> 16)
+}
+
+func (s *bmi160) readRegister(reg uint8) uint8 {
+	reg &= 0x7f
+	value := s.regs[reg]
+	if reg == 0x17 {
+		s.regs[0x1b] &^= 0x80 // reading the accelerometer data clears drdy_acc
+	} else if reg == 0x11 {
+		s.regs[0x1b] &^= 0x40
+	}
+	return value
+}
+
+func (s *bmi160) writeRegister(reg, value uint8) {
+	reg &= 0x7f
+	if reg == 0x7e { // CMD
+		switch {
+		case value == 0xb6: // softreset
+			s.reset()
+		case value&0xfc == 0x10: // acc_set_pmu_mode
+			s.regs[0x03] = s.regs[0x03]&^0x30 | (value&3)<<4
+		case value&0xfc == 0x14: // gyr_set_pmu_mode
+			s.regs[0x03] = s.regs[0x03]&^0x0c | (value&3)<<2
+		}
+	} else if reg >= 0x40 && reg < 0x7e {
+		s.regs[reg] = value
+	}
+}
+
+// Bosch BME280 temperature, pressure and humidity sensor. The raw ADC values
+// are chosen such that the compensation formulas of the datasheet, with the
+// typical calibration values below, result in the stimulus values.
+type bme280 struct {
+	regs [256]uint8
+}
+
+// Calibration values, as read from a real chip.
+const (
+	bme280T1 = 27504
+	bme280T2 = 26435
+	bme280T3 = -1000
+	bme280P1 = 36477
+	bme280P2 = -10685
+	bme280P3 = 3024
+	bme280P4 = 2855
+	bme280P5 = 140
+	bme280P6 = -7
+	bme280P7 = 15500
+	bme280P8 = -14600
+	bme280P9 = 6000
+	bme280H1 = 75
+	bme280H2 = 362
+	bme280H3 = 0
+	bme280H4 = 313
+	bme280H5 = 50
+	bme280H6 = 30
+)
+
+func newBME280() sensorModel {
+	s := &bme280{}
+	s.reset()
+	return s
+}
+
+func (s *bme280) reset() {
+	s.regs = [256]uint8{}
+	for i, value := range []int{bme280T1, bme280T2, bme280T3, bme280P1, bme280P2, bme280P3, bme280P4, bme280P5, bme280P6, bme280P7, bme280P8, bme280P9} {
+		s.regs[0x88+i*2] = uint8(value)
+		s.regs[0x89+i*2] = uint8(value >> 8)
+	}
+	s.regs[0xa1] = bme280H1
+	s.regs[0xe1] = bme280H2 & 0xff
+	s.regs[0xe2] = uint8(bme280H2 >> 8)
+	s.regs[0xe3] = bme280H3
+	s.regs[0xe4] = uint8(bme280H4 >> 4)
+	s.regs[0xe5] = uint8(bme280H4&0xf | bme280H5&0xf<<4)
+	s.regs[0xe6] = uint8(bme280H5 >> 4)
+	s.regs[0xe7] = bme280H6
+	s.regs[0xd0] = 0x60 // id
+	s.setData(0x80000, 0x80000, 0x8000)
+}
+
+func (s *bme280) setData(adcP, adcT, adcH int32) {
+	s.regs[0xf7] = uint8(adcP >> 12)
+	s.regs[0xf8] = uint8(adcP >> 4)
+	s.regs[0xf9] = uint8(adcP << 4)
+	s.regs[0xfa] = uint8(adcT >> 12)
+	s.regs[0xfb] = uint8(adcT >> 4)
+	s.regs[0xfc] = uint8(adcT << 4)
+	s.regs[0xfd] = uint8(adcH >> 8)
+	s.regs[0xfe] = uint8(adcH)
+}
+
+// Compensation formulas from the datasheet. The temperature is in 0.01 °C,
+// the pressure in Pa as Q24.8 and the humidity in %RH as Q22.10.
+func bme280Temperature(adc int32) (t, fine int32) {
+	var1 := ((adc>>3 - bme280T1<<1) * bme280T2) >> 11
+	var2 := (((adc>>4 - bme280T1) * (adc>>4 - bme280T1)) >> 12 * bme280T3) >> 14
+	fine = var1 + var2
+	return (fine*5 + 128) >> 8, fine
+}
+
+func bme280Pressure(adc, fine int32) int64 {
+	var1 := int64(fine) - 128000
+	var2 := var1 * var1 * bme280P6
+	var2 += (var1 * bme280P5) << 17
+	var2 += int64(bme280P4) << 35
+	var1 = (var1*var1*bme280P3)>>8 + (var1*bme280P2)<<12
+	var1 = ((int64(1)<<47 + var1) * bme280P1) >> 33
+	if var1 == 0 {
+		return 0
+	}
+	p := 1048576 - int64(adc)
+	p = ((p<<31 - var2) * 3125) / var1
+	var1 = (bme280P9 * (p >> 13) * (p >> 13)) >> 25
+	var2 = (bme280P8 * p) >> 19
+	return (p+var1+var2)>>8 + int64(bme280P7)<<4
+}
+
+func bme280Humidity(adc, fine int32) int32 {
+	v := fine - 76800
+	v = ((adc<<14 - bme280H4<<20 - bme280H5*v + 16384) >> 15) * ((((((v*bme280H6)>>10)*(((v*bme280H3)>>11)+32768))>>10+2097152)*bme280H2 + 8192) >> 14)
+	v -= (((v >> 15) * (v >> 15)) >> 7 * bme280H1) >> 4
+	if v < 0 {
+		v = 0
+	} else if v > 419430400 {
+		v = 419430400
+	}
+	return v >> 12
+}
+
+// Find the ADC value in [0, max) for which the monotonic function f is
+// closest to target.
+func bme280Search(max int32, increasing bool, target float64, f func(adc int32) float64) int32 {
+	lo, hi := int32(0), max-1
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if (f(mid) < target) == increasing {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	if lo > 0 && math.Abs(f(lo-1)-target) < math.Abs(f(lo)-target) {
+		lo--
+	}
+	return lo
+}
+
+func (s *bme280) sample(t float64, values map[string]float64) {
+	ctrlMeas := s.regs[0xf4]
+	if ctrlMeas&3 == 0 {
+		return // sleep mode: keep the last measurement
+	}
+	if ctrlMeas&3 != 3 {
+		s.regs[0xf4] &^= 3 // forced mode returns to sleep mode
+	}
+	adcT := bme280Search(1<<20, true, values["temperature"]*100, func(adc int32) float64 {
+		t, _ := bme280Temperature(adc)
+		return float64(t)
+	})
+	_, fine := bme280Temperature(adcT)
+	adcP := bme280Search(1<<20, false, values["pressure"]*256, func(adc int32) float64 {
+		return float64(bme280Pressure(adc, fine))
+	})
+	adcH := bme280Search(1<<16, true, values["humidity"]*1024, func(adc int32) float64 {
+		return float64(bme280Humidity(adc, fine))
+	})
+	// Measurements that are skipped (oversampling 0) read as 0x80000.
+	if ctrlMeas>>5 == 0 {
+		adcT = 0x80000
+	}
+	if ctrlMeas>>2&7 == 0 {
+		adcP = 0x80000
+	}
+	if s.regs[0xf2]&7 == 0 { // ctrl_hum
+		adcH = 0x8000
+	}
+	s.setData(adcP, adcT, adcH)
+}
+
+func (s *bme280) readRegister(reg uint8) uint8 {
+	return s.regs[reg]
+}
+
+func (s *bme280) writeRegister(reg, value uint8) {
+	switch reg {
+	case 0xe0: // reset
+		if value == 0xb6 {
+			s.reset()
+		}
+	case 0xf2, 0xf4, 0xf5: // ctrl_hum, ctrl_meas, config
+		s.regs[reg] = value
+	}
+}
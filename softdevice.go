@@ -0,0 +1,1173 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+	"unsafe"
+)
+
+// #include "machine.h"
+// void softDeviceAdvertise(machine_t *machine);
+import "C"
+
+// This file emulates the SoftDevice of an nRF52: the Bluetooth stack of Nordic
+// that applications built with the nRF5 SDK (and others, like the Adafruit
+// nRF52 core) run on. The proprietary SoftDevice isn't run at all. Its
+// supervisor calls are implemented with stubs instead, and the application
+// starts directly from its own vector table after the MBR and SoftDevice
+// region. Only enough is implemented to run such applications and let them
+// advertise: the advertising packets go out on the air, where the other
+// machines of a swarm receive them, but there are no scan responses or
+// connections. Other calls return NRF_ERROR_NOT_SUPPORTED with a warning.
+//
+// With -softdevice=s132 or s140, an application (like an ELF file linked for
+// the SoftDevice) starts at 0x26000 or 0x27000 respectively. Another start can
+// be given as s140:0x27000.
+
+// SoftDevices that -softdevice knows: their ID and the start of the
+// application after them in flash, for version 7.
+var softDeviceVariants = map[string]struct {
+	id       uint32
+	appStart uint32
+}{
+	"s132": {132, 0x26000},
+	"s140": {140, 0x27000},
+}
+
+// Error codes of the SoftDevice API (nrf_error.h, ble_err.h).
+const (
+	nrfSuccess                = 0
+	nrfErrorNoMem             = 4
+	nrfErrorNotFound          = 5
+	nrfErrorNotSupported      = 6
+	nrfErrorInvalidParam      = 7
+	nrfErrorInvalidState      = 8
+	nrfErrorInvalidLength     = 9
+	nrfErrorDataSize          = 12
+	nrfErrorForbidden         = 15
+	nrfErrorInvalidAddr       = 16
+	nrfErrorMutexTaken        = 0x2000
+	nrfErrorRandNotEnough     = 0x2007
+	bleErrorInvalidConnHandle = 0x3002
+	bleErrorInvalidAdvHandle  = 0x3004
+)
+
+const (
+	softDeviceEventIRQ          = 22 // SWI2_EGU2, the SD_EVT_IRQn
+	softDeviceRandPool          = 64
+	softDeviceVendorUUIDs       = 10 // the default of BLE_COMMON_CFG_VS_UUID
+	softDeviceFirstHandle       = 0x000c
+	bleGapAdvSetTerminated      = 0x26
+	bleGapAdvTerminatedTimeout  = 1
+	bleGapAdvTerminatedLimit    = 2
+	bleAdvertisingAccessAddress = 0x8e89bed600 // as prefix<<32 | base, see machine_radio_address
+	bleRadioMode1Mbit           = 3
+)
+
+// The state of an emulated SoftDevice.
+type softDevice struct {
+	m        *Machine
+	id       uint32
+	appStart uint32
+	enabled  bool
+	warned   map[uint8]bool
+
+	socEvents []uint32 // NRF_SOC_EVTS, for sd_evt_get
+	bleEvents [][]byte // ble_evt_t structures, for sd_ble_evt_get
+
+	addr       [7]byte // ble_gap_addr_t
+	deviceName []byte
+	appearance uint16
+	ppcp       [8]byte // ble_gap_conn_params_t
+	uuidBases  [][16]byte
+	nextHandle uint16
+	values     map[uint16]*gattsValue
+	adv        softDeviceAdv
+}
+
+// An advertising set, configured with sd_ble_gap_adv_set_configure.
+type softDeviceAdv struct {
+	configured bool
+	running    bool
+	data       [2]uint32 // ble_data_t of the advertising data: pointer and length
+	scanRsp    [2]uint32 // ble_data_t of the scan response data
+	pdu        byte      // PDU type, like ADV_IND
+	peer       [7]byte   // ble_gap_addr_t of the peer, for directed advertising
+	interval   uint64    // in cycles
+	duration   uint64    // in cycles, 0 if there is no timeout
+	maxEvents  int       // 0 if there is no limit
+	channels   []uint32  // radio frequencies, see machine_radio_send
+	events     int       // advertising events since the start
+	end        uint64    // cycle at which the duration is over
+}
+
+// The value of a GATT attribute.
+type gattsValue struct {
+	address  uint32 // of the value in application memory (BLE_GATTS_VLOC_USER), or 0
+	data     []byte // the value in the SoftDevice (BLE_GATTS_VLOC_STACK)
+	length   int
+	max      int
+	variable bool
+}
+
+var softDevices machineMap[*softDevice]
+
+// Parse -softdevice, like s140 or s140:0x27000.
+func parseSoftDevice(spec string) (id, appStart uint32, err error) {
+	name, start, hasStart := strings.Cut(spec, ":")
+	variant, ok := softDeviceVariants[name]
+	if !ok {
+		return 0, 0, fmt.Errorf("unknown SoftDevice %q, expected s132 or s140", name)
+	}
+	if hasStart {
+		variant.appStart, err = parseUint32(start)
+		if err != nil || variant.appStart == 0 || variant.appStart%4096 != 0 {
+			return 0, 0, fmt.Errorf("invalid application start %q", start)
+		}
+	}
+	return variant.id, variant.appStart, nil
+}
+
+// Emulate the SoftDevice of -softdevice for the application in flash. This
+// must be done before the machine is reset, so that it starts the application.
+func addSoftDevice(m *Machine, spec string) error {
+	id, appStart, err := parseSoftDevice(spec)
+	if err != nil {
+		return err
+	}
+	if m.machine.family != C.FAMILY_NRF {
+		return fmt.Errorf("a SoftDevice needs an nRF chip")
+	}
+	if appStart >= uint32(m.machine.image_size) {
+		return fmt.Errorf("the application start 0x%x is outside flash", appStart)
+	}
+	sd := &softDevice{
+		m:          m,
+		id:         id,
+		appStart:   appStart,
+		warned:     map[uint8]bool{},
+		deviceName: []byte("nRF5x"),
+		nextHandle: softDeviceFirstHandle,
+		values:     map[uint16]*gattsValue{},
+	}
+	sd.addr[0] = 1 << 1 // BLE_GAP_ADDR_TYPE_RANDOM_STATIC
+	for i := range m.machine.device.addr {
+		sd.addr[1+i] = byte(m.machine.device.addr[i])
+	}
+	sd.addr[6] |= 0xc0 // a static address has the two top bits set
+	softDevices.set(m.machine, sd)
+
+	// Code in the MBR and SoftDevice region doesn't exist, so a call into it
+	// is reported.
+	C.machine_set_boot_vectors(m.machine, C.uint32_t(appStart))
+	if err := m.AddStubRange(0, appStart); err != nil {
+		return err
+	}
+	sd.writeInfo()
+	for n := 0x10; n < 0x100; n++ {
+		number := uint8(n)
+		m.AddSVCStub(number, fmt.Sprintf("SoftDevice call 0x%02x", n), func(c *stubCall) error {
+			return sd.unsupported(c, number)
+		})
+	}
+	for number, call := range sd.calls() {
+		m.AddSVCStub(number, call.name, call.fn)
+	}
+	return nil
+}
+
+// The supervisor calls that are implemented, by number (nrf_svc.h, nrf_sdm.h,
+// nrf_soc.h, ble.h, ble_gap.h and ble_gatts.h).
+func (sd *softDevice) calls() map[uint8]stub {
+	success := func(c *stubCall) error {
+		c.Return(nrfSuccess)
+		return nil
+	}
+	notConnected := func(c *stubCall) error {
+		c.Return(bleErrorInvalidConnHandle)
+		return nil
+	}
+	return map[uint8]stub{
+		0x10: {"sd_softdevice_enable", sd.softDeviceEnable},
+		0x11: {"sd_softdevice_disable", sd.softDeviceDisable},
+		0x12: {"sd_softdevice_is_enabled", sd.softDeviceIsEnabled},
+		0x13: {"sd_softdevice_vector_table_base_set", sd.vectorTableBaseSet},
+		0x18: {"sd_mbr_command", sd.mbrCommand},
+
+		0x20: {"sd_ppi_channel_enable_get", sd.register(0x4001f500, true)},
+		0x21: {"sd_ppi_channel_enable_set", sd.register(0x4001f504, false)},
+		0x22: {"sd_ppi_channel_enable_clr", sd.register(0x4001f508, false)},
+		0x23: {"sd_ppi_channel_assign", sd.ppiChannelAssign},
+		0x24: {"sd_ppi_group_task_enable", sd.ppiGroupTask(0x4001f000)},
+		0x25: {"sd_ppi_group_task_disable", sd.ppiGroupTask(0x4001f004)},
+		0x26: {"sd_ppi_group_assign", sd.ppiGroup(false)},
+		0x27: {"sd_ppi_group_get", sd.ppiGroup(true)},
+		0x28: {"sd_flash_page_erase", sd.flashPageErase},
+		0x29: {"sd_flash_write", sd.flashWrite},
+		0x2c: {"sd_mutex_new", sd.mutex(0)},
+		0x2d: {"sd_mutex_acquire", sd.mutex(1)},
+		0x2e: {"sd_mutex_release", sd.mutex(0)},
+		0x2f: {"sd_rand_application_pool_capacity_get", sd.randPool},
+		0x30: {"sd_rand_application_bytes_available_get", sd.randPool},
+		0x31: {"sd_rand_application_vector_get", sd.randVectorGet},
+		0x32: {"sd_power_mode_set", success},
+		0x34: {"sd_power_reset_reason_get", sd.register(0x40000400, true)},
+		0x35: {"sd_power_reset_reason_clr", sd.register(0x40000400, false)},
+		0x36: {"sd_power_pof_enable", success},
+		0x37: {"sd_power_pof_threshold_set", success},
+		0x3c: {"sd_power_gpregret_set", sd.gpregret(0x3c)},
+		0x3d: {"sd_power_gpregret_clr", sd.gpregret(0x3d)},
+		0x3e: {"sd_power_gpregret_get", sd.gpregret(0x3e)},
+		0x3f: {"sd_power_dcdc_mode_set", success},
+		0x40: {"sd_power_dcdc0_mode_set", success},
+		0x41: {"sd_app_evt_wait", sd.appEvtWait},
+		0x42: {"sd_clock_hfclk_request", sd.task(0x40000000)},
+		0x43: {"sd_clock_hfclk_release", sd.task(0x40000004)},
+		0x44: {"sd_clock_hfclk_is_running", sd.hfclkIsRunning},
+		0x46: {"sd_ecb_block_encrypt", sd.ecbBlockEncrypt},
+		0x4b: {"sd_evt_get", sd.evtGet},
+		0x4c: {"sd_temp_get", sd.tempGet},
+
+		0x60: {"sd_ble_enable", success},
+		0x61: {"sd_ble_evt_get", sd.bleEvtGet},
+		0x62: {"sd_ble_uuid_vs_add", sd.uuidVSAdd},
+		0x63: {"sd_ble_uuid_decode", sd.uuidDecode},
+		0x64: {"sd_ble_uuid_encode", sd.uuidEncode},
+		0x65: {"sd_ble_version_get", sd.versionGet},
+		0x67: {"sd_ble_opt_set", success},
+		0x69: {"sd_ble_cfg_set", success},
+
+		0x6c: {"sd_ble_gap_addr_set", sd.gapAddrSet},
+		0x6d: {"sd_ble_gap_addr_get", sd.gapAddrGet},
+		0x72: {"sd_ble_gap_adv_set_configure", sd.gapAdvSetConfigure},
+		0x73: {"sd_ble_gap_adv_start", sd.gapAdvStart},
+		0x74: {"sd_ble_gap_adv_stop", sd.gapAdvStop},
+		0x76: {"sd_ble_gap_disconnect", notConnected},
+		0x77: {"sd_ble_gap_tx_power_set", success},
+		0x78: {"sd_ble_gap_appearance_set", sd.gapAppearanceSet},
+		0x79: {"sd_ble_gap_appearance_get", sd.gapAppearanceGet},
+		0x7a: {"sd_ble_gap_ppcp_set", sd.gapPPCP(false)},
+		0x7b: {"sd_ble_gap_ppcp_get", sd.gapPPCP(true)},
+		0x7c: {"sd_ble_gap_device_name_set", sd.gapDeviceNameSet},
+		0x7d: {"sd_ble_gap_device_name_get", sd.gapDeviceNameGet},
+		0x93: {"sd_ble_gap_adv_addr_get", sd.gapAdvAddrGet},
+
+		0xa8: {"sd_ble_gatts_service_add", sd.gattsServiceAdd},
+		0xaa: {"sd_ble_gatts_characteristic_add", sd.gattsCharacteristicAdd},
+		0xab: {"sd_ble_gatts_descriptor_add", sd.gattsDescriptorAdd},
+		0xac: {"sd_ble_gatts_value_set", sd.gattsValueSet},
+		0xad: {"sd_ble_gatts_value_get", sd.gattsValueGet},
+		0xae: {"sd_ble_gatts_hvx", notConnected},
+		0xaf: {"sd_ble_gatts_service_changed", notConnected},
+		0xb1: {"sd_ble_gatts_sys_attr_set", notConnected},
+		0xb3: {"sd_ble_gatts_initial_user_handle_get", sd.gattsInitialUserHandleGet},
+		0xb5: {"sd_ble_gatts_exchange_mtu_reply", notConnected},
+	}
+}
+
+// Write the information structure of the SoftDevice that follows the MBR, like
+// the SDK reads with SD_ID_GET, unless it is there already.
+func (sd *softDevice) writeInfo() {
+	const address = 0x3000 // MBR_SIZE + SOFTDEVICE_INFO_STRUCT_OFFSET
+	if sd.appStart < address+0x18 || sd.read32(address+0x04) == 0x51b1e5db {
+		return
+	}
+	info := make([]byte, 0x18)
+	info[0x00] = 0x18                                       // SD_INFO_STRUCT_SIZE
+	binary.LittleEndian.PutUint32(info[0x04:], 0x51b1e5db)  // SD_MAGIC_NUMBER
+	binary.LittleEndian.PutUint32(info[0x08:], sd.appStart) // SD_SIZE
+	binary.LittleEndian.PutUint32(info[0x10:], sd.id)       // SD_ID
+	binary.LittleEndian.PutUint32(info[0x14:], 7*1000000)   // SD_VERSION: 7.0.0
+	sd.m.WriteMemory(address, info)
+}
+
+// A call that isn't implemented: warn about it the first time.
+func (sd *softDevice) unsupported(c *stubCall, number uint8) error {
+	if !sd.warned[number] {
+		sd.warned[number] = true
+		fmt.Fprintf(os.Stderr, "\nsoftdevice: call 0x%02x is not emulated, returning NRF_ERROR_NOT_SUPPORTED (LR: %x)\n", number, c.regs[14]-1)
+	}
+	c.Return(nrfErrorNotSupported)
+	return nil
+}
+
+// Read a word of memory.
+func (sd *softDevice) read32(address uint32) uint32 {
+	return binary.LittleEndian.Uint32(sd.m.ReadMemory(int(address), 4))
+}
+
+// Write a word or halfword of memory, like a result of a call.
+func (sd *softDevice) write32(address, value uint32) {
+	sd.m.WriteMemory(int(address), binary.LittleEndian.AppendUint32(nil, value))
+}
+
+func (sd *softDevice) write16(address uint32, value uint16) {
+	sd.m.WriteMemory(int(address), binary.LittleEndian.AppendUint16(nil, value))
+}
+
+// Access a peripheral register on the bus, like the SoftDevice does for the
+// application. It returns the value that was loaded.
+func (sd *softDevice) bus(address uint32, store bool, value uint32) uint32 {
+	data := C.uint32_t(value)
+	C.machine_bus_transfer(sd.m.machine, C.uint32_t(address), C.bool(store), &data, C.WIDTH_32)
+	return uint32(data)
+}
+
+// A call that reads a register into the result pointer of its argument, or
+// writes its argument to the register.
+func (sd *softDevice) register(address uint32, load bool) func(c *stubCall) error {
+	return func(c *stubCall) error {
+		if load {
+			sd.write32(c.Uint32(), sd.bus(address, false, 0))
+		} else {
+			sd.bus(address, true, c.Uint32())
+		}
+		c.Return(nrfSuccess)
+		return nil
+	}
+}
+
+// A call that triggers a task.
+func (sd *softDevice) task(address uint32) func(c *stubCall) error {
+	return func(c *stubCall) error {
+		sd.bus(address, true, 1)
+		c.Return(nrfSuccess)
+		return nil
+	}
+}
+
+// Queue an event of the SoC library or the BLE stack, and pend the interrupt
+// that tells the application about it.
+func (sd *softDevice) signal() {
+	C.machine_pend_irq(sd.m.machine, softDeviceEventIRQ)
+	sd.m.machine.event = true // wakes sd_app_evt_wait
+}
+
+// sd_softdevice_enable(nrf_clock_lf_cfg_t const *p_clock_lf_cfg, nrf_fault_handler_t fault_handler)
+func (sd *softDevice) softDeviceEnable(c *stubCall) error {
+	if sd.enabled {
+		c.Return(nrfErrorInvalidState)
+		return nil
+	}
+	sd.enabled = true
+	sd.bus(0x40000008, true, 1) // CLOCK.TASKS_LFCLKSTART, for the RTC1 of the application
+	c.Return(nrfSuccess)
+	return nil
+}
+
+// sd_softdevice_disable(void)
+func (sd *softDevice) softDeviceDisable(c *stubCall) error {
+	sd.enabled = false
+	sd.adv.running = false
+	C.machine_set_host_timer(sd.m.machine, nil, 0)
+	c.Return(nrfSuccess)
+	return nil
+}
+
+// sd_softdevice_is_enabled(uint8_t *p_softdevice_enabled)
+func (sd *softDevice) softDeviceIsEnabled(c *stubCall) error {
+	enabled := byte(0)
+	if sd.enabled {
+		enabled = 1
+	}
+	c.Write(c.Uint32(), []byte{enabled})
+	c.Return(nrfSuccess)
+	return nil
+}
+
+// sd_softdevice_vector_table_base_set(uint32_t address): forward interrupts to
+// another vector table, like that of a boot loader.
+func (sd *softDevice) vectorTableBaseSet(c *stubCall) error {
+	sd.bus(0xe000ed08, true, c.Uint32()) // VTOR
+	c.Return(nrfSuccess)
+	return nil
+}
+
+// sd_mbr_command(sd_mbr_command_t *param): only the commands that don't copy
+// flash around are supported.
+func (sd *softDevice) mbrCommand(c *stubCall) error {
+	param := c.Uint32()
+	switch command := sd.read32(param); command {
+	case 2: // SD_MBR_COMMAND_INIT_SD
+	case 4, 5: // SD_MBR_COMMAND_VECTOR_TABLE_BASE_SET, SD_MBR_COMMAND_IRQ_FORWARD_ADDRESS_SET
+		sd.bus(0xe000ed08, true, sd.read32(param+4))
+	default:
+		fmt.Fprintf(os.Stderr, "\nsoftdevice: MBR command %d is not emulated (LR: %x)\n", command, c.regs[14]-1)
+		c.Return(nrfErrorNotSupported)
+		return nil
+	}
+	c.Return(nrfSuccess)
+	return nil
+}
+
+// sd_ppi_channel_assign(uint8_t channel_num, const volatile void *evt_endpoint, const volatile void *task_endpoint)
+func (sd *softDevice) ppiChannelAssign(c *stubCall) error {
+	channel := c.Uint32() & 0xff
+	if channel >= 20 {
+		c.Return(nrfErrorInvalidParam)
+		return nil
+	}
+	sd.bus(0x4001f510+8*channel, true, c.Uint32()) // CH[n].EEP
+	sd.bus(0x4001f514+8*channel, true, c.Uint32()) // CH[n].TEP
+	c.Return(nrfSuccess)
+	return nil
+}
+
+// sd_ppi_group_task_enable and sd_ppi_group_task_disable(uint8_t group_num)
+func (sd *softDevice) ppiGroupTask(address uint32) func(c *stubCall) error {
+	return func(c *stubCall) error {
+		sd.bus(address+8*(c.Uint32()&0xff), true, 1) // TASKS_CHG[n].EN or DIS
+		c.Return(nrfSuccess)
+		return nil
+	}
+}
+
+// sd_ppi_group_assign(uint8_t group_num, uint32_t channel_msk) and
+// sd_ppi_group_get(uint8_t group_num, uint32_t *p_channel_msk)
+func (sd *softDevice) ppiGroup(get bool) func(c *stubCall) error {
+	return func(c *stubCall) error {
+		address := 0x4001f800 + 4*(c.Uint32()&0xff) // CHG[n]
+		if get {
+			sd.write32(c.Uint32(), sd.bus(address, false, 0))
+		} else {
+			sd.bus(address, true, c.Uint32())
+		}
+		c.Return(nrfSuccess)
+		return nil
+	}
+}
+
+// Check that a flash operation is allowed: it must be in the application area
+// after the SoftDevice.
+func (sd *softDevice) flashAllowed(address, length uint32) uint32 {
+	if address%4 != 0 || uint64(address)+uint64(length) > uint64(sd.m.machine.image_size) {
+		return nrfErrorInvalidAddr
+	}
+	if address < sd.appStart {
+		return nrfErrorForbidden
+	}
+	return nrfSuccess
+}
+
+// Finish a flash operation: the SoftDevice does them in the background, and
+// reports with an event when they're done.
+func (sd *softDevice) flashDone(c *stubCall) {
+	sd.socEvents = append(sd.socEvents, 2) // NRF_EVT_FLASH_OPERATION_SUCCESS
+	sd.signal()
+	c.Return(nrfSuccess)
+}
+
+// sd_flash_page_erase(uint32_t page_number)
+func (sd *softDevice) flashPageErase(c *stubCall) error {
+	pagesize := uint32(sd.m.machine.pagesize)
+	address := c.Uint32() * pagesize
+	if err := sd.flashAllowed(address, pagesize); err != nrfSuccess {
+		c.Return(err)
+		return nil
+	}
+	sd.bus(0x4001e504, true, 2)       // NVMC.CONFIG: EEN
+	sd.bus(0x4001e508, true, address) // NVMC.ERASEPAGE
+	sd.bus(0x4001e504, true, 0)
+	sd.flashDone(c)
+	return nil
+}
+
+// sd_flash_write(uint32_t *p_dst, uint32_t const *p_src, uint32_t size)
+func (sd *softDevice) flashWrite(c *stubCall) error {
+	dst, src, size := c.Uint32(), c.Uint32(), c.Uint32()
+	if size == 0 || size > 1024 {
+		c.Return(nrfErrorInvalidLength)
+		return nil
+	}
+	if err := sd.flashAllowed(dst, size*4); err != nrfSuccess {
+		c.Return(err)
+		return nil
+	}
+	data := c.Read(src, int(size)*4)
+	sd.bus(0x4001e504, true, 1) // NVMC.CONFIG: WEN
+	for i := uint32(0); i < size; i++ {
+		sd.bus(dst+4*i, true, binary.LittleEndian.Uint32(data[4*i:]))
+	}
+	sd.bus(0x4001e504, true, 0)
+	sd.flashDone(c)
+	return nil
+}
+
+// sd_mutex_new, sd_mutex_acquire and sd_mutex_release(nrf_mutex_t *p_mutex)
+func (sd *softDevice) mutex(value byte) func(c *stubCall) error {
+	return func(c *stubCall) error {
+		mutex := c.Uint32()
+		if value == 1 && c.Read(mutex, 1)[0] == 1 {
+			c.Return(nrfErrorMutexTaken)
+			return nil
+		}
+		c.Write(mutex, []byte{value})
+		c.Return(nrfSuccess)
+		return nil
+	}
+}
+
+// sd_rand_application_pool_capacity_get and
+// sd_rand_application_bytes_available_get(uint8_t *p_bytes): the pool is
+// always full.
+func (sd *softDevice) randPool(c *stubCall) error {
+	c.Write(c.Uint32(), []byte{softDeviceRandPool})
+	c.Return(nrfSuccess)
+	return nil
+}
+
+// sd_rand_application_vector_get(uint8_t *p_buff, uint8_t length): the bytes
+// come from the RNG, so that they're reproducible like its values.
+func (sd *softDevice) randVectorGet(c *stubCall) error {
+	buf, length := c.Uint32(), c.Uint32()&0xff
+	if length > softDeviceRandPool {
+		c.Return(nrfErrorRandNotEnough)
+		return nil
+	}
+	data := make([]byte, length)
+	for i := range data {
+		data[i] = byte(sd.bus(0x4000d508, false, 0)) // RNG.VALUE
+	}
+	c.Write(buf, data)
+	c.Return(nrfSuccess)
+	return nil
+}
+
+// sd_power_gpregret_set, sd_power_gpregret_clr(uint32_t gpregret_id, uint32_t
+// gpregret_msk) and sd_power_gpregret_get(uint32_t gpregret_id, uint32_t
+// *p_gpregret)
+func (sd *softDevice) gpregret(number uint8) func(c *stubCall) error {
+	return func(c *stubCall) error {
+		id, arg := c.Uint32(), c.Uint32()
+		if id > 1 {
+			c.Return(nrfErrorInvalidParam)
+			return nil
+		}
+		address := 0x4000051c + 4*id // POWER.GPREGRET or GPREGRET2
+		value := sd.bus(address, false, 0)
+		switch number {
+		case 0x3c:
+			sd.bus(address, true, value|arg)
+		case 0x3d:
+			sd.bus(address, true, value&^arg)
+		default:
+			sd.write32(arg, value)
+		}
+		c.Return(nrfSuccess)
+		return nil
+	}
+}
+
+// sd_app_evt_wait(void): sleep until an interrupt or an event of the
+// SoftDevice, like WFE.
+func (sd *softDevice) appEvtWait(c *stubCall) error {
+	C.machine_wait_for_event(sd.m.machine)
+	c.Return(nrfSuccess)
+	return nil
+}
+
+// sd_clock_hfclk_is_running(uint32_t *p_is_running)
+func (sd *softDevice) hfclkIsRunning(c *stubCall) error {
+	sd.write32(c.Uint32(), sd.bus(0x4000040c, false, 0)>>16&1) // CLOCK.HFCLKSTAT.STATE
+	c.Return(nrfSuccess)
+	return nil
+}
+
+// sd_ecb_block_encrypt(nrf_ecb_hal_data_t *p_ecb_data): AES-128 of the
+// cleartext with the key, like the ECB peripheral.
+func (sd *softDevice) ecbBlockEncrypt(c *stubCall) error {
+	data := c.Uint32()
+	buf := c.Read(data, 32) // key, cleartext
+	block, err := aes.NewCipher(buf[:16])
+	if err != nil {
+		return err
+	}
+	ciphertext := make([]byte, 16)
+	block.Encrypt(ciphertext, buf[16:])
+	c.Write(data+32, ciphertext)
+	c.Return(nrfSuccess)
+	return nil
+}
+
+// sd_evt_get(uint32_t *p_evt_id)
+func (sd *softDevice) evtGet(c *stubCall) error {
+	if len(sd.socEvents) == 0 {
+		c.Return(nrfErrorNotFound)
+		return nil
+	}
+	sd.write32(c.Uint32(), sd.socEvents[0])
+	sd.socEvents = sd.socEvents[1:]
+	c.Return(nrfSuccess)
+	return nil
+}
+
+// sd_temp_get(int32_t *p_temp): the die temperature in 0.25 °C.
+func (sd *softDevice) tempGet(c *stubCall) error {
+	sd.write32(c.Uint32(), uint32(int32(sd.m.machine.device.temperature)/25))
+	c.Return(nrfSuccess)
+	return nil
+}
+
+// sd_ble_evt_get(uint8_t *p_dest, uint16_t *p_len)
+func (sd *softDevice) bleEvtGet(c *stubCall) error {
+	dest, lenPtr := c.Uint32(), c.Uint32()
+	if len(sd.bleEvents) == 0 {
+		c.Return(nrfErrorNotFound)
+		return nil
+	}
+	event := sd.bleEvents[0]
+	length := binary.LittleEndian.Uint16(c.Read(lenPtr, 2))
+	sd.write16(lenPtr, uint16(len(event)))
+	if dest == 0 {
+		// Only the length was asked for.
+		c.Return(nrfSuccess)
+		return nil
+	}
+	if int(length) < len(event) {
+		c.Return(nrfErrorDataSize)
+		return nil
+	}
+	c.Write(dest, event)
+	sd.bleEvents = sd.bleEvents[1:]
+	c.Return(nrfSuccess)
+	return nil
+}
+
+// sd_ble_uuid_vs_add(ble_uuid128_t const *p_vs_uuid, uint8_t *p_uuid_type)
+func (sd *softDevice) uuidVSAdd(c *stubCall) error {
+	var base [16]byte
+	copy(base[:], c.Read(c.Uint32(), 16))
+	base[12], base[13] = 0, 0 // replaced by the 16-bit UUID
+	typePtr := c.Uint32()
+	for i, b := range sd.uuidBases {
+		if b == base {
+			c.Write(typePtr, []byte{byte(2 + i)})
+			c.Return(nrfSuccess)
+			return nil
+		}
+	}
+	if len(sd.uuidBases) >= softDeviceVendorUUIDs {
+		c.Return(nrfErrorNoMem)
+		return nil
+	}
+	sd.uuidBases = append(sd.uuidBases, base)
+	c.Write(typePtr, []byte{byte(2 + len(sd.uuidBases) - 1)}) // BLE_UUID_TYPE_VENDOR_BEGIN and on
+	c.Return(nrfSuccess)
+	return nil
+}
+
+// sd_ble_uuid_decode(uint8_t uuid_le_len, uint8_t const *p_uuid_le, ble_uuid_t *p_uuid)
+func (sd *softDevice) uuidDecode(c *stubCall) error {
+	length, uuid, result := c.Uint32()&0xff, c.Uint32(), c.Uint32()
+	if length != 2 && length != 16 {
+		c.Return(nrfErrorInvalidLength)
+		return nil
+	}
+	data := c.Read(uuid, int(length))
+	if length == 2 {
+		c.Write(result, []byte{data[0], data[1], 1}) // BLE_UUID_TYPE_BLE
+		c.Return(nrfSuccess)
+		return nil
+	}
+	for i, base := range sd.uuidBases {
+		if bytes.Equal(base[:12], data[:12]) && bytes.Equal(base[14:], data[14:]) {
+			c.Write(result, []byte{data[12], data[13], byte(2 + i)})
+			c.Return(nrfSuccess)
+			return nil
+		}
+	}
+	c.Write(result, []byte{0, 0, 0}) // BLE_UUID_TYPE_UNKNOWN
+	c.Return(nrfErrorNotFound)
+	return nil
+}
+
+// sd_ble_uuid_encode(ble_uuid_t const *p_uuid, uint8_t *p_uuid_le_len, uint8_t *p_uuid_le)
+func (sd *softDevice) uuidEncode(c *stubCall) error {
+	uuid := c.Read(c.Uint32(), 3)
+	lenPtr, result := c.Uint32(), c.Uint32()
+	var encoded []byte
+	switch uuidType := int(uuid[2]); {
+	case uuidType == 1: // BLE_UUID_TYPE_BLE
+		encoded = uuid[:2]
+	case uuidType >= 2 && uuidType-2 < len(sd.uuidBases):
+		base := sd.uuidBases[uuidType-2]
+		encoded = base[:]
+		encoded[12], encoded[13] = uuid[0], uuid[1]
+	default:
+		c.Return(nrfErrorInvalidParam)
+		return nil
+	}
+	c.Write(lenPtr, []byte{byte(len(encoded))})
+	if result != 0 {
+		c.Write(result, encoded)
+	}
+	c.Return(nrfSuccess)
+	return nil
+}
+
+// sd_ble_version_get(ble_version_t *p_version)
+func (sd *softDevice) versionGet(c *stubCall) error {
+	version := make([]byte, 6)
+	version[0] = 9                                     // BLE_VERSION_NUMBER: Bluetooth 5.0
+	binary.LittleEndian.PutUint16(version[2:], 0x0059) // Nordic Semiconductor
+	c.Write(c.Uint32(), version)
+	c.Return(nrfSuccess)
+	return nil
+}
+
+// sd_ble_gap_addr_set(ble_gap_addr_t const *p_addr)
+func (sd *softDevice) gapAddrSet(c *stubCall) error {
+	if sd.adv.running {
+		c.Return(nrfErrorInvalidState)
+		return nil
+	}
+	copy(sd.addr[:], c.Read(c.Uint32(), 7))
+	c.Return(nrfSuccess)
+	return nil
+}
+
+// sd_ble_gap_addr_get(ble_gap_addr_t *p_addr)
+func (sd *softDevice) gapAddrGet(c *stubCall) error {
+	c.Write(c.Uint32(), sd.addr[:])
+	c.Return(nrfSuccess)
+	return nil
+}
+
+// sd_ble_gap_adv_addr_get(uint8_t adv_handle, ble_gap_addr_t *p_addr)
+func (sd *softDevice) gapAdvAddrGet(c *stubCall) error {
+	if c.Uint32()&0xff != 0 || !sd.adv.configured {
+		c.Return(bleErrorInvalidAdvHandle)
+		return nil
+	}
+	return sd.gapAddrGet(c)
+}
+
+// sd_ble_gap_adv_set_configure(uint8_t *p_adv_handle, ble_gap_adv_data_t const *p_adv_data, ble_gap_adv_params_t const *p_adv_params):
+// there is a single advertising set with handle 0. The data is read from the
+// buffers of the application for every advertising event, like the
+// SoftDevice does.
+func (sd *softDevice) gapAdvSetConfigure(c *stubCall) error {
+	handlePtr, data, params := c.Uint32(), c.Uint32(), c.Uint32()
+	switch handle := c.Read(handlePtr, 1)[0]; handle {
+	case 0xff: // BLE_GAP_ADV_SET_HANDLE_NOT_SET
+		if params == 0 {
+			c.Return(bleErrorInvalidAdvHandle)
+			return nil
+		}
+		c.Write(handlePtr, []byte{0})
+	case 0:
+	default:
+		c.Return(bleErrorInvalidAdvHandle)
+		return nil
+	}
+	adv := sd.adv
+	if params != 0 {
+		if adv.running {
+			c.Return(nrfErrorInvalidState)
+			return nil
+		}
+		p := c.Read(params, 24)
+		switch p[0] { // properties.type
+		case 1: // BLE_GAP_ADV_TYPE_CONNECTABLE_SCANNABLE_UNDIRECTED
+			adv.pdu = 0 // ADV_IND
+		case 2, 3: // BLE_GAP_ADV_TYPE_CONNECTABLE_NONSCANNABLE_DIRECTED(_HIGH_DUTY_CYCLE)
+			adv.pdu = 1 // ADV_DIRECT_IND
+			peer := binary.LittleEndian.Uint32(p[4:])
+			if peer == 0 {
+				c.Return(nrfErrorInvalidParam)
+				return nil
+			}
+			copy(adv.peer[:], c.Read(peer, 7))
+		case 4: // BLE_GAP_ADV_TYPE_NONCONNECTABLE_SCANNABLE_UNDIRECTED
+			adv.pdu = 6 // ADV_SCAN_IND
+		case 5: // BLE_GAP_ADV_TYPE_NONCONNECTABLE_NONSCANNABLE_UNDIRECTED
+			adv.pdu = 2 // ADV_NONCONN_IND
+		default:
+			// Extended advertising isn't emulated.
+			c.Return(nrfErrorNotSupported)
+			return nil
+		}
+		clock := uint64(sd.m.machine.clock)
+		adv.interval = uint64(binary.LittleEndian.Uint32(p[8:])) * 625 * clock / 1000000
+		adv.duration = uint64(binary.LittleEndian.Uint16(p[12:])) * clock / 100
+		adv.maxEvents = int(p[14])
+		if adv.interval == 0 {
+			c.Return(nrfErrorInvalidParam)
+			return nil
+		}
+		adv.channels = nil
+		for i, frequency := range []uint32{2, 26, 80} { // channel 37, 38 and 39
+			if p[19]&(1<<(5+i)) == 0 { // channel_mask[4]
+				adv.channels = append(adv.channels, frequency)
+			}
+		}
+		if len(adv.channels) == 0 {
+			c.Return(nrfErrorInvalidParam)
+			return nil
+		}
+	} else if !adv.configured {
+		c.Return(nrfErrorInvalidState)
+		return nil
+	}
+	if data != 0 {
+		d := c.Read(data, 16)
+		adv.data = [2]uint32{binary.LittleEndian.Uint32(d[0:]), uint32(binary.LittleEndian.Uint16(d[4:]))}
+		adv.scanRsp = [2]uint32{binary.LittleEndian.Uint32(d[8:]), uint32(binary.LittleEndian.Uint16(d[12:]))}
+		if adv.data[1] > 31 || adv.scanRsp[1] > 31 {
+			c.Return(nrfErrorInvalidLength)
+			return nil
+		}
+	}
+	adv.configured = true
+	sd.adv = adv
+	c.Return(nrfSuccess)
+	return nil
+}
+
+// sd_ble_gap_adv_start(uint8_t adv_handle, uint8_t conn_cfg_tag)
+func (sd *softDevice) gapAdvStart(c *stubCall) error {
+	if c.Uint32()&0xff != 0 {
+		c.Return(bleErrorInvalidAdvHandle)
+		return nil
+	}
+	if !sd.adv.configured || sd.adv.running {
+		c.Return(nrfErrorInvalidState)
+		return nil
+	}
+	now := uint64(sd.m.machine.stats.cycles)
+	sd.adv.running = true
+	sd.adv.events = 0
+	sd.adv.end = 0
+	if sd.adv.duration != 0 {
+		sd.adv.end = now + sd.adv.duration
+	}
+	C.machine_set_host_timer(sd.m.machine, C.host_timer_t(C.softDeviceAdvertise), C.uint64_t(now))
+	c.Return(nrfSuccess)
+	return nil
+}
+
+// sd_ble_gap_adv_stop(uint8_t adv_handle)
+func (sd *softDevice) gapAdvStop(c *stubCall) error {
+	if c.Uint32()&0xff != 0 {
+		c.Return(bleErrorInvalidAdvHandle)
+		return nil
+	}
+	if !sd.adv.running {
+		c.Return(nrfErrorInvalidState)
+		return nil
+	}
+	sd.adv.running = false
+	C.machine_set_host_timer(sd.m.machine, nil, 0)
+	c.Return(nrfSuccess)
+	return nil
+}
+
+// Send an advertising event, for the timer of the host.
+//
+//export softDeviceAdvertise
+func softDeviceAdvertise(machine *C.machine_t) {
+	softDevices.get(machine).advertise()
+}
+
+// Send the advertising packet on every channel, and schedule the next
+// advertising event.
+func (sd *softDevice) advertise() {
+	adv := &sd.adv
+	if !adv.running {
+		return
+	}
+	now := uint64(sd.m.machine.stats.cycles)
+	if adv.end != 0 && now >= adv.end {
+		sd.advTerminated(bleGapAdvTerminatedTimeout)
+		return
+	}
+
+	// The PDU: the header, the address of the advertiser and either the
+	// address of the peer or the advertising data.
+	packet := []byte{adv.pdu, 6}
+	if sd.addr[0]>>1 != 0 { // not BLE_GAP_ADDR_TYPE_PUBLIC
+		packet[0] |= 1 << 6 // TxAdd
+	}
+	packet = append(packet, sd.addr[1:]...)
+	if adv.pdu == 1 {
+		if adv.peer[0]>>1 != 0 {
+			packet[0] |= 1 << 7 // RxAdd
+		}
+		packet = append(packet, adv.peer[1:]...)
+	} else if adv.data[0] != 0 {
+		packet = append(packet, sd.m.ReadMemory(int(adv.data[0]), int(adv.data[1]))...)
+	}
+	packet[1] = byte(len(packet) - 2)
+	for _, frequency := range adv.channels {
+		C.machine_radio_send(sd.m.machine, (*C.uint8_t)(unsafe.Pointer(&packet[0])), C.uint32_t(len(packet)), C.uint32_t(frequency), bleRadioMode1Mbit, bleAdvertisingAccessAddress)
+	}
+
+	adv.events++
+	if adv.maxEvents != 0 && adv.events >= adv.maxEvents {
+		sd.advTerminated(bleGapAdvTerminatedLimit)
+		return
+	}
+	next := now + adv.interval
+	if adv.end != 0 && next > adv.end {
+		next = adv.end
+	}
+	C.machine_set_host_timer(sd.m.machine, C.host_timer_t(C.softDeviceAdvertise), C.uint64_t(next))
+}
+
+// Stop advertising by itself, and tell the application with a
+// BLE_GAP_EVT_ADV_SET_TERMINATED event.
+func (sd *softDevice) advTerminated(reason byte) {
+	sd.adv.running = false
+	event := make([]byte, 28)
+	binary.LittleEndian.PutUint16(event[0:], bleGapAdvSetTerminated)  // header.evt_id
+	binary.LittleEndian.PutUint16(event[2:], uint16(len(event)))      // header.evt_len
+	binary.LittleEndian.PutUint16(event[4:], 0xffff)                  // conn_handle: BLE_CONN_HANDLE_INVALID
+	event[8] = reason                                                 // reason
+	event[9] = 0                                                      // adv_handle
+	event[10] = byte(sd.adv.events)                                   // num_completed_adv_events
+	binary.LittleEndian.PutUint32(event[12:], sd.adv.data[0])         // adv_data
+	binary.LittleEndian.PutUint16(event[16:], uint16(sd.adv.data[1])) //
+	binary.LittleEndian.PutUint32(event[20:], sd.adv.scanRsp[0])      //
+	binary.LittleEndian.PutUint16(event[24:], uint16(sd.adv.scanRsp[1]))
+	sd.bleEvents = append(sd.bleEvents, event)
+	sd.signal()
+}
+
+// sd_ble_gap_appearance_set(uint16_t appearance)
+func (sd *softDevice) gapAppearanceSet(c *stubCall) error {
+	sd.appearance = uint16(c.Uint32())
+	c.Return(nrfSuccess)
+	return nil
+}
+
+// sd_ble_gap_appearance_get(uint16_t *p_appearance)
+func (sd *softDevice) gapAppearanceGet(c *stubCall) error {
+	sd.write16(c.Uint32(), sd.appearance)
+	c.Return(nrfSuccess)
+	return nil
+}
+
+// sd_ble_gap_ppcp_set(ble_gap_conn_params_t const *p_conn_params) and
+// sd_ble_gap_ppcp_get(ble_gap_conn_params_t *p_conn_params)
+func (sd *softDevice) gapPPCP(get bool) func(c *stubCall) error {
+	return func(c *stubCall) error {
+		if get {
+			c.Write(c.Uint32(), sd.ppcp[:])
+		} else {
+			copy(sd.ppcp[:], c.Read(c.Uint32(), len(sd.ppcp)))
+		}
+		c.Return(nrfSuccess)
+		return nil
+	}
+}
+
+// sd_ble_gap_device_name_set(ble_gap_conn_sec_mode_t const *p_write_perm, uint8_t const *p_dev_name, uint16_t len)
+func (sd *softDevice) gapDeviceNameSet(c *stubCall) error {
+	c.Uint32()
+	name, length := c.Uint32(), c.Uint32()&0xffff
+	if length > 248 { // BLE_GAP_DEVNAME_MAX_LEN
+		c.Return(nrfErrorDataSize)
+		return nil
+	}
+	sd.deviceName = c.Read(name, int(length))
+	c.Return(nrfSuccess)
+	return nil
+}
+
+// sd_ble_gap_device_name_get(uint8_t *p_dev_name, uint16_t *p_len)
+func (sd *softDevice) gapDeviceNameGet(c *stubCall) error {
+	name, lenPtr := c.Uint32(), c.Uint32()
+	length := binary.LittleEndian.Uint16(c.Read(lenPtr, 2))
+	if name == 0 {
+		sd.write16(lenPtr, uint16(len(sd.deviceName)))
+		c.Return(nrfSuccess)
+		return nil
+	}
+	if int(length) < len(sd.deviceName) {
+		c.Return(nrfErrorDataSize)
+		return nil
+	}
+	c.Write(name, sd.deviceName)
+	sd.write16(lenPtr, uint16(len(sd.deviceName)))
+	c.Return(nrfSuccess)
+	return nil
+}
+
+// Add an attribute with a value, described by a ble_gatts_attr_t. It returns
+// the handle, or 0 with the error.
+func (sd *softDevice) gattsAddValue(attr uint32) (uint16, uint32) {
+	a := sd.m.ReadMemory(int(attr), 20)
+	md := binary.LittleEndian.Uint32(a[4:])
+	initLen := int(binary.LittleEndian.Uint16(a[8:]))
+	initOffs := int(binary.LittleEndian.Uint16(a[10:]))
+	maxLen := int(binary.LittleEndian.Uint16(a[12:]))
+	value := binary.LittleEndian.Uint32(a[16:])
+	if md == 0 || initOffs+initLen > maxLen || maxLen > 512 {
+		return 0, nrfErrorInvalidParam
+	}
+	flags := sd.m.ReadMemory(int(md)+2, 1)[0]
+	v := &gattsValue{length: initLen, max: maxLen, variable: flags&1 != 0}
+	switch flags >> 1 & 3 { // vloc
+	case 1: // BLE_GATTS_VLOC_STACK
+		v.data = make([]byte, maxLen)
+		if value != 0 {
+			copy(v.data[initOffs:], sd.m.ReadMemory(int(value)+initOffs, initLen))
+		}
+	case 2: // BLE_GATTS_VLOC_USER
+		if value == 0 {
+			return 0, nrfErrorInvalidParam
+		}
+		v.address = value
+	default:
+		return 0, nrfErrorInvalidParam
+	}
+	handle := sd.nextHandle
+	sd.nextHandle++
+	sd.values[handle] = v
+	return handle, nrfSuccess
+}
+
+// sd_ble_gatts_service_add(uint8_t type, ble_uuid_t const *p_uuid, uint16_t *p_handle)
+func (sd *softDevice) gattsServiceAdd(c *stubCall) error {
+	c.Uint32()
+	c.Uint32()
+	sd.write16(c.Uint32(), sd.nextHandle)
+	sd.nextHandle++
+	c.Return(nrfSuccess)
+	return nil
+}
+
+// sd_ble_gatts_characteristic_add(uint16_t service_handle, ble_gatts_char_md_t const *p_char_md, ble_gatts_attr_t const *p_attr_char_value, ble_gatts_char_handles_t *p_handles):
+// the declaration is followed by the value, the user description, the CCCD
+// and the SCCD, as far as they're there.
+func (sd *softDevice) gattsCharacteristicAdd(c *stubCall) error {
+	c.Uint32()
+	md := c.Read(c.Uint32(), 28)
+	attr, handlesPtr := c.Uint32(), c.Uint32()
+	sd.nextHandle++ // the declaration
+	var handles [4]uint16
+	var err uint32
+	handles[0], err = sd.gattsAddValue(attr)
+	if err != nrfSuccess {
+		c.Return(err)
+		return nil
+	}
+	props := md[0]
+	if desc := binary.LittleEndian.Uint32(md[4:]); desc != 0 { // p_char_user_desc
+		maxSize := int(binary.LittleEndian.Uint16(md[8:]))
+		size := int(binary.LittleEndian.Uint16(md[10:]))
+		if size > maxSize {
+			c.Return(nrfErrorInvalidParam)
+			return nil
+		}
+		v := &gattsValue{data: make([]byte, maxSize), length: size, max: maxSize, variable: true}
+		copy(v.data, c.Read(desc, size))
+		handles[1] = sd.nextHandle
+		sd.values[handles[1]] = v
+		sd.nextHandle++
+	}
+	if props&(1<<4|1<<5) != 0 { // notify, indicate
+		handles[2] = sd.nextHandle
+		sd.values[handles[2]] = &gattsValue{data: make([]byte, 2), length: 2, max: 2}
+		sd.nextHandle++
+	}
+	if props&1 != 0 { // broadcast
+		handles[3] = sd.nextHandle
+		sd.values[handles[3]] = &gattsValue{data: make([]byte, 2), length: 2, max: 2}
+		sd.nextHandle++
+	}
+	buf := make([]byte, 8)
+	for i, handle := range handles {
+		binary.LittleEndian.PutUint16(buf[2*i:], handle)
+	}
+	c.Write(handlesPtr, buf)
+	c.Return(nrfSuccess)
+	return nil
+}
+
+// sd_ble_gatts_descriptor_add(uint16_t char_handle, ble_gatts_attr_t const *p_attr, uint16_t *p_handle)
+func (sd *softDevice) gattsDescriptorAdd(c *stubCall) error {
+	c.Uint32()
+	attr, handlePtr := c.Uint32(), c.Uint32()
+	handle, err := sd.gattsAddValue(attr)
+	if err == nrfSuccess {
+		sd.write16(handlePtr, handle)
+	}
+	c.Return(err)
+	return nil
+}
+
+// sd_ble_gatts_value_set(uint16_t conn_handle, uint16_t handle, ble_gatts_value_t *p_value)
+func (sd *softDevice) gattsValueSet(c *stubCall) error {
+	c.Uint32()
+	v := sd.values[uint16(c.Uint32())]
+	valuePtr := c.Uint32()
+	if v == nil {
+		c.Return(nrfErrorNotFound)
+		return nil
+	}
+	p := c.Read(valuePtr, 8)
+	length := int(binary.LittleEndian.Uint16(p[0:]))
+	offset := int(binary.LittleEndian.Uint16(p[2:]))
+	if offset > v.length || offset+length > v.max {
+		c.Return(nrfErrorDataSize)
+		return nil
+	}
+	if length != 0 {
+		data := c.Read(binary.LittleEndian.Uint32(p[4:]), length)
+		if v.address != 0 {
+			c.Write(v.address+uint32(offset), data)
+		} else {
+			copy(v.data[offset:], data)
+		}
+	}
+	if v.variable || offset+length > v.length {
+		v.length = offset + length
+	}
+	c.Return(nrfSuccess)
+	return nil
+}
+
+// sd_ble_gatts_value_get(uint16_t conn_handle, uint16_t handle, ble_gatts_value_t *p_value)
+func (sd *softDevice) gattsValueGet(c *stubCall) error {
+	c.Uint32()
+	v := sd.values[uint16(c.Uint32())]
+	valuePtr := c.Uint32()
+	if v == nil {
+		c.Return(nrfErrorNotFound)
+		return nil
+	}
+	p := c.Read(valuePtr, 8)
+	length := int(binary.LittleEndian.Uint16(p[0:]))
+	offset := int(binary.LittleEndian.Uint16(p[2:]))
+	dest := binary.LittleEndian.Uint32(p[4:])
+	if offset > v.length {
+		c.Return(nrfErrorInvalidParam)
+		return nil
+	}
+	if dest == 0 || length > v.length-offset {
+		// Without a buffer, only the length is returned.
+		length = v.length - offset
+	}
+	if dest != 0 && length != 0 {
+		if v.address != 0 {
+			c.Write(dest, c.Read(v.address+uint32(offset), length))
+		} else {
+			c.Write(dest, v.data[offset:offset+length])
+		}
+	}
+	sd.write16(valuePtr, uint16(length))
+	c.Return(nrfSuccess)
+	return nil
+}
+
+// sd_ble_gatts_initial_user_handle_get(uint16_t *p_handle)
+func (sd *softDevice) gattsInitialUserHandleGet(c *stubCall) error {
+	sd.write16(c.Uint32(), softDeviceFirstHandle)
+	c.Return(nrfSuccess)
+	return nil
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// #include "machine.h"
+import "C"
+
+// This file reads the DWARF call frame information (.debug_frame) of an ELF
+// file, for -stack-guard. For each function it finds the registers that the
+// prologue saves on the stack. The C core guards them while the function runs,
+// and stops the firmware when anything else stores into them: that's the
+// classic stack buffer overflow that overwrites the return address.
+
+// The registers a function saves on the stack. Offsets are in bytes below the
+// SP at the call, which is the CFA (canonical frame address) on ARM.
+type stackFrame struct {
+	Address     uint32 // start of the function
+	PrologueEnd uint32 // address after the last instruction that saves a register
+	SavedOffset uint32 // the saved registers start at CFA - SavedOffset
+	SavedSize   uint32
+	LROffset    uint32 // the return address is at CFA - LROffset, or 0 if not saved
+}
+
+// DWARF register numbers on ARM.
+const (
+	dwarfRegLR = 14
+	dwarfRegD0 = 256 // D0..D31 are 256..287
+)
+
+// A CIE (common information entry) of .debug_frame: the part that is shared
+// by the FDEs (frame description entries) of several functions.
+type frameCIE struct {
+	codeAlign    uint64
+	dataAlign    int64
+	instructions []byte
+}
+
+var errFrameTruncated = errors.New("truncated .debug_frame")
+
+// Read the saved registers of all functions in the .debug_frame section.
+// Functions that don't save any registers are left out. It returns nil if there
+// is no .debug_frame.
+func readFrames(f *elf.File) ([]stackFrame, error) {
+	section := f.Section(".debug_frame")
+	if section == nil {
+		return nil, nil
+	}
+	data, err := section.Data()
+	if err != nil {
+		return nil, err
+	}
+	cies := make(map[uint32]*frameCIE)
+	var frames []stackFrame
+	for offset := 0; offset+4 <= len(data); {
+		length := int(binary.LittleEndian.Uint32(data[offset:]))
+		if length == 0xffffffff {
+			return nil, errors.New("64-bit DWARF in .debug_frame is not supported")
+		}
+		if length < 4 || offset+4+length > len(data) {
+			return nil, errFrameTruncated
+		}
+		entry := data[offset+4 : offset+4+length]
+		id := binary.LittleEndian.Uint32(entry)
+		if id == 0xffffffff {
+			cie, err := parseCIE(entry[4:])
+			if err != nil {
+				return nil, err
+			}
+			cies[uint32(offset)] = cie
+		} else {
+			cie := cies[id]
+			if cie == nil {
+				return nil, fmt.Errorf("FDE at 0x%x in .debug_frame refers to unknown CIE 0x%x", offset, id)
+			}
+			if len(entry) < 12 {
+				return nil, errFrameTruncated
+			}
+			address := binary.LittleEndian.Uint32(entry[4:]) &^ 1
+			frame, err := runFrameProgram(cie, address, entry[12:])
+			if err != nil {
+				return nil, fmt.Errorf("FDE at 0x%x in .debug_frame: %w", offset, err)
+			}
+			if frame.SavedSize != 0 {
+				frames = append(frames, frame)
+			}
+		}
+		offset += 4 + length
+	}
+	sort.Slice(frames, func(i, j int) bool {
+		return frames[i].Address < frames[j].Address
+	})
+	return frames, nil
+}
+
+// Parse a CIE, after its length and ID.
+func parseCIE(data []byte) (*frameCIE, error) {
+	r := &frameReader{data: data}
+	version := r.byte()
+	augmentation := r.cstring()
+	if augmentation != "" {
+		return nil, fmt.Errorf("unsupported CIE augmentation %#v in .debug_frame", augmentation)
+	}
+	if version >= 4 {
+		r.byte() // address size
+		r.byte() // segment selector size
+	}
+	cie := &frameCIE{
+		codeAlign: r.uleb(),
+		dataAlign: r.sleb(),
+	}
+	if version == 1 {
+		r.byte() // return address register
+	} else {
+		r.uleb()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	cie.instructions = r.data[r.pos:]
+	return cie, nil
+}
+
+// Run the call frame instructions of a CIE and an FDE, and return the
+// registers that the function saves. The saved registers of all rows are
+// combined, so that a function that saves more registers later on (like with
+// a vpush after a push) has all of them guarded.
+func runFrameProgram(cie *frameCIE, address uint32, instructions []byte) (stackFrame, error) {
+	frame := stackFrame{Address: address}
+	location := address
+	saved := make(map[uint64]int64) // register number -> offset from the CFA
+	offset := func(reg uint64, factored int64) {
+		if _, ok := saved[reg]; !ok {
+			frame.PrologueEnd = location
+		}
+		saved[reg] = factored * cie.dataAlign
+	}
+	for _, program := range [][]byte{cie.instructions, instructions} {
+		r := &frameReader{data: program}
+		for r.pos < len(r.data) && r.err == nil {
+			op := r.byte()
+			switch op >> 6 {
+			case 1: // DW_CFA_advance_loc
+				location += uint32(uint64(op&0x3f) * cie.codeAlign)
+				continue
+			case 2: // DW_CFA_offset
+				offset(uint64(op&0x3f), int64(r.uleb()))
+				continue
+			case 3: // DW_CFA_restore
+				continue
+			}
+			switch op {
+			case 0x00, 0x0a, 0x0b: // nop, remember_state, restore_state
+			case 0x01: // DW_CFA_set_loc
+				location = r.uint32() &^ 1
+			case 0x02: // DW_CFA_advance_loc1
+				location += uint32(uint64(r.byte()) * cie.codeAlign)
+			case 0x03: // DW_CFA_advance_loc2
+				location += uint32(uint64(r.uint16()) * cie.codeAlign)
+			case 0x04: // DW_CFA_advance_loc4
+				location += uint32(uint64(r.uint32()) * cie.codeAlign)
+			case 0x05: // DW_CFA_offset_extended
+				reg := r.uleb()
+				offset(reg, int64(r.uleb()))
+			case 0x11: // DW_CFA_offset_extended_sf
+				reg := r.uleb()
+				offset(reg, r.sleb())
+			case 0x2f: // DW_CFA_GNU_negative_offset_extended
+				reg := r.uleb()
+				offset(reg, -int64(r.uleb()))
+			case 0x06, 0x07, 0x08, 0x0d, 0x0e, 0x2e: // restore_extended, undefined, same_value, def_cfa_register, def_cfa_offset, GNU_args_size
+				r.uleb()
+			case 0x09, 0x0c, 0x14: // register, def_cfa, val_offset
+				r.uleb()
+				r.uleb()
+			case 0x12, 0x15: // def_cfa_sf, val_offset_sf
+				r.uleb()
+				r.sleb()
+			case 0x13: // def_cfa_offset_sf
+				r.sleb()
+			case 0x0f: // def_cfa_expression
+				r.block()
+			case 0x10, 0x16: // expression, val_expression
+				r.uleb()
+				r.block()
+			default:
+				return frame, fmt.Errorf("unknown call frame instruction 0x%02x", op)
+			}
+		}
+		if r.err != nil {
+			return frame, r.err
+		}
+	}
+
+	// Combine the saved registers into a single range below the CFA.
+	var low, high int64
+	found := false
+	for reg, off := range saved {
+		size := int64(4)
+		if reg >= dwarfRegD0 && reg < dwarfRegD0+32 {
+			size = 8
+		}
+		if off >= 0 {
+			continue // not on the stack of this function
+		}
+		if !found || off < low {
+			low = off
+		}
+		if !found || off+size > high {
+			high = off + size
+		}
+		found = true
+		if reg == dwarfRegLR {
+			frame.LROffset = uint32(-off)
+		}
+	}
+	if low < -0xffff {
+		return frame, fmt.Errorf("saved registers too far from the CFA (%d bytes)", -low)
+	}
+	frame.SavedOffset = uint32(-low)
+	frame.SavedSize = uint32(high - low)
+	return frame, nil
+}
+
+// A reader of the numbers in call frame information. The first error is kept
+// in err, after which all reads return zero.
+type frameReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *frameReader) byte() byte {
+	if r.pos >= len(r.data) {
+		r.err = errFrameTruncated
+		return 0
+	}
+	r.pos++
+	return r.data[r.pos-1]
+}
+
+func (r *frameReader) uint16() uint16 {
+	return uint16(r.byte()) | uint16(r.byte())<<8
+}
+
+func (r *frameReader) uint32() uint32 {
+	return uint32(r.uint16()) | uint32(r.uint16())<<16
+}
+
+func (r *frameReader) uleb() uint64 {
+	var value uint64
+	for shift := uint(0); r.err == nil; shift += 7 {
+		b := r.byte()
+		if shift < 64 {
+			value |= uint64(b&0x7f) << shift
+		}
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	return value
+}
+
+func (r *frameReader) sleb() int64 {
+	var value int64
+	shift := uint(0)
+	for r.err == nil {
+		b := r.byte()
+		if shift < 64 {
+			value |= int64(b&0x7f) << shift
+		}
+		shift += 7
+		if b&0x80 == 0 {
+			if shift < 64 && b&0x40 != 0 {
+				value |= -1 << shift
+			}
+			break
+		}
+	}
+	return value
+}
+
+func (r *frameReader) cstring() string {
+	end := bytes.IndexByte(r.data[r.pos:], 0)
+	if end < 0 {
+		r.err = errFrameTruncated
+		return ""
+	}
+	s := string(r.data[r.pos : r.pos+end])
+	r.pos += end + 1
+	return s
+}
+
+// Skip a block: a ULEB128 length followed by that many bytes.
+func (r *frameReader) block() {
+	length := r.uleb()
+	if length > uint64(len(r.data)-r.pos) {
+		r.err = errFrameTruncated
+		return
+	}
+	r.pos += int(length)
+}
+
+// Enable the stack guard, which also checks return addresses with
+// checkReturn (-stack-guard-return). The debug information must have been
+// added to the machine already.
+func setStackGuard(machine *C.machine_t, info *debugInfo, checkReturn bool) error {
+	if info == nil || len(info.frames) == 0 {
+		return errors.New("the stack guard needs an ELF file with DWARF call frame information (.debug_frame)")
+	}
+	C.machine_enable_stack_guard(machine, C.bool(checkReturn))
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"unsafe"
+)
+
+// #include "machine.h"
+// #include "disasm.h"
+import "C"
+
+// Print execution statistics of the machine, like the number of cycles spent
+// in each sleep state.
+func printStats(w io.Writer, machine *C.machine_t) {
+	stats := machine.stats
+	cycles := uint64(stats.cycles)
+	percent := func(n C.uint64_t) float64 {
+		if cycles == 0 {
+			return 0
+		}
+		return float64(n) / float64(cycles) * 100
+	}
+	fmt.Fprintln(w, "statistics:")
+	fmt.Fprintf(w, "  instructions:     %d\n", uint64(stats.instructions))
+	fmt.Fprintf(w, "  cycles:           %d\n", cycles)
+	fmt.Fprintf(w, "  cycles running:   %d (%.1f%%)\n", uint64(stats.cycles_state[C.SLEEP_NONE]), percent(stats.cycles_state[C.SLEEP_NONE]))
+	fmt.Fprintf(w, "  cycles sleep:     %d (%.1f%%)\n", uint64(stats.cycles_state[C.SLEEP_LIGHT]), percent(stats.cycles_state[C.SLEEP_LIGHT]))
+	fmt.Fprintf(w, "  cycles deepsleep: %d (%.1f%%)\n", uint64(stats.cycles_state[C.SLEEP_DEEP]), percent(stats.cycles_state[C.SLEEP_DEEP]))
+	fmt.Fprintf(w, "  wakeups:          %d\n", uint64(stats.wakeups))
+	if stats.fast_forwarded != 0 {
+		fmt.Fprintf(w, "  fast-forwarded:   %d (%.1f%%)\n", uint64(stats.fast_forwarded), percent(stats.fast_forwarded))
+	}
+	fmt.Fprintf(w, "  exceptions:       %d\n", uint64(stats.exceptions))
+	fmt.Fprintf(w, "  flash erases:     %d\n", uint64(stats.flash_erases))
+	fmt.Fprintf(w, "  flash writes:     %d\n", uint64(stats.flash_writes))
+	if stats.radio_tx_packets != 0 {
+		fmt.Fprintf(w, "  radio packets:    %d\n", uint64(stats.radio_tx_packets))
+	}
+	if stats.ws2812_frames != 0 {
+		fmt.Fprintf(w, "  ws2812 frames:    %d (%d timing errors)\n", uint64(stats.ws2812_frames), uint64(stats.ws2812_errors))
+	}
+	if stats.audio_out != 0 || stats.audio_in != 0 {
+		fmt.Fprintf(w, "  audio frames:     %d played, %d recorded\n", uint64(stats.audio_out), uint64(stats.audio_in))
+	}
+	if stats.can_tx != 0 || stats.can_rx != 0 {
+		fmt.Fprintf(w, "  can frames:       %d sent, %d received\n", uint64(stats.can_tx), uint64(stats.can_rx))
+	}
+	if stats.uart_overruns != 0 || stats.uart_rx_errors != 0 {
+		fmt.Fprintf(w, "  uart errors:      %d overruns, %d framing/parity/break\n", uint64(stats.uart_overruns), uint64(stats.uart_rx_errors))
+	}
+	if stats.power_cuts != 0 {
+		fmt.Fprintf(w, "  power cuts:       %d\n", uint64(stats.power_cuts))
+	}
+	printExceptionStats(w, machine)
+
+	// Report the page with the most wear, as that is the page that will fail
+	// first.
+	var wornPage, wornCount uint32
+	for page := 0; page < int(machine.image_size/machine.pagesize); page++ {
+		count := uint32(C.machine_flash_erase_count(machine, C.size_t(page)))
+		if count > wornCount {
+			wornPage = uint32(page)
+			wornCount = count
+		}
+	}
+	if wornCount != 0 {
+		fmt.Fprintf(w, "  most erased page: 0x%x (%d erases)\n", wornPage*uint32(machine.pagesize), wornCount)
+	}
+}
+
+// Names of the system exceptions, by exception number.
+var exceptionNames = map[int]string{
+	2:  "NMI",
+	3:  "HardFault",
+	4:  "MemManage",
+	5:  "BusFault",
+	6:  "UsageFault",
+	11: "SVCall",
+	12: "DebugMon",
+	14: "PendSV",
+	15: "SysTick",
+}
+
+// Return the name of an exception number, like "SysTick" or "IRQ 3".
+func exceptionName(exception int) string {
+	if exception >= 16 {
+		return fmt.Sprintf("IRQ %d", exception-16)
+	}
+	if name, ok := exceptionNames[exception]; ok {
+		return name
+	}
+	return fmt.Sprintf("exception %d", exception)
+}
+
+// Print, for each exception that was taken, how often it was taken, the
+// cycles spent in its handler, the latency from becoming pending until the
+// handler was entered and how deeply it was nested.
+func printExceptionStats(w io.Writer, machine *C.machine_t) {
+	stats := machine.stats
+	header := false
+	for exception := 2; exception < 16+C.MACHINE_NUM_IRQS; exception++ {
+		count := uint64(stats.exceptions_by_number[exception])
+		if count == 0 {
+			continue
+		}
+		if !header {
+			fmt.Fprintln(w, "  exception       count      cycles  avg latency  max latency  max nesting")
+			header = true
+		}
+		fmt.Fprintf(w, "  %-10s %10d  %10d  %11.1f  %11d  %11d\n", exceptionName(exception), count, uint64(stats.exception_cycles[exception]), float64(stats.exception_latency[exception])/float64(count), uint64(stats.exception_latency_max[exception]), uint32(stats.exception_nesting_max[exception]))
+	}
+}
+
+// Print a histogram of the executed instructions by mnemonic, and the
+// undefined instructions that were hit sorted by how often they were hit. The
+// latter shows which instructions are most worth implementing.
+func printHistogram(w io.Writer, machine *C.machine_t) {
+	if machine.histogram != nil {
+		counts := (*[1 << 16]C.uint64_t)(unsafe.Pointer(machine.histogram))
+		byMnemonic := make(map[string]uint64)
+		var total uint64
+		for hw1, count := range counts {
+			if count == 0 {
+				continue
+			}
+			// Classify by the first halfword only. This is enough to find
+			// the mnemonic of nearly all instructions.
+			mnemonic := strings.Fields(disassemble(0, uint16(hw1), 0) + " ?")[0]
+			byMnemonic[mnemonic] += uint64(count)
+			total += uint64(count)
+		}
+		var mnemonics []string
+		for mnemonic := range byMnemonic {
+			mnemonics = append(mnemonics, mnemonic)
+		}
+		sort.Slice(mnemonics, func(i, j int) bool {
+			if byMnemonic[mnemonics[i]] != byMnemonic[mnemonics[j]] {
+				return byMnemonic[mnemonics[i]] > byMnemonic[mnemonics[j]]
+			}
+			return mnemonics[i] < mnemonics[j]
+		})
+		fmt.Fprintln(w, "instruction histogram:")
+		for _, mnemonic := range mnemonics {
+			count := byMnemonic[mnemonic]
+			fmt.Fprintf(w, "  %-8s %12d (%.1f%%)\n", mnemonic, count, float64(count)/float64(total)*100)
+		}
+	}
+
+	undefined := machine.undefined[:machine.num_undefined]
+	sort.SliceStable(undefined, func(i, j int) bool {
+		return undefined[i].count > undefined[j].count
+	})
+	if len(undefined) != 0 {
+		fmt.Fprintln(w, "undefined instructions:")
+	}
+	for _, instr := range undefined {
+		encoding := fmt.Sprintf("%04x", uint16(instr.hw1))
+		if C.disasm_is_32bit(instr.hw1) {
+			encoding += fmt.Sprintf(" %04x", uint16(instr.hw2))
+		}
+		var pcs []string
+		for i := 0; i < int(instr.count) && i < C.MACHINE_UNDEFINED_PCS; i++ {
+			pcs = append(pcs, fmt.Sprintf("0x%x", uint32(instr.pcs[i])))
+		}
+		fmt.Fprintf(w, "  %-9s  %-24s %6d hits, at %s\n", encoding, disassemble(uint32(instr.pcs[0]), uint16(instr.hw1), uint16(instr.hw2)), uint32(instr.count), strings.Join(pcs, ", "))
+	}
+}
+
+// Disassemble a single instruction at the given address, given as raw
+// halfwords.
+func disassemble(address uint32, hw1, hw2 uint16) string {
+	var buf [80]C.char
+	C.disasm_thumb(C.uint32_t(address), C.uint16_t(hw1), C.uint16_t(hw2), &buf[0], C.size_t(len(buf)))
+	return C.GoString(&buf[0])
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+)
+
+// #include "machine.h"
+import "C"
+
+// StopReason is the reason why machine_run or machine_step returned. The
+// values are the error codes of the C core.
+type StopReason int
+
+const (
+	StopExit         StopReason = C.ERR_EXIT
+	StopHalt         StopReason = C.ERR_HALT
+	StopBreakpoint   StopReason = C.ERR_BREAK
+	StopDivideByZero StopReason = C.ERR_DIVZERO
+	StopMemoryFault  StopReason = C.ERR_MEM
+	StopInvalidPC    StopReason = C.ERR_PC
+	StopUndefined    StopReason = C.ERR_UNDEFINED
+	StopDeadline     StopReason = C.ERR_DEADLINE
+	StopInputEOF     StopReason = C.ERR_EOF
+	StopLimit        StopReason = C.ERR_LIMIT
+	StopSemihosting  StopReason = C.ERR_SEMIHOSTING
+	StopHang         StopReason = C.ERR_HANG
+)
+
+// Signal numbers as used in GDB stop replies. These are GDB's own numbers,
+// which are not necessarily the same as those of the host.
+const (
+	gdbSignalINT  = 2
+	gdbSignalILL  = 4
+	gdbSignalTRAP = 5
+	gdbSignalFPE  = 8
+	gdbSignalSEGV = 11
+)
+
+var stopReasonNames = map[StopReason]string{
+	StopExit:         "exited",
+	StopHalt:         "halted",
+	StopBreakpoint:   "breakpoint",
+	StopDivideByZero: "divide by zero",
+	StopMemoryFault:  "memory error",
+	StopInvalidPC:    "invalid PC",
+	StopUndefined:    "undefined instruction",
+	StopDeadline:     "deadline reached",
+	StopInputEOF:     "end of input",
+	StopLimit:        "instruction limit reached",
+	StopSemihosting:  "semihosting call",
+	StopHang:         "stuck in a loop",
+}
+
+func (r StopReason) String() string {
+	if name, ok := stopReasonNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("error %d", int(r))
+}
+
+// Fault returns whether the firmware stopped because of an error in the
+// firmware itself, like an invalid memory access.
+func (r StopReason) Fault() bool {
+	switch r {
+	case StopDivideByZero, StopMemoryFault, StopInvalidPC, StopUndefined:
+		return true
+	default:
+		return false
+	}
+}
+
+// Signal returns the GDB signal that corresponds to this stop reason.
+func (r StopReason) Signal() int {
+	switch r {
+	case StopHalt:
+		return gdbSignalINT
+	case StopDivideByZero:
+		return gdbSignalFPE
+	case StopMemoryFault, StopInvalidPC:
+		return gdbSignalSEGV
+	case StopUndefined:
+		return gdbSignalILL
+	default:
+		return gdbSignalTRAP
+	}
+}
+
+// StopError describes why and where the machine stopped running.
+type StopError struct {
+	Reason   StopReason
+	PC       uint32 // address of the instruction where the machine stopped
+	Address  uint32 // faulting address, only set for StopMemoryFault
+	ExitCode int    // exit code of the program, only set for StopExit
+}
+
+func (e *StopError) Error() string {
+	switch e.Reason {
+	case StopExit:
+		return fmt.Sprintf("exited with code %d", e.ExitCode)
+	case StopMemoryFault:
+		return fmt.Sprintf("memory error at address 0x%08x (PC: %x)", e.Address, e.PC)
+	default:
+		return fmt.Sprintf("%s (PC: %x)", e.Reason, e.PC)
+	}
+}
+
+// ExitStatus returns the status the emulator should exit with after this
+// stop: the exit code of the program, or 128 plus the signal number for a
+// fault like a shell would report it.
+func (e *StopError) ExitStatus() int {
+	if e.Reason == StopExit {
+		return e.ExitCode
+	}
+	return 128 + e.Reason.Signal()
+}
+
+// Convert an error code from the C core into a StopError, using the current
+// state of the machine. A zero code means the program returned from its entry
+// point, which is reported as an exit with code 0.
+func newStopError(machine *C.machine_t, code C.int) *StopError {
+	err := &StopError{
+		Reason: StopReason(code),
+		PC:     uint32(C.machine_readreg(machine, 15)) - 1,
+	}
+	switch err.Reason {
+	case 0:
+		err.Reason = StopExit
+	case StopDivideByZero, StopMemoryFault, StopUndefined:
+		// The PC may have moved past the faulting instruction already.
+		err.PC = uint32(machine.instruction_pc)
+	}
+	if err.Reason == StopMemoryFault {
+		err.Address = uint32(machine.transfer_address)
+	}
+	return err
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// #include "machine.h"
+// int runStub(machine_t *machine, stub_kind_t kind, uint32_t id);
+import "C"
+
+// This file implements stubs: Go functions that stand in for code that isn't
+// in the firmware image, like the functions of a boot ROM, the vendor ROM APIs
+// of some chips and the supervisor calls (SVC) of an nRF SoftDevice. A stub
+// gets the arguments of the call like the function would, following the
+// AAPCS: the first four words in r0-r3, the others on the stack and 64-bit
+// values in an even register pair. Its result goes to r0 (and r1).
+//
+// ROM stubs live in address ranges: a call to an address in a range runs the
+// stub of that address, and returns to the caller. SVC stubs replace the
+// SVCall exception for their number; other SVC numbers still go to the
+// SVCall handler of the firmware. Simple stubs can be set on the command line:
+//
+//	-stub=0x1fff1ff1=return:0   a ROM function that returns 0
+//	-stub=svc:0x10=return       a supervisor call that does nothing
+
+// A stub: the Go implementation of a ROM function or supervisor call.
+type stub struct {
+	name string
+	fn   func(c *stubCall) error
+}
+
+// The stubs of a machine.
+type stubSet struct {
+	m   *Machine
+	rom map[uint32]stub // by address, without the Thumb bit
+	svc map[uint8]stub
+}
+
+var stubSets machineMap[*stubSet]
+
+// A call to a stub, with the registers of the caller. Arguments are read in
+// order, and the results are written back when the stub returns.
+type stubCall struct {
+	m    *Machine
+	regs [17]uint32
+	next int // the next argument word: a register, or a stack slot from 4 on
+}
+
+// Return the stubs of the machine, after setting up the handler if needed.
+func (m *Machine) stubs() *stubSet {
+	s := stubSets.get(m.machine)
+	if s == nil {
+		s = &stubSet{m: m, rom: map[uint32]stub{}, svc: map[uint8]stub{}}
+		stubSets.set(m.machine, s)
+		C.machine_set_stub_handler(m.machine, C.stub_call_t(C.runStub))
+	}
+	return s
+}
+
+// AddStubRange marks the code in start..end as implemented by ROM stubs, so
+// that calls to addresses in it that don't have a stub are reported.
+func (m *Machine) AddStubRange(start, end uint32) error {
+	m.stubs()
+	if !C.machine_add_stub_range(m.machine, C.uint32_t(start), C.uint32_t(end)) {
+		return fmt.Errorf("too many stub ranges, there can be %d", C.MACHINE_STUB_RANGES)
+	}
+	return nil
+}
+
+// AddROMStub implements the function at the given address with fn. The
+// address gets a range of its own when no range of AddStubRange covers it, or
+// when it is covered by a stub of the C core like the RP2040 boot ROM.
+func (m *Machine) AddROMStub(address uint32, name string, fn func(c *stubCall) error) error {
+	s := m.stubs()
+	address &^= 1
+	covered := false
+	for i := 0; i < int(m.machine.stubs.num_ranges); i++ {
+		if address >= uint32(m.machine.stubs.start[i]) && address < uint32(m.machine.stubs.end[i]) {
+			// The last range that covers the address is used.
+			covered = m.machine.stubs.handler[i] == nil
+		}
+	}
+	if !covered {
+		if err := m.AddStubRange(address, address+2); err != nil {
+			return err
+		}
+	}
+	s.rom[address] = stub{name, fn}
+	return nil
+}
+
+// AddSVCStub implements the supervisor call with this number with fn.
+func (m *Machine) AddSVCStub(number uint8, name string, fn func(c *stubCall) error) {
+	s := m.stubs()
+	s.svc[number] = stub{name, fn}
+	C.machine_set_svc_stub(m.machine, C.uint32_t(number), true)
+}
+
+// Run a stub, for the C core.
+//
+//export runStub
+func runStub(machine *C.machine_t, kind C.stub_kind_t, id C.uint32_t) C.int {
+	s := stubSets.get(machine)
+	var st stub
+	var ok bool
+	if kind == C.STUB_SVC {
+		st, ok = s.svc[uint8(id)]
+	} else {
+		st, ok = s.rom[uint32(id)]
+	}
+	if !ok {
+		fmt.Fprintf(os.Stderr, "\nERROR: call to ROM address 0x%x without a stub (LR: %x)\n", uint32(id), uint32(C.machine_readreg(machine, 14))-1)
+		return C.ERR_PC
+	}
+	c := &stubCall{m: s.m, regs: s.m.DebugRegisters()}
+	err := st.fn(c)
+	var stop *StopError
+	if errors.As(err, &stop) {
+		return C.int(stop.Reason)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nERROR: %s: %v (LR: %x)\n", st.name, err, c.regs[14]-1)
+		return C.ERR_PC
+	}
+	for i := 0; i < 4; i++ {
+		C.machine_writereg(machine, C.size_t(i), C.uint32_t(c.regs[i]))
+	}
+	return C.ERR_OK
+}
+
+// Uint32 returns the next argument.
+func (c *stubCall) Uint32() uint32 {
+	n := c.next
+	c.next++
+	if n < 4 {
+		return c.regs[n]
+	}
+	return binary.LittleEndian.Uint32(c.m.ReadMemory(int(c.regs[13])+4*(n-4), 4))
+}
+
+// Int32 returns the next argument, which is signed.
+func (c *stubCall) Int32() int32 {
+	return int32(c.Uint32())
+}
+
+// Uint64 returns the next argument, which is a 64-bit value in two registers
+// (or stack slots) starting at an even one.
+func (c *stubCall) Uint64() uint64 {
+	if c.next%2 != 0 {
+		// Skip r1, r3 or an odd stack slot, so a value isn't split between
+		// r3 and the stack either.
+		c.next++
+	}
+	lo := c.Uint32()
+	return uint64(c.Uint32())<<32 | uint64(lo)
+}
+
+// Return sets the result of the call, in r0.
+func (c *stubCall) Return(value uint32) {
+	c.regs[0] = value
+}
+
+// Return64 sets a 64-bit result of the call, in r0 and r1.
+func (c *stubCall) Return64(value uint64) {
+	c.regs[0] = uint32(value)
+	c.regs[1] = uint32(value >> 32)
+}
+
+// Read reads memory of the machine, like a structure that an argument points
+// to.
+func (c *stubCall) Read(address uint32, length int) []byte {
+	return c.m.ReadMemory(int(address), length)
+}
+
+// Write writes memory of the machine, like a structure for the results.
+func (c *stubCall) Write(address uint32, data []byte) {
+	c.m.WriteMemory(int(address), data)
+}
+
+// String reads a NUL-terminated string of at most max bytes.
+func (c *stubCall) String(address uint32, max int) string {
+	s, _, _ := bytes.Cut(c.Read(address, max), []byte{0})
+	return string(s)
+}
+
+// Add the stubs of -stub, like 0x1fff1ff1=return:0 or svc:0x10=return.
+func addStubFlags(m *Machine, specs []string) error {
+	for _, spec := range specs {
+		target, action, ok := strings.Cut(spec, "=")
+		if !ok {
+			return fmt.Errorf("expected ADDRESS=ACTION or svc:NUMBER=ACTION, got %q", spec)
+		}
+		fn, err := parseStubAction(action)
+		if err != nil {
+			return err
+		}
+		if number, ok := strings.CutPrefix(target, "svc:"); ok {
+			n, err := strconv.ParseUint(number, 0, 8)
+			if err != nil {
+				return fmt.Errorf("invalid SVC number %q", number)
+			}
+			m.AddSVCStub(uint8(n), "svc "+number, fn)
+			continue
+		}
+		address, err := parseUint32(target)
+		if err != nil {
+			return fmt.Errorf("invalid stub address %q", target)
+		}
+		if err := m.AddROMStub(address, target, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Parse the action of a -stub: return (leave r0 as it is) or return:VALUE.
+func parseStubAction(action string) (func(c *stubCall) error, error) {
+	if action == "return" {
+		return func(c *stubCall) error { return nil }, nil
+	}
+	if value, ok := strings.CutPrefix(action, "return:"); ok {
+		n, err := strconv.ParseInt(value, 0, 64)
+		if err != nil || n < -1<<31 || n >= 1<<32 {
+			return nil, fmt.Errorf("invalid return value %q", value)
+		}
+		return func(c *stubCall) error {
+			c.Return(uint32(n))
+			return nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown stub action %q, expected return or return:VALUE", action)
+}
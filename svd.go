@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// #include "machine.h"
+// void periphTrace(machine_t *machine, uint32_t address, bool store, uint32_t value, uint32_t pc);
+import "C"
+
+// This file resolves peripheral register addresses to names, from a CMSIS-SVD
+// file (-svd) and the peripherals of a platform description (-platform), and
+// traces all register accesses of the firmware with -periphtrace:
+//
+//	UARTE0->TASKS_STARTTX = 0x1 (PC=0x1a4)     a write
+//	UARTE0->EVENTS_ENDTX -> 0x1 (PC=0x1b0)     a read
+//
+// Registers that aren't described are shown as an offset into their
+// peripheral, like uart0+0x11c, or as an address.
+// Format:
+// https://open-cmsis-pack.github.io/svd-spec/main/index.html
+
+// The parts of an SVD file that are needed to name registers.
+type svdDevice struct {
+	Peripherals []svdPeripheral `xml:"peripherals>peripheral"`
+}
+
+type svdPeripheral struct {
+	Name         string        `xml:"name"`
+	DerivedFrom  string        `xml:"derivedFrom,attr"`
+	BaseAddress  string        `xml:"baseAddress"`
+	AddressBlock []svdBlock    `xml:"addressBlock"`
+	Registers    []svdRegister `xml:"registers>register"`
+	Clusters     []svdCluster  `xml:"registers>cluster"`
+}
+
+type svdBlock struct {
+	Offset string `xml:"offset"`
+	Size   string `xml:"size"`
+}
+
+// Registers and clusters can be arrays, with dim elements that are
+// dimIncrement bytes apart.
+type svdDim struct {
+	Dim          string `xml:"dim"`
+	DimIncrement string `xml:"dimIncrement"`
+	DimIndex     string `xml:"dimIndex"`
+}
+
+type svdRegister struct {
+	svdDim
+	Name          string `xml:"name"`
+	AddressOffset string `xml:"addressOffset"`
+}
+
+type svdCluster struct {
+	svdDim
+	Name          string        `xml:"name"`
+	AddressOffset string        `xml:"addressOffset"`
+	Registers     []svdRegister `xml:"register"`
+	Clusters      []svdCluster  `xml:"cluster"`
+}
+
+// A named address range, with the names of its registers if known.
+type registerBlock struct {
+	name      string
+	start     uint32
+	size      uint32
+	registers map[uint32]string // by offset
+}
+
+// registerNames resolves peripheral register addresses to names.
+type registerNames struct {
+	blocks []*registerBlock // sorted by start address
+}
+
+// Add the peripherals and registers of an SVD file.
+func (r *registerNames) loadSVD(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var device svdDevice
+	if err := xml.NewDecoder(f).Decode(&device); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	byName := map[string]*svdPeripheral{}
+	for i := range device.Peripherals {
+		byName[device.Peripherals[i].Name] = &device.Peripherals[i]
+	}
+	for _, periph := range device.Peripherals {
+		base, err := parseSVDNumber(periph.BaseAddress)
+		if err != nil {
+			return fmt.Errorf("%s: peripheral %s: invalid baseAddress %#v", path, periph.Name, periph.BaseAddress)
+		}
+		// A derived peripheral is a copy at another address, but what it
+		// specifies itself takes precedence.
+		from := &periph
+		if parent := byName[periph.DerivedFrom]; parent != nil {
+			if len(periph.Registers) == 0 && len(periph.Clusters) == 0 {
+				from = parent
+			}
+			if len(periph.AddressBlock) == 0 {
+				periph.AddressBlock = parent.AddressBlock
+			}
+		}
+		block := &registerBlock{name: periph.Name, start: uint32(base), registers: map[uint32]string{}}
+		if err := block.addRegisters(from.Registers, from.Clusters, 0, ""); err != nil {
+			return fmt.Errorf("%s: peripheral %s: %v", path, periph.Name, err)
+		}
+		for _, b := range periph.AddressBlock {
+			offset, err1 := parseSVDNumber(b.Offset)
+			size, err2 := parseSVDNumber(b.Size)
+			if err1 != nil || err2 != nil {
+				return fmt.Errorf("%s: peripheral %s: invalid addressBlock", path, periph.Name)
+			}
+			if end := uint32(offset + size); end > block.size {
+				block.size = end
+			}
+		}
+		for offset := range block.registers {
+			if offset+4 > block.size {
+				block.size = offset + 4
+			}
+		}
+		r.add(block)
+	}
+	return nil
+}
+
+// Add registers and clusters at the given offset, with names that start with
+// the given prefix.
+func (block *registerBlock) addRegisters(registers []svdRegister, clusters []svdCluster, offset uint32, prefix string) error {
+	for _, reg := range registers {
+		err := expandSVDDim(reg.svdDim, reg.Name, reg.AddressOffset, func(name string, regOffset uint32) error {
+			if _, ok := block.registers[offset+regOffset]; !ok {
+				block.registers[offset+regOffset] = prefix + name
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("register %s: %v", reg.Name, err)
+		}
+	}
+	for _, cluster := range clusters {
+		err := expandSVDDim(cluster.svdDim, cluster.Name, cluster.AddressOffset, func(name string, clusterOffset uint32) error {
+			return block.addRegisters(cluster.Registers, cluster.Clusters, offset+clusterOffset, prefix+name+".")
+		})
+		if err != nil {
+			return fmt.Errorf("cluster %s: %v", cluster.Name, err)
+		}
+	}
+	return nil
+}
+
+// Call f for every element of a register or cluster, which is an array if dim
+// is set. The name of an element is like "CC[2]" or "EVENTS_COMPARE2".
+func expandSVDDim(dim svdDim, name, addressOffset string, f func(name string, offset uint32) error) error {
+	offset, err := parseSVDNumber(addressOffset)
+	if err != nil {
+		return fmt.Errorf("invalid addressOffset %#v", addressOffset)
+	}
+	if dim.Dim == "" {
+		return f(name, uint32(offset))
+	}
+	count, err1 := parseSVDNumber(dim.Dim)
+	increment, err2 := parseSVDNumber(dim.DimIncrement)
+	if err1 != nil || err2 != nil {
+		return fmt.Errorf("invalid dim or dimIncrement")
+	}
+	indices, err := parseSVDDimIndex(dim.DimIndex, int(count))
+	if err != nil {
+		return err
+	}
+	for i, index := range indices {
+		elementName := strings.Replace(strings.Replace(name, "[%s]", "["+strconv.Itoa(i)+"]", 1), "%s", index, 1)
+		if err := f(elementName, uint32(offset)+uint32(i)*uint32(increment)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Parse a dimIndex, like "0-3" or "A,B,C". Without one, elements are numbered
+// from 0.
+func parseSVDDimIndex(s string, count int) ([]string, error) {
+	var indices []string
+	if s = strings.TrimSpace(s); s == "" {
+		for i := 0; i < count; i++ {
+			indices = append(indices, strconv.Itoa(i))
+		}
+	} else if first, last, ok := strings.Cut(s, "-"); ok && !strings.Contains(s, ",") {
+		start, err1 := strconv.Atoi(strings.TrimSpace(first))
+		end, err2 := strconv.Atoi(strings.TrimSpace(last))
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid dimIndex %#v", s)
+		}
+		for i := start; i <= end; i++ {
+			indices = append(indices, strconv.Itoa(i))
+		}
+	} else {
+		for _, index := range strings.Split(s, ",") {
+			indices = append(indices, strings.TrimSpace(index))
+		}
+	}
+	if len(indices) != count {
+		return nil, fmt.Errorf("dimIndex %#v doesn't have %d elements", s, count)
+	}
+	return indices, nil
+}
+
+// Parse a number in an SVD file: decimal, hexadecimal (0x) or binary (#).
+func parseSVDNumber(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "#") {
+		return strconv.ParseUint(s[1:], 2, 64)
+	}
+	return strconv.ParseUint(s, 0, 64)
+}
+
+// Add the peripherals of a platform description, which only have a name.
+func (r *registerNames) addPlatform(p *platform) {
+	for name := range p.peripherals {
+		start, size, ok := p.peripheralRange(name)
+		if !ok || strings.HasPrefix(p.peripherals[name].typ, "Memory.") || strings.HasPrefix(p.peripherals[name].typ, "CPU.") {
+			continue
+		}
+		r.add(&registerBlock{name: name, start: uint32(start), size: uint32(size)})
+	}
+}
+
+func (r *registerNames) add(block *registerBlock) {
+	r.blocks = append(r.blocks, block)
+	sort.SliceStable(r.blocks, func(i, j int) bool {
+		return r.blocks[i].start < r.blocks[j].start
+	})
+}
+
+// Return the name of the register at the given address, like
+// "UARTE0->TASKS_STARTTX". A register of which only the peripheral is known is
+// named like "uart0+0x8", others are named by their address. The SVD file
+// takes precedence over the platform, as it was loaded first.
+func (r *registerNames) name(address uint32) string {
+	var inside *registerBlock
+	for _, block := range r.blocks {
+		if block.start > address {
+			break
+		}
+		if address-block.start >= block.size {
+			continue
+		}
+		if name, ok := block.registers[address-block.start]; ok {
+			return block.name + "->" + name
+		}
+		if inside == nil {
+			inside = block
+		}
+	}
+	if inside != nil {
+		return fmt.Sprintf("%s+0x%x", inside.name, address-inside.start)
+	}
+	return fmt.Sprintf("0x%08x", address)
+}
+
+// Where the register accesses of each machine are traced to.
+type periphTracer struct {
+	names *registerNames
+	w     io.Writer
+}
+
+var periphTraceMachines machineMap[*periphTracer]
+
+// Trace all peripheral register accesses of the firmware to w. The accesses
+// are recorded in the trace ring, and written to w in batches.
+func attachPeriphTrace(m *Machine, names *registerNames, w io.Writer) {
+	buf := bufio.NewWriter(w)
+	t := &periphTracer{names: names, w: buf}
+	ok := attachTraceRing(m.machine, func(event *C.trace_event_t) {
+		switch event._type {
+		case C.TRACE_PERIPH_LOAD, C.TRACE_PERIPH_STORE:
+			t.trace(uint32(event.address), event._type == C.TRACE_PERIPH_STORE, uint32(event.value), uint32(event.pc))
+		}
+	}, func() {
+		buf.Flush()
+	})
+	if ok {
+		C.machine_set_periph_trace(m.machine, C.periph_trace_t(C.machine_trace_ring_periph))
+		return
+	}
+	// Without a trace ring, each access is written right away.
+	t.w = w
+	periphTraceMachines.set(m.machine, t)
+	C.machine_set_periph_trace(m.machine, C.periph_trace_t(C.periphTrace))
+}
+
+func (t *periphTracer) trace(address uint32, store bool, value, pc uint32) {
+	op := "->"
+	if store {
+		op = "="
+	}
+	fmt.Fprintf(t.w, "%s %s 0x%x (PC=0x%x)\n", t.names.name(address), op, value, pc)
+}
+
+//export periphTrace
+func periphTrace(machine *C.machine_t, address C.uint32_t, store C.bool, value, pc C.uint32_t) {
+	periphTraceMachines.get(machine).trace(uint32(address), bool(store), uint32(value), uint32(pc))
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// #include "machine.h"
+// void swarmRadioSend(machine_t *machine, uint8_t *packet, uint32_t length, uint32_t frequency, uint32_t mode, uint64_t address);
+// void swarmUARTOutput(machine_t *machine, uint32_t uart, uint8_t c);
+import "C"
+
+// This file runs a swarm: several machines in one process that share the air
+// for their radios and can have their UARTs connected, for testing protocols
+// between devices like mesh networks. The machines run in lockstep: each runs
+// for a quantum of emulated time in turn, and the radio packets and UART
+// characters sent during a quantum reach the other machines at the start of
+// the next. Time and randomness are deterministic, so a run is reproducible.
+//
+// With -swarm=N, N machines run the firmware image (or one image each). Each
+// gets its own device ID, Bluetooth address and random seed, by adding its
+// index to those of the first. -swarm-uart=A-B connects UART0 of machines A
+// and B; the output of the other UART0s is printed, prefixed with "[A] ".
+
+// Swarm is a group of machines that run in lockstep.
+type Swarm struct {
+	nodes   []*swarmNode
+	quantum uint64 // cycles per step
+	now     uint64 // cycle that all machines have reached
+	packets []swarmPacket
+	output  io.Writer
+}
+
+// A machine in a swarm.
+type swarmNode struct {
+	swarm   *Swarm
+	index   int
+	machine *C.machine_t
+	m       *Machine
+	peer    *swarmNode // the other end of the UART line, if connected
+	sent    []byte     // UART output that hasn't reached the peer yet
+	line    []byte     // incomplete line of output
+	stop    *StopError // why the machine stopped, once it did
+}
+
+// A radio packet, on its way to the other machines.
+type swarmPacket struct {
+	from      *swarmNode
+	data      []byte
+	frequency uint32
+	mode      uint32
+	address   uint64
+}
+
+var swarmNodes machineMap[*swarmNode]
+
+// NewSwarm creates an empty swarm, which lets the machines run for the given
+// number of cycles at a time. Output of the machines goes to w.
+func NewSwarm(quantum uint64, w io.Writer) *Swarm {
+	return &Swarm{quantum: quantum, output: w}
+}
+
+// Add a machine that was created and loaded, but not reset yet. It returns
+// the index of the machine in the swarm.
+func (s *Swarm) Add(machine *C.machine_t, debug *debugInfo) int {
+	node := &swarmNode{swarm: s, index: len(s.nodes), machine: machine}
+	node.m = NewMachine(machine, nil, debug)
+	node.m.console = node
+	s.nodes = append(s.nodes, node)
+	swarmNodes.set(machine, node)
+	C.machine_set_deterministic(machine, true)
+	C.machine_set_radio(machine, C.radio_send_t(C.swarmRadioSend))
+	C.machine_set_uart_output(machine, 0, C.uart_output_t(C.swarmUARTOutput))
+	return node.index
+}
+
+// ConnectUART connects UART0 of two machines, so that each receives what the
+// other sends.
+func (s *Swarm) ConnectUART(a, b int) error {
+	if a < 0 || b < 0 || a >= len(s.nodes) || b >= len(s.nodes) || a == b {
+		return fmt.Errorf("cannot connect the UARTs of machines %d and %d", a, b)
+	}
+	if s.nodes[a].peer != nil || s.nodes[b].peer != nil {
+		return fmt.Errorf("a UART can only be connected to a single other UART")
+	}
+	s.nodes[a].peer, s.nodes[b].peer = s.nodes[b], s.nodes[a]
+	return nil
+}
+
+// Step runs every machine for a quantum, and then delivers what they sent. It
+// returns false once all machines have stopped.
+func (s *Swarm) Step() bool {
+	s.now += s.quantum
+	running := false
+	for _, node := range s.nodes {
+		if node.stop != nil {
+			continue
+		}
+		node.run(s.now)
+		running = running || node.stop == nil
+	}
+	for _, packet := range s.packets {
+		for _, node := range s.nodes {
+			if node == packet.from || node.stop != nil {
+				continue
+			}
+			data := C.CBytes(packet.data)
+			C.machine_radio_receive(node.machine, (*C.uint8_t)(data), C.uint32_t(len(packet.data)), C.uint32_t(packet.frequency), C.uint32_t(packet.mode), C.uint64_t(packet.address))
+			C.free(data)
+		}
+	}
+	s.packets = s.packets[:0]
+	for _, node := range s.nodes {
+		if node.peer == nil || len(node.sent) == 0 {
+			continue
+		}
+		// Characters that don't fit in the injection queue of the peer
+		// are sent in a later quantum.
+		data := C.CBytes(node.sent)
+		n := int(C.machine_uart_inject(node.peer.machine, 0, (*C.uint8_t)(data), C.size_t(len(node.sent))))
+		C.free(data)
+		node.sent = node.sent[:copy(node.sent, node.sent[n:])]
+	}
+	return running
+}
+
+// Run until all machines have stopped, or until the given cycle if it isn't 0.
+func (s *Swarm) Run(until uint64) {
+	for s.Step() {
+		if until != 0 && s.now >= until {
+			break
+		}
+	}
+	for _, node := range s.nodes {
+		if len(node.line) != 0 {
+			node.Write([]byte{'\n'})
+		}
+	}
+}
+
+// Run the machine until the given cycle, or until it stops.
+func (node *swarmNode) run(until uint64) {
+	C.machine_set_deadline(node.machine, C.uint64_t(until))
+	for {
+		err := node.m.Run()
+		switch err.Reason {
+		case StopDeadline:
+			return
+		case StopSemihosting:
+			if exit, code := node.m.semihost(); exit {
+				node.stop = &StopError{Reason: StopExit, PC: err.PC, ExitCode: code}
+				return
+			}
+		default:
+			node.stop = err
+			return
+		}
+	}
+}
+
+// Write output of the machine, prefixed with its index at the start of every
+// line.
+func (node *swarmNode) Write(data []byte) (int, error) {
+	node.line = append(node.line, data...)
+	for {
+		i := bytes.IndexByte(node.line, '\n')
+		if i < 0 {
+			return len(data), nil
+		}
+		fmt.Fprintf(node.swarm.output, "[%d] %s\n", node.index, node.line[:i])
+		node.line = node.line[:copy(node.line, node.line[i+1:])]
+	}
+}
+
+//export swarmRadioSend
+func swarmRadioSend(machine *C.machine_t, packet *C.uint8_t, length, frequency, mode C.uint32_t, address C.uint64_t) {
+	node := swarmNodes.get(machine)
+	node.swarm.packets = append(node.swarm.packets, swarmPacket{
+		from:      node,
+		data:      C.GoBytes(unsafe.Pointer(packet), C.int(length)),
+		frequency: uint32(frequency),
+		mode:      uint32(mode),
+		address:   uint64(address),
+	})
+}
+
+//export swarmUARTOutput
+func swarmUARTOutput(machine *C.machine_t, uart C.uint32_t, c C.uint8_t) {
+	node := swarmNodes.get(machine)
+	if node.peer != nil {
+		node.sent = append(node.sent, byte(c))
+	} else {
+		node.Write([]byte{byte(c)})
+	}
+}
+
+// Parse a UART connection of -swarm-uart, like "0-1".
+func parseSwarmUART(s string) (a, b int, err error) {
+	first, second, ok := strings.Cut(s, "-")
+	a, err1 := strconv.Atoi(first)
+	b, err2 := strconv.Atoi(second)
+	if !ok || err1 != nil || err2 != nil {
+		return 0, 0, fmt.Errorf("invalid UART connection %#v, expected something like 0-1", s)
+	}
+	return a, b, nil
+}
+
+// Run a swarm of machines from the command line flags, with one firmware image
+// for all machines or one for each. It returns the exit status: that of the
+// first machine that failed, or 0.
+func runSwarm(images []string, w io.Writer) (int, error) {
+	clock := uint64(flagClock)
+	quantum := uint64(flagSwarmQuantum.Seconds() * float64(clock))
+	if quantum == 0 {
+		return 0, fmt.Errorf("-swarm-quantum is too short")
+	}
+	s := NewSwarm(quantum, w)
+	for i := 0; i < flagSwarm; i++ {
+		path := images[0]
+		if len(images) > 1 {
+			path = images[i]
+		}
+		firmware, debug, release, err := loadFirmware(path, machinePresets[flagMachine].flashBase, flagFlashSize*1024)
+		if err != nil {
+			return 0, err
+		}
+		machine := C.machine_create(C.size_t(flagFlashSize*1024), C.size_t(flagFlashPageSize), C.size_t(flagRAMSize*1024), C.int(loglevels[flagLoglevel]))
+		C.machine_set_family(machine, machinePresets[flagMachine].family)
+		if err := setDeviceInfo(machine, flagDevice); err != nil {
+			return 0, err
+		}
+		machine.device.id[0] += C.uint8_t(i)
+		machine.device.addr[0] += C.uint8_t(i)
+		loadImage(machine, firmware)
+		release()
+		addDebugInfo(machine, debug, nil)
+		if flagStackGuard || flagStackGuardRet {
+			if err := setStackGuard(machine, debug, flagStackGuardRet); err != nil {
+				return 0, err
+			}
+		}
+		C.machine_set_wakeup_latency(machine, C.uint32_t(flagWakeupLatency[0]), C.uint32_t(flagWakeupLatency[1]))
+		C.machine_set_clock(machine, C.uint32_t(flagClock))
+		if err := setPermissions(machine, flagPermissions); err != nil {
+			return 0, err
+		}
+		if err := setUARTQueue(machine, flagUARTQueue, flagUARTPacing); err != nil {
+			return 0, err
+		}
+		C.machine_seed(machine, C.uint32_t(flagFaultSeed+int64(i)))
+		index := s.Add(machine, debug)
+		if flagSoftDevice != "" {
+			if err := addSoftDevice(s.nodes[index].m, flagSoftDevice); err != nil {
+				return 0, err
+			}
+		}
+	}
+	for _, spec := range flagSwarmUART {
+		a, b, err := parseSwarmUART(spec)
+		if err != nil {
+			return 0, err
+		}
+		if err := s.ConnectUART(a, b); err != nil {
+			return 0, err
+		}
+	}
+	for _, node := range s.nodes {
+		C.machine_reset_cause(node.machine, C.uint32_t(resetReasons[flagResetReason]))
+	}
+	s.Run(uint64(flagSwarmDuration.Seconds() * float64(clock)))
+
+	status := 0
+	for _, node := range s.nodes {
+		if node.stop == nil {
+			fmt.Fprintf(w, "[%d] still running at %d cycles\n", node.index, s.now)
+			continue
+		}
+		fmt.Fprintf(w, "[%d] stopped: %s\n", node.index, node.stop)
+		if code := node.stop.ExitStatus(); code != 0 && status == 0 {
+			status = code
+		}
+	}
+	return status, nil
+}
@@ -1,11 +1,16 @@
 
+#ifdef EMCULATOR_MAIN
+
 #include <stdio.h>
 #include <stdlib.h>
 #include <termios.h>
 #include <unistd.h>
 #include <stdbool.h>
+#include <poll.h>
 
-// This file handles raw terminal input and output.
+// This file handles raw terminal input and output for the C-only build. The Go
+// build implements these functions in terminal.go, which also works on
+// Windows.
 
 static int terminal_buf = -1;
 static struct termios terminal_termios_state;
@@ -37,18 +42,40 @@ void terminal_enable_raw() {
 static int terminal_getchar_raw() {
 	terminal_enable_raw(); // idempotent
 
+	unsigned char buf;
+	int c = EOF;
 	if (terminal_buf >= 0) {
-		int c = terminal_buf;
+		c = terminal_buf;
 		terminal_buf = -1;
-		return c;
+	} else if (read(STDIN_FILENO, &buf, 1) == 1) { // TODO: this blocks
+		c = buf;
 	}
-	int c = getchar(); // TODO: this blocks
 	if (c == 24) { // Ctrl-X
 		exit(0);
 	}
 	return c;
 }
 
+// Return whether a character can be read without blocking.
+bool terminal_poll() {
+	terminal_enable_raw(); // idempotent
+	if (terminal_buf >= 0) {
+		return true;
+	}
+	struct pollfd fd = {.fd = STDIN_FILENO, .events = POLLIN};
+	if (poll(&fd, 1, 0) <= 0) {
+		return false;
+	}
+	// At the end of the input, standard input is always ready but there is
+	// nothing to read.
+	unsigned char buf;
+	if (read(STDIN_FILENO, &buf, 1) != 1) {
+		return false;
+	}
+	terminal_buf = buf;
+	return true;
+}
+
 int terminal_getchar() {
 	int c = terminal_getchar_raw();
 	return c;
@@ -56,5 +83,8 @@ int terminal_getchar() {
 
 void terminal_putchar(int c) {
 	// bypass all buffering etc.
-	write(STDOUT_FILENO, &c, 1);
+	unsigned char buf = c;
+	write(STDOUT_FILENO, &buf, 1);
 }
+
+#endif
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// #include "machine.h"
+// #include "terminal.h"
+import "C"
+
+// This file implements the terminal that the UART is connected to. The C code
+// calls terminal_getchar, terminal_poll and terminal_putchar, which are
+// implemented here so that they work on all operating systems. (The C-only
+// build uses terminal.c instead.)
+//
+// By default, the terminal reads from standard input (in raw mode, if it is a
+// terminal) and writes to standard output. Other backends, like the console
+// and the telnet server, replace the input and output.
+
+var (
+	terminalOutput io.Writer = os.Stdout
+
+	terminalLock    sync.Mutex
+	terminalInput   chan byte // nil until input is started
+	terminalPending = -1      // character read by terminal_poll
+	terminalQueue   = 256     // depth of terminalInput (-uart-queue)
+	terminalRestore func()    // restore the terminal from raw mode
+
+	// Wakes up terminal_getchar when it waits for input, see
+	// terminalInterrupt.
+	terminalWake = make(chan struct{}, 1)
+
+	// Written to standard output when the terminal leaves raw mode, to undo
+	// changes to the screen like the scroll region of the TUI.
+	terminalRestoreScreen string
+)
+
+// Read terminal input from r instead of from standard input. This must be
+// called before the machine starts running.
+func terminalUseInput(r io.Reader) {
+	terminalLock.Lock()
+	defer terminalLock.Unlock()
+	terminalInput = make(chan byte, terminalQueue)
+	go func(input chan byte) {
+		var buf [256]byte
+		for {
+			n, err := r.Read(buf[:])
+			for _, c := range buf[:n] {
+				input <- c
+			}
+			if err != nil {
+				close(input)
+				return
+			}
+		}
+	}(terminalInput)
+}
+
+// Return the input channel, starting to read from standard input on first
+// use.
+func terminalStart() chan byte {
+	terminalLock.Lock()
+	input := terminalInput
+	terminalLock.Unlock()
+	if input == nil {
+		terminalEnableRaw()
+		terminalUseInput(os.Stdin)
+		terminalLock.Lock()
+		input = terminalInput
+		terminalLock.Unlock()
+	}
+	return input
+}
+
+// Put standard input in raw mode, if it is a terminal. This is idempotent.
+func terminalEnableRaw() {
+	terminalLock.Lock()
+	defer terminalLock.Unlock()
+	if terminalRestore != nil {
+		return
+	}
+	restore, err := terminalMakeRaw(os.Stdin.Fd())
+	if err == nil {
+		terminalRestore = restore
+	}
+}
+
+// Restore standard input from raw mode. This must be called before exiting.
+func terminalDisableRaw() {
+	terminalLock.Lock()
+	defer terminalLock.Unlock()
+	if terminalRestore != nil {
+		terminalRestore()
+		terminalRestore = nil
+		os.Stdout.WriteString(terminalRestoreScreen)
+	}
+}
+
+// Return whether a character can be read without blocking.
+//
+//export terminal_poll
+func terminal_poll() C.bool {
+	input := terminalStart()
+	if terminalPending >= 0 {
+		return true
+	}
+	select {
+	case c, ok := <-input:
+		if !ok {
+			// The input ended: nothing will be received anymore, like when
+			// nobody types.
+			return false
+		}
+		terminalPending = int(c)
+		return true
+	default:
+		return false
+	}
+}
+
+// Read a single character, blocking until one is available. It returns -1 at
+// the end of the input, and TERMINAL_INTERRUPTED when terminalInterrupt was
+// called while it was waiting.
+//
+//export terminal_getchar
+func terminal_getchar() C.int {
+	input := terminalStart()
+	c := terminalPending
+	terminalPending = -1
+	if c < 0 {
+		var b byte
+		var ok bool
+		select {
+		case b, ok = <-input:
+		default:
+			select {
+			case b, ok = <-input:
+			case <-terminalWake:
+				return C.TERMINAL_INTERRUPTED
+			}
+		}
+		if !ok {
+			return -1
+		}
+		c = int(b)
+	}
+	if c == 24 { // Ctrl-X
+		terminalDisableRaw()
+		os.Exit(0)
+	}
+	return C.int(c)
+}
+
+// Write a single character.
+//
+//export terminal_putchar
+func terminal_putchar(c C.int) {
+	terminalOutput.Write([]byte{byte(c)})
+}
+
+// Wake up terminal_getchar if it waits for input, so that the machine that
+// called it can stop for a halt request. The terminal is shared by all
+// machines, so the wait may be interrupted for another machine: then it
+// continues.
+func terminalInterrupt() {
+	select {
+	case terminalWake <- struct{}{}:
+	default:
+	}
+}
+
+// terminalReader reads from the terminal, for semihosting console input. A
+// read that waits for input fails with EINTR when the machine is halted, like
+// a read interrupted by a signal.
+type terminalReader struct {
+	machine *C.machine_t
+}
+
+func (r terminalReader) Read(buf []byte) (int, error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	c := terminal_getchar()
+	for c == C.TERMINAL_INTERRUPTED {
+		if C.machine_halt_requested(r.machine) {
+			return 0, syscall.EINTR
+		}
+		c = terminal_getchar()
+	}
+	if c < 0 {
+		return 0, io.EOF
+	}
+	buf[0] = byte(c)
+	return 1, nil
+}
@@ -1,7 +1,14 @@
 
 #pragma once
 
+#include <stdbool.h>
+
+// Returned by terminal_getchar when a halt request interrupted the wait for
+// input. The C-only build never interrupts it.
+#define TERMINAL_INTERRUPTED (-2)
+
 void terminal_enable_raw();
 int terminal_getchar();
+bool terminal_poll();
 void terminal_putchar(int c);
 void terminal_disable_raw();
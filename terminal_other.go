@@ -0,0 +1,16 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package main
+
+import "errors"
+
+// Raw mode is not supported on this operating system.
+func terminalMakeRaw(fd uintptr) (func(), error) {
+	return nil, errors.New("raw mode is not supported")
+}
+
+// The terminal size is not known on this operating system.
+func terminalSize(fd uintptr) (cols, rows int, err error) {
+	return 0, 0, errors.New("terminal size is not supported")
+}
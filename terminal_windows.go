@@ -0,0 +1,52 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// Console input modes.
+// https://docs.microsoft.com/en-us/windows/console/setconsolemode
+const (
+	consoleProcessedInput       = 0x0001
+	consoleLineInput            = 0x0002
+	consoleEchoInput            = 0x0004
+	consoleVirtualTerminalInput = 0x0200
+)
+
+var (
+	procSetConsoleMode             = syscall.NewLazyDLL("kernel32.dll").NewProc("SetConsoleMode")
+	procGetConsoleScreenBufferInfo = syscall.NewLazyDLL("kernel32.dll").NewProc("GetConsoleScreenBufferInfo")
+)
+
+// Put the console in raw mode. It returns a function to restore the previous
+// state, or an error if fd is not a console.
+func terminalMakeRaw(fd uintptr) (func(), error) {
+	var mode uint32
+	if err := syscall.GetConsoleMode(syscall.Handle(fd), &mode); err != nil {
+		return nil, err
+	}
+	raw := mode &^ (consoleProcessedInput | consoleLineInput | consoleEchoInput)
+	raw |= consoleVirtualTerminalInput
+	if r, _, err := procSetConsoleMode.Call(fd, uintptr(raw)); r == 0 {
+		return nil, err
+	}
+	return func() {
+		procSetConsoleMode.Call(fd, uintptr(mode))
+	}, nil
+}
+
+// Return the size of the console window in columns and rows.
+func terminalSize(fd uintptr) (cols, rows int, err error) {
+	// CONSOLE_SCREEN_BUFFER_INFO, with the window in srWindow.
+	var info struct {
+		size, cursor             [2]int16
+		attributes               uint16
+		left, top, right, bottom int16
+		maxWidth, maxHeight      int16
+	}
+	if r, _, err := procGetConsoleScreenBufferInfo.Call(fd, uintptr(unsafe.Pointer(&info))); r == 0 {
+		return 0, 0, err
+	}
+	return int(info.right-info.left) + 1, int(info.bottom-info.top) + 1, nil
+}
@@ -0,0 +1,45 @@
+#!/bin/sh
+# Build the firmware that the integration tests in this directory run, into
+# build/. Each part needs its SDK and is skipped without it:
+#
+#   ZEPHYR_BASE  a Zephyr tree with west and the Zephyr SDK set up, for the
+#                hello_world and philosophers samples
+#   NRF5_SDK     the nRF5 SDK with GNU_INSTALL_ROOT set in its
+#                components/toolchain/gcc/Makefile.posix, for the FreeRTOS
+#                blinky example
+#   MICROPYTHON  a MicroPython tree with its submodules and arm-none-eabi-gcc,
+#                for the nrf port on the PCA10040 and MICROBIT boards
+#
+# With all of them set, all scenarios can run:
+#
+#   tests/firmware/build.sh && emculator test tests/firmware/*.yaml
+
+set -e
+cd "$(dirname "$0")"
+mkdir -p build
+
+if [ -n "$ZEPHYR_BASE" ]; then
+	for sample in hello_world philosophers; do
+		west build -p auto -b nrf52dk/nrf52832 -d "build/zephyr-$sample" "$ZEPHYR_BASE/samples/$sample"
+		cp "build/zephyr-$sample/zephyr/zephyr.elf" "build/zephyr-$sample.elf"
+	done
+else
+	echo "ZEPHYR_BASE is not set, not building the Zephyr samples" >&2
+fi
+
+if [ -n "$NRF5_SDK" ]; then
+	make -C "$NRF5_SDK/examples/peripheral/blinky_freertos/pca10040/blank/armgcc" OUTPUT_DIRECTORY="$PWD/build/freertos-blinky"
+	cp build/freertos-blinky/nrf52832_xxaa.out build/freertos-blinky.elf
+else
+	echo "NRF5_SDK is not set, not building the FreeRTOS blinky example" >&2
+fi
+
+if [ -n "$MICROPYTHON" ]; then
+	for board in PCA10040 MICROBIT; do
+		name=$(echo "$board" | tr A-Z a-z)
+		make -C "$MICROPYTHON/ports/nrf" BOARD="$board" BUILD="$PWD/build/micropython-$name"
+		cp "build/micropython-$name/firmware.elf" "build/micropython-$name.elf"
+	done
+else
+	echo "MICROPYTHON is not set, not building MicroPython" >&2
+fi
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// #include <stdlib.h>
+// #include "machine.h"
+import "C"
+
+// This file implements interaction scripts (-script): a timeline of inputs
+// and checks that run at set moments in emulated time, so that a regression
+// test does the same thing on every run, however fast the host is. A script
+// has a TIME COMMAND line per step:
+//
+//	# boot, then ask the modem on UART1 for its status
+//	100ms  click b1 50ms
+//	1s     uart1 "AT\r"
+//	1s     expect "OK" within 500ms
+//	+2s    screenshot lcd status.png
+//	+0     exit
+//
+// TIME is the emulated time since start, or with + the time since the
+// previous line. The commands are:
+//
+//	press, release, click, glitch and rotate, see inputs.go
+//	uart TEXT                    receive TEXT on UART0
+//	uartN TEXT                   receive TEXT on UART N, like uart1
+//	expect TEXT within DURATION  fail unless a UART prints TEXT in time
+//	gpio PIN high|low|float      drive an input pin, like P0.13
+//	screenshot [NAME] PATH       save the image of a -display as PNG
+//	exit [STATUS]                stop the emulator (status 0 by default)
+//
+// TEXT is a word or a string in double quotes with Go escapes, like "AT\r\n".
+// Expected output must be printed after TIME, on any UART or the semihosting
+// console, but not spread over several of them. When it isn't, the emulator
+// stops with exit status 1.
+
+// A step of a script, at the given cycle.
+type timelineEvent struct {
+	cycle uint64
+	apply func() *timelineStop
+}
+
+// Output that is expected before a deadline.
+type timelineExpect struct {
+	text   string
+	output map[int][]byte // the last output of each UART, too short to contain text
+	seen   bool
+}
+
+// Why a script stopped the emulator.
+type timelineStop struct {
+	status  int
+	message string
+}
+
+// The script of a machine and its pending steps.
+type timeline struct {
+	lock    sync.Mutex
+	m       *Machine
+	path    string
+	events  []timelineEvent   // sorted by cycle, then by line
+	expects []*timelineExpect // expected output that wasn't seen yet
+}
+
+// Load a script, see the top of this file for the syntax.
+func loadTimeline(m *Machine, path string, clock int) (*timeline, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	t := &timeline{m: m, path: path}
+	var previous uint64
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected TIME COMMAND", path, lineno)
+		}
+		cycle, err := parseCycles(strings.TrimPrefix(fields[0], "+"), clock)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineno, err)
+		}
+		if strings.HasPrefix(fields[0], "+") {
+			cycle += previous
+		}
+		previous = cycle
+		command := strings.TrimSpace(line[len(fields[0]):])
+		if err := t.parse(command, cycle, lineno, clock); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineno, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Parse a command and schedule it at the given cycle.
+func (t *timeline) parse(command string, cycle uint64, lineno int, clock int) error {
+	op := strings.Fields(command)[0]
+	args := strings.TrimSpace(command[len(op):])
+	location := fmt.Sprintf("%s:%d", t.path, lineno)
+	uart := 0
+	if n, err := strconv.Atoi(strings.TrimPrefix(op, "uart")); err == nil && strings.HasPrefix(op, "uart") {
+		// uartN is the uart command for another UART than UART0.
+		if n < 0 || n >= C.MACHINE_NUM_UARTS {
+			return fmt.Errorf("there is no UART%d", n)
+		}
+		uart, op = n, "uart"
+	}
+	switch op {
+	case "press", "release", "click", "glitch", "rotate":
+		im := t.m.inputs // set up before the script is loaded
+		if im == nil {
+			return errors.New("input commands need -input")
+		}
+		cmd, err := im.parse(command)
+		if err != nil {
+			return err
+		}
+		t.schedule(cycle, func() *timelineStop {
+			im.exec(cmd)
+			return nil
+		})
+	case "uart":
+		text, rest, err := parseTimelineText(args)
+		if err != nil {
+			return err
+		}
+		if rest != "" {
+			return errors.New("expected uart TEXT")
+		}
+		t.schedule(cycle, func() *timelineStop {
+			data := C.CBytes([]byte(text))
+			n := int(C.machine_uart_inject(t.m.machine, C.uint32_t(uart), (*C.uint8_t)(data), C.size_t(len(text))))
+			C.free(data)
+			if n != len(text) {
+				fmt.Fprintf(os.Stderr, "%s: the input queue of UART%d is full, dropped %d bytes\n", location, uart, len(text)-n)
+			}
+			return nil
+		})
+	case "expect":
+		text, rest, err := parseTimelineText(args)
+		if err != nil {
+			return err
+		}
+		within := strings.Fields(rest)
+		if len(within) != 2 || within[0] != "within" || text == "" {
+			return errors.New("expected expect TEXT within DURATION")
+		}
+		duration, err := parseCycles(within[1], clock)
+		if err != nil {
+			return err
+		}
+		e := &timelineExpect{text: text, output: make(map[int][]byte)}
+		t.schedule(cycle, func() *timelineStop {
+			t.expects = append(t.expects, e)
+			return nil
+		})
+		t.schedule(cycle+duration, func() *timelineStop {
+			if e.seen {
+				return nil
+			}
+			for i, other := range t.expects {
+				if other == e {
+					t.expects = append(t.expects[:i], t.expects[i+1:]...)
+					break
+				}
+			}
+			return &timelineStop{1, fmt.Sprintf("%s: expected %q within %s", location, text, within[1])}
+		})
+	case "gpio":
+		fields := strings.Fields(args)
+		if len(fields) != 2 {
+			return errors.New("expected gpio PIN high|low|float")
+		}
+		pin, err := parseGPIOPin(fields[0])
+		if err != nil {
+			return err
+		}
+		level, ok := map[string]int{"high": 1, "low": 0, "float": -1}[fields[1]]
+		if !ok {
+			return fmt.Errorf("expected high, low or float, not %q", fields[1])
+		}
+		t.schedule(cycle, func() *timelineStop {
+			C.machine_set_gpio_input(t.m.machine, C.uint32_t(pin), C.int(level))
+			return nil
+		})
+	case "screenshot":
+		fields := strings.Fields(args)
+		if len(fields) != 1 && len(fields) != 2 {
+			return errors.New("expected screenshot [NAME] PATH")
+		}
+		name, path := "", fields[len(fields)-1]
+		if len(fields) == 2 {
+			name = fields[0]
+		}
+		t.schedule(cycle, func() *timelineStop {
+			if err := t.m.SaveScreenshot(name, path); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", location, err)
+			}
+			return nil
+		})
+	case "exit":
+		status := 0
+		if args != "" {
+			var err error
+			status, err = strconv.Atoi(args)
+			if err != nil {
+				return fmt.Errorf("invalid exit status %q", args)
+			}
+		}
+		t.schedule(cycle, func() *timelineStop {
+			return &timelineStop{status, fmt.Sprintf("stopped: exit %d at %s", status, location)}
+		})
+	default:
+		return fmt.Errorf("unknown command %q", op)
+	}
+	return nil
+}
+
+// Parse a word or a string in double quotes at the start of s, and return it
+// with the rest of s.
+func parseTimelineText(s string) (text, rest string, err error) {
+	if strings.HasPrefix(s, `"`) {
+		quoted, err := strconv.QuotedPrefix(s)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid string %s", s)
+		}
+		text, _ = strconv.Unquote(quoted)
+		return text, strings.TrimSpace(s[len(quoted):]), nil
+	}
+	text, rest, _ = strings.Cut(s, " ")
+	if text == "" {
+		return "", "", errors.New("expected a word or a quoted string")
+	}
+	return text, strings.TrimSpace(rest), nil
+}
+
+// Add a step at the given cycle, after the steps that were added for that
+// cycle before.
+func (t *timeline) schedule(cycle uint64, apply func() *timelineStop) {
+	i := sort.Search(len(t.events), func(i int) bool {
+		return t.events[i].cycle > cycle
+	})
+	t.events = append(t.events, timelineEvent{})
+	copy(t.events[i+1:], t.events[i:])
+	t.events[i] = timelineEvent{cycle, apply}
+}
+
+// Run all steps that are due and return the cycle of the next one, or 0 if
+// there is none. A *timelineStop is returned when the script stops the
+// emulator. The machine must not be running.
+func (t *timeline) update() (uint64, *timelineStop) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for len(t.events) != 0 && t.events[0].cycle <= uint64(t.m.machine.stats.cycles) {
+		event := t.events[0]
+		t.events = t.events[1:]
+		if stop := event.apply(); stop != nil {
+			return 0, stop
+		}
+	}
+	if len(t.events) == 0 {
+		return 0, nil
+	}
+	return t.events[0].cycle, nil
+}
+
+// Return a writer for the output of a UART, or of the semihosting
+// console for -1, to check the expected output. Every output is checked on
+// its own, so that text isn't broken up by what other UARTs print.
+func (t *timeline) output(uart int) io.Writer {
+	return timelineOutput{t, uart}
+}
+
+// The output of a UART that is checked by a script.
+type timelineOutput struct {
+	t    *timeline
+	uart int
+}
+
+// Write receives the output of the firmware, to check the expected output.
+func (o timelineOutput) Write(p []byte) (int, error) {
+	t := o.t
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for i := 0; i < len(t.expects); i++ {
+		e := t.expects[i]
+		output := append(e.output[o.uart], p...)
+		if bytes.Contains(output, []byte(e.text)) {
+			e.seen = true
+			t.expects = append(t.expects[:i], t.expects[i+1:]...)
+			i--
+			continue
+		}
+		// Only keep what may be the start of the text.
+		if keep := len(e.text) - 1; len(output) > keep {
+			output = append(output[:0], output[len(output)-keep:]...)
+		}
+		e.output[o.uart] = output
+	}
+	return len(p), nil
+}
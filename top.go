@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// #include "machine.h"
+import "C"
+
+// This file implements -top: a live view of where the firmware spends its
+// time, like top(1). The PC is sampled at a fixed rate of host time while the
+// machine runs, without stopping it, and the hottest functions are shown in a
+// table that is redrawn every second:
+//
+//	emculator top: 4000 samples at 1000 Hz, 75.0% sleeping
+//
+//	   NOW   TOTAL  FUNCTION
+//	 80.1%   75.0%  (sleeping)
+//	 12.3%   15.2%  crc32
+//	  7.6%    9.8%  main
+//
+// NOW is the share of the samples of the last second, TOTAL of all samples.
+// Samples are not taken while the machine is halted in the debugger.
+
+// The number of functions shown.
+const topRows = 20
+
+// Function symbols sorted by address, to find the function of a PC quickly.
+type functionTable struct {
+	names   []string
+	symbols []symbol
+}
+
+func newFunctionTable(info *debugInfo) *functionTable {
+	t := &functionTable{}
+	if info == nil {
+		return t
+	}
+	for name := range info.symbols {
+		t.names = append(t.names, name)
+	}
+	sort.Strings(t.names)
+	sort.SliceStable(t.names, func(i, j int) bool {
+		return info.symbols[t.names[i]].Address < info.symbols[t.names[j]].Address
+	})
+	for _, name := range t.names {
+		t.symbols = append(t.symbols, info.symbols[name])
+	}
+	return t
+}
+
+// Return the name of the function that contains the given address, or the
+// address itself if it isn't known.
+func (t *functionTable) lookup(address uint32) string {
+	name, _, ok := t.function(address)
+	if !ok {
+		return fmt.Sprintf("0x%x", address)
+	}
+	return name
+}
+
+// Return the name and start address of the function that contains the given
+// address.
+func (t *functionTable) function(address uint32) (string, uint32, bool) {
+	i := sort.Search(len(t.symbols), func(i int) bool {
+		return t.symbols[i].Address > address
+	})
+	if i == 0 || (t.symbols[i-1].Size != 0 && address-t.symbols[i-1].Address >= t.symbols[i-1].Size) {
+		return "", 0, false
+	}
+	return t.names[i-1], t.symbols[i-1].Address, true
+}
+
+type topProfiler struct {
+	m         *Machine
+	functions *functionTable
+	rate      int // samples per second
+	total     map[string]int
+	recent    map[string]int // samples since the last redraw
+	samples   int
+	w         io.Writer
+}
+
+// Sample the PC of the machine rate times per second, and draw the table to
+// output: a file or terminal, or - for stderr.
+func startTop(m *Machine, output string, rate int) error {
+	if rate <= 0 {
+		return fmt.Errorf("-top-rate must be positive")
+	}
+	var w io.Writer = os.Stderr
+	if output != "-" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+	p := &topProfiler{
+		m:         m,
+		functions: newFunctionTable(m.debug),
+		rate:      rate,
+		total:     map[string]int{},
+		recent:    map[string]int{},
+		w:         w,
+	}
+	go p.run()
+	return nil
+}
+
+// Take samples and redraw the table every second. Like the metrics server, it
+// reads the machine while it runs, so a sample may be slightly out of date.
+func (p *topProfiler) run() {
+	sample := time.NewTicker(time.Second / time.Duration(p.rate))
+	redraw := time.NewTicker(time.Second)
+	for {
+		select {
+		case <-sample.C:
+			if p.m.machine.time_paused {
+				continue
+			}
+			name := "(sleeping)"
+			if p.m.machine.sleep == C.SLEEP_NONE {
+				name = p.functions.lookup(uint32(p.m.machine.instruction_pc))
+			}
+			p.total[name]++
+			p.recent[name]++
+			p.samples++
+		case <-redraw.C:
+			p.draw()
+			p.recent = map[string]int{}
+		}
+	}
+}
+
+// Clear the screen and draw the hottest functions, those of the last second
+// first.
+func (p *topProfiler) draw() {
+	recentSamples := 0
+	for _, n := range p.recent {
+		recentSamples += n
+	}
+	percent := func(n, total int) float64 {
+		if total == 0 {
+			return 0
+		}
+		return float64(n) / float64(total) * 100
+	}
+	var names []string
+	for name := range p.total {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := names[i], names[j]
+		if p.recent[a] != p.recent[b] {
+			return p.recent[a] > p.recent[b]
+		}
+		if p.total[a] != p.total[b] {
+			return p.total[a] > p.total[b]
+		}
+		return a < b
+	})
+	if len(names) > topRows {
+		names = names[:topRows]
+	}
+	fmt.Fprint(p.w, "\x1b[H\x1b[2J")
+	fmt.Fprintf(p.w, "emculator top: %d samples at %d Hz, %.1f%% sleeping\r\n\r\n", p.samples, p.rate, percent(p.total["(sleeping)"], p.samples))
+	fmt.Fprintf(p.w, "   NOW   TOTAL  FUNCTION\r\n")
+	for _, name := range names {
+		fmt.Fprintf(p.w, "%5.1f%%  %5.1f%%  %s\r\n", percent(p.recent[name], recentSamples), percent(p.total[name], p.samples), name)
+	}
+}
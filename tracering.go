@@ -0,0 +1,122 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// #include "machine.h"
+// void traceRingFlush(machine_t *machine);
+import "C"
+
+// This file implements the host side of the trace ring of the C core. Frequent
+// trace events, like every peripheral register access with -periphtrace, bus
+// operations with -buslog, stores to watched values and exceptions with
+// -rtos-trace, are written by the C core into a ring buffer instead of calling
+// into Go for each of them, which would make traced firmware run many times
+// slower. A goroutine reads them in batches. The ring is also read when the
+// machine stops and when it is full, so no events are lost and they are all
+// handled before the machine reports why it stopped.
+
+// Number of events in the trace ring.
+const traceRingSize = 1 << 16
+
+// How often the trace ring is read while the machine runs.
+const traceRingInterval = 20 * time.Millisecond
+
+// The host side of the trace ring of a machine.
+type traceRing struct {
+	machine  *C.machine_t
+	events   []C.trace_event_t
+	handlers []traceHandler
+	lock     sync.Mutex // held while reading events
+	done     chan struct{}
+}
+
+// A user of the trace ring, like the peripheral trace. Each handler sees all
+// events, and picks the types it needs.
+type traceHandler struct {
+	handle func(*C.trace_event_t)
+	flush  func() // called after each batch of events, if not nil
+}
+
+var traceRings machineMap[*traceRing]
+
+// Let the C core record trace events in a ring buffer, handled by handle on
+// another goroutine, with a call to flush after each batch of events. The ring
+// is created by the first handler that is attached to a machine. Events are
+// handled later than they happen, so they must carry all the state that the
+// handler needs.
+func attachTraceRing(machine *C.machine_t, handle func(*C.trace_event_t), flush func()) bool {
+	r := traceRings.get(machine)
+	if r == nil {
+		if !C.machine_enable_trace_ring(machine, traceRingSize, C.trace_flush_t(C.traceRingFlush)) {
+			return false
+		}
+		r = &traceRing{
+			machine: machine,
+			events:  unsafe.Slice(machine.trace_ring.events, traceRingSize),
+			done:    make(chan struct{}),
+		}
+		traceRings.set(machine, r)
+		go func() {
+			ticker := time.NewTicker(traceRingInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					r.drain()
+				case <-r.done:
+					return
+				}
+			}
+		}()
+	}
+	r.lock.Lock()
+	r.handlers = append(r.handlers, traceHandler{handle, flush})
+	r.lock.Unlock()
+	return true
+}
+
+// Handle all events that are in the ring.
+func (r *traceRing) drain() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	head := atomic.LoadUint64((*uint64)(unsafe.Pointer(&r.machine.trace_ring.head)))
+	tail := (*uint64)(unsafe.Pointer(&r.machine.trace_ring.tail))
+	if *tail == head {
+		return
+	}
+	for i := *tail; i != head; i++ {
+		for _, h := range r.handlers {
+			h.handle(&r.events[i%traceRingSize])
+		}
+	}
+	atomic.StoreUint64(tail, head)
+	for _, h := range r.handlers {
+		if h.flush != nil {
+			h.flush()
+		}
+	}
+}
+
+// Stop the goroutine that reads the ring, after handling the last events.
+func (r *traceRing) close() {
+	r.drain()
+	close(r.done)
+}
+
+// Handle the trace events of the machine that are still in its ring, if it
+// has one.
+func drainTraceRing(machine *C.machine_t) {
+	if r := traceRings.get(machine); r != nil {
+		r.drain()
+	}
+}
+
+//export traceRingFlush
+func traceRingFlush(machine *C.machine_t) {
+	traceRings.get(machine).drain()
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// #include "machine.h"
+import "C"
+
+// This file implements -tui: a dashboard on the terminal, for debugging
+// without setting up GDB. It is redrawn ten times per second while the
+// firmware runs:
+//
+//	running  PC 0x1a2c in main.blink at main.go:12  12345678 cycles  0.193 s
+//	r0   00000001 | => 00001a2c: ldr r3, [pc, #16]
+//	r1   20000104 |    00001a2e: adds r0, #1
+//	...          | ...
+//	-- GPIO ---------------------------------------------
+//	P0   ............1.........0.....
+//	-- UART ---------------------------------------------
+//	hello world
+//	-- messages -----------------------------------------
+//	stopped at main.blink (0x1a2c) at main.go:12
+//	C-a : command  C-a h help  C-a x exit
+//
+// The registers that changed since the last redraw are bold. In the GPIO
+// pane, pins that are outputs show their level (1 or 0) and other pins a dot.
+// Like with the console, all keys go to the UART except those that follow
+// Ctrl-A. Ctrl-A : opens the command line, which runs the monitor commands
+// and halt, continue, step [N], reset and quit. The messages of the emulator
+// and the output of commands scroll in the messages pane.
+
+const tuiHelp = `C-a :    enter a command (halt, continue, step [N], reset, quit or a monitor command)
+C-a h    print this help
+C-a x    exit the emulator
+C-a C-a  send C-a to the firmware
+`
+
+// The number of UART lines that are kept.
+const tuiUARTLines = 500
+
+type tui struct {
+	m         *Machine
+	functions *functionTable
+	uart      *tuiScreen
+	commands  chan string // command lines typed by the user
+
+	lock    sync.Mutex
+	command *string // the command line being typed, nil if not typing
+
+	frame    string     // the last frame that was drawn
+	regs     [17]uint32 // the registers of the last redraw
+	logStart int        // first row of the messages pane, 0 if not set up
+	logEnd   int
+}
+
+// Start the dashboard on the terminal. It must be called before the machine
+// starts running, instead of startConsole.
+func startTUI(m *Machine) error {
+	for _, f := range []*os.File{os.Stdin, os.Stdout} {
+		if info, err := f.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+			return errors.New("standard input and output must be a terminal")
+		}
+	}
+	t := &tui{
+		m:         m,
+		functions: newFunctionTable(m.debug),
+		uart:      &tuiScreen{lines: []string{""}},
+		commands:  make(chan string),
+	}
+	// The UART output goes to its pane, and its input comes from the keys
+	// that aren't for the dashboard.
+	terminalOutput = t.uart
+	r, w := io.Pipe()
+	terminalUseInput(r)
+	terminalEnableRaw()
+	t.draw()
+	go t.readKeys(w)
+	go t.run()
+	return nil
+}
+
+// Read the keys from the terminal, and pass them to the UART or the command
+// line.
+func (t *tui) readKeys(w *io.PipeWriter) {
+	input := bufio.NewReader(os.Stdin)
+	for {
+		c, err := input.ReadByte()
+		if err != nil {
+			w.Close()
+			return
+		}
+		t.lock.Lock()
+		typing := t.command != nil
+		t.lock.Unlock()
+		if typing {
+			t.editCommand(c, input)
+			continue
+		}
+		if c != consoleEscape {
+			w.Write([]byte{c})
+			continue
+		}
+		c, err = input.ReadByte()
+		if err != nil {
+			w.Close()
+			return
+		}
+		switch c {
+		case consoleEscape:
+			w.Write([]byte{consoleEscape})
+		case ':':
+			t.lock.Lock()
+			t.command = new(string)
+			t.lock.Unlock()
+		case 'h':
+			fmt.Fprint(os.Stderr, tuiHelp)
+			if t.m.inputs != nil {
+				t.m.inputs.help(os.Stderr)
+			}
+		case 'x':
+			terminalDisableRaw()
+			fmt.Fprintln(os.Stderr, "\nemculator: terminated")
+			os.Exit(0)
+		default:
+			if t.m.inputs != nil {
+				if command, ok := t.m.inputs.consoleKey(c); ok {
+					t.m.inputCommand(command)
+				}
+			}
+		}
+	}
+}
+
+// Handle a key typed on the command line. Enter runs the command, and Escape
+// or Ctrl-C cancels it.
+func (t *tui) editCommand(c byte, input *bufio.Reader) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	switch c {
+	case '\r', '\n':
+		line := *t.command
+		t.command = nil
+		go func() { t.commands <- line }()
+	case 0x1b:
+		if input.Buffered() != 0 {
+			// An escape sequence, like that of an arrow key: ignore it.
+			for {
+				c, err := input.ReadByte()
+				if err != nil || (c >= 0x40 && c <= 0x7e && c != '[') {
+					return
+				}
+			}
+		}
+		t.command = nil
+	case 3: // Ctrl-C
+		t.command = nil
+	case 0x7f, '\b':
+		if n := len(*t.command); n != 0 {
+			*t.command = (*t.command)[:n-1]
+		}
+	default:
+		if c >= ' ' && c < 0x7f {
+			*t.command += string(c)
+		}
+	}
+}
+
+// Redraw the dashboard and run the commands that were typed. Like -top, it
+// reads the machine while it runs, so what is shown may be slightly out of
+// date.
+func (t *tui) run() {
+	redraw := time.NewTicker(time.Second / 10)
+	for {
+		select {
+		case <-redraw.C:
+		case line := <-t.commands:
+			fmt.Fprintf(os.Stderr, "> %s\n", line)
+			if err := t.runCommand(line); err != nil {
+				fmt.Fprintln(os.Stderr, "error:", err)
+			}
+		}
+		t.draw()
+	}
+}
+
+// Run a command of the command line.
+func (t *tui) runCommand(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+	m := t.m
+	switch fields[0] {
+	case "halt":
+		m.Debug(func(running bool) bool {
+			if running {
+				m.stop = &StopError{Reason: StopHalt, PC: m.ReadRegister(15) - 1}
+			}
+			return false
+		})
+	case "continue", "c":
+		m.Continue()
+	case "step", "s":
+		n := 1
+		if len(fields) > 1 {
+			var err error
+			n, err = strconv.Atoi(fields[1])
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid step count %#v", fields[1])
+			}
+		}
+		m.Debug(func(running bool) bool {
+			m.stop = nil
+			for i := 0; i < n && m.stop == nil; i++ {
+				m.stop = m.Step()
+			}
+			if m.stop == nil {
+				m.stop = &StopError{Reason: StopHalt, PC: m.ReadRegister(15) - 1}
+			}
+			return false
+		})
+	case "reset":
+		m.Pause(func(running bool) error {
+			C.machine_reset_cause(m.machine, C.RESET_PIN)
+			return nil
+		})
+	case "quit", "q":
+		terminalDisableRaw()
+		os.Exit(0)
+	case "help":
+		fmt.Fprint(os.Stderr, tuiHelp)
+		return runMonitorCommand(m, line, os.Stderr)
+	default:
+		return m.Pause(func(running bool) error {
+			return runMonitorCommand(m, line, os.Stderr)
+		})
+	}
+	return nil
+}
+
+// Draw the dashboard, if it changed. The messages pane is a scroll region
+// that is left alone: messages are written there by whoever prints them, and
+// the cursor stays in it between redraws.
+func (t *tui) draw() {
+	cols, rows, err := terminalSize(os.Stdout.Fd())
+	if err != nil || cols <= 0 || rows <= 0 {
+		cols, rows = 80, 24
+	}
+	m := t.m
+	regs := m.DebugRegisters()
+	ports := t.gpioPorts()
+	if len(ports) > 3 {
+		ports = ports[:3]
+	}
+
+	// Sizes of the panes, from the top: the status line, the registers and
+	// code, GPIO, UART, the messages and the command line.
+	top := 17
+	if rows-top < 12+len(ports) {
+		top = rows - 12 - len(ports)
+	}
+	if top < 1 || cols < 40 {
+		t.setFrame(rows, rows, "\x1b[H\x1b[2Jterminal too small")
+		return
+	}
+	rest := rows - 1 - top - 1 - len(ports) - 1 - 1 - 1
+	if len(ports) == 0 {
+		rest++
+	}
+	uartRows := rest * 2 / 3
+	logRows := rest - uartRows
+	logStart := rows - logRows
+	var b strings.Builder
+	line := func(row int, s string) {
+		fmt.Fprintf(&b, "\x1b[%d;1H\x1b[2K%s", row, s)
+	}
+
+	// The status line.
+	state := "running"
+	if m.Halted() {
+		state = "halted"
+		if m.stop != nil && m.stop.Reason != StopHalt {
+			state = m.stop.Error()
+		}
+	}
+	pc := regs[15]
+	where := ""
+	if name, _, ok := t.functions.function(pc); ok {
+		where = " in " + name
+	}
+	if location := m.debug.location(pc); location != "" {
+		where += " at " + location
+	}
+	status := fmt.Sprintf(" %s  PC 0x%x%s  %d cycles  %.3f s", state, pc, where, uint64(m.machine.stats.cycles), float64(C.machine_time_us(m.machine))/1e6)
+	line(1, "\x1b[7m"+tuiFit(status, cols)+"\x1b[0m")
+
+	// The registers and the code around the PC.
+	names := [17]string{"r0", "r1", "r2", "r3", "r4", "r5", "r6", "r7", "r8", "r9", "r10", "r11", "r12", "sp", "lr", "pc", "xpsr"}
+	code := t.disassemble(pc, top)
+	for i := 0; i < top; i++ {
+		reg := ""
+		if i < len(regs) {
+			reg = fmt.Sprintf("%-4s %08x", names[i], regs[i])
+			if regs[i] != t.regs[i] {
+				reg = "\x1b[1m" + reg + "\x1b[0m"
+			}
+		} else {
+			reg = strings.Repeat(" ", 13)
+		}
+		text := ""
+		if i < len(code) {
+			text = tuiFit(code[i], cols-16)
+		}
+		line(2+i, reg+" | "+text)
+	}
+	t.regs = regs
+	row := 2 + top
+
+	// GPIO.
+	if len(ports) != 0 {
+		line(row, tuiFit("-- GPIO "+strings.Repeat("-", cols), cols))
+		row++
+		for _, port := range ports {
+			line(row, port)
+			row++
+		}
+	}
+
+	// The last lines of the UART.
+	line(row, tuiFit("-- UART "+strings.Repeat("-", cols), cols))
+	row++
+	for _, s := range t.uart.last(uartRows) {
+		line(row, tuiFit(s, cols))
+		row++
+	}
+	for ; row < logStart-1; row++ {
+		line(row, "")
+	}
+	line(logStart-1, tuiFit("-- messages "+strings.Repeat("-", cols), cols))
+
+	// The command line, below the messages.
+	t.lock.Lock()
+	if t.command != nil {
+		line(rows, "> "+*t.command)
+	} else {
+		line(rows, "\x1b[2mC-a : command  C-a h help  C-a x exit\x1b[0m")
+	}
+	t.lock.Unlock()
+	t.setFrame(logStart, rows-1, b.String())
+}
+
+// Write a frame if it differs from the last one, after setting up the scroll
+// region of the messages pane from row start to end if it moved.
+func (t *tui) setFrame(start, end int, frame string) {
+	if start != t.logStart || end != t.logEnd {
+		t.logStart, t.logEnd = start, end
+		t.frame = ""
+		// Set the scroll region and put the cursor at its bottom, where the
+		// next message will be written. Restore the whole screen when the
+		// terminal leaves raw mode.
+		terminalRestoreScreen = fmt.Sprintf("\x1b[r\x1b[%d;1H\n", end+1)
+		fmt.Fprintf(os.Stdout, "\x1b[2J\x1b[%d;%dr\x1b[%d;1H", start, end, end)
+	}
+	if frame == t.frame {
+		return
+	}
+	t.frame = frame
+	os.Stdout.WriteString("\x1b7" + frame + "\x1b8")
+}
+
+// Disassemble the code around the PC: from the start of its function, with
+// up to a third of the lines before the PC. Only memory that code can be in
+// is read.
+func (t *tui) disassemble(pc uint32, lines int) []string {
+	start := pc
+	if _, address, ok := t.functions.function(pc); ok && pc-address < 4096 {
+		start = address
+	}
+	var end uint64
+	for _, r := range memoryRegions(t.m) {
+		if uint64(pc) >= r.start && uint64(pc) < r.start+r.size && strings.Contains(r.permissions, "x") {
+			end = r.start + r.size
+			if uint64(start) < r.start {
+				start = pc
+			}
+		}
+	}
+	var addresses []uint32
+	var texts []string
+	for address := start; uint64(address)+4 <= end && (len(addresses) < lines || address <= pc); {
+		text, size := t.m.Disassemble(address)
+		marker := "  "
+		if address == pc {
+			marker = "=>"
+		}
+		addresses = append(addresses, address)
+		texts = append(texts, fmt.Sprintf("%s %08x: %s", marker, address, text))
+		if size <= 0 {
+			break
+		}
+		address += uint32(size)
+		if address > pc && len(addresses) > lines {
+			break
+		}
+	}
+	// Scroll so that the PC is in view.
+	first := 0
+	for i, address := range addresses {
+		if address == pc && i > lines/3 {
+			first = i - lines/3
+		}
+	}
+	texts = texts[first:]
+	if len(texts) > lines {
+		texts = texts[:lines]
+	}
+	return texts
+}
+
+// Return a line per GPIO port that has outputs, with the level of each pin:
+// 1 or 0 for outputs, a dot for other pins.
+func (t *tui) gpioPorts() []string {
+	machine := t.m.machine
+	var ports []string
+	switch machine.family {
+	case C.FAMILY_STM32:
+		for port := 0; port < 11; port++ {
+			ports = append(ports, tuiGPIOPort(machine, fmt.Sprintf("P%c", 'A'+port), port, 16))
+		}
+	case C.FAMILY_RP2040:
+		ports = append(ports, tuiGPIOPort(machine, "GPIO", 0, 30))
+	default:
+		ports = append(ports, tuiGPIOPort(machine, "P0", 0, 32), tuiGPIOPort(machine, "P1", 1, 16))
+	}
+	var used []string
+	for _, port := range ports {
+		if port != "" {
+			used = append(used, port)
+		}
+	}
+	return used
+}
+
+// Return the pins of a GPIO port, or an empty string if none are outputs.
+func tuiGPIOPort(machine *C.machine_t, name string, port, pins int) string {
+	s := fmt.Sprintf("%-5s", name)
+	outputs := false
+	for pin := 0; pin < pins; pin++ {
+		if pin%8 == 0 && pin != 0 {
+			s += " "
+		}
+		switch C.machine_gpio_level(machine, C.uint32_t(port*32+pin)) {
+		case 1:
+			s += "\x1b[1;32m1\x1b[0m"
+			outputs = true
+		case 0:
+			s += "0"
+			outputs = true
+		default:
+			s += "."
+		}
+	}
+	if !outputs {
+		return ""
+	}
+	return s
+}
+
+// Cut a line that has no escape sequences to the given width.
+func tuiFit(s string, width int) string {
+	if width < 0 {
+		width = 0
+	}
+	if len(s) > width {
+		s = s[:width]
+	}
+	return s
+}
+
+// tuiScreen keeps the last lines of the UART output, like a terminal does.
+// Escape sequences are dropped.
+type tuiScreen struct {
+	lock   sync.Mutex
+	lines  []string
+	column int
+	escape int // 1 after ESC, 2 inside a CSI sequence
+}
+
+func (s *tuiScreen) Write(buf []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, c := range buf {
+		if s.escape == 1 {
+			s.escape = 0
+			if c == '[' {
+				s.escape = 2
+			}
+			continue
+		}
+		if s.escape == 2 {
+			if c >= 0x40 && c <= 0x7e {
+				s.escape = 0
+			}
+			continue
+		}
+		last := &s.lines[len(s.lines)-1]
+		switch {
+		case c == 0x1b:
+			s.escape = 1
+		case c == '\n':
+			s.lines = append(s.lines, "")
+			if len(s.lines) > tuiUARTLines {
+				s.lines = s.lines[len(s.lines)-tuiUARTLines:]
+			}
+			s.column = 0
+		case c == '\r':
+			s.column = 0
+		case c == '\b':
+			if s.column > 0 {
+				s.column--
+			}
+		case c == '\t':
+			s.put(last, ' ')
+			for s.column%8 != 0 {
+				s.put(last, ' ')
+			}
+		case c >= ' ' && c < 0x7f:
+			s.put(last, c)
+		}
+	}
+	return len(buf), nil
+}
+
+// Put a character at the cursor, and move the cursor right.
+func (s *tuiScreen) put(line *string, c byte) {
+	if s.column < len(*line) {
+		*line = (*line)[:s.column] + string(c) + (*line)[s.column+1:]
+	} else {
+		*line += strings.Repeat(" ", s.column-len(*line)) + string(c)
+	}
+	s.column++
+}
+
+// Return the last n lines, without the empty line the cursor is on.
+func (s *tuiScreen) last(n int) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	lines := s.lines
+	if len(lines) > 1 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return append([]string(nil), lines...)
+}
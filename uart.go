@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// #include "machine.h"
+import "C"
+
+// This file implements the UART backends. By default UART0 is connected to the
+// terminal, and the other UARTs only receive injected input. With a telnet
+// backend, a UART is connected to a TCP port instead and can be used with
+// `telnet localhost PORT`.
+// Telnet protocol:
+// https://tools.ietf.org/html/rfc854
+
+// Telnet commands and options.
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+
+	telnetOptionEcho            = 1
+	telnetOptionSuppressGoAhead = 3
+)
+
+// Connect a UART to the backend described by spec, which is either "stdio" for
+// UART0 (the terminal), "none" for the other UARTs or "telnet:PORT" where PORT
+// is a TCP address like 4444 or localhost:4444.
+func startUARTBackend(m *Machine, uart int, spec string) error {
+	if spec == "stdio" && uart == 0 || spec == "none" && uart != 0 {
+		return nil
+	}
+	if !strings.HasPrefix(spec, "telnet:") {
+		if uart == 0 {
+			return fmt.Errorf("unknown UART backend %#v, expected stdio or telnet:PORT", spec)
+		}
+		return fmt.Errorf("unknown UART backend %#v, expected none or telnet:PORT", spec)
+	}
+	port := spec[len("telnet:"):]
+	if port == "" {
+		return errors.New("no telnet port specified")
+	}
+	if !strings.Contains(port, ":") {
+		port = "localhost:" + port
+	}
+	sock, err := net.Listen("tcp", port)
+	if err != nil {
+		return err
+	}
+
+	// The machine reads from this pipe, which is connected to the current
+	// telnet client.
+	rxReader, rxWriter := io.Pipe()
+	server := &telnetServer{rx: rxWriter}
+	if uart == 0 {
+		// The terminal is served over telnet.
+		terminalUseInput(rxReader)
+		terminalOutput = server
+	} else {
+		m.SetUARTInput(uart, rxReader)
+		m.SetUARTOutput(uart, server)
+	}
+	go server.accept(sock)
+	return nil
+}
+
+// Input of a UART that is read from an io.Reader, see SetUARTInput. Only the
+// goroutine that runs the machine takes characters from it.
+type uartInput struct {
+	input   chan byte
+	pending int // character that was looked at but not taken, or -1
+}
+
+// Start reading the input of a UART from r, with a queue of the given depth.
+func newUARTInput(r io.Reader, depth int) *uartInput {
+	u := &uartInput{input: make(chan byte, depth), pending: -1}
+	go func() {
+		var buf [256]byte
+		for {
+			n, err := r.Read(buf[:])
+			for _, c := range buf[:n] {
+				u.input <- c
+			}
+			if err != nil {
+				close(u.input)
+				return
+			}
+		}
+	}()
+	return u
+}
+
+// Return the next character without waiting for it, or -1 if there is none
+// yet. It is only taken when take is true.
+func (u *uartInput) next(take bool) int {
+	if u.pending < 0 {
+		select {
+		case c, ok := <-u.input:
+			if ok {
+				u.pending = int(c)
+			}
+		default:
+		}
+	}
+	c := u.pending
+	if take {
+		u.pending = -1
+	}
+	return c
+}
+
+// A telnet server that serves a single client at a time.
+type telnetServer struct {
+	lock sync.Mutex
+	conn net.Conn // current client, or nil
+	rx   io.Writer
+}
+
+// Accept telnet clients, one at a time.
+func (s *telnetServer) accept(sock net.Listener) {
+	for {
+		conn, err := sock.Accept()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "telnet server error:", err)
+			return
+		}
+		s.lock.Lock()
+		s.conn = conn
+		s.lock.Unlock()
+
+		// Character mode: the server echoes input and go-ahead is not used.
+		conn.Write([]byte{
+			telnetIAC, telnetWILL, telnetOptionEcho,
+			telnetIAC, telnetWILL, telnetOptionSuppressGoAhead,
+			telnetIAC, telnetDO, telnetOptionSuppressGoAhead,
+		})
+		err = s.receive(conn)
+		if err != nil && err != io.EOF {
+			fmt.Fprintln(os.Stderr, "telnet connection error:", err)
+		}
+
+		s.lock.Lock()
+		s.conn = nil
+		s.lock.Unlock()
+		conn.Close()
+	}
+}
+
+// Read input from the telnet client and send it to the UART, filtering out
+// telnet commands.
+func (s *telnetServer) receive(conn net.Conn) error {
+	r := bufio.NewReader(conn)
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if c == '\r' {
+			// A carriage return is followed by a NUL or newline. Drop the NUL.
+			next, err := r.ReadByte()
+			if err != nil {
+				return err
+			}
+			if next != 0 {
+				r.UnreadByte()
+			}
+		} else if c == telnetIAC {
+			cmd, err := r.ReadByte()
+			if err != nil {
+				return err
+			}
+			switch cmd {
+			case telnetIAC:
+				// Escaped 0xff byte.
+			case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+				option, err := r.ReadByte()
+				if err != nil {
+					return err
+				}
+				s.negotiate(conn, cmd, option)
+				continue
+			case telnetSB:
+				// Skip subnegotiation until IAC SE.
+				prev := byte(0)
+				for {
+					b, err := r.ReadByte()
+					if err != nil {
+						return err
+					}
+					if prev == telnetIAC && b == telnetSE {
+						break
+					}
+					prev = b
+				}
+				continue
+			default:
+				// Other commands (NOP, break, etc.) are ignored.
+				continue
+			}
+		}
+		if _, err := s.rx.Write([]byte{c}); err != nil {
+			return err
+		}
+	}
+}
+
+// Answer an option request from the client. Only echo and suppress-go-ahead
+// are supported, which the server already offered on connect, so only
+// refusals need to be sent.
+func (s *telnetServer) negotiate(conn net.Conn, cmd, option byte) {
+	supported := option == telnetOptionEcho || option == telnetOptionSuppressGoAhead
+	switch {
+	case cmd == telnetDO && !supported:
+		conn.Write([]byte{telnetIAC, telnetWONT, option})
+	case cmd == telnetWILL && option != telnetOptionSuppressGoAhead:
+		conn.Write([]byte{telnetIAC, telnetDONT, option})
+	}
+}
+
+// Send UART output to the current telnet client. Output is dropped while no
+// client is connected.
+func (s *telnetServer) Write(buf []byte) (int, error) {
+	// Escape 0xff bytes, they would be interpreted as IAC.
+	data := make([]byte, 0, len(buf))
+	for _, c := range buf {
+		data = append(data, c)
+		if c == telnetIAC {
+			data = append(data, telnetIAC)
+		}
+	}
+	s.lock.Lock()
+	if s.conn != nil {
+		s.conn.Write(data)
+	}
+	s.lock.Unlock()
+	return len(buf), nil
+}
+
+// Configure the input queue of the UART (-uart-queue) and the time between
+// two characters that are taken from it (-uart-pacing). Input that arrives
+// while the machine is halted waits in the queue until the machine continues.
+// When the queue is full the host waits, like with flow control, and the
+// control socket accepts fewer bytes.
+func setUARTQueue(machine *C.machine_t, depth int, pacing time.Duration) error {
+	if depth < 1 {
+		return errors.New("the UART queue must hold at least 1 character")
+	}
+	if pacing < 0 || pacing > math.MaxUint32*time.Nanosecond {
+		return errors.New("the UART pacing must be between 0 and 4s")
+	}
+	C.machine_set_uart_queue(machine, C.size_t(depth))
+	C.machine_set_uart_pacing(machine, C.uint32_t(pacing.Nanoseconds()))
+	return nil
+}
+
+// Errors that can be given to the uart command, in the UART_ERROR_* bits.
+var uartErrors = map[string]C.uint32_t{
+	"overrun": C.UART_ERROR_OVERRUN,
+	"parity":  C.UART_ERROR_PARITY,
+	"framing": C.UART_ERROR_FRAMING,
+	"break":   C.UART_ERROR_BREAK,
+}
+
+// Run the uart command of the monitor and Emculator.UART on the control
+// socket. Without arguments it shows the line, "cts on" or "cts off" sets the
+// CTS input of the chip and "error KIND" receives the next character with an
+// error. A UART number can come first, like "1 cts off", for another UART than
+// UART0. It must be called while the machine isn't running.
+func uartCommand(machine *C.machine_t, args []string, w io.Writer) error {
+	index := 0
+	if len(args) != 0 {
+		if n, err := strconv.Atoi(args[0]); err == nil {
+			if n < 0 || n >= C.MACHINE_NUM_UARTS {
+				return fmt.Errorf("there is no UART%d", n)
+			}
+			index, args = n, args[1:]
+		}
+	}
+	uart := &machine.uart[index]
+	switch {
+	case len(args) == 0:
+		baud := "unknown"
+		if uart.baud != 0 {
+			baud = fmt.Sprint(uint32(uart.baud))
+		}
+		host := "any"
+		if uart.host_baud != 0 {
+			host = fmt.Sprint(uint32(uart.host_baud))
+		}
+		fmt.Fprintf(w, "baud rate:   %s (host: %s), %d bits per character\n", baud, host, uint32(uart.frame_bits))
+		fmt.Fprintf(w, "timing:      %v\n", bool(uart.timing))
+		fmt.Fprintf(w, "flow:        RTS %v, CTS %v\n", bool(uart.rtsflow), bool(uart.ctsflow))
+		fmt.Fprintf(w, "cts:         %v\n", bool(uart.cts))
+		fmt.Fprintf(w, "receive:     %d of %d characters\n", uint32(uart.rx_len), uint32(uart.depth))
+		fmt.Fprintf(w, "queue:       %d of %d characters, pacing %v\n", uint32(uart.inject_len), uint32(uart.inject_size), time.Duration(uart.pacing))
+		return nil
+	case len(args) == 2 && args[0] == "cts" && (args[1] == "on" || args[1] == "off"):
+		C.machine_uart_set_cts(machine, C.uint32_t(index), C.bool(args[1] == "on"))
+		return nil
+	case len(args) == 2 && args[0] == "error":
+		kind, ok := uartErrors[args[1]]
+		if !ok {
+			return fmt.Errorf("unknown UART error %#v, expected overrun, parity, framing or break", args[1])
+		}
+		C.machine_uart_inject_error(machine, C.uint32_t(index), kind)
+		return nil
+	default:
+		return errors.New("usage: uart [N] [cts on|off | error KIND]")
+	}
+}
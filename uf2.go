@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// UF2 is the file format used to drag and drop firmware onto the USB mass
+// storage bootloader of boards like the Raspberry Pi Pico. See:
+// https://github.com/microsoft/uf2
+const (
+	uf2BlockSize  = 512
+	uf2MagicStart = 0x0a324655 // "UF2\n"
+	uf2MagicNext  = 0x9e5d5157
+	uf2MagicEnd   = 0x0ab16f30
+
+	uf2FlagNotMainFlash = 0x00000001
+)
+
+func isUF2(data []byte) bool {
+	return len(data) >= uf2BlockSize && binary.LittleEndian.Uint32(data[0:]) == uf2MagicStart && binary.LittleEndian.Uint32(data[4:]) == uf2MagicNext
+}
+
+// Convert a UF2 file to a raw firmware image starting at address 0. Blocks
+// that are not meant for the main flash are skipped.
+func loadUF2(data []byte, flashBase uint32, flashSize int) ([]byte, error) {
+	if len(data)%uf2BlockSize != 0 {
+		return nil, fmt.Errorf("file size %d is not a multiple of %d", len(data), uf2BlockSize)
+	}
+	var image []byte
+	for offset := 0; offset < len(data); offset += uf2BlockSize {
+		block := data[offset : offset+uf2BlockSize]
+		if binary.LittleEndian.Uint32(block[0:]) != uf2MagicStart || binary.LittleEndian.Uint32(block[4:]) != uf2MagicNext || binary.LittleEndian.Uint32(block[508:]) != uf2MagicEnd {
+			return nil, fmt.Errorf("invalid block at offset 0x%x", offset)
+		}
+		flags := binary.LittleEndian.Uint32(block[8:])
+		address := binary.LittleEndian.Uint32(block[12:])
+		size := binary.LittleEndian.Uint32(block[16:])
+		if flags&uf2FlagNotMainFlash != 0 {
+			continue
+		}
+		if size > 476 {
+			return nil, fmt.Errorf("invalid payload size %d in block at offset 0x%x", size, offset)
+		}
+		start := address
+		if start >= flashBase {
+			start -= flashBase
+		}
+		if uint64(start)+uint64(size) > uint64(flashSize) {
+			return nil, fmt.Errorf("block at 0x%x does not fit in flash", address)
+		}
+		end := int(start + size)
+		if end > len(image) {
+			image = append(image, make([]byte, end-len(image))...)
+		}
+		copy(image[start:end], block[32:32+size])
+	}
+	return image, nil
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"debug/dwarf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// This file implements reading and writing variables of the firmware by name,
+// with the print and set monitor commands and control calls:
+//
+//	print counter             counter = 42
+//	print config.mode         config.mode = MODE_FAST
+//	set buffer[3] = 0x20
+//
+// Types come from the DWARF debug information. Without it, a variable in the
+// symbol table is read as an unsigned integer of its size.
+
+// Maximum number of array elements and string characters that are printed.
+const maxPrintElements = 200
+
+// A resolved variable expression: where the value is and its type.
+type varLocation struct {
+	Address uint32
+	Type    dwarf.Type
+}
+
+// Resolve an expression like "name", "name.field" or "name[3].field" to an
+// address and type.
+func (m *Machine) lookupVariable(expr string) (varLocation, error) {
+	expr = strings.TrimSpace(expr)
+	if m.debug == nil {
+		return varLocation{}, errors.New("no debug information, load an ELF file")
+	}
+	end := strings.IndexAny(expr, ".[")
+	if _, ok := m.debug.variables[expr]; ok {
+		end = -1 // a static variable like "counter.1"
+	} else if _, ok := m.debug.symbols[expr]; ok {
+		end = -1
+	}
+	if end < 0 {
+		end = len(expr)
+	}
+	name, rest := expr[:end], expr[end:]
+	var loc varLocation
+	if v, ok := m.debug.variables[name]; ok {
+		loc = varLocation{v.Address, v.Type}
+	} else if sym, ok := m.debug.symbols[name]; ok && sym.Size <= 8 {
+		size := int64(sym.Size)
+		if size == 0 {
+			size = 4
+		}
+		loc = varLocation{sym.Address, &dwarf.UintType{BasicType: dwarf.BasicType{CommonType: dwarf.CommonType{ByteSize: size, Name: "unsigned"}}}}
+	} else {
+		return loc, fmt.Errorf("unknown variable: %s", name)
+	}
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			field := rest[1:]
+			if i := strings.IndexAny(field, ".["); i >= 0 {
+				field, rest = field[:i], field[i:]
+			} else {
+				rest = ""
+			}
+			st, ok := underlyingType(loc.Type).(*dwarf.StructType)
+			if !ok {
+				return loc, fmt.Errorf("cannot get field %s of %s, it is not a struct or union", field, loc.Type)
+			}
+			found := false
+			for _, f := range st.Field {
+				if f.Name == field && f.BitSize != 0 {
+					return loc, fmt.Errorf("%s is a bitfield, which can only be printed as part of its struct", field)
+				}
+				if f.Name == field {
+					loc = varLocation{loc.Address + uint32(f.ByteOffset), f.Type}
+					found = true
+					break
+				}
+			}
+			if !found {
+				return loc, fmt.Errorf("%s has no field %s", st.String(), field)
+			}
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return loc, fmt.Errorf("missing ] in %s", expr)
+			}
+			index, err := strconv.ParseInt(strings.TrimSpace(rest[1:end]), 0, 64)
+			if err != nil {
+				return loc, fmt.Errorf("invalid index in %s", expr)
+			}
+			rest = rest[end+1:]
+			at, ok := underlyingType(loc.Type).(*dwarf.ArrayType)
+			if !ok {
+				return loc, fmt.Errorf("cannot index %s, it is not an array", loc.Type)
+			}
+			if index < 0 || (at.Count >= 0 && index >= at.Count) {
+				return loc, fmt.Errorf("index %d out of range in %s", index, expr)
+			}
+			loc = varLocation{loc.Address + uint32(index*at.Type.Size()), at.Type}
+		default:
+			return loc, fmt.Errorf("invalid expression: %s", expr)
+		}
+	}
+	return loc, nil
+}
+
+// Strip typedefs and qualifiers like const and volatile.
+func underlyingType(typ dwarf.Type) dwarf.Type {
+	for {
+		switch t := typ.(type) {
+		case *dwarf.TypedefType:
+			typ = t.Type
+		case *dwarf.QualType:
+			typ = t.Type
+		default:
+			return typ
+		}
+	}
+}
+
+// Return the value of a variable expression, formatted according to its type.
+func (m *Machine) printVariable(expr string) (string, error) {
+	loc, err := m.lookupVariable(expr)
+	if err != nil {
+		return "", err
+	}
+	size := loc.Type.Size()
+	if at, ok := underlyingType(loc.Type).(*dwarf.ArrayType); ok && at.Count > maxPrintElements {
+		size = maxPrintElements * at.Type.Size()
+	}
+	if size <= 0 {
+		return "", fmt.Errorf("%s has an unknown size", strings.TrimSpace(expr))
+	}
+	return formatValue(loc.Type, m.ReadMemory(int(loc.Address), int(size))), nil
+}
+
+// Format a value in memory of the given type, like GDB would.
+func formatValue(typ dwarf.Type, data []byte) string {
+	switch t := underlyingType(typ).(type) {
+	case *dwarf.BoolType:
+		return strconv.FormatBool(loadUint(data, t.ByteSize) != 0)
+	case *dwarf.CharType, *dwarf.UcharType:
+		c := loadUint(data, 1)
+		if _, ok := t.(*dwarf.CharType); ok && c >= 0x80 {
+			return fmt.Sprintf("%d", int8(c))
+		}
+		if c >= ' ' && c <= '~' {
+			return fmt.Sprintf("%d '%c'", c, rune(c))
+		}
+		return fmt.Sprintf("%d", c)
+	case *dwarf.IntType:
+		return strconv.FormatInt(loadInt(data, t.ByteSize), 10)
+	case *dwarf.UintType:
+		return strconv.FormatUint(loadUint(data, t.ByteSize), 10)
+	case *dwarf.FloatType:
+		if t.ByteSize == 4 {
+			return fmt.Sprint(math.Float32frombits(uint32(loadUint(data, 4))))
+		}
+		return fmt.Sprint(math.Float64frombits(loadUint(data, 8)))
+	case *dwarf.PtrType:
+		return fmt.Sprintf("0x%x", loadUint(data, 4))
+	case *dwarf.EnumType:
+		value := loadInt(data, t.ByteSize)
+		for _, v := range t.Val {
+			if v.Val == value {
+				return v.Name
+			}
+		}
+		return strconv.FormatInt(value, 10)
+	case *dwarf.StructType:
+		var fields []string
+		for _, f := range t.Field {
+			size := f.Type.Size()
+			if f.ByteOffset+size > int64(len(data)) || size <= 0 {
+				continue
+			}
+			value := data[f.ByteOffset : f.ByteOffset+size]
+			var s string
+			if f.BitSize != 0 {
+				s = strconv.FormatUint(loadBitfield(data, f), 10)
+			} else {
+				s = formatValue(f.Type, value)
+			}
+			fields = append(fields, f.Name+" = "+s)
+		}
+		return "{" + strings.Join(fields, ", ") + "}"
+	case *dwarf.ArrayType:
+		elemSize := t.Type.Size()
+		if elemSize <= 0 {
+			return "[...]"
+		}
+		count := int64(len(data)) / elemSize
+		if _, ok := underlyingType(t.Type).(*dwarf.CharType); ok {
+			s := data[:count]
+			if i := strings.IndexByte(string(s), 0); i >= 0 {
+				s = s[:i]
+			}
+			return strconv.Quote(string(s))
+		}
+		var elements []string
+		for i := int64(0); i < count; i++ {
+			elements = append(elements, formatValue(t.Type, data[i*elemSize:(i+1)*elemSize]))
+		}
+		if t.Count < 0 || t.Count > count {
+			elements = append(elements, "...")
+		}
+		return "[" + strings.Join(elements, ", ") + "]"
+	}
+	return fmt.Sprintf("%x", data)
+}
+
+// Load a little-endian unsigned integer of the given size.
+func loadUint(data []byte, size int64) uint64 {
+	var buf [8]byte
+	copy(buf[:], data[:size])
+	return binary.LittleEndian.Uint64(buf[:])
+}
+
+// Load a little-endian signed integer of the given size.
+func loadInt(data []byte, size int64) int64 {
+	bits := 64 - uint(size)*8
+	return int64(loadUint(data, size)<<bits) >> bits
+}
+
+// Load a bitfield of a struct.
+func loadBitfield(data []byte, f *dwarf.StructField) uint64 {
+	offset := f.DataBitOffset
+	if f.ByteSize != 0 {
+		// DWARF 2 and 3 count from the most significant bit of the storage
+		// unit of the given size.
+		offset = f.ByteOffset*8 + f.ByteSize*8 - f.BitOffset - f.BitSize
+	}
+	var value uint64
+	for i := int64(0); i < f.BitSize; i++ {
+		bit := offset + i
+		if data[bit/8]&(1<<(bit%8)) != 0 {
+			value |= 1 << i
+		}
+	}
+	return value
+}
+
+// Set a variable to a value, from an assignment like "counter = 5". Only
+// variables of a basic type (integers, floats, booleans, enums and pointers)
+// can be set.
+func (m *Machine) setVariable(assignment string) error {
+	expr, valueText, ok := strings.Cut(assignment, "=")
+	if !ok {
+		return errors.New("expected VARIABLE = VALUE")
+	}
+	loc, err := m.lookupVariable(expr)
+	if err != nil {
+		return err
+	}
+	valueText = strings.TrimSpace(valueText)
+	var value uint64
+	size := loc.Type.Size()
+	switch t := underlyingType(loc.Type).(type) {
+	case *dwarf.BoolType:
+		b, err := strconv.ParseBool(valueText)
+		if err != nil {
+			return fmt.Errorf("invalid boolean: %s", valueText)
+		}
+		if b {
+			value = 1
+		}
+	case *dwarf.FloatType:
+		f, err := strconv.ParseFloat(valueText, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number: %s", valueText)
+		}
+		if t.ByteSize == 4 {
+			value = uint64(math.Float32bits(float32(f)))
+		} else {
+			value = math.Float64bits(f)
+		}
+	case *dwarf.EnumType:
+		found := false
+		for _, v := range t.Val {
+			if v.Name == valueText {
+				value = uint64(v.Val)
+				found = true
+			}
+		}
+		if !found {
+			value, err = parseIntValue(valueText, size, true)
+			if err != nil {
+				return err
+			}
+		}
+	case *dwarf.IntType, *dwarf.CharType:
+		value, err = parseIntValue(valueText, size, true)
+		if err != nil {
+			return err
+		}
+	case *dwarf.UintType, *dwarf.UcharType, *dwarf.PtrType:
+		value, err = parseIntValue(valueText, size, false)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("cannot set %s of type %s, only basic types can be set", strings.TrimSpace(expr), loc.Type)
+	}
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], value)
+	m.WriteMemory(int(loc.Address), buf[:size])
+	return nil
+}
+
+// Parse an integer (or a character like 'A') that must fit in size bytes.
+func parseIntValue(s string, size int64, signed bool) (uint64, error) {
+	if len(s) == 3 && s[0] == '\'' && s[2] == '\'' {
+		return uint64(s[1]), nil
+	}
+	bits := int(size * 8)
+	if signed {
+		n, err := strconv.ParseInt(s, 0, bits)
+		if err != nil {
+			// Also accept the unsigned notation, like 0xffffffff.
+			u, uerr := strconv.ParseUint(s, 0, bits)
+			if uerr != nil {
+				return 0, fmt.Errorf("invalid value for a %d-bit integer: %s", bits, s)
+			}
+			return u, nil
+		}
+		return uint64(n) & (math.MaxUint64 >> (64 - bits)), nil
+	}
+	n, err := strconv.ParseUint(s, 0, bits)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value for a %d-bit unsigned integer: %s", bits, s)
+	}
+	return n, nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"sync"
+)
+
+// #include "machine.h"
+import "C"
+
+// This file implements watch expressions: variables in memory that are
+// printed every time their value changes, without halting the firmware. They
+// are set with -watch or the watch monitor command, like
+// "watch 0x20001234 u32 as ticks", and print lines like:
+//
+//	0.012345s: ticks = 42 (was 41, PC=0x1a4)
+//
+// The time is the emulated time since reset. Only stores by the CPU are seen,
+// not those by DMA.
+
+// A watched value in memory.
+type Watch struct {
+	ID      int
+	Address uint32
+	Type    string // one of watchTypes: unsigned, signed, hexadecimal or float
+	Name    string
+	value   []byte // the value when it was last printed
+}
+
+// Size in bytes of each type of a watched value.
+var watchTypes = map[string]int{
+	"u8": 1, "u16": 2, "u32": 4, "u64": 8,
+	"i8": 1, "i16": 2, "i32": 4, "i64": 8,
+	"x8": 1, "x16": 2, "x32": 4, "x64": 8,
+	"f32": 4, "f64": 8,
+}
+
+type watchManager struct {
+	m       *Machine
+	output  io.Writer
+	ring    bool // whether the new values are recorded in the trace ring
+	lock    sync.Mutex
+	lastID  int
+	watches []*Watch // sorted by ID
+}
+
+var watchManagers machineMap[*watchManager]
+
+func newWatchManager(m *Machine) *watchManager {
+	wm := &watchManager{m: m, output: os.Stderr}
+	wm.ring = attachTraceRing(m.machine, func(event *C.trace_event_t) {
+		if event._type == C.TRACE_WATCH {
+			wm.changed(event)
+		}
+	}, nil)
+	watchManagers.set(m.machine, wm)
+	return wm
+}
+
+// Parse a watch expression: ADDR [TYPE] [as NAME]. The address can be a symbol,
+// in which case the type defaults to an unsigned integer of the size of the
+// symbol.
+func parseWatch(spec string, symbols map[string]symbol) (Watch, error) {
+	var w Watch
+	fields := strings.Fields(spec)
+	if len(fields) >= 2 && fields[len(fields)-2] == "as" {
+		w.Name = fields[len(fields)-1]
+		fields = fields[:len(fields)-2]
+	}
+	if len(fields) == 0 || len(fields) > 2 {
+		return w, fmt.Errorf("invalid watch %#v, expected ADDR [TYPE] [as NAME]", spec)
+	}
+	w.Type = "u32"
+	if sym, ok := symbols[fields[0]]; ok {
+		w.Address = sym.Address
+		switch sym.Size {
+		case 1:
+			w.Type = "u8"
+		case 2:
+			w.Type = "u16"
+		case 8:
+			w.Type = "u64"
+		}
+	} else {
+		address, err := parseUint32(fields[0])
+		if err != nil {
+			return w, fmt.Errorf("unknown symbol or address: %s", fields[0])
+		}
+		w.Address = address
+	}
+	if len(fields) == 2 {
+		if _, ok := watchTypes[fields[1]]; !ok {
+			return w, fmt.Errorf("unknown type %s, expected u8..u64, i8..i64, x8..x64, f32 or f64", fields[1])
+		}
+		w.Type = fields[1]
+	}
+	if w.Name == "" {
+		w.Name = fields[0]
+	}
+	return w, nil
+}
+
+// Add a watch and return it with its ID set. Its current value is printed.
+func (wm *watchManager) Add(w Watch) (Watch, error) {
+	wm.lock.Lock()
+	defer wm.lock.Unlock()
+	wm.lastID++
+	w.ID = wm.lastID
+	w.value = wm.m.ReadMemory(int(w.Address), watchTypes[w.Type])
+	stored := w
+	wm.watches = append(wm.watches, &stored)
+	if err := wm.update(); err != nil {
+		wm.watches = wm.watches[:len(wm.watches)-1]
+		return w, err
+	}
+	wm.print(&stored, nil, 0, uint64(wm.m.machine.stats.cycles))
+	return w, nil
+}
+
+// Delete the watch with the given ID.
+func (wm *watchManager) Delete(id int) error {
+	wm.lock.Lock()
+	defer wm.lock.Unlock()
+	for i, w := range wm.watches {
+		if w.ID == id {
+			wm.watches = append(wm.watches[:i], wm.watches[i+1:]...)
+			return wm.update()
+		}
+	}
+	return fmt.Errorf("no watch %d", id)
+}
+
+// Return a copy of all watches, sorted by ID.
+func (wm *watchManager) List() []Watch {
+	wm.lock.Lock()
+	defer wm.lock.Unlock()
+	list := make([]Watch, len(wm.watches))
+	for i, w := range wm.watches {
+		list[i] = *w
+	}
+	return list
+}
+
+// Pass the watched ranges to the machine.
+func (wm *watchManager) update() error {
+	if !wm.ring {
+		return errors.New("cannot allocate the trace ring for watches")
+	}
+	address := make([]C.uint32_t, len(wm.watches)+1)
+	size := make([]C.uint32_t, len(wm.watches)+1)
+	for i, w := range wm.watches {
+		address[i] = C.uint32_t(w.Address)
+		size[i] = C.uint32_t(watchTypes[w.Type])
+	}
+	if !C.machine_set_watches(wm.m.machine, C.watch_t(C.machine_trace_ring_watch), &address[0], &size[0], C.size_t(len(wm.watches))) {
+		return fmt.Errorf("at most %d values can be watched", C.MACHINE_WATCHES)
+	}
+	return nil
+}
+
+// Print the value of a watch at the given cycle. It is printed as a change,
+// with the instruction that changed it, if old is not nil.
+func (wm *watchManager) print(w *Watch, old []byte, pc uint32, cycles uint64) {
+	seconds := float64(cycles) / float64(wm.m.machine.clock)
+	line := fmt.Sprintf("%.6fs: %s = %s", seconds, w.Name, formatWatchValue(w.Type, w.value))
+	if old != nil {
+		line += fmt.Sprintf(" (was %s, PC=0x%x)", formatWatchValue(w.Type, old), pc)
+	}
+	fmt.Fprintln(wm.output, line)
+}
+
+// Format a value in memory as the given type.
+func formatWatchValue(typ string, data []byte) string {
+	var n uint64
+	for i := len(data) - 1; i >= 0; i-- {
+		n = n<<8 | uint64(data[i])
+	}
+	bits := uint(len(data) * 8)
+	switch typ {
+	case "i8", "i16", "i32", "i64":
+		return fmt.Sprint(int64(n<<(64-bits)) >> (64 - bits))
+	case "x8", "x16", "x32", "x64":
+		return fmt.Sprintf("0x%x", n)
+	case "f32":
+		return fmt.Sprint(math.Float32frombits(binary.LittleEndian.Uint32(data)))
+	case "f64":
+		return fmt.Sprint(math.Float64frombits(binary.LittleEndian.Uint64(data)))
+	default:
+		return fmt.Sprint(n)
+	}
+}
+
+// Print the watches of a range that was stored to, from the trace ring, if
+// the value changed.
+func (wm *watchManager) changed(event *C.trace_event_t) {
+	wm.lock.Lock()
+	defer wm.lock.Unlock()
+	var data [8]byte
+	binary.LittleEndian.PutUint64(data[:], uint64(event.data))
+	for _, w := range wm.watches {
+		if w.Address != uint32(event.address) || len(w.value) != int(event.value) {
+			continue
+		}
+		value := data[:len(w.value)]
+		if string(value) == string(w.value) {
+			continue
+		}
+		old := w.value
+		w.value = append([]byte(nil), value...)
+		wm.print(w, old, uint32(event.pc), uint64(event.cycle))
+	}
+}
@@ -29,6 +29,9 @@ var importObject = {
     _terminal_getchar: function() {
       throw 'TODO: terminal_getchar';
     },
+    _terminal_poll: function() {
+      return 0; // no input yet
+    },
     _terminal_putchar: function(c) {
       document.querySelector('#terminal').textContent += String.fromCharCode(c);
     },
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unsafe"
+)
+
+// #include "machine.h"
+// void ws2812Frame(machine_t *machine, uint8_t *data, uint32_t len);
+import "C"
+
+// This file shows the colors of WS2812 (NeoPixel) LEDs. The C core decodes
+// the waveform on their data pin, whether the firmware bit-bangs it or an
+// nRF52 PWM peripheral generates it with EasyDMA, and hands over every frame.
+// Frames are shown in the terminal as colored blocks, or written as a JSON
+// object per line:
+//
+//	{"time_us": 10250, "leds": ["#ff0000", "#00ff00"]}
+
+// Where the frames of the LEDs of a machine go.
+type ws2812Output struct {
+	order string // byte order: grb (WS2812, SK6812), rgb (WS2811) or grbw (SK6812 RGBW)
+	w     io.Writer
+	json  bool
+	last  string // the last frame shown in the terminal
+}
+
+var ws2812Outputs machineMap[*ws2812Output]
+
+// Attach a strip of WS2812 LEDs to the given data pin. The output is "term"
+// for the terminal, or json:PATH.
+func attachWS2812(m *Machine, pin, format, output string) error {
+	p, err := parseGPIOPin(pin)
+	if err != nil {
+		return err
+	}
+	if format != "grb" && format != "rgb" && format != "grbw" {
+		return fmt.Errorf("unknown format %q, expected grb, rgb or grbw", format)
+	}
+	out := &ws2812Output{order: format, w: os.Stderr}
+	switch {
+	case output == "term":
+	case output == "json:-":
+		out.w, out.json = os.Stdout, true
+	case strings.HasPrefix(output, "json:"):
+		f, err := os.Create(output[len("json:"):])
+		if err != nil {
+			return err
+		}
+		out.w, out.json = f, true
+	default:
+		return fmt.Errorf("unknown output %q, expected term or json:PATH", output)
+	}
+	ws2812Outputs.set(m.machine, out)
+	C.machine_set_ws2812(m.machine, C.ws2812_frame_t(C.ws2812Frame), C.int32_t(p))
+	return nil
+}
+
+// Convert a frame to the red, green, blue and white value of each LED.
+func (out *ws2812Output) pixels(data []byte) [][4]byte {
+	var pixels [][4]byte
+	size := len(out.order)
+	for i := 0; i+size <= len(data); i += size {
+		var pixel [4]byte
+		for j, c := range out.order {
+			pixel[strings.IndexRune("rgbw", c)] = data[i+j]
+		}
+		pixels = append(pixels, pixel)
+	}
+	return pixels
+}
+
+// Show a frame of the LEDs, for the C core.
+//
+//export ws2812Frame
+func ws2812Frame(machine *C.machine_t, data *C.uint8_t, length C.uint32_t) {
+	out := ws2812Outputs.get(machine)
+	pixels := out.pixels(C.GoBytes(unsafe.Pointer(data), C.int(length)))
+	if out.json {
+		leds := []string{}
+		for _, pixel := range pixels {
+			leds = append(leds, fmt.Sprintf("#%x", pixel[:len(out.order)]))
+		}
+		line, _ := json.Marshal(struct {
+			Time uint64   `json:"time_us"`
+			LEDs []string `json:"leds"`
+		}{uint64(C.machine_time_us(machine)), leds})
+		fmt.Fprintf(out.w, "%s\n", line)
+		return
+	}
+
+	// Only show changes, so that a static pattern that is refreshed
+	// doesn't fill the terminal.
+	var blocks strings.Builder
+	for _, pixel := range pixels {
+		// Mix the white channel in, as terminals can't show it separately.
+		var rgb [3]int
+		for i := range rgb {
+			rgb[i] = int(pixel[i]) + int(pixel[3])
+			if rgb[i] > 255 {
+				rgb[i] = 255
+			}
+		}
+		fmt.Fprintf(&blocks, "\x1b[38;2;%d;%d;%dm██", rgb[0], rgb[1], rgb[2])
+	}
+	if blocks.String() == out.last {
+		return
+	}
+	out.last = blocks.String()
+	fmt.Fprintf(out.w, "\r\nws2812 (%d LEDs): %s\x1b[0m\r\n", len(pixels), out.last)
+}